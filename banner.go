@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// bannerData is what banner templates have to work with, as in
+// {{.URL}} or {{if .CopilotURL}}...{{end}}.
+type bannerData struct {
+	URL        string
+	CopilotURL string
+	Expires    string
+	Server     string
+}
+
+// sessionBanner renders the configured banner, read from banner_file if
+// there is one. Banners from before templates used a bare {{URL}}, which
+// still works.
+func sessionBanner(data bannerData) string {
+	text := settings().Banner
+	if file := settings().BannerFile; file != "" {
+		if contents, err := ioutil.ReadFile(file); err != nil {
+			serverLog.Warn("unable to read banner file", "error", err)
+		} else {
+			text = string(contents)
+		}
+	}
+	t, err := template.New("banner").Parse(strings.Replace(text, "{{URL}}", "{{.URL}}", -1))
+	if err != nil {
+		serverLog.Warn("invalid banner", "error", err)
+		t = template.Must(template.New("banner").Parse(banner))
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		serverLog.Warn("invalid banner", "error", err)
+	}
+	return buf.String()
+}
+
+// publicUrl is the address of the daemon as users should see it: the
+// configured public_url, or else what a trusted proxy in front of us says
+// with X-Forwarded-Proto and X-Forwarded-Host, or else the request itself.
+// Anyone else could point the links in banners at a server of their own.
+func publicUrl(r *http.Request) string {
+	if public := settings().PublicUrl; public != "" {
+		return strings.TrimSuffix(public, "/")
+	}
+	if r == nil || r.Host == "" {
+		url := baseUrl("http")
+		url = strings.TrimSuffix(url, ":443")
+		return strings.TrimSuffix(url, ":80")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if fromTrustedProxy(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host = strings.TrimSuffix(host, map[string]string{"http": ":80", "https": ":443"}[scheme])
+	return scheme + "://" + host
+}
+
+func serverName(r *http.Request) string {
+	if name := settings().Name; name != "" {
+		return name
+	}
+	return strings.SplitN(publicUrl(r), "://", 2)[1]
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func withConfig(t *testing.T, c *config) {
+	configLock.Lock()
+	old := currentConfig
+	currentConfig = c
+	configLock.Unlock()
+	t.Cleanup(func() {
+		configLock.Lock()
+		currentConfig = old
+		configLock.Unlock()
+	})
+}
+
+func TestPublicUrlTrustsOnlyProxies(t *testing.T) {
+	tests := []struct {
+		remote, public string
+		want           string
+	}{
+		{"10.0.0.5:4000", "", "https://termshare.example.com"},
+		{"203.0.113.9:4000", "", "http://internal:8080"},
+		{"203.0.113.9:4000", "https://share.example.org/", "https://share.example.org"},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.TrustedProxies = []string{"10.0.0.0/8"}
+		c.PublicUrl = test.public
+		withConfig(t, c)
+		r := httptest.NewRequest("GET", "http://internal:8080/", nil)
+		r.RemoteAddr = test.remote
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "termshare.example.com")
+		if got := publicUrl(r); got != test.want {
+			t.Errorf("from %s with public_url %q: %q, want %q", test.remote, test.public, got, test.want)
+		}
+	}
+}
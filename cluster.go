@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A daemon runs alone or as one node of a cluster behind a load balancer.
+// Either way a session lives on the node its pilot connected to. The
+// directory says which node that is, and the bus carries viewers and
+// copilots that land on any other node over to it.
+
+type directory interface {
+	// Register claims name for a session on node, or refreshes the claim.
+	Register(name, node string) error
+	Lookup(name string) (node string, err error)
+	Unregister(name, node string)
+}
+
+type bus interface {
+	// Relay serves a request for a session whose pilot is on node.
+	Relay(w http.ResponseWriter, r *http.Request, node string)
+}
+
+var errSessionTaken = errors.New("session already exists")
+var errSessionNotFound = errors.New("session not found")
+
+// Claims that aren't refreshed expire, so sessions of a node that died
+// don't hold on to their names.
+const (
+	directoryTTL     = 90 * time.Second
+	directoryRefresh = 30 * time.Second
+)
+
+type directoryEntry struct {
+	node    string
+	expires time.Time
+}
+
+type memoryDirectory struct {
+	sync.Mutex
+	entries map[string]directoryEntry
+}
+
+func newMemoryDirectory() *memoryDirectory {
+	return &memoryDirectory{entries: make(map[string]directoryEntry)}
+}
+
+func (d *memoryDirectory) Register(name, node string) error {
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.entries[name]; ok && e.node != node && time.Now().Before(e.expires) {
+		return errSessionTaken
+	}
+	d.entries[name] = directoryEntry{node: node, expires: time.Now().Add(directoryTTL)}
+	return nil
+}
+
+func (d *memoryDirectory) Lookup(name string) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	e, ok := d.entries[name]
+	if !ok || time.Now().After(e.expires) {
+		return "", errSessionNotFound
+	}
+	return e.node, nil
+}
+
+func (d *memoryDirectory) Unregister(name, node string) {
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.entries[name]; ok && e.node == node {
+		delete(d.entries, name)
+	}
+}
+
+// localBus is the bus of a daemon running alone. Every session is in its
+// own sessions map, so there is never anywhere else to relay to.
+type localBus struct{}
+
+func (localBus) Relay(w http.ResponseWriter, r *http.Request, node string) {
+	refuse(w, http.StatusNotFound, errNotFound, errSessionNotFound.Error())
+}
+
+// clusterDirectory spreads the directory over the nodes of a cluster. Each
+// name has a home node, picked by rendezvous hashing, that keeps its entry,
+// so claiming a name is decided in one place without any coordination.
+type clusterDirectory struct {
+	self   string
+	nodes  []string
+	secret string
+	local  *memoryDirectory
+}
+
+func newClusterDirectory(self string, peers []string, secret string) *clusterDirectory {
+	nodes := []string{self}
+	for _, p := range peers {
+		if p = strings.TrimSuffix(p, "/"); p != "" && p != self {
+			nodes = append(nodes, p)
+		}
+	}
+	sort.Strings(nodes)
+	return &clusterDirectory{self: self, nodes: nodes, secret: secret, local: newMemoryDirectory()}
+}
+
+func (d *clusterDirectory) home(name string) (home string) {
+	var best uint64
+	for _, node := range d.nodes {
+		h := fnv.New64a()
+		io.WriteString(h, node+"/"+name)
+		if score := mix(h.Sum64()); home == "" || score > best {
+			home, best = node, score
+		}
+	}
+	return
+}
+
+// mix spreads out the bits of an FNV hash, whose top bits hardly change
+// with the last few bytes hashed, so names are shared out evenly rather
+// than nearly all going to one node. It's the murmur3 finalizer.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (d *clusterDirectory) call(method, name, node string) (*http.Response, error) {
+	home := d.home(name)
+	target := home + "/_cluster/directory/" + url.QueryEscape(name) + "?" + url.Values{"node": {node}}.Encode()
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Termshare-Cluster-Secret", d.secret)
+	return clusterClient.Do(req)
+}
+
+var clusterClient = &http.Client{Timeout: 5 * time.Second}
+
+func (d *clusterDirectory) Register(name, node string) error {
+	if d.home(name) == d.self {
+		return d.local.Register(name, node)
+	}
+	resp, err := d.call("PUT", name, node)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errSessionTaken
+	}
+	return errors.New("directory: unexpected status " + resp.Status)
+}
+
+func (d *clusterDirectory) Lookup(name string) (string, error) {
+	if d.home(name) == d.self {
+		return d.local.Lookup(name)
+	}
+	resp, err := d.call("GET", name, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errSessionNotFound
+	}
+	node, err := ioutil.ReadAll(resp.Body)
+	return string(node), err
+}
+
+func (d *clusterDirectory) Unregister(name, node string) {
+	if d.home(name) == d.self {
+		d.local.Unregister(name, node)
+		return
+	}
+	if resp, err := d.call("DELETE", name, node); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// ServeHTTP answers other nodes asking after the names this node is home
+// to, at /_cluster/directory/<name>.
+func (d *clusterDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get("X-Termshare-Cluster-Secret")
+	if d.secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(d.secret)) != 1 {
+		writeError(w, http.StatusForbidden, errForbidden, "wrong cluster secret")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/_cluster/directory/")
+	node := r.URL.Query().Get("node")
+	switch r.Method {
+	case "GET":
+		node, err := d.local.Lookup(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, errNotFound, err.Error())
+			return
+		}
+		w.Write([]byte(node))
+	case "PUT":
+		if err := d.local.Register(name, node); err != nil {
+			writeError(w, http.StatusConflict, errConflict, err.Error())
+		}
+	case "DELETE":
+		d.local.Unregister(name, node)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// httpBus relays requests to the node with the pilot as if they had gone
+// there in the first place: websockets frame by frame, anything else as a
+// streamed response.
+type httpBus struct{}
+
+func (httpBus) Relay(w http.ResponseWriter, r *http.Request, node string) {
+	header := http.Header{}
+	for _, h := range []string{"User-Agent", "Accept", "X-Request-Id"} {
+		if v := r.Header.Get(h); v != "" {
+			header.Set(h, v)
+		}
+	}
+	forwarded, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	header.Set("X-Forwarded-For", forwarded)
+	target := node + r.URL.RequestURI()
+
+	if r.Header.Get("Upgrade") == "websocket" {
+		header.Set("Origin", node)
+		upstream, resp, err := websocket.DefaultDialer.DialContext(r.Context(), "ws"+strings.TrimPrefix(target, "http"), header)
+		if err != nil {
+			if resp != nil {
+				// The node turned the websocket away, so pass on why.
+				for k, v := range resp.Header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(resp.StatusCode)
+				io.Copy(w, resp.Body)
+				return
+			}
+			writeError(w, http.StatusBadGateway, errUnavailable, "unable to reach the session's node")
+			return
+		}
+		conn, err := acceptConn(w, r)
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		down, up := newFramedConn(conn, true), newFramedConn(upstream, true)
+		defer down.Close()
+		defer up.Close()
+		done := make(chan struct{}, 2)
+		go func() { relayRawFrames(down, up); done <- struct{}{} }()
+		go func() { relayRawFrames(up, down); done <- struct{}{} }()
+		<-done
+		return
+	}
+
+	// Tied to the viewer's request, so it's cancelled when they go.
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errUnavailable, err.Error())
+		return
+	}
+	req.Header = header
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errUnavailable, "unable to reach the session's node")
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(FlushWriter(w), resp.Body)
+}
+
+// relayRawFrames copies messages between websockets keeping their type, so
+// control messages stay text and data stays binary, and passes on why the
+// connection was closed.
+func relayRawFrames(dst, src *framedConn) error {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			if e, ok := err.(*websocket.CloseError); ok && e.Code != websocket.CloseAbnormalClosure &&
+				e.Code != websocket.CloseNoStatusReceived {
+				dst.CloseWith(e.Code, e.Text)
+			}
+			return err
+		}
+		src.SetReadDeadline(time.Now().Add(src.timeout))
+		if err := dst.writeMessage(messageType, data); err != nil {
+			return err
+		}
+	}
+}
+
+// cluster is how this daemon finds and reaches sessions: on its own with
+// everything in memory, or with peers when cluster.peers is configured.
+type cluster struct {
+	Self      string
+	Directory directory
+	Bus       bus
+}
+
+func newCluster(c *config) *cluster {
+	if len(c.Cluster.Peers) == 0 {
+		return &cluster{Self: "local", Directory: newMemoryDirectory(), Bus: localBus{}}
+	}
+	self := strings.TrimSuffix(c.Cluster.Node, "/")
+	if self == "" {
+		fatal(exitUsage, "cluster.node must be set to this node's url when cluster.peers are")
+	}
+	// The directory is served on the public port, so without a secret
+	// anyone could claim or drop session names.
+	if c.Cluster.Secret == "" {
+		fatal(exitUsage, "cluster.secret must be set when cluster.peers are")
+	}
+	dir := newClusterDirectory(self, c.Cluster.Peers, c.Cluster.Secret)
+	http.Handle("/_cluster/directory/", dir)
+	return &cluster{Self: self, Directory: dir, Bus: httpBus{}}
+}
+
+// keepRegistered refreshes the directory entries of this node's sessions
+// before they expire.
+func (c *cluster) keepRegistered(s *sessions) {
+	for range time.Tick(directoryRefresh) {
+		for _, session := range s.All() {
+			if err := c.Directory.Register(session.Name, c.Self); err != nil {
+				serverLog.Warn("unable to refresh session in directory", "session", session.Name, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClusterDirectoryNeedsSecret(t *testing.T) {
+	tests := []struct {
+		secret, sent string
+		status       int
+	}{
+		{"s3cret", "s3cret", http.StatusOK},
+		{"s3cret", "", http.StatusForbidden},
+		{"s3cret", "s3cre", http.StatusForbidden},
+		{"s3cret", "s3cret!", http.StatusForbidden},
+		{"", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		d := newClusterDirectory("http://a", []string{"http://b"}, test.secret)
+		req := httptest.NewRequest("PUT", "/_cluster/directory/brave-otter?node=http%3A%2F%2Fb", nil)
+		req.Header.Set("X-Termshare-Cluster-Secret", test.sent)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("secret %q, sent %q: status %d, want %d", test.secret, test.sent, w.Code, test.status)
+		}
+		if _, err := d.local.Lookup("brave-otter"); (err == nil) != (test.status == http.StatusOK) {
+			t.Errorf("secret %q, sent %q: lookup error %v", test.secret, test.sent, err)
+		}
+	}
+}
+
+// clusterNode is a daemon in a test cluster, cut down to its directory and
+// bus. Sessions it has itself are served by pilot.
+type clusterNode struct {
+	*httptest.Server
+	dir   *clusterDirectory
+	pilot http.HandlerFunc
+}
+
+func (n *clusterNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/_cluster/directory/") {
+		n.dir.ServeHTTP(w, r)
+		return
+	}
+	node, err := n.dir.Lookup(strings.TrimPrefix(r.URL.Path, "/"))
+	switch {
+	case err != nil:
+		writeError(w, http.StatusNotFound, errNotFound, err.Error())
+	case node == n.URL:
+		n.pilot(w, r)
+	default:
+		httpBus{}.Relay(w, r, node)
+	}
+}
+
+// testCluster starts nodes that know each other as peers. Names are
+// registered with the directory directly, standing in for pilots.
+func testCluster(t *testing.T, count int) []*clusterNode {
+	nodes := make([]*clusterNode, count)
+	var urls []string
+	for i := range nodes {
+		nodes[i] = &clusterNode{}
+		nodes[i].Server = httptest.NewServer(nodes[i])
+		t.Cleanup(nodes[i].Close)
+		urls = append(urls, nodes[i].URL)
+	}
+	for _, n := range nodes {
+		n.dir = newClusterDirectory(n.URL, urls, "s3cret")
+	}
+	return nodes
+}
+
+// nameHomedOn finds a session name whose directory entry is kept by home,
+// so a test can be sure it goes over the network.
+func nameHomedOn(t *testing.T, home *clusterNode) string {
+	for i := 0; i < 1000; i++ {
+		if name := "brave-otter-" + strconv.Itoa(i); home.dir.home(name) == home.URL {
+			return name
+		}
+	}
+	t.Fatal("no name homed on " + home.URL)
+	return ""
+}
+
+func TestClusterDirectoryAcrossNodes(t *testing.T) {
+	nodes := testCluster(t, 2)
+	a, b := nodes[0], nodes[1]
+	// Kept by b, so a has to ask it, and the other way around.
+	for _, home := range nodes {
+		name := nameHomedOn(t, home)
+		if err := a.dir.Register(name, a.URL); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := b.dir.Register(name, b.URL); err != errSessionTaken {
+			t.Errorf("%s: b claimed a name a has, error %v", name, err)
+		}
+		for _, n := range nodes {
+			if node, err := n.dir.Lookup(name); err != nil || node != a.URL {
+				t.Errorf("%s: lookup on %s found %q, %v, want %s", name, n.URL, node, err, a.URL)
+			}
+		}
+		a.dir.Unregister(name, a.URL)
+		if err := b.dir.Register(name, b.URL); err != nil {
+			t.Errorf("%s: b couldn't claim the name once a let it go: %v", name, err)
+		}
+	}
+}
+
+func TestClusterRelaysViewers(t *testing.T) {
+	nodes := testCluster(t, 2)
+	a, b := nodes[0], nodes[1]
+	a.pilot = func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			w.Write([]byte("$ ls\r\n"))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello"}`))
+		if _, data, err := conn.ReadMessage(); err == nil {
+			conn.WriteMessage(websocket.BinaryMessage, append([]byte("typed "), data...))
+		}
+	}
+	b.pilot = func(w http.ResponseWriter, r *http.Request) {
+		t.Error("b served a session it doesn't have")
+	}
+	name := nameHomedOn(t, b)
+	if err := a.dir.Register(name, a.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(b.URL + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "$ ls\r\n" {
+		t.Errorf("viewer on b got %q", body)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(b.URL, "http")+"/"+name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messageType, data, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage || string(data) != `{"type":"hello"}` {
+		t.Fatalf("copilot on b got %d %q, %v, want the hello as text", messageType, data, err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ls"))
+	messageType, data, err = conn.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage || string(data) != "typed ls" {
+		t.Errorf("copilot on b got %d %q, %v, want its keys back", messageType, data, err)
+	}
+}
+
+func TestClusterSharesOutNames(t *testing.T) {
+	d := newClusterDirectory("http://127.0.0.1:35243", []string{"http://127.0.0.1:42161", "http://127.0.0.1:42162"}, "s3cret")
+	homes := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		homes[d.home("brave-otter-"+strconv.Itoa(i))]++
+	}
+	for _, node := range d.nodes {
+		if homes[node] < 800 {
+			t.Errorf("%s is home to %d of 3000 names", node, homes[node])
+		}
+	}
+}
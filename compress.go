@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// With deflate negotiated, data messages are compressed the way
+// permessage-deflate (RFC 7692) does it: one raw deflate stream for each
+// direction of a connection, flushed at the end of every message with the
+// 00 00 ff ff the flush ends in left off. Each side starts compressing
+// what it sends once it has said hello.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// Put back on the end of each message before inflating it, along with an
+// empty final block so the message reads to a clean end.
+var inflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Deflate looks back at most this far, so it's all the history the
+// receiving end needs to keep.
+const deflateWindow = 32 << 10
+
+type deflater struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newDeflater() *deflater {
+	d := &deflater{}
+	d.w, _ = flate.NewWriter(&d.buf, flate.BestSpeed)
+	return d
+}
+
+func (d *deflater) compress(p []byte) []byte {
+	d.buf.Reset()
+	d.w.Write(p)
+	d.w.Flush()
+	return append([]byte(nil), bytes.TrimSuffix(d.buf.Bytes(), deflateTail)...)
+}
+
+type inflater struct {
+	r       io.ReadCloser
+	history []byte
+}
+
+var errInflatedTooBig = errors.New("message too big once inflated")
+
+// inflate decompresses a message, which is held to the same limit on size
+// as messages that aren't compressed, so a small message can't inflate to
+// fill up memory.
+func (in *inflater) inflate(p []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(inflateTail))
+	if in.r == nil {
+		in.r = flate.NewReaderDict(src, in.history)
+	} else {
+		in.r.(flate.Resetter).Reset(src, in.history)
+	}
+	var r io.Reader = in.r
+	max := settings().Limits.MaxMessageSize
+	if max > 0 {
+		r = io.LimitReader(in.r, int64(max)+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(data) > max {
+		return nil, errInflatedTooBig
+	}
+	in.history = append(in.history, data...)
+	if len(in.history) > deflateWindow {
+		in.history = append([]byte(nil), in.history[len(in.history)-deflateWindow:]...)
+	}
+	return data, nil
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipFlushWriter compresses a streamed response, flushing the gzip stream
+// and the connection after every write so output isn't held back.
+type gzipFlushWriter struct {
+	gz *gzip.Writer
+	fw flushWriter
+}
+
+func newGzipFlushWriter(w http.ResponseWriter) *gzipFlushWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	fw := FlushWriter(w)
+	return &gzipFlushWriter{gz: gzip.NewWriter(fw.w), fw: fw}
+}
+
+func (gw *gzipFlushWriter) Write(p []byte) (int, error) {
+	n, err := gw.gz.Write(p)
+	if err == nil {
+		err = gw.gz.Flush()
+	}
+	if gw.fw.f != nil {
+		gw.fw.f.Flush()
+	}
+	return n, err
+}
+
+func (gw *gzipFlushWriter) Close() error {
+	return gw.gz.Close()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInflateRoundTrip(t *testing.T) {
+	d, in := newDeflater(), &inflater{}
+	for _, msg := range []string{"hello", "hello again", "hello"} {
+		data, err := in.inflate(d.compress([]byte(msg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != msg {
+			t.Errorf("inflated %q, want %q", data, msg)
+		}
+	}
+}
+
+// A message under the size limit that inflates past it fails, rather than
+// being read into memory whole.
+func TestInflateLimit(t *testing.T) {
+	max := settings().Limits.MaxMessageSize
+	bomb := newDeflater().compress(bytes.Repeat([]byte{0}, 64*max))
+	if len(bomb) >= max {
+		t.Fatalf("compressed to %d bytes, not under the limit", len(bomb))
+	}
+	if _, err := (&inflater{}).inflate(bomb); err != errInflatedTooBig {
+		t.Errorf("inflate error is %v, want %v", err, errInflatedTooBig)
+	}
+	exact := newDeflater().compress(bytes.Repeat([]byte{0}, max))
+	if data, err := (&inflater{}).inflate(exact); err != nil || len(data) != max {
+		t.Errorf("inflating a message of the limit gave %d bytes, %v", len(data), err)
+	}
+}
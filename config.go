@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// config holds the daemon's settings. They come from the JSON file given
+// with -config (or $TERMSHARE_CONFIG), then environment variables, which
+// win. Everything but Listen, TLS, Cluster and the SSH and telnet listeners
+// can be changed on a running daemon by sending it SIGHUP.
+type config struct {
+	Listen    string `json:"listen"`
+	PublicUrl string `json:"public_url"`
+	TLS       struct {
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	} `json:"tls"`
+	Limits struct {
+		MaxSessions            int    `json:"max_sessions"`
+		MaxSessionsPerIP       int    `json:"max_sessions_per_ip"`
+		SessionsPerMinute      int    `json:"sessions_per_minute"`
+		SessionsPerIPPerMinute int    `json:"sessions_per_ip_per_minute"`
+		MaxViewers             int    `json:"max_viewers"`
+		JoinsPerMinute         int    `json:"joins_per_minute"`
+		BytesPerSecond         int    `json:"bytes_per_second"`
+		MaxDuration            string `json:"max_duration"`
+		DrainTimeout           string `json:"drain_timeout"`
+		PeerTimeout            string `json:"peer_timeout"`
+		MaxMessageSize         int    `json:"max_message_size"`
+	} `json:"limits"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	AllowedOrigins []string `json:"allowed_origins"`
+	Name           string   `json:"name"`
+	Banner         string   `json:"banner"`
+	BannerFile     string   `json:"banner_file"`
+	Auth           struct {
+		Tokens []string `json:"tokens"`
+	} `json:"auth"`
+	Storage struct {
+		Releases string `json:"releases"`
+	} `json:"storage"`
+	Cluster struct {
+		Node   string   `json:"node"`
+		Peers  []string `json:"peers"`
+		Secret string   `json:"secret"`
+	} `json:"cluster"`
+	SSH struct {
+		Listen         string `json:"listen"`
+		HostKey        string `json:"host_key"`
+		AuthorizedKeys string `json:"authorized_keys"`
+	} `json:"ssh"`
+	Telnet struct {
+		Listen string `json:"listen"`
+	} `json:"telnet"`
+	Output struct {
+		Coalesce   string `json:"coalesce"`
+		MaxBacklog int    `json:"max_backlog"`
+	} `json:"output"`
+	Log struct {
+		Level  string `json:"level"`
+		Format string `json:"format"`
+		Sample int    `json:"sample"`
+	} `json:"log"`
+}
+
+var configLock sync.RWMutex
+var currentConfig = defaultConfig()
+
+func defaultConfig() *config {
+	c := &config{Listen: ":8080", Banner: banner}
+	c.Limits.DrainTimeout = "30s"
+	c.Limits.PeerTimeout = "30s"
+	c.Limits.MaxMessageSize = 1 << 20
+	c.Storage.Releases = "https://github.com/progrium/termshare/releases/download"
+	c.Output.Coalesce = "10ms"
+	c.Output.MaxBacklog = 1 << 20
+	c.Log.Level = "info"
+	c.Log.Format = "logfmt"
+	return c
+}
+
+func settings() *config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return currentConfig
+}
+
+func loadConfig(path string) (*config, error) {
+	c := defaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// A misspelt setting would otherwise quietly do nothing.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, err
+		}
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		c.Listen = ":" + port
+	}
+	env := func(name string, value *string) {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	var notNumbers []string
+	envInt := func(name string, value *int) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				notNumbers = append(notNumbers, name)
+				return
+			}
+			*value = n
+		}
+	}
+	envList := func(name string, value *[]string) {
+		if v := os.Getenv(name); v != "" {
+			*value = strings.Split(v, ",")
+		}
+	}
+	env("TERMSHARE_LISTEN", &c.Listen)
+	env("TERMSHARE_PUBLIC_URL", &c.PublicUrl)
+	env("TERMSHARE_TLS_CERT", &c.TLS.Cert)
+	env("TERMSHARE_TLS_KEY", &c.TLS.Key)
+	envInt("TERMSHARE_MAX_SESSIONS", &c.Limits.MaxSessions)
+	envInt("TERMSHARE_MAX_SESSIONS_PER_IP", &c.Limits.MaxSessionsPerIP)
+	envInt("TERMSHARE_SESSIONS_PER_MINUTE", &c.Limits.SessionsPerMinute)
+	envInt("TERMSHARE_SESSIONS_PER_IP_PER_MINUTE", &c.Limits.SessionsPerIPPerMinute)
+	envInt("TERMSHARE_MAX_VIEWERS", &c.Limits.MaxViewers)
+	envInt("TERMSHARE_JOINS_PER_MINUTE", &c.Limits.JoinsPerMinute)
+	envInt("TERMSHARE_BYTES_PER_SECOND", &c.Limits.BytesPerSecond)
+	env("TERMSHARE_MAX_DURATION", &c.Limits.MaxDuration)
+	env("TERMSHARE_DRAIN_TIMEOUT", &c.Limits.DrainTimeout)
+	env("TERMSHARE_PEER_TIMEOUT", &c.Limits.PeerTimeout)
+	envInt("TERMSHARE_MAX_MESSAGE_SIZE", &c.Limits.MaxMessageSize)
+	envList("TERMSHARE_TRUSTED_PROXIES", &c.TrustedProxies)
+	envList("TERMSHARE_ALLOWED_ORIGINS", &c.AllowedOrigins)
+	env("TERMSHARE_NAME", &c.Name)
+	env("TERMSHARE_BANNER", &c.Banner)
+	env("TERMSHARE_BANNER_FILE", &c.BannerFile)
+	envList("TERMSHARE_AUTH_TOKENS", &c.Auth.Tokens)
+	env("TERMSHARE_RELEASES", &c.Storage.Releases)
+	env("TERMSHARE_NODE", &c.Cluster.Node)
+	envList("TERMSHARE_PEERS", &c.Cluster.Peers)
+	env("TERMSHARE_CLUSTER_SECRET", &c.Cluster.Secret)
+	env("TERMSHARE_SSH_LISTEN", &c.SSH.Listen)
+	env("TERMSHARE_SSH_HOST_KEY", &c.SSH.HostKey)
+	env("TERMSHARE_SSH_AUTHORIZED_KEYS", &c.SSH.AuthorizedKeys)
+	env("TERMSHARE_TELNET_LISTEN", &c.Telnet.Listen)
+	env("TERMSHARE_COALESCE", &c.Output.Coalesce)
+	envInt("TERMSHARE_MAX_BACKLOG", &c.Output.MaxBacklog)
+	env("TERMSHARE_LOG_LEVEL", &c.Log.Level)
+	env("TERMSHARE_LOG_FORMAT", &c.Log.Format)
+	envInt("TERMSHARE_LOG_SAMPLE", &c.Log.Sample)
+	if len(notNumbers) > 0 {
+		return nil, errors.New("not a number: " + strings.Join(notNumbers, ", "))
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// check makes sure every duration is one, so a typo is an error rather
+// than a limit that's quietly gone. Only max_duration may be left empty,
+// for sessions that go on as long as they like, and timeouts and ticks of
+// zero would never fire.
+func (c *config) check() error {
+	type duration struct {
+		name, value string
+		min         time.Duration
+	}
+	durations := []duration{
+		{"limits.drain_timeout", c.Limits.DrainTimeout, 0},
+		{"limits.peer_timeout", c.Limits.PeerTimeout, 1},
+		{"output.coalesce", c.Output.Coalesce, 1},
+	}
+	if c.Limits.MaxDuration != "" {
+		durations = append(durations, duration{"limits.max_duration", c.Limits.MaxDuration, 1})
+	}
+	for _, d := range durations {
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("%s: %q isn't a duration like 30s or 8h", d.name, d.value)
+		}
+		if v < d.min {
+			return fmt.Errorf("%s: %q is too short", d.name, d.value)
+		}
+	}
+	return nil
+}
+
+// The durations below have all been through check.
+
+// MaxDuration is how long sessions may last, or zero if they may go on
+// forever.
+func (c *config) MaxDuration() time.Duration {
+	d, _ := time.ParseDuration(c.Limits.MaxDuration)
+	return d
+}
+
+// DrainTimeout is how long a stopping daemon waits for sessions to end.
+func (c *config) DrainTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.Limits.DrainTimeout)
+	return d
+}
+
+// PeerTimeout is how long a connection may go without a word, not even a
+// pong, from the other end before it's given up as dead.
+func (c *config) PeerTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.Limits.PeerTimeout)
+	return d
+}
+
+// CoalesceTick is how long output is gathered up before it's sent on.
+func (c *config) CoalesceTick() time.Duration {
+	d, _ := time.ParseDuration(c.Output.Coalesce)
+	return d
+}
+
+func configPath() string {
+	if *configFile != "" {
+		return *configFile
+	}
+	return os.Getenv("TERMSHARE_CONFIG")
+}
+
+// reloadConfigOnHangup swaps in a freshly loaded config on SIGHUP. Live
+// sessions don't notice, they only ever look settings up as they need them.
+func reloadConfigOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			c, err := loadConfig(configPath())
+			if err != nil {
+				serverLog.Error("config not reloaded", "error", err)
+				continue
+			}
+			old := settings()
+			if c.Listen != old.Listen || c.TLS != old.TLS || c.SSH.Listen != old.SSH.Listen ||
+				c.SSH.HostKey != old.SSH.HostKey || c.Telnet != old.Telnet || c.Cluster.Node != old.Cluster.Node ||
+				c.Cluster.Secret != old.Cluster.Secret || strings.Join(c.Cluster.Peers, ",") != strings.Join(old.Cluster.Peers, ",") {
+				serverLog.Warn("listen, tls, ssh listen, telnet and cluster settings only change on restart")
+			}
+			configLock.Lock()
+			currentConfig = c
+			configLock.Unlock()
+			serverLog.Info("config reloaded", "path", configPath())
+		}
+	}()
+}
+
+// authorized checks the bearer token needed to create sessions, if the
+// daemon is configured with any.
+func authorized(r *http.Request) bool {
+	tokens := settings().Auth.Tokens
+	if len(tokens) == 0 {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, t := range tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// originAllowed checks the Origin of websocket requests. The termshare
+// client uses the server itself as origin, which is always fine.
+func originAllowed(r *http.Request) bool {
+	allowed := settings().AllowedOrigins
+	origin := r.Header.Get("Origin")
+	if len(allowed) == 0 || origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.TrimSuffix(strings.TrimSuffix(u.Host, ":443"), ":80") == r.Host {
+		return true
+	}
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
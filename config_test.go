@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func configFileWith(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "termshare.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name, file string
+		env        map[string]string
+		err        string
+	}{
+		{"valid", `{"limits": {"max_duration": "8h", "drain_timeout": "0s"}}`, nil, ""},
+		{"no max duration", `{"limits": {"max_duration": ""}}`, nil, ""},
+		{"misspelt setting", `{"limits": {"max_durration": "8h"}}`, nil, "max_durration"},
+		{"bad max duration", `{"limits": {"max_duration": "2hrs"}}`, nil, "limits.max_duration"},
+		{"bad drain timeout", `{"limits": {"drain_timeout": "soon"}}`, nil, "limits.drain_timeout"},
+		{"zero peer timeout", `{"limits": {"peer_timeout": "0s"}}`, nil, "limits.peer_timeout"},
+		{"negative max duration", `{"limits": {"max_duration": "-1h"}}`, nil, "limits.max_duration"},
+		{"bad coalesce from env", `{}`, map[string]string{"TERMSHARE_COALESCE": "10"}, "output.coalesce"},
+		{"bad number from env", `{}`, map[string]string{"TERMSHARE_MAX_VIEWERS": "lots"}, "TERMSHARE_MAX_VIEWERS"},
+	}
+	for _, test := range tests {
+		for k, v := range test.env {
+			os.Setenv(k, v)
+		}
+		c, err := loadConfig(configFileWith(t, test.file))
+		for k := range test.env {
+			os.Unsetenv(k)
+		}
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if test.name == "valid" && c.MaxDuration().Hours() != 8 {
+				t.Errorf("%s: max duration %v", test.name, c.MaxDuration())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want one about %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	c := defaultConfig()
+	c.Auth.Tokens = []string{"", "team-secret"}
+	withConfig(t, c)
+	for header, want := range map[string]bool{
+		"Bearer team-secret":  true,
+		"Bearer team-secre":   false,
+		"Bearer team-secret!": false,
+		"Bearer ":             false,
+		"":                    false,
+	} {
+		r := httptest.NewRequest("POST", "/brave-otter", nil)
+		r.Header.Set("Authorization", header)
+		if got := authorized(r); got != want {
+			t.Errorf("authorized with %q = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// Session keys for end-to-end encrypted sessions only ever travel in the
+// fragment of the session URL, which browsers and the client never send to
+// the server.
+
+func newSessionKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// Each direction gets its own key, derived from the session key, so a
+// relay can't pass the pilot's output back to it as copilot input.
+const (
+	outputKeyLabel = "termshare output"
+	inputKeyLabel  = "termshare input"
+)
+
+// sessionKeys are the keys for sealing the pilot's output and copilot
+// input.
+type sessionKeys struct {
+	output, input cipher.AEAD
+}
+
+func parseSessionKey(encoded string) (keys sessionKeys, err error) {
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return keys, errors.New("invalid session key")
+	}
+	if keys.output, err = directionKey(key, outputKeyLabel); err != nil {
+		return keys, err
+	}
+	keys.input, err = directionKey(key, inputKeyLabel)
+	return keys, err
+}
+
+func directionKey(key []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedConn seals every Write into binary websocket messages and opens
+// messages as they are Read. The daemon relays these messages whole, so
+// frame boundaries are preserved. Control messages are left in the clear.
+//
+// A message is a header of the sender's random stream id and a count of
+// the messages it has sent, then the nonce and ciphertext. The header is
+// authenticated along with the data, and messages that don't count up
+// from what was last seen on their stream are dropped, so a relay can't
+// replay earlier keystrokes or output.
+type encryptedConn struct {
+	conn       *framedConn
+	seal, open cipher.AEAD
+	stream     [8]byte
+	sent       uint64
+	seen       map[[8]byte]uint64
+	buf        []byte
+}
+
+const sealedHeader = 16
+
+func newEncryptedConn(conn *framedConn, seal, open cipher.AEAD) *encryptedConn {
+	ec := &encryptedConn{conn: conn, seal: seal, open: open, seen: make(map[[8]byte]uint64)}
+	rand.Read(ec.stream[:])
+	return ec
+}
+
+func (ec *encryptedConn) Read(p []byte) (n int, err error) {
+	for len(ec.buf) == 0 {
+		frame, err := ec.conn.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		size := ec.open.NonceSize()
+		if len(frame) < sealedHeader+size {
+			return 0, errors.New("short encrypted frame")
+		}
+		header, nonce := frame[:sealedHeader], frame[sealedHeader:sealedHeader+size]
+		data, err := ec.open.Open(nil, nonce, frame[sealedHeader+size:], header)
+		if err != nil {
+			return 0, err
+		}
+		var stream [8]byte
+		copy(stream[:], header)
+		count := binary.BigEndian.Uint64(header[8:])
+		if next, ok := ec.seen[stream]; ok && count < next {
+			continue
+		}
+		ec.seen[stream] = count + 1
+		ec.buf = data
+	}
+	n = copy(p, ec.buf)
+	ec.buf = ec.buf[n:]
+	return n, nil
+}
+
+// Output gathered up over a flood can be big, so it's sealed in pieces
+// that stay well under the server's limit on message size.
+const maxSealed = 32 << 10
+
+func (ec *encryptedConn) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > maxSealed {
+			chunk = chunk[:maxSealed]
+		}
+		frame := make([]byte, sealedHeader+ec.seal.NonceSize(), sealedHeader+ec.seal.NonceSize()+len(chunk)+ec.seal.Overhead())
+		copy(frame, ec.stream[:])
+		binary.BigEndian.PutUint64(frame[8:], ec.sent)
+		nonce := frame[sealedHeader:]
+		if _, err = rand.Read(nonce); err != nil {
+			return n, err
+		}
+		frame = ec.seal.Seal(frame, nonce, chunk, frame[:sealedHeader])
+		if _, err = ec.conn.Write(frame); err != nil {
+			return n, err
+		}
+		ec.sent++
+		n += len(chunk)
+	}
+	return n, nil
+}
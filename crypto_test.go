@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// framedPair connects two framedConns over a websocket, as the pilot and a
+// copilot are through the daemon.
+func framedPair(t *testing.T) (*framedConn, *framedConn) {
+	accepted := make(chan *framedConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- newFramedConn(conn, true)
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newFramedConn(conn, true)
+	t.Cleanup(func() { client.Close() })
+	server := <-accepted
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func testKeys(t *testing.T) sessionKeys {
+	key, err := newSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseSessionKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func readString(t *testing.T, ec *encryptedConn) string {
+	buf := make([]byte, 64)
+	n, err := ec.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestEncryptedConnRejectsReplays(t *testing.T) {
+	pilotSide, copilotSide := framedPair(t)
+	keys := testKeys(t)
+	copilot := newEncryptedConn(copilotSide, keys.input, keys.output)
+	pilot := newEncryptedConn(pilotSide, keys.output, keys.input)
+
+	copilot.Write([]byte("rm -rf ~\r"))
+	replayed, err := pilotSide.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copilotSide.Write(replayed)
+	copilotSide.Write(replayed)
+	copilot.Write([]byte("ls\r"))
+	if got := readString(t, pilot); got != "rm -rf ~\r" {
+		t.Fatalf("pilot read %q, want the first keystrokes", got)
+	}
+	if got := readString(t, pilot); got != "ls\r" {
+		t.Errorf("pilot read %q after the replays, want the next keystrokes", got)
+	}
+}
+
+func TestEncryptedConnRejectsReflectedOutput(t *testing.T) {
+	pilotSide, copilotSide := framedPair(t)
+	keys := testKeys(t)
+	pilot := newEncryptedConn(pilotSide, keys.output, keys.input)
+
+	pilot.Write([]byte("$ "))
+	output, err := copilotSide.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copilotSide.Write(output)
+	if _, err := pilot.Read(make([]byte, 64)); err == nil {
+		t.Error("pilot took its own output back as input")
+	}
+}
+
+func TestEncryptedConnRejectsTamperedHeader(t *testing.T) {
+	pilotSide, copilotSide := framedPair(t)
+	keys := testKeys(t)
+	copilot := newEncryptedConn(copilotSide, keys.input, keys.output)
+	pilot := newEncryptedConn(pilotSide, keys.output, keys.input)
+
+	copilot.Write([]byte("x"))
+	frame, err := pilotSide.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[15]++
+	copilotSide.Write(frame)
+	if _, err := pilot.Read(make([]byte, 64)); err == nil {
+		t.Error("pilot took a message with its count changed")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+const mdnsService = "_termshare._tcp"
+
+type nearbySession struct {
+	Name  string
+	Pilot string
+	Url   string
+}
+
+func displayName() string {
+	if u, err := user.Current(); err == nil {
+		if u.Name != "" {
+			return u.Name
+		}
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// advertiseSession announces a -listen session to the local network. The
+// TXT record carries the session name and who is piloting it.
+func advertiseSession(session *session, addr *net.TCPAddr) (*mdns.Server, error) {
+	var ips []net.IP
+	if !addr.IP.IsUnspecified() {
+		ips = []net.IP{addr.IP}
+	} else if ip := net.ParseIP(lanAddr()); ip != nil {
+		ips = []net.IP{ip}
+	}
+	host, _ := os.Hostname()
+	info := []string{"session=" + session.Name, "pilot=" + displayName()}
+	service, err := mdns.NewMDNSService(session.Name, mdnsService, "", host+".", addr.Port, ips, info)
+	if err != nil {
+		return nil, err
+	}
+	return mdns.NewServer(&mdns.Config{Zone: service, Logger: log.New(ioutil.Discard, "", 0)})
+}
+
+func findSessions(timeout time.Duration) []nearbySession {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	params := mdns.DefaultParams(mdnsService)
+	params.Entries = entries
+	params.Timeout = timeout
+	params.Logger = log.New(ioutil.Discard, "", 0)
+	go func() {
+		mdns.Query(params)
+		close(entries)
+	}()
+	var found []nearbySession
+	seen := make(map[string]bool)
+	for entry := range entries {
+		nearby := nearbySession{}
+		for _, field := range entry.InfoFields {
+			switch {
+			case strings.HasPrefix(field, "session="):
+				nearby.Name = strings.TrimPrefix(field, "session=")
+			case strings.HasPrefix(field, "pilot="):
+				nearby.Pilot = strings.TrimPrefix(field, "pilot=")
+			}
+		}
+		if nearby.Name == "" || entry.AddrV4 == nil || seen[nearby.Name] {
+			continue
+		}
+		seen[nearby.Name] = true
+		nearby.Url = "http://" + net.JoinHostPort(entry.AddrV4.String(), strconv.Itoa(entry.Port)) + "/" + nearby.Name
+		found = append(found, nearby)
+	}
+	return found
+}
+
+func pickSession(found []nearbySession) (string, error) {
+	for i, nearby := range found {
+		fmt.Printf("%d) %s\t%s\n", i+1, nearby.Pilot, nearby.Url)
+	}
+	fmt.Print("Join session: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || choice < 1 || choice > len(found) {
+		return "", errors.New("no such session")
+	}
+	return found[choice-1].Url, nil
+}
+
+// browseSessions lists sessions advertised nearby and joins the one picked.
+func browseSessions() {
+	fmt.Println("Looking for sessions nearby...")
+	found := findSessions(2 * time.Second)
+	if len(found) == 0 {
+		fatal(exitUnavailable, "no sessions found nearby")
+	}
+	sessionUrl, err := pickSession(found)
+	if err != nil {
+		fatal(exitUsage, "unable to pick a session:", err)
+	}
+	joinSession(sessionUrl)
+}
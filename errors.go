@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/heroku/hk/term"
+)
+
+// Error codes the daemon reports in the "error" field of JSON error bodies.
+const (
+	errConflict        = "conflict"
+	errForbidden       = "forbidden"
+	errInvalidName     = "invalid_name"
+	errNotAcceptable   = "not_acceptable"
+	errNotFound        = "not_found"
+	errRateLimited     = "rate_limited"
+	errRestarting      = "restarting"
+	errServerFull      = "server_full"
+	errUnavailable     = "unavailable"
+	errUnauthorized    = "unauthorized"
+	errVersionMismatch = "version_mismatch"
+)
+
+// Exit codes follow sysexits(3) so scripts can tell failures apart.
+const (
+	exitUsage       = 64
+	exitNoInput     = 66
+	exitUnavailable = 69
+	exitConflict    = 73
+	exitTempFail    = 75
+	exitProtocol    = 76
+	exitNoPerm      = 77
+)
+
+type apiError struct {
+	Status     int    `json:"-"`
+	RetryAfter string `json:"-"`
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return "unexpected status: " + strconv.Itoa(e.Status)
+	}
+	return e.Message
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Code: code, Message: message})
+}
+
+// refuse turns a client away, counting why.
+func refuse(w http.ResponseWriter, status int, code, message string) {
+	metrics.HandshakeFailures.Inc(code)
+	writeError(w, status, code, message)
+}
+
+func readError(resp *http.Response) *apiError {
+	e := &apiError{Status: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	if resp.Header.Get("Content-Type") == "application/json" {
+		json.NewDecoder(resp.Body).Decode(e)
+	}
+	return e
+}
+
+var rawMode bool
+
+func makeRaw() error {
+	if err := term.MakeRaw(os.Stdin); err != nil {
+		return err
+	}
+	rawMode = true
+	return nil
+}
+
+func restoreTerminal() {
+	if rawMode {
+		term.Restore(os.Stdin)
+		rawMode = false
+	}
+}
+
+// fatal puts the terminal back the way we found it before printing the
+// message and exiting with code.
+func fatal(code int, v ...interface{}) {
+	restoreTerminal()
+	fmt.Fprintln(os.Stderr, v...)
+	os.Exit(code)
+}
+
+// joinError explains why a session couldn't be joined. The websocket dial
+// doesn't say, so the session url is fetched to see what the server has to
+// say about it.
+func joinError(sessionUrl string, err error) {
+	if resp, herr := http.Get(sessionUrl); herr == nil {
+		if resp.StatusCode != http.StatusOK {
+			e := readError(resp)
+			resp.Body.Close()
+			switch e.Code {
+			case errRateLimited:
+				fatal(exitTempFail, "server is rate limiting joins, try again in "+retryWait(e))
+			case errNotFound:
+				fatal(exitUnavailable, "session not found, it may have ended")
+			case errServerFull:
+				fatal(exitTempFail, e.Message+", try again in "+retryWait(e))
+			case errForbidden:
+				fatal(exitNoPerm, e.Message)
+			case errVersionMismatch:
+				fatal(exitProtocol, e.Message)
+			}
+		}
+		resp.Body.Close()
+	}
+	fatal(exitUnavailable, "unable to join session:", err)
+}
+
+func retryWait(e *apiError) string {
+	if e.RetryAfter == "" {
+		return "a little while"
+	}
+	return e.RetryAfter + " seconds"
+}
+
+// sessionError turns a failed attempt at opening a session into something
+// the user can act on.
+func sessionError(name string, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		fatal(1, "unable to open session:", err)
+	}
+	switch e.Code {
+	case errConflict:
+		fatal(exitConflict, "session name "+name+" is already taken, pick another with -name")
+	case errInvalidName:
+		fatal(exitUsage, "server rejected session name "+name+":", e.Message)
+	case errRateLimited:
+		fatal(exitTempFail, "server is rate limiting new sessions ("+e.Message+"), try again in "+retryWait(e))
+	case errUnauthorized:
+		fatal(exitNoPerm, "server requires a token to create sessions, set TERMSHARE_TOKEN")
+	case errServerFull:
+		fatal(exitTempFail, "server is full, try again in "+retryWait(e)+" or run your own with -d")
+	case errRestarting:
+		fatal(exitTempFail, "server is restarting, try again in a moment")
+	case errUnavailable:
+		fatal(exitTempFail, "unable to open session ("+e.Message+"), try again in a moment")
+	case errVersionMismatch:
+		fatal(exitProtocol, e.Message)
+	}
+	fatal(1, "unable to open session:", e)
+}
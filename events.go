@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Browsers behind proxies that won't upgrade to websockets can follow a
+// session with Server-Sent Events at /<name>/events or, failing that, by
+// long polling /<name>/poll. Both carry what a websocket viewer with
+// framing gets, one event per message: terminal data, base64 encoded since
+// it may be encrypted, or a control message.
+type streamEvent struct {
+	Data    []byte          `json:"data,omitempty"`
+	Control *controlMessage `json:"control,omitempty"`
+}
+
+// How long a poll waits for something to happen, at most, and how often an
+// idle event stream sends a comment so proxies don't time it out.
+const (
+	maxPollWait    = 25 * time.Second
+	eventKeepAlive = 15 * time.Second
+)
+
+var errFellBehind = errors.New("fell behind")
+
+// eventQueue is a viewer that keeps what it's sent until the event stream
+// or the next poll picks it up. A viewer that lets more than max_backlog
+// bytes pile up is dropped.
+type eventQueue struct {
+	sync.Mutex
+	events  []streamEvent
+	size    int
+	dropped bool
+	seen    time.Time
+	wake    chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{seen: time.Now(), wake: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(ev streamEvent, size int) error {
+	q.Lock()
+	if max := settings().Output.MaxBacklog; max > 0 && q.size+size > max {
+		q.dropped = true
+	} else {
+		q.events = append(q.events, ev)
+		q.size += size
+	}
+	dropped := q.dropped
+	q.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	if dropped {
+		return errFellBehind
+	}
+	return nil
+}
+
+func (q *eventQueue) Write(p []byte) (int, error) {
+	if err := q.push(streamEvent{Data: append([]byte(nil), p...)}, len(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (q *eventQueue) WriteControl(msg controlMessage) error {
+	return q.push(streamEvent{Control: &msg}, 0)
+}
+
+// take hands out everything waiting, and whether the viewer was dropped.
+func (q *eventQueue) take() ([]streamEvent, bool) {
+	q.Lock()
+	defer q.Unlock()
+	events := q.events
+	q.events, q.size = nil, 0
+	return events, q.dropped
+}
+
+func (q *eventQueue) fellBehind() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped
+}
+
+func (q *eventQueue) empty() bool {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.events) == 0 && !q.dropped
+}
+
+func (q *eventQueue) touch() {
+	q.Lock()
+	defer q.Unlock()
+	q.seen = time.Now()
+}
+
+func (q *eventQueue) idle() time.Duration {
+	q.Lock()
+	defer q.Unlock()
+	return time.Since(q.seen)
+}
+
+// pollers are a session's long polling viewers, by the id they poll with.
+type pollers struct {
+	sync.Mutex
+	p map[string]*eventQueue
+}
+
+func (p *pollers) Get(id string) *eventQueue {
+	p.Lock()
+	defer p.Unlock()
+	return p.p[id]
+}
+
+func (p *pollers) Add(id string, q *eventQueue) {
+	p.Lock()
+	defer p.Unlock()
+	p.p[id] = q
+}
+
+func (p *pollers) Remove(id string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.p, id)
+}
+
+// continuingPoll says whether a request is a viewer that already joined
+// polling again, rather than somebody new.
+func continuingPoll(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/poll") && r.URL.Query().Get("id") != ""
+}
+
+func (session *session) serveEvents(w http.ResponseWriter, r *http.Request, h handshake, l *logger) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Proxies like nginx hold streamed responses back without this.
+	w.Header().Set("X-Accel-Buffering", "no")
+	q := newEventQueue()
+	session.greet(q, h)
+	session.Viewers.Add(q, transportEvents)
+	l = l.With("role", "viewer", "transport", transportEvents).Sample()
+	l.Info("connected")
+	started := time.Now()
+	fw := FlushWriter(w)
+	reason := "session ended"
+	for {
+		events, dropped := q.take()
+		if len(events) > 0 {
+			var buf bytes.Buffer
+			for _, ev := range events {
+				data, _ := json.Marshal(ev)
+				buf.WriteString("data: ")
+				buf.Write(data)
+				buf.WriteString("\n\n")
+			}
+			if _, err := fw.Write(buf.Bytes()); err != nil {
+				session.Viewers.Remove(q)
+				reason = disconnectReason(err)
+				break
+			}
+		}
+		if dropped {
+			reason = errFellBehind.Error()
+			break
+		}
+		select {
+		case <-q.wake:
+			continue
+		case <-time.After(eventKeepAlive):
+			fw.Write([]byte(":\n\n"))
+			continue
+		case <-r.Context().Done():
+			session.Viewers.Remove(q)
+			reason = "closed"
+		case <-session.EOF:
+		}
+		break
+	}
+	l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+}
+
+type pollReply struct {
+	ID     string        `json:"id"`
+	Events []streamEvent `json:"events"`
+}
+
+// servePoll answers a long poll. The first poll joins the session and gets
+// an id to poll with from then on. Later polls wait until there's
+// something to send, and a viewer that stops polling for the peer timeout
+// is dropped.
+func (session *session) servePoll(w http.ResponseWriter, r *http.Request, h handshake, l *logger) {
+	timeout := settings().PeerTimeout()
+	wait := timeout / 2
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+	id := r.URL.Query().Get("id")
+	q := session.Pollers.Get(id)
+	if id == "" {
+		id, q = newToken(), newEventQueue()
+		session.greet(q, h)
+		session.Pollers.Add(id, q)
+		session.Viewers.Add(q, transportPoll)
+		go session.expirePoll(id, q, l.With("role", "viewer", "transport", transportPoll).Sample(), timeout)
+	} else if q == nil {
+		refuse(w, http.StatusNotFound, errNotFound, "not polling this session, join it again")
+		return
+	} else {
+		q.touch()
+		expired := time.After(wait)
+	waiting:
+		for q.empty() {
+			select {
+			case <-q.wake:
+			case <-expired:
+				break waiting
+			case <-session.EOF:
+				break waiting
+			}
+		}
+	}
+	events, dropped := q.take()
+	if dropped {
+		session.Pollers.Remove(id)
+	}
+	if events == nil {
+		events = []streamEvent{}
+	}
+	q.touch()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(pollReply{ID: id, Events: events})
+}
+
+func (session *session) expirePoll(id string, q *eventQueue, l *logger, timeout time.Duration) {
+	l.Info("connected")
+	started := time.Now()
+	reason := "session ended"
+	for {
+		select {
+		case <-time.After(timeout / 3):
+		case <-session.EOF:
+			session.Pollers.Remove(id)
+			l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+			return
+		}
+		if q.fellBehind() || session.Pollers.Get(id) == nil {
+			reason = errFellBehind.Error()
+			break
+		}
+		if q.idle() > timeout {
+			reason = "timed out"
+			break
+		}
+	}
+	session.Pollers.Remove(id)
+	session.Viewers.Remove(q)
+	l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats a session can be viewed in over plain HTTP. A viewer picks one
+// with ?format=, ?raw for the terminal output as it is, or an Accept
+// header. Without any of those it gets the raw output, so curl, wget, nc
+// and the like work as they are; browsers ask for html.
+const (
+	formatRaw       = "raw"
+	formatText      = "text"
+	formatHtml      = "html"
+	formatJson      = "json"
+	formatAsciicast = "asciicast"
+	formatEvents    = "events"
+)
+
+var formatTypes = []struct{ format, mediaType string }{
+	{formatRaw, "text/plain"},
+	{formatHtml, "text/html"},
+	{formatJson, "application/x-ndjson"},
+	{formatJson, "application/json"},
+	{formatAsciicast, "application/x-asciicast"},
+	{formatEvents, "text/event-stream"},
+}
+
+func contentType(format string) string {
+	switch format {
+	case formatHtml:
+		return "text/html; charset=utf-8"
+	case formatJson:
+		return "application/x-ndjson"
+	case formatAsciicast:
+		return "application/x-asciicast"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// viewerFormat works out which format a request is after, or returns an
+// empty string if it only accepts ones we don't have.
+func viewerFormat(r *http.Request) string {
+	query := r.URL.Query()
+	if _, ok := query["raw"]; ok {
+		return formatRaw
+	}
+	if format := query.Get("format"); format != "" {
+		switch format {
+		case formatRaw, formatText, formatHtml, formatJson, formatAsciicast, formatEvents:
+			return format
+		}
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatRaw
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64)
+			}
+		}
+		// Wildcards take the first format they match, which is raw for */*
+		// and text/*.
+		for _, t := range formatTypes {
+			if mediaType == t.mediaType || mediaType == "*/*" ||
+				mediaType == strings.SplitN(t.mediaType, "/", 2)[0]+"/*" {
+				if q > bestQ {
+					best, bestQ = t.format, q
+				}
+				break
+			}
+		}
+	}
+	return best
+}
+
+// negotiateFormat picks the format for a viewer's request, refusing it
+// with 406 if it only accepts ones we don't have.
+func negotiateFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	format := viewerFormat(r)
+	if format == "" {
+		refuse(w, http.StatusNotAcceptable, errNotAcceptable,
+			"sessions can be viewed as raw, text, html, json or asciicast")
+		return "", false
+	}
+	return format, true
+}
+
+// streamViewer makes the viewer for an HTTP response in one of the
+// streamed formats, writing to the flushed, maybe gzipped, response.
+func (session *session) streamViewer(w io.Writer, format string) io.Writer {
+	switch format {
+	case formatText:
+		cols, rows := 80, 24
+		if size := session.Size; size != nil {
+			cols, rows = size.Cols, size.Rows
+		}
+		t := newTranscriber(w, cols, rows)
+		// Start from what's on the screen, so the lines already there make
+		// it into the transcript as they're finished.
+		if session.Screen != nil {
+			t.Write(session.Screen.Snapshot())
+		}
+		return t
+	case formatJson:
+		return &jsonViewer{w: w, started: time.Now()}
+	case formatAsciicast:
+		cast := &castViewer{jsonViewer{w: w, started: time.Now()}}
+		cols, rows := 80, 24
+		if size := session.Size; size != nil {
+			cols, rows = size.Cols, size.Rows
+		}
+		cast.header(cols, rows, session.Name)
+		return cast
+	}
+	return w
+}
+
+// jsonViewer writes the session as a stream of JSON objects, one per line:
+// {"time":1.5,"type":"output","data":"..."} for output, with time in
+// seconds since the viewer joined, and control messages like resize as
+// they come, with their time added.
+type jsonViewer struct {
+	sync.Mutex
+	w       io.Writer
+	started time.Time
+	text    textChunker
+}
+
+func (jv *jsonViewer) elapsed() float64 {
+	return float64(time.Since(jv.started)/time.Millisecond) / 1000
+}
+
+func (jv *jsonViewer) line(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = jv.w.Write(append(data, '\n'))
+	return err
+}
+
+func (jv *jsonViewer) Write(p []byte) (int, error) {
+	jv.Lock()
+	defer jv.Unlock()
+	text := jv.text.chunk(p)
+	if len(text) == 0 {
+		return len(p), nil
+	}
+	event := struct {
+		Time float64 `json:"time"`
+		Type string  `json:"type"`
+		Data string  `json:"data"`
+	}{jv.elapsed(), "output", string(text)}
+	if err := jv.line(event); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (jv *jsonViewer) WriteControl(msg controlMessage) error {
+	jv.Lock()
+	defer jv.Unlock()
+	return jv.line(struct {
+		Time float64 `json:"time"`
+		controlMessage
+	}{jv.elapsed(), msg})
+}
+
+// castViewer writes the session live in asciicast v2, the format of
+// asciinema recordings, so it can be played or saved as it happens.
+type castViewer struct {
+	jsonViewer
+}
+
+func (cv *castViewer) header(cols, rows int, title string) error {
+	return cv.line(map[string]interface{}{
+		"version": 2, "width": cols, "height": rows,
+		"timestamp": cv.started.Unix(), "title": title,
+	})
+}
+
+func (cv *castViewer) Write(p []byte) (int, error) {
+	cv.Lock()
+	defer cv.Unlock()
+	text := cv.text.chunk(p)
+	if len(text) == 0 {
+		return len(p), nil
+	}
+	if err := cv.line([]interface{}{cv.elapsed(), "o", string(text)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cv *castViewer) WriteControl(msg controlMessage) error {
+	cv.Lock()
+	defer cv.Unlock()
+	switch msg.Type {
+	case "resize":
+		return cv.line([]interface{}{cv.elapsed(), "r", fmt.Sprintf("%dx%d", msg.Cols, msg.Rows)})
+	case "restart":
+		return cv.line([]interface{}{cv.elapsed(), "m", msg.Message})
+	}
+	return nil
+}
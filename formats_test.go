@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		accept string
+		format string
+	}{
+		{"no accept header", "/brave-otter", "", formatRaw},
+		{"curl", "/brave-otter", "*/*", formatRaw},
+		{"browser", "/brave-otter", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatHtml},
+		{"httpie", "/brave-otter", "application/json, */*;q=0.5", formatJson},
+		{"ndjson", "/brave-otter", "application/x-ndjson", formatJson},
+		{"asciicast", "/brave-otter", "application/x-asciicast", formatAsciicast},
+		{"event source", "/brave-otter", "text/event-stream", formatEvents},
+		{"text wildcard", "/brave-otter", "text/*", formatRaw},
+		{"quality order", "/brave-otter", "text/plain;q=0.2, text/html;q=0.7", formatHtml},
+		{"q=0 excludes", "/brave-otter", "text/html;q=0, text/plain;q=0.1", formatRaw},
+		{"q=0 excludes everything", "/brave-otter", "*/*;q=0", ""},
+		{"format overrides accept", "/brave-otter?format=asciicast", "text/html", formatAsciicast},
+		{"raw overrides accept", "/brave-otter?raw", "application/json", formatRaw},
+		{"unsupported format", "/brave-otter?format=pdf", "*/*", ""},
+		{"unsupported type", "/brave-otter", "image/png", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		format, ok := negotiateFormat(w, r)
+		if format != test.format || ok != (test.format != "") {
+			t.Errorf("%s: got %q, %v, want %q", test.name, format, ok, test.format)
+		}
+		if ok {
+			continue
+		}
+		var e apiError
+		json.NewDecoder(w.Body).Decode(&e)
+		if w.Code != http.StatusNotAcceptable || e.Code != errNotAcceptable {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, w.Code, e.Code, http.StatusNotAcceptable, errNotAcceptable)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const restartNotice = "server restarting, reconnect"
+
+var drainLock sync.RWMutex
+var draining bool
+
+func isDraining() bool {
+	drainLock.RLock()
+	defer drainLock.RUnlock()
+	return draining
+}
+
+// serveHealth answers liveness and readiness checks. The daemon stays live
+// while it drains, but stops being ready so load balancers send new
+// sessions elsewhere.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/readyz" && isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// drainOnTerm shuts the daemon down gently on SIGTERM or interrupt: new
+// sessions are turned away, everyone connected is told the server is
+// restarting, and the daemon exits once the sessions have ended or the
+// drain timeout runs out, whichever comes first.
+func drainOnTerm(s *sessions) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-term
+		drainLock.Lock()
+		draining = true
+		drainLock.Unlock()
+		timeout := settings().DrainTimeout()
+		serverLog.Info("draining", "sessions", s.Len(), "timeout", timeout)
+		notice := controlMessage{Type: "restart", Message: restartNotice}
+		for _, session := range s.All() {
+			session.announce(notice)
+		}
+		waitForSessions(s, timeout, term)
+		for _, session := range s.All() {
+			if pilot := session.Pilot; pilot != nil {
+				hangUp(pilot, websocket.CloseGoingAway, "server restarting")
+			}
+		}
+		waitForSessions(s, time.Second, term)
+		serverLog.Info("server stopped", "sessions", s.Len())
+		os.Exit(0)
+	}()
+}
+
+// waitForSessions waits for every session to end, giving up after timeout
+// or when another signal says to hurry.
+func waitForSessions(s *sessions, timeout time.Duration, hurry chan os.Signal) {
+	deadline := time.After(timeout)
+	for s.Len() > 0 {
+		select {
+		case <-hurry:
+			return
+		case <-deadline:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// sessionInfo is what the pilot gets to know about a new session, and what
+// -json, -info-file and -hook hand to other tools.
+type sessionInfo struct {
+	Name         string `json:"name"`
+	Url          string `json:"url"`
+	CopilotUrl   string `json:"copilot_url,omitempty"`
+	CopilotToken string `json:"copilot_token,omitempty"`
+	Key          string `json:"key,omitempty"`
+	Expires      string `json:"expires,omitempty"`
+	Banner       string `json:"-"`
+}
+
+// withKey adds the key of an end-to-end encrypted session to its urls,
+// which is the only place it is ever shared.
+func (info *sessionInfo) withKey(key string) {
+	urls := []string{info.Url, info.Url + "#" + key}
+	if info.CopilotUrl != "" {
+		urls = append([]string{info.CopilotUrl, info.CopilotUrl + "#" + key}, urls...)
+		info.CopilotUrl += "#" + key
+	}
+	info.Key = key
+	info.Url += "#" + key
+	info.Banner = strings.NewReplacer(urls...).Replace(info.Banner)
+}
+
+func (info *sessionInfo) print() {
+	data, _ := json.Marshal(info)
+	switch {
+	case *jsonOutput:
+		fmt.Println(string(data))
+	case *quiet:
+		fmt.Println(info.Url)
+		if info.CopilotUrl != "" {
+			fmt.Println(info.CopilotUrl)
+		}
+	default:
+		fmt.Println(info.Banner)
+	}
+	if *infoFile != "" {
+		if err := ioutil.WriteFile(*infoFile, append(data, '\n'), 0600); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to write session info:", err)
+		}
+	}
+	if *hook != "" {
+		info.runHook(data)
+	}
+}
+
+// runHook runs the -hook command before the session goes interactive, with
+// the session details as json on stdin and in TERMSHARE_* variables.
+func (info *sessionInfo) runHook(data []byte) {
+	cmd := exec.Command("/bin/sh", "-c", *hook)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"TERMSHARE_NAME="+info.Name,
+		"TERMSHARE_URL="+info.Url,
+		"TERMSHARE_COPILOT_URL="+info.CopilotUrl,
+		"TERMSHARE_EXPIRES="+info.Expires,
+	)
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "hook failed:", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// listenSession serves the pilot's pty straight from this process, using the
+// same handlers, websocket protocol and term.html as the daemon, so viewers
+// and copilots can join over a LAN or VPN without a relay server.
+func listenSession() {
+	if *encrypt {
+		fatal(exitUsage, "end-to-end encryption protects sessions relayed through a server and can't be used with -listen")
+	}
+	name, err := newSessionName()
+	if err != nil {
+		fatal(1, "unable to pick a session name:", err)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal(1, "unable to listen:", err)
+	}
+	session := newSession(name, *copilot, *private, false)
+	if *advertise {
+		server, err := advertiseSession(session, listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			serverLog.Warn("unable to advertise session", "error", err)
+		} else {
+			defer server.Shutdown()
+		}
+	}
+	// Connects and disconnects would be logged over the pilot's shell.
+	logOutput = ioutil.Discard
+	mux := http.NewServeMux()
+	mux.Handle("/"+session.Name, session)
+	mux.Handle("/"+session.Name+"/", session)
+	go http.Serve(listener, mux)
+	host, _ := os.Hostname()
+	info := sessionInfo{Name: session.Name, CopilotToken: session.CopilotToken}
+	data := session.banner(listenUrl(listener.Addr()), host)
+	info.Url, info.CopilotUrl, info.Banner = data.URL, data.CopilotURL, sessionBanner(data)
+	info.print()
+
+	pty, err := startShell()
+	if err != nil {
+		fatal(1, "unable to start shell:", err)
+	}
+	session.Pilot = pty
+	watchSize(pty, func(cols, rows int) {
+		session.control(resizeMessage(cols, rows))
+	})
+	// Like the daemon, output goes through a shaper, so the pilot's terminal
+	// never waits on a slow viewer, and the screen is kept to catch up late
+	// joiners and text viewers.
+	output := newShaper(io.MultiWriter(session.Viewers, session.CopilotBuffer), session.Screen, func() int { return 0 })
+	runPilot(pty, output, nil)
+	output.Close()
+	close(session.EOF)
+}
+
+func listenUrl(addr net.Addr) string {
+	tcp := addr.(*net.TCPAddr)
+	host := tcp.IP.String()
+	if tcp.IP.IsUnspecified() {
+		host = lanAddr()
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(tcp.Port))
+}
+
+// lanAddr picks the first non-loopback IPv4 address, which is usually the
+// one peers on the same network can reach.
+func lanAddr() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "localhost"
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return "localhost"
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Log levels, from chattiest to quietest.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLevel(name string) int {
+	for i, n := range levelNames {
+		if n == name {
+			return i
+		}
+	}
+	return levelInfo
+}
+
+var logLock sync.Mutex
+
+// logOutput is where logs go. It's stderr for the daemon, and nowhere for
+// a -listen session, where stderr is the pilot's terminal.
+var logOutput io.Writer = os.Stderr
+
+// logger writes structured daemon logs, as logfmt or JSON depending on the
+// config. Each one carries fields that are added to everything it logs.
+type logger struct {
+	fields  []interface{}
+	sampled bool
+}
+
+var serverLog = &logger{sampled: true}
+
+// requestLog starts a logger for an incoming request, tagged with its id
+// and where it came from.
+func requestLog(r *http.Request) *logger {
+	l := serverLog.With(
+		"request_id", r.Header.Get("X-Request-Id"),
+		"remote_addr", r.RemoteAddr)
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		l = l.With("forwarded_for", forwarded)
+	}
+	return l.With("user_agent", r.UserAgent())
+}
+
+// requestId makes sure a request has an id, keeping one set by a proxy in
+// front of us, and hands it back to the client.
+func requestId(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = newToken()[:16]
+		r.Header.Set("X-Request-Id", id)
+	}
+	w.Header().Set("X-Request-Id", id)
+}
+
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{fields: fields, sampled: l.sampled}
+}
+
+// Sample decides once whether this logger's info and debug events get
+// logged, so high-volume events like viewers coming and going can be thinned
+// out with log.sample while their connects and disconnects still pair up.
+func (l *logger) Sample() *logger {
+	n := settings().Log.Sample
+	sampled := n <= 1 || rand.Intn(n) == 0
+	return &logger{fields: l.fields, sampled: sampled}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(level int, msg string, kv []interface{}) {
+	c := settings().Log
+	if level < parseLevel(c.Level) || level < levelWarn && !l.sampled {
+		return
+	}
+	fields := append([]interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", levelNames[level],
+		"msg", msg,
+	}, append(l.fields, kv...)...)
+	var line []byte
+	if c.Format == "json" {
+		line = jsonLine(fields)
+	} else {
+		line = logfmtLine(fields)
+	}
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOutput.Write(line)
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.Seconds()
+	}
+	return v
+}
+
+func jsonLine(fields []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		value, err := json.Marshal(fieldValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func logfmtLine(fields []interface{}) []byte {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprint(fieldValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&buf, "%v=%s", fields[i], value)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// disconnectReason describes how a connection ended for the logs.
+func disconnectReason(err error) string {
+	if e, ok := err.(*websocket.CloseError); ok && e.Text != "" {
+		return e.Text
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timed out"
+	}
+	if cleanClose(err) {
+		return "closed"
+	}
+	return err.Error()
+}
+
+// cleanClose says whether a connection was closed on purpose rather than
+// lost.
+func cleanClose(err error) bool {
+	return err == nil || err == io.EOF ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
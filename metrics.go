@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Viewer transports, as labelled in metrics and logs.
+const (
+	transportWebsocket = "websocket"
+	transportHttp      = "http"
+	transportBrowser   = "browser"
+	transportEvents    = "events"
+	transportPoll      = "poll"
+	transportSSH       = "ssh"
+	transportTelnet    = "telnet"
+)
+
+var viewerTransports = []string{transportBrowser, transportEvents, transportHttp, transportPoll, transportSSH, transportTelnet, transportWebsocket}
+
+// counterVec is a set of counters told apart by the value of one label. With
+// no label it's a single counter under the empty value.
+type counterVec struct {
+	sync.Mutex
+	label  string
+	values map[string]int64
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, values: make(map[string]int64)}
+}
+
+func (c *counterVec) Add(value string, n int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[value] += n
+}
+
+func (c *counterVec) Inc(value string) {
+	c.Add(value, 1)
+}
+
+func (c *counterVec) snapshot() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	values := make(map[string]int64, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+type histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []int64
+	sum     float64
+	count   int64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+var metrics = struct {
+	RelayedBytes      *counterVec
+	ViewerEvictions   *counterVec
+	HandshakeFailures *counterVec
+	SessionDuration   *histogram
+	Snapshots         *counterVec
+}{
+	RelayedBytes:      newCounterVec("direction"),
+	ViewerEvictions:   newCounterVec(""),
+	HandshakeFailures: newCounterVec("reason"),
+	SessionDuration:   newHistogram(60, 300, 900, 1800, 3600, 4*3600, 12*3600, 24*3600),
+	Snapshots:         newCounterVec(""),
+}
+
+// countingWriter adds whatever passes through it to the relayed bytes in
+// one direction.
+type countingWriter struct {
+	w         io.Writer
+	direction string
+}
+
+func (cw countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	metrics.RelayedBytes.Add(cw.direction, int64(n))
+	return
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw metricsWriter) value(name string, v interface{}) {
+	fmt.Fprintf(mw.w, "%s %v\n", name, v)
+}
+
+func (mw metricsWriter) vec(name, kind, help string, c *counterVec, always ...string) {
+	mw.header(name, kind, help)
+	values := c.snapshot()
+	if c.label == "" {
+		mw.value(name, values[""])
+		return
+	}
+	for _, k := range always {
+		if _, ok := values[k]; !ok {
+			values[k] = 0
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.value(fmt.Sprintf("%s{%s=%q}", name, c.label, k), values[k])
+	}
+}
+
+func (mw metricsWriter) histogram(name, help string, h *histogram) {
+	mw.header(name, "histogram", help)
+	h.Lock()
+	defer h.Unlock()
+	for i, le := range h.buckets {
+		mw.value(fmt.Sprintf("%s_bucket{le=\"%g\"}", name, le), h.counts[i])
+	}
+	mw.value(name+"_bucket{le=\"+Inf\"}", h.count)
+	mw.value(name+"_sum", h.sum)
+	mw.value(name+"_count", h.count)
+}
+
+// serveMetrics writes the daemon's metrics in the Prometheus text format.
+// Anything that can be read off the live sessions is counted at scrape time
+// rather than tracked as it changes.
+func serveMetrics(w http.ResponseWriter, s *sessions) {
+	var pilots, copilots, buffered int64
+	viewers := newCounterVec("transport")
+	all := s.All()
+	for _, session := range all {
+		if session.Pilot != nil {
+			pilots++
+		}
+		if session.Copilot != nil {
+			copilots++
+		}
+		buffered += int64(session.CopilotBuffer.Len())
+		for transport, n := range session.Viewers.Transports() {
+			viewers.Add(transport, int64(n))
+		}
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := metricsWriter{w}
+	mw.header("termshare_sessions", "gauge", "Sessions on this server.")
+	mw.value("termshare_sessions", len(all))
+	mw.header("termshare_pilots", "gauge", "Pilots connected.")
+	mw.value("termshare_pilots", pilots)
+	mw.header("termshare_copilots", "gauge", "Copilots connected.")
+	mw.value("termshare_copilots", copilots)
+	mw.vec("termshare_viewers", "gauge", "Viewers connected, by transport.", viewers, viewerTransports...)
+	mw.vec("termshare_relayed_bytes_total", "counter", "Bytes relayed from pilots (output) and copilots (input).",
+		metrics.RelayedBytes, "input", "output")
+	mw.histogram("termshare_session_duration_seconds", "How long pilots stayed connected.", metrics.SessionDuration)
+	mw.vec("termshare_viewer_evictions_total", "counter", "Viewers dropped after a write to them failed.", metrics.ViewerEvictions)
+	mw.vec("termshare_snapshots_total", "counter", "Floods of output skipped by sending a screen snapshot.", metrics.Snapshots)
+	mw.vec("termshare_handshake_failures_total", "counter", "Clients turned away, by reason.", metrics.HandshakeFailures)
+	mw.header("termshare_copilot_buffer_bytes", "gauge", "Output held for copilots that aren't connected.")
+	mw.value("termshare_copilot_buffer_bytes", buffered)
+	mw.header("termshare_goroutines", "gauge", "Goroutines running.")
+	mw.value("termshare_goroutines", runtime.NumGoroutine())
+	mw.header("termshare_heap_bytes", "gauge", "Bytes of allocated heap objects.")
+	mw.value("termshare_heap_bytes", mem.HeapAlloc)
+	mw.header("termshare_uptime_seconds", "gauge", "Seconds since the server started.")
+	mw.value("termshare_uptime_seconds", int64(time.Since(startTime).Seconds()))
+}
+
+var startTime = time.Now()
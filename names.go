@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+var sessionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{2,63}$`)
+
+// Paths the daemon serves itself can't be used as session names.
+var reservedNames = map[string]bool{
+	"version":  true,
+	"download": true,
+	"metrics":  true,
+	"healthz":  true,
+	"readyz":   true,
+}
+
+func validSessionName(name string) bool {
+	return sessionNamePattern.MatchString(name) && !reservedNames[strings.ToLower(name)]
+}
+
+func newToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// newSessionName picks the name for a new session: the -name slug if one was
+// given, otherwise a generated one. The name is all it takes to join a
+// session, so generated names need to be hard to guess.
+func newSessionName() (string, error) {
+	switch {
+	case *slug != "":
+		if !validSessionName(*slug) {
+			return "", errors.New("invalid session name, use 3 to 64 letters, digits, dashes or underscores")
+		}
+		return *slug, nil
+	case *words:
+		return wordName()
+	default:
+		name, err := uuid.NewV4()
+		if err != nil {
+			return "", err
+		}
+		return name.String(), nil
+	}
+}
+
+// wordName generates names like brave-otter-quiet-maple-4821, which are
+// easy to read aloud and still carry about 41 bits of entropy.
+func wordName() (string, error) {
+	var parts []string
+	for _, list := range [][]string{adjectives, nouns, adjectives, nouns} {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(len(list))))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, list[i.Int64()])
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(parts, "-") + "-" + strconv.FormatInt(n.Int64(), 10), nil
+}
+
+var adjectives = []string{
+	"able", "agile", "amber", "ample", "azure", "bold", "brave", "breezy",
+	"bright", "brisk", "calm", "candid", "clever", "cool", "cosmic", "crisp",
+	"curious", "daring", "dapper", "dawn", "deft", "dusky", "eager", "early",
+	"easy", "elder", "epic", "fair", "fancy", "fast", "fierce", "fine",
+	"firm", "fleet", "fond", "frank", "free", "fresh", "frosty", "gentle",
+	"giant", "glad", "golden", "grand", "green", "happy", "hardy", "hazel",
+	"hearty", "honest", "humble", "icy", "ideal", "jolly", "jovial", "keen",
+	"kind", "lively", "loyal", "lucky", "lunar", "magic", "merry", "mighty",
+	"misty", "modest", "noble", "nimble", "odd", "olive", "patient", "plucky",
+	"polite", "proud", "quick", "quiet", "rapid", "rare", "ready", "regal",
+	"rosy", "royal", "ruby", "rustic", "sable", "sandy", "savvy", "scarlet",
+	"serene", "sharp", "shiny", "silent", "silver", "simple", "sleek", "smart",
+	"snowy", "solar", "solid", "sonic", "spry", "steady", "stellar", "stoic",
+	"sturdy", "sunny", "super", "swift", "tame", "tidy", "tiny", "topaz",
+	"tranquil", "true", "trusty", "upbeat", "urban", "valiant", "vast", "velvet",
+	"vivid", "warm", "wild", "wise", "witty", "young", "zany", "zesty",
+}
+
+var nouns = []string{
+	"acorn", "alder", "anchor", "aspen", "badger", "beacon", "bear", "beaver",
+	"birch", "bison", "breeze", "brook", "canyon", "cedar", "cliff", "cloud",
+	"comet", "coral", "cougar", "coyote", "crane", "creek", "crow", "dingo",
+	"dolphin", "dove", "dune", "eagle", "ember", "falcon", "fern", "finch",
+	"fjord", "forest", "fox", "gecko", "glacier", "grove", "gull", "harbor",
+	"hawk", "heron", "hill", "ibis", "iris", "island", "jackal", "jaguar",
+	"koala", "lagoon", "lake", "lark", "lemur", "lily", "lion", "lynx",
+	"maple", "marsh", "meadow", "mesa", "moose", "moss", "moth", "newt",
+	"oak", "ocean", "orca", "osprey", "otter", "owl", "panda", "parrot",
+	"peak", "pebble", "pine", "plain", "plover", "pond", "puffin", "quail",
+	"rabbit", "raven", "reef", "ridge", "river", "robin", "salmon", "sparrow",
+	"spruce", "squid", "stone", "stork", "summit", "swan", "thistle", "tiger",
+	"toad", "trout", "tulip", "tundra", "turtle", "valley", "viper", "walrus",
+	"wave", "willow", "wolf", "wren", "yak", "zebra", "aurora", "basin",
+	"bay", "bluff", "cove", "delta", "field", "geyser", "gorge", "heath",
+	"inlet", "kelp", "lotus", "mango", "nectar", "orchid", "prairie", "quartz",
+}
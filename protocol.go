@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The protocol version is bumped whenever clients and the daemon need to
+// agree on something new. Version 1 is the plain stream spoken by v0.2.0 and
+// earlier, which didn't send a version at all. Version 2 brought framing,
+// capabilities and sealed encrypted frames, which older clients can't
+// follow, so it's the oldest termshare clients and servers take from each
+// other. Plain viewers, like curl, don't send a version and aren't held to
+// it. term.html has its own copy of protocolVersion.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 2
+)
+
+// Optional features negotiated per connection. With framing, terminal data
+// travels in binary messages and control messages in JSON text messages.
+// Deflate compresses the data messages, see compress.go.
+const (
+	capFraming = "framing"
+	capResize  = "resize"
+	capDeflate = "deflate"
+)
+
+var supportedCapabilities = []string{capFraming, capResize, capDeflate}
+
+type handshake struct {
+	Protocol     int
+	Capabilities []string
+}
+
+func (h handshake) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Without drops a capability, for when it can't be used after all.
+func (h handshake) Without(capability string) handshake {
+	without := handshake{Protocol: h.Protocol}
+	for _, c := range h.Capabilities {
+		if c != capability {
+			without.Capabilities = append(without.Capabilities, c)
+		}
+	}
+	return without
+}
+
+// parseHandshake reads the version and capabilities a client sent, keeping
+// only the capabilities we support too.
+func parseHandshake(values url.Values) handshake {
+	h := handshake{Protocol: 1}
+	if v, err := strconv.Atoi(values.Get("protocol")); err == nil {
+		h.Protocol = v
+	}
+	requested := handshake{Capabilities: strings.Split(values.Get("capabilities"), ",")}
+	for _, c := range supportedCapabilities {
+		if requested.Has(c) {
+			h.Capabilities = append(h.Capabilities, c)
+		}
+	}
+	return h
+}
+
+func clientHandshake() url.Values {
+	return url.Values{
+		"protocol":     {strconv.Itoa(protocolVersion)},
+		"capabilities": {strings.Join(supportedCapabilities, ",")},
+		"os":           {releaseOS()},
+		"arch":         {releaseArch()},
+	}
+}
+
+// checkProtocol turns away clients too old to talk to us, telling them
+// where to get a newer one for their platform. Clients that don't say what
+// that is get a command that works it out with uname.
+func checkProtocol(w http.ResponseWriter, r *http.Request, h handshake) bool {
+	if h.Protocol >= minProtocolVersion {
+		return true
+	}
+	os, arch := r.FormValue("os"), r.FormValue("arch")
+	if os == "" {
+		os = "$(uname -s)"
+	}
+	if arch == "" {
+		arch = "$(uname -m)"
+	}
+	refuse(w, http.StatusUpgradeRequired, errVersionMismatch,
+		"this version of termshare is too old for "+serverName(r)+", upgrade with:\n"+
+			"  curl -sL "+publicUrl(r)+"/download/"+os+"/"+arch+" | tar -C /usr/local/bin -zxf -")
+	return false
+}
+
+// serverTooOld is a server, or a -listen session, speaking a protocol older
+// than this client takes.
+type serverTooOld struct {
+	server   string
+	protocol int
+}
+
+func (e *serverTooOld) Error() string {
+	return fmt.Sprintf("server %s speaks termshare protocol %d and this termshare needs %d or later, "+
+		"ask whoever runs it to upgrade or run your own with -d", e.server, e.protocol, minProtocolVersion)
+}
+
+// checkServerProtocol makes sure the server a session is on isn't too old
+// for this client. Servers from before versions were sent count as version
+// 1.
+func checkServerProtocol(server string, h handshake) error {
+	if h.Protocol >= minProtocolVersion {
+		return nil
+	}
+	return &serverTooOld{server, h.Protocol}
+}
+
+func writeHandshake(w http.ResponseWriter, h handshake) {
+	w.Header().Set("X-Termshare-Protocol", strconv.Itoa(protocolVersion))
+	w.Header().Set("X-Termshare-Capabilities", strings.Join(h.Capabilities, ","))
+}
+
+func readHandshake(resp *http.Response) handshake {
+	values := url.Values{
+		"protocol":     {resp.Header.Get("X-Termshare-Protocol")},
+		"capabilities": {resp.Header.Get("X-Termshare-Capabilities")},
+	}
+	return parseHandshake(values)
+}
+
+type controlMessage struct {
+	Type         string   `json:"type"`
+	Protocol     int      `json:"protocol,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Cols         int      `json:"cols,omitempty"`
+	Rows         int      `json:"rows,omitempty"`
+	Message      string   `json:"message,omitempty"`
+}
+
+func helloMessage(h handshake) controlMessage {
+	return controlMessage{Type: "hello", Protocol: protocolVersion, Capabilities: h.Capabilities}
+}
+
+func resizeMessage(cols, rows int) controlMessage {
+	return controlMessage{Type: "resize", Cols: cols, Rows: rows}
+}
+
+type controlWriter interface {
+	WriteControl(msg controlMessage) error
+}
+
+// Dead peers are noticed when nothing, not even a pong, has been heard
+// from them for the peer timeout. Pings go out three times as often, so a
+// live peer always answers in time. Writes get writeWait to go through.
+const writeWait = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Origins are checked against allowed_origins before upgrading.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// acceptConn upgrades a request to a websocket, limiting the size of the
+// messages it will read.
+func acceptConn(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if max := settings().Limits.MaxMessageSize; max > 0 {
+		conn.SetReadLimit(int64(max))
+	}
+	return conn, nil
+}
+
+// framedConn is a websocket connection that knows whether framing was
+// negotiated. Every Write is sent as one message, and with framing incoming
+// text messages are handed to OnControl instead of being read as data.
+type framedConn struct {
+	*websocket.Conn
+	OnControl  func(msg controlMessage)
+	framing    bool
+	awaitHello bool
+	server     string
+	binary     bool
+	timeout    time.Duration
+	buf        []byte
+	writeLock  sync.Mutex
+	saidHello  bool
+	closedWith string
+	text       textChunker
+	deflate    *deflater
+	inflate    *inflater
+}
+
+// newFramedConn wraps conn, sending data in binary messages with framing
+// and in text messages, cut at rune boundaries, to older clients that
+// expect them, and starts pinging the peer.
+func newFramedConn(conn *websocket.Conn, framing bool) *framedConn {
+	fc := &framedConn{Conn: conn, framing: framing, binary: framing, timeout: settings().PeerTimeout()}
+	fc.SetReadDeadline(time.Now().Add(fc.timeout))
+	fc.SetPongHandler(func(string) error {
+		return fc.SetReadDeadline(time.Now().Add(fc.timeout))
+	})
+	go fc.keepAlive()
+	return fc
+}
+
+func (fc *framedConn) keepAlive() {
+	for {
+		time.Sleep(fc.timeout / 3)
+		if err := fc.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+			return
+		}
+	}
+}
+
+// dialSession connects to a session on the server. Until the server says
+// hello we can't know whether it speaks framing, so data is always sent in
+// binary messages, which any server relays as-is. A server that doesn't say
+// hello, or says it with too old a protocol, fails the first read with
+// serverTooOld.
+func dialSession(path string, query url.Values) (*framedConn, error) {
+	values := clientHandshake()
+	for k, v := range query {
+		values[k] = v
+	}
+	// Older servers turn away websockets without an origin.
+	header := http.Header{"Origin": {baseUrl("http")}}
+	conn, _, err := websocket.DefaultDialer.Dial(baseUrl("ws")+path+"?"+values.Encode(), header)
+	if err != nil {
+		return nil, err
+	}
+	fc := newFramedConn(conn, false)
+	fc.binary = true
+	fc.awaitHello = true
+	fc.server = *server
+	return fc, nil
+}
+
+// ReadFrame returns the data of the next message that isn't a control message.
+func (fc *framedConn) ReadFrame() ([]byte, error) {
+	for {
+		messageType, data, err := fc.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		fc.SetReadDeadline(time.Now().Add(fc.timeout))
+		if fc.awaitHello && messageType != websocket.TextMessage {
+			return nil, checkServerProtocol(fc.server, handshake{Protocol: 1})
+		}
+		if messageType != websocket.TextMessage || !fc.framing && !fc.awaitHello {
+			if fc.inflate != nil {
+				return fc.inflate.inflate(data)
+			}
+			return data, nil
+		}
+		var msg controlMessage
+		err = json.Unmarshal(data, &msg)
+		if fc.awaitHello {
+			h := handshake{Protocol: 1}
+			if err == nil && msg.Type == "hello" {
+				h.Protocol = msg.Protocol
+			}
+			if err := checkServerProtocol(fc.server, h); err != nil {
+				return nil, err
+			}
+			fc.awaitHello = false
+			fc.framing = true
+		}
+		if err == nil && msg.Type == "hello" {
+			fc.hello(msg)
+		}
+		if err == nil && fc.OnControl != nil {
+			fc.OnControl(msg)
+		}
+	}
+}
+
+// hello handles the other side saying hello. If it's going to compress what
+// it sends, we do the same, saying hello back first if we haven't yet.
+func (fc *framedConn) hello(msg controlMessage) {
+	if !(handshake{Capabilities: msg.Capabilities}).Has(capDeflate) {
+		return
+	}
+	fc.inflate = &inflater{}
+	if !fc.saidHello {
+		fc.WriteControl(controlMessage{Type: "hello", Protocol: protocolVersion, Capabilities: []string{capDeflate}})
+	}
+}
+
+func (fc *framedConn) Write(p []byte) (int, error) {
+	fc.writeLock.Lock()
+	defer fc.writeLock.Unlock()
+	data := p
+	if fc.deflate != nil {
+		data = fc.deflate.compress(p)
+	}
+	messageType := websocket.BinaryMessage
+	if !fc.binary {
+		messageType = websocket.TextMessage
+		if data = fc.text.chunk(data); len(data) == 0 {
+			return len(p), nil
+		}
+	}
+	if err := fc.write(messageType, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (fc *framedConn) write(messageType int, data []byte) error {
+	fc.SetWriteDeadline(time.Now().Add(writeWait))
+	return fc.WriteMessage(messageType, data)
+}
+
+// writeMessage sends a message as it is, for relaying.
+func (fc *framedConn) writeMessage(messageType int, data []byte) error {
+	fc.writeLock.Lock()
+	defer fc.writeLock.Unlock()
+	return fc.write(messageType, data)
+}
+
+func (fc *framedConn) Read(p []byte) (n int, err error) {
+	for len(fc.buf) == 0 {
+		if fc.buf, err = fc.ReadFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, fc.buf)
+	fc.buf = fc.buf[n:]
+	return n, nil
+}
+
+// WriteControl sends a control message. It shadows the websocket's own
+// WriteControl, which is for pings and closes.
+func (fc *framedConn) WriteControl(msg controlMessage) error {
+	if !fc.framing {
+		return nil
+	}
+	fc.writeLock.Lock()
+	defer fc.writeLock.Unlock()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := fc.write(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	if msg.Type == "hello" {
+		fc.saidHello = true
+		if (handshake{Capabilities: msg.Capabilities}).Has(capDeflate) {
+			fc.deflate = newDeflater()
+		}
+	}
+	return nil
+}
+
+// CloseWith says why the connection is being closed before closing it.
+func (fc *framedConn) CloseWith(code int, reason string) error {
+	fc.writeLock.Lock()
+	fc.closedWith = reason
+	fc.writeLock.Unlock()
+	fc.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	return fc.Close()
+}
+
+// ClosedWith is the reason we closed the connection for, or empty if we
+// didn't close it.
+func (fc *framedConn) ClosedWith() string {
+	fc.writeLock.Lock()
+	defer fc.writeLock.Unlock()
+	return fc.closedWith
+}
+
+// hangUp closes a session participant, telling websocket peers why.
+func hangUp(c io.Closer, code int, reason string) {
+	if fc, ok := c.(*framedConn); ok {
+		fc.CloseWith(code, reason)
+		return
+	}
+	c.Close()
+}
+
+// relayFrames copies whole messages from src to dst, which keeps encrypted
+// frames intact on their way through the daemon.
+func relayFrames(dst io.Writer, src *framedConn) error {
+	for {
+		data, err := src.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+	}
+}
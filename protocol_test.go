@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckProtocolRejectsOldClients(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   url.Values
+		ok       bool
+		download string
+	}{
+		{"v0.2.0, which sent no version", url.Values{}, false, "/download/$(uname -s)/$(uname -m) "},
+		{"protocol 1", url.Values{"protocol": {"1"}, "os": {"Linux"}, "arch": {"armv7"}}, false, "/download/Linux/armv7 "},
+		{"current", clientHandshake(), true, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "http://termshare.example.com/brave-otter", strings.NewReader(test.values.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		w := httptest.NewRecorder()
+		if ok := checkProtocol(w, r, parseHandshake(r.Form)); ok != test.ok {
+			t.Errorf("%s: checkProtocol = %v, want %v", test.name, ok, test.ok)
+		}
+		if test.ok {
+			continue
+		}
+		var e apiError
+		json.NewDecoder(w.Body).Decode(&e)
+		if w.Code != http.StatusUpgradeRequired || e.Code != errVersionMismatch {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, w.Code, e.Code, http.StatusUpgradeRequired, errVersionMismatch)
+		}
+		if !strings.Contains(e.Message, test.download) {
+			t.Errorf("%s: message %q doesn't point at %s", test.name, e.Message, test.download)
+		}
+	}
+}
+
+func TestCheckServerProtocol(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"", false},
+		{"1", false},
+		{strconv.Itoa(protocolVersion), true},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if test.header != "" {
+			resp.Header.Set("X-Termshare-Protocol", test.header)
+		}
+		err := checkServerProtocol("termshare.example.com", readHandshake(resp))
+		if (err == nil) != test.ok {
+			t.Errorf("server on protocol %q: error %v", test.header, err)
+		}
+	}
+}
+
+// oldServer stands in for a server that greets a joining client with hello,
+// or with nothing but output, as v0.2.0 did.
+func oldServer(t *testing.T, hello *controlMessage) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if hello == nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("$ "))
+		} else {
+			data, _ := json.Marshal(hello)
+			conn.WriteMessage(websocket.TextMessage, data)
+			conn.WriteMessage(websocket.BinaryMessage, []byte("$ "))
+		}
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestJoinChecksServerProtocol(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello *controlMessage
+		ok    bool
+	}{
+		{"v0.2.0, which said no hello", nil, false},
+		{"protocol 1", &controlMessage{Type: "hello", Protocol: 1}, false},
+		{"current", &controlMessage{Type: "hello", Protocol: protocolVersion}, true},
+	}
+	defer func(s string, n bool) { *server, *notls = s, n }(*server, *notls)
+	for _, test := range tests {
+		srv := oldServer(t, test.hello)
+		*server, *notls = strings.TrimPrefix(srv.URL, "http://"), true
+		conn, err := dialSession("/brave-otter", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := conn.ReadFrame()
+		conn.Close()
+		if _, tooOld := err.(*serverTooOld); tooOld == test.ok {
+			t.Errorf("%s: read %q, %v", test.name, data, err)
+		}
+	}
+}
+
+// term.html can't share the constant, so it has to keep up by hand.
+func TestTermHtmlProtocolVersion(t *testing.T) {
+	want := "var protocolVersion = " + strconv.Itoa(protocolVersion) + ";"
+	if !strings.Contains(string(term_html()), want) {
+		t.Errorf("term.html doesn't say %q", want)
+	}
+}
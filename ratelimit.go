@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per key, for things like sessions created
+// per minute by one address. The rate is looked up on every call so it
+// follows config reloads, and zero means no limit.
+type rateLimiter struct {
+	sync.Mutex
+	perMinute func() int
+	buckets   map[string]*bucket
+	pruned    time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute func() int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token for key, or says how long until there will be one.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	rate := l.perMinute()
+	if rate <= 0 {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	perSecond := float64(rate) / 60
+	if now.Sub(l.pruned) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond >= float64(rate) {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// throttle holds writes back to a number of bytes per second. The wait
+// pushes back on whoever is writing rather than dropping anything.
+type throttle struct {
+	w         io.Writer
+	rate      func() int
+	allowance float64
+	last      time.Time
+}
+
+func newThrottle(w io.Writer, rate func() int) *throttle {
+	return &throttle{w: w, rate: rate}
+}
+
+func (t *throttle) Close() error {
+	return nil
+}
+
+func (t *throttle) Write(p []byte) (int, error) {
+	if rate := float64(t.rate()); rate > 0 {
+		now := time.Now()
+		if t.last.IsZero() {
+			t.allowance = rate
+		} else {
+			t.allowance = math.Min(rate, t.allowance+now.Sub(t.last).Seconds()*rate)
+		}
+		t.last = now
+		t.allowance -= float64(len(p))
+		if t.allowance < 0 {
+			time.Sleep(time.Duration(-t.allowance / rate * float64(time.Second)))
+		}
+	}
+	return t.w.Write(p)
+}
+
+// clientIP is the address a request came from. X-Forwarded-For is only
+// believed when the request came through one of the trusted proxies, and
+// then the last address in it that isn't a trusted proxy is the client.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !fromTrustedProxy(r) {
+		return ip
+	}
+	trusted := settings().TrustedProxies
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !ipIn(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// fromTrustedProxy is whether the request came straight from one of the
+// trusted proxies, so its X-Forwarded headers can be believed.
+func fromTrustedProxy(r *http.Request) bool {
+	trusted := settings().TrustedProxies
+	return len(trusted) > 0 && ipIn(remoteIP(r), trusted)
+}
+
+func ipIn(ip string, networks []string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range networks {
+		if _, network, err := net.ParseCIDR(n); err == nil {
+			if addr != nil && network.Contains(addr) {
+				return true
+			}
+		} else if n == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// limited turns a client away for going too fast, telling it when to come
+// back.
+func limited(w http.ResponseWriter, retry time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	refuse(w, http.StatusTooManyRequests, errRateLimited, message)
+}
+
+// full turns a client away because the server or session is at one of its
+// caps. There's no knowing when room frees up, so the wait is a guess.
+func full(w http.ResponseWriter, retry time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	refuse(w, http.StatusTooManyRequests, errServerFull, message)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// releasePlatforms are the builds `make release` publishes, named
+// <OS>_<arch> as in the tarball names. Keep in sync with the Makefile.
+var releasePlatforms = []string{
+	"Linux_x86_64",
+	"Linux_i386",
+	"Linux_arm64",
+	"Linux_armv7",
+	"Darwin_x86_64",
+	"Darwin_arm64",
+}
+
+// archAliases maps the names uname -m, GOARCH and friends use for an
+// architecture to the one release tarballs use.
+var archAliases = map[string]string{
+	"amd64":   "x86_64",
+	"x64":     "x86_64",
+	"386":     "i386",
+	"i686":    "i386",
+	"x86":     "i386",
+	"aarch64": "arm64",
+	"arm":     "armv7",
+	"armv7l":  "armv7",
+	"armhf":   "armv7",
+}
+
+type build struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	Url  string `json:"url"`
+}
+
+func normalizeOS(name string) string {
+	switch strings.ToLower(name) {
+	case "linux":
+		return "Linux"
+	case "darwin", "macos", "osx":
+		return "Darwin"
+	}
+	return name
+}
+
+func normalizeArch(name string) string {
+	if canonical, ok := archAliases[strings.ToLower(name)]; ok {
+		return canonical
+	}
+	return strings.ToLower(name)
+}
+
+func releaseFile(platform string) string {
+	return "termshare_" + VERSION + "_" + platform + ".tgz"
+}
+
+// localReleases reports whether releases are served from a directory, like
+// the one `make release` creates, instead of a remote mirror.
+func localReleases() bool {
+	info, err := os.Stat(settings().Storage.Releases)
+	return err == nil && info.IsDir()
+}
+
+func availableBuilds(base string) []build {
+	platforms := releasePlatforms
+	if localReleases() {
+		platforms = nil
+		files, _ := filepath.Glob(filepath.Join(settings().Storage.Releases, releaseFile("*")))
+		for _, file := range files {
+			name := strings.TrimPrefix(filepath.Base(file), "termshare_"+VERSION+"_")
+			platforms = append(platforms, strings.TrimSuffix(name, ".tgz"))
+		}
+	}
+	builds := []build{}
+	for _, platform := range platforms {
+		parts := strings.SplitN(platform, "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		builds = append(builds, build{
+			OS:   parts[0],
+			Arch: parts[1],
+			Url:  base + "/download/" + parts[0] + "/" + parts[1],
+		})
+	}
+	return builds
+}
+
+// serveDownload handles /download/<os>/<arch>, with ".sha256" appended for
+// the checksum, by redirecting to the release mirror or serving the file
+// from a local directory. /download/<os> still means x86_64, and /download
+// on its own lists the available builds.
+func serveDownload(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/download"), "/")
+	if path == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version": VERSION,
+			"builds":  availableBuilds(publicUrl(r)),
+		})
+		return
+	}
+	parts := strings.Split(path, "/")
+	arch, suffix := "x86_64", ""
+	if len(parts) > 1 {
+		arch = parts[1]
+	}
+	if strings.HasSuffix(arch, ".sha256") {
+		arch, suffix = strings.TrimSuffix(arch, ".sha256"), ".sha256"
+	}
+	file := releaseFile(normalizeOS(parts[0])+"_"+normalizeArch(arch)) + suffix
+	releases := settings().Storage.Releases
+	if !localReleases() {
+		http.Redirect(w, r, strings.TrimSuffix(releases, "/")+"/"+VERSION+"/"+file, http.StatusFound)
+		return
+	}
+	file = filepath.Join(releases, file)
+	if _, err := os.Stat(file); err != nil {
+		writeError(w, http.StatusNotFound, errNotFound, "no release for "+parts[0]+"/"+arch)
+		return
+	}
+	http.ServeFile(w, r, file)
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// screen follows a session's output the way a terminal would, well enough
+// to redraw it from scratch. It understands the usual xterm cursor, erase,
+// scrolling and color sequences and ignores the rest.
+type screen struct {
+	sync.Mutex
+	cols, rows int
+	lines      [][]cell
+	main       [][]cell
+	x, y       int
+	wrapNext   bool
+	pen        attr
+	saved      cursor
+	top        int
+	bottom     int
+	hidden     bool
+
+	// Scrolled, if set, is called with each line that scrolls off the top
+	// of the main screen.
+	Scrolled func(line []cell)
+	// Committed, if set, is called with the row the cursor leaves on a line
+	// feed on the main screen, before anything scrolls, and whether the line
+	// goes on in the next row because it wrapped.
+	Committed func(y int, wrapped bool)
+
+	state   int
+	params  []byte
+	pending []byte
+}
+
+type cell struct {
+	r rune
+	a attr
+}
+
+// attr is how a cell is drawn. Colors are -1 for the default, 0-255 for
+// the palette, or a 24 bit color with trueColor set.
+type attr struct {
+	fg, bg int32
+	flags  uint8
+}
+
+type cursor struct {
+	x, y int
+	pen  attr
+}
+
+const trueColor = 1 << 24
+
+const (
+	attrBold = 1 << iota
+	attrDim
+	attrItalic
+	attrUnderline
+	attrBlink
+	attrReverse
+	attrHidden
+	attrStrike
+)
+
+// sgrFlags maps SGR parameters to the attributes they turn on. Adding 20
+// turns them off again, except bold which 22 turns off along with dim.
+var sgrFlags = []struct {
+	code int
+	flag uint8
+}{
+	{1, attrBold}, {2, attrDim}, {3, attrItalic}, {4, attrUnderline},
+	{5, attrBlink}, {7, attrReverse}, {8, attrHidden}, {9, attrStrike},
+}
+
+var defaultAttr = attr{fg: -1, bg: -1}
+
+const (
+	stateGround = iota
+	stateEscape
+	stateCharset
+	stateCSI
+	stateString
+	stateStringEscape
+)
+
+// newScreen makes a screen of the given size, or of 80x24 if it doesn't
+// have one, as a recording with no width or height in its header doesn't.
+func newScreen(cols, rows int) *screen {
+	if cols < 1 || rows < 1 {
+		cols, rows = 80, 24
+	}
+	s := &screen{pen: defaultAttr}
+	s.resize(cols, rows)
+	return s
+}
+
+func blankLine(cols int) []cell {
+	line := make([]cell, cols)
+	for i := range line {
+		line[i] = cell{' ', defaultAttr}
+	}
+	return line
+}
+
+func (s *screen) Resize(cols, rows int) {
+	s.Lock()
+	defer s.Unlock()
+	s.resize(cols, rows)
+}
+
+// maxScreenSize caps the columns and rows a screen takes on, so a bogus
+// size doesn't have it allocate more than any terminal has.
+const maxScreenSize = 1000
+
+func (s *screen) resize(cols, rows int) {
+	if cols < 1 || rows < 1 {
+		return
+	}
+	cols, rows = min(cols, maxScreenSize), min(rows, maxScreenSize)
+	resizeLines := func(old [][]cell, scroll bool) [][]cell {
+		if old == nil {
+			old = [][]cell{}
+		}
+		if drop := s.y - rows + 1; drop > 0 && len(old) > drop {
+			if scroll && s.Scrolled != nil {
+				for _, line := range old[:drop] {
+					s.Scrolled(line)
+				}
+			}
+			old = old[drop:]
+		}
+		lines := make([][]cell, rows)
+		for i := range lines {
+			lines[i] = blankLine(cols)
+			if i < len(old) {
+				copy(lines[i], old[i])
+			}
+		}
+		return lines
+	}
+	if s.main != nil {
+		s.main = resizeLines(s.main, false)
+		s.lines = resizeLines(s.lines, false)
+	} else {
+		s.lines = resizeLines(s.lines, true)
+	}
+	if drop := s.y - rows + 1; drop > 0 {
+		s.y -= drop
+		s.saved.y = max(s.saved.y-drop, 0)
+	}
+	s.cols, s.rows = cols, rows
+	s.top, s.bottom = 0, rows-1
+	s.x = min(s.x, cols-1)
+	s.saved.x, s.saved.y = min(s.saved.x, cols-1), min(s.saved.y, rows-1)
+	s.wrapNext = false
+}
+
+// restore puts the cursor back where it was saved, or as near as the
+// screen allows if it has shrunk since.
+func (s *screen) restore() {
+	s.x, s.y, s.pen = min(s.saved.x, s.cols-1), min(s.saved.y, s.rows-1), s.saved.pen
+	s.wrapNext = false
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (s *screen) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, b := range p {
+		s.feed(b)
+	}
+	return len(p), nil
+}
+
+func (s *screen) feed(b byte) {
+	switch s.state {
+	case stateGround:
+		s.ground(b)
+	case stateEscape:
+		s.escape(b)
+	case stateCharset:
+		s.state = stateGround
+	case stateCSI:
+		switch {
+		case b >= 0x30 && b <= 0x3f:
+			s.params = append(s.params, b)
+		case b >= 0x40 && b <= 0x7e:
+			s.state = stateGround
+			s.csi(b)
+		case b == 0x1b:
+			s.state = stateEscape
+		case b < 0x20:
+			s.ground(b)
+		}
+	case stateString:
+		switch b {
+		case 0x07:
+			s.state = stateGround
+		case 0x1b:
+			s.state = stateStringEscape
+		}
+	case stateStringEscape:
+		if b == '\\' {
+			s.state = stateGround
+		} else {
+			s.state = stateString
+		}
+	}
+}
+
+func (s *screen) ground(b byte) {
+	if len(s.pending) > 0 || b >= 0x80 {
+		s.pending = append(s.pending, b)
+		if utf8.FullRune(s.pending) {
+			r, _ := utf8.DecodeRune(s.pending)
+			s.pending = s.pending[:0]
+			s.put(r)
+		}
+		return
+	}
+	switch {
+	case b == 0x1b:
+		s.state = stateEscape
+	case b == '\r':
+		s.x, s.wrapNext = 0, false
+	case b == '\n' || b == '\v' || b == '\f':
+		s.lineFeed(false)
+	case b == '\b':
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrapNext = false
+	case b == '\t':
+		s.x = min((s.x/8+1)*8, s.cols-1)
+	case b >= 0x20 && b < 0x7f:
+		s.put(rune(b))
+	}
+}
+
+func (s *screen) escape(b byte) {
+	s.state = stateGround
+	switch b {
+	case '[':
+		s.state = stateCSI
+		s.params = s.params[:0]
+	case ']', 'P', 'X', '^', '_':
+		s.state = stateString
+	case '(', ')', '*', '+', '#', '%':
+		s.state = stateCharset
+	case '7':
+		s.saved = cursor{s.x, s.y, s.pen}
+	case '8':
+		s.restore()
+	case 'D':
+		s.lineFeed(false)
+	case 'E':
+		s.x = 0
+		s.lineFeed(false)
+	case 'M':
+		if s.y == s.top {
+			s.scrollDown(1)
+		} else if s.y > 0 {
+			s.y--
+		}
+	case 'c':
+		s.reset()
+	}
+}
+
+func (s *screen) reset() {
+	s.lines, s.main = nil, nil
+	s.x, s.y, s.pen, s.saved, s.hidden = 0, 0, defaultAttr, cursor{}, false
+	s.resize(s.cols, s.rows)
+}
+
+func (s *screen) put(r rune) {
+	if s.wrapNext {
+		s.x = 0
+		s.lineFeed(true)
+	}
+	s.lines[s.y][s.x] = cell{r, s.pen}
+	if s.x == s.cols-1 {
+		s.wrapNext = true
+	} else {
+		s.x++
+	}
+}
+
+// lineFeed moves the cursor down a line, or scrolls. wrapped is set when
+// it's because the text ran past the end of the line.
+func (s *screen) lineFeed(wrapped bool) {
+	s.wrapNext = false
+	if s.main == nil && s.Committed != nil {
+		s.Committed(s.y, wrapped)
+	}
+	if s.y == s.bottom {
+		s.scrollUp(1)
+	} else if s.y < s.rows-1 {
+		s.y++
+	}
+}
+
+func (s *screen) scrollUp(n int) {
+	for i := 0; i < n; i++ {
+		if s.top == 0 && s.main == nil && s.Scrolled != nil {
+			s.Scrolled(s.lines[0])
+		}
+		copy(s.lines[s.top:s.bottom], s.lines[s.top+1:s.bottom+1])
+		s.lines[s.bottom] = blankLine(s.cols)
+	}
+}
+
+func (s *screen) scrollDown(n int) {
+	for i := 0; i < n; i++ {
+		copy(s.lines[s.top+1:s.bottom+1], s.lines[s.top:s.bottom])
+		s.lines[s.top] = blankLine(s.cols)
+	}
+}
+
+func (s *screen) erase(y, from, to int) {
+	for x := max(from, 0); x < min(to, s.cols); x++ {
+		s.lines[y][x] = cell{' ', defaultAttr}
+	}
+}
+
+func (s *screen) csi(final byte) {
+	private := len(s.params) > 0 && s.params[0] == '?'
+	var args []int
+	for _, p := range bytes.Split(bytes.TrimLeft(s.params, "?>=<"), []byte(";")) {
+		n, _ := strconv.Atoi(string(bytes.SplitN(p, []byte(":"), 2)[0]))
+		// Anything bigger is no different on any screen, and stops
+		// cursor movement from overflowing.
+		args = append(args, min(n, 1<<16))
+	}
+	arg := func(i, def int) int {
+		if i < len(args) && args[i] > 0 {
+			return args[i]
+		}
+		return def
+	}
+	if final != 'm' {
+		s.wrapNext = false
+	}
+	switch final {
+	case 'A':
+		s.y = max(s.y-arg(0, 1), 0)
+	case 'B':
+		s.y = min(s.y+arg(0, 1), s.rows-1)
+	case 'C':
+		s.x = min(s.x+arg(0, 1), s.cols-1)
+	case 'D':
+		s.x = max(s.x-arg(0, 1), 0)
+	case 'E':
+		s.x, s.y = 0, min(s.y+arg(0, 1), s.rows-1)
+	case 'F':
+		s.x, s.y = 0, max(s.y-arg(0, 1), 0)
+	case 'G', '`':
+		s.x = min(arg(0, 1), s.cols) - 1
+	case 'd':
+		s.y = min(arg(0, 1), s.rows) - 1
+	case 'H', 'f':
+		s.y, s.x = min(arg(0, 1), s.rows)-1, min(arg(1, 1), s.cols)-1
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			s.erase(s.y, s.x, s.cols)
+			for y := s.y + 1; y < s.rows; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		case 1:
+			s.erase(s.y, 0, s.x+1)
+			for y := 0; y < s.y; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		case 2, 3:
+			for y := 0; y < s.rows; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			s.erase(s.y, s.x, s.cols)
+		case 1:
+			s.erase(s.y, 0, s.x+1)
+		case 2:
+			s.erase(s.y, 0, s.cols)
+		}
+	case 'L', 'M':
+		if s.y < s.top || s.y > s.bottom {
+			return
+		}
+		top := s.top
+		s.top = s.y
+		if final == 'L' {
+			s.scrollDown(min(arg(0, 1), s.bottom-s.y+1))
+		} else {
+			s.scrollUpQuietly(min(arg(0, 1), s.bottom-s.y+1))
+		}
+		s.top = top
+	case '@':
+		n := min(arg(0, 1), s.cols-s.x)
+		line := s.lines[s.y]
+		copy(line[s.x+n:], line[s.x:])
+		s.erase(s.y, s.x, s.x+n)
+	case 'P':
+		n := min(arg(0, 1), s.cols-s.x)
+		line := s.lines[s.y]
+		copy(line[s.x:], line[s.x+n:])
+		s.erase(s.y, s.cols-n, s.cols)
+	case 'X':
+		s.erase(s.y, s.x, s.x+arg(0, 1))
+	case 'S':
+		s.scrollUp(min(arg(0, 1), s.rows))
+	case 'T':
+		s.scrollDown(min(arg(0, 1), s.rows))
+	case 'r':
+		top, bottom := arg(0, 1)-1, min(arg(1, s.rows), s.rows)-1
+		if top < bottom {
+			s.top, s.bottom = top, bottom
+			s.x, s.y = 0, 0
+		}
+	case 's':
+		s.saved = cursor{s.x, s.y, s.pen}
+	case 'u':
+		s.restore()
+	case 'h', 'l':
+		if private {
+			s.mode(args, final == 'h')
+		}
+	case 'm':
+		s.sgr(args)
+	}
+}
+
+// scrollUpQuietly deletes lines without them counting as scrolled off.
+func (s *screen) scrollUpQuietly(n int) {
+	scrolled := s.Scrolled
+	s.Scrolled = nil
+	s.scrollUp(n)
+	s.Scrolled = scrolled
+}
+
+func (s *screen) mode(args []int, set bool) {
+	for _, m := range args {
+		switch m {
+		case 25:
+			s.hidden = !set
+		case 47, 1047, 1049:
+			if set && s.main == nil {
+				if m == 1049 {
+					s.saved = cursor{s.x, s.y, s.pen}
+				}
+				s.main = s.lines
+				s.lines = make([][]cell, s.rows)
+				for i := range s.lines {
+					s.lines[i] = blankLine(s.cols)
+				}
+			} else if !set && s.main != nil {
+				s.lines, s.main = s.main, nil
+				if m == 1049 {
+					s.restore()
+				}
+			}
+		}
+	}
+}
+
+func (s *screen) sgr(args []int) {
+	if len(args) == 0 {
+		args = []int{0}
+	}
+	color := func(i int) (int32, int) {
+		if i+1 < len(args) && args[i+1] == 5 && i+2 < len(args) {
+			return int32(args[i+2]), i + 2
+		}
+		if i+1 < len(args) && args[i+1] == 2 && i+4 < len(args) {
+			return trueColor | int32(args[i+2])<<16 | int32(args[i+3])<<8 | int32(args[i+4]), i + 4
+		}
+		return -1, len(args)
+	}
+	for i := 0; i < len(args); i++ {
+		switch n := args[i]; {
+		case n == 0:
+			s.pen = defaultAttr
+		case n == 22:
+			s.pen.flags &^= attrBold | attrDim
+		case n >= 30 && n <= 37:
+			s.pen.fg = int32(n - 30)
+		case n == 38:
+			s.pen.fg, i = color(i)
+		case n == 39:
+			s.pen.fg = -1
+		case n >= 40 && n <= 47:
+			s.pen.bg = int32(n - 40)
+		case n == 48:
+			s.pen.bg, i = color(i)
+		case n == 49:
+			s.pen.bg = -1
+		default:
+			for _, f := range sgrFlags {
+				if n == f.code {
+					s.pen.flags |= f.flag
+				} else if n == f.code+20 {
+					s.pen.flags &^= f.flag
+				}
+			}
+		case n >= 90 && n <= 97:
+			s.pen.fg = int32(n - 90 + 8)
+		case n >= 100 && n <= 107:
+			s.pen.bg = int32(n - 100 + 8)
+		}
+	}
+}
+
+func (a attr) sgr() string {
+	codes := []string{"0"}
+	for _, f := range sgrFlags {
+		if a.flags&f.flag != 0 {
+			codes = append(codes, strconv.Itoa(f.code))
+		}
+	}
+	color := func(c int32, base int) {
+		switch {
+		case c < 0:
+		case c&trueColor != 0:
+			codes = append(codes, strconv.Itoa(base+8)+";2;"+strconv.Itoa(int(c>>16&0xff))+";"+
+				strconv.Itoa(int(c>>8&0xff))+";"+strconv.Itoa(int(c&0xff)))
+		case c < 8:
+			codes = append(codes, strconv.Itoa(base+int(c)))
+		case c < 16:
+			codes = append(codes, strconv.Itoa(base+60+int(c)-8))
+		default:
+			codes = append(codes, strconv.Itoa(base+8)+";5;"+strconv.Itoa(int(c)))
+		}
+	}
+	color(a.fg, 30)
+	color(a.bg, 40)
+	s := "\x1b["
+	for i, c := range codes {
+		if i > 0 {
+			s += ";"
+		}
+		s += c
+	}
+	return s + "m"
+}
+
+// Snapshot is what it takes to draw the screen as it is now on a terminal
+// of the same size, cursor and colors included.
+func (s *screen) Snapshot() []byte {
+	s.Lock()
+	defer s.Unlock()
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[0m\x1b[H\x1b[2J")
+	for y, line := range s.lines {
+		end := len(line)
+		for end > 0 && line[end-1] == (cell{' ', defaultAttr}) {
+			end--
+		}
+		if end == 0 {
+			continue
+		}
+		buf.WriteString("\x1b[" + strconv.Itoa(y+1) + ";1H")
+		pen := defaultAttr
+		for _, c := range line[:end] {
+			if c.a != pen {
+				buf.WriteString(c.a.sgr())
+				pen = c.a
+			}
+			buf.WriteRune(c.r)
+		}
+		buf.WriteString("\x1b[0m")
+	}
+	buf.WriteString("\x1b[" + strconv.Itoa(s.y+1) + ";" + strconv.Itoa(s.x+1) + "H")
+	buf.WriteString(s.pen.sgr())
+	if s.hidden {
+		buf.WriteString("\x1b[?25l")
+	} else {
+		buf.WriteString("\x1b[?25h")
+	}
+	return buf.Bytes()
+}
+
+// lineText is the text of a line without trailing blanks.
+func lineText(line []cell) string {
+	var buf bytes.Buffer
+	for _, c := range line {
+		buf.WriteRune(c.r)
+	}
+	return string(bytes.TrimRight(buf.Bytes(), " "))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Shrinking the screen with the cursor saved near the bottom right, then
+// restoring it, has to leave the cursor on the screen.
+func TestScreenShrinkWithSavedCursor(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+	}{
+		{"DECSC", "\x1b7", "\x1b8"},
+		{"SCOSC", "\x1b[s", "\x1b[u"},
+		{"alt screen 1049", "\x1b[?1049h", "\x1b[?1049l"},
+		{"alt screen 47", "\x1b7\x1b[?47h", "\x1b[?47l\x1b8"},
+		{"alt screen 1047", "\x1b[s\x1b[?1047h", "\x1b[?1047l\x1b[u"},
+	}
+	for _, test := range tests {
+		s := newScreen(80, 24)
+		s.Write([]byte("\x1b[24;80H" + test.before + "\x1b[24;80H"))
+		s.Resize(40, 12)
+		s.Write([]byte(test.after))
+		if s.x >= s.cols || s.y >= s.rows {
+			t.Errorf("%s: cursor at %d,%d on a %dx%d screen", test.name, s.x, s.y, s.cols, s.rows)
+			continue
+		}
+		s.Write([]byte("x\r\nmore"))
+		if s.y >= s.rows {
+			t.Errorf("%s: cursor row %d on a %d row screen", test.name, s.y, s.rows)
+		}
+	}
+}
+
+func TestScreenShrinkKeepsSavedRowWithText(t *testing.T) {
+	s := newScreen(80, 24)
+	s.Write([]byte("\x1b[20;1Hsaved\x1b7\x1b[24;1H"))
+	s.Resize(80, 12)
+	s.Write([]byte("\x1b8!"))
+	if got := lineText(s.lines[s.y]); got != "saved!" {
+		t.Errorf("restored onto %q, want the saved line", got)
+	}
+}
+
+// A transcriber's screen shrinking while the alternate screen is up, as
+// an "r" event in a recording can do, mustn't stop the transcript.
+func TestTranscriberShrinkOnAltScreen(t *testing.T) {
+	var out strings.Builder
+	tr := newTranscriber(&out, 80, 24)
+	tr.Write([]byte("before\r\n\x1b[24;80H\x1b[?1049hfull screen"))
+	tr.screen.Resize(40, 12)
+	tr.Write([]byte("\x1b[?1049lafter\r\n"))
+	tr.Flush()
+	if !strings.Contains(out.String(), "before\n") || !strings.Contains(out.String(), "after\n") {
+		t.Errorf("transcript is %q", out.String())
+	}
+}
+
+// Whatever the output or size, the screen has to keep up without panicking,
+// since nothing recovers from it.
+func TestScreenSurvivesHostileOutput(t *testing.T) {
+	outputs := []string{
+		"\x1b[9223372036854775807B\x1b[9223372036854775807Cx",
+		"\x1b[5;5H\x1b[9223372036854775807E\x1b[9223372036854775807@x",
+		"\x1b[99999;99999H\x1b[99999Px\x1b[99999X\x1b[99999L\x1b[99999M",
+		"\x1b[99999S\x1b[99999T\x1b[5;99999r\x1b[99999;2r\x1bM\x1bD\x1bE",
+		"\x1b[?1049h\x1b[?47h\x1bc\x1b[?1049l\x1b8\x1b[u",
+		"\t\t\t\t\t\t\t\t\t\t\t\t\b\b\x1b[38;2;999;999;999m\x1b[48;5m\x1b[38;2m",
+		"\xe2\x82\x1b[2J\xf0\x9f\x98\x80\xff\x80",
+	}
+	sizes := [][2]int{{80, 24}, {1, 1}, {0, 0}, {-5, 3}, {1 << 30, 1 << 30}}
+	for _, size := range sizes {
+		for _, output := range outputs {
+			s := newScreen(size[0], size[1])
+			s.Write([]byte(output))
+			s.Resize(size[1], size[0])
+			s.Write([]byte(output))
+			if s.x < 0 || s.x >= s.cols || s.y < 0 || s.y >= s.rows {
+				t.Errorf("%q at %v: cursor at %d,%d on a %dx%d screen", output, size, s.x, s.y, s.cols, s.rows)
+			}
+			s.Snapshot()
+		}
+	}
+}
+
+// Recordings don't always say how big the terminal was.
+func TestTranscriberWithoutSize(t *testing.T) {
+	var out strings.Builder
+	tr := newTranscriber(&out, 0, 0)
+	tr.Write([]byte("hello\r\nworld"))
+	tr.Flush()
+	if out.String() != "hello\nworld\n" {
+		t.Errorf("transcript is %q", out.String())
+	}
+}
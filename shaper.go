@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// shaper sits between a pilot and everyone following the session. Output
+// is gathered up and sent on a short tick, so a flood goes out in a few
+// large messages instead of thousands of tiny ones, and held to the
+// session's bytes per second. When output piles up faster than it can be
+// sent, the backlog is dropped and viewers are sent a snapshot of the
+// screen instead, so they skip ahead to what the pilot is looking at.
+// Without a screen, as for encrypted output, it only gathers output up,
+// and holds the writer back once max_backlog is waiting so a slow link
+// pushes back on the pty instead of piling output up in memory.
+type shaper struct {
+	sync.Mutex
+	w         io.Writer
+	screen    *screen
+	rate      func() int
+	pending   []byte
+	room      *sync.Cond
+	allowance float64
+	last      time.Time
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newShaper(w io.Writer, screen *screen, rate func() int) *shaper {
+	s := &shaper{w: w, screen: screen, rate: rate,
+		wake: make(chan struct{}, 1), done: make(chan struct{}), stopped: make(chan struct{})}
+	s.room = sync.NewCond(&s.Mutex)
+	go s.run()
+	return s
+}
+
+func (s *shaper) Write(p []byte) (int, error) {
+	if s.screen != nil {
+		s.screen.Write(p)
+	}
+	s.Lock()
+	if s.screen == nil {
+		for backlog := settings().Output.MaxBacklog; backlog > 0 && len(s.pending) >= backlog; {
+			s.room.Wait()
+		}
+	}
+	s.pending = append(s.pending, p...)
+	s.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (s *shaper) run() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			s.flush()
+			return
+		}
+		for {
+			select {
+			case <-time.After(settings().CoalesceTick()):
+			case <-s.done:
+				s.flush()
+				return
+			}
+			if !s.send() {
+				break
+			}
+		}
+	}
+}
+
+// send writes out what take hands out, and says whether anything was
+// waiting.
+func (s *shaper) send() bool {
+	data := s.take()
+	if data == nil {
+		return false
+	}
+	if len(data) > 0 {
+		s.w.Write(data)
+	}
+	return true
+}
+
+// flush sends everything pending regardless of the rate.
+func (s *shaper) flush() {
+	s.Lock()
+	data := s.pending
+	s.pending = nil
+	s.room.Broadcast()
+	s.Unlock()
+	if len(data) > 0 {
+		s.w.Write(data)
+	}
+}
+
+// take hands out what can be sent now, which may be nothing until the rate
+// allows more, or nil when nothing is waiting.
+func (s *shaper) take() []byte {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	defer s.room.Broadcast()
+	rate := float64(s.rate())
+	backlog := settings().Output.MaxBacklog
+	flooded := rate > 0 && float64(len(s.pending)) > 2*rate || backlog > 0 && len(s.pending) > backlog
+	if flooded && s.screen != nil {
+		s.pending = nil
+		s.allowance = 0
+		metrics.Snapshots.Inc("")
+		return s.screen.Snapshot()
+	}
+	if rate <= 0 {
+		data := s.pending
+		s.pending = nil
+		return data
+	}
+	now := time.Now()
+	if s.last.IsZero() {
+		s.allowance = rate
+	} else {
+		s.allowance = math.Min(rate, s.allowance+now.Sub(s.last).Seconds()*rate)
+	}
+	s.last = now
+	n := int(math.Min(s.allowance, float64(len(s.pending))))
+	if n < 1 {
+		return []byte{}
+	}
+	s.allowance -= float64(n)
+	data := s.pending[:n:n]
+	s.pending = s.pending[n:]
+	return data
+}
+
+// Close sends whatever is left and stops the shaper.
+func (s *shaper) Close() error {
+	close(s.done)
+	<-s.stopped
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// slowLink takes output slower than the pty makes it, like a pilot's
+// uplink during a big cat.
+type slowLink struct {
+	got bytes.Buffer
+}
+
+func (l *slowLink) Write(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return l.got.Write(p)
+}
+
+func TestShaperHoldsBackWritersWithoutScreen(t *testing.T) {
+	c := defaultConfig()
+	c.Output.MaxBacklog = 4096
+	withConfig(t, c)
+	link := &slowLink{}
+	s := newShaper(link, nil, func() int { return 0 })
+
+	var sent bytes.Buffer
+	var waiting int
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	for i := 0; i < 200; i++ {
+		chunk[0] = byte(i)
+		s.Write(chunk)
+		sent.Write(chunk)
+		s.Lock()
+		if len(s.pending) > waiting {
+			waiting = len(s.pending)
+		}
+		s.Unlock()
+	}
+	s.Close()
+	if !bytes.Equal(link.got.Bytes(), sent.Bytes()) {
+		t.Errorf("sent %d bytes, %d arrived", sent.Len(), link.got.Len())
+	}
+	if max := c.Output.MaxBacklog + len(chunk); waiting > max {
+		t.Errorf("%d bytes waiting, want at most %d", waiting, max)
+	}
+}
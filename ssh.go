@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// With ssh.listen set the daemon also takes viewers and copilots over SSH,
+// so joining a session is just
+//
+//	ssh -p 2222 <session-name>@<server>
+//
+// Anyone can view a session that way, the same as with its Session URL.
+// Clients with a key listed in ssh.authorized_keys that also give the
+// session's copilot token, as <session-name>+<token>, join as copilot
+// instead, if nobody is in the seat. Only sessions piloted through this
+// node can be joined.
+func serveSSH(c *config, sessions *sessions, joinRate *rateLimiter) {
+	hostKey, err := sshHostKey(c.SSH.HostKey)
+	if err != nil {
+		fatal(1, "unable to load ssh host key:", err)
+	}
+	listener, err := net.Listen("tcp", c.SSH.Listen)
+	if err != nil {
+		fatal(1, "unable to listen for ssh:", err)
+	}
+	serverLog.Info("ssh server started", "listen", c.SSH.Listen,
+		"fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	acceptSSH(listener, sshConfig(hostKey), sessions, joinRate)
+}
+
+func sshConfig(hostKey ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: sshPublicKey,
+		// Viewers don't need a key. Asking them no questions lets clients
+		// without one in, and clients with keys that aren't listed end up
+		// here once they've tried them all.
+		KeyboardInteractiveCallback: func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+		ServerVersion: "SSH-2.0-termshare",
+	}
+	config.AddHostKey(hostKey)
+	return config
+}
+
+func acceptSSH(listener net.Listener, config *ssh.ServerConfig, sessions *sessions, joinRate *rateLimiter) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverLog.Error("ssh server stopped", "error", err)
+			return
+		}
+		go handleSSH(conn, config, sessions, joinRate)
+	}
+}
+
+// sshHostKey loads the server's host key, or makes one up that lasts until
+// the daemon restarts, which clients will complain about every time.
+func sshHostKey(path string) (ssh.Signer, error) {
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKey(data)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serverLog.Warn("no ssh host key configured, using a new one until restart")
+	return ssh.NewSignerFromKey(key)
+}
+
+var errKeyNotAuthorized = errors.New("key not authorized")
+
+// sshPublicKey lets in keys listed in ssh.authorized_keys, to join as
+// copilot. The file is read on every try, so it can change any time.
+func sshPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	path := settings().SSH.AuthorizedKeys
+	if path == "" {
+		return nil, errKeyNotAuthorized
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		serverLog.Warn("unable to read ssh authorized keys", "path", path, "error", err)
+		return nil, errKeyNotAuthorized
+	}
+	for len(data) > 0 {
+		listed, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(listed.Marshal(), key.Marshal()) {
+			fingerprint := ssh.FingerprintSHA256(key)
+			return &ssh.Permissions{Extensions: map[string]string{"copilot": fingerprint}}, nil
+		}
+		data = rest
+	}
+	return nil, errKeyNotAuthorized
+}
+
+func handleSSH(conn net.Conn, config *ssh.ServerConfig, sessions *sessions, joinRate *rateLimiter) {
+	defer conn.Close()
+	l := serverLog.With("remote_addr", conn.RemoteAddr().String())
+	timeout := settings().PeerTimeout()
+	conn.SetDeadline(time.Now().Add(timeout))
+	sconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		l.Debug("ssh handshake failed", "error", err)
+		return
+	}
+	defer sconn.Close()
+	conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+	go sshKeepAlive(sconn, conn, timeout)
+	name, _ := sshUser(sconn.User())
+	l = l.With("session", name, "transport", transportSSH)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only shells are supported")
+			continue
+		}
+		ch, chRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		term := &sshTerm{newTermViewer(ch), ch}
+		if term.waitForShell(chRequests, timeout) {
+			ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			term.join(sconn, sessions, joinRate, ip, l)
+		}
+		ch.Close()
+		// Give the client a moment to hang up itself, so it doesn't report
+		// the connection as lost.
+		time.AfterFunc(writeWait, func() { sconn.Close() })
+		sconn.Wait()
+		return
+	}
+}
+
+// sshKeepAlive checks on the client every so often, the way websocket
+// pings do, so a connection that died quietly doesn't linger.
+func sshKeepAlive(sconn *ssh.ServerConn, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		time.Sleep(timeout / 3)
+		if _, _, err := sconn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// sshTerm is a viewer or copilot on the other end of an SSH channel. The
+// channel closing, which closes closed, is how we hear about the client
+// leaving; its input ending only means there's no more.
+type sshTerm struct {
+	*termViewer
+	ch ssh.Channel
+}
+
+// waitForShell handles the channel's requests, and says whether the client
+// asked for a shell before giving up. Anything else, like running a
+// command, is turned down.
+func (t *sshTerm) waitForShell(requests <-chan *ssh.Request, timeout time.Duration) bool {
+	shell := make(chan bool, 1)
+	answer := func(ok bool) {
+		select {
+		case shell <- ok:
+		default:
+		}
+	}
+	go func() {
+		for req := range requests {
+			switch req.Type {
+			case "pty-req":
+				var pty struct {
+					Term                      string
+					Cols, Rows, Width, Height uint32
+					Modes                     string
+				}
+				ok := ssh.Unmarshal(req.Payload, &pty) == nil
+				if ok {
+					t.window(int(pty.Cols), int(pty.Rows))
+				}
+				req.Reply(ok, nil)
+			case "window-change":
+				var size struct{ Cols, Rows, Width, Height uint32 }
+				if ssh.Unmarshal(req.Payload, &size) == nil {
+					t.window(int(size.Cols), int(size.Rows))
+				}
+			case "shell":
+				req.Reply(true, nil)
+				answer(true)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+		answer(false)
+		close(t.closed)
+	}()
+	select {
+	case ok := <-shell:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// sshUser splits the SSH user into the session name and, if there is one,
+// the copilot token after a +.
+func sshUser(user string) (name, token string) {
+	if i := strings.Index(user, "+"); i >= 0 {
+		return user[:i], user[i+1:]
+	}
+	return user, ""
+}
+
+// join puts the client in the session the SSH user names, the same way
+// ServeHTTP does for websockets. Having an authorized key isn't enough to
+// take the copilot seat of a stranger's session, the session's copilot
+// token is needed too.
+func (t *sshTerm) join(sconn *ssh.ServerConn, sessions *sessions, joinRate *rateLimiter, ip string, l *logger) {
+	name, token := sshUser(sconn.User())
+	session, err := sessions.Get(name)
+	key := sconn.Permissions.Extensions["copilot"]
+	if key != "" && err == nil && session.Pilot != nil && !session.Encrypted &&
+		session.AllowCopilot && session.Copilot == nil && session.isCopilotToken(token) {
+		session.Copilot = t
+		session.CopilotBuffer.w = t
+		session.Pilot.Write([]byte("\x07")) // ding!
+		if session.Size != nil {
+			t.WriteControl(*session.Size)
+		}
+		l = l.With("role", "copilot", "key", key)
+		l.Info("connected")
+		started := time.Now()
+		go io.Copy(countingWriter{session.Pilot, "input"}, t.ch)
+		reason := t.pump(session.EOF)
+		session.Copilot = nil
+		session.CopilotBuffer.w = nil
+		t.exit(0)
+		l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+		return
+	}
+	if code, message := refuseViewer(session, err, joinRate, ip); code != "" {
+		t.refuse(code, message)
+		t.exit(1)
+		return
+	}
+	go t.readKeys()
+	session.watch(t.termViewer, transportSSH, l)
+	t.exit(0)
+}
+
+func (t *sshTerm) exit(status uint32) {
+	t.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// readKeys lets a viewer leave with ctrl-c, ctrl-d or q, since there's
+// nothing else for their keys to do.
+func (t *sshTerm) readKeys() {
+	buf := make([]byte, 256)
+	for {
+		n, err := t.ch.Read(buf)
+		if leaving(buf[:n]) {
+			t.exit(0)
+			t.ch.Close()
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *sshTerm) Read(p []byte) (int, error) {
+	return t.ch.Read(p)
+}
+
+func (t *sshTerm) Close() error {
+	return t.ch.Close()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHUser(t *testing.T) {
+	tests := []struct{ user, name, token string }{
+		{"brave-otter", "brave-otter", ""},
+		{"brave-otter+abc123", "brave-otter", "abc123"},
+		{"brave-otter+", "brave-otter", ""},
+	}
+	for _, test := range tests {
+		if name, token := sshUser(test.user); name != test.name || token != test.token {
+			t.Errorf("sshUser(%q) = %q, %q, want %q, %q", test.user, name, token, test.name, test.token)
+		}
+	}
+}
+
+func TestCopilotToken(t *testing.T) {
+	session := newSession("brave-otter", true, false, false)
+	if !session.isCopilotToken(session.CopilotToken) {
+		t.Error("the session's own token was turned down")
+	}
+	for _, token := range []string{"", "nope", session.CopilotToken[1:]} {
+		if session.isCopilotToken(token) {
+			t.Errorf("token %q was taken", token)
+		}
+	}
+	if newSession("no-copilot", false, false, false).isCopilotToken("") {
+		t.Error("an empty token was taken for a session without a copilot")
+	}
+}
+
+// sshServer serves sessions over SSH on a port of its own, with a host key
+// made up for the test and key in ssh.authorized_keys.
+func sshServer(t *testing.T, sessions *sessions, key ssh.PublicKey) string {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.SSH.AuthorizedKeys = path
+	withConfig(t, c)
+	hostKey, err := sshHostKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go acceptSSH(listener, sshConfig(hostKey), sessions, newRateLimiter(func() int { return 0 }))
+	return listener.Addr().String()
+}
+
+func sshSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func noQuestions(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	return nil, nil
+}
+
+// sshShell logs in as user and starts a shell, handing back what the
+// server sends it as it comes.
+func sshShell(t *testing.T, addr, user string, auth ...ssh.AuthMethod) (io.Writer, <-chan string) {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	shell, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := shell.StdinPipe()
+	stdout, _ := shell.StdoutPipe()
+	if err := shell.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	return stdin, reads(stdout)
+}
+
+func reads(r io.Reader) <-chan string {
+	got := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				got <- string(buf[:n])
+			}
+			if err != nil {
+				close(got)
+				return
+			}
+		}
+	}()
+	return got
+}
+
+func waitFor(t *testing.T, got <-chan string, want string) {
+	var all string
+	timeout := time.After(5 * time.Second)
+	for !strings.Contains(all, want) {
+		select {
+		case s, ok := <-got:
+			if !ok {
+				t.Fatalf("connection closed after %q, waiting for %q", all, want)
+			}
+			all += s
+		case <-timeout:
+			t.Fatalf("got %q, waiting for %q", all, want)
+		}
+	}
+}
+
+func TestSSHServer(t *testing.T) {
+	s := &sessions{s: make(map[string]*session)}
+	session, _ := s.Create("brave-otter", "192.0.2.1", true, false, false)
+	pilot, pilotEnd := net.Pipe()
+	session.Pilot = pilot
+	typed := reads(pilotEnd)
+	defer close(session.EOF)
+	listed, unlisted := sshSigner(t), sshSigner(t)
+	addr := sshServer(t, s, listed.PublicKey())
+
+	// Anyone can watch.
+	_, output := sshShell(t, addr, "brave-otter", ssh.KeyboardInteractive(noQuestions))
+	for session.Viewers.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	session.Viewers.Write([]byte("hello from the pilot"))
+	waitFor(t, output, "hello from the pilot")
+
+	// A key that isn't listed is refused, and with nothing else to try
+	// the client can't log in.
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "brave-otter+" + session.CopilotToken,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(unlisted)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("logged in with a key that isn't authorized")
+	}
+
+	// Falling back to no key at all, it only gets to watch, token or not.
+	keys, output := sshShell(t, addr, "brave-otter+"+session.CopilotToken,
+		ssh.PublicKeys(unlisted), ssh.KeyboardInteractive(noQuestions))
+	for session.Viewers.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	keys.Write([]byte("x"))
+	session.Viewers.Write([]byte("still watching"))
+	waitFor(t, output, "still watching")
+	select {
+	case s := <-typed:
+		t.Fatalf("a viewer without an authorized key typed %q to the pilot", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A listed key with the token takes the copilot seat.
+	keys, _ = sshShell(t, addr, "brave-otter+"+session.CopilotToken, ssh.PublicKeys(listed))
+	waitFor(t, typed, "\x07")
+	keys.Write([]byte("ls\n"))
+	waitFor(t, typed, "ls\n")
+}
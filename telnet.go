@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// With telnet.listen set the daemon also takes viewers over plain TCP, for
+// machines with nothing better than nc or telnet. The first line a client
+// sends names the session, or is its Session URL, and from then on it gets
+// the session's output. Clients that turn out to speak telnet, by ending
+// that line with CR LF or sending commands, are asked for their window size
+// (NAWS, RFC 1073) and put in character mode so their keys aren't echoed.
+func serveTelnet(c *config, sessions *sessions, joinRate *rateLimiter) {
+	listener, err := net.Listen("tcp", c.Telnet.Listen)
+	if err != nil {
+		fatal(1, "unable to listen for telnet:", err)
+	}
+	serverLog.Info("telnet server started", "listen", c.Telnet.Listen)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverLog.Error("telnet server stopped", "error", err)
+			return
+		}
+		go handleTelnet(conn, sessions, joinRate)
+	}
+}
+
+func handleTelnet(conn net.Conn, sessions *sessions, joinRate *rateLimiter) {
+	defer conn.Close()
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	l := serverLog.With("remote_addr", conn.RemoteAddr().String(), "transport", transportTelnet)
+	tc := &telnetConn{Conn: conn}
+	term := newTermViewer(tc)
+	tc.window = term.window
+	in := bufio.NewReaderSize(tc, 256)
+	conn.SetReadDeadline(time.Now().Add(settings().PeerTimeout()))
+	line, err := in.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		term.refuse(errInvalidName, "the first line should be a session name")
+		return
+	} else if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if tc.sawCommand || bytes.HasSuffix(line, []byte("\r\n")) {
+		tc.start()
+	}
+	name := telnetSessionName(string(line))
+	l = l.With("session", name)
+	session, err := sessions.Get(name)
+	if code, message := refuseViewer(session, err, joinRate, ip); code != "" {
+		term.refuse(code, message)
+		return
+	}
+	go func() {
+		// Input running out doesn't mean the client is gone, nc closes its
+		// side once its stdin ends. A write failing tells us that.
+		buf := make([]byte, 256)
+		for {
+			n, err := in.Read(buf)
+			if leaving(buf[:n]) || err != nil && err != io.EOF {
+				close(term.closed)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	session.watch(term, transportTelnet, l)
+}
+
+// telnetSessionName takes the session name out of the first line, which
+// may be the whole Session URL.
+func telnetSessionName(line string) string {
+	name := strings.Trim(line, " \t\r\n\x00")
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Telnet commands and options we deal in.
+const (
+	telnetSE   = 240
+	telnetIP   = 244
+	telnetSB   = 250
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIAC  = 255
+
+	telnetEcho = 1
+	telnetSGA  = 3
+	telnetNAWS = 31
+)
+
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+// telnetConn takes telnet commands out of what a client sends, answering
+// them and passing on window sizes, and once it knows the client speaks
+// telnet, escapes the IAC bytes in what it's sent.
+type telnetConn struct {
+	net.Conn
+	window     func(cols, rows int)
+	sawCommand bool
+	started    bool
+	askedSize  bool
+
+	state int
+	verb  byte
+	sub   []byte
+}
+
+// start asks the client for its window size and tells it we'll do the
+// echoing, which we don't, and that it needn't wait for go aheads.
+func (tc *telnetConn) start() {
+	tc.started = true
+	commands := []byte{telnetIAC, telnetWill, telnetEcho, telnetIAC, telnetWill, telnetSGA}
+	if !tc.askedSize {
+		tc.askedSize = true
+		commands = append([]byte{telnetIAC, telnetDo, telnetNAWS}, commands...)
+	}
+	tc.Conn.Write(commands)
+}
+
+func (tc *telnetConn) Write(p []byte) (int, error) {
+	data := p
+	if tc.started {
+		data = bytes.Replace(p, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)
+	}
+	tc.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := tc.Conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (tc *telnetConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for {
+		n, err := tc.Conn.Read(buf)
+		data := p[:0]
+		for _, b := range buf[:n] {
+			data = tc.feed(b, data)
+		}
+		if len(data) > 0 || err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// feed handles a byte from the client, adding it to data unless it's part
+// of a command. An interrupt comes through as ctrl-c.
+func (tc *telnetConn) feed(b byte, data []byte) []byte {
+	switch tc.state {
+	case telnetData:
+		if b == telnetIAC {
+			tc.state = telnetCommand
+			tc.sawCommand = true
+		} else {
+			data = append(data, b)
+		}
+	case telnetCommand:
+		tc.state = telnetData
+		switch b {
+		case telnetIAC:
+			data = append(data, b)
+		case telnetIP:
+			data = append(data, 0x03)
+		case telnetSB:
+			tc.state = telnetSub
+			tc.sub = tc.sub[:0]
+		case telnetWill, telnetWont, telnetDo, telnetDont:
+			tc.state = telnetOption
+			tc.verb = b
+		}
+	case telnetOption:
+		tc.state = telnetData
+		tc.negotiate(tc.verb, b)
+	case telnetSub:
+		if b == telnetIAC {
+			tc.state = telnetSubIAC
+		} else if len(tc.sub) < 64 {
+			tc.sub = append(tc.sub, b)
+		}
+	case telnetSubIAC:
+		tc.state = telnetSub
+		if b == telnetSE {
+			tc.state = telnetData
+			tc.subnegotiation()
+		} else if b == telnetIAC && len(tc.sub) < 64 {
+			tc.sub = append(tc.sub, b)
+		}
+	}
+	return data
+}
+
+// negotiate answers the client offering or asking for an option. Only
+// NAWS, echo and suppressing go aheads are agreed to; those are what we
+// ask for ourselves, so the client saying yes to them needs no answer.
+func (tc *telnetConn) negotiate(verb, option byte) {
+	switch {
+	case verb == telnetWill && option == telnetNAWS:
+		if !tc.askedSize {
+			tc.askedSize = true
+			tc.Conn.Write([]byte{telnetIAC, telnetDo, telnetNAWS})
+		}
+	case verb == telnetDo && (option == telnetEcho || option == telnetSGA):
+	case verb == telnetWill:
+		tc.Conn.Write([]byte{telnetIAC, telnetDont, option})
+	case verb == telnetDo:
+		tc.Conn.Write([]byte{telnetIAC, telnetWont, option})
+	}
+}
+
+func (tc *telnetConn) subnegotiation() {
+	if len(tc.sub) == 5 && tc.sub[0] == telnetNAWS && tc.window != nil {
+		cols := int(tc.sub[1])<<8 | int(tc.sub[2])
+		rows := int(tc.sub[3])<<8 | int(tc.sub[4])
+		tc.window(cols, rows)
+	}
+}
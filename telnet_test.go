@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// splitConn hands over what the client sent a piece per Read, the way
+// commands get split across packets, and keeps what's written back.
+type splitConn struct {
+	net.Conn
+	reads   []string
+	written bytes.Buffer
+}
+
+func (c *splitConn) Read(p []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.reads[0])
+	if c.reads[0] = c.reads[0][n:]; c.reads[0] == "" {
+		c.reads = c.reads[1:]
+	}
+	return n, nil
+}
+
+func (c *splitConn) Write(p []byte) (int, error)        { return c.written.Write(p) }
+func (c *splitConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestTelnetConnRead(t *testing.T) {
+	type size struct{ cols, rows int }
+	tests := []struct {
+		name    string
+		reads   []string
+		data    string
+		sizes   []size
+		replies string
+	}{
+		{"plain", []string{"brave-otter\n"}, "brave-otter\n", nil, ""},
+		{"doubled IAC", []string{"a\xff\xffb"}, "a\xffb", nil, ""},
+		{"doubled IAC split", []string{"a\xff", "\xffb"}, "a\xffb", nil, ""},
+		{"interrupt", []string{"\xff", "\xf4"}, "\x03", nil, ""},
+		{"NAWS", []string{"x\xff\xfa\x1f\x00\x78\x00\x28\xff\xf0y"}, "xy", []size{{120, 40}}, ""},
+		{"NAWS split mid-sequence", []string{"x\xff", "\xfa\x1f\x00", "\x78\x00", "\x28\xff", "\xf0y"}, "xy", []size{{120, 40}}, ""},
+		{"NAWS with an escaped 255", []string{"\xff\xfa\x1f\x00\xff", "\xff\x00\x18\xff\xf0"}, "", []size{{255, 24}}, ""},
+		{"short NAWS", []string{"\xff\xfa\x1f\x00\x50\xff\xf0z"}, "z", nil, ""},
+		{"other subnegotiation", []string{"\xff\xfa\x18\x00xterm\xff\xf0z"}, "z", nil, ""},
+		{"will NAWS", []string{"\xff\xfb\x1f", "z"}, "z", nil, "\xff\xfd\x1f"},
+		{"do echo", []string{"\xff\xfd\x01z"}, "z", nil, ""},
+		{"will terminal type", []string{"\xff\xfb\x18z"}, "z", nil, "\xff\xfe\x18"},
+		{"do terminal type", []string{"\xff\xfd", "\x18z"}, "z", nil, "\xff\xfc\x18"},
+	}
+	for _, test := range tests {
+		conn := &splitConn{reads: test.reads}
+		var sizes []size
+		tc := &telnetConn{Conn: conn, window: func(cols, rows int) {
+			sizes = append(sizes, size{cols, rows})
+		}}
+		var data []byte
+		buf := make([]byte, 256)
+		for {
+			n, err := tc.Read(buf)
+			data = append(data, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		if string(data) != test.data {
+			t.Errorf("%s: read %q, want %q", test.name, data, test.data)
+		}
+		if len(sizes) != len(test.sizes) || len(sizes) > 0 && sizes[0] != test.sizes[0] {
+			t.Errorf("%s: window sizes %v, want %v", test.name, sizes, test.sizes)
+		}
+		if conn.written.String() != test.replies {
+			t.Errorf("%s: replied %q, want %q", test.name, conn.written.String(), test.replies)
+		}
+		if tc.sawCommand != (test.name != "plain") {
+			t.Errorf("%s: sawCommand = %v", test.name, tc.sawCommand)
+		}
+	}
+}
+
+func TestTelnetConnWrite(t *testing.T) {
+	conn := &splitConn{}
+	tc := &telnetConn{Conn: conn}
+	tc.Write([]byte("a\xffb"))
+	if got := conn.written.String(); got != "a\xffb" {
+		t.Errorf("before telnet started, wrote %q", got)
+	}
+
+	conn.written.Reset()
+	tc.start()
+	if got, want := conn.written.String(), "\xff\xfd\x1f\xff\xfb\x01\xff\xfb\x03"; got != want {
+		t.Errorf("start sent %q, want %q", got, want)
+	}
+	conn.written.Reset()
+	if n, _ := tc.Write([]byte("a\xffb\xff")); n != 4 {
+		t.Errorf("Write returned %d, want 4", n)
+	}
+	if got := conn.written.String(); got != "a\xff\xffb\xff\xff" {
+		t.Errorf("after telnet started, wrote %q", got)
+	}
+}
+
+func TestTelnetSessionName(t *testing.T) {
+	tests := []struct {
+		line, name string
+	}{
+		{"brave-otter\n", "brave-otter"},
+		{"brave-otter\r\n", "brave-otter"},
+		{"  brave-otter \x00\r\n", "brave-otter"},
+		{"https://termshare.example.com/brave-otter\r\n", "brave-otter"},
+		{"termshare.example.com/brave-otter?format=text#end\n", "brave-otter"},
+		{"\r\n", ""},
+	}
+	for _, test := range tests {
+		if name := telnetSessionName(test.line); name != test.name {
+			t.Errorf("telnetSessionName(%q) = %q, want %q", test.line, name, test.name)
+		}
+	}
+}
@@ -9,2864 +9,3039 @@ import (
 // term_html returns raw, uncompressed file data.
 func term_html() []byte {
 	gz, err := gzip.NewReader(bytes.NewBuffer([]byte{
-0x1f,0x8b,0x08,0x00,0x00,0x09,0x6e,0x88,0x00,0xff,0xec,0xfd,
-0xfb,0x7f,0x1b,0x37,0xae,0x38,0x80,0xfe,0xee,0xbf,0x82,0xcd,
-0xee,0xa9,0xe4,0x46,0x92,0x25,0xf9,0x11,0x3f,0xf2,0x38,0x8e,
-0xed,0x34,0xde,0xfa,0x75,0x2c,0x27,0x6d,0x8f,0x37,0xdb,0x8e,
-0xa4,0x91,0x3d,0x89,0xa4,0x51,0x67,0x46,0xb6,0xb5,0x6d,0xfa,
-0xb7,0x5f,0x00,0x7c,0x73,0x38,0xd2,0xc8,0x49,0xf7,0x7b,0x3e,
-0xf7,0x5e,0xb7,0xb1,0x25,0x3e,0x40,0x10,0x04,0x49,0x10,0x00,
-0xc1,0xe7,0xdf,0xf4,0xe3,0x5e,0x36,0x9b,0x84,0xec,0x36,0x1b,
-0x0d,0x5f,0xae,0x3c,0x4f,0xb3,0xd9,0x30,0x7c,0xb9,0xc2,0x58,
-0x37,0xee,0xcf,0xd8,0xef,0xac,0x1b,0xf4,0x3e,0xdd,0x24,0xf1,
-0x74,0xdc,0xdf,0x65,0x7f,0x6b,0x36,0x9b,0x7b,0xec,0x33,0x64,
-0x36,0xb2,0x30,0x19,0x45,0xe3,0x60,0x08,0x25,0x06,0xf1,0x38,
-0xab,0xa7,0xd1,0xbf,0xc3,0x5d,0xd6,0xda,0x9a,0x3c,0x60,0x81,
-0xe7,0x6b,0x02,0xcc,0xf3,0xb4,0x97,0x44,0x93,0xec,0xe5,0xca,
-0x5e,0x75,0x30,0x1d,0xf7,0xb2,0x28,0x1e,0x57,0x57,0xd9,0xef,
-0x00,0xe1,0x3e,0x1a,0xf7,0xe3,0xfb,0x46,0x3c,0x1e,0xc6,0x41,
-0x9f,0xbd,0x60,0x4e,0x36,0x63,0x77,0x41,0xc2,0x26,0x49,0x9c,
-0xc5,0xbd,0x78,0x08,0xf9,0xd5,0x61,0xdc,0x0b,0xb0,0x40,0x43,
-0x27,0xbe,0x60,0x4f,0x6e,0xb3,0x6c,0x92,0xee,0x3e,0x59,0x65,
-0xaf,0xd8,0x93,0xfb,0x34,0x7d,0xc2,0x76,0xf1,0xef,0x13,0x05,
-0x21,0x8d,0x7b,0x9f,0xc2,0x0c,0xea,0x8f,0xc3,0x7b,0xf6,0x63,
-0xd8,0xed,0xd0,0xf7,0xaa,0x84,0xf1,0xf4,0xc9,0xee,0xda,0xda,
-0x93,0xa7,0x0a,0xf6,0x6d,0x9c,0x66,0xfa,0xdb,0x24,0xc8,0x6e,
-0xc7,0xc1,0x28,0x5c,0xdd,0x23,0x78,0x1c,0x16,0xa0,0x1c,0x4f,
-0xc2,0xb1,0x0f,0x65,0xde,0x24,0x92,0x46,0x34,0x78,0x25,0xa8,
-0x54,0x95,0xf9,0x8c,0x41,0xa3,0x29,0x10,0xaa,0xd9,0xac,0xa9,
-0xa4,0x24,0xbe,0x87,0xa4,0x75,0x23,0x65,0x9a,0x86,0x1d,0x24,
-0xe0,0x2e,0xcb,0x92,0x69,0xa8,0xd3,0x81,0x9a,0x61,0x38,0xfe,
-0x21,0x9c,0xa5,0x3c,0x47,0x64,0x7c,0x16,0x08,0x32,0x6a,0x1b,
-0x10,0xac,0x56,0xfa,0x41,0x16,0x54,0x6a,0x1a,0x45,0xfc,0x0e,
-0x68,0xca,0x3e,0xa4,0xe1,0xb8,0xcf,0xd3,0xf6,0x72,0xb5,0xa1,
-0x73,0x55,0x60,0x8a,0xe9,0x28,0x1c,0x67,0x0d,0xe4,0x02,0x95,
-0xaf,0x08,0x30,0x0a,0xd3,0x34,0xb8,0x09,0x4d,0x1a,0x84,0x77,
-0x50,0x1c,0x5b,0x20,0x20,0xf7,0x49,0x94,0x85,0x3c,0xad,0x21,
-0x9b,0xc9,0x41,0xe9,0x0d,0xe3,0x34,0x74,0xe8,0xc8,0xab,0xf7,
-0xc3,0x34,0x4b,0xe2,0x59,0x55,0x57,0x43,0xa6,0x83,0x8f,0x9f,
-0x57,0x1b,0xbd,0x60,0x38,0xac,0x66,0xb7,0x51,0x0a,0x68,0x01,
-0x9f,0x09,0xfe,0x52,0x8c,0xb6,0xf6,0xdd,0x77,0x2b,0xec,0x3b,
-0x0e,0xe6,0x63,0xca,0xea,0x2c,0x18,0xb3,0x07,0x1a,0x92,0x70,
-0x34,0x1d,0x06,0x59,0x9c,0x60,0xf6,0x41,0x3c,0x99,0x25,0xd1,
-0xcd,0x6d,0xc6,0xaa,0xbd,0x55,0xd6,0x6e,0xb6,0xda,0x75,0xf8,
-0xb5,0x5e,0x63,0x07,0xb7,0x49,0x94,0x66,0xf1,0xe4,0x36,0x4c,
-0xd8,0x3f,0xc2,0xc1,0x20,0x09,0x67,0xac,0x7a,0x7a,0x7c,0xc5,
-0x4e,0xa2,0x5e,0x38,0x4e,0xc3,0x55,0xac,0xcd,0x99,0x6e,0x6d,
-0xed,0x26,0xca,0x6e,0xa7,0xdd,0x46,0x2f,0x1e,0xad,0xf5,0x6e,
-0x3f,0x7e,0x5c,0x13,0x8d,0x42,0x11,0x2c,0x75,0x81,0x83,0x9f,
-0xa6,0xd0,0x31,0x16,0xa5,0x0c,0x00,0x86,0xdd,0x19,0xbb,0x49,
-0x82,0x71,0x16,0xf6,0x61,0x64,0x60,0x24,0x59,0x3c,0x60,0xbd,
-0xdb,0x20,0xb9,0x09,0x6b,0x2c,0x8b,0x01,0xd3,0x19,0x9b,0x84,
-0x49,0x0a,0x15,0xe2,0x6e,0x16,0x44,0xe3,0x68,0x7c,0xc3,0x02,
-0xe0,0x98,0xc9,0x0c,0xe1,0x41,0x61,0xec,0x36,0xd0,0x6f,0x90,
-0xdd,0x07,0x49,0x08,0xe5,0xfb,0x2c,0x48,0x81,0x9c,0x51,0x00,
-0x20,0x99,0x1c,0x33,0xe2,0x5d,0x36,0x88,0x86,0x61,0xca,0x80,
-0x50,0x21,0x7b,0xd2,0x11,0x35,0x9e,0xac,0x52,0x3b,0xfd,0x30,
-0x18,0x22,0xc0,0x68,0xcc,0x30,0x5b,0xe6,0xc2,0x94,0xcc,0x6e,
-0xe3,0x69,0xc6,0x12,0xa4,0x7e,0x44,0x43,0x52,0x83,0x42,0xbd,
-0xe1,0xb4,0x8f,0x98,0xc8,0xec,0x61,0x34,0x8a,0x44,0x23,0x58,
-0x9d,0xc8,0x98,0x12,0xcd,0x63,0x64,0xdc,0x1a,0x21,0x5c,0x63,
-0xa3,0xb8,0x1f,0x0d,0xf0,0x6f,0x48,0xfd,0x9b,0x4c,0xbb,0xc3,
-0x28,0xbd,0xad,0xb1,0x7e,0x84,0xd0,0xbb,0xd3,0x0c,0x12,0x53,
-0x4c,0x24,0xba,0xd6,0xb0,0x37,0x6b,0x31,0x4c,0xd8,0x70,0x48,
-0xc8,0x01,0x90,0x08,0x3a,0x40,0x9d,0xd6,0x38,0x52,0x31,0x6c,
-0x68,0x82,0xc4,0xcd,0x04,0xb9,0x52,0x4c,0xb9,0xbf,0x8d,0x47,
-0x76,0x7f,0x22,0xc2,0x6a,0x30,0x4d,0xc6,0xd0,0x70,0x48,0xd5,
-0xfa,0x31,0x90,0x8f,0xda,0xfd,0x18,0xf6,0x32,0x4c,0xc1,0x1a,
-0x83,0x78,0x38,0x8c,0xef,0xb1,0x8f,0xbd,0x78,0xdc,0x8f,0xb0,
-0x6b,0xe9,0xae,0x18,0xc5,0x2b,0xc8,0x0f,0xba,0xf1,0x5d,0x48,
-0xdd,0xe2,0x3c,0x33,0x8e,0x33,0xc0,0x9a,0xa3,0x82,0x23,0x32,
-0xd1,0x23,0x2d,0xb2,0xd2,0x5b,0xe0,0x52,0xd6,0x0d,0x05,0xf9,
-0xa0,0xf1,0x68,0x8c,0xd0,0x30,0x55,0xf6,0x2c,0x41,0x34,0xd2,
-0x0c,0xf8,0x21,0x82,0x75,0x74,0x12,0x27,0xd4,0xae,0xdb,0xe3,
-0x86,0xc4,0xe3,0xed,0x11,0xeb,0x9c,0xbf,0xb9,0xfa,0x71,0xff,
-0xf2,0x88,0x1d,0x77,0xd8,0xc5,0xe5,0xf9,0xfb,0xe3,0xc3,0xa3,
-0x43,0xf6,0x64,0xbf,0x03,0xdf,0x9f,0xd4,0xd8,0x8f,0xc7,0x57,
-0x6f,0xcf,0xdf,0x5d,0x31,0x28,0x71,0xb9,0x7f,0x76,0xf5,0x33,
-0x3b,0x7f,0xc3,0xf6,0xcf,0x7e,0x66,0x3f,0x1c,0x9f,0x1d,0xd6,
-0xd8,0xd1,0x4f,0x17,0x97,0x47,0x9d,0x0e,0x3b,0xbf,0x44,0x68,
-0xc7,0xa7,0x17,0x27,0xc7,0x47,0x90,0x7c,0x7c,0x76,0x70,0xf2,
-0xee,0xf0,0xf8,0xec,0x7b,0xf6,0x1a,0xaa,0x9e,0x9d,0x03,0xa3,
-0x1f,0x03,0xbb,0x03,0xdc,0xab,0x73,0x6a,0x53,0x40,0x3b,0x3e,
-0xea,0x20,0xbc,0xd3,0xa3,0xcb,0x83,0xb7,0xf0,0x75,0xff,0xf5,
-0xf1,0xc9,0xf1,0xd5,0xcf,0x35,0x84,0xf5,0xe6,0xf8,0xea,0x0c,
-0x21,0xbf,0x39,0xbf,0x64,0xfb,0xec,0x62,0xff,0xf2,0xea,0xf8,
-0xe0,0xdd,0xc9,0xfe,0x25,0xbb,0x78,0x77,0x79,0x71,0xde,0x39,
-0x02,0x24,0x0e,0x01,0xf2,0xd9,0xf1,0xd9,0x9b,0x4b,0x68,0xe8,
-0xe8,0xf4,0xe8,0xec,0xaa,0x01,0x0d,0x43,0x1a,0x3b,0x7a,0x0f,
-0x5f,0x58,0xe7,0xed,0xfe,0xc9,0x09,0xb6,0x86,0xe0,0xf6,0xdf,
-0x41,0x37,0x2e,0x11,0x51,0x76,0x70,0x7e,0xf1,0xf3,0xe5,0xf1,
-0xf7,0x6f,0xaf,0xd8,0xdb,0xf3,0x93,0xc3,0x23,0x48,0x7c,0x7d,
-0x04,0xf8,0xed,0xbf,0x3e,0x39,0xe2,0xad,0x41,0xef,0x0e,0x4e,
-0xf6,0x8f,0x4f,0x6b,0xec,0x70,0xff,0x74,0xff,0xfb,0x23,0xaa,
-0x75,0x0e,0x80,0xa8,0x93,0x58,0x92,0xa3,0xc9,0x7e,0x7c,0x7b,
-0x84,0xa9,0xd8,0xea,0x3e,0xfc,0x7f,0x70,0x75,0x7c,0x7e,0x86,
-0xfd,0x39,0x38,0x3f,0xbb,0xba,0x84,0xaf,0x35,0xe8,0xee,0xe5,
-0x95,0xaa,0xfd,0xe3,0x71,0xe7,0xa8,0xc6,0xf6,0x2f,0x8f,0x3b,
-0x48,0x99,0x37,0x97,0xe7,0xa7,0xd4,0x53,0xa4,0x2e,0x54,0x3a,
-0x27,0x38,0x50,0xf5,0xec,0x88,0x03,0x42,0xca,0xdb,0x03,0x04,
-0x45,0xf0,0xfb,0xbb,0xce,0x91,0x82,0xc9,0x0e,0x8f,0xf6,0x4f,
-0x00,0x1c,0x8c,0xd6,0x99,0x3b,0xa0,0x72,0x90,0xcf,0x81,0xbf,
-0x70,0xbf,0x18,0xce,0x80,0x27,0x93,0x4f,0xc0,0x36,0x83,0x04,
-0xb8,0xba,0x8a,0x53,0x8f,0xb8,0x22,0x98,0xc2,0x1c,0x4c,0x2a,
-0x26,0xcb,0xad,0x22,0xa7,0xc2,0x0a,0xf9,0x26,0xe8,0x26,0xc8,
-0x7a,0xaf,0x61,0x02,0x05,0x49,0x1f,0xca,0x7c,0x0c,0xee,0x02,
-0xbe,0x2c,0xb2,0xbb,0x0c,0x76,0x1c,0x84,0xc9,0x3e,0xa6,0xc3,
-0x68,0x3c,0x7d,0x10,0x95,0x70,0x25,0x83,0x85,0xac,0xcb,0xeb,
-0x34,0xe2,0xe4,0x66,0x4d,0x14,0x58,0xe3,0x05,0x72,0x0b,0x65,
-0xcb,0x6d,0x88,0x97,0xc3,0x69,0x12,0x0b,0xec,0x61,0x81,0x49,
-0xa3,0x9b,0x31,0xac,0x23,0x23,0x58,0xc4,0xd2,0x06,0x65,0x2a,
-0x81,0x21,0xca,0x60,0x8a,0x0f,0x44,0xf3,0x41,0x0a,0x93,0x04,
-0x36,0xd3,0x10,0x96,0xe8,0x71,0x9f,0xcf,0x51,0x31,0x65,0xc4,
-0xaa,0x7d,0xd0,0x39,0x86,0x19,0x03,0x10,0x61,0xea,0x8f,0xe2,
-0xf1,0x0d,0xaf,0x18,0x67,0xb8,0x40,0x0f,0xc2,0x20,0x9b,0xc2,
-0x6a,0x85,0xe4,0x5b,0x5b,0x71,0x65,0x0c,0xb9,0x15,0xc8,0x4d,
-0x98,0x1d,0xd1,0x06,0x80,0xb3,0xf4,0x32,0x1c,0xc0,0x72,0x3c,
-0xee,0x85,0xa9,0x4d,0x07,0x22,0x53,0x63,0x1c,0x66,0x6b,0x56,
-0x72,0x34,0xbe,0x8b,0xd2,0xa8,0x3b,0x0c,0xeb,0x51,0x3a,0x84,
-0x59,0x4f,0x25,0x08,0xbd,0xb5,0x5e,0x36,0x4c,0xc3,0xdf,0x52,
-0xf9,0xb7,0x91,0x3d,0x64,0x8f,0xad,0x8a,0x02,0xd8,0xe2,0xba,
-0x77,0x59,0x06,0xcb,0xb3,0x8d,0xdf,0xfd,0xfd,0x7d,0x23,0x1a,
-0xdf,0x07,0x13,0xda,0x8a,0x26,0xfd,0x49,0xab,0xb9,0x16,0x8c,
-0xd3,0x08,0xe9,0x96,0xc3,0x88,0x46,0xb7,0xd1,0x8f,0x42,0x02,
-0x37,0x0a,0xc6,0x6b,0x1b,0x6b,0xb0,0xec,0xa5,0xf1,0x30,0xfc,
-0x85,0x08,0xbd,0xa0,0xf4,0xb3,0xb5,0x69,0xf2,0x70,0x97,0x71,
-0x92,0x57,0x60,0xc1,0x67,0x7c,0xb7,0xa8,0xec,0x29,0x8a,0x77,
-0x60,0x4f,0x0b,0xfb,0xbc,0x04,0x4a,0x44,0x5c,0xd6,0x83,0x9d,
-0x1e,0x57,0x4b,0xd8,0xc8,0x6b,0x6a,0xaf,0x12,0x69,0x0d,0xf9,
-0x5d,0xc3,0x38,0x42,0xd9,0xe1,0x08,0xd6,0x78,0xa0,0x15,0x87,
-0x24,0x07,0xd7,0xca,0x12,0xb2,0x17,0x01,0xf9,0x85,0xe4,0x8d,
-0x54,0xc2,0x94,0x5f,0xff,0xf8,0x83,0xfd,0x8e,0xa2,0xc3,0xca,
-0x8a,0x59,0x91,0x8b,0x91,0x28,0xf9,0x36,0x82,0x7e,0xff,0x04,
-0x36,0xa5,0x70,0x0c,0x2c,0x65,0x48,0x23,0x98,0x57,0x83,0xdd,
-0x8e,0xe7,0xe4,0xdb,0xb9,0xc6,0x02,0x1f,0x9c,0xd6,0x44,0x22,
-0xb4,0x79,0xfd,0x61,0xcf,0x5b,0xa1,0x31,0x99,0xa6,0xb7,0x55,
-0x05,0x16,0x10,0xdb,0x2b,0xc4,0x2c,0x46,0x31,0x73,0x31,0xd6,
-0xc5,0x00,0x60,0x0a,0xc2,0xd6,0x55,0xb6,0x77,0xd1,0x80,0x55,
-0xbf,0xc9,0x63,0xbc,0x0a,0x33,0x19,0xe6,0xd9,0x18,0x9a,0xe1,
-0x12,0x6e,0xdc,0xfd,0xe8,0xed,0x36,0x49,0x6a,0x20,0x32,0x40,
-0x26,0x14,0x69,0x0c,0xc3,0xf1,0x4d,0x76,0x4b,0xb5,0xee,0x6f,
-0x41,0x1c,0x61,0xd5,0xa8,0x5e,0x97,0xb2,0x32,0xb6,0x05,0x85,
-0xae,0x23,0xa0,0x20,0x08,0xf2,0x12,0x11,0xa4,0x1c,0x4f,0x6e,
-0xa8,0x24,0x33,0x5f,0x8b,0xda,0xd8,0x42,0x3a,0x41,0xf1,0xa1,
-0x1a,0xd5,0x58,0x4b,0x09,0xa9,0x12,0x57,0x25,0x35,0xce,0x25,
-0xf0,0x60,0x50,0x4c,0x61,0x9b,0x78,0x8b,0x88,0xbc,0x3f,0x1c,
-0xca,0xa2,0xa9,0x4b,0x68,0x4d,0x5e,0x1f,0x75,0xfb,0xe1,0x30,
-0xcc,0x42,0x0f,0x3d,0x17,0xf0,0x46,0x2f,0x5c,0x34,0xa0,0x6a,
-0xca,0x38,0xe7,0x2a,0x10,0x39,0x11,0xc7,0xfd,0x24,0x09,0x66,
-0x06,0xc8,0x14,0xa9,0xc9,0x05,0x6c,0x28,0x41,0x13,0x32,0x15,
-0x74,0x25,0xe4,0x6c,0x82,0x88,0x16,0x61,0x07,0xe2,0x45,0x38,
-0xe1,0x15,0x06,0x8d,0x60,0x32,0x19,0xce,0xa8,0xc3,0x35,0x6a,
-0x90,0x8a,0xe1,0x88,0xc0,0xc9,0x4a,0x8f,0xad,0x2a,0x8f,0xb9,
-0x02,0x04,0x35,0xa6,0xba,0x44,0x0d,0xcc,0x21,0x44,0x88,0x82,
-0x60,0x21,0xc1,0xcb,0xf0,0xf3,0x12,0xe4,0x40,0x4e,0x13,0x6c,
-0xbe,0x60,0x16,0x0c,0xad,0x59,0x60,0x4c,0x8d,0x26,0xb5,0x8b,
-0x7b,0x71,0x75,0x0f,0x12,0x9e,0xb3,0x21,0xfc,0x79,0xfa,0x54,
-0x8e,0x8f,0xe0,0xfe,0x02,0xea,0xcd,0xa1,0xc3,0x70,0x3e,0xf7,
-0x99,0xb4,0x2d,0xbf,0x82,0x7d,0x36,0x56,0x75,0x10,0xfa,0x69,
-0x77,0x10,0xab,0xfa,0x38,0x4e,0x46,0x01,0xf6,0xb2,0x49,0x4b,
-0x7a,0x98,0xf6,0x82,0x49,0x88,0x47,0xf9,0x16,0x7d,0xef,0xa5,
-0xd8,0xd9,0x36,0x7d,0x8e,0xd3,0x1e,0x7c,0x5e,0xe7,0xe9,0xb0,
-0x39,0xa4,0x74,0x24,0xdf,0xe0,0x5b,0x41,0x0f,0x11,0xde,0xa4,
-0xcf,0x20,0x35,0xc4,0x09,0x72,0xf5,0xd6,0x5e,0x6e,0xfb,0x76,
-0x36,0x01,0x75,0xb4,0x8e,0x27,0x24,0x37,0xf3,0x4e,0xd2,0x91,
-0x1f,0xc4,0x0b,0xd1,0x27,0xa2,0x34,0x71,0x01,0x51,0x12,0x44,
-0x0b,0x94,0xb7,0x7b,0x21,0xc8,0xd8,0xb2,0xfe,0xaa,0xa4,0xbb,
-0xa0,0x8f,0x75,0x6c,0x57,0xc3,0x7e,0xdd,0xfc,0x40,0xc3,0x20,
-0xbe,0xb5,0xac,0x6f,0xed,0x0f,0x62,0x70,0xe0,0x97,0x35,0x36,
-0xe6,0x51,0x55,0xce,0x7f,0x20,0x2e,0xb4,0x2e,0x90,0xa6,0xa5,
-0xad,0x32,0x9e,0x8e,0xba,0x61,0x52,0x51,0x0c,0x20,0xf3,0xd4,
-0x52,0xc7,0x75,0x06,0x16,0x32,0x2b,0xa6,0xea,0xc0,0x42,0x4c,
-0xe4,0xdc,0x82,0xc0,0x30,0x0c,0x93,0x5d,0x0b,0x4f,0xbe,0x28,
-0x2a,0x64,0x75,0x4b,0xf2,0x93,0xd8,0x2b,0x21,0x2f,0x0c,0x7a,
-0xb7,0xd5,0x4f,0xe1,0x2c,0xad,0x4a,0x6a,0xc0,0xa9,0x7c,0x10,
-0x4c,0x87,0xb0,0x24,0x18,0x7a,0x05,0x28,0x61,0xad,0xe8,0x1c,
-0xce,0x35,0x24,0xe3,0xba,0xce,0xc6,0xd3,0xe1,0xd0,0x58,0xb2,
-0xad,0x5c,0x45,0xe6,0x86,0x99,0x2e,0x97,0xf1,0xb5,0x35,0x76,
-0x12,0xde,0x04,0xbd,0xd9,0xae,0x48,0x40,0xf0,0xb2,0x06,0x87,
-0xf0,0xcd,0x0b,0x03,0x86,0x44,0x8e,0xb2,0x74,0x93,0x85,0x8d,
-0x5a,0x8d,0x7d,0x5e,0xd1,0xbf,0x91,0x7d,0x64,0x61,0x17,0xb1,
-0xcf,0x7a,0x20,0x45,0x16,0x48,0x5c,0xc3,0x38,0x49,0xc5,0x2c,
-0xa7,0xf1,0xdc,0x76,0x06,0x52,0x14,0xd1,0xe0,0x64,0x1d,0x90,
-0xba,0x7a,0x41,0xa6,0xe9,0xfb,0x8b,0x48,0xa7,0x75,0xa7,0xba,
-0xbd,0xca,0xb9,0x8a,0x85,0x20,0x1e,0x2e,0x68,0xb2,0xb5,0xf5,
-0x75,0xda,0x04,0x38,0x4b,0x34,0xda,0x2c,0xdb,0x28,0x07,0xde,
-0xac,0xb1,0x7a,0x7b,0x55,0x62,0x20,0x28,0x5f,0xd4,0x79,0x2a,
-0x5b,0xf3,0x03,0x82,0x9c,0x25,0xb0,0x5c,0x76,0x38,0xe6,0x23,
-0xd6,0xda,0x2a,0x85,0x99,0x94,0xfc,0x0a,0xda,0x22,0x2e,0xe2,
-0xbb,0x9c,0x3b,0x05,0x29,0x0b,0x98,0x5f,0x54,0x1f,0x67,0x70,
-0x34,0xb2,0xea,0xf3,0x14,0x98,0xa8,0x5c,0xaa,0xde,0x33,0x8a,
-0x1b,0x52,0xb5,0x2c,0xaf,0x92,0xa0,0x82,0x16,0xb2,0x45,0xe3,
-0x13,0x10,0xd3,0xad,0xd2,0xa4,0xf3,0x45,0x09,0x4c,0x7c,0xe7,
-0x05,0x88,0x22,0x90,0xaa,0xb4,0x82,0xec,0x95,0x82,0xd5,0xb8,
-0x09,0xb3,0xa3,0x61,0x48,0x0b,0xcc,0xeb,0xd9,0x55,0x70,0x73,
-0x16,0x8c,0xc2,0x6a,0x05,0x01,0x55,0x56,0x61,0xa1,0x62,0xbb,
-0x7c,0x0d,0xd0,0x3d,0xc6,0xc5,0xcc,0x26,0x48,0x6a,0x36,0x79,
-0x13,0xc6,0xa3,0x30,0x4b,0x66,0x50,0x57,0xe1,0x89,0xab,0x9c,
-0x51,0x85,0xbe,0xfa,0xaa,0xb4,0x3e,0xe4,0xa6,0xa7,0x58,0x06,
-0x25,0x0f,0x48,0xc9,0x42,0xea,0x47,0xdd,0x62,0x6a,0x69,0xa4,
-0x82,0xb3,0x6e,0x40,0x0a,0xca,0xa6,0xc2,0x64,0xd6,0x8f,0xd2,
-0x89,0x95,0xf2,0x60,0xe7,0x5b,0xdf,0x7a,0xd3,0x24,0x8d,0x13,
-0xda,0x37,0x3d,0xe9,0x6f,0xa3,0x7e,0x9f,0xeb,0x91,0x03,0x60,
-0x63,0x9d,0x19,0x8f,0xef,0xc2,0x24,0x3b,0x8a,0x87,0x2a,0x29,
-0xcd,0x41,0xf8,0x6d,0x1a,0x4e,0x31,0xa5,0x52,0xd1,0x85,0x7a,
-0x49,0x3c,0x1c,0x5e,0xc5,0x36,0x7a,0x3c,0xf5,0x75,0x9c,0x65,
-0xf1,0x48,0x6e,0xf4,0x44,0xbf,0x3a,0x6b,0x49,0x56,0x1b,0xf1,
-0x53,0x1f,0xcf,0x44,0xb9,0x23,0xe2,0xfa,0xef,0x1f,0xc2,0xd9,
-0x84,0xeb,0xe6,0x2d,0x04,0x8d,0x12,0x07,0xd4,0x91,0x5c,0x09,
-0xae,0x08,0x38,0x05,0xb0,0xb9,0x2c,0xd8,0x81,0xa1,0x73,0xde,
-0xac,0xfb,0x24,0x00,0x7e,0x43,0x4b,0x83,0x37,0x5b,0x89,0x1b,
-0xc8,0x4f,0x12,0x75,0x58,0xac,0x51,0x8f,0x67,0xf5,0x60,0x92,
-0x84,0x83,0xe8,0xc1,0x0b,0x83,0x17,0xf7,0x66,0xc1,0x51,0x7b,
-0x1a,0x0c,0x0b,0x6a,0x05,0x49,0xef,0x76,0x4e,0xd6,0x61,0x7c,
-0x3f,0x56,0x49,0x30,0x13,0x92,0x99,0x3d,0x34,0x94,0x74,0x41,
-0x68,0x61,0x46,0x87,0x2a,0xed,0x32,0x5d,0xe0,0x97,0x24,0x0c,
-0xf4,0x70,0xff,0xc2,0xd1,0x0c,0xfb,0x3a,0x05,0xe7,0x3c,0xcc,
-0xc5,0x40,0xf6,0x5b,0x08,0x51,0x8a,0x67,0x94,0x4c,0xc5,0x89,
-0x23,0x92,0x6f,0x8a,0xd2,0x87,0x20,0xea,0x0d,0x6d,0x96,0xe4,
-0x25,0x71,0x9a,0x5d,0x63,0xd9,0x0f,0x9a,0x39,0xf0,0x88,0x0f,
-0x52,0xe6,0x04,0xc6,0x2d,0xd2,0x54,0xee,0x87,0xbd,0x13,0xb4,
-0x93,0xc4,0x89,0x9e,0x0a,0xad,0xe6,0x29,0x96,0xd6,0x34,0xcd,
-0xda,0xcd,0x5c,0xd2,0xba,0x9b,0xc4,0x07,0xd6,0x4e,0xa3,0x56,
-0x49,0x96,0x4a,0x0d,0x5a,0x8f,0xfb,0x6f,0x60,0xd9,0xd1,0x29,
-0xd3,0x6c,0x60,0x57,0x4b,0x6f,0x12,0x3b,0x81,0x54,0x15,0x22,
-0x49,0xf4,0x27,0x4a,0x7b,0x6a,0x5c,0xf8,0xc2,0x65,0x10,0x21,
-0x1a,0xf6,0x61,0xc5,0xd3,0x0b,0x4f,0x38,0x48,0xc2,0xf4,0x16,
-0x66,0x70,0x92,0xb9,0x89,0x47,0x63,0x3d,0x3e,0x69,0x70,0x17,
-0xf6,0x7f,0xb2,0xbf,0xfe,0x6c,0x7f,0x3d,0x80,0x75,0x4e,0x71,
-0x6d,0x06,0x43,0x39,0xd2,0xf0,0x82,0x7e,0xd0,0x1d,0x22,0x73,
-0xa1,0x4d,0xc7,0x98,0x0f,0x51,0x66,0xa5,0x6b,0xd2,0x0f,0xf6,
-0xb3,0x0c,0xa7,0x5d,0xb5,0xc9,0x9e,0x3f,0xa7,0x2d,0x0e,0x56,
-0xe7,0xf6,0xe6,0x33,0xfc,0xb6,0x23,0xbe,0x6c,0xe1,0x97,0xe6,
-0xaa,0xb9,0xe8,0x88,0x5a,0x26,0x10,0x0d,0x15,0xe6,0x5e,0x30,
-0xa2,0xf1,0xff,0x60,0xd6,0xc1,0x0d,0xe0,0x02,0xb3,0x2c,0x76,
-0x99,0x28,0x66,0xd6,0x4c,0x3c,0x89,0xd3,0x4c,0x27,0xca,0xd4,
-0x61,0x34,0x0e,0x35,0x54,0x94,0xcf,0x23,0x73,0x1d,0xc2,0xc4,
-0xbc,0x72,0x40,0xd7,0xe4,0xda,0x12,0xfa,0xde,0x1d,0x06,0xe3,
-0x4f,0x27,0x90,0x58,0x5d,0x75,0xd6,0x69,0x20,0x93,0xc9,0x26,
-0xd9,0x74,0xd2,0xc9,0xe2,0x49,0x5a,0x5d,0x25,0xad,0x4f,0x34,
-0xbe,0x0d,0x81,0x94,0x5a,0x90,0xad,0x59,0x52,0x3a,0x6e,0x4d,
-0x30,0x26,0x68,0xe7,0xe4,0x5b,0xfd,0x2f,0x61,0x82,0xcb,0xbe,
-0x50,0x2e,0xd2,0x41,0x8d,0x14,0x76,0x8d,0x15,0x25,0x13,0x18,
-0x87,0x4f,0x2c,0x2b,0xe8,0xea,0xd8,0x03,0x01,0xa8,0x3a,0xf1,
-0x47,0x69,0xb5,0xc2,0x8d,0x77,0x95,0xd5,0x55,0xeb,0x28,0xa6,
-0xc6,0x41,0x9d,0x40,0xaa,0xd6,0x20,0x7f,0xcb,0xfe,0x6c,0x3e,
-0xb4,0x06,0x03,0x1a,0x55,0x6b,0x20,0xbf,0x65,0x3c,0xc3,0x3a,
-0xa4,0x1d,0x90,0x7c,0xc1,0xcf,0x4a,0x80,0x00,0xff,0xca,0x9a,
-0xf5,0xd6,0xa6,0xc6,0x1e,0x8e,0x40,0x37,0xf1,0x81,0x94,0x4c,
-0xae,0x39,0xaa,0xfd,0x20,0xf9,0x84,0xa2,0x76,0xe5,0x6f,0xed,
-0x70,0x7d,0x63,0x7d,0xab,0x52,0xa3,0x2f,0xbd,0x5e,0x13,0x7e,
-0xc4,0x97,0x8d,0x70,0x27,0x68,0xaa,0x9c,0x8d,0x40,0xe7,0xac,
-0x6f,0x6c,0x6d,0x06,0x1b,0xe2,0xcb,0xb3,0xcd,0xcd,0xe6,0xb3,
-0xae,0xf8,0xd2,0xdc,0xda,0xd9,0xde,0x09,0xc4,0x97,0xfe,0x7a,
-0xff,0x59,0x6f,0x40,0x5f,0x90,0xe4,0xa4,0x58,0xe6,0x8d,0x6e,
-0x6e,0x6e,0x3e,0xdb,0x5c,0x17,0xc5,0xc2,0x41,0x7b,0xa7,0xbd,
-0x23,0xbe,0x6c,0x07,0x61,0x7b,0x5d,0x82,0x1e,0xf4,0xc2,0x9d,
-0x8d,0x81,0x6c,0xa7,0xbd,0x33,0xe8,0xc9,0x2f,0x41,0xff,0xd9,
-0x20,0xd8,0x56,0xe8,0x84,0xed,0xb0,0x2d,0xa1,0xe1,0x4f,0xaf,
-0xb2,0x82,0x4b,0x9a,0xa2,0x01,0x8d,0x68,0x31,0x0d,0x9a,0x4d,
-0xde,0x6d,0x42,0x73,0x08,0xac,0xc1,0xbb,0xdc,0xd7,0xa9,0x49,
-0xd8,0x5f,0x17,0x45,0x31,0x99,0x27,0xde,0xe0,0x08,0xaf,0x8b,
-0xb2,0x3a,0x79,0x16,0xa2,0x7d,0x69,0x5d,0x41,0x0e,0x43,0x09,
-0x79,0x1a,0xb6,0x15,0xe4,0x5e,0x9f,0xa7,0x8e,0x82,0x1b,0xb4,
-0xe2,0x69,0xe8,0x32,0xa3,0x37,0x0b,0x04,0xf0,0x70,0x13,0xff,
-0x93,0x6d,0x06,0xb3,0x9d,0x66,0x9e,0xa2,0xcf,0x06,0xf8,0x9f,
-0x2e,0xb3,0xd9,0xe4,0x14,0x1c,0x58,0x7d,0x10,0x8d,0x60,0xaa,
-0xd1,0x05,0x51,0x52,0xa7,0xf2,0x1e,0xf0,0x91,0xea,0x6d,0xf6,
-0x06,0x02,0x6e,0x72,0xd3,0xdd,0xdd,0xec,0xad,0xc1,0xff,0x83,
-0x81,0x82,0x2e,0x33,0x45,0x3f,0x54,0x0b,0x32,0x1d,0xbb,0xa1,
-0x1a,0x80,0x44,0xc2,0x1c,0xd6,0x80,0x2c,0xa4,0x21,0xb2,0xb9,
-0x96,0x3d,0x85,0xc3,0x4d,0xbd,0xbd,0xb9,0x89,0xe9,0xa7,0xd3,
-0x1e,0x9a,0x41,0x60,0x19,0x20,0x8b,0xdf,0x55,0x1c,0x5f,0xc1,
-0x09,0xfb,0x0c,0x85,0x23,0x9c,0xa5,0xb8,0x60,0xa2,0x11,0x8f,
-0x66,0x89,0x1e,0x6a,0x25,0x83,0xbb,0x2e,0x08,0xb8,0x18,0xa9,
-0x4c,0xdf,0xec,0x10,0x52,0xbd,0x54,0xf8,0xe0,0x1c,0xbf,0x6e,
-0x3e,0x34,0xe1,0x20,0xd3,0x7c,0xd8,0x1c,0xe0,0xef,0xed,0x67,
-0xf8,0x3b,0xa0,0xcf,0x7d,0xfa,0x3c,0x18,0x28,0x35,0xa8,0x5c,
-0xee,0xb1,0x03,0xeb,0xa8,0x14,0x89,0xe4,0x1a,0x6a,0x28,0x7f,
-0xda,0xad,0x2d,0x5b,0xfd,0x33,0xcd,0xaa,0xc9,0x75,0x35,0x62,
-0x6b,0x6c,0x1d,0x4e,0x75,0xff,0xc5,0xb6,0x60,0xe2,0xa3,0xf6,
-0x41,0x24,0x3a,0x69,0x11,0x7e,0x33,0xf4,0x0f,0xd0,0x5c,0x7b,
-0xbd,0x8d,0x04,0x63,0x55,0x18,0xca,0xd9,0x6a,0x51,0xb3,0x1b,
-0x56,0xab,0xd8,0xb5,0x6d,0xa0,0x75,0x04,0x4b,0x48,0xab,0xb9,
-0xa7,0x31,0x81,0x36,0xe0,0x7f,0x0d,0x5f,0x6b,0x14,0x79,0xee,
-0x4d,0x8d,0x75,0x25,0x10,0x71,0x14,0xa2,0x15,0xbb,0xf2,0xb7,
-0x0a,0x80,0xbb,0x0d,0x1f,0xaa,0x20,0x7b,0xf3,0x0f,0x37,0xf2,
-0x43,0x77,0xd5,0x03,0x0f,0x33,0x7a,0x0a,0x12,0xa0,0xd3,0x6b,
-0x64,0x71,0x27,0x4b,0x60,0x40,0xf1,0x58,0x6a,0xa9,0x18,0x7b,
-0xf2,0x80,0x07,0xfd,0x80,0xb3,0x48,0xa5,0x89,0x6d,0xf5,0xe0,
-0xa8,0xd1,0x53,0x70,0x65,0x49,0x71,0xdc,0xfa,0xbc,0x5a,0x15,
-0xeb,0xfc,0x21,0xd7,0x13,0xb0,0xd7,0xdf,0xaf,0xbd,0xf9,0xde,
-0x65,0x92,0x6b,0xd8,0x36,0xf1,0xdc,0xaf,0x16,0x80,0x3d,0x4f,
-0x89,0x67,0xbc,0xc4,0xa0,0x89,0xff,0x55,0xcc,0x45,0xe5,0x97,
-0x3c,0x37,0x59,0xc7,0xc3,0x55,0xb3,0xf0,0xdd,0x5c,0xbe,0x44,
-0x43,0x3b,0x6e,0x9a,0x82,0x97,0x8a,0x00,0xaf,0x18,0x6a,0x45,
-0xb3,0xa8,0xab,0x62,0x84,0x7e,0x59,0xe3,0x4d,0x85,0xa0,0xd2,
-0x04,0xa5,0xbe,0xe3,0x71,0x56,0x15,0xbd,0x8b,0x3e,0x34,0xc8,
-0x28,0xcd,0xc9,0x0e,0xc7,0x5c,0x45,0x7a,0x40,0x88,0x8f,0xec,
-0xf5,0x0a,0x3f,0x20,0xf3,0x2a,0xec,0xe5,0x4b,0xd2,0x3e,0x7c,
-0x4b,0xac,0x5f,0xcb,0xe5,0x6d,0xbb,0x59,0x3c,0x87,0xa7,0x51,
-0x92,0xc1,0xbc,0x62,0xd0,0xa0,0x29,0x3d,0x62,0x7c,0x5b,0x3b,
-0xe7,0xe7,0x34,0xbe,0xaf,0xe5,0x74,0x3e,0x42,0x55,0xc6,0xfb,
-0xb0,0xeb,0xd2,0xa8,0x46,0x59,0xf2,0x50,0xb5,0xcb,0x25,0x78,
-0x4c,0xc4,0x2d,0x00,0x8f,0xab,0x20,0x89,0xd3,0x76,0x40,0xfb,
-0x85,0x3c,0x4c,0xee,0xb2,0xeb,0x6d,0x98,0xe8,0xed,0x0d,0xd2,
-0xa8,0xf1,0x13,0xdb,0x6b,0x10,0x49,0x3e,0x69,0x9f,0x1c,0x7e,
-0x64,0x40,0x33,0xa8,0x01,0x74,0x12,0x4f,0xce,0xc7,0x4e,0x1a,
-0x3f,0x84,0xa1,0x84,0x41,0x9e,0x3f,0x4d,0x91,0xa6,0x5c,0x79,
-0x54,0xc1,0x7e,0xd8,0x9d,0xde,0x18,0xdf,0xb5,0x1f,0x10,0x25,
-0xf1,0xf9,0x0d,0xc2,0x07,0xac,0xe7,0xa3,0x37,0xc2,0xf8,0x69,
-0x14,0x87,0xcc,0x01,0x0a,0xc8,0x16,0xd4,0xcf,0x26,0xd3,0x19,
-0xba,0x45,0x4c,0x5f,0x56,0xc9,0x67,0xeb,0xdf,0x8a,0xb4,0x6f,
-0x7b,0x46,0xc9,0x46,0x91,0xce,0xcf,0xa9,0xf1,0xd9,0x18,0x6c,
-0x12,0xf2,0xc3,0xbe,0xa3,0xf9,0x55,0x35,0xa9,0x8b,0xfa,0x1c,
-0xe8,0x11,0xca,0x64,0x09,0x67,0x5e,0x99,0x1a,0x44,0x59,0xe6,
-0x05,0x97,0x45,0x2d,0x93,0x40,0xbe,0x9c,0x9c,0x36,0x76,0x2a,
-0x48,0xa4,0xd3,0xa4,0xaa,0xd9,0x57,0x49,0x7b,0xea,0xa4,0xb2,
-0xaa,0x4f,0x2e,0xd5,0xca,0x3f,0x1f,0x5a,0xdd,0xeb,0xe3,0x8a,
-0x96,0xc8,0xd3,0xdb,0xf8,0x9e,0x9f,0xa0,0xab,0xab,0x4a,0xed,
-0x03,0x67,0x47,0x21,0x3c,0xda,0x87,0x14,0xde,0x24,0x6f,0x0d,
-0x32,0x3f,0x33,0x38,0x7b,0xc1,0x6e,0x58,0x0d,0x57,0x75,0x79,
-0x99,0x67,0xaa,0x90,0xd0,0x3a,0x52,0xad,0x50,0xe5,0x0a,0x6f,
-0x25,0x47,0x48,0xae,0x29,0xff,0xec,0xa7,0x25,0xf6,0xb1,0x14,
-0x29,0xbf,0xf1,0x91,0x72,0xae,0x1a,0x44,0x1c,0xa4,0x38,0xcd,
-0x66,0x35,0xa1,0x41,0xa1,0x1e,0x96,0x21,0xe5,0x79,0xa5,0x04,
-0xd5,0xf4,0x10,0x2d,0x4f,0x34,0xac,0x5b,0x44,0x33,0xce,0x7c,
-0x86,0xe0,0x7d,0x3c,0x8e,0xd0,0x8f,0x27,0xfa,0x77,0xc8,0x6e,
-0x86,0x71,0x37,0x40,0xef,0x9f,0xdb,0xe0,0x2e,0x8a,0x13,0x87,
-0x7d,0x35,0x69,0x23,0xa8,0xf2,0x3d,0x2f,0x9b,0x23,0x30,0xee,
-0x01,0x73,0x8c,0xe4,0xa6,0x7e,0xb2,0x8b,0x2a,0x93,0xc3,0xb8,
-0x67,0x6d,0x0f,0x46,0xaa,0xb2,0x45,0x23,0x51,0xff,0x8c,0xc6,
-0xfd,0xf0,0xe1,0x7c,0x50,0xf5,0x94,0xd4,0x66,0x79,0xc7,0x28,
-0x22,0x55,0x9a,0x9e,0x3a,0x7c,0x4f,0x50,0xf5,0x6c,0xd4,0xba,
-0xd0,0xd8,0x45,0x90,0x66,0xe1,0xbc,0x02,0xb8,0x58,0xcd,0xcb,
-0x47,0x0f,0x14,0x27,0xdf,0x38,0x56,0x1d,0x4f,0x82,0x7e,0x7e,
-0x76,0x46,0x0f,0x98,0x6e,0xd6,0x72,0xa7,0xa8,0x5c,0x59,0x73,
-0x75,0xb9,0x82,0x8a,0xf2,0x54,0xfd,0x9a,0xa9,0xcc,0x25,0x19,
-0xc1,0x4d,0x79,0xf6,0xc1,0xb0,0xcf,0x09,0x8e,0x78,0x1d,0x09,
-0x57,0x35,0xa4,0x00,0x23,0xe3,0x9a,0xc3,0x0a,0x8a,0x3e,0xe6,
-0xf8,0x2b,0xa4,0x25,0x8b,0x5e,0x91,0xd3,0x5f,0x18,0x8e,0xb8,
-0x9b,0x5b,0x9c,0x7c,0x62,0xf7,0xb0,0xbf,0xd0,0xf6,0xde,0xcb,
-0x92,0x61,0xfd,0x3d,0x79,0xa2,0x8d,0xa2,0x7e,0x7f,0x18,0xd6,
-0x7b,0x20,0x69,0x7c,0x12,0x9b,0x01,0xb6,0xa9,0xdc,0xf6,0xd0,
-0x7d,0x88,0xb4,0xc7,0x70,0xf2,0xed,0x0b,0xcd,0x02,0x02,0xe3,
-0x2a,0xb7,0x86,0xe0,0x39,0xe5,0xaa,0xa1,0x14,0xbc,0x62,0xa1,
-0x7e,0x1f,0x85,0xa4,0x6b,0x06,0x0c,0x79,0x99,0x1a,0xab,0x50,
-0xcf,0x4c,0x2f,0xd3,0xf0,0xce,0xb4,0x32,0x0b,0x47,0x58,0x7b,
-0xee,0x70,0x69,0x82,0x5b,0x66,0x21,0x63,0xd5,0xb2,0xd7,0x63,
-0x72,0x78,0xd7,0x80,0x3e,0x4c,0xba,0x71,0x90,0xf4,0x0f,0xb9,
-0xd7,0xaa,0x10,0x1d,0xe8,0x10,0x4e,0x0b,0x80,0x5b,0x06,0xb5,
-0xd0,0xf8,0xb7,0x5a,0x41,0x45,0xd9,0xda,0x64,0x18,0x44,0x78,
-0xd0,0xe6,0x40,0x0d,0x33,0x01,0x41,0x10,0x2a,0xf4,0xc5,0xad,
-0x14,0x97,0xd6,0xed,0x5d,0x41,0x9e,0x6e,0x69,0x45,0x58,0xae,
-0xce,0xe2,0x8c,0x8d,0xc3,0x1e,0x7a,0xc9,0x26,0xb3,0x06,0x3b,
-0x8c,0x59,0x94,0xa1,0x7b,0xe7,0x7d,0x40,0x8e,0x5d,0xec,0x26,
-0x8e,0x61,0xc0,0xc2,0x20,0x9d,0x92,0x83,0x9f,0x6c,0x55,0x2e,
-0x5a,0xee,0x30,0x81,0xb8,0x29,0x94,0x18,0x15,0x5b,0x0e,0x46,
-0x5b,0xe6,0x10,0xa9,0x2e,0x8d,0x53,0x06,0xfb,0x89,0x95,0x85,
-0x2b,0xd1,0xa8,0x55,0xd8,0x69,0xb9,0x59,0x30,0x22,0x37,0x2a,
-0x97,0x13,0x71,0x22,0xce,0x65,0xc4,0x1f,0xd1,0xaf,0x31,0x9e,
-0x0e,0xfb,0xc0,0x04,0xc3,0x19,0x74,0x90,0xfb,0x6b,0xf5,0x6e,
-0xc3,0xde,0x27,0xf6,0x6b,0x86,0x7e,0xac,0x19,0xed,0xa8,0xa8,
-0xfd,0xff,0x15,0xd6,0x3f,0x38,0x32,0xca,0xa3,0x3e,0x30,0xe0,
-0x7d,0x88,0x08,0x8b,0xe2,0xc0,0x9a,0xc9,0x0c,0xe6,0x10,0x1c,
-0xd7,0x7c,0x04,0x31,0x9a,0x07,0x3e,0x03,0xc4,0x81,0xe1,0xc6,
-0x7e,0x4e,0x23,0x56,0x72,0xb7,0x6b,0x93,0xa9,0x88,0x15,0x05,
-0x72,0xd0,0x6e,0x43,0x7c,0x86,0x65,0x11,0xbe,0xa4,0x49,0xef,
-0x48,0x6b,0x01,0x25,0x63,0x52,0x89,0x3c,0x6b,0x1a,0x5d,0x74,
-0x24,0x01,0x31,0x72,0x2b,0xd2,0xe8,0x08,0xc0,0x8b,0x0b,0x0b,
-0x96,0x2a,0x57,0x58,0x92,0xa1,0x5c,0x69,0xa4,0xfc,0xa2,0x92,
-0x4a,0x99,0x5c,0x0e,0x24,0xb7,0x01,0xe9,0xf9,0x21,0x78,0xcf,
-0x29,0x05,0x43,0x84,0x5a,0x70,0xc9,0x8b,0xc2,0xf5,0xa6,0x46,
-0xb2,0x32,0x5f,0xb4,0x73,0x43,0x3a,0x81,0xcd,0x3f,0xfd,0xff,
-0x8f,0xe9,0xff,0xe9,0x31,0xbd,0xc0,0x31,0x9a,0x33,0xa8,0x30,
-0xb5,0x8f,0x07,0x34,0xb3,0x71,0xdb,0x61,0x29,0x9c,0x9d,0xee,
-0xd1,0xd3,0x5d,0x38,0x68,0xa2,0xae,0x86,0x05,0x42,0xb0,0x52,
-0xda,0xd7,0xe9,0x98,0x4b,0x51,0x99,0xe1,0x16,0x9a,0x9f,0xf4,
-0x64,0x02,0x78,0xe4,0xb4,0x57,0x3c,0x42,0x56,0x8e,0x52,0xfc,
-0x11,0x0e,0x9d,0xea,0xfd,0x58,0x91,0x87,0xb6,0xa5,0xe1,0x1c,
-0x1e,0xb1,0xd9,0xea,0xb3,0xd4,0x68,0xf3,0xd6,0x87,0x82,0xdc,
-0x67,0x71,0x5f,0x50,0x6d,0xde,0x41,0xc2,0x55,0xe7,0x4e,0x66,
-0xac,0x43,0xe6,0x20,0x54,0x92,0xdc,0xaf,0xb1,0x03,0xdc,0xf1,
-0x0f,0x58,0x95,0x27,0x32,0xb4,0x4a,0xad,0x7a,0x16,0x73,0xaa,
-0x58,0xb8,0x98,0x97,0xd8,0xe9,0x57,0x94,0x02,0xfb,0x9b,0x6a,
-0x25,0x1e,0x77,0x43,0x58,0xa6,0x43,0x74,0x81,0xaf,0xe0,0xbd,
-0x01,0x47,0x50,0x24,0x41,0x9a,0x14,0x77,0xe4,0xda,0x0e,0x9b,
-0xc2,0x77,0xb8,0x45,0x7c,0xc7,0x85,0x0e,0xb9,0x73,0x36,0x64,
-0x49,0x53,0x86,0x20,0x90,0x7a,0x84,0xd9,0x40,0x0f,0x32,0x95,
-0x5d,0x20,0x4a,0x88,0x32,0x5e,0x79,0xc2,0xcd,0xd3,0x86,0x35,
-0x4f,0x29,0xde,0x0a,0xd9,0xda,0xa9,0x2c,0x1c,0xb1,0xbb,0xb8,
-0xb9,0x57,0x75,0x11,0xb1,0x4b,0x2b,0x28,0x8d,0x87,0x56,0x2d,
-0x97,0xd4,0xae,0xcd,0xa9,0x30,0xcb,0x57,0x98,0xb5,0x57,0x0d,
-0x2c,0xb8,0x18,0x40,0xa7,0x0f,0x41,0x18,0xc4,0xc9,0x2c,0x91,
-0x13,0x7d,0x52,0x8f,0xe8,0xe3,0x56,0xfb,0xac,0x3f,0x5a,0x1d,
-0x97,0x87,0x1e,0x3d,0x6e,0x93,0x24,0x1a,0x81,0xcc,0x22,0x0c,
-0xab,0x38,0x20,0xdf,0x81,0xc4,0xf0,0x5d,0x6e,0x10,0xcf,0xce,
-0xaf,0x8e,0x76,0xb9,0x68,0x3a,0x02,0xa1,0x86,0xa4,0xd2,0x6e,
-0x88,0xf6,0x14,0x18,0x5d,0xd8,0xe7,0x27,0x64,0x3b,0x99,0xdc,
-0x06,0x4a,0x33,0x01,0xbb,0xfc,0x34,0xe5,0xea,0xd9,0x90,0xfd,
-0xaa,0xf9,0xe9,0x57,0x2e,0x1a,0x37,0x56,0xe6,0xf2,0xc5,0x57,
-0x11,0x2d,0xe7,0x70,0x81,0x66,0x00,0x5c,0x45,0x15,0x13,0x84,
-0x19,0x4e,0xa4,0x2b,0x91,0x5c,0x5d,0xb5,0x8b,0xfa,0x78,0x65,
-0x19,0x36,0x59,0x8a,0x43,0xe6,0x32,0x07,0x53,0xa8,0x9b,0x7a,
-0x02,0x23,0x15,0x3f,0x1c,0x70,0xb1,0x92,0xb0,0x7e,0xc8,0x9c,
-0x02,0x77,0xc1,0x90,0x3c,0x0a,0x3c,0x59,0xc0,0x61,0x6a,0x09,
-0xba,0x0c,0xc6,0x37,0xe4,0xca,0x43,0x42,0x31,0x57,0xc3,0xca,
-0xeb,0x71,0x61,0x76,0x15,0x8d,0x42,0x54,0x0c,0x7b,0x6e,0xc6,
-0x59,0x02,0xae,0x85,0xa3,0xc8,0xb3,0xd2,0x3e,0x4b,0x8f,0x5e,
-0x67,0x3d,0x7c,0x13,0x3d,0xb0,0xe8,0x22,0xe8,0xb3,0x3a,0x1b,
-0x83,0x50,0xdd,0x87,0xa1,0x8a,0xc4,0xb5,0x28,0x64,0x41,0x57,
-0x41,0x28,0x0e,0x82,0xf3,0x17,0x42,0x63,0xd0,0xd5,0x52,0xd8,
-0x83,0xef,0x59,0x28,0x76,0x09,0x3e,0xb5,0xb0,0x88,0x50,0xde,
-0x28,0xc2,0xe0,0x29,0x11,0xed,0x9e,0x74,0x65,0x08,0xc5,0xf4,
-0xa0,0x9b,0xc6,0xc3,0x29,0x1c,0x8a,0x3c,0xe5,0x86,0xe1,0x00,
-0x69,0x5f,0xa9,0xaf,0xb7,0x9b,0xcd,0xe6,0xe4,0xc1,0x57,0x26,
-0x23,0xf7,0x8d,0xb9,0x45,0xee,0xa3,0x3e,0xba,0x36,0xb1,0x4a,
-0x41,0xfe,0x6d,0x48,0xd7,0x35,0x8a,0x0b,0xc4,0x93,0xa0,0x17,
-0x65,0xe4,0xa2,0xd0,0xf4,0xe5,0xeb,0x1b,0x9f,0x07,0x42,0x4b,
-0x5c,0xc9,0x92,0x60,0x9c,0xf2,0x5d,0xcc,0x5b,0x23,0x4e,0xfa,
-0x61,0x42,0x67,0x66,0x2c,0x3d,0x8e,0xc7,0x5e,0x02,0x00,0x67,
-0xa0,0x4d,0xd7,0x2d,0xb7,0xc2,0x4a,0x7b,0x13,0xa1,0xef,0x09,
-0x9c,0xcc,0x0e,0xd0,0x4e,0x5f,0x95,0xd0,0x1d,0x9d,0xc1,0x2f,
-0xd6,0x24,0x36,0xdc,0x26,0xe6,0xf1,0xa7,0x6f,0xf6,0x20,0x0f,
-0xc2,0x28,0xac,0x3a,0x6a,0x1e,0x54,0x0f,0xb0,0x80,0x89,0xcd,
-0x92,0x51,0xd7,0x1c,0xb6,0x33,0x74,0x08,0x3e,0xd6,0xab,0xb1,
-0xee,0x0d,0xac,0x6c,0x37,0x86,0xcb,0xaa,0x28,0xea,0xa1,0xc3,
-0xeb,0xd9,0x71,0x1f,0x19,0x30,0x19,0xd5,0xa9,0x54,0x45,0xe9,
-0xc7,0x52,0xae,0xbf,0x70,0x7c,0x99,0x6f,0x43,0xe2,0xf7,0x05,
-0x14,0xc5,0x52,0x44,0x51,0x09,0xec,0x1b,0x4c,0xc9,0x01,0xcb,
-0xe1,0xe5,0xcc,0x0b,0x03,0x23,0x3e,0xc4,0x51,0x9f,0xd8,0x45,
-0x63,0xab,0x34,0x74,0xc6,0xfa,0xd3,0x8f,0xc3,0x74,0x5c,0xc9,
-0x0c,0x55,0x06,0xdd,0x6f,0x3a,0x3e,0xa2,0xa3,0xa0,0xb8,0x81,
-0xcc,0xc4,0x5a,0x81,0x97,0x7b,0x24,0xf0,0xf1,0x38,0x4c,0xde,
-0x5e,0x9d,0x9e,0x90,0x8b,0x01,0x8d,0xdb,0x53,0x56,0x31,0xae,
-0x22,0xff,0x73,0xac,0x52,0x19,0x1b,0x0c,0xe3,0x20,0xdb,0x65,
-0x38,0xeb,0xf6,0xac,0x0c,0xce,0xad,0xbb,0x0c,0x8d,0x46,0xdd,
-0x1b,0x4a,0x83,0x49,0x0b,0x98,0x6f,0x4e,0x1e,0xec,0x92,0x74,
-0xb3,0x79,0x10,0x8c,0xa2,0xe1,0x6c,0x97,0x3d,0x39,0x0c,0x3f,
-0x06,0xef,0xa7,0xac,0x03,0x53,0x01,0xc4,0xae,0x71,0xfc,0xa4,
-0xc6,0x9e,0x9c,0x44,0xdd,0x30,0xe1,0x77,0x8a,0x44,0xd2,0x08,
-0xfe,0xc0,0x54,0xe9,0x85,0x1e,0x50,0xe2,0x92,0x74,0xcb,0x6d,
-0x87,0xd4,0x48,0x1c,0xa1,0x01,0x21,0xe4,0x20,0x6c,0x5c,0xc1,
-0xd6,0x48,0x9b,0x65,0x3e,0x1b,0x9f,0x8d,0x8f,0x8a,0x34,0x75,
-0xae,0x82,0x75,0x28,0x64,0x34,0x9b,0x07,0x99,0x6f,0x36,0x8f,
-0x1a,0x36,0x2b,0x07,0x58,0x1b,0xad,0xb8,0x4b,0x08,0xaa,0x9f,
-0xd0,0xba,0xe0,0x1a,0x63,0xf4,0x74,0xa0,0x84,0x1a,0x8b,0x0c,
-0x61,0x0f,0x39,0x31,0x22,0x39,0xbb,0xbd,0xb9,0x65,0x09,0x81,
-0x08,0xfa,0xe9,0x0b,0xec,0x1d,0x75,0xaa,0xde,0xbd,0xa9,0x53,
-0xfd,0xba,0x9c,0x87,0xe6,0x4d,0xf5,0xba,0xd1,0x33,0x6e,0x6f,
-0x42,0xc4,0xd9,0xe7,0x8a,0x16,0x88,0x7c,0x2d,0x3e,0x9b,0xdb,
-0xe2,0x20,0xdf,0x62,0xf9,0x66,0x0a,0xd1,0xaf,0x90,0xd1,0x15,
-0xe9,0xbd,0x5c,0x07,0x0a,0xb1,0x33,0x01,0x2e,0x80,0xa2,0xa4,
-0x42,0x77,0x7a,0x01,0x60,0x82,0x4f,0xcc,0x44,0x03,0x8c,0xab,
-0x83,0x58,0xd6,0x5e,0x93,0xe4,0xc6,0x57,0x9f,0x1a,0xcf,0x18,
-0x44,0x49,0x9a,0xd1,0xa2,0x6c,0x2f,0x96,0xe7,0x78,0x4f,0xbe,
-0xc0,0x8a,0x63,0x5c,0x64,0x71,0x6e,0xd3,0x9b,0x87,0x53,0xc7,
-0x9f,0x9f,0x18,0xcf,0x36,0x77,0xf6,0xa3,0x3b,0xcb,0x87,0x89,
-0x0b,0x38,0xe2,0x03,0x1e,0x82,0x75,0xba,0xbe,0x0d,0x60,0x24,
-0x6a,0x97,0xa3,0x04,0x4e,0x43,0xe8,0xfd,0x7f,0x94,0x24,0x71,
-0x82,0x9a,0x3d,0xb1,0xac,0x24,0xe1,0x6f,0xd3,0x08,0xce,0xc1,
-0xb0,0xe8,0x0b,0xb0,0x52,0x8c,0xa9,0x58,0x76,0xf7,0xef,0x41,
-0x0a,0x94,0xba,0x7f,0x73,0xf1,0x72,0x3c,0x79,0x8d,0xb6,0x1b,
-0x70,0xba,0x0d,0x93,0xc3,0x02,0x4d,0xab,0xeb,0xd2,0x5b,0x58,
-0x51,0x15,0x26,0xf7,0x5d,0xc7,0x58,0xb0,0x68,0x4b,0x95,0xf3,
-0xf7,0x02,0x2d,0xc1,0x68,0x70,0x4c,0xea,0xe4,0xb7,0xc1,0xb8,
-0x11,0x98,0x7a,0xa0,0xb4,0xe6,0x52,0x19,0x3a,0x0e,0xee,0xa2,
-0x1b,0xf4,0xfd,0x63,0xdf,0x7e,0xcb,0xfc,0x39,0xa8,0x61,0x4f,
-0xf6,0x6f,0x2c,0x0a,0x93,0xc6,0xfe,0x34,0x40,0xeb,0xfe,0x37,
-0xdf,0xfc,0xb9,0xa8,0x5e,0x43,0x9a,0x2a,0x2a,0x50,0xa5,0x62,
-0xde,0x43,0xe2,0x6a,0xff,0x65,0xa1,0xa0,0xdc,0xe8,0x80,0x39,
-0xed,0xc0,0xa6,0xb3,0x2c,0x32,0x50,0xc7,0x1e,0xf8,0x03,0xda,
-0x14,0x61,0xca,0x24,0x0c,0x2f,0xbc,0xea,0xab,0xae,0x92,0x4f,
-0x56,0x6c,0xa3,0x54,0x6e,0x88,0x9c,0x5d,0x15,0x58,0xda,0xb0,
-0x12,0x2a,0xa5,0xf0,0x30,0x48,0x53,0x1c,0x3c,0xb9,0xc3,0x62,
-0x13,0x95,0x5c,0x31,0x4b,0xd4,0xb2,0xa5,0x31,0xab,0x58,0x98,
-0xa1,0x13,0x19,0xdd,0xc3,0x07,0xf1,0x22,0xe8,0x52,0xff,0xe0,
-0x48,0xd1,0xcc,0xb7,0x5c,0x24,0x16,0xba,0x46,0x91,0x82,0x8a,
-0x3d,0x6f,0xf1,0x67,0x8a,0xf3,0x04,0xf9,0xf0,0x58,0xc8,0x9d,
-0x05,0x51,0x0a,0x40,0x62,0x9a,0xba,0x21,0xcb,0x3f,0x53,0xb9,
-0x13,0x1a,0x1e,0x0e,0xda,0xa3,0xd0,0xf4,0x73,0x00,0x52,0x96,
-0xa6,0xb6,0x83,0xbc,0x29,0x6a,0x42,0x19,0xb3,0x88,0xc4,0x43,
-0x18,0xbf,0x44,0xe6,0x67,0x7b,0x15,0xb2,0x65,0x55,0x03,0xb2,
-0xd2,0x9c,0x1d,0x26,0xc1,0x3d,0x75,0x9b,0xfb,0x02,0xa8,0x6e,
-0x4a,0xbb,0x68,0xb3,0x66,0xfb,0x6b,0x6b,0x95,0x5b,0xce,0xd6,
-0x18,0xf4,0xb8,0x5d,0x3f,0xbb,0x0d,0x32,0x5e,0x46,0x6a,0xe7,
-0xbb,0x40,0xd9,0xe0,0x53,0x88,0x57,0x00,0xa9,0x2d,0x45,0x86,
-0x15,0xe5,0x91,0x2d,0xad,0x90,0xda,0x0a,0x7d,0x34,0x46,0x45,
-0x3c,0x96,0xa7,0x30,0x0a,0xb0,0xf2,0x39,0x0a,0x2b,0x59,0x59,
-0x89,0xcb,0xbc,0x1e,0x39,0xca,0xb2,0x2e,0xba,0x49,0xc8,0x93,
-0x3e,0x97,0x3c,0x54,0x85,0x14,0x4b,0x90,0x1f,0x85,0xae,0x25,
-0x0d,0x65,0x87,0xe7,0xa7,0x4c,0xdc,0xd9,0x4d,0xc2,0x21,0xc6,
-0xb4,0x10,0xb2,0x63,0xcc,0xdd,0x1a,0xc8,0xcc,0xc5,0xad,0x69,
-0xd2,0xb6,0x2a,0xb4,0x06,0x26,0x79,0x6b,0x4c,0x58,0xbb,0x6b,
-0xf9,0x00,0x2d,0xb8,0x95,0xd8,0x07,0x4d,0x12,0xa4,0x31,0xd5,
-0x36,0x25,0xfa,0xce,0x13,0xce,0x09,0x75,0x45,0x5d,0x07,0x92,
-0x36,0xba,0x5e,0x00,0xcb,0x45,0xca,0xd2,0x21,0x1e,0xc0,0xf0,
-0x0a,0xff,0x74,0xfc,0x69,0x66,0xa1,0x8a,0x6a,0x90,0x1c,0xb6,
-0x64,0x66,0xce,0x21,0x4b,0xbb,0x3c,0x61,0x66,0x9b,0xb0,0x95,
-0x32,0xdd,0x81,0xe2,0x55,0x97,0x16,0xf5,0x5b,0x23,0x7e,0x80,
-0x7a,0x5b,0x32,0x32,0x71,0xc2,0x6a,0x8b,0x60,0x4d,0xa8,0x6b,
-0x1c,0x63,0x54,0xc3,0xe8,0x30,0xec,0xe1,0x5d,0x48,0x9b,0x09,
-0xb3,0x90,0x94,0xe9,0x85,0xc2,0xa7,0xd1,0x68,0x90,0xdd,0x27,
-0xe2,0x12,0x7f,0x03,0x0e,0xef,0xc0,0xd9,0xf1,0x03,0x46,0x2f,
-0xc0,0xb6,0x56,0x94,0x8d,0x32,0xd3,0xe6,0x4d,0xb2,0x2c,0xd1,
-0xc1,0x00,0xe7,0xb6,0x24,0x7d,0xfa,0xaa,0x7c,0x9f,0x6d,0x45,
-0x11,0x20,0x90,0xd1,0xd1,0x3c,0xbc,0x6b,0x88,0xcf,0xdf,0x70,
-0xeb,0xbd,0x18,0xe7,0x57,0xec,0xa9,0xca,0x12,0x49,0xbb,0x58,
-0xf8,0xfe,0x36,0xea,0xdd,0x3a,0x65,0xb1,0xb4,0xca,0xaa,0xd3,
-0x3d,0x47,0x59,0x43,0x5d,0x4a,0xe0,0x33,0x1b,0xfa,0x0b,0xe7,
-0x99,0x1d,0x54,0x22,0x23,0xce,0xaf,0x5c,0x5e,0xc3,0x4d,0x44,
-0xf3,0x9a,0x42,0x52,0x7e,0xc0,0x7b,0x4b,0xd0,0x56,0x13,0x00,
-0x1b,0x49,0x1b,0x90,0xd4,0x52,0x49,0x92,0x0d,0x15,0x68,0xd5,
-0x3d,0x90,0x65,0x1d,0x5d,0x36,0xb5,0x3a,0xc7,0xba,0x88,0x0a,
-0xfd,0x4a,0x19,0x2d,0xce,0x22,0x40,0xca,0x4c,0x89,0x54,0xa8,
-0x90,0x07,0x52,0xc5,0xd5,0xe8,0x38,0xf6,0x03,0x7e,0x9d,0x98,
-0x86,0x9b,0xdf,0x35,0x10,0x4b,0x00,0x45,0x57,0x41,0xbd,0x03,
-0xae,0x04,0x62,0x21,0xb8,0x0d,0x47,0x2c,0x1a,0x63,0xd4,0x16,
-0xb9,0xc5,0xaa,0xeb,0x09,0x14,0xce,0x49,0x2f,0x4c,0xb8,0x9f,
-0x91,0xdf,0xbf,0x5e,0x66,0xde,0x44,0x37,0xb8,0xa8,0xa1,0x64,
-0x7b,0x7f,0x1b,0x92,0x7d,0xa2,0x1b,0x03,0xd7,0x86,0x29,0x34,
-0x36,0x18,0x84,0x3d,0x8c,0x62,0x23,0x9a,0xa1,0x0b,0x16,0xb0,
-0xa8,0x86,0xa8,0x27,0x47,0x7d,0x4b,0x3c,0xd0,0x27,0x3b,0x3a,
-0xcc,0x29,0xc1,0x48,0xab,0xdd,0x93,0x18,0xd6,0xd9,0xd7,0x00,
-0xd2,0xbd,0xf9,0xe8,0x2d,0x02,0xeb,0x2a,0x7e,0x78,0x4d,0x49,
-0x55,0x6b,0x8b,0xb2,0xa4,0x0b,0xc3,0x21,0x05,0x25,0xe5,0x8a,
-0xbb,0xe6,0x8c,0x71,0x89,0x87,0x8e,0x0e,0xa6,0xdc,0x25,0x00,
-0xe7,0x16,0xcc,0x5b,0x31,0x09,0x83,0x94,0x9f,0xb0,0x03,0x6e,
-0x6e,0x21,0xdd,0xd9,0x20,0x7a,0x68,0x2c,0xd0,0x87,0x58,0xe3,
-0x9c,0xd3,0x89,0x48,0x29,0x7f,0x8d,0xfd,0x84,0x5d,0xb3,0xc6,
-0x0d,0x53,0x1f,0x17,0xfb,0xe2,0x6f,0x34,0x5e,0xff,0xd5,0x6e,
-0x5e,0x01,0xe5,0x71,0xff,0x40,0x50,0x57,0xb1,0x54,0x2b,0xc3,
-0x92,0x14,0x26,0x78,0x7d,0x17,0x83,0xee,0x84,0x69,0xb8,0x22,
-0x46,0x8a,0x87,0x09,0xc1,0xc8,0x15,0xb8,0x53,0xa1,0x59,0x19,
-0x0e,0x25,0xc3,0x09,0x90,0x63,0x17,0x8b,0x5c,0x42,0x2f,0xee,
-0x02,0x58,0x62,0x28,0x20,0x12,0x25,0xc9,0x09,0xd7,0xe8,0xf1,
-0xdb,0xc8,0xc0,0x3d,0x3d,0xfc,0x8c,0x57,0x43,0x1a,0x3d,0xbb,
-0x92,0x20,0x0c,0x5e,0x1d,0xe6,0x2d,0xad,0xc9,0xba,0x02,0xd4,
-0xeb,0x6c,0x7c,0x00,0x6d,0xd7,0x18,0x5e,0x27,0x78,0x4d,0x79,
-0xe2,0x3b,0x4c,0x8b,0x38,0xe1,0x29,0x35,0xd6,0x09,0x05,0x3f,
-0x5e,0x08,0x6d,0xa1,0xd7,0xd7,0x4a,0x32,0xad,0xdf,0x1f,0x88,
-0xcc,0x49,0xe6,0x12,0x28,0x8e,0x40,0xf9,0x03,0x12,0x99,0x56,
-0xe9,0x2e,0xf6,0x7a,0x5b,0x29,0x73,0x80,0xe9,0xc3,0x21,0xb9,
-0x03,0xe0,0x4c,0x8d,0xc7,0x34,0x6a,0x94,0x58,0xe1,0xa1,0xa0,
-0x22,0xdb,0x8c,0xf9,0x4a,0x2c,0xb0,0xbc,0xc8,0x0a,0x5f,0xe7,
-0x2a,0xb0,0x49,0x13,0x8a,0x1d,0xf2,0x69,0xac,0x58,0xd7,0x84,
-0xa6,0x93,0x1a,0x53,0x6b,0xb2,0xf8,0x48,0xb5,0x79,0x19,0x52,
-0x80,0x92,0xa1,0x70,0x97,0xfd,0xeb,0xfa,0xfa,0x94,0xad,0x3f,
-0xc7,0x3f,0x7f,0x5b,0x7f,0x6e,0xc0,0xa0,0xf2,0x6c,0x3a,0xe1,
-0x45,0x7e,0x5d,0xc7,0x50,0x74,0xca,0x38,0x84,0x6e,0x19,0x9c,
-0xa2,0xde,0x65,0x5e,0x2c,0x52,0xd0,0xff,0x38,0xd5,0x8b,0x31,
-0x1a,0xfe,0x14,0xa3,0x70,0xb5,0x94,0x59,0x5e,0x2d,0xbe,0x50,
-0x4e,0xc3,0xb6,0xab,0x73,0x06,0xef,0xc5,0x71,0xd2,0x87,0x21,
-0xa3,0x5b,0xf0,0x0c,0x5d,0x3d,0x53,0x5e,0xed,0x00,0x33,0x0c,
-0x33,0x29,0x9d,0x31,0x21,0x37,0xb7,0x0a,0x8f,0xfb,0x44,0x7f,
-0xb1,0x54,0x13,0x9e,0xb2,0xa5,0xf4,0x3e,0xe2,0xae,0x69,0x77,
-0x0d,0x7d,0x67,0x1f,0x7f,0x7a,0x78,0x19,0xc5,0xd8,0xea,0x76,
-0xd5,0xae,0xa3,0x47,0xd9,0xdc,0x11,0xa8,0x4f,0xb0,0x67,0x7e,
-0xda,0xcb,0x03,0x98,0x4e,0x8c,0xea,0xd0,0xb7,0x4f,0x61,0x38,
-0x21,0xd7,0x14,0x4e,0x21,0x1c,0x20,0x33,0x5b,0xa2,0xf9,0x71,
-0x9a,0x66,0xc8,0x22,0x08,0xa9,0xe1,0x69,0x1e,0x99,0xac,0xb8,
-0x69,0xcd,0x77,0x56,0xdb,0xe3,0x98,0xdc,0x3f,0x1a,0xb0,0x47,
-0x82,0xe0,0x60,0xe6,0xc0,0x0a,0x1f,0x26,0x18,0xa0,0x87,0xf4,
-0x82,0x66,0xce,0xaf,0xa2,0xcd,0x5f,0x1b,0xbe,0xf6,0x3e,0x1b,
-0xab,0xe6,0x28,0x26,0x86,0x09,0x1f,0x82,0xd1,0x64,0x48,0x81,
-0xd6,0x02,0x93,0xff,0x78,0x21,0x83,0x09,0xff,0x7b,0x83,0xff,
-0xd9,0xe4,0x7f,0xb6,0xf8,0x9f,0x67,0x9c,0x41,0x9f,0x3d,0x77,
-0x99,0xf0,0x34,0xbe,0x0b,0x8b,0x24,0x0d,0x81,0xa3,0x87,0x19,
-0x97,0x65,0x18,0x35,0x04,0x68,0x64,0xa3,0x70,0x50,0xb0,0x8c,
-0xf3,0x9e,0xa5,0xb2,0x00,0x05,0x3a,0x1b,0xc3,0x01,0x02,0x17,
-0x04,0x28,0xd1,0x9d,0xc1,0x70,0x98,0x8c,0xfd,0x54,0x2d,0x02,
-0xc5,0x1c,0xa8,0xe9,0x16,0x8e,0x69,0x25,0x15,0x75,0x61,0xb1,
-0xe5,0xc9,0xca,0xc6,0x41,0xfe,0x3e,0x62,0x6b,0x4c,0x4d,0xaa,
-0xf0,0x8a,0x14,0x53,0x10,0x57,0x55,0xcb,0x4c,0x4f,0xbb,0x89,
-0xbc,0xac,0xb7,0x6a,0x99,0xd5,0x7b,0xb7,0x42,0xf9,0xb6,0xa9,
-0xae,0x45,0x21,0x08,0x7e,0xb2,0x6a,0x2a,0x0b,0x91,0x28,0xfa,
-0x92,0xb5,0xda,0xcf,0x56,0x19,0x56,0xc2,0x4f,0x32,0x57,0xd7,
-0xe8,0xdd,0xda,0x4e,0x5f,0xbe,0xa6,0x9a,0x1b,0xcf,0xca,0xb4,
-0xf5,0x9c,0xb7,0xf5,0xbb,0xe2,0x34,0x4f,0x2b,0xb9,0x76,0x0c,
-0x4c,0x79,0x3b,0x84,0x2a,0x7e,0xdc,0xf3,0xc0,0x69,0x3e,0x1c,
-0x34,0xf1,0x5a,0x17,0x96,0x7f,0xc9,0xb6,0x56,0x57,0xfd,0x85,
-0xb6,0x65,0x21,0xf4,0x9a,0x5f,0x7f,0xa3,0x8b,0x7d,0xce,0xb1,
-0x3d,0x0e,0x30,0x70,0xba,0xb1,0x21,0x0b,0x56,0x4f,0xc2,0x9b,
-0xe9,0x30,0x48,0xd6,0x60,0x14,0xb6,0xc5,0xea,0x7b,0xd0,0x65,
-0x07,0x0f,0xec,0x60,0xc6,0x0b,0xd0,0x4d,0x49,0xca,0xc1,0x8c,
-0x3d,0xcc,0x82,0x5f,0x33,0x76,0x2a,0x00,0xdf,0x24,0xbe,0xcc,
-0xb5,0x11,0xcf,0xa6,0x6b,0x9d,0xbc,0x40,0x7b,0xa3,0xda,0x5a,
-0x5b,0x5f,0xdb,0x5c,0xfd,0x93,0x5d,0x63,0xc1,0x1a,0x16,0xfc,
-0xc0,0xfe,0x99,0x88,0x4d,0x80,0x5f,0x1a,0xdd,0xa5,0xc0,0x5e,
-0x17,0x2c,0x04,0x40,0x17,0xac,0x4b,0xbf,0x13,0xfa,0xdd,0xa3,
-0xdf,0x13,0xe8,0xec,0xbd,0x3b,0xeb,0xf2,0xac,0x2b,0x08,0x4f,
-0x3d,0x47,0x89,0x85,0xc4,0x24,0xea,0x3d,0x1c,0x09,0x54,0x1e,
-0x63,0x0f,0xbb,0x58,0xbc,0xf1,0x00,0x52,0xfb,0xba,0x30,0xbd,
-0x52,0xfa,0xac,0x20,0x9d,0xb7,0xb1,0x6b,0xee,0x13,0xfa,0xf0,
-0x65,0x48,0xf2,0xfa,0x3a,0xab,0xe6,0x14,0x65,0x1d,0x7f,0x87,
-0xd1,0x46,0xc4,0x91,0x49,0x64,0x18,0x01,0xbb,0x74,0xac,0x31,
-0x10,0xfb,0xd2,0x35,0x80,0xf4,0xf0,0x50,0xbf,0x99,0xac,0xc1,
-0xf4,0x9a,0xc0,0xe4,0x6a,0x6d,0x8a,0x80,0x60,0xcc,0x98,0xcb,
-0xdf,0xc2,0x5c,0x96,0x83,0x2f,0xf0,0x36,0x57,0x5f,0x4c,0x9a,
-0xd9,0x49,0xe4,0x47,0x0c,0xbc,0x84,0x5b,0x3e,0x79,0x4d,0xb7,
-0x37,0x2a,0x26,0xa3,0x1b,0xc7,0x8b,0xe6,0x2a,0x2f,0x89,0x6a,
-0xe5,0x96,0x2a,0xa4,0x7c,0x27,0xcd,0xb3,0x89,0x51,0x72,0x7d,
-0x6e,0xc9,0xb6,0x51,0x72,0x73,0x6e,0xc9,0x75,0xdb,0x1a,0x2f,
-0x0a,0xa9,0xca,0xcd,0x8a,0x39,0xd9,0x29,0xe9,0xcf,0x6b,0x54,
-0x6c,0x73,0x32,0x3c,0x65,0x95,0x9a,0xfc,0x36,0xc3,0x6f,0x1f,
-0xfe,0x99,0xa8,0x1a,0x34,0x52,0x46,0xc4,0x53,0x91,0x6c,0x07,
-0x8a,0xb2,0xc7,0x55,0xdf,0x6e,0x2e,0x31,0xae,0x8f,0x1e,0x9c,
-0xfc,0x00,0xa8,0x4d,0xa4,0xbd,0x80,0xfe,0xaa,0xe0,0xc6,0x02,
-0xf2,0xab,0x82,0x5b,0x0b,0xa8,0xaf,0x0a,0xae,0xe7,0xe9,0xc6,
-0x59,0xa7,0xa2,0x56,0xa7,0xa7,0xb6,0xc0,0x45,0xc6,0xa0,0x3d,
-0x33,0xdb,0x82,0x0d,0x92,0xe4,0x06,0x88,0x8e,0xcd,0xd5,0xc2,
-0xe2,0x44,0x9b,0xb9,0xb9,0x0f,0xc5,0x4d,0x61,0xf6,0x04,0xa3,
-0xd1,0xfe,0xf1,0x87,0xd3,0xc6,0xb7,0xf7,0x95,0x52,0xa3,0xad,
-0x6f,0x89,0xeb,0xd1,0x2e,0x37,0x82,0x54,0xea,0xe9,0x53,0xab,
-0x84,0xfe,0x9a,0x23,0xa0,0x22,0x1c,0xef,0x85,0xc9,0xbe,0x7b,
-0x16,0xfb,0x9e,0x96,0x43,0x5c,0xde,0x77,0x5f,0x16,0x6d,0x17,
-0xb1,0xe7,0x16,0x41,0xe5,0xe0,0x7d,0x8b,0x6c,0x21,0x47,0x50,
-0xa5,0xfd,0xb9,0xae,0x54,0x10,0xf3,0x07,0xb4,0x78,0xc8,0xdc,
-0xe1,0xf6,0xb7,0x58,0x19,0x55,0xf0,0xc0,0x71,0x5a,0x59,0x9d,
-0x47,0x0b,0x63,0x81,0xbb,0xfe,0x20,0x96,0x67,0x4b,0x16,0x11,
-0xa8,0xee,0xe5,0x73,0x08,0xc9,0xa2,0x8c,0xd9,0xaa,0xa9,0x3b,
-0x31,0x68,0x75,0x8a,0x03,0xc5,0x2f,0x26,0x36,0x30,0x3a,0xe7,
-0x01,0x88,0x43,0x78,0xe2,0x13,0x11,0xbb,0x78,0x4e,0x8d,0x70,
-0xf2,0xdd,0x73,0xb4,0x4e,0x19,0xc5,0x27,0x98,0xf4,0x36,0x52,
-0xb2,0x38,0xc6,0xd0,0xcd,0x02,0xf5,0x05,0x7d,0xfe,0x75,0x4e,
-0xdc,0xd7,0xc2,0x62,0x76,0x1f,0xc3,0xfe,0x7a,0xcf,0xba,0x51,
-0x96,0xee,0xca,0xc4,0x26,0x50,0x46,0x09,0xf6,0x78,0x1b,0x15,
-0xbe,0xf3,0xbb,0x02,0x32,0xa5,0x0d,0x29,0x74,0x71,0x58,0x26,
-0xac,0x63,0x02,0x9c,0x31,0x83,0x54,0x95,0x91,0xc7,0xb2,0x35,
-0x3c,0x83,0x28,0xd8,0x2d,0x1e,0x8f,0xb7,0x0d,0xdb,0x27,0x99,
-0xf0,0xb7,0x36,0x58,0xd0,0xef,0x0b,0xd9,0xf7,0x11,0x27,0x9a,
-0x85,0xda,0x3a,0xfc,0xf1,0x68,0xec,0xf0,0x67,0x8e,0xd6,0x8e,
-0xd7,0xf2,0x6a,0xee,0x78,0x4d,0x43,0x7b,0x87,0x3f,0x85,0x8a,
-0x3a,0x0b,0xc7,0xe5,0x95,0x75,0x9c,0x6d,0x15,0xa0,0x32,0x87,
-0xb4,0xfc,0xaa,0xec,0xad,0xe8,0x9c,0xca,0xfd,0x14,0xed,0x03,
-0x17,0x45,0x43,0x10,0x6c,0x9b,0x16,0x35,0xb7,0x36,0x2c,0x2a,
-0x6e,0x6d,0x2e,0x3e,0x47,0x72,0x95,0x80,0xbf,0x15,0xca,0x3b,
-0x0c,0x87,0x59,0xf0,0x33,0x48,0xc1,0x8f,0x69,0xea,0xb3,0x62,
-0xe8,0x31,0x9a,0x4c,0xb3,0x5b,0x0c,0x95,0x8d,0x3c,0x4d,0x87,
-0x1d,0x3c,0xa8,0x52,0x6c,0xe9,0x08,0x4e,0x20,0x8a,0x13,0x37,
-0xa0,0x71,0x9a,0x33,0x35,0xb6,0x8d,0x0c,0x1e,0xe2,0x3c,0x6e,
-0x6d,0xe1,0x3d,0xe2,0x78,0x9c,0x01,0x51,0x38,0x4b,0x62,0x09,
-0x8e,0x26,0x7d,0xfc,0x21,0x9c,0xc9,0xcd,0x89,0x37,0x8d,0xf5,
-0x78,0x3e,0x7e,0xe2,0xd9,0xdb,0x3a,0x1b,0xa7,0x1e,0xcf,0xc6,
-0x4f,0x3c,0x1b,0x1a,0xd1,0xd5,0xe3,0xbe,0xc4,0x03,0x44,0x76,
-0x02,0xf6,0x07,0x55,0xd2,0x73,0x74,0x1c,0x63,0xa9,0xd4,0x15,
-0x23,0xdb,0x3e,0x31,0x92,0x9a,0x43,0x8d,0xb8,0x48,0x42,0xf0,
-0x20,0x65,0x70,0x80,0x44,0x29,0xbd,0x99,0xf3,0x43,0x96,0x11,
-0x4b,0x45,0x43,0xe2,0x58,0x35,0x5d,0xe2,0xaa,0x53,0x23,0x1e,
-0xea,0x3a,0x17,0x2b,0xd6,0x40,0x56,0xd7,0xdb,0xb8,0x30,0x63,
-0xd5,0xe7,0xcf,0x41,0x8e,0x58,0x55,0x5b,0x97,0xe8,0x8a,0x38,
-0x40,0x69,0xf6,0xfe,0x6c,0x05,0x8c,0x31,0x74,0x25,0xf2,0x5e,
-0x47,0x9f,0x54,0x08,0xf1,0x30,0x5d,0x43,0x83,0x96,0xb3,0x26,
-0xea,0x13,0xb1,0xb1,0x26,0x3e,0xd4,0xd8,0xac,0xc6,0xee,0x6b,
-0xec,0xb6,0x06,0x1d,0xd5,0x34,0x14,0x61,0x02,0xbb,0x08,0x07,
-0xe3,0x1d,0xca,0x2b,0x4e,0x28,0x05,0xfc,0x44,0x4a,0xd0,0x31,
-0x05,0x2b,0x50,0x17,0x8a,0x78,0x86,0xd2,0xca,0x5a,0x87,0xec,
-0x07,0x3e,0xa0,0x54,0x84,0x93,0x68,0xa6,0x53,0x7e,0x16,0xbb,
-0x03,0x8e,0xba,0xa9,0x13,0xd5,0xb8,0x88,0x1b,0x31,0xca,0x14,
-0xc2,0xaf,0xb7,0xc4,0x83,0x41,0x1a,0x62,0xdc,0x14,0xa9,0xa5,
-0x13,0x77,0x60,0xc8,0x53,0x11,0x7d,0x66,0x11,0x7f,0x0c,0xf9,
-0x8d,0x72,0x24,0x15,0xd0,0x2e,0xe3,0xdf,0x7e,0x8b,0xed,0xa1,
-0x1a,0x9f,0x8b,0xa2,0xca,0x3d,0x40,0x7c,0x38,0x92,0x3e,0xe7,
-0x72,0x7c,0x69,0xbf,0x0f,0x87,0x0d,0xde,0xe8,0x09,0x3a,0x3c,
-0x89,0x9c,0x99,0x95,0x73,0x15,0x4f,0xb4,0x0c,0x48,0x3a,0x40,
-0x03,0x4b,0xd2,0x01,0x86,0x96,0xa5,0x43,0xd6,0x33,0xba,0xc1,
-0xe7,0xad,0xe5,0xd2,0xee,0xb2,0x95,0xb8,0x6a,0x4d,0x9a,0x02,
-0x63,0xb0,0xa1,0x87,0x0e,0x0d,0xd1,0x8f,0x19,0xfe,0xfc,0x88,
-0xfa,0x75,0x0e,0xe4,0xd6,0x5f,0xe2,0x2d,0x79,0x34,0xee,0xa9,
-0xd1,0x3a,0x0d,0xb2,0xdb,0x06,0xd9,0xa8,0xaa,0xd5,0x07,0x06,
-0x7b,0xd3,0x2a,0xfb,0x8e,0xd7,0xc3,0x06,0x57,0xf5,0x20,0x9a,
-0x05,0x67,0x50,0xf0,0x56,0x15,0x44,0xa4,0x0c,0x1d,0x5f,0x37,
-0x64,0xdc,0xe0,0x19,0xb3,0xe0,0x2e,0x8e,0xfa,0x74,0xda,0xa4,
-0x5b,0x52,0x22,0x3f,0xe8,0x2b,0x15,0x48,0x2a,0xa3,0xc6,0x8b,
-0x7b,0xd8,0x8a,0xcf,0x1e,0x70,0x65,0x5d,0x65,0x0f,0x7a,0xae,
-0xf1,0xd4,0x97,0x06,0x6e,0x94,0xab,0xbe,0xea,0x52,0x33,0x5e,
-0x77,0x66,0xd7,0x9d,0xc9,0xba,0x84,0x2e,0xe5,0xaa,0xaf,0x1a,
-0x79,0xae,0x00,0x47,0x8c,0x53,0x86,0x16,0xe5,0xee,0x0c,0x27,
-0x1d,0x57,0xdd,0x08,0xf7,0x9e,0x20,0xc1,0xc5,0x33,0x03,0x09,
-0x90,0x55,0x3b,0x17,0xab,0x34,0x45,0xd0,0x3b,0xab,0x21,0x68,
-0xfa,0x54,0x0b,0x87,0x33,0x4b,0x61,0x24,0x66,0xb9,0xe2,0xb4,
-0x5d,0x98,0x93,0x92,0xb7,0x76,0x61,0x72,0x8a,0xcf,0xb8,0xbf,
-0xd3,0xfe,0x4b,0x2f,0x89,0xe0,0xf6,0xa7,0x95,0x7e,0x06,0x47,
-0xe5,0xf4,0xc9,0x82,0x9d,0x78,0x3d,0xce,0x47,0x6a,0x29,0x41,
-0x09,0x69,0x58,0xf2,0x1e,0x08,0x51,0xc5,0x88,0x19,0x95,0xd7,
-0xa3,0x91,0x62,0x04,0x47,0xcd,0x90,0x1b,0x6c,0x6d,0xb2,0x2e,
-0x1b,0x72,0xeb,0x37,0x99,0x3d,0xb4,0x08,0x68,0x9a,0xba,0xa9,
-0x18,0xc6,0x3a,0x22,0x57,0x85,0x7e,0x1f,0xa0,0x4a,0x5e,0xf1,
-0xac,0xe9,0x38,0xa3,0x0b,0x97,0xe7,0xb9,0x7b,0x80,0x81,0xe1,
-0xef,0xec,0x97,0x5f,0xc8,0x52,0xf0,0xcb,0x2f,0x48,0xb1,0x9a,
-0xa0,0xb9,0x12,0x19,0x8c,0x67,0x3c,0xbc,0xb7,0x03,0xcd,0x29,
-0x8a,0x76,0x06,0x69,0xae,0xb1,0x70,0xb0,0xf0,0x83,0x46,0xad,
-0x05,0x48,0x8e,0x05,0xc6,0x00,0xae,0xd4,0x94,0x1a,0xd4,0xa0,
-0xc8,0x43,0xab,0x09,0x73,0x7e,0x34,0x09,0xb2,0xa8,0x1b,0x0d,
-0xd1,0xc7,0x18,0x03,0xb3,0x21,0x22,0x95,0x8c,0x8f,0x80,0xd8,
-0x5f,0x84,0x70,0x99,0x3a,0x23,0x28,0x03,0x88,0x19,0x11,0x43,
-0x0b,0x70,0x80,0x0e,0x1b,0x77,0x46,0xa6,0x13,0x83,0x21,0x7c,
-0x23,0x2b,0xd3,0x0b,0x3a,0x3a,0x18,0x94,0xed,0xa9,0x04,0x54,
-0x58,0x85,0x10,0x9b,0x4e,0x8c,0xa2,0x05,0xa3,0xa1,0x5f,0x6d,
-0xf9,0x6c,0x4d,0xb5,0xfc,0x9d,0xce,0x15,0x8b,0xad,0x72,0x2c,
-0x84,0xfa,0xaa,0xf2,0x43,0x85,0xe5,0xcd,0xe9,0xa5,0xe7,0xe9,
-0x63,0x66,0x97,0x45,0x53,0x39,0x7a,0xaa,0xe7,0x70,0x1e,0x77,
-0x94,0x64,0xb9,0x2c,0x53,0xcf,0x62,0x02,0xf5,0x0d,0xe0,0x7c,
-0x02,0xe1,0xd3,0x1a,0x70,0xf4,0x31,0x6c,0x48,0x3c,0xea,0x06,
-0xba,0x30,0xe0,0xdb,0x1b,0xd2,0xb0,0x9b,0xde,0xca,0xbb,0xd3,
-0xc2,0x36,0xb0,0x14,0x2d,0x4a,0x92,0x22,0x17,0x44,0xd1,0x7b,
-0xcd,0x59,0x2d,0x96,0xae,0xf8,0xee,0xd8,0xdb,0x79,0x47,0x0e,
-0xa3,0x14,0xd9,0xdc,0x90,0xe2,0x61,0x45,0xad,0x6f,0xc2,0xfa,
-0xb9,0xe9,0xd7,0x79,0x7b,0xea,0x3a,0xb2,0x79,0x0e,0xc0,0x7c,
-0x3a,0x1b,0x9e,0x9d,0x87,0xfc,0x81,0x9e,0xc5,0xce,0x9d,0xe2,
-0x25,0x9f,0xbc,0x41,0xd3,0x0d,0x7d,0xe7,0xc6,0x82,0x54,0x3e,
-0x05,0x76,0x86,0x8e,0xf1,0xff,0xfb,0x67,0x95,0x28,0xa2,0x77,
-0x3a,0x8d,0x7c,0xb6,0xa0,0xb9,0x36,0x55,0xca,0x55,0x8e,0x8d,
-0x52,0xe0,0x30,0x6e,0xea,0x99,0x5e,0x8b,0xf9,0x6c,0x11,0x0b,
-0xdd,0xeb,0xdd,0x25,0xfd,0x7e,0x0d,0xcb,0x3d,0x3d,0x75,0x54,
-0xb1,0x69,0x78,0x89,0x2f,0x5e,0xa0,0xb2,0x80,0x1d,0x8d,0x6f,
-0xa2,0x71,0xa8,0x82,0xb6,0x1d,0x8f,0x0d,0xaf,0x30,0x58,0x32,
-0x07,0x83,0x30,0xa9,0xd1,0x7e,0xad,0x6d,0x2f,0x58,0x0e,0xc3,
-0x02,0xc0,0xcc,0xe1,0x66,0xa1,0x00,0x1f,0x3a,0x0a,0x30,0x82,
-0x39,0x3f,0x8a,0x07,0x76,0x59,0x7a,0x2b,0x08,0xf6,0xf5,0x3a,
-0x9c,0xa3,0xc8,0xc0,0x76,0x13,0x26,0x8d,0x15,0xf2,0x8a,0x48,
-0xd2,0x8c,0xd1,0xed,0x9f,0x5d,0x28,0x31,0xcd,0x06,0x75,0x38,
-0xd1,0xa8,0xba,0x54,0xa6,0x13,0xe2,0xbb,0x38,0xa2,0x10,0x26,
-0x9c,0xe1,0xb9,0x6c,0x87,0xeb,0x19,0x0c,0xb7,0x65,0xe1,0x65,
-0x5c,0x6d,0xd6,0x37,0x5b,0xad,0xd5,0x46,0xae,0x24,0x3a,0x0e,
-0xcf,0x2f,0xd9,0xda,0x10,0x45,0x03,0x36,0x0a,0x52,0xee,0x04,
-0x44,0x66,0x79,0x36,0x18,0x06,0x37,0xd2,0x7c,0xdf,0x7a,0x81,
-0x8e,0x1b,0x35,0xd6,0x7e,0x41,0x4e,0x01,0xe8,0x35,0x58,0x63,
-0x1b,0x2f,0xc8,0xef,0x0c,0xce,0x7f,0x2f,0x22,0x94,0x40,0xf1,
-0x4d,0xa1,0xd6,0xd6,0x0b,0xe5,0x84,0xe0,0x65,0x4f,0xe1,0x6a,
-0x67,0xf2,0x06,0x49,0x4b,0x40,0xee,0x71,0x5f,0x5b,0xde,0xb9,
-0x2a,0x0b,0x4e,0x23,0xe2,0x6f,0x24,0xfe,0x0e,0x69,0xd8,0xe8,
-0x23,0x9c,0x3f,0xc4,0xa7,0x9e,0x0c,0xf6,0x4e,0x9e,0x23,0xe2,
-0x33,0xaa,0x83,0xc4,0xc7,0x20,0xcb,0x12,0xf1,0xb1,0x7b,0x23,
-0x3e,0x0c,0xd4,0x07,0xec,0xa6,0xf8,0x9c,0x88,0x43,0x4c,0x8d,
-0x39,0xfe,0xcb,0xb8,0x93,0xd6,0xb9,0x58,0xc7,0x5e,0x9a,0x41,
-0x5d,0xd7,0x50,0xe3,0xcb,0xf9,0x56,0xb9,0x42,0x17,0x30,0xb0,
-0x5e,0x89,0xa4,0x1f,0xb4,0x70,0x5b,0x5c,0xc0,0xd8,0x2b,0x8c,
-0xc9,0x1b,0x48,0xd2,0xa1,0x93,0xe4,0x58,0x12,0x4e,0x79,0x9c,
-0x4c,0x03,0x4b,0x89,0x1d,0x8f,0xe5,0x28,0xae,0x8b,0x59,0x41,
-0x1e,0xe3,0x9b,0x6a,0xe5,0x57,0x28,0xfa,0x2b,0xb2,0x73,0x16,
-0xc7,0x6c,0x88,0x57,0x75,0x1b,0xec,0x34,0x4e,0xf1,0xa9,0xa9,
-0x4f,0x21,0x9c,0xa9,0x02,0x12,0xc0,0x0f,0x3a,0x97,0x8d,0x8a,
-0x52,0xd7,0xf5,0x99,0x07,0x34,0x8f,0x6a,0x2b,0x55,0x6e,0xdc,
-0x39,0x14,0x44,0xeb,0x17,0x58,0x1e,0x3e,0x19,0xf1,0xce,0xe8,
-0xe6,0x2b,0xaa,0x5a,0x79,0xd0,0x19,0x0c,0xeb,0x2b,0xe4,0x18,
-0xe1,0x37,0xab,0x61,0x5f,0x43,0x61,0x11,0x29,0x5c,0x5f,0x70,
-0x30,0x64,0x74,0x19,0x43,0xc8,0x50,0x69,0x2a,0xaf,0x68,0x1d,
-0xf9,0xc6,0xcc,0xab,0xea,0x46,0x8d,0xda,0x14,0x6c,0x58,0x7a,
-0xac,0xeb,0x48,0xb5,0xab,0x66,0xcd,0x6f,0x0c,0xb0,0x3c,0x7e,
-0xb0,0x79,0x0c,0x14,0x90,0x1e,0xbc,0xdb,0x01,0x66,0xd7,0x5b,
-0x96,0xc8,0x11,0xf8,0xe2,0x81,0x52,0xc7,0x98,0x7c,0xa6,0xc0,
-0xf2,0xb1,0xa5,0x81,0xb7,0xfc,0x6b,0x99,0xd4,0xbd,0x22,0xa5,
-0xae,0xa3,0x0f,0xe2,0x46,0x11,0xfe,0x90,0xe5,0x53,0x26,0xb7,
-0x3e,0x28,0xf5,0x9a,0xbe,0x71,0xf1,0xb0,0x2a,0x6b,0xd7,0x5b,
-0x56,0x36,0xa5,0xe2,0x01,0x18,0x11,0x5c,0x75,0x8c,0xab,0x84,
-0xb4,0x0c,0x36,0x24,0xd1,0xb6,0x55,0x74,0xf2,0x72,0xc4,0xf3,
-0xb5,0x74,0x12,0x8c,0x5f,0x56,0x7c,0xda,0x37,0xab,0x9d,0x62,
-0x50,0xaa,0x18,0x22,0x5c,0x6f,0xd9,0x99,0x46,0x4b,0xd8,0x10,
-0x23,0x17,0xed,0x17,0x4f,0x92,0x90,0x96,0x9f,0xfa,0x5d,0xd4,
-0x0f,0xb5,0xab,0x9a,0xb8,0x83,0xf3,0xc4,0x44,0xc7,0x63,0x3f,
-0xce,0x43,0x25,0x8f,0x95,0x17,0x4f,0x2a,0x86,0x82,0x12,0x7f,
-0xba,0x37,0x78,0x31,0x0b,0x51,0x13,0x81,0x40,0xf7,0xac,0xec,
-0x01,0x66,0x73,0xd4,0x5f,0xbe,0xc4,0xa0,0xb0,0xfe,0x52,0xb8,
-0xdc,0x48,0x38,0x18,0xca,0x6d,0xdb,0x69,0x05,0x4f,0x0b,0xb0,
-0xd6,0x5a,0x69,0x48,0x13,0x5e,0xf1,0x5b,0x96,0xa3,0x88,0x7b,
-0x33,0x5f,0xbb,0xbc,0xe5,0x4b,0xea,0x9e,0xd2,0xf5,0xa8,0x7b,
-0x3a,0xe7,0xef,0x62,0x7b,0x7b,0x95,0x3d,0xa7,0xec,0x67,0xe7,
-0x3b,0x6d,0x4b,0xb0,0x65,0x91,0x07,0xda,0x77,0x58,0xe7,0x40,
-0x47,0xc4,0x73,0x70,0xbd,0x01,0xde,0xdd,0x5e,0xa5,0x0b,0x4c,
-0x2f,0xd8,0xb6,0x0d,0xf9,0x73,0xae,0xbf,0x6a,0x4f,0x29,0xec,
-0x74,0x3b,0xdf,0x15,0xd9,0x11,0xf4,0x9e,0xaa,0x83,0x54,0x1b,
-0xf3,0x5b,0x61,0xbb,0x0a,0x98,0xdb,0xa3,0x7c,0xbb,0xb4,0x7d,
-0x15,0xb6,0xb9,0xe1,0x27,0xf4,0x1c,0x94,0xe4,0x72,0x85,0x91,
-0xfb,0x74,0x04,0xfe,0xd6,0xaa,0x4b,0x59,0x8d,0x3c,0x47,0xc1,
-0x43,0x7b,0x1f,0x93,0xce,0xeb,0x75,0x11,0x9c,0x05,0x14,0x10,
-0xfb,0x76,0x21,0x0d,0xb6,0xf3,0x9d,0xec,0x96,0x62,0x73,0x31,
-0x1d,0x8a,0x67,0x0b,0xe7,0x27,0xae,0xca,0x13,0x58,0x70,0xaf,
-0xa7,0x2e,0xfa,0x9a,0xa3,0xdc,0x82,0x22,0x59,0xbe,0x0a,0x7f,
-0x19,0x50,0x73,0x1f,0x0b,0xc9,0x91,0x94,0x1e,0x1a,0x01,0xd9,
-0xf6,0x95,0x67,0xc4,0xcc,0xa9,0x03,0x2b,0xfa,0x92,0xcc,0xa9,
-0xc5,0x99,0x22,0x22,0xe9,0xb7,0x20,0xf4,0x8f,0x1c,0x27,0xaa,
-0x4b,0x27,0xf3,0xdd,0x5b,0xda,0x3d,0x16,0x73,0xa5,0xac,0xfa,
-0x44,0xae,0x6e,0x15,0xb7,0x04,0xd9,0xf7,0xf2,0xb7,0xda,0x84,
-0x6c,0xe3,0x16,0x64,0x73,0xea,0x5b,0x97,0xd8,0x06,0xfe,0xfa,
-0xb4,0x7e,0xe6,0x3a,0x0f,0x6c,0xf0,0x8d,0x79,0x6b,0xd0,0xd7,
-0xf9,0xdc,0xf5,0xba,0x4a,0x8e,0x9f,0x9f,0x5a,0x97,0x54,0xba,
-0x37,0x1f,0x3c,0x25,0x2a,0x0b,0x68,0x26,0x56,0x9c,0x6f,0xcc,
-0x2b,0x85,0x3e,0x74,0xca,0xe1,0x30,0x78,0x14,0x0e,0x6a,0xd0,
-0x9c,0xcd,0x26,0xb7,0x0f,0xaa,0x7a,0xd2,0x58,0xa7,0x3d,0xb7,
-0xf0,0x87,0x9b,0x7c,0xbe,0x35,0x2c,0x3d,0x1a,0xf6,0xb7,0x70,
-0x7a,0xb6,0xd1,0xb0,0xac,0x45,0xb2,0xf2,0x73,0x7f,0xe5,0x61,
-0x56,0xa2,0xee,0x4b,0x7f,0xdd,0x9b,0xf9,0x75,0xc5,0x35,0xba,
-0x5d,0x67,0x17,0x47,0x97,0x2e,0x5c,0xe3,0x2a,0x45,0x7b,0xf8,
-0xb7,0xe3,0x6e,0xea,0xf4,0xc8,0xbb,0xf0,0x91,0x00,0x93,0xfe,
-0x08,0x9b,0x3b,0x52,0x6b,0x15,0xc5,0xa1,0x3d,0x1f,0xc0,0xde,
-0xad,0x9f,0xf6,0x0e,0xc2,0x6a,0x08,0x84,0x34,0x86,0x8b,0x94,
-0x25,0xa5,0x95,0x10,0x7a,0xfc,0x02,0x8f,0xa8,0x6f,0x5d,0x59,
-0xba,0x9e,0x7d,0xb0,0xee,0x51,0x53,0xac,0x55,0x23,0x38,0x9e,
-0x73,0x18,0x98,0x73,0x87,0xa9,0x20,0x5e,0xe4,0x2f,0x46,0xa8,
-0xd4,0xfc,0xa9,0xbf,0x54,0xdc,0x48,0x4f,0xd8,0xc8,0x7f,0xbd,
-0xe0,0x82,0xfd,0xfc,0xb8,0x91,0x05,0x28,0xe9,0x38,0x9b,0x7e,
-0x84,0xbe,0x71,0x9b,0xb3,0x4e,0x28,0x76,0xf4,0x4a,0x21,0x40,
-0x2f,0x8a,0x5f,0x69,0x31,0x0e,0xba,0xb1,0x87,0xa3,0x09,0x6c,
-0x8e,0x49,0x04,0xa7,0x19,0x10,0xfb,0x51,0xb5,0xd1,0x57,0xb6,
-0x4b,0x13,0x98,0xba,0x1a,0x25,0x83,0x09,0xfa,0xfa,0xa3,0xee,
-0x50,0x2d,0xee,0x0f,0x15,0x33,0x49,0x9b,0x7b,0x21,0x4b,0x2a,
-0x56,0x68,0xcf,0xce,0x29,0x51,0x08,0x47,0xd2,0x24,0x99,0x03,
-0x2b,0x10,0x74,0x2a,0x93,0x79,0x22,0x3b,0x46,0xef,0xdd,0xbb,
-0x60,0x58,0xb5,0xc0,0xd6,0xd8,0xa6,0xba,0x37,0x50,0x7c,0x0e,
-0x7f,0x6c,0xa7,0x7a,0xc3,0x30,0x48,0x7c,0x0d,0xaf,0x7e,0x3d,
-0x14,0xb9,0x26,0xcd,0xef,0x99,0x9f,0xc4,0xf7,0xea,0xd8,0xfb,
-0xf4,0xa9,0x71,0x9c,0x53,0xa7,0x3b,0x1d,0x02,0xd8,0x62,0x2e,
-0xf9,0xc2,0x8c,0xf1,0x05,0xfd,0x31,0xfe,0x90,0x56,0x20,0x7d,
-0x0a,0xb5,0x8f,0xbb,0xe2,0xb9,0xa1,0xaa,0x51,0xef,0xa9,0xd6,
-0x03,0xa0,0xb1,0xb6,0xa5,0xcf,0xeb,0xe6,0x69,0xd3,0x68,0x49,
-0x2a,0x4e,0x61,0x5b,0xcf,0xa4,0x26,0x23,0x51,0xcf,0x74,0xe6,
-0xa1,0x9a,0x4f,0xc6,0xa4,0xd3,0x6e,0x86,0x0a,0x22,0x6e,0x52,
-0xe1,0xaf,0xcb,0x08,0x02,0x25,0xe1,0x4d,0x44,0x06,0x16,0x84,
-0x55,0x77,0x9e,0x9c,0x81,0x7f,0x06,0x39,0xf8,0xb3,0x34,0x8a,
-0x72,0xd4,0xf8,0x8b,0x39,0x1a,0x03,0x72,0x44,0xc6,0x2b,0x47,
-0xf8,0x60,0x32,0x06,0x16,0x1e,0x45,0xff,0xe6,0x02,0xa7,0xca,
-0x9e,0xa6,0x14,0x53,0x30,0x4a,0xd9,0x00,0xef,0x98,0x89,0x10,
-0x64,0xf4,0x4e,0xa4,0x61,0xcf,0xbb,0xbf,0x0d,0x49,0xc7,0x36,
-0xc3,0x37,0x65,0xa7,0x63,0xf5,0x10,0x74,0x1a,0x8c,0x94,0xc7,
-0x8b,0x79,0x6f,0xaf,0xec,0x8b,0x14,0xce,0xac,0x0f,0xfa,0x7d,
-0xba,0xc8,0x8a,0xb7,0xca,0xd5,0x81,0xc2,0x1c,0x45,0xfe,0x7c,
-0x65,0x82,0x01,0x8f,0xe4,0x65,0x4f,0xef,0x2b,0x17,0x3a,0x1c,
-0xae,0x7a,0xe4,0xe7,0x1b,0xee,0x30,0xa8,0x55,0xd3,0xc6,0xa0,
-0x59,0x79,0x26,0xa7,0xd5,0xeb,0x7b,0x56,0x9a,0x87,0x27,0xf4,
-0x5e,0x95,0x47,0x34,0xcf,0x17,0x0a,0x9f,0x9a,0xc9,0x70,0x72,
-0x4d,0x1b,0x05,0x0f,0x3c,0x5e,0x90,0x9e,0x86,0xd3,0x09,0xec,
-0x6f,0x21,0x4f,0xb5,0x21,0x2c,0x2c,0xc3,0xb9,0x65,0xd1,0x04,
-0x3d,0xe4,0x5d,0xd2,0x41,0x57,0xe0,0xbb,0xa1,0x71,0xe6,0x5d,
-0x86,0xbd,0x52,0x69,0x7c,0x34,0xed,0x28,0xeb,0xa5,0x41,0x0d,
-0x7b,0xaa,0x7a,0x89,0x65,0x06,0x17,0xd5,0xa5,0x9e,0x6b,0xf2,
-0x5b,0x75,0x9b,0xf6,0x9c,0x9c,0x73,0xd1,0xb7,0xa0,0x8f,0x39,
-0x4d,0x76,0x5f,0xc5,0x2e,0xc5,0x75,0x68,0x28,0xe4,0x07,0xcf,
-0xa3,0x93,0xe2,0xf3,0x47,0xf1,0xb7,0x27,0x95,0x8c,0xbd,0xdb,
-0x3d,0x17,0x1f,0x7e,0x8b,0x57,0xf6,0xd4,0xdd,0x76,0x8f,0xb4,
-0xea,0x6d,0xe6,0x10,0x50,0x31,0x9f,0xee,0x74,0x09,0x12,0x32,
-0x1f,0xb3,0x58,0x7c,0x84,0x4a,0xc2,0x7f,0x74,0xce,0xcf,0x1a,
-0x3c,0x26,0x41,0x34,0x98,0x51,0xbf,0x01,0xa3,0xc9,0x30,0x00,
-0xbe,0x5c,0x43,0xc7,0xbc,0xb5,0x9b,0x1a,0xab,0xfc,0xeb,0xba,
-0xb2,0xba,0xba,0xea,0x46,0xbf,0xb7,0x1f,0xd8,0x24,0xc5,0x14,
-0xd6,0xbf,0x8e,0x84,0xb2,0x4a,0x0a,0xbf,0xf2,0x86,0x72,0xe6,
-0x3a,0xab,0x71,0xa3,0x9b,0x96,0x28,0xfd,0xd2,0x32,0x21,0x5c,
-0xf9,0x67,0xb3,0x62,0xa7,0x70,0x59,0x16,0x92,0x77,0xbd,0xe9,
-0xed,0x66,0x2e,0x47,0x49,0x88,0x2e,0xe8,0xc0,0x04,0x2d,0xea,
-0x3f,0x34,0x9f,0x59,0xf5,0xe5,0x05,0xc8,0x70,0x38,0xac,0x3a,
-0x67,0xfd,0x02,0xa8,0x68,0x59,0xaf,0xfc,0xf3,0x8e,0x7e,0x0f,
-0x3c,0x2d,0x8c,0x2d,0xf8,0xaa,0xd9,0xae,0x3f,0xb9,0xe7,0x60,
-0x63,0x06,0x8f,0x10,0x31,0xf8,0xf3,0x87,0x22,0xae,0xb7,0xd4,
-0xde,0x0f,0xf2,0xc7,0xd6,0x18,0xa0,0x20,0x75,0x7e,0x78,0xbe,
-0xcb,0x8e,0xd1,0x70,0x47,0xae,0x4b,0x61,0x90,0xfd,0x02,0xcb,
-0x2b,0x2e,0x53,0xbf,0xdc,0x0c,0x71,0x54,0x1a,0x6e,0x15,0x85,
-0x00,0x3e,0xb2,0xf5,0x93,0x52,0x49,0x73,0x7f,0x0c,0xe7,0xec,
-0x20,0xaa,0x18,0xc5,0x73,0x28,0x71,0xe6,0x75,0x65,0x7e,0x3d,
-0x09,0xe4,0x0a,0x62,0x2d,0x5a,0xfe,0x0e,0xcf,0xf4,0x7a,0x6c,
-0xa5,0xf3,0xaa,0xee,0xe8,0x7d,0x2e,0x33,0x96,0x89,0x67,0xfc,
-0x12,0x1f,0x7f,0x78,0x88,0x5d,0x00,0xb2,0xeb,0x65,0xba,0xed,
-0xa2,0x61,0x46,0x87,0x97,0x66,0xd1,0x08,0xbb,0x1d,0x2e,0xd5,
-0xa7,0xcc,0x83,0x40,0x56,0xd4,0x27,0xfa,0x80,0x7e,0x83,0xf8,
-0x04,0x54,0xa9,0x09,0xc0,0xdd,0xf5,0xa4,0xfd,0xc6,0xe9,0x66,
-0xe8,0x6b,0x07,0x44,0xc8,0x9b,0x13,0x7c,0x42,0xad,0xea,0x6a,
-0xd3,0xe6,0x34,0x10,0x8d,0x7d,0xf0,0x07,0xf3,0xe1,0x37,0xcb,
-0xcd,0xe0,0xd0,0x37,0x44,0xad,0xae,0x17,0xb6,0x38,0xc8,0x88,
-0xe7,0x7a,0x17,0x81,0xf7,0x1c,0xa6,0x79,0x9b,0x8e,0x1e,0x47,
-0x5e,0x7b,0xf2,0x9e,0xb0,0xcd,0x45,0x40,0xbc,0x48,0xa7,0x2c,
-0x24,0xfc,0xfb,0x75,0xef,0xf6,0x83,0x4f,0x83,0xd9,0xd3,0x76,
-0x26,0x5d,0x30,0xaf,0x56,0x2c,0x6a,0xed,0xc1,0x99,0xed,0xf9,
-0x06,0x8a,0xe6,0x82,0xca,0xcb,0xcd,0x74,0xab,0x81,0x92,0xb3,
-0x5d,0x43,0xcb,0xcf,0x78,0x95,0xe7,0x9f,0xf5,0xbc,0x83,0x0b,
-0x3a,0x6c,0x18,0xab,0x04,0x5a,0x4f,0x8d,0x4d,0xf6,0x03,0x4f,
-0x7c,0xc0,0xf7,0x37,0xae,0xe5,0x31,0x0a,0x15,0x08,0xb8,0xfb,
-0xe7,0xa8,0xc9,0xcb,0xe6,0x7b,0xed,0x17,0xcd,0x94,0x9b,0xbc,
-0x4d,0x1c,0x53,0x3f,0x92,0x27,0x86,0x7a,0x37,0xdb,0xc6,0x73,
-0x0e,0x9d,0xe9,0x95,0x50,0x7c,0xed,0x47,0xda,0xc7,0x16,0x8f,
-0xac,0x45,0x95,0x8f,0x92,0x06,0x28,0x5e,0x79,0xe8,0x00,0x4c,
-0x9b,0x23,0x04,0xfe,0x78,0xb6,0x07,0x3e,0x00,0x65,0xda,0x2a,
-0xdd,0x4e,0x11,0xc9,0x5d,0x7d,0xf9,0x1c,0xcc,0xe6,0xb9,0x95,
-0x8b,0xa9,0x5e,0x4a,0x7c,0x39,0xea,0x1c,0xe0,0xb5,0x3d,0xee,
-0x33,0xcd,0x3a,0xe1,0x6f,0xd3,0x10,0xdf,0x99,0x3f,0xc6,0xef,
-0xfd,0x69,0x0f,0x0e,0x54,0x55,0xba,0xb9,0x07,0x07,0xac,0xe6,
-0xc3,0x4e,0x77,0xb5,0x91,0x5b,0x78,0xae,0x7d,0xab,0x8e,0xf3,
-0xb8,0xa0,0x93,0xeb,0x7b,0x66,0xd0,0x29,0x22,0x97,0xad,0x5e,
-0x1a,0x95,0x58,0x11,0xb1,0x17,0x1f,0x30,0xfc,0x18,0xda,0x23,
-0xe0,0x38,0xd8,0x99,0xc1,0x59,0x70,0x04,0xdd,0x1a,0x8d,0xd0,
-0x11,0xa2,0xca,0xce,0xa1,0x00,0xef,0x42,0xdf,0xd3,0x85,0x0f,
-0x7f,0x69,0x17,0xe2,0xb4,0x57,0xb2,0x0b,0x17,0xec,0x30,0xbc,
-0x83,0x83,0x97,0x1e,0x0f,0x92,0x7f,0x01,0xff,0xc3,0x83,0x8e,
-0xc0,0xbf,0xe9,0xc1,0xff,0xe2,0x2f,0xc5,0xbf,0xdf,0x4b,0x4b,
-0xe2,0xff,0x0b,0xdb,0xd7,0x8e,0x50,0xec,0x82,0xfb,0xcb,0x1a,
-0xa3,0xb0,0x7f,0x21,0x47,0x61,0xe0,0xe9,0xc5,0x2f,0xf3,0xb6,
-0x2f,0xee,0x02,0x5e,0x12,0x8f,0x7f,0x41,0xdb,0xd1,0x5d,0xd0,
-0x9b,0xb1,0x53,0x7c,0x92,0xe1,0x26,0x84,0xb6,0x2f,0x4e,0x45,
-0xd3,0xa1,0xa7,0xe9,0x7f,0x7d,0xb5,0xa6,0x7b,0xec,0xcd,0x74,
-0x38,0x64,0x97,0x21,0x6e,0x7a,0xd5,0xcb,0xe3,0x8e,0xa7,0x35,
-0x57,0x62,0x16,0xd2,0x27,0xd4,0x28,0x25,0xbf,0x60,0x33,0x47,
-0xdc,0x7d,0x06,0xf5,0x06,0xd0,0xb7,0xb3,0xa3,0x13,0xde,0xb9,
-0xed,0x4d,0xab,0x39,0x51,0xf8,0x10,0xa6,0x73,0x3f,0x7c,0x80,
-0x82,0xc7,0x67,0x87,0xa2,0xe0,0x86,0x07,0xaf,0xa3,0x92,0x72,
-0xe3,0x5e,0xae,0xe6,0xa1,0xaf,0x26,0x45,0x18,0x2b,0xdd,0xa3,
-0x53,0xa0,0x19,0xb7,0xc3,0x49,0x64,0x2f,0xc5,0xaa,0xb3,0xed,
-0x9b,0xb2,0xa7,0x7e,0x1a,0x12,0x84,0xe3,0xa5,0x1a,0xfe,0x2f,
-0x11,0x6f,0x5d,0x8a,0x3e,0x78,0x65,0xba,0xbe,0x6d,0x04,0x84,
-0x81,0x71,0x71,0x88,0xfa,0xdf,0x38,0x2b,0x78,0xe9,0x1a,0xfb,
-0x1e,0xbe,0x50,0x95,0x1c,0x8e,0xff,0x55,0x71,0xc5,0x28,0x4b,
-0x24,0xd2,0x8f,0xf4,0x3a,0xdd,0x28,0x16,0x07,0x55,0xf6,0x01,
-0x87,0x81,0x9a,0x04,0x1d,0x70,0x53,0x3c,0xe9,0xdb,0x78,0xd7,
-0xf1,0x56,0x13,0xec,0xcc,0xcf,0xb6,0xce,0x69,0xc6,0xdd,0x8b,
-0x0a,0xa9,0x55,0xad,0xad,0xd6,0xbe,0xab,0x3d,0xad,0xd5,0x6b,
-0x0d,0x74,0x0a,0x84,0xb9,0x81,0x50,0xbf,0x6f,0xd6,0xbf,0x6f,
-0xb3,0x03,0x45,0xb2,0x8e,0x4d,0x32,0x4e,0x8e,0x6a,0x65,0x17,
-0xa1,0x3c,0xaf,0x73,0x9d,0xa0,0x8e,0x01,0x85,0x11,0x37,0x02,
-0x98,0x34,0xa8,0x91,0x0b,0x32,0xd2,0xf7,0xc5,0x79,0xe1,0x79,
-0xd5,0x73,0xfc,0xfc,0xce,0x93,0xf6,0xd4,0x93,0x56,0xf7,0xa4,
-0x35,0x9c,0xd1,0x29,0xda,0x24,0xad,0x0e,0xf8,0xb7,0x72,0xe3,
-0xdd,0x65,0x8f,0x58,0xe9,0x95,0x29,0x7c,0x7d,0xf2,0x43,0x6c,
-0x2d,0x05,0xf1,0xbb,0x12,0x10,0xdb,0x4b,0x41,0x7c,0x5a,0x02,
-0xe2,0xfa,0x52,0x10,0xeb,0x5f,0xbd,0xd7,0xee,0x58,0x3e,0xbe,
-0xd7,0x9f,0xe7,0x88,0x22,0x1c,0x54,0x89,0x89,0x62,0x4c,0x8c,
-0x75,0x7b,0x56,0xb0,0xea,0xfb,0xab,0xf5,0x66,0xd3,0x5d,0xa5,
-0xf7,0x01,0xfc,0x71,0xe7,0x9c,0x9d,0xa0,0xf8,0x52,0x6f,0xb1,
-0xce,0x74,0x22,0x14,0x1e,0x3c,0x1a,0xa2,0x51,0x14,0x9f,0x1a,
-0x8a,0xa4,0x3a,0x24,0xec,0xe7,0xa7,0xd9,0x9a,0x6f,0x65,0x2c,
-0x1e,0xab,0xc5,0x5d,0x8c,0xdc,0x33,0x4c,0xe1,0xe2,0x70,0x66,
-0x27,0x75,0x40,0x76,0x19,0x86,0xac,0x43,0xc7,0x61,0xb1,0xc8,
-0xc6,0x03,0xe6,0xae,0x14,0x76,0xa5,0x2a,0xeb,0x74,0xda,0x62,
-0xe1,0x87,0xad,0x9a,0x47,0xbd,0x12,0xe1,0xba,0xf8,0xfd,0x40,
-0xbd,0x32,0xe3,0x55,0xb9,0x3c,0x01,0xce,0x1c,0x02,0xe4,0x46,
-0x59,0x60,0x7b,0x5e,0x0e,0xdb,0xf5,0x45,0xd8,0xae,0x0b,0x6c,
-0x07,0x8f,0xc2,0xf6,0xbc,0x24,0xb6,0x63,0x3b,0xe9,0x78,0x7c,
-0x17,0x7f,0xe2,0x97,0x23,0x5d,0x7a,0xa2,0x77,0xf0,0xf7,0x27,
-0xac,0x7a,0xd2,0x69,0x7b,0x36,0xce,0xf1,0x7c,0x05,0x44,0xdb,
-0xbf,0x6d,0xe6,0xd0,0x89,0x8b,0xd1,0x71,0x59,0x5e,0xa1,0xb3,
-0xee,0x41,0x27,0x9e,0x8f,0xce,0x7a,0x49,0x74,0xfe,0x58,0x0e,
-0x9d,0x4b,0x42,0xe7,0xd2,0x83,0xcf,0x1f,0x5f,0x07,0x9f,0xcf,
-0xcb,0x8d,0x16,0xe1,0xd3,0xf6,0xe1,0xf3,0xf9,0xeb,0x0c,0xd7,
-0x9f,0xc5,0xf8,0xb4,0x8a,0xf0,0x69,0xf9,0xf0,0xf9,0xf3,0x2b,
-0xe8,0xc7,0x10,0xa1,0x67,0xac,0x13,0xdc,0xc1,0x41,0x87,0x9b,
-0xe9,0xab,0x87,0x47,0x07,0x9d,0x03,0x4f,0x73,0x5e,0x55,0x37,
-0xbe,0xaf,0xaf,0xdf,0xd1,0xcc,0x67,0xcf,0x11,0x74,0x0a,0xf1,
-0xd9,0x46,0x91,0x1d,0x9d,0xeb,0x4d,0x94,0x2e,0x7d,0x28,0xb9,
-0x8a,0x50,0x29,0xbd,0x63,0xe5,0xaf,0x8d,0xd5,0xdf,0xd8,0x3a,
-0x03,0x3c,0xb8,0x8f,0x32,0x7f,0xe8,0x61,0x4d,0x7b,0x99,0x9b,
-0x58,0xfd,0x6d,0xde,0x09,0xe6,0xcb,0x44,0xbe,0xb7,0xec,0x2a,
-0xe8,0xf2,0xcd,0xeb,0xed,0x95,0x38,0x86,0x6e,0x6f,0x7b,0x28,
-0xf3,0xd6,0x87,0x43,0x16,0x74,0x3b,0x4b,0x1c,0x6c,0x5e,0x58,
-0x47,0x48,0x7e,0x99,0x86,0xc6,0xe2,0x62,0xff,0xd4,0xd3,0xe4,
-0x0b,0x5f,0x93,0xe4,0x63,0xde,0x09,0x13,0xb4,0x1a,0xe3,0x9d,
-0x5b,0x8a,0xe8,0x0d,0x03,0x84,0x17,0x27,0x0c,0xe0,0x9f,0x08,
-0x78,0xa3,0xe2,0x1b,0xad,0xdc,0x85,0x1e,0xd4,0x60,0x25,0xd3,
-0xf0,0x6b,0x0d,0xec,0x4b,0xd8,0xc7,0xb1,0xb8,0xd5,0xc3,0x33,
-0x5f,0x0f,0x5f,0x16,0xf7,0x90,0x04,0x56,0xd4,0x0f,0xa0,0x9b,
-0x01,0x0a,0xd2,0x1c,0x85,0xa5,0x3b,0xa6,0x6e,0xdc,0x7c,0x51,
-0xcf,0xbc,0x9a,0xe3,0x85,0x70,0xa8,0x40,0xc8,0x23,0xb0,0xbf,
-0x1b,0x7f,0x1a,0xc7,0xf7,0x63,0x7e,0x8e,0xe6,0x1a,0x90,0x5d,
-0xf6,0x5f,0x69,0xa3,0x42,0x01,0xc6,0xe6,0x2e,0x74,0x39,0x75,
-0xd8,0x8a,0x41,0x43,0x21,0xd5,0x2c,0xd6,0x87,0x71,0x8a,0x37,
-0xf9,0x39,0x05,0xe7,0x5d,0x67,0x12,0xf6,0x90,0x8b,0xf4,0x0a,
-0x89,0x8a,0x0c,0x3a,0x75,0x63,0x30,0x67,0x52,0x35,0xd9,0x47,
-0x1d,0x00,0x62,0x3f,0xdb,0x2d,0x0f,0x65,0x9d,0x83,0x93,0xc3,
-0x05,0x6b,0x35,0x6f,0x7e,0x9f,0x37,0xff,0xee,0x87,0x32,0x50,
-0xdf,0xfd,0x50,0x0a,0xe6,0x6b,0x01,0x73,0x1c,0xe1,0x24,0x20,
-0xdf,0xa6,0x94,0x55,0xdf,0x75,0xf6,0x3b,0x07,0xc7,0xc7,0xab,
-0xa5,0xf0,0x7f,0xd7,0x29,0xd5,0xd2,0x86,0x20,0xde,0x34,0xeb,
-0xdd,0x96,0x01,0x4b,0x05,0x4b,0x41,0x3e,0xe0,0x90,0xdf,0x44,
-0xe3,0x71,0x94,0xe6,0x17,0xc0,0x4d,0x67,0x9e,0x14,0xb4,0x27,
-0xaa,0x97,0x6a,0xf1,0x52,0xb4,0x98,0x84,0xe3,0x72,0x9d,0xe1,
-0x25,0x4b,0xc1,0xfe,0x1f,0x13,0xf6,0x41,0x30,0x0e,0xfa,0x51,
-0x30,0x2e,0xdf,0x86,0xac,0x51,0xaa,0xad,0x1f,0x78,0x5b,0xdf,
-0x03,0xac,0x72,0x6d,0xf0,0x92,0xa5,0x60,0xff,0xcc,0x61,0x1f,
-0xc3,0x41,0xa5,0x64,0x07,0x44,0xd1,0x52,0xd0,0x8f,0x38,0x74,
-0x58,0x2b,0xef,0xc3,0x1b,0xa8,0x74,0x18,0x78,0xc7,0x7e,0xab,
-0xdc,0xd8,0x3b,0x60,0x4a,0x61,0xf0,0xbf,0x1c,0x83,0xce,0xc4,
-0x6d,0xb9,0x78,0xa2,0x4f,0xca,0x43,0x7f,0x2b,0xa0,0xdf,0x87,
-0x7d,0x5f,0xbf,0x5c,0xe9,0xa7,0xa8,0x45,0x5e,0xbd,0x54,0x8b,
-0x2f,0x64,0x8b,0x51,0x9a,0x96,0x83,0x0d,0x05,0x4b,0x41,0x5e,
-0x13,0x9c,0xd0,0x39,0xa7,0x53,0x2c,0xab,0xc2,0x82,0x39,0x0d,
-0x86,0xc3,0x19,0x5b,0xdb,0x5f,0x2d,0xc5,0x18,0xa2,0x66,0x39,
-0x39,0x45,0x27,0xc8,0x8d,0x87,0x9f,0xbc,0xe9,0xf3,0x57,0x58,
-0xd0,0xf4,0x8e,0x92,0x53,0xba,0x59,0x27,0x6a,0x74,0xad,0x31,
-0xf6,0x26,0xf7,0xb4,0x6d,0xab,0xf8,0xe6,0x6e,0x87,0x9e,0x9d,
-0x2b,0x4e,0x7b,0x56,0x0c,0x55,0x34,0x63,0x5c,0xa4,0x18,0x30,
-0x11,0x8e,0xa8,0x57,0x45,0x39,0xaf,0x8f,0x4e,0xcc,0x2c,0x46,
-0xb2,0x1b,0xbe,0x57,0xc7,0x48,0xdd,0x1f,0x62,0x28,0x4f,0xbd,
-0xe6,0x1b,0xa1,0x32,0xb9,0x11,0x19,0x6d,0x6e,0x3a,0xa1,0xf9,
-0xac,0x92,0xbf,0x21,0x65,0x95,0x17,0x1e,0xd1,0x46,0x11,0xc3,
-0xfe,0x60,0x78,0xcf,0x99,0x26,0x07,0xdb,0x8a,0x68,0xf9,0xe3,
-0xf0,0x7a,0xd7,0xcd,0x9c,0x7d,0x98,0x28,0xd2,0xdc,0xcd,0xa7,
-0xb5,0x3c,0x69,0x6d,0x57,0x21,0xa4,0x4c,0x8b,0x02,0x7e,0xcb,
-0x6b,0x7f,0xe6,0x22,0x6b,0x94,0x0d,0x95,0x93,0xa6,0x2a,0x5e,
-0x60,0xc6,0xe3,0x77,0x91,0xaf,0xb0,0x4a,0x55,0xd7,0xce,0x19,
-0x75,0x5d,0x0b,0xa2,0x47,0xf5,0x44,0x78,0xaf,0xbb,0x78,0x53,
-0x2c,0x8b,0x8c,0xfd,0x84,0xe1,0x47,0x26,0x61,0x92,0xcd,0x4a,
-0x02,0xda,0xf0,0x10,0x65,0xd3,0x03,0x1c,0x58,0x75,0x7c,0x13,
-0xb2,0xfe,0x6c,0x1c,0x8c,0xa2,0x1e,0xbf,0xa7,0xeb,0x5e,0xaa,
-0x2a,0x6a,0xa3,0xe5,0x1d,0x0d,0xdf,0x70,0xb4,0xda,0xbe,0xc4,
-0x75,0x5f,0xa2,0x0f,0xf1,0xd6,0xa6,0x2f,0x71,0xcb,0x97,0xf8,
-0xcc,0x97,0xb8,0xed,0x4b,0xdc,0x59,0x4c,0x8d,0x69,0xb4,0x1c,
-0x41,0x36,0xb6,0x8a,0x61,0x82,0xcc,0x4e,0x31,0xc9,0x4b,0x82,
-0xda,0x6c,0x7a,0x40,0x49,0xbc,0xf0,0xfa,0x5c,0x59,0x38,0x2d,
-0x0f,0x9c,0x70,0x14,0xc0,0xaa,0x48,0xa1,0x11,0xca,0x82,0xc9,
-0x4d,0x28,0x0c,0xfd,0x04,0x3b,0xdd,0x64,0x8a,0xf1,0xfa,0x8d,
-0xf7,0x43,0xd5,0xcd,0xe7,0xc5,0x40,0x5b,0x4d,0xef,0x60,0x37,
-0xbd,0xa3,0x5d,0xc0,0x6c,0x5e,0x6e,0xf3,0xb3,0x9b,0x9f,0xdf,
-0xfc,0x0c,0xe7,0xe7,0x38,0x3f,0xcb,0xf9,0x79,0xce,0x65,0x3a,
-0xa2,0x18,0x59,0xf9,0x4a,0xf2,0xd4,0xe7,0x82,0x25,0x35,0x67,
-0xd2,0x5d,0x68,0xd0,0x9d,0xbb,0xed,0x78,0xee,0xbc,0x58,0x6f,
-0x66,0xe1,0x22,0x6e,0xbb,0x65,0x9b,0xc5,0x84,0x0f,0x50,0xb3,
-0x82,0x1e,0x3e,0xe2,0xca,0xcd,0x8e,0xc7,0x21,0xc8,0x83,0xa3,
-0x7f,0x3d,0xb5,0xca,0x7c,0x07,0xcc,0x80,0x8f,0x99,0xdd,0xd2,
-0xb6,0x8d,0x51,0x17,0xf7,0xb3,0x6a,0x73,0x95,0xd5,0xd9,0x86,
-0x7b,0x73,0x4e,0xfb,0xe5,0xca,0xcd,0x69,0xaf,0x08,0x8d,0x45,
-0x3b,0xd3,0x42,0xcc,0xc5,0x93,0x77,0xe6,0x50,0xe5,0x30,0xb1,
-0x5b,0xce,0x03,0x99,0x73,0x61,0x68,0xfe,0x61,0x36,0x8d,0x2c,
-0x91,0xa0,0xf2,0x0a,0xfd,0x38,0x5f,0xe2,0xaf,0x6f,0x2a,0xde,
-0x4d,0xfd,0x95,0xb5,0xa3,0xbf,0xb4,0xbe,0x7d,0xe3,0xd0,0x88,
-0xd3,0x27,0x09,0x31,0xd6,0x91,0x8b,0x60,0x4e,0x40,0x32,0xd1,
-0x68,0xc2,0x98,0xec,0xb8,0xcd,0x2f,0xe4,0x0c,0x1f,0x6d,0x1f,
-0xcf,0x05,0x73,0x11,0xac,0xfc,0x1d,0x49,0xf4,0xa4,0x42,0x3e,
-0x39,0xe8,0xf9,0x5a,0xf1,0x53,0xeb,0xef,0x16,0x7d,0x9e,0x58,
-0xdf,0x98,0x2d,0x1b,0x55,0xbc,0xc4,0x8b,0xd3,0x6c,0x39,0xea,
-0x2d,0xc5,0x93,0x05,0x73,0xdd,0xea,0xe9,0x9e,0xbf,0x67,0x38,
-0x1f,0x5c,0xb5,0x8d,0x77,0x65,0x50,0xb9,0x73,0xfc,0x86,0x28,
-0x9a,0x77,0xca,0xf6,0x9d,0x54,0xae,0x3b,0x7d,0x37,0xc1,0x3c,
-0x7c,0x6c,0x24,0x65,0x55,0xf9,0x7c,0x22,0x85,0x31,0xae,0x1e,
-0xbc,0x7b,0xe7,0x51,0x72,0xed,0xfb,0x94,0x5c,0xfc,0xee,0xcf,
-0xbb,0x89,0x29,0xb6,0x95,0x51,0x23,0x0a,0xd4,0x5e,0x7b,0x51,
-0x3b,0x44,0x05,0x53,0x31,0x72,0x87,0x1e,0xe4,0x5e,0x17,0x23,
-0x87,0xd0,0x1e,0x89,0xde,0x81,0x17,0xbd,0x37,0x70,0x44,0x0d,
-0x92,0xfe,0x1c,0x0c,0xdf,0x78,0x30,0x3c,0x28,0xc6,0x50,0x00,
-0x7c,0x24,0x92,0x87,0x5e,0x24,0x5f,0x07,0xbd,0x4f,0x0b,0xb0,
-0x7c,0xed,0xc1,0xd2,0xeb,0x24,0x22,0x2e,0x78,0x09,0x88,0x8f,
-0x44,0x73,0x0f,0x7f,0xbd,0xf5,0xe2,0x2a,0x9f,0x5f,0x61,0x18,
-0xd5,0x63,0x0f,0x36,0xde,0xe9,0x68,0xfc,0xc1,0xc4,0xf7,0xba,
-0x55,0xc3,0xa3,0x00,0xe0,0x7c,0x51,0x56,0xa5,0xcd,0x71,0x06,
-0xc8,0x8f,0x44,0xf7,0x1f,0x8c,0x1d,0x25,0x08,0x1e,0x4e,0xc9,
-0x78,0x7d,0x65,0x18,0xcc,0x58,0xf5,0xc8,0xc7,0x7a,0xff,0xf0,
-0x35,0x1f,0x62,0xdd,0xe3,0xb1,0xa8,0xf9,0x48,0x1c,0x7e,0x30,
-0x70,0xe0,0x5e,0x44,0x47,0x27,0x1e,0x04,0x7e,0x98,0x83,0x00,
-0x5d,0x5a,0x7a,0x4c,0xeb,0x23,0x36,0x62,0x86,0x4a,0x55,0xbd,
-0x4b,0x08,0x7c,0xd4,0xf9,0xde,0x67,0x74,0x1a,0x79,0x7c,0xcf,
-0xbf,0x31,0xb6,0xaa,0x22,0x71,0x03,0x9a,0xd0,0xc0,0xe7,0xa0,
-0x5a,0xc2,0x2b,0x5d,0x90,0x6d,0xcc,0xa4,0x8b,0x1e,0x2a,0x51,
-0xa7,0x29,0xbb,0x0c,0xc9,0xc2,0x50,0x3d,0xec,0xf8,0x10,0x77,
-0x8d,0xad,0x25,0x11,0xef,0x53,0x13,0xbc,0x85,0x2f,0x41,0x1b,
-0xe3,0x4e,0xe9,0x9f,0xef,0xd8,0x7e,0xbf,0x1f,0xe9,0xc7,0x44,
-0x64,0xf2,0x9a,0xbf,0xab,0xff,0x6d,0xa7,0x8a,0x87,0xb0,0x21,
-0xa3,0xfa,0x1a,0xaf,0xac,0xad,0xea,0x11,0xac,0xa6,0xab,0xee,
-0x0a,0x70,0x7c,0xf0,0xd6,0x43,0x8e,0xff,0xf6,0xbb,0x89,0x21,
-0x60,0xd2,0xad,0x3c,0x92,0x97,0x8f,0xbc,0x33,0x5f,0x3b,0xc8,
-0x15,0x2e,0x53,0x67,0x3e,0x96,0xf7,0x7a,0xc1,0xf1,0x29,0x8f,
-0x20,0x1f,0xcd,0xf5,0x29,0x7b,0xe3,0x5f,0xa1,0x92,0xb0,0x17,
-0x62,0xf0,0xd1,0xc7,0x20,0xfb,0x66,0xce,0xfa,0x24,0xe1,0x7e,
-0x01,0xc6,0xdf,0x7b,0x31,0x36,0xa6,0xae,0x78,0xfe,0x9e,0xb1,
-0x6b,0xdf,0xd2,0x8a,0x17,0x1d,0xf9,0xe2,0xfa,0x76,0xdf,0x83,
-0xfc,0xf7,0xc5,0xc8,0x63,0x13,0x12,0xf8,0x23,0x71,0x3f,0x29,
-0xe2,0x5f,0xa2,0x87,0x87,0x65,0x7d,0xf4,0x3d,0x29,0xe6,0x58,
-0x04,0xf3,0x58,0x8e,0x3d,0xb5,0x53,0x0f,0xe1,0xf0,0x9c,0x85,
-0x73,0x70,0x3b,0xf4,0xe1,0xe6,0x75,0x81,0xec,0x13,0xa8,0x2f,
-0xc1,0xed,0xa2,0x08,0xb7,0x79,0xf3,0xfd,0xd0,0x3b,0xdf,0xbd,
-0x7e,0xc9,0x1c,0xc3,0x2f,0x99,0xef,0x3f,0xd9,0xa9,0x7c,0x1f,
-0x5b,0x80,0xe0,0x91,0x17,0xc1,0x9f,0x0a,0xb7,0xb7,0xc7,0xe3,
-0x37,0x62,0xbf,0x9a,0xbb,0x9b,0x12,0x40,0x24,0x3b,0xdb,0x55,
-0x16,0xcd,0x9c,0xb7,0x17,0xbe,0x99,0xf3,0xab,0x77,0xe6,0x40,
-0x9b,0xd0,0xda,0x63,0xa7,0x4d,0x6b,0xa3,0xc5,0xb6,0x5a,0x2c,
-0x80,0x7d,0xe2,0xed,0xc5,0x25,0xab,0xdb,0xb9,0x6f,0xe3,0x24,
-0xfa,0x77,0x8c,0xfe,0x68,0xba,0x47,0x97,0xf8,0x68,0x6b,0x74,
-0x17,0xe6,0xd0,0x0b,0x7c,0xe8,0xbd,0x95,0xf5,0x64,0xb5,0x47,
-0x51,0x97,0xa5,0xac,0x67,0x27,0xe3,0x4b,0x7b,0x72,0x53,0x36,
-0x45,0x89,0x8b,0x24,0x1a,0x05,0xc9,0x8c,0x1d,0xee,0xbb,0xde,
-0x76,0x08,0xe8,0xe5,0x32,0xa0,0x78,0x3c,0x44,0x01,0x2c,0xd7,
-0x5b,0xaf,0x3b,0x37,0x06,0x34,0xe5,0x90,0x4a,0x49,0x20,0xf3,
-0xd8,0xa9,0x6f,0xa7,0xf2,0x5d,0xc2,0xe5,0x2a,0x46,0x3c,0xe3,
-0x4a,0xb6,0x82,0xb5,0x80,0x8f,0xde,0x7b,0xf9,0xa8,0xef,0x75,
-0x2e,0x80,0x06,0xbe,0x88,0x8f,0x36,0xd9,0xd6,0x26,0x0b,0x81,
-0x8f,0xde,0x23,0x1f,0xb1,0xf7,0xb0,0x58,0x46,0xbd,0x52,0x8c,
-0xe3,0xbd,0x7d,0xf7,0xfe,0xab,0x30,0x8e,0x38,0x25,0x0c,0xdc,
-0xe9,0x67,0x30,0x36,0xda,0xf6,0xf3,0xc8,0x16,0x1c,0x1c,0x72,
-0xd3,0x58,0x9c,0x23,0xde,0xbe,0xf7,0x9d,0x23,0xbc,0xd7,0xfe,
-0xde,0xaa,0x9e,0x3d,0x92,0x33,0x6e,0xb9,0x69,0x07,0xa3,0x06,
-0x02,0x93,0x9e,0xfa,0xf8,0xfc,0x15,0x2f,0x57,0x97,0x4f,0x84,
-0xd1,0xd5,0x20,0x7a,0x3d,0x33,0xad,0x89,0xb7,0x9a,0xad,0xc4,
-0x1c,0xe6,0xb7,0x05,0x0e,0x5f,0xd8,0xe8,0x23,0xd1,0x1e,0x32,
-0x71,0x3f,0x82,0x23,0x7e,0x59,0x8c,0xf8,0x30,0x87,0xce,0xb0,
-0xf0,0xee,0xc4,0xa3,0x11,0x12,0x9c,0x91,0xb8,0x23,0x8a,0xa4,
-0xed,0xa8,0x98,0xc2,0x97,0x14,0xe6,0x82,0x5d,0x67,0xf1,0x64,
-0x8f,0x07,0xc0,0xb0,0x26,0xdb,0x00,0x6f,0x7d,0xa4,0xf8,0x42,
-0x77,0x3c,0x60,0xf7,0xd1,0xb8,0xee,0x42,0xeb,0xc7,0xf7,0xab,
-0xdc,0xcf,0xed,0xea,0x75,0x71,0x87,0x93,0x5c,0x87,0xbd,0x97,
-0x79,0xa1,0xbb,0x1c,0x33,0x8e,0xd5,0x63,0xba,0x9d,0xe6,0xba,
-0x8b,0xfe,0x78,0x82,0x23,0xaa,0xfb,0x67,0x9d,0xe3,0x46,0xe7,
-0x67,0xdf,0xed,0x95,0x74,0x81,0x4b,0xde,0x23,0x70,0x99,0xba,
-0xb8,0x48,0x5f,0xbc,0x12,0xe8,0x4c,0x17,0xbb,0xe3,0x2d,0x85,
-0x91,0x7b,0x66,0x3a,0xc1,0xc7,0x1d,0x13,0xf6,0x4e,0xbf,0xf0,
-0xc8,0x33,0x0a,0x4e,0x4d,0xc7,0x5e,0x89,0x59,0xaa,0x75,0xae,
-0x82,0x2e,0x9a,0x4b,0xe8,0x76,0x54,0xca,0xb2,0xa0,0x8b,0x01,
-0x7d,0x27,0x79,0x59,0xff,0xed,0x95,0xa7,0xa7,0xc7,0x0b,0xb5,
-0x3c,0x00,0xfe,0x91,0x33,0xa0,0xc3,0x04,0xab,0xb3,0x29,0xe9,
-0xee,0x78,0x08,0x1a,0x07,0xad,0x8e,0x4f,0x75,0xd7,0xf1,0xb2,
-0x03,0xc1,0x7a,0xb4,0xea,0xee,0x4a,0x61,0xd3,0x17,0xea,0x3a,
-0x3f,0x3e,0x87,0xbe,0x79,0x24,0xe7,0xb3,0xf3,0xeb,0xca,0x2b,
-0x03,0xa4,0xb9,0x3c,0xde,0xab,0xab,0xdc,0xd5,0x1d,0xc3,0x80,
-0x2c,0xd4,0xe3,0x5c,0x9b,0xee,0x1e,0xe1,0x89,0x7f,0xf5,0xaa,
-0x44,0x86,0x61,0x5c,0x9a,0xe6,0xed,0xfe,0x6b,0x46,0x08,0x08,
-0x27,0x3d,0x17,0x10,0xc1,0xb1,0x63,0xcb,0x40,0xb8,0x2f,0xf3,
-0x11,0x21,0x35,0x26,0xf8,0xe4,0x3f,0xc5,0x1b,0x97,0x2f,0x2d,
-0x7f,0x0d,0x5c,0x0a,0x10,0xc1,0x4b,0xbb,0x2a,0x70,0xed,0x5c,
-0x2d,0x87,0x88,0xdf,0x32,0x5f,0x85,0x5a,0x5e,0x35,0xf3,0xbf,
-0xde,0x99,0xa7,0x74,0x95,0x65,0xa7,0xde,0x6b,0xdf,0xd4,0xfb,
-0xdf,0xc5,0xaa,0xcb,0xc7,0xcf,0xbd,0x2e,0xae,0x77,0x93,0x50,
-0xbc,0xc9,0x3b,0x51,0xea,0x80,0x9b,0x24,0x98,0xdc,0xa2,0x49,
-0x5e,0x9f,0x25,0x00,0x71,0xae,0x1b,0xb8,0x3c,0xf2,0x49,0x19,
-0xde,0x00,0x00,0x09,0xc1,0x56,0xda,0x00,0x7d,0x48,0x7a,0x1c,
-0xb6,0x37,0x8c,0xdc,0x81,0x0f,0x30,0x02,0x17,0xab,0x5e,0xbd,
-0xf6,0xb9,0x48,0xdf,0x14,0x38,0x02,0x53,0xa5,0x47,0x0a,0x0d,
-0x11,0x63,0xa7,0xd0,0x81,0x80,0x1d,0xc4,0x93,0x19,0xab,0x9e,
-0x1e,0x14,0xee,0xa1,0x91,0x9d,0xce,0x51,0x8a,0xf2,0x31,0x57,
-0x08,0x8f,0x11,0xc2,0x44,0x90,0x85,0x68,0xad,0x15,0xc6,0x67,
-0x59,0x56,0x99,0xe9,0x2e,0x3b,0x23,0x1f,0xa2,0x23,0xee,0x46,
-0xd5,0x9f,0x72,0x3f,0xdd,0xdc,0x71,0xb1,0xd4,0x32,0x44,0x25,
-0xb5,0xac,0x00,0xdb,0x69,0x3c,0x4d,0x7a,0x73,0xd6,0x20,0xaa,
-0xe0,0xb1,0x5c,0x9a,0x80,0x4a,0xaa,0x53,0x39,0xa8,0xf2,0x04,
-0x5c,0x42,0xa9,0x6a,0x10,0xd0,0xbd,0x0f,0xa3,0xf4,0xad,0x5f,
-0x97,0x78,0x22,0x76,0xdf,0xa9,0x7c,0x7f,0xec,0x8b,0x08,0x58,
-0x4a,0xad,0xbb,0x24,0xf9,0x88,0x16,0x13,0x2e,0xac,0x4e,0x62,
-0x7a,0x49,0x9b,0x1e,0x61,0xf1,0x90,0xed,0x1b,0x2c,0xc7,0x3a,
-0xf1,0x20,0x53,0x31,0xaa,0x85,0x3f,0x02,0x17,0x4b,0xbd,0xb4,
-0xbe,0x48,0xff,0xce,0x26,0x79,0xf1,0x8c,0xfc,0xe9,0x19,0x8a,
-0x65,0xfc,0xc9,0x17,0xba,0x2d,0xf1,0x3f,0x45,0x72,0xed,0x3c,
-0x18,0xe8,0x66,0x3d,0xc1,0xdb,0xda,0x59,0xb8,0x10,0x94,0xdc,
-0xcb,0x9f,0x58,0xe0,0xf8,0xd0,0x4f,0x0a,0xae,0x73,0xce,0xdd,
-0x87,0x14,0xe3,0xb8,0x5e,0xf6,0xe6,0x12,0x81,0x2f,0x62,0x71,
-0xca,0x2e,0x38,0x62,0x14,0x6f,0x9e,0x12,0xc9,0x6f,0x8a,0xee,
-0x29,0xa6,0x30,0x2a,0x74,0x26,0x9a,0x0b,0xbe,0x00,0xb6,0xea,
-0xc5,0x2b,0x7f,0x2f,0x34,0xd7,0x4b,0xdb,0x34,0x37,0x74,0x7b,
-0xe9,0xa1,0x50,0x12,0x97,0x26,0x2e,0xf8,0xd8,0x94,0xeb,0xba,
-0x27,0x68,0x77,0x31,0xce,0xde,0x0b,0x03,0x73,0x51,0x7e,0xb2,
-0x00,0xe5,0x14,0xdf,0x95,0x1b,0x0f,0xd0,0x8c,0x3d,0xee,0x85,
-0xfc,0x46,0xd2,0x62,0x9c,0x9d,0x88,0x6e,0x8f,0x21,0xd2,0xfe,
-0x38,0x8d,0xbe,0x2e,0x85,0xca,0xcb,0x3d,0xbf,0x31,0x76,0x12,
-0x07,0x7d,0x76,0x72,0x74,0x98,0xd2,0xe4,0x39,0x39,0x29,0x98,
-0x3b,0x9d,0x0b,0xf6,0x9b,0x37,0xe3,0x89,0x9b,0xce,0xd9,0xe9,
-0xb7,0xfc,0x9e,0xe9,0xa7,0x92,0x1b,0x01,0xc8,0x1d,0x13,0x11,
-0x51,0x75,0x36,0x2c,0x26,0x90,0xa8,0xe2,0xbb,0xbf,0xe6,0x59,
-0x0e,0xcb,0xb1,0x87,0x8b,0x06,0xea,0x47,0x93,0x38,0xe3,0x7e,
-0x6a,0xb8,0x93,0x7d,0x25,0x6c,0xb8,0xd6,0x0c,0xc6,0x00,0x87,
-0xe0,0xb1,0x72,0xc4,0xff,0x55,0x2d,0x84,0xc4,0x2f,0x03,0xf4,
-0x86,0xf0,0xaf,0x0b,0xff,0x92,0x3d,0x5a,0xd3,0x13,0x1f,0xd3,
-0x24,0x8f,0xd9,0x82,0x5f,0xcd,0x19,0x39,0x71,0x96,0x17,0xeb,
-0xd0,0x7b,0x7c,0x93,0xa6,0xdc,0x36,0x5c,0x6e,0x46,0x3b,0x4c,
-0x82,0x6c,0x71,0x3c,0xbe,0x04,0x1e,0x09,0xf0,0x3a,0xf0,0x17,
-0xed,0xf7,0x65,0xb5,0x34,0x4b,0x6e,0xf9,0x29,0x7d,0x59,0xac,
-0xae,0x31,0x47,0x34,0xf5,0x0d,0x55,0xfa,0xb5,0x87,0x0a,0xb5,
-0x40,0xcb,0x8f,0xd3,0x3c,0x68,0x0b,0x34,0x38,0xcb,0xcb,0x9a,
-0x5a,0x21,0x90,0x95,0x63,0x72,0x4f,0x31,0x25,0xc0,0xfb,0x40,
-0xd0,0x32,0x9b,0xf9,0xc8,0x9d,0x95,0x5d,0x4e,0xe7,0xb1,0xa8,
-0x08,0x71,0xf2,0x18,0x36,0x7d,0xd4,0xda,0xfd,0x63,0x90,0x8c,
-0x61,0xe1,0x79,0x1d,0x0e,0x87,0xef,0x51,0x07,0xfe,0xe8,0x19,
-0xb1,0x8c,0xe8,0xad,0x9b,0x57,0xea,0x93,0x37,0x70,0x86,0x9d,
-0x26,0x0b,0xf7,0x8f,0xe2,0xf6,0xe5,0x79,0x4f,0xb9,0x2c,0xff,
-0x18,0x8d,0x61,0x35,0x5c,0x08,0xf0,0xf1,0xdc,0x36,0xa5,0x2f,
-0xa5,0x54,0x99,0x16,0xf3,0x4c,0x7d,0xcc,0x33,0x2d,0x3d,0x57,
-0x97,0x18,0xdc,0xd3,0x20,0xb9,0x89,0xc6,0x5f,0x3e,0xb6,0x4b,
-0xe8,0x5c,0x97,0x9d,0xb1,0xee,0x8c,0x9c,0xec,0xe9,0xb4,0xc9,
-0xdf,0xd9,0x9d,0x8f,0x56,0x77,0x5f,0x63,0xa2,0xf5,0xe2,0xc9,
-0x8c,0xe6,0xd7,0xe2,0xe9,0xb5,0x44,0x6f,0x70,0xe9,0x19,0xe2,
-0xaf,0x2e,0xfe,0x4a,0x60,0x84,0xee,0x7d,0x3d,0xb8,0x2f,0xdb,
-0x83,0x9c,0x0f,0xaa,0xd9,0x85,0x70,0x8c,0x67,0xd7,0x37,0xd1,
-0x10,0x8e,0x2e,0x65,0x97,0x8a,0x65,0xd6,0xd2,0x07,0x7d,0x8a,
-0x93,0xd7,0xab,0x8c,0x1b,0x46,0xfc,0x20,0x77,0xf4,0x3f,0x57,
-0x17,0xfb,0x7e,0x0b,0x0f,0x87,0x20,0x22,0x6d,0x28,0xc5,0x02,
-0xea,0x52,0xf0,0xba,0xc4,0xd1,0x03,0x06,0x02,0xe2,0xb2,0xca,
-0xfe,0xc1,0x91,0x17,0x40,0x6f,0xcf,0x61,0x90,0xbf,0x8b,0x97,
-0xdb,0x1c,0x72,0x3e,0x7c,0x0d,0x86,0x18,0x44,0xb8,0x91,0x7f,
-0x0d,0xb9,0x40,0x9e,0xac,0x14,0xa9,0x16,0x2d,0x42,0x22,0x70,
-0xd4,0x2f,0xbf,0x7c,0xdd,0x8d,0x70,0x0a,0xec,0xf7,0xef,0x45,
-0x73,0xee,0xef,0x6e,0x11,0x4e,0xd2,0x7f,0x7f,0x45,0x0e,0x15,
-0x2f,0x82,0x72,0xad,0xcf,0x3c,0xed,0xf4,0x97,0x49,0x77,0xe4,
-0xd7,0xf1,0xf5,0xe7,0xc1,0x08,0xa8,0xe8,0x73,0x8e,0x76,0xa8,
-0xf8,0xbb,0x8f,0x8a,0xbf,0x7f,0x15,0x2a,0xe2,0x23,0xe0,0x9c,
-0x84,0xfc,0x91,0xd2,0xbf,0x4c,0x3a,0xa6,0x2b,0x3e,0x77,0xe1,
-0xd1,0x5f,0x43,0xc8,0x14,0xdd,0xeb,0x7d,0x54,0xfa,0xe3,0xab,
-0x50,0x49,0xcc,0x3a,0x41,0xa9,0x85,0x96,0xf7,0x65,0xb1,0x67,
-0x23,0xdc,0xbb,0x73,0x71,0x5f,0xb8,0xd3,0x19,0xc8,0xec,0x07,
-0xe4,0x41,0xe0,0x73,0x9d,0x3a,0x3a,0x38,0x3e,0x58,0xad,0xb1,
-0xf7,0x57,0x1b,0xed,0x26,0xf9,0x20,0x4c,0x27,0x0d,0x1f,0x19,
-0x3e,0x7f,0x8d,0xe3,0xb8,0xf0,0xb6,0x24,0x64,0xbe,0x9e,0x0e,
-0x97,0x77,0xde,0x09,0x32,0x23,0x3d,0xc7,0x16,0x74,0xfe,0xd0,
-0xed,0xbc,0xaf,0xef,0x7f,0x7e,0x8d,0xbe,0x0b,0xcf,0xb3,0xaf,
-0xd4,0xf7,0xe2,0x78,0x17,0x4e,0x38,0x0b,0xa4,0x10,0xfa,0x56,
-0x94,0x8f,0x65,0xb1,0x62,0x81,0x53,0xd7,0x71,0xcc,0x5b,0x47,
-0x76,0xcf,0xad,0x2c,0xcf,0xa5,0xa1,0x7e,0x2f,0xd5,0x78,0xfe,
-0x05,0x17,0x7e,0x4b,0x28,0x5b,0x81,0x8a,0xef,0x80,0xf5,0xea,
-0x87,0x90,0x39,0x0e,0xfb,0x18,0xf8,0x84,0x8b,0x08,0xef,0x0e,
-0x7f,0x70,0x23,0x50,0xd0,0x90,0xe7,0x74,0x99,0xf9,0x21,0x20,
-0xa8,0x52,0x04,0x11,0xb6,0x03,0x19,0x32,0x95,0xb4,0xc8,0x9d,
-0xce,0x6a,0x2e,0x3c,0x7c,0x06,0x85,0x77,0x59,0xd8,0xbb,0x8d,
-0x59,0x1d,0xe3,0x66,0x87,0x17,0x7f,0xff,0xed,0xc9,0xe4,0x9f,
-0xe1,0x3f,0xff,0x59,0xf1,0x60,0xf1,0xf7,0xdf,0x72,0x78,0xe0,
-0xc3,0x0b,0x93,0xcc,0x77,0x53,0xc9,0x29,0x88,0xcf,0x2d,0xdc,
-0x05,0xc3,0xc8,0x88,0xb1,0xe2,0x94,0x90,0x74,0x9b,0x64,0xbe,
-0xcb,0xc8,0x6b,0x14,0x84,0xa4,0x73,0xb0,0x9f,0xcb,0xe1,0xb8,
-0x3d,0xc9,0xe3,0x86,0x3f,0x84,0x5b,0xa5,0x09,0xb9,0x79,0xfd,
-0xb1,0x9f,0x8a,0x66,0x63,0x27,0x45,0x8d,0xb9,0x0a,0x76,0xb3,
-0xb1,0xad,0x16,0x64,0x3f,0xa2,0xb5,0xab,0xd7,0xa7,0x05,0xcd,
-0xb9,0x6e,0x2f,0x66,0x6b,0xf9,0x37,0xd4,0xf0,0xe7,0x69,0xee,
-0xc9,0x14,0x7c,0x14,0xa7,0xa0,0xa8,0x79,0x47,0xaa,0x18,0x08,
-0x0f,0xef,0x3d,0x17,0x4e,0xb2,0x6c,0xb7,0x3b,0xdf,0x5f,0x16,
-0x74,0xd9,0xbd,0xe5,0xc0,0x7f,0xc4,0x68,0x8e,0x96,0x6a,0xa7,
-0x40,0xb5,0x8e,0x3f,0xbe,0x15,0x0a,0xa3,0x0b,0x5f,0x64,0x72,
-0x7d,0x9a,0x64,0x1e,0xc3,0x83,0xa2,0xfd,0x1c,0x34,0xec,0x44,
-0x7f,0xd0,0x72,0xf4,0x8b,0xac,0xd2,0x32,0x72,0x81,0x8f,0xfe,
-0x3d,0xe5,0xf3,0x03,0x08,0xf9,0xf7,0x04,0xbf,0x43,0x23,0x4f,
-0xf9,0x2a,0x03,0xd3,0x31,0x87,0x46,0xc1,0x0a,0xc0,0xc3,0x1b,
-0x24,0xa3,0x5e,0x30,0x59,0xe3,0x07,0x91,0x41,0xcc,0x0e,0xf1,
-0xed,0xc7,0xea,0x03,0x5a,0xba,0x6a,0x2c,0x7c,0x98,0x84,0x49,
-0xc4,0xe3,0x29,0x7a,0x17,0x9b,0xa7,0x79,0xee,0x5e,0xb0,0xdc,
-0xe4,0x1a,0x94,0x0b,0x8f,0xaf,0xc9,0x3c,0x90,0x9b,0xe9,0x10,
-0xdf,0x99,0xc6,0xb2,0xac,0x1f,0x87,0x29,0x1b,0xc7,0x19,0xc3,
-0xb7,0xce,0xd1,0x24,0x37,0xc1,0xd7,0xb7,0xe9,0x89,0x22,0x0a,
-0x93,0xca,0x63,0x72,0xe7,0x16,0xb2,0x2b,0xcc,0xed,0xe1,0x33,
-0xb4,0x01,0xba,0xf6,0x05,0x2c,0x1d,0x61,0x14,0x55,0xfe,0x2a,
-0x06,0xde,0xeb,0xb9,0x8b,0x46,0x73,0x57,0xbf,0x31,0x5f,0xfe,
-0x9e,0xfe,0xb6,0xd5,0xdd,0xda,0x28,0x5a,0x00,0x9f,0xfe,0xa5,
-0x0b,0xe0,0x7c,0x9e,0x78,0xfa,0x48,0x9e,0x28,0x60,0xff,0x22,
-0xd6,0xe7,0x1b,0x96,0x64,0x7f,0x73,0x0f,0x2b,0x68,0x4c,0x27,
-0xe4,0xef,0x68,0x2f,0xbc,0x87,0xed,0xdd,0xce,0xcb,0xdd,0xd1,
-0xb6,0xde,0x45,0xd3,0xb7,0x43,0x8b,0xee,0x6e,0xf3,0x86,0xf8,
-0xed,0xdb,0x6f,0xc4,0xdd,0x56,0xe3,0xdb,0xd3,0x9c,0x6d,0xcb,
-0xd7,0x01,0xe7,0x92,0xb2,0x7b,0x78,0xa0,0x36,0xa4,0xef,0x0f,
-0x8a,0x08,0x39,0x37,0xa4,0xd2,0x40,0x3d,0xd5,0x44,0x17,0xe6,
-0xdd,0x95,0xce,0xd7,0xcd,0x37,0xe8,0xd4,0x9f,0x7b,0xbf,0x9a,
-0x47,0xfb,0xb6,0xae,0x58,0xbf,0xc1,0x5b,0x3a,0xa7,0x24,0x9d,
-0xee,0x5f,0x1c,0x7c,0xfd,0xc8,0x29,0x65,0x99,0xc0,0x45,0x5b,
-0x26,0xea,0x07,0xa6,0xbc,0xcf,0x35,0xa8,0xf3,0x8f,0xf1,0x7a,
-0xa1,0xf9,0xf2,0x53,0xcd,0xca,0x3f,0x1a,0xf7,0x17,0x3c,0x47,
-0x35,0x1c,0xfb,0x1f,0xa4,0x22,0x28,0x54,0x82,0xbf,0xcf,0x8b,
-0x93,0x36,0xf9,0xe7,0xb8,0x22,0xc0,0x01,0x21,0x41,0xe6,0x63,
-0xca,0x17,0x85,0xde,0xf6,0xbf,0xcd,0xb2,0x49,0xba,0xbb,0xb6,
-0xd6,0x47,0x5b,0x2d,0xc6,0x37,0x69,0x8c,0xe2,0x7f,0x47,0xc3,
-0x61,0xd0,0x88,0x93,0x9b,0xb5,0x70,0x5c,0x7f,0xd7,0x59,0xeb,
-0xc7,0xbd,0x74,0xed,0xf0,0xfc,0x74,0x0d,0xaa,0x77,0xe3,0x20,
-0xe9,0xd3,0x29,0xd7,0x87,0xde,0xa7,0x70,0x46,0xf7,0x7b,0x0d,
-0xf4,0xc2,0x3b,0xfd,0x5a,0x96,0xf1,0x0c,0x22,0xd1,0xae,0x86,
-0x91,0xf2,0x68,0xf4,0xa5,0x1c,0x16,0xde,0x21,0x0c,0xbc,0x61,
-0x6e,0x3c,0x41,0x87,0xd1,0xf5,0xd2,0x49,0xd0,0xe3,0x3a,0x57,
-0x62,0x12,0x15,0xda,0x81,0xde,0xbd,0xbf,0x6b,0xd0,0x8b,0x2f,
-0x80,0x9e,0x39,0xde,0x00,0x88,0xbd,0x10,0x4f,0xe7,0xec,0x21,
-0x9c,0x7f,0xbd,0xf5,0x0d,0xa0,0x1e,0x57,0x55,0xe1,0xd9,0x40,
-0x54,0x90,0xcf,0x09,0x1b,0xc5,0x71,0x09,0x0f,0xba,0x1a,0x93,
-0x9d,0x65,0x30,0x69,0x75,0xaf,0xff,0x37,0x7f,0x50,0xf0,0x63,
-0x91,0xa9,0x82,0x76,0xeb,0xfc,0x11,0xc6,0x35,0x0c,0x3e,0x9c,
-0x68,0x34,0x74,0x68,0x0d,0x59,0x3f,0x29,0xa8,0xcf,0x9d,0xcd,
-0x75,0xcd,0xf6,0x33,0xb7,0x26,0xce,0x0c,0x7f,0xdd,0x61,0x38,
-0xc8,0xea,0x01,0x2c,0xe0,0xf7,0xba,0xfe,0xfa,0x33,0x93,0x02,
-0xc4,0x83,0x46,0x8c,0x43,0xae,0x8d,0x2e,0x20,0xc6,0xf9,0x21,
-0xa7,0x33,0x86,0xf0,0x0d,0x52,0xf6,0xaf,0xeb,0x73,0x7a,0x44,
-0xec,0x59,0xbd,0x1b,0x65,0xc6,0xfc,0x57,0x35,0xb6,0x07,0x76,
-0x05,0x8c,0xf9,0x4b,0x35,0xb6,0xad,0x1a,0xf3,0x07,0x17,0xc6,
-0xe0,0xb0,0x88,0xb4,0x18,0xdf,0x33,0xd7,0xbf,0x9d,0xc7,0xf7,
-0xef,0xa0,0xec,0x60,0x23,0x56,0x07,0x05,0x58,0x4d,0x27,0x39,
-0x94,0xb6,0x1f,0x8f,0xd2,0xfe,0x22,0x94,0x04,0x1f,0xf7,0xb2,
-0x64,0xe8,0xb0,0xb1,0x21,0x98,0xe3,0xdd,0xe7,0xaa,0xf5,0xb4,
-0x39,0x67,0x4b,0x14,0x87,0x7a,0xe1,0x10,0x67,0xbd,0x82,0xeb,
-0x6e,0x10,0x66,0x9f,0x35,0x36,0x9f,0xbd,0x7d,0x47,0xf7,0x63,
-0xb7,0xf7,0x1b,0xcd,0xc7,0xf7,0xfe,0xf5,0xd7,0xeb,0xfd,0x97,
-0x77,0xfe,0xf5,0xa2,0xce,0x93,0xba,0xc4,0xe8,0xf8,0x96,0x67,
-0xa6,0x5e,0xaf,0xff,0x59,0xc0,0x37,0x5c,0xd3,0x64,0x54,0xdf,
-0xf4,0x55,0x6f,0x17,0x55,0xbf,0x8d,0x47,0x46,0xdb,0xeb,0x5b,
-0xf3,0x88,0xce,0x23,0x99,0x16,0x11,0xfd,0xed,0x12,0xb3,0xc0,
-0x28,0xec,0x2c,0x5b,0xe3,0xbe,0x81,0xcd,0xe6,0xe3,0xb1,0x79,
-0xb3,0x0c,0x36,0x6f,0x0a,0xb0,0x99,0xe0,0x9b,0x26,0x42,0x53,
-0xc6,0x31,0x5a,0x2f,0xb1,0x0f,0xe4,0x26,0x90,0x90,0x05,0xe4,
-0x2b,0x94,0x5f,0xcc,0x51,0x9b,0x7f,0x2e,0x60,0x29,0xc2,0x1b,
-0x27,0x95,0x81,0xf9,0xc6,0x23,0x30,0xb7,0xf1,0xfe,0x52,0xb4,
-0xb7,0x16,0xa1,0xfd,0xa6,0x65,0xec,0x74,0x3a,0xb6,0x94,0x39,
-0x52,0x17,0x05,0x23,0xf5,0xa6,0x6d,0x56,0xcd,0xed,0x92,0x58,
-0xf5,0x7f,0x8a,0xaa,0xae,0x9b,0x55,0x37,0x7c,0x55,0x2f,0x8b,
-0xaa,0x6e,0x98,0x55,0x7d,0x13,0xef,0xbc,0x53,0x54,0x75,0xd3,
-0xac,0xea,0x9d,0xf2,0xad,0xcd,0xa2,0x49,0xfb,0x66,0xcb,0xac,
-0xec,0xdb,0xd9,0xaf,0x5b,0xcf,0x0a,0x2b,0x3f,0x33,0x2b,0x6f,
-0x7b,0x2b,0x6f,0x17,0x56,0xde,0x36,0x2b,0xef,0x78,0x2b,0xef,
-0x14,0x56,0xde,0x31,0x2a,0xb7,0x9b,0xde,0x75,0xaa,0x59,0x58,
-0xb9,0xd5,0x34,0x6b,0xb7,0xbc,0xb5,0x5b,0xc5,0xb5,0x4d,0xde,
-0x6a,0xfb,0x78,0xeb,0xba,0x5d,0xb8,0xc6,0xbe,0x69,0x99,0xec,
-0xd5,0xf6,0xb1,0xd7,0x75,0x7b,0xc3,0x5b,0xdb,0x39,0x23,0x03,
-0xb0,0xa0,0xfe,0x6f,0x3a,0xe3,0x68,0x59,0x77,0xde,0x7e,0x24,
-0x72,0x84,0xb8,0x8c,0xa1,0x9e,0xb6,0x36,0xf1,0x74,0x69,0xa4,
-0x3d,0x7f,0xc1,0x76,0x9a,0xf9,0xc8,0x41,0x00,0xab,0x6e,0xaa,
-0x34,0xcd,0xc7,0x8e,0xc3,0x10,0x97,0xcf,0xdc,0xfb,0x6e,0xee,
-0xa1,0x96,0x2e,0x0e,0xaa,0x5b,0x26,0xdc,0x30,0x25,0xd3,0x0c,
-0x04,0xf0,0xa4,0xb5,0xb5,0x59,0x70,0xfd,0x84,0x24,0xd8,0x0b,
-0x02,0x97,0x7f,0x83,0xaf,0x70,0x21,0xe1,0x3f,0x56,0xbc,0x2f,
-0x4f,0xf7,0xde,0xfb,0xba,0x67,0xa3,0xee,0xa0,0xb9,0xbd,0xe5,
-0x3d,0x37,0x0f,0x43,0x72,0xa9,0xf2,0x21,0xa9,0x5f,0x43,0x9f,
-0x87,0xc9,0x81,0x83,0x49,0x0e,0x15,0xf9,0xc0,0x9e,0x26,0xe2,
-0xaa,0x8f,0x8a,0xcf,0x7c,0x43,0x42,0x15,0xef,0xa2,0x74,0x1a,
-0x0c,0x4f,0x8d,0x33,0x93,0xfe,0x21,0x0f,0x9e,0x51,0x18,0x4f,
-0xb3,0x6a,0xee,0x91,0x79,0xbb,0xdc,0x70,0xc0,0xfb,0xfa,0x9e,
-0xa0,0xe5,0x07,0xe4,0x73,0x8d,0xb9,0x6f,0x0b,0x7c,0x5e,0x82,
-0x1c,0x7c,0x42,0x70,0x15,0x5d,0x63,0x90,0xc4,0xa3,0x03,0x11,
-0x49,0xcc,0xe4,0xe1,0x3a,0xdb,0xda,0x58,0xf5,0x2a,0x5d,0x1c,
-0x6a,0xac,0xb7,0x73,0x5c,0x7d,0xf6,0xee,0xa4,0x54,0x73,0xcd,
-0x85,0x0d,0xc0,0x4c,0xda,0x6c,0xe5,0x67,0xd2,0xe6,0x66,0xae,
-0x4d,0x7e,0x94,0xaa,0x51,0x54,0x49,0x20,0xe1,0xa4,0xc6,0x6e,
-0x92,0x78,0x3a,0xe1,0x1f,0x93,0xb0,0x17,0x27,0x7d,0xfe,0x79,
-0x3a,0x8e,0x32,0xfc,0xb4,0x3c,0x41,0x00,0x93,0xa7,0x70,0x44,
-0x2b,0x45,0x95,0xcd,0xad,0x1c,0x86,0x86,0x08,0xb9,0xa8,0xd9,
-0x56,0xc9,0x56,0xda,0xad,0x9d,0x5c,0x33,0xff,0xba,0x06,0x54,
-0x8d,0x83,0xe5,0xa2,0xb6,0xca,0x36,0xd5,0x6e,0xe5,0x9b,0xfa,
-0x00,0x4d,0x29,0x32,0x97,0x6b,0x6d,0x67,0x35,0xaf,0xc4,0x31,
-0x5a,0x15,0x2b,0x5b,0x94,0x9e,0x06,0x3d,0x31,0xee,0xc1,0x90,
-0x4b,0x40,0x30,0x39,0xab,0xb9,0xcc,0x51,0x98,0x05,0x98,0xfb,
-0xe5,0xab,0xb1,0x79,0xe2,0x86,0x71,0x5e,0xc0,0x0d,0x4f,0x91,
-0xef,0xcb,0xd0,0xad,0xb5,0xd3,0x2e,0x6c,0xe7,0xd7,0x4a,0x09,
-0xfe,0xdf,0xd8,0xf6,0xf0,0xff,0xb3,0xb9,0xb8,0xdb,0x6c,0xbb,
-0xb1,0xed,0x23,0xb9,0xbb,0x09,0x7e,0x96,0xaf,0x99,0x7f,0xf3,
-0x09,0x89,0x2d,0xd6,0x7c,0xfe,0xcc,0xc3,0x8a,0x77,0xe1,0xb6,
-0x5e,0x37,0xf7,0xac,0xcd,0xde,0x6d,0xe3,0xb3,0x05,0xcc,0x5c,
-0x67,0x0d,0x60,0x80,0x01,0xf7,0x84,0x82,0x5a,0xa4,0x97,0x5a,
-0x08,0x91,0x6f,0x62,0xa3,0x28,0xab,0x56,0xa0,0x38,0x0a,0xd5,
-0x95,0x1a,0x13,0x05,0xec,0xbc,0x0a,0x01,0x14,0x99,0x32,0x37,
-0xbd,0x8d,0xef,0xcd,0xe7,0x4a,0x28,0x91,0x07,0x33,0x4e,0xaa,
-0xbc,0xfd,0x15,0x6f,0xf3,0x45,0xaf,0xf1,0xcb,0x37,0x60,0x4c,
-0xed,0xdb,0x8d,0xa1,0x19,0xbc,0x19,0x8a,0xdc,0x1b,0xd5,0x9c,
-0x0e,0x93,0x6d,0x7e,0x4d,0xaf,0x6f,0x3e,0xcc,0x6d,0xe6,0x40,
-0x55,0xd3,0x0d,0xd5,0xe4,0x2b,0x0f,0x46,0x8b,0x06,0x3c,0xfb,
-0x6d,0x2b,0x35,0x18,0x12,0x27,0x60,0xda,0x1b,0x6b,0x38,0x34,
-0x66,0x46,0xb5,0xcf,0x45,0x48,0x01,0xb9,0x80,0x0f,0xd2,0xb4,
-0x48,0xf1,0x28,0xd5,0x8c,0x26,0x19,0x57,0xb4,0x70,0x25,0xe6,
-0x9a,0x44,0x80,0x73,0xb6,0x91,0x41,0x6d,0x5b,0x73,0xe5,0xfe,
-0x36,0x22,0x45,0x32,0x85,0x17,0xcf,0xd5,0x13,0xf3,0xa0,0xa8,
-0x1a,0x2a,0xff,0x9b,0x62,0x82,0xc9,0x26,0x78,0x62,0x0e,0x12,
-0x55,0x30,0xe0,0xfc,0x6e,0xf2,0xa4,0x7a,0x36,0xc4,0x9a,0x47,
-0xb8,0x66,0x69,0x89,0x51,0x7c,0xe3,0xeb,0x99,0xf8,0x22,0xd7,
-0x2f,0x07,0xce,0xca,0xbc,0x35,0x54,0x31,0xe4,0x23,0x26,0xa5,
-0x9c,0x5f,0x22,0xd5,0x3b,0xbf,0xf2,0x7d,0xf9,0x82,0xc9,0x6a,
-0x03,0xb3,0xe7,0xe2,0x04,0xf9,0xc4,0x9a,0x90,0x5f,0x7f,0xb6,
-0x8a,0xf6,0x0b,0x67,0xd0,0xb8,0xef,0x57,0xe0,0x3b,0x3a,0x72,
-0x45,0x6f,0xbe,0x3f,0xfd,0x36,0x0d,0xa7,0x8a,0x0c,0xf3,0x05,
-0x3b,0x12,0xe7,0x24,0x76,0xf4,0x85,0x57,0xde,0x33,0xf3,0x29,
-0xc9,0x30,0x83,0x29,0x09,0x4f,0x53,0x8d,0x17,0x79,0xfa,0x82,
-0x62,0x4a,0x17,0x76,0xa8,0x1b,0x0e,0xad,0x45,0x87,0xe3,0xa1,
-0x11,0xe7,0x02,0x2a,0x7a,0x39,0xaf,0x1a,0x52,0x62,0xae,0xb3,
-0x72,0x1c,0xf8,0xcb,0x7a,0x8d,0x14,0xaf,0x2b,0x35,0xba,0x20,
-0x43,0x85,0xc0,0x82,0xc3,0x38,0x41,0x54,0x61,0x3e,0x64,0x21,
-0xe1,0x3b,0x8f,0x00,0xd4,0xbd,0xb9,0x70,0x08,0x04,0x76,0x98,
-0x8b,0x83,0x86,0x2b,0xd3,0xe4,0x7c,0xcc,0x31,0xe5,0x3e,0xa7,
-0x71,0x6f,0x9a,0x56,0x8b,0x17,0x5d,0x8c,0x29,0x3e,0xa7,0xe7,
-0xfd,0xb0,0x3b,0xbd,0x31,0x3b,0x6d,0x18,0x10,0x63,0x38,0xfe,
-0x3c,0x64,0xf8,0x37,0x8d,0x87,0x74,0x0c,0xf0,0x66,0x60,0x13,
-0x2e,0xd9,0x82,0xe4,0x06,0x97,0xba,0xfd,0x24,0x09,0x66,0x26,
-0x63,0x0d,0xa3,0x5e,0xd8,0xe8,0x05,0xc3,0x61,0x15,0x4a,0x4c,
-0xb1,0xf7,0xa9,0x66,0x56,0x0f,0x5c,0x52,0x9a,0x89,0x8b,0xd7,
-0x4e,0x76,0x8d,0x1a,0x29,0xee,0x38,0x59,0x71,0xff,0xea,0xae,
-0x53,0x23,0x7f,0x49,0xe7,0x09,0xf2,0x17,0x74,0x1f,0x16,0x11,
-0xbc,0xe4,0x65,0xf4,0xff,0xa1,0xc6,0x66,0x7a,0x16,0x63,0xb8,
-0x0c,0x62,0x45,0x58,0x46,0x86,0xe2,0x43,0x24,0xfe,0x7e,0x14,
-0x7f,0x71,0x61,0x17,0x74,0x79,0x60,0xcf,0xd1,0x1b,0x0f,0x8d,
-0xd2,0x2d,0x49,0xab,0x19,0x4f,0x9b,0xf1,0xb4,0x15,0x61,0xfb,
-0xa1,0x66,0xf1,0x05,0xf6,0x15,0xe3,0x55,0x77,0xfc,0x2e,0xab,
-0x7d,0x84,0x6a,0xca,0xf7,0x8b,0x5e,0xf3,0xbf,0x16,0xe3,0x31,
-0x30,0x5e,0x44,0xe7,0xba,0xf5,0x30,0x15,0x0e,0x10,0xe8,0xbe,
-0x80,0xb1,0x0f,0xa4,0x6f,0x60,0x00,0x25,0xb9,0xed,0x2b,0x92,
-0x6d,0x50,0x00,0x10,0x61,0x67,0xe6,0xeb,0x05,0xcc,0x45,0x18,
-0xbc,0x6a,0x54,0xaf,0xeb,0x85,0x47,0xa4,0xe9,0x1a,0xd7,0xd1,
-0x07,0x1d,0x98,0xe2,0x21,0xa7,0x52,0x54,0x65,0x28,0xee,0xb2,
-0xe1,0x98,0xc7,0x65,0xc5,0xcf,0xf6,0x0e,0xfa,0x91,0xbd,0xd4,
-0x30,0xbe,0x22,0x66,0x2f,0xe7,0x62,0x16,0x4f,0xaa,0x3e,0xb4,
-0x56,0xb4,0xf3,0xef,0x74,0xd2,0xc1,0x50,0x16,0xd5,0x8f,0x26,
-0xc3,0x0d,0x91,0x4b,0x1f,0x9c,0x91,0x43,0x95,0xa9,0x39,0x72,
-0xf8,0xdd,0x1c,0x39,0xa5,0xe1,0x21,0x41,0xcd,0x5c,0x0f,0xad,
-0x9e,0x7d,0x7c,0xfa,0xd4,0x2c,0x6c,0x2c,0x60,0x26,0x31,0xb0,
-0x88,0xf5,0xde,0xbf,0xbf,0x93,0x46,0xcc,0xeb,0x2e,0x06,0x16,
-0xa5,0x10,0x88,0xab,0x4e,0x97,0x8d,0x26,0x7a,0x80,0x43,0x3f,
-0x09,0xc7,0x46,0x2b,0x26,0x60,0x7a,0x2a,0x4f,0xe0,0xde,0x87,
-0xe5,0x93,0x16,0xe1,0x1e,0x88,0xfc,0x59,0x78,0xc4,0xbb,0x52,
-0xad,0xf4,0xa3,0x3b,0xd3,0x91,0x24,0x1c,0xe2,0x54,0x84,0x6d,
-0xf1,0x00,0x41,0x57,0x11,0x82,0x91,0x6b,0x37,0x4a,0xc8,0x5a,
-0x25,0x0a,0x59,0x45,0xa1,0x25,0xa9,0x56,0xaf,0x9b,0xa9,0x45,
-0x54,0x7b,0x59,0x92,0x6a,0x79,0xbe,0x98,0x43,0xa4,0x97,0x36,
-0x91,0xf4,0xf0,0xea,0x8e,0x99,0xf0,0xc4,0x72,0x19,0xc2,0x3e,
-0x84,0x2b,0x53,0x34,0x36,0x5f,0xbe,0x03,0x72,0x4d,0x02,0x74,
-0xae,0x38,0xc3,0x38,0x03,0x49,0x38,0x8a,0xef,0x42,0x4e,0x39,
-0x28,0x3f,0x87,0x53,0x49,0x5f,0xff,0x82,0xcd,0x24,0x4f,0x8e,
-0x82,0x4f,0x21,0x4b,0xa7,0x09,0x9f,0xfb,0xe2,0x7e,0x54,0x9a,
-0x05,0xb3,0x94,0xc5,0x63,0xc6,0x95,0x81,0xe6,0xe6,0x38,0xc3,
-0xa3,0xe1,0x4c,0xec,0x8c,0xb8,0x2e,0xcd,0x50,0xfb,0x6f,0xed,
-0x9f,0x0f,0x58,0xe4,0x41,0x14,0xc1,0xe5,0xec,0x81,0x17,0x59,
-0xb1,0x4c,0x08,0xe8,0x1b,0x28,0x3c,0x73,0xf2,0xce,0x7e,0x0a,
-0xec,0x8a,0xe3,0x37,0xd1,0xac,0x31,0xd7,0xec,0xc0,0xfb,0x11,
-0x65,0x95,0x94,0x05,0x30,0xc5,0x82,0x21,0x1b,0xa3,0x09,0x77,
-0x14,0x60,0x9f,0x92,0x19,0x48,0xb1,0xbc,0x44,0x16,0xcb,0x09,
-0x88,0x3d,0x8d,0x93,0xe8,0x06,0xd7,0x73,0x9e,0xc7,0xfb,0xc9,
-0xba,0xd3,0xc1,0x20,0x4c,0x1a,0xec,0xe3,0x34,0xcd,0xe8,0xc1,
-0x17,0x32,0x28,0xf3,0xba,0x28,0xe4,0x93,0x9d,0x79,0x1c,0xdf,
-0x37,0x24,0x5a,0xe2,0xad,0x3f,0xf9,0xc2,0x50,0xc1,0x46,0x61,
-0x38,0x84,0x98,0xbb,0xc5,0x4c,0x6f,0x97,0xb8,0xce,0xe7,0x5c,
-0x42,0x56,0xf3,0x49,0x7c,0xe4,0x64,0x9d,0x97,0x39,0x9f,0x11,
-0x37,0x41,0x96,0x5f,0x5b,0x2b,0xae,0xf2,0xfb,0x8a,0xf0,0xae,
-0x2e,0xae,0xeb,0x36,0x28,0x89,0xaf,0xeb,0xfa,0x6a,0x5b,0x65,
-0x15,0xa4,0xcf,0xfc,0x43,0xe1,0x31,0x6e,0x14,0x3c,0xe4,0x28,
-0x65,0x1c,0x27,0x1d,0x6a,0x68,0xfe,0x99,0xd7,0x74,0xf1,0x31,
-0x56,0xac,0xda,0x66,0x63,0x91,0x1e,0x96,0x08,0x4e,0x64,0xd6,
-0xe9,0x4e,0xcb,0x2f,0x59,0xd0,0xc5,0x9d,0xc1,0x58,0x47,0x64,
-0xb3,0x70,0xb8,0xb8,0x43,0xa0,0x00,0x68,0xcf,0x5d,0x95,0x8c,
-0xe3,0x0b,0x02,0x80,0x2a,0xbf,0x7f,0xde,0x53,0x3b,0x59,0x53,
-0x09,0xde,0xc8,0x67,0xd5,0x3d,0x48,0x7c,0x6e,0x6c,0xee,0xf0,
-0x15,0xa4,0xf0,0xed,0x55,0x17,0x0a,0xa0,0xc1,0xf4,0xc3,0x98,
-0x85,0x84,0x95,0x78,0x59,0x02,0x8b,0xee,0xeb,0x83,0x3e,0xc9,
-0x3e,0xc8,0xae,0x3c,0x20,0x40,0xb1,0x70,0x1a,0xdd,0xae,0xd7,
-0x1f,0x3e,0xe0,0xd1,0x15,0x26,0x3a,0xe3,0xb2,0xb3,0x38,0xf3,
-0xd0,0xcc,0x57,0x08,0x13,0x96,0xaf,0x8c,0xad,0x10,0xc6,0x82,
-0xd2,0x76,0x19,0xca,0x3a,0x4d,0xc8,0x6b,0xe2,0xe7,0xc2,0xf1,
-0xc1,0xa7,0x9b,0xbf,0x0e,0xc6,0x4f,0x9f,0x4a,0x8c,0x0d,0x82,
-0xfe,0x85,0x98,0xf3,0x5b,0x4e,0xb8,0x0c,0xcd,0x17,0x0f,0x2d,
-0xf1,0xe5,0x5a,0x6f,0x37,0xb0,0xf7,0xcc,0x3e,0x28,0x11,0x51,
-0xc9,0x6f,0x04,0x96,0x62,0x26,0xac,0x1a,0x32,0x1c,0x89,0x6f,
-0x2b,0x06,0xdb,0x3c,0xd8,0x6c,0xf3,0xf0,0xf4,0xa9,0xe4,0x19,
-0x6c,0xe7,0xfa,0xe1,0x83,0x72,0xfe,0xf3,0x3b,0xad,0xcd,0xe6,
-0x89,0xfc,0x80,0xc1,0x49,0x38,0xf8,0x0f,0xf6,0x8b,0x61,0x07,
-0x8c,0x61,0x7d,0x40,0x89,0xce,0xee,0xc8,0xa3,0x3a,0xc1,0xd1,
-0x74,0x57,0x63,0x8d,0x0f,0x0d,0x1f,0x6e,0x38,0x73,0x20,0x29,
-0x59,0xc9,0x84,0x04,0x9b,0xa8,0xa6,0x06,0x4a,0xd1,0x88,0xe5,
-0x34,0x31,0x99,0xca,0xe8,0xb0,0xe0,0x2b,0x53,0x3e,0xa7,0x0e,
-0x61,0x65,0x4e,0xa2,0x40,0x89,0xec,0x82,0x72,0x82,0xc2,0xd7,
-0xf2,0xbb,0x58,0x3b,0x8a,0xd7,0x0d,0x87,0x01,0x22,0x87,0x01,
-0xc4,0x1c,0xc0,0xbc,0xc2,0x9e,0x12,0x2a,0xf9,0x2e,0x4a,0xd5,
-0xa4,0xea,0x5e,0xc1,0x80,0x8a,0x5e,0xfa,0x8e,0x21,0x45,0x2d,
-0x46,0xd6,0xaa,0x8c,0xbc,0xa0,0xa9,0x3a,0x0e,0x46,0x8a,0xc7,
-0x30,0xe7,0x0c,0xbe,0x1b,0xb3,0xb9,0x4a,0xf9,0x4f,0xe1,0x88,
-0xbf,0xda,0x88,0xc6,0xfd,0xf0,0xe1,0x7c,0x20,0x00,0xa0,0x92,
-0xb1,0x59,0xd8,0xa4,0xd0,0x96,0xcc,0xf1,0xac,0xe4,0x0a,0x22,
-0x4c,0xac,0xd4,0x48,0x21,0x52,0xcc,0x1b,0xc6,0x9b,0x74,0x56,
-0x47,0xe8,0x65,0x3a,0x17,0x22,0xa5,0xa2,0xdf,0xb3,0x78,0xb7,
-0x8e,0x7c,0x35,0x31,0x0a,0xe6,0x77,0xf8,0x10,0xef,0x0a,0x45,
-0xba,0x5c,0xe3,0xaf,0x16,0x1f,0xb2,0x63,0xec,0x12,0xab,0x1e,
-0x9f,0x1d,0x8a,0x77,0xa0,0x37,0x56,0x1b,0x5e,0x0a,0x52,0x39,
-0xff,0x3e,0x3a,0xe3,0x73,0xca,0x94,0xeb,0xf2,0x72,0x98,0xb5,
-0xd5,0xcc,0xea,0x75,0x43,0x95,0xc7,0x8b,0x55,0x85,0xae,0xa8,
-0xc0,0x69,0x56,0x78,0x9c,0x22,0xd6,0xa7,0xec,0x92,0x07,0x4d,
-0x90,0xd8,0x5f,0x1e,0x0b,0xe4,0xfb,0x7e,0xe4,0x45,0x8c,0x85,
-0x63,0x7f,0x1f,0x90,0x09,0x3e,0xaa,0xbd,0x5f,0xa0,0x66,0x74,
-0xe6,0xb9,0x23,0x6a,0xda,0x3d,0x91,0xfe,0xbe,0xe8,0x0c,0x13,
-0xa7,0x69,0xd4,0x1d,0xce,0x18,0x0a,0xd0,0x5c,0x06,0x46,0x4d,
-0x6c,0x37,0x1c,0xc6,0xf7,0xe4,0xfd,0x0f,0x98,0x49,0x5c,0x3a,
-0x46,0x9f,0x0b,0xfc,0xf8,0xaf,0x5b,0x7b,0xad,0xb7,0xf0,0x67,
-0x63,0x63,0xf4,0xcf,0xf0,0x14,0x3e,0x34,0x47,0x15,0x59,0x5a,
-0x1f,0xac,0x70,0xaf,0x5e,0xc5,0xee,0xd3,0x12,0xb7,0x06,0x13,
-0x6f,0xfa,0x00,0x4d,0xde,0x06,0x77,0x51,0x9c,0xac,0x38,0x67,
-0x8c,0x14,0x7d,0x9a,0xa4,0x27,0xb1,0x75,0x28,0xa9,0x31,0x29,
-0x0e,0x3b,0xa0,0x05,0x86,0x1f,0x5d,0x49,0x08,0xfe,0xe5,0xc6,
-0x78,0x6f,0x5e,0x7b,0xaa,0xa2,0xd9,0x2c,0x24,0x7c,0xc4,0xeb,
-0x38,0xda,0x18,0x8c,0xa4,0xc0,0x6c,0x29,0xbb,0x59,0x4a,0xdf,
-0x9c,0x3b,0xb4,0x1e,0x94,0xc5,0xa5,0x04,0x1f,0x96,0xe5,0xb2,
-0x1e,0x7b,0x83,0x62,0x3a,0x0f,0x6c,0x0c,0x2c,0xd6,0x29,0xe2,
-0x2d,0xc7,0x72,0xc1,0xd9,0x43,0x3f,0x4f,0x8a,0x1a,0x24,0x6c,
-0x4b,0x90,0x37,0x9e,0xd0,0x83,0x1d,0x79,0x37,0x6e,0xcf,0x71,
-0xc4,0xc0,0xa6,0xf0,0xcd,0x76,0x0f,0x4a,0xfc,0x85,0xf6,0x82,
-0xc9,0x4a,0x32,0x0c,0x97,0x6f,0x4c,0x51,0xaf,0x98,0x1a,0x7c,
-0xe5,0x38,0xe8,0x1c,0xab,0x95,0x43,0x3d,0x15,0xb5,0x56,0xfe,
-0x81,0x28,0xdf,0x36,0x20,0x9e,0x83,0x32,0x11,0x15,0xd7,0x37,
-0xd5,0xbc,0x9c,0x88,0xfb,0x05,0xea,0x0d,0x51,0x39,0x37,0x79,
-0x06,0x69,0xb4,0x64,0x99,0x96,0x9e,0xc3,0xac,0x2e,0xaa,0xe4,
-0xa6,0x72,0xd3,0x38,0x6e,0x36,0x15,0x85,0xd5,0x0b,0x53,0x6b,
-0xcb,0xbc,0x2b,0x55,0xd8,0x27,0xd7,0x67,0xfd,0x6b,0xf5,0xea,
-0xa9,0xbf,0x57,0x2f,0x8d,0xa9,0x69,0x2f,0x4e,0xbe,0x93,0xd3,
-0x67,0xa7,0xd3,0x07,0x46,0xa7,0xcb,0xbd,0x56,0x55,0xd8,0x6f,
-0x59,0xfd,0xab,0x77,0xfd,0xc1,0xdf,0x75,0x5b,0xd2,0xb6,0xba,
-0xfe,0x60,0xea,0x32,0x8b,0xba,0x7e,0x68,0x74,0xbd,0xe4,0x1b,
-0x58,0x85,0x7d,0x57,0xf5,0xff,0x82,0xce,0x7b,0xb9,0xf9,0xc1,
-0xe0,0xe6,0x07,0x1f,0x37,0x8b,0x47,0xb4,0xd6,0x1e,0xfb,0x74,
-0x56,0x61,0x57,0x01,0xce,0xbc,0x5e,0xe2,0x53,0x17,0xa8,0x52,
-0xe6,0x16,0x2c,0xd8,0xfa,0x8c,0x0e,0x2b,0x4d,0x8c,0xea,0xb5,
-0x56,0x93,0x19,0x57,0x8d,0xa0,0xb6,0xae,0xd5,0xfa,0xa0,0xc6,
-0xcf,0x3c,0xf9,0xf2,0x32,0xfa,0x9c,0x8b,0x10,0xb1,0xb5,0xe7,
-0xda,0xec,0xc9,0x1b,0x6f,0x1a,0x55,0x65,0x21,0xdf,0x94,0xe1,
-0xa5,0x3d,0xf3,0x45,0x00,0xc7,0x06,0x0d,0xe0,0x66,0xfb,0xc6,
-0x5b,0x95,0x90,0xea,0x63,0x4a,0x5e,0xda,0xc3,0x91,0x2b,0x06,
-0xc3,0x12,0xd1,0x8c,0xb9,0x8b,0xc3,0xe4,0x0c,0xea,0x3f,0x0a,
-0x9f,0x1a,0x13,0xba,0x93,0x0b,0x1c,0x9b,0x26,0x63,0xf5,0x97,
-0xa2,0xe0,0x6b,0x12,0x3f,0xe4,0x28,0x3b,0x05,0x5b,0x46,0xc1,
-0xfd,0x2e,0x88,0x2d,0x76,0x76,0xdb,0xcc,0x1e,0x0e,0xed,0xcc,
-0x75,0x23,0x13,0x83,0x97,0xf5,0xe9,0x25,0x8b,0x54,0x5c,0x98,
-0xe4,0x0d,0xc9,0x78,0xa1,0xec,0x1f,0xbc,0x6a,0x1e,0x77,0xbc,
-0x35,0x5c,0x80,0x7f,0x47,0xc6,0xa7,0x28,0xdf,0x13,0xb7,0x4a,
-0x61,0x9f,0x72,0x05,0xb1,0x77,0x45,0xe7,0x3b,0xf5,0x36,0xdb,
-0x3c,0xb6,0x27,0x11,0x52,0xdd,0xff,0x96,0x0c,0xaf,0xc6,0x1f,
-0x1b,0x51,0x8e,0xa8,0xee,0xc9,0x90,0x73,0x80,0x10,0x00,0x66,
-0x4a,0xe7,0xaa,0x84,0x2e,0x94,0xd5,0x5a,0x32,0x55,0x1c,0xcc,
-0x3e,0x2a,0x3d,0x1f,0xea,0xfc,0xd9,0x47,0x7d,0x30,0xb3,0x5b,
-0x20,0x51,0xee,0x63,0x4e,0xb3,0x6c,0x78,0x8e,0xda,0x6f,0x6e,
-0x1b,0x35,0xe1,0x6c,0xbe,0x18,0x35,0x99,0xa2,0x95,0xe2,0x5f,
-0x84,0x87,0x72,0x98,0xcd,0xd9,0x34,0xdc,0x46,0x0a,0x41,0xbb,
-0x20,0x95,0x17,0x2d,0xa9,0x02,0xc6,0x31,0x4b,0x89,0x5b,0x49,
-0x44,0x75,0xab,0xb8,0x5b,0x44,0xc1,0xb3,0x7a,0x45,0x93,0x0d,
-0xa4,0x7c,0xae,0xaa,0x29,0x31,0xdf,0xa0,0x2c,0x52,0x78,0xf1,
-0x8c,0x53,0x93,0xe8,0x07,0x67,0x12,0x71,0x84,0x68,0x06,0xf9,
-0x91,0x72,0xb9,0xbc,0x1c,0x7a,0x9e,0x5a,0x45,0x88,0x2e,0x39,
-0x8d,0x5c,0xf5,0x86,0x39,0x87,0xbe,0xee,0xd4,0xf9,0x42,0xf6,
-0x2e,0xe4,0x4a,0x87,0xe9,0x8a,0xaa,0xd9,0x6c,0xb4,0x30,0xa4,
-0x78,0x7e,0xe4,0xce,0xb8,0x35,0x60,0xee,0x38,0xbd,0x8e,0x87,
-0x7d,0x3b,0x7d,0x83,0xd2,0xdf,0xc1,0x39,0x37,0x41,0xee,0x76,
-0x72,0x37,0x79,0x2d,0xc8,0xf9,0xc4,0xaa,0x68,0x20,0x0b,0x92,
-0x14,0xaf,0xbd,0x21,0x1c,0xa7,0x81,0x67,0x54,0xf4,0x78,0x4c,
-0x67,0x55,0x3b,0x6b,0x5b,0x66,0x45,0x78,0xd8,0x85,0x83,0x63,
-0xd4,0x08,0x1b,0x35,0x76,0x1b,0xf5,0xfb,0xe1,0x98,0x55,0xdf,
-0x5f,0xad,0x37,0x9b,0xab,0x2e,0xaf,0xb4,0xad,0x4e,0x8d,0xc3,
-0x08,0x4e,0xc7,0x09,0xeb,0x42,0xc3,0x78,0xd8,0x60,0x83,0x20,
-0x1a,0xbb,0x7d,0x6c,0x8b,0xde,0x9c,0xc5,0x19,0x9b,0x16,0xf4,
-0xa8,0x2d,0xfa,0xd4,0xc9,0xc2,0xa0,0x0f,0x9b,0x09,0xde,0xb9,
-0xef,0x62,0xff,0xa2,0xf1,0x4d,0x0e,0x1c,0xef,0x13,0x17,0x82,
-0x80,0x61,0xa9,0x70,0xc4,0x7b,0x98,0x2b,0xcb,0x3b,0xf9,0xde,
-0xee,0x22,0x56,0x98,0xd7,0xcd,0x75,0x35,0xeb,0x32,0x5c,0xa4,
-0x43,0xf4,0x2a,0x1d,0xf7,0xf9,0xe3,0xe0,0x38,0x89,0x5e,0x0f,
-0x41,0x46,0x74,0xab,0xb4,0xe6,0x56,0xb9,0x74,0x7b,0xbc,0xae,
-0x26,0x9e,0xbf,0xc2,0xf7,0x68,0x7c,0x72,0xab,0xac,0xcf,0xad,
-0xf2,0x73,0x38,0x1c,0xa2,0x1d,0xca,0xae,0xb3,0xb1,0xa0,0x2b,
-0xd3,0xd0,0xad,0xb1,0x39,0xb7,0xc6,0x69,0x70,0x83,0xa1,0x13,
-0xdc,0x4a,0x5b,0x73,0x2b,0x1d,0xcc,0x82,0x5c,0x67,0x9e,0xcd,
-0xad,0xf1,0x23,0x3a,0xf4,0xb8,0x55,0x76,0xe6,0x56,0x91,0xf2,
-0x6f,0x55,0xda,0xf1,0x56,0xdd,0x49,0xa5,0x87,0x15,0xaf,0x0e,
-0x97,0x18,0xd6,0x0d,0x63,0x58,0x7d,0x55,0x72,0xc3,0xba,0x61,
-0x0c,0xab,0xaf,0x82,0x67,0x58,0x37,0x8c,0x61,0xf5,0x55,0xf1,
-0x0d,0xeb,0x86,0x31,0xac,0xfe,0xae,0xb8,0xc3,0xba,0x61,0x0c,
-0xab,0xaf,0x86,0x77,0x58,0x37,0x8c,0x61,0xf5,0x55,0xca,0x0f,
-0xeb,0x86,0x31,0xac,0xbe,0x1a,0x9e,0x61,0xdd,0x30,0x86,0xd5,
-0x57,0xc5,0x37,0xac,0x1c,0xc0,0xf1,0x80,0xb5,0xb6,0xea,0xbc,
-0x60,0x3a,0x9d,0xd0,0xd3,0x04,0x18,0x79,0x23,0x1e,0x4d,0x40,
-0xba,0xe8,0xd7,0x48,0x75,0x37,0x88,0x91,0x7c,0x18,0x00,0x84,
-0xbc,0x7a,0x1a,0x8c,0xed,0xa7,0xe9,0x74,0x14,0xae,0x08,0xfb,
-0x66,0x90,0x71,0x8d,0x5b,0x25,0x45,0x53,0x30,0xbf,0x01,0xcf,
-0xd0,0x4e,0x8c,0xea,0xa0,0x34,0xe6,0x25,0x10,0xd0,0x71,0xe7,
-0x5c,0x20,0x45,0xef,0x71,0x61,0x19,0x09,0x03,0x5a,0x89,0x92,
-0x34,0x83,0xd5,0x26,0x1e,0x60,0xb8,0x0f,0xa8,0x19,0x23,0x6e,
-0xd0,0xd8,0xd5,0x2d,0xac,0x32,0x58,0x22,0x88,0xb8,0x4b,0x0d,
-0x81,0xe0,0x2d,0x40,0x32,0x87,0xd0,0xa5,0x0b,0xc6,0x0c,0x97,
-0x30,0xd4,0x29,0x61,0x65,0xab,0x45,0x7e,0x25,0x5f,0x51,0x6c,
-0x67,0xf9,0xf5,0x69,0x67,0xd9,0xf5,0x69,0x67,0xf9,0xf5,0x69,
-0xe7,0x11,0xeb,0xd3,0xce,0xd2,0xeb,0xd3,0xce,0x63,0xd6,0xa7,
-0x9d,0xa5,0xd7,0xa7,0x9d,0xe5,0xd7,0xa7,0x16,0x0c,0xcb,0xd2,
-0x2b,0x0c,0x56,0x5a,0x72,0x8d,0xc1,0x2a,0x4b,0xaf,0x32,0x58,
-0x69,0xf9,0x75,0x06,0x6b,0x2d,0xbb,0xd2,0x60,0x9d,0x47,0xac,
-0x35,0x58,0x6d,0xd9,0xd5,0x06,0xeb,0x94,0x5a,0x6f,0xd4,0x7a,
-0xc1,0xe7,0xa0,0xb1,0x48,0x30,0x90,0x56,0x6f,0x69,0xb6,0xe5,
-0x96,0x12,0xf1,0xc4,0x08,0xac,0x23,0x51,0xc6,0x01,0x88,0x9c,
-0xd4,0x5e,0x58,0x6a,0x0c,0x3d,0xa2,0x59,0xf2,0x70,0x97,0xed,
-0xce,0x61,0x08,0x83,0x8b,0xf0,0x32,0x9f,0x07,0x5b,0x59,0x59,
-0xac,0x78,0x06,0xda,0xdb,0xdb,0x75,0x06,0x45,0xda,0x9b,0x4b,
-0x2f,0x77,0xce,0x0e,0xba,0x8d,0x87,0xa7,0x4d,0xc6,0x75,0x4a,
-0x73,0xd8,0x1b,0x41,0xa5,0xf4,0xb8,0xa6,0x06,0xe0,0x2e,0xdb,
-0x3e,0x58,0xbe,0x31,0xf0,0xc3,0xf2,0xda,0x13,0xcd,0x77,0x6c,
-0x8a,0xce,0x17,0x00,0xe3,0x7c,0x92,0x45,0x23,0xf4,0xda,0x81,
-0xb5,0x36,0xc2,0x50,0x97,0x18,0xbc,0xab,0xd9,0xf0,0xaa,0xa3,
-0xe8,0xde,0x0b,0xda,0xf9,0xb5,0xee,0xea,0x85,0xe9,0x52,0xcf,
-0x55,0x39,0x53,0x6a,0x58,0x9e,0x54,0x95,0xcd,0x15,0x0b,0x68,
-0x2f,0xd3,0xcf,0xd2,0x06,0xab,0x95,0x5a,0xa2,0x15,0xd3,0xe8,
-0x2a,0x3e,0x0f,0x86,0x01,0xf9,0xa3,0x5a,0xf0,0x5f,0xbe,0x64,
-0xad,0x6d,0x59,0x00,0x3d,0x84,0xab,0x6e,0xf6,0xce,0x2a,0xfb,
-0x96,0x35,0x1f,0x5a,0x83,0x81,0x28,0xd6,0xbd,0x71,0x81,0xd8,
-0xf9,0x13,0xd7,0xc8,0x3b,0xb4,0x8c,0xbb,0x13,0xad,0x7f,0x8b,
-0x3e,0x08,0xb7,0x12,0xa4,0x11,0x2a,0xb7,0xd6,0xe9,0xb2,0xc1,
-0x04,0x2f,0xf1,0xac,0x1b,0x97,0x78,0x80,0xc0,0x80,0x1b,0x1f,
-0xbe,0x6d,0xa9,0xab,0x40,0x2c,0x26,0xac,0x0e,0x75,0x84,0x03,
-0x8b,0x56,0x95,0x11,0xac,0x0d,0x0d,0x6b,0xc3,0x86,0xd5,0x75,
-0x61,0x75,0x25,0xac,0x8d,0x02,0x58,0x3b,0x1a,0xd6,0x4e,0x01,
-0x5e,0xad,0x2d,0x91,0x38,0x21,0xff,0x97,0x3d,0x17,0xcd,0x9d,
-0x02,0xd0,0xad,0xa6,0x86,0xdd,0x6a,0x16,0x20,0x5a,0x00,0x5c,
-0xe1,0x0d,0x40,0x3c,0xd0,0x2d,0xae,0x12,0x97,0xec,0x68,0x1e,
-0x4b,0xdc,0x4c,0x86,0x10,0x1c,0xc6,0x19,0xc2,0xc2,0xbe,0xea,
-0xe6,0x6b,0x8e,0xb0,0x10,0xb1,0x8a,0x39,0x05,0x90,0x52,0xa2,
-0xb5,0xe6,0x9e,0x45,0xbd,0x17,0xb9,0x82,0x5d,0x27,0x31,0xd7,
-0xa7,0x96,0x4d,0x24,0x3c,0xea,0xa1,0x47,0xb4,0xd5,0xab,0x3f,
-0x5e,0x48,0xb5,0x56,0xae,0xfa,0x86,0x55,0x5d,0x1f,0x00,0xbd,
-0x40,0xda,0x05,0x40,0x36,0x6d,0x1c,0xf0,0x64,0xe8,0x56,0xdd,
-0x28,0xa8,0x6a,0x8f,0xb1,0x38,0x27,0xd2,0x0a,0x3c,0x11,0x27,
-0x48,0x9d,0x8b,0xb6,0x5b,0xda,0x10,0xac,0x30,0x94,0xd7,0xeb,
-0xad,0x11,0x9a,0x6f,0xdb,0xa3,0x5b,0xdc,0x22,0xe1,0xe3,0xb3,
-0xd1,0x7d,0x9c,0x0c,0xfb,0xf0,0xa9,0xfd,0x6c,0x74,0x1b,0xc1,
-0xdf,0x51,0xc5,0xc5,0x67,0xbb,0x00,0x9f,0x6d,0x17,0x1f,0x7e,
-0x36,0xcd,0x91,0x73,0xab,0xa0,0x7e,0xbb,0x6d,0x01,0xa0,0x93,
-0x32,0x8c,0x89,0x55,0xff,0xdb,0x17,0xec,0xcf,0xa2,0xf1,0x68,
-0x6f,0xe4,0xea,0xeb,0x41,0xc9,0x41,0x29,0x1a,0x90,0xf6,0x66,
-0x1e,0x8b,0xdc,0xa8,0x20,0x80,0xa2,0x61,0x69,0x3f,0xcb,0x01,
-0x10,0x63,0x93,0x03,0x51,0x44,0xc9,0xf6,0xb6,0x0f,0x84,0x87,
-0x9c,0x44,0x8e,0x22,0x7a,0xae,0xef,0x58,0x50,0xb8,0x19,0x78,
-0x70,0xb3,0xd4,0x94,0xcc,0x33,0xbd,0x0f,0x68,0xf7,0xa6,0xdc,
-0xfc,0xcd,0xa3,0xb8,0xed,0x5f,0x04,0x41,0x1c,0x10,0xa9,0x7a,
-0xdb,0xbb,0x8e,0x50,0xc5,0xfc,0x21,0x1f,0xf1,0x8d,0x1c,0x05,
-0xdb,0x7b,0xea,0x3b,0xf5,0x6c,0x14,0x64,0xbd,0x5b,0xba,0xfc,
-0x52,0x55,0x19,0x4c,0xef,0x17,0x84,0xd7,0x60,0x50,0xf3,0xe4,
-0xf1,0x56,0xe6,0xe6,0xb7,0x65,0xbe,0xe3,0xbd,0x8c,0x2d,0x03,
-0x76,0x75,0x58,0x58,0xf2,0x2b,0x92,0x8b,0xa8,0x49,0x8c,0x5c,
-0x07,0x37,0xe7,0x75,0xd0,0xda,0xf9,0x04,0x26,0x4e,0xf7,0x27,
-0xb6,0x12,0x3b,0x3f,0x8c,0xdb,0xfe,0x0d,0xe2,0x8b,0x08,0xdf,
-0xfd,0x7f,0x46,0xf8,0xae,0x26,0xbc,0xbb,0xea,0xff,0xe7,0x08,
-0xdf,0x2d,0x43,0x78,0xd8,0x61,0xbd,0xb3,0x72,0xad,0xbb,0xdc,
-0xc4,0x2c,0x3b,0xd7,0x7e,0xb7,0xb5,0xc2,0x56,0x20,0x4a,0x10,
-0x2d,0xc9,0x63,0x8f,0xa4,0xd2,0x5d,0xf6,0x5f,0x7d,0x0a,0xc5,
-0x6a,0xfa,0xf1,0x2a,0xdb,0x9f,0x16,0x23,0xab,0x7c,0xe5,0x79,
-0xfe,0x1c,0xb6,0xf7,0x55,0xf6,0x07,0x31,0x3d,0x7c,0xd9,0xc1,
-0xcf,0xdd,0x1b,0xd7,0x18,0xb8,0xe0,0x9d,0xc5,0xbc,0xee,0xd7,
-0x2a,0xd6,0xa0,0xb7,0x4c,0x48,0x45,0xf2,0xeb,0xaf,0xe7,0x3f,
-0x60,0xa8,0xf5,0x28,0xe5,0x95,0x10,0x7e,0x93,0x8d,0x2d,0x08,
-0xfc,0x90,0x25,0x5a,0x70,0x2d,0xca,0xd5,0x83,0x8b,0xcb,0x55,
-0xcb,0xae,0x2c,0x9a,0x17,0x2d,0x98,0x80,0x13,0x90,0xfc,0x7b,
-0xec,0xd2,0xb2,0x6c,0x88,0xa6,0x0a,0x7b,0x53,0xc3,0xe8,0xc2,
-0xf5,0x74,0x12,0xf6,0xa2,0x41,0xd4,0x73,0xfa,0xb6,0x24,0x66,
-0xa8,0xf2,0x46,0x77,0x16,0x01,0xe2,0x95,0x44,0x88,0x55,0x03,
-0xd2,0xf0,0xa4,0x3c,0xaa,0x11,0x1c,0x91,0xfe,0x1d,0x26,0x71,
-0x4e,0xf3,0xbe,0x69,0xb6,0x76,0x91,0xf0,0x17,0x1a,0x53,0x8e,
-0x31,0x87,0x0c,0x20,0xf1,0x08,0x87,0xc3,0x53,0x4d,0x50,0x31,
-0xad,0x61,0x00,0x66,0xb2,0x40,0x8b,0x17,0xc0,0xed,0xc7,0x29,
-0x64,0xa9,0xb6,0x45,0x43,0xef,0x0e,0x7f,0xc8,0x35,0xd2,0x96,
-0x8d,0x4c,0xc7,0xc3,0xb8,0xf7,0x29,0xec,0xaf,0xe6,0x9a,0x69,
-0xcb,0x66,0x44,0x01,0xb7,0x0d,0x8b,0x74,0x32,0x1c,0xa3,0x6e,
-0x48,0x0f,0xda,0x2b,0xae,0x40,0xdf,0x63,0x08,0x10,0x7e,0x37,
-0xe5,0x6f,0x04,0x7e,0x06,0xb5,0x6f,0xd9,0xfe,0x28,0x4c,0xa2,
-0x5e,0x30,0x96,0x8d,0x5c,0xc1,0xf9,0x6d,0x18,0x80,0x64,0x94,
-0xdd,0xc7,0x7c,0x62,0xf3,0x67,0x44,0xe8,0x80,0x89,0x07,0xbc,
-0xf7,0x57,0x1b,0x28,0x56,0xb3,0xe9,0xa4,0x46,0x82,0x55,0x3f,
-0x04,0x62,0x84,0x78,0x59,0xb6,0x2e,0xf4,0x5b,0x84,0x0d,0x51,
-0x87,0x0a,0x9c,0xfc,0xd0,0x6c,0x51,0x38,0x5d,0x6e,0x73,0x72,
-0x8f,0xa9,0x9b,0x42,0x53,0x21,0xba,0x23,0x1e,0x06,0xf0,0xf7,
-0x86,0xca,0x8e,0x99,0x2a,0x14,0xdc,0x05,0xd1,0x30,0xe0,0xca,
-0xfe,0x81,0x3a,0x1b,0xd7,0xa3,0x71,0x0d,0x88,0x69,0x57,0xe4,
-0x9d,0x3e,0x8b,0x65,0x5d,0xaa,0x01,0x98,0x7b,0xcf,0xa6,0xe6,
-0x13,0xa1,0x45,0x27,0x53,0x37,0x18,0x8e,0xba,0x76,0x5a,0x64,
-0x11,0x13,0x46,0xa9,0x4d,0x2b,0xa8,0xa9,0xe8,0x66,0x42,0x9d,
-0x57,0x19,0xdc,0xaf,0x4b,0xc5,0xe3,0xbd,0x6e,0x8e,0xcd,0x8b,
-0x52,0x56,0xbc,0x32,0x82,0xb9,0x65,0xc1,0x14,0x77,0x78,0x26,
-0x62,0x32,0x15,0x42,0x35,0xe3,0x0c,0x3f,0x65,0xda,0xbf,0xd0,
-0x0a,0xb3,0xed,0x06,0xe9,0x7e,0xaa,0x1c,0x59,0xf2,0x05,0x2f,
-0x0b,0xb0,0x74,0x6e,0x65,0x19,0x44,0x73,0x1f,0x33,0x03,0xec,
-0xf1,0xf5,0x51,0xf4,0xc7,0x57,0x31,0x99,0xc7,0x78,0x13,0x27,
-0x1c,0xa1,0xca,0x44,0x14,0x31,0x62,0x33,0x07,0xe3,0x99,0x50,
-0xa0,0x02,0xf0,0xf0,0xa1,0x17,0x4e,0x32,0xf6,0x6a,0xab,0xc6,
-0xb6,0x38,0x73,0x6e,0x96,0x1a,0x92,0xc7,0x91,0xef,0xd5,0x7f,
-0x8c,0x7e,0xd2,0x1a,0x6a,0xb3,0xce,0x38,0xc6,0x17,0x5b,0x55,
-0x00,0x50,0x91,0x9a,0xc3,0xb2,0xd5,0x5a,0xc0,0x3c,0x6d,0x1b,
-0x6c,0x3f,0x46,0x82,0x0b,0x8d,0xd3,0x14,0x1f,0xdd,0xef,0x8b,
-0xb7,0x02,0x60,0x8a,0xa7,0x73,0x9b,0x6a,0x2f,0x6c,0x6a,0xcb,
-0xe9,0x01,0xae,0x40,0x81,0x58,0x81,0x10,0x3e,0xad,0x1d,0xf3,
-0xdb,0x78,0xb6,0xd7,0xda,0x6b,0xee,0x2d,0x9a,0x11,0x9b,0xeb,
-0x2e,0xad,0xfa,0x61,0x8f,0x0d,0xf9,0xdc,0x5f,0x1b,0xe1,0x2b,
-0xec,0x73,0x9b,0xd9,0x2c,0x6c,0x80,0x0b,0x01,0x86,0x93,0xe5,
-0x7e,0xbf,0x4f,0x8c,0x92,0xba,0xae,0x96,0xff,0x8d,0x9f,0xe5,
-0xdb,0x23,0x29,0xab,0xbe,0x46,0x1f,0xdd,0x55,0x6d,0x52,0xf6,
-0x3c,0xc4,0x71,0x7c,0xf0,0xb6,0xc8,0x93,0x9b,0x1e,0x0c,0xc1,
-0x28,0x18,0x0b,0x7d,0xd5,0x6a,0xdc,0x99,0xeb,0xa3,0xba,0x5c,
-0xbc,0xa4,0x07,0xdb,0x8a,0xe5,0x55,0x65,0x7b,0x1c,0x63,0x4d,
-0xe5,0xe3,0x41,0x77,0x6d,0xca,0xdf,0xe2,0x10,0x6e,0x20,0xd4,
-0x52,0xbd,0x8e,0x9a,0x99,0x8f,0xd6,0x6d,0x1c,0x2b,0x80,0x04,
-0xdd,0x1b,0x01,0x34,0x3e,0x48,0x77,0xe4,0x8f,0x4f,0x9f,0x92,
-0xbb,0xb3,0xba,0x1e,0xec,0x96,0x53,0x57,0x27,0x5d,0x6f,0x90,
-0x23,0xc3,0x9b,0xee,0x2c,0x7c,0xc8,0xb8,0x07,0x46,0xa1,0xc7,
-0xe0,0x99,0xf0,0xca,0x48,0xf1,0x0a,0x81,0xd8,0xb6,0xd1,0xcd,
-0x94,0xbd,0x2a,0x76,0xae,0x43,0xb0,0xf3,0xdc,0x24,0xfe,0x0f,
-0xf8,0x8f,0xb2,0x39,0x4e,0x87,0x6f,0x4c,0x7f,0x43,0xf5,0xf2,
-0x7d,0x39,0x32,0x25,0x21,0xde,0x1b,0x97,0xde,0xc5,0xf3,0x88,
-0xa4,0x20,0xff,0x55,0x94,0x2a,0xeb,0x3f,0x3c,0x8f,0x14,0xdf,
-0x1b,0xa4,0x30,0x9c,0x3f,0xba,0x29,0x88,0xa1,0x20,0xe6,0xb0,
-0x6b,0x9f,0x07,0x26,0xce,0x37,0xee,0x83,0xf9,0x76,0x7f,0x9e,
-0x0f,0x26,0x02,0x54,0xa0,0xfe,0x02,0x97,0x53,0x51,0x43,0xdf,
-0x79,0xd4,0xfd,0x3a,0xb1,0x17,0x23,0xf2,0x83,0xf1,0xac,0x3f,
-0x27,0xf3,0x96,0x1f,0xee,0x29,0x58,0x76,0xf9,0x79,0xcc,0xd2,
-0x33,0x77,0xe5,0x59,0x59,0xe2,0x42,0x43,0xbe,0xa0,0xef,0x02,
-0xc3,0x5e,0x7e,0x59,0x32,0x24,0x91,0xdc,0x13,0x35,0xfc,0x52,
-0xc7,0x75,0xeb,0x64,0xfe,0xb5,0x8e,0xfa,0x32,0xb7,0x3a,0x88,
-0x56,0xf3,0x6f,0x71,0xe4,0x2b,0x7d,0xb4,0x82,0xb4,0xac,0x79,
-0x2f,0x5f,0xf8,0x2f,0x55,0xcc,0xe6,0xe4,0x39,0x17,0x2e,0x6c,
-0xfe,0x39,0xc5,0xcf,0xf2,0x2d,0xa9,0x42,0xfe,0x39,0x2c,0xe0,
-0x1f,0x1e,0x81,0xee,0xff,0xab,0xf8,0xe7,0x91,0xbc,0xb3,0xe0,
-0x4a,0xd0,0x52,0xbc,0x23,0x2e,0xe1,0x2c,0xcb,0x3d,0x44,0xde,
-0xff,0x34,0xff,0x5c,0xd8,0xfc,0x33,0x4f,0x08,0x3a,0x2c,0x12,
-0x82,0xc4,0xcb,0x61,0xcb,0x08,0x41,0x7f,0x8d,0x04,0xf4,0x58,
-0x99,0x67,0x81,0x88,0x23,0xdd,0x1a,0x5b,0x45,0x12,0x8e,0x11,
-0x1e,0xc5,0x15,0x72,0x7e,0xa2,0x3b,0x47,0xe4,0xce,0xb9,0x80,
-0xbc,0x47,0x45,0xe4,0xa5,0xae,0xfc,0xff,0xa2,0x88,0x79,0x0d,
-0xb2,0xa5,0x79,0x23,0xd6,0xf6,0x02,0xfd,0xd5,0xf4,0x02,0x55,
-0x1a,0x2a,0xb9,0x8d,0x73,0x2d,0xc3,0x7c,0xa9,0xe0,0xed,0x45,
-0x91,0x54,0x80,0x6f,0xe1,0xc7,0xe9,0x7f,0x4c,0x24,0xf8,0x1a,
-0xb7,0x70,0x5a,0x1b,0x2d,0xb6,0xd5,0x62,0x01,0x9c,0x7c,0xde,
-0x5e,0x5c,0x32,0x52,0xfa,0xbc,0x8d,0x93,0xe8,0xdf,0x31,0xbe,
-0xb1,0xa4,0x09,0x74,0x19,0x0e,0x03,0x32,0xb8,0xb9,0x32,0xe2,
-0x81,0x5f,0x46,0x7c,0x2b,0x6b,0xca,0x8a,0x7f,0x05,0x35,0xfe,
-0x92,0x0b,0x49,0x3d,0x7c,0x3e,0x77,0xdc,0x97,0x7a,0x50,0xd3,
-0x51,0xf8,0x22,0x89,0x46,0x41,0x32,0x63,0x87,0xfb,0x79,0x7f,
-0x61,0x10,0x30,0xe3,0x51,0x94,0x65,0x70,0xb2,0xae,0xbf,0x64,
-0xe2,0x5d,0x4c,0xad,0x7c,0x4e,0xb9,0xa3,0x49,0x26,0x29,0x45,
-0xaa,0x39,0x09,0x83,0x6b,0x40,0xf0,0x49,0xc1,0x10,0x23,0xe6,
-0x50,0xa8,0x16,0x1e,0xba,0xa9,0x27,0x49,0x7b,0x7c,0xa8,0x5c,
-0xdc,0xd0,0x47,0x0d,0x5f,0x74,0x55,0x28,0x40,0x7b,0x52,0xa1,
-0xb9,0xc7,0xda,0xd8,0x81,0xea,0xaf,0xbf,0xbe,0xbf,0x42,0x7b,
-0x39,0x79,0xc8,0xec,0xf7,0xef,0x30,0x46,0x62,0x9f,0xbd,0x8f,
-0xfa,0x61,0x4c,0x1e,0x18,0xf1,0xb8,0x52,0x59,0xf5,0xd6,0x6f,
-0x1a,0xf5,0x5b,0xbc,0xfe,0x99,0xac,0x93,0xfa,0x2a,0x6d,0x19,
-0x15,0xda,0xfe,0x02,0x4d,0x80,0xcb,0x71,0xdb,0x83,0x6f,0x7b,
-0x6c,0x1b,0xfe,0xed,0x50,0xda,0x26,0xa9,0x7d,0x79,0xf5,0x76,
-0xbb,0xa9,0xaa,0xa3,0xde,0x92,0x7a,0x50,0xa7,0x50,0x6f,0x9a,
-0x42,0x86,0x0e,0xb3,0x1f,0x93,0xdd,0x70,0x14,0x06,0x63,0x54,
-0x1c,0xc1,0xc0,0xc2,0x29,0xa7,0x3b,0x53,0x8e,0x7d,0xa3,0x34,
-0x1c,0xde,0xc1,0x3e,0xc9,0x18,0xc1,0xb6,0xab,0xc2,0x26,0x1b,
-0x0e,0x87,0x58,0x03,0x09,0x7d,0x1b,0xa3,0xf1,0x18,0xbd,0x05,
-0x07,0x61,0x20,0x14,0x9f,0xf8,0x32,0x3a,0xf7,0x16,0x92,0x83,
-0xa6,0x7c,0x88,0x5c,0x57,0x21,0xec,0x6b,0x6b,0xbd,0x5d,0xe7,
-0xcb,0x46,0xea,0x73,0xd2,0x17,0x4a,0x6a,0x9f,0xd2,0x5c,0xfb,
-0xef,0xd3,0x72,0xe8,0xf3,0xf4,0xa6,0x47,0x1e,0x4d,0xc5,0x8d,
-0xeb,0xf0,0x46,0x4e,0xda,0xf4,0x50,0x02,0xa0,0x99,0x84,0x93,
-0x61,0xd0,0xa3,0xb0,0x4c,0x14,0x69,0x93,0xaf,0x75,0x18,0xb4,
-0xd3,0xaf,0x47,0xbf,0x02,0xc1,0x66,0x1c,0xf5,0xa0,0xa6,0x2a,
-0x9d,0xeb,0x03,0xef,0x05,0xbe,0xb3,0xce,0xed,0x68,0x35,0x16,
-0x36,0x6e,0x1a,0xf8,0xc6,0xe8,0x66,0x7b,0xd3,0x2d,0xbc,0xa3,
-0x0b,0xa3,0xa7,0x80,0x54,0xd4,0xb0,0x2a,0xf7,0xe1,0x3e,0x3c,
-0x3a,0x50,0x3a,0x5f,0xd4,0x0f,0xea,0x6b,0x4a,0x2f,0x69,0x02,
-0x72,0x68,0x45,0x93,0xb0,0x43,0xee,0x48,0xcb,0x4d,0x43,0x73,
-0x14,0x2b,0x29,0x83,0x69,0x30,0xce,0xd0,0x88,0x41,0x14,0x93,
-0x20,0xd0,0x35,0x94,0xcf,0xcb,0x47,0x4c,0xc8,0xba,0x84,0x42,
-0x33,0x93,0xb1,0xe3,0x8c,0xa5,0xb7,0xf1,0x74,0xd8,0x17,0xaa,
-0xf6,0x78,0x2c,0xf5,0xed,0x6d,0xf5,0x26,0x6b,0x8d,0x41,0x97,
-0x84,0x6a,0x34,0xc4,0x97,0xb9,0xfb,0xa9,0x82,0x02,0xab,0x14,
-0x2f,0x0e,0x73,0xc0,0x9d,0xe8,0x48,0xa6,0x09,0xba,0x6e,0xdd,
-0xe1,0xaf,0x9e,0x24,0xd8,0xfd,0x6d,0x98,0x84,0x98,0xc3,0x75,
-0xf8,0x0e,0xef,0xe2,0xaa,0xac,0x88,0x35,0x61,0xf2,0x8e,0x83,
-0x58,0x28,0x2a,0x95,0x86,0x95,0xd9,0x52,0x99,0x34,0x2b,0x45,
-0x26,0xa2,0x0d,0x8d,0x46,0xa9,0xf4,0x9b,0x1d,0xdd,0xa3,0x2f,
-0xac,0xf0,0x7d,0x65,0x55,0xf4,0x64,0x12,0x2f,0xf5,0x51,0x07,
-0xee,0x83,0x54,0x05,0x66,0x1a,0xea,0x89,0xc9,0x7e,0x7a,0x93,
-0x84,0xe1,0xf6,0x16,0xcc,0x48,0x54,0xe4,0x8e,0xa7,0xa3,0x6e,
-0x08,0x0c,0x95,0x62,0x0c,0x20,0x9c,0x91,0xb4,0xe8,0xec,0x6c,
-0xae,0x22,0x19,0x61,0x6a,0x13,0xbf,0x50,0x3f,0x04,0x91,0x01,
-0x5a,0x0d,0xfb,0x1d,0x8d,0xfb,0xf4,0x6c,0x3f,0x47,0xe7,0xf2,
-0xfc,0x94,0xf5,0x00,0x42,0x12,0xf5,0x6f,0x70,0x04,0x6f,0xa2,
-0x34,0x4b,0x68,0x80,0x45,0x0b,0x84,0xbe,0x34,0x82,0x05,0xc3,
-0x7b,0x8c,0x89,0x85,0xd6,0x25,0xea,0xdc,0x69,0x9c,0xe0,0x75,
-0x9e,0x01,0xde,0x8e,0xc0,0x3a,0x62,0x8a,0x73,0xf1,0x1d,0xa7,
-0x05,0x6c,0x6d,0xbd,0x46,0x0f,0x36,0x0d,0x8a,0xd6,0xd1,0x6e,
-0xb6,0xda,0x35,0xf2,0xdc,0x1a,0x39,0x15,0x05,0xa9,0xee,0xa2,
-0x91,0x54,0x6c,0xa7,0xbc,0x43,0xff,0xba,0xbe,0x7e,0xd5,0xec,
-0x21,0x83,0xe2,0xa7,0x56,0x8f,0x05,0x03,0x9c,0x96,0x0e,0x6b,
-0x2a,0xce,0xab,0xbe,0x5a,0x2d,0x0a,0x34,0xca,0x27,0xc5,0x62,
-0x6f,0x3b,0xc3,0xfe,0xdb,0xfc,0x40,0xb1,0x7d,0x94,0x43,0xdc,
-0x4a,0xb1,0xc5,0x43,0x6d,0xa4,0x51,0x5a,0xad,0x70,0xf7,0x6a,
-0xad,0xd8,0x96,0x81,0xed,0x31,0x0f,0x9d,0x26,0xeb,0x53,0x58,
-0x38,0x60,0xde,0x14,0x14,0xe1,0x71,0xb8,0x2a,0x46,0x54,0xed,
-0xbc,0x42,0x7b,0xaf,0xdd,0x93,0xba,0x59,0xd7,0xaa,0x80,0x20,
-0xe8,0xe8,0x34,0x17,0xc2,0x96,0xae,0xbf,0xc0,0x32,0xf1,0xd2,
-0xb4,0x4c,0xf0,0x79,0x47,0x33,0x11,0x7b,0x22,0x93,0x85,0x71,
-0x82,0xa5,0x93,0x28,0xa3,0xb6,0x64,0x46,0x0c,0x73,0x35,0xe0,
-0xee,0x91,0x7f,0xae,0x3f,0x6b,0xc2,0x44,0x27,0x3d,0xda,0x2b,
-0xf1,0xf4,0xa5,0x8f,0x6c,0xc5,0x48,0xbf,0x6c,0xee,0xb5,0x9f,
-0x6d,0xed,0x35,0xe7,0x76,0xdd,0x26,0xf0,0x1c,0x60,0xdb,0x9b,
-0x7b,0x3b,0x9b,0x0b,0x80,0xe5,0xe8,0x28,0xdc,0x6e,0xc4,0x9e,
-0x06,0xeb,0x65,0x77,0xc6,0xf8,0x39,0x55,0x06,0xd4,0xd4,0x05,
-0xad,0x74,0x3a,0x07,0x93,0x85,0x56,0xee,0xa7,0x8d,0x1c,0x62,
-0x9a,0xed,0x9e,0xb2,0xca,0x5c,0xbc,0x16,0xb3,0xc8,0xcb,0xed,
-0xf5,0xbd,0x8d,0x66,0xb3,0xb9,0x6e,0xf6,0xd0,0x23,0xd9,0x93,
-0x8b,0x2a,0xd7,0x72,0xba,0x62,0x3d,0x23,0xf1,0xdd,0xbd,0x67,
-0x2d,0xa4,0x7c,0x10,0xe9,0xdf,0x17,0x89,0xf4,0x38,0xd9,0xff,
-0x52,0x91,0x7e,0x56,0x28,0xd2,0x3f,0x3a,0xa6,0x40,0x6b,0x63,
-0x13,0x03,0xd5,0x87,0x20,0xd2,0xbf,0x47,0x91,0x9e,0xbd,0x0f,
-0x61,0x5d,0xed,0x95,0x92,0xe6,0x0b,0xd4,0xe2,0xef,0xff,0x7a,
-0x69,0xfe,0x2f,0x8a,0xac,0x40,0x0e,0xce,0x03,0xbe,0x26,0x1b,
-0xe7,0x1a,0x9c,0xf6,0x79,0xb2,0x14,0xdc,0xc9,0x17,0x87,0x42,
-0x71,0x31,0xff,0xed,0xfb,0x82,0x8b,0xf9,0x6f,0x15,0x95,0xca,
-0x2d,0xc8,0x9a,0x10,0xdc,0xb3,0x59,0x8f,0xbf,0xbe,0x74,0x6f,
-0x96,0x69,0x7d,0x50,0xa7,0x6d,0x9b,0x75,0xf4,0xa5,0xfe,0x2f,
-0x22,0x5c,0xee,0x94,0x69,0x5e,0xfb,0xff,0x4a,0xc7,0xab,0x11,
-0xbb,0x65,0xe4,0x6c,0x4e,0xcf,0xa4,0x54,0x3b,0xa7,0x39,0x6f,
-0x08,0x94,0x3b,0x94,0x13,0xc4,0x3e,0xd1,0x50,0x14,0xde,0x77,
-0x0b,0x6f,0x88,0x5b,0x90,0xa4,0x05,0xe7,0x65,0x8e,0x2f,0xdd,
-0x42,0x2d,0x75,0xdf,0x62,0xdc,0x5f,0x43,0x93,0x05,0xdd,0x3b,
-0xec,0xe4,0xca,0xb5,0x85,0x40,0xb4,0x3f,0xcd,0x62,0xdc,0xc9,
-0x7b,0xec,0x2c,0xbc,0xa7,0xbd,0xbe,0x7a,0x72,0x76,0x6a,0xdd,
-0xa4,0x87,0x4e,0x08,0x57,0x19,0x10,0x4c,0x40,0xb0,0xbf,0xc3,
-0x88,0x2d,0xd4,0x3e,0xc5,0x86,0xa1,0xbb,0xc0,0x57,0xde,0xdb,
-0xa2,0xfb,0xfa,0x41,0x33,0x69,0x95,0x50,0x4f,0xb6,0x1f,0xfc,
-0xe0,0x27,0xc6,0x61,0x98,0x46,0x37,0x63,0x6c,0xe2,0x5d,0x67,
-0xbf,0x73,0x70,0x7c,0x4c,0x62,0x87,0x2d,0xd7,0xb3,0xef,0x9b,
-0xf5,0xef,0xd7,0x65,0x65,0x84,0xb6,0x0f,0x38,0x73,0xa3,0x39,
-0x7a,0x5f,0xf1,0xc3,0x20,0xca,0xda,0xbe,0xf0,0x01,0x70,0x74,
-0x61,0xfc,0x01,0x7f,0x41,0x45,0xc4,0xe6,0xfc,0xc4,0x4f,0xee,
-0xce,0x28,0x8e,0x41,0x9a,0xa9,0x76,0x86,0xf1,0xfd,0x2a,0xe3,
-0x21,0x94,0x78,0x9f,0x0f,0x72,0x35,0xa4,0xf7,0x0c,0xf7,0xdb,
-0xe5,0xa7,0x4f,0x5e,0xf4,0xcc,0x2d,0xca,0x8f,0x42,0xe7,0x24,
-0x2c,0x6a,0x2c,0xce,0xdd,0x62,0xfc,0xc6,0xc8,0x8f,0x49,0x30,
-0x11,0x5b,0xb1,0x2a,0xba,0xff,0xa3,0x5b,0x76,0x5b,0x8d,0x67,
-0x1d,0x4e,0x44,0x61,0x90,0x69,0x5a,0xef,0xe7,0x86,0x7f,0x47,
-0x31,0x09,0x80,0xc4,0x05,0xf1,0x27,0xf6,0x2d,0xfb,0x19,0xe5,
-0x7e,0x10,0xb1,0x32,0xf8,0x43,0x31,0xe6,0x1b,0xc8,0xbc,0xa1,
-0xbc,0x15,0x61,0xc8,0xfc,0xc4,0xa4,0x58,0xed,0x0a,0x46,0xe5,
-0x93,0x79,0x38,0x57,0xb7,0x49,0x08,0xfe,0x2d,0x45,0xa1,0x8a,
-0x87,0x5d,0x58,0x27,0xab,0xb8,0xbf,0x17,0x71,0x2b,0xc5,0xc3,
-0x7c,0x2d,0xae,0xd1,0x4a,0x5e,0xa9,0x06,0x59,0xb6,0xd5,0x72,
-0xaf,0xbc,0xb6,0x44,0x4f,0xe9,0x88,0x89,0xcc,0x31,0x82,0x53,
-0x2c,0xec,0xe7,0xd8,0xd1,0x8b,0x37,0x6f,0x72,0xa5,0xf5,0x95,
-0x3d,0x72,0x38,0xe0,0x47,0x8f,0x0c,0x65,0x9e,0x01,0x06,0x5b,
-0x12,0xb1,0x53,0xa9,0xf6,0xd1,0x4f,0x05,0x1e,0x51,0xd4,0x11,
-0x89,0x15,0x94,0xbc,0x3a,0x38,0x72,0x29,0xba,0x6e,0xf6,0x99,
-0x2b,0x93,0x8b,0x7a,0x2d,0xef,0xad,0x1e,0x8d,0xd1,0xfb,0x07,
-0xba,0x30,0xce,0xea,0xf4,0x62,0x1d,0xf6,0x5d,0xae,0xa4,0x69,
-0x41,0xd5,0x6d,0x51,0x15,0xe7,0xc2,0x55,0xf8,0x29,0x4b,0xe2,
-0x31,0xc8,0x7b,0x8a,0x2f,0xae,0x8e,0x7e,0x28,0xb8,0x4b,0xba,
-0x8f,0xb7,0x6d,0xd8,0x76,0x53,0x4e,0x81,0xd3,0xdc,0xf4,0x90,
-0x57,0x48,0x51,0xc6,0xaf,0xa2,0xcb,0x2b,0x00,0xae,0x82,0x80,
-0x48,0x4e,0x25,0xa1,0xbe,0x74,0x98,0x6b,0xa0,0x6d,0x76,0x87,
-0x9f,0xcb,0xd1,0x23,0x4a,0x9d,0xca,0x0f,0xec,0xd9,0x8b,0x78,
-0x9e,0x29,0x6e,0xba,0x3c,0xc8,0xcf,0x3c,0x3e,0xf7,0xae,0x30,
-0x18,0xde,0x39,0xb0,0x5a,0x90,0xe0,0x34,0xc1,0x98,0xf6,0xfe,
-0x9b,0xa2,0x62,0xca,0xd5,0xef,0xed,0x89,0x52,0x70,0x43,0x94,
-0x78,0xed,0x24,0xbe,0xb9,0xe1,0x47,0xd7,0x2b,0x3c,0xba,0x45,
-0xa9,0x88,0x40,0x05,0xc7,0x56,0x79,0x99,0x0a,0x25,0xc4,0x40,
-0x9f,0x96,0xc9,0x3d,0xab,0x8e,0x62,0x30,0xe3,0x01,0xb5,0xfc,
-0xd7,0x49,0xdf,0x51,0x48,0x02,0xe8,0x2b,0xad,0x61,0x1d,0xce,
-0x5d,0xaf,0x45,0x64,0x5e,0x56,0xa5,0xd6,0x46,0xc1,0x8c,0x75,
-0x43,0x6c,0x48,0x51,0x41,0xb5,0x48,0x07,0xa4,0x28,0x0b,0x8f,
-0xc7,0xb7,0x51,0x37,0xca,0x8a,0x88,0xbe,0x25,0x7a,0x63,0x2e,
-0xb1,0x9f,0xe8,0xd1,0x48,0x4e,0xde,0xdc,0xea,0xba,0x25,0xf0,
-0xc3,0xa0,0x41,0xf4,0x1a,0x29,0xbd,0x94,0x91,0xd2,0x71,0x5f,
-0xbd,0x4e,0x4c,0x75,0x5f,0xe7,0xea,0xf2,0xdb,0x61,0xcd,0x52,
-0x6b,0x06,0x2e,0xc2,0x5a,0xd1,0x37,0x0c,0x51,0xc5,0x63,0x2d,
-0x23,0xa5,0x56,0x0f,0x79,0xd3,0x10,0xa9,0xf9,0x36,0x1a,0x46,
-0xb4,0xe3,0x2c,0xaa,0xd2,0x56,0x55,0x0e,0xf0,0x39,0x87,0xd3,
-0xb8,0x64,0x53,0xeb,0xc6,0xc0,0x2d,0x51,0x6d,0x43,0xd3,0xe3,
-0x0d,0xbe,0xb1,0x70,0x3c,0x5e,0xa3,0xbf,0xe7,0x53,0xfe,0x0a,
-0x7f,0x5e,0xff,0xd4,0x54,0xf7,0x0d,0xc5,0x5c,0x39,0x22,0x35,
-0x48,0x28,0x09,0x9a,0x67,0x5a,0x7e,0xe7,0x52,0x50,0x9e,0x6f,
-0x3e,0xb0,0x70,0x75,0x79,0x98,0x69,0xd4,0xd2,0x64,0x33,0x3c,
-0xa9,0x4d,0xa0,0x49,0xff,0xfa,0xda,0xe4,0x6e,0x9f,0x05,0xd5,
-0x91,0x05,0xf8,0xa8,0x15,0xd5,0x5e,0x57,0x62,0x07,0xb0,0x34,
-0x14,0xcd,0xd8,0x13,0x7c,0x7b,0xe5,0x09,0x7f,0x5f,0x84,0xa6,
-0x73,0x88,0x37,0x82,0x6f,0x19,0x30,0xab,0xaa,0x5e,0x0d,0xa9,
-0x7f,0x5c,0x53,0x41,0xf9,0xaf,0xa3,0xec,0x78,0x8c,0x68,0x16,
-0xf0,0x33,0x6f,0xcb,0x22,0x0e,0xb9,0xde,0x82,0xbc,0x0a,0xfb,
-0x78,0x34,0x88,0x50,0x8f,0x89,0x92,0xc0,0x3e,0xc6,0xf6,0x07,
-0x92,0x9f,0x4d,0x47,0x6a,0xf2,0x9c,0xc4,0xbd,0x4f,0x5c,0x4f,
-0x28,0x67,0x98,0xd9,0xfe,0x78,0x3a,0xa2,0x02,0x73,0x5b,0xde,
-0xd2,0x83,0x89,0xb1,0xef,0x48,0xbd,0x04,0x4c,0x00,0x5d,0x95,
-0xed,0x63,0x7c,0x6e,0x68,0x43,0x36,0x21,0x61,0x98,0x2d,0x21,
-0x65,0x10,0x44,0x7a,0x44,0xef,0x88,0xcd,0x6f,0xf1,0x99,0x6e,
-0xf1,0xf0,0xe8,0x44,0xe8,0xcb,0x91,0x5c,0xe8,0x90,0x35,0xbe,
-0xa9,0x8b,0xd9,0xcc,0xad,0x8e,0xb2,0x3e,0x22,0xe0,0x81,0xb5,
-0xe3,0x60,0x4f,0xc8,0x23,0xa5,0xca,0xe3,0x1e,0x0c,0xb3,0x92,
-0xa8,0xcb,0x0d,0xe5,0x87,0x30,0xc4,0x07,0xcc,0x86,0x62,0x4a,
-0x23,0xcb,0x0b,0xb7,0x54,0x76,0x0b,0x43,0x3e,0xc4,0x61,0x37,
-0x2e,0x04,0xe7,0x07,0xe6,0x13,0x00,0xe8,0xa8,0xfa,0x73,0x5b,
-0xd4,0xab,0x01,0x56,0x3c,0x38,0x39,0xbe,0x78,0x7d,0xbe,0x7f,
-0x79,0xa8,0x9b,0x77,0x47,0x5e,0x6b,0x16,0x43,0x51,0xe8,0x2a,
-0x3e,0x18,0x46,0x13,0xe9,0xdf,0x3b,0xa7,0x2d,0x6b,0x37,0x7b,
-0x97,0xdc,0x84,0xe3,0xde,0x8c,0xdd,0x47,0xe3,0x3e,0xac,0x99,
-0xa3,0x60,0x1c,0xdc,0xc0,0x3e,0x76,0x8b,0x92,0x04,0x52,0x59,
-0xd6,0x3f,0x80,0x4d,0x1c,0xe6,0x57,0xfd,0x7b,0xdc,0x4a,0x84,
-0xdc,0xdd,0xf7,0xb2,0x23,0x3e,0x35,0x73,0x9c,0x12,0xdc,0xcc,
-0xb0,0x88,0x14,0xe3,0xb3,0x6e,0xe2,0x93,0x04,0x11,0xde,0x23,
-0x95,0xf7,0xee,0x05,0x5a,0x34,0xde,0x0a,0x05,0x09,0xc3,0xc1,
-0xc4,0x44,0x42,0x3d,0x12,0x33,0xbf,0xe9,0x65,0xb7,0x34,0x09,
-0xc2,0xdc,0x42,0x4b,0x6e,0x68,0xbc,0x41,0x2e,0xdd,0x60,0x68,
-0x2f,0xe9,0xc9,0x1a,0xa4,0x14,0xbb,0x0b,0xa5,0xe8,0xaf,0xb9,
-0x7f,0xf2,0xe6,0x76,0xe6,0x35,0xc7,0x95,0x65,0x66,0xdf,0x25,
-0x04,0x8b,0x04,0x35,0xd6,0x83,0x5d,0x0e,0x9f,0x9b,0x62,0xd0,
-0x1c,0x45,0x57,0xf0,0x20,0x2a,0xf1,0x33,0xf9,0xd2,0x8f,0xa6,
-0x90,0x48,0x40,0xe0,0xe8,0x92,0xc7,0x09,0xad,0x09,0xd0,0x50,
-0x2f,0x53,0xd1,0x16,0x5a,0x12,0x8a,0x18,0x23,0x44,0x54,0xd1,
-0x0f,0x8f,0x3d,0xb8,0x10,0xf2,0xc9,0x12,0x09,0x75,0x2c,0xd7,
-0xb9,0x0e,0xe2,0x3a,0x1a,0xa9,0xd5,0x06,0x6d,0xbc,0x38,0x0d,
-0xbc,0x12,0x50,0x84,0x9c,0xec,0x36,0xe0,0xda,0x7f,0x02,0x9d,
-0x3f,0x44,0xf1,0x4b,0xf3,0xfa,0xb2,0xb8,0x84,0xbc,0x86,0x1f,
-0x60,0xed,0x50,0x12,0x2c,0xae,0x60,0x85,0xf5,0x75,0x20,0x81,
-0xce,0x74,0x5c,0xae,0x8a,0x0e,0x24,0xf0,0xf6,0xa2,0x5c,0x0d,
-0x1d,0x45,0xa0,0x73,0x70,0x5e,0xa6,0xca,0x96,0xd1,0xaf,0x61,
-0x78,0x13,0xc0,0xc4,0x97,0x7e,0xbd,0x2c,0x1c,0x4d,0x87,0x5c,
-0xce,0xaa,0xfe,0xd4,0x6a,0x5d,0x6e,0x79,0x18,0x6a,0xcb,0xe8,
-0x16,0xb7,0x7c,0xe4,0x6b,0xe7,0x8f,0xe1,0x56,0xdc,0x02,0x94,
-0x37,0x42,0x54,0x4f,0x4e,0x82,0x14,0x26,0x9b,0x42,0x13,0x45,
-0x03,0x69,0x88,0xbb,0xcd,0xb2,0xc9,0xee,0xda,0xda,0x5d,0x86,
-0xc6,0x92,0x71,0x98,0xad,0xf5,0xe3,0x5e,0x0a,0x5f,0xa1,0xc1,
-0x3a,0x57,0xdf,0x4f,0x60,0x2c,0x36,0x1a,0xb7,0xd9,0x68,0x58,
-0xf0,0x70,0x00,0x9d,0x17,0xe6,0xa8,0x6d,0xb0,0x1c,0x30,0x1b,
-0x4f,0xe6,0xda,0xe4,0xb8,0xfb,0x11,0x78,0x50,0xa9,0x94,0x8b,
-0x2f,0x97,0xdb,0x31,0xbd,0xe7,0x5c,0xf8,0xd6,0xaf,0xcf,0x20,
-0x3a,0xea,0xee,0xd6,0x07,0xa5,0xf4,0x5c,0xe1,0x6b,0xa3,0x75,
-0xa9,0xbd,0xdc,0xcd,0x05,0xc7,0x47,0x7e,0x43,0xfb,0x53,0x73,
-0x4d,0x2c,0x29,0x51,0x04,0x11,0x64,0x3c,0x5a,0xfe,0xe3,0xf1,
-0xfb,0x6e,0x9a,0xde,0xd8,0x42,0xe3,0x83,0x17,0x40,0xb3,0x23,
-0x1e,0x61,0xb1,0xa8,0x7e,0xf9,0x9b,0x03,0x73,0x91,0x6f,0x39,
-0xc8,0x1b,0x93,0x56,0x1c,0x49,0x4b,0xf4,0xc1,0x81,0x61,0x3c,
-0x81,0x88,0x51,0x80,0x75,0xe8,0x60,0xf1,0xdc,0x61,0xe3,0x5d,
-0xc7,0x7d,0xbe,0xc6,0xac,0xd2,0x5a,0xbe,0x4a,0x7b,0xf9,0x2a,
-0xeb,0x0b,0xab,0x90,0x01,0xc3,0xd4,0xf7,0x30,0x34,0x0a,0xce,
-0xa1,0xc3,0xfa,0x2e,0xd6,0xc1,0xe3,0x2f,0x46,0xc7,0xc4,0x1a,
-0x4e,0xf3,0x18,0xa6,0xef,0x80,0x3f,0x7c,0xa4,0x74,0x7b,0x0e,
-0x8a,0xfc,0x19,0x96,0x2a,0x00,0x31,0xc2,0x27,0x97,0xbd,0xe1,
-0x42,0x15,0xb8,0x91,0xb0,0x24,0xfb,0x3d,0x73,0x2a,0xeb,0x43,
-0x6e,0x49,0x00,0xad,0xb6,0x75,0x9b,0x80,0x77,0x8b,0x07,0x90,
-0xa5,0xb8,0x6c,0x8b,0x21,0x6c,0xb9,0x1d,0x18,0xc6,0x37,0xd5,
-0x4a,0x27,0x4c,0x50,0x3c,0xa7,0xab,0x16,0xc2,0xf2,0x1c,0xf6,
-0xcd,0x2d,0x45,0x1c,0x48,0x1b,0x15,0x77,0x90,0x8d,0x32,0x3f,
-0x70,0x29,0x77,0x31,0x0e,0x3b,0x34,0x72,0x3f,0xb5,0x9a,0xfc,
-0xac,0x64,0xf6,0x68,0x1c,0xcb,0x93,0x26,0x06,0x4c,0x83,0x51,
-0x45,0xc0,0xf4,0x11,0xe4,0xa2,0x70,0x28,0x12,0xc5,0x21,0xa2,
-0x61,0x91,0xa6,0xd9,0x6c,0x12,0x5c,0x58,0x3c,0x89,0x83,0xf2,
-0x90,0x39,0xb4,0x46,0x2e,0x55,0x80,0xab,0xc9,0x7b,0x3b,0x3d,
-0x2e,0x7d,0x49,0xd3,0x39,0xb5,0xec,0xb6,0xd5,0xa6,0xb6,0xc4,
-0x69,0x99,0x8e,0x88,0x56,0x93,0xb2,0x18,0x67,0x52,0xbc,0x1c,
-0x94,0x2f,0xc3,0xec,0xac,0xba,0x38,0xc1,0x73,0x2c,0xc5,0xb1,
-0xb3,0x66,0x96,0x95,0x62,0x79,0x46,0xe6,0x72,0xd2,0x73,0x48,
-0x0c,0x6e,0xc3,0x61,0x9f,0xe1,0xa3,0xaf,0x0d,0x7b,0x78,0x1e,
-0x5a,0x4d,0x7e,0x1e,0x7d,0x61,0x6e,0x00,0x3b,0xce,0x20,0x12,
-0xc9,0x3c,0xe5,0x90,0xa6,0x4e,0x51,0xae,0x5a,0x71,0xca,0xbe,
-0xf4,0x95,0xa4,0xae,0x1e,0x51,0x2f,0x72,0x3c,0xc1,0x5d,0xe8,
-0xac,0x27,0x11,0x7b,0x72,0xfd,0xab,0x08,0xeb,0x45,0x65,0xcf,
-0xc3,0xa8,0xaf,0xd1,0x72,0x8e,0xae,0x2f,0x31,0x27,0xa5,0x3c,
-0x9d,0x2f,0xb8,0xb0,0xd4,0x6c,0x6e,0xec,0xf2,0x15,0x06,0xc4,
-0x2b,0x7a,0x45,0x31,0x1a,0xaf,0xd1,0xdf,0x58,0x9d,0xf0,0x4d,
-0x4a,0x8b,0x22,0xbb,0x68,0xf0,0x3e,0xce,0x65,0x40,0x1d,0xca,
-0x39,0x77,0xd7,0xbb,0x71,0x9f,0xb4,0x06,0x65,0x26,0x72,0xb3,
-0xb9,0x49,0x18,0x4d,0xb3,0xc1,0x36,0xea,0x31,0xf9,0x92,0x67,
-0xb3,0x07,0xf7,0x6e,0xcd,0x06,0x92,0xda,0x36,0x50,0xc2,0x26,
-0x01,0x91,0xb0,0xaf,0xcd,0xf0,0x56,0x27,0xd2,0x68,0x84,0xfe,
-0x1b,0x70,0xe6,0xa1,0xc8,0x61,0xc3,0x00,0xce,0x29,0xb0,0xd7,
-0x0f,0xa7,0x21,0xdd,0x02,0xa5,0x96,0xb5,0xdb,0xcc,0x7c,0x64,
-0xb7,0x38,0xf9,0x6e,0x92,0xb9,0xb8,0x42,0xfe,0x23,0x71,0xa5,
-0xd7,0xff,0xf0,0xb8,0x19,0xf4,0xfb,0x0c,0x96,0x74,0x54,0xe9,
-0x46,0xc0,0xd3,0x56,0x21,0x52,0x6f,0x10,0xe5,0x9f,0x77,0xf7,
-0x1e,0xf6,0x66,0xa7,0x66,0xa6,0x58,0x36,0x8c,0xec,0xd1,0xdc,
-0x2e,0xb5,0x04,0xfd,0x51,0x59,0x32,0x7f,0x00,0xb0,0xc4,0x23,
-0xbb,0xc5,0xdd,0x37,0xb8,0xb6,0x63,0x5e,0x7f,0xf2,0xdd,0xe1,
-0xab,0x80,0xce,0xbc,0x9a,0x27,0x11,0xf0,0xae,0xe0,0xa3,0xb0,
-0xe2,0xec,0x63,0xf7,0x80,0xa7,0xbd,0xe5,0xb1,0x27,0x5f,0xe8,
-0xf7,0x68,0x8b,0x89,0xb3,0xc1,0x97,0xe8,0x60,0x98,0xd9,0x0f,
-0x92,0xb9,0xe0,0x85,0x0c,0x85,0x5b,0xad,0xf9,0x1c,0x2d,0xff,
-0x21,0x8f,0xd8,0x37,0xfb,0x27,0x27,0xf5,0xab,0xb7,0x97,0xe7,
-0xef,0xbe,0x7f,0x6b,0x89,0x71,0xcf,0xfc,0x2d,0x38,0x78,0xcc,
-0x2f,0x65,0x8a,0x90,0x7c,0x61,0x32,0x23,0x04,0x88,0x07,0x5a,
-0xe4,0xc3,0x68,0x66,0x06,0x7f,0x7e,0x26,0xdd,0x35,0x1c,0x70,
-0x6b,0x56,0x36,0x39,0x00,0xef,0x1a,0xce,0xc0,0x4e,0x36,0x1c,
-0x03,0x27,0x32,0x1b,0x3f,0xdb,0xd9,0x0f,0x22,0xeb,0xc1,0xa9,
-0x25,0x6b,0xd8,0xc9,0xea,0x15,0x8a,0x5d,0xf3,0x0a,0x00,0x7c,
-0xf7,0x15,0xe3,0x5e,0xed,0xbb,0xf9,0xcb,0x02,0x76,0x61,0x7c,
-0xa7,0x41,0x14,0xc2,0x8f,0x56,0x1e,0xee,0xbd,0x3f,0xfd,0x44,
-0x61,0x8c,0xe5,0x73,0xd6,0xe8,0x9d,0x8d,0x9b,0xca,0x2b,0xb7,
-0xa0,0xc8,0x17,0xa0,0xc4,0xb7,0x9a,0x5b,0x8a,0xbf,0x9b,0x2d,
-0x0a,0xf1,0x2f,0xb9,0x32,0x52,0xea,0xb3,0x41,0x99,0x98,0x7d,
-0xde,0x33,0xbe,0x48,0xf1,0x0c,0x70,0x5b,0xcd,0xa5,0xeb,0xc7,
-0xee,0xc4,0x53,0x13,0x4e,0xbe,0xfb,0x3c,0xb2,0x80,0x5f,0x28,
-0xd8,0x3b,0x86,0xde,0x21,0x13,0xef,0x76,0x70,0x53,0x8c,0xc7,
-0xe0,0xba,0xb4,0xa9,0x57,0x98,0x50,0xbe,0x9a,0xad,0x57,0xc4,
-0xc2,0x45,0x9f,0x11,0x6e,0x31,0xcb,0x5b,0x7a,0x87,0x05,0x96,
-0x5e,0xf1,0x24,0x09,0xa4,0x5f,0x76,0xfc,0xb6,0x5e,0x01,0x7c,
-0x79,0x33,0x2f,0xba,0x54,0xf2,0x75,0x54,0x1a,0x72,0x7d,0x46,
-0xdb,0xed,0x66,0x79,0x9b,0xed,0x3f,0xa6,0xa3,0x09,0xab,0xbe,
-0x81,0x03,0x74,0x39,0x8b,0xad,0x40,0xbd,0x84,0xc1,0xd6,0xee,
-0xe4,0x22,0xbb,0xed,0x59,0xbc,0x94,0xe9,0x16,0x8a,0x2f,0x65,
-0xbd,0x3d,0x8c,0xc7,0x95,0x8c,0x4b,0x27,0xf3,0x6c,0xb8,0x5e,
-0xcb,0xec,0x5b,0xda,0x7d,0x4a,0x59,0x66,0xe3,0xc9,0x92,0x86,
-0x59,0x8e,0xd7,0x64,0x29,0xf3,0xec,0x49,0x34,0x8a,0x64,0x1d,
-0xf4,0x46,0xa3,0x51,0xc3,0x16,0xd1,0xb1,0x31,0x5e,0x64,0x9e,
-0xa5,0xde,0x94,0x33,0xcf,0x0a,0xa2,0x95,0x37,0xd2,0x1e,0x72,
-0xdd,0xdd,0x52,0x56,0x5a,0xa9,0x21,0xc7,0xba,0xa5,0xad,0xae,
-0x67,0xf1,0x63,0x0d,0xaf,0x12,0xc5,0x72,0x96,0x57,0xa5,0x32,
-0x3d,0x5b,0x64,0x79,0x1d,0x0c,0x16,0x9b,0x5e,0xcf,0xe2,0x65,
-0xad,0xaf,0xc0,0x4f,0xda,0xf8,0x5a,0x7d,0xb4,0xf5,0x35,0x87,
-0xb9,0xd6,0x55,0x8b,0x59,0x6a,0x2b,0xaa,0xbd,0xd6,0xd3,0xb3,
-0x29,0x5d,0xdf,0x7f,0xbc,0xe5,0x94,0x5f,0xea,0x2a,0x61,0x36,
-0x2d,0x37,0x59,0xbf,0xae,0xf1,0x94,0xb7,0x39,0x5d,0xde,0x84,
-0xaa,0x2b,0x3e,0xc6,0x90,0xaa,0x6b,0x3f,0xc2,0x9c,0x6a,0xd0,
-0x69,0x69,0xa3,0xaa,0x9c,0x07,0x4b,0x59,0x55,0x45,0x83,0x73,
-0x6d,0xab,0xca,0x84,0xb5,0xc0,0xc4,0x5a,0x0c,0xab,0xbc,0xa1,
-0x95,0xc3,0x88,0x3c,0xe6,0x56,0x35,0x5d,0xc4,0x14,0xb1,0x6c,
-0x5c,0x4b,0x1b,0x59,0x25,0xb1,0xbe,0xc4,0xca,0x2a,0x11,0x59,
-0xd6,0xcc,0x6a,0x0c,0xb2,0x36,0x57,0xfa,0x6c,0xad,0xb6,0xed,
-0xd0,0x6a,0xee,0xb1,0xb6,0x56,0xae,0x97,0xbf,0xa4,0x17,0xa7,
-0x8b,0x8c,0xae,0x12,0x82,0xb8,0xf1,0x39,0xd7,0xe8,0xea,0xed,
-0x8b,0xc7,0xf4,0x3a,0xa7,0x2b,0xcb,0x9b,0x5e,0x0f,0xf9,0x5d,
-0xa0,0x4f,0xb6,0x05,0x96,0x9a,0x9e,0x6f,0x7e,0xb5,0xda,0x7d,
-0xb4,0xfd,0xf5,0xe2,0xf2,0xf8,0x74,0xff,0xf2,0x67,0x8f,0xf5,
-0xd5,0xc7,0x9a,0x8f,0x32,0xbf,0x4a,0xf6,0xfc,0x3a,0xf6,0x57,
-0xab,0xdb,0x8f,0x34,0xc0,0x4a,0x8c,0x4a,0x58,0x60,0x25,0x8c,
-0x12,0xc8,0x2c,0x6d,0x88,0xf5,0x6d,0x6e,0x86,0x09,0x52,0x3c,
-0x79,0x2e,0x20,0xf0,0x58,0xef,0x70,0xde,0x8d,0xb8,0x56,0xd2,
-0xb5,0xe2,0x7e,0x91,0xa1,0xb2,0xd0,0x7c,0x0b,0x87,0x85,0x0c,
-0xaf,0x89,0xb8,0x26,0xd5,0x4b,0xd7,0x82,0xfb,0xc5,0xe6,0xe2,
-0x9d,0xb9,0x64,0xa1,0x15,0x2c,0xb1,0x90,0x51,0x86,0xcf,0x42,
-0x9c,0xe6,0x21,0x93,0xe7,0x96,0x32,0xc6,0x5a,0xc7,0x4a,0x2b,
-0x81,0x94,0x36,0xd6,0xfa,0xac,0xb4,0x7a,0x74,0xca,0x1b,0x6b,
-0xf9,0x19,0xee,0x4b,0xcc,0xb5,0x1c,0xc2,0x92,0x06,0x5b,0x5e,
-0x69,0x39,0x93,0xad,0x68,0x68,0x39,0xa3,0x2d,0xaf,0xf4,0x05,
-0x66,0x5b,0x0e,0xc0,0x53,0x13,0xb6,0x72,0xe8,0xf4,0xda,0xc5,
-0x01,0xe3,0x6a,0xe7,0x42,0x13,0x2e,0x87,0xe0,0x37,0xe2,0x16,
-0x3d,0xe4,0xf9,0x7f,0xc9,0x14,0xab,0x10,0xfa,0x7f,0x66,0x8c,
-0x5d,0xa8,0x67,0x5c,0x64,0x8d,0x2d,0x06,0xf0,0x1f,0x34,0xc7,
-0x2e,0xec,0x85,0x11,0xe0,0x4b,0xe1,0x42,0xd7,0x08,0xc8,0x82,
-0x02,0xe7,0xc4,0x6f,0xbf,0x75,0x0c,0x92,0xb6,0x92,0xd2,0x34,
-0x44,0xda,0xe5,0xfc,0x36,0x49,0xad,0xc6,0x12,0x27,0x16,0xbb,
-0xd2,0xa3,0x8d,0x97,0x0b,0x3b,0xba,0xd0,0x7a,0xb9,0x58,0xb1,
-0xbc,0xd0,0x7c,0xb9,0x10,0x44,0x81,0xfd,0x92,0x46,0x99,0x6e,
-0x51,0xc3,0x7c,0xc5,0x49,0x2e,0x54,0x84,0xcb,0x98,0x2d,0x17,
-0xb6,0xed,0xb7,0x5b,0x2e,0xb2,0x3e,0x7e,0x55,0x8b,0xa1,0x6b,
-0xd4,0x73,0x70,0xce,0x5b,0xf3,0x7c,0x05,0x6c,0x1b,0x9e,0xaf,
-0x84,0x6d,0xbb,0xf3,0x95,0x28,0x32,0xde,0x55,0xbe,0x9e,0x1d,
-0x2e,0x67,0x54,0x2b,0x61,0xb8,0x78,0x84,0x55,0xad,0x0c,0xd4,
-0xa5,0xcd,0x5f,0x25,0x80,0x3e,0xce,0x00,0xb5,0x78,0x51,0xe5,
-0x60,0x6f,0x51,0x8f,0x56,0xc2,0x18,0xb4,0xd8,0x50,0x59,0xd6,
-0x16,0x54,0xc6,0xdc,0x23,0x66,0xe5,0x62,0x8b,0x8f,0xaf,0x20,
-0xab,0xe7,0xdd,0xf3,0xf2,0x4b,0xaf,0xcf,0x0e,0xa4,0xad,0x3c,
-0xd2,0x17,0x84,0x97,0xe2,0x69,0x39,0xf3,0x01,0x0f,0xad,0x64,
-0x97,0x54,0x11,0x61,0xec,0x92,0x68,0xfb,0x71,0x4b,0x62,0x5a,
-0xae,0xe4,0x83,0x53,0xea,0x21,0x0f,0xcb,0x85,0x93,0x37,0x6b,
-0x48,0xc3,0x90,0x53,0x52,0xa5,0x17,0xd4,0xe0,0x06,0x22,0x6f,
-0x25,0xf3,0xe5,0x75,0xa3,0x1e,0xda,0x8c,0x9c,0xf2,0x98,0x34,
-0xc7,0x10,0x33,0x1d,0x5a,0x66,0x18,0x18,0x42,0x7d,0x1d,0x50,
-0xf8,0x12,0x98,0xe1,0xe9,0x45,0x19,0x97,0x38,0xb4,0x8b,0xfd,
-0xb4,0xe7,0x2d,0x34,0xb3,0x0a,0xfd,0xec,0x14,0xfa,0x9c,0xdf,
-0x51,0x0b,0x1f,0x46,0x77,0x89,0xf4,0x25,0xd6,0x22,0x71,0x4f,
-0x53,0x48,0xf1,0xe4,0x9f,0xa8,0x14,0xde,0x97,0x5c,0xe1,0x7d,
-0x9d,0xc1,0xc8,0x70,0xfd,0x91,0x75,0x8f,0x97,0xdf,0x59,0xc2,
-0x07,0x65,0x40,0x26,0x84,0xb3,0xa7,0x38,0x6b,0xf6,0xf1,0x76,
-0x1a,0x99,0x2e,0xae,0x5e,0xbb,0x36,0x9d,0xa4,0xc0,0x07,0x90,
-0xb7,0x29,0xda,0x9b,0x27,0x80,0x9a,0xf2,0x9d,0x16,0x00,0x73,
-0xdc,0x65,0xdc,0xf5,0xfc,0xe3,0x0f,0xbc,0xc8,0x59,0x37,0xee,
-0xbb,0x3a,0x4c,0x65,0xdc,0xf9,0x94,0x17,0xe8,0xf9,0xbd,0xcd,
-0xba,0x13,0xff,0x47,0x07,0x3c,0xcc,0x3f,0x9f,0x2e,0xb4,0x0c,
-0xa6,0xfb,0x6e,0x15,0xa3,0x70,0x34,0x3a,0x3f,0x17,0xbc,0x9c,
-0xaf,0x6d,0xce,0x45,0x1d,0x36,0x38,0x8a,0x99,0x51,0x9c,0x0c,
-0x26,0x62,0xfa,0x19,0x5a,0x03,0x99,0x29,0x47,0xc6,0x39,0xfb,
-0x2e,0xc0,0x47,0x1c,0x4e,0x4b,0xa0,0xe4,0x70,0x3b,0x52,0xcd,
-0x26,0x8d,0x89,0x20,0xcf,0x34,0xa2,0xbc,0x9e,0x84,0x29,0xc6,
-0xc2,0x7d,0x87,0xae,0xbf,0x4e,0x9c,0x57,0x11,0x94,0xdc,0x79,
-0x8d,0xfd,0x2a,0xe8,0xca,0xc3,0x0f,0x94,0x81,0x69,0x0c,0x27,
-0x9f,0x78,0x92,0x8f,0xa3,0xf9,0xf6,0xaa,0xc4,0xe3,0xec,0x00,
-0xac,0xa8,0x6f,0xde,0x0b,0xd4,0xc4,0x3e,0xd8,0xb9,0x39,0xf1,
-0xc7,0xf4,0xd2,0x08,0xbb,0x20,0x1a,0x15,0xfc,0xd1,0x53,0x3b,
-0x4c,0x5a,0x00,0xa7,0x13,0xfc,0xce,0xd7,0x73,0xa7,0x17,0x9d,
-0x77,0x05,0xdc,0x42,0x35,0xdf,0x4d,0xbe,0x3a,0xf2,0x56,0x40,
-0x3b,0x63,0xf7,0x78,0xea,0xda,0xf2,0x3d,0xc1,0xd4,0x16,0x55,
-0x13,0x86,0x7d,0x4f,0x5c,0xbd,0x55,0x41,0xa1,0xe5,0x62,0xe6,
-0x29,0x64,0x1e,0x1b,0x3b,0xef,0x4a,0x0d,0x01,0xba,0x9a,0x15,
-0x0f,0xc2,0xe1,0xbc,0x41,0x38,0xc4,0xaa,0xff,0x4f,0x86,0x41,
-0xd2,0x73,0xf9,0x91,0xa0,0x01,0xfc,0x3f,0x33,0x0c,0x7b,0x9e,
-0x5f,0x57,0x7c,0xee,0x1f,0x8f,0xa3,0x2c,0x42,0xa5,0xa0,0xd2,
-0x1b,0x0b,0x3f,0xb9,0x4c,0x9a,0x6b,0x18,0xbb,0xd0,0xd1,0xa4,
-0xd4,0x6b,0x92,0xd7,0x38,0x1c,0x7b,0x14,0xc7,0xe6,0x81,0xff,
-0x99,0xed,0x91,0x80,0x85,0x71,0x05,0x30,0x0c,0x3f,0xc5,0xfd,
-0x2b,0xb0,0x5f,0x71,0x10,0xda,0x20,0xe4,0x8d,0xdb,0x1a,0x71,
-0x11,0x56,0x96,0x2a,0xe2,0x00,0x00,0x75,0x09,0x67,0x8b,0xbb,
-0x60,0x9c,0xed,0x32,0x7e,0x1f,0x1d,0x05,0xf0,0x96,0x49,0x02,
-0x8c,0xb5,0x64,0x76,0x9a,0xab,0x6a,0xe2,0x71,0xc8,0x64,0x54,
-0x9b,0x41,0x18,0xf0,0x20,0x58,0x42,0x71,0x97,0x45,0xd9,0x90,
-0x2b,0x6f,0x52,0xf9,0x36,0x9c,0x7c,0x26,0x8b,0x20,0x90,0x57,
-0x5c,0x83,0x09,0xd5,0xe3,0x70,0x56,0x63,0x4f,0x48,0x7f,0xf2,
-0xc4,0xd6,0xf0,0x0a,0xb0,0x3c,0x48,0x52,0x94,0x62,0x68,0xf6,
-0x54,0x86,0xf6,0x41,0x7d,0x32,0xbe,0x1b,0x2a,0x54,0xcb,0x64,
-0x0c,0xe8,0xa2,0xad,0x8e,0x82,0x27,0x89,0xa7,0x44,0x24,0x5a,
-0xdd,0x99,0xb0,0x83,0xd2,0x93,0x79,0x62,0xdf,0x8f,0x50,0xc8,
-0xc5,0x23,0x9f,0x9c,0x4d,0xa8,0xe2,0x71,0xb1,0x8f,0xc6,0x00,
-0x8d,0x82,0xb4,0xd8,0xaa,0x2b,0xcb,0x98,0x80,0x6d,0x71,0x65,
-0xf6,0x5a,0xd4,0x83,0x51,0x1a,0x06,0xdd,0x70,0x98,0xb2,0x29,
-0x29,0xbb,0x6f,0xc3,0x87,0xa0,0x1f,0xf6,0x22,0x14,0xea,0x3c,
-0xce,0x1f,0x02,0xc4,0x6f,0xd3,0x30,0x99,0x2d,0x06,0xa2,0xf4,
-0xe3,0x39,0x68,0xed,0xd2,0x08,0xbd,0xbb,0x7a,0x53,0xdf,0xf6,
-0x39,0x8a,0x94,0x43,0xc5,0xac,0x5e,0x45,0xfe,0x84,0x21,0x80,
-0xf3,0x22,0xc5,0x75,0x82,0xe1,0x7f,0x72,0x45,0xd4,0xa3,0x4b,
-0x17,0x4f,0x0a,0xb7,0xee,0x30,0xa3,0x62,0x54,0xaa,0x88,0x35,
-0xdd,0x69,0xf8,0xbf,0x6a,0xab,0x45,0x73,0xf2,0x52,0x7b,0xed,
-0xeb,0xb9,0x7b,0xad,0x04,0xf7,0x97,0x6e,0xb6,0x20,0x05,0xde,
-0x15,0x6f,0xb6,0x5d,0x9c,0x55,0xe4,0xbb,0x42,0x96,0x0d,0x15,
-0x8a,0xfb,0x26,0x09,0x26,0xb7,0x51,0xcf,0x08,0xe2,0x80,0xfd,
-0xe4,0xf1,0x84,0x2e,0x8f,0x0a,0xc2,0x8b,0x70,0x2f,0x18,0x15,
-0x75,0x5b,0x3b,0x32,0x2c,0xdd,0x39,0xea,0x47,0x8d,0x07,0xb2,
-0x7a,0x61,0xac,0xdf,0xd7,0xf9,0x85,0x7b,0xf6,0x41,0x14,0xa6,
-0xa0,0x9d,0x58,0xea,0x5a,0x10,0xa0,0xce,0xb8,0xa8,0xca,0xbf,
-0x8b,0x07,0x7a,0x44,0x10,0x4f,0x5f,0xa8,0x54,0xa3,0xae,0x0e,
-0xcf,0x69,0x93,0xeb,0x86,0xe1,0xd0,0xb3,0x03,0x3c,0x9e,0xb2,
-0xea,0xd5,0xeb,0x03,0xef,0xab,0xec,0x3c,0x1b,0x78,0x86,0x66,
-0xb9,0xf0,0x81,0x2a,0x78,0xa3,0x7d,0xdd,0xa8,0x21,0x5f,0xf2,
-0xbf,0x88,0x31,0xdc,0x41,0x84,0x0b,0x94,0xb8,0x3e,0x64,0xcc,
-0x34,0x5e,0xb4,0x43,0xec,0x16,0xf3,0xc7,0xfd,0x1b,0x05,0x77,
-0x8c,0x82,0xf1,0x38,0x48,0xba,0x71,0xb2,0x16,0x04,0x41,0x7d,
-0x7a,0xb3,0x26,0x16,0xf3,0xad,0xc2,0x5b,0x46,0xc0,0xc8,0x1c,
-0xfc,0x17,0xc4,0xce,0x31,0x9e,0x29,0x34,0xf5,0x96,0x78,0xac,
-0x14,0xc4,0xa5,0x1a,0xee,0x03,0x50,0xfc,0x29,0x32,0x8b,0x85,
-0xc5,0xe1,0xf4,0xf7,0xcf,0x79,0xc6,0x1d,0xb1,0x88,0xb1,0x53,
-0xe0,0xb2,0x00,0xc8,0x3b,0x99,0xb1,0xea,0xa9,0x7f,0x24,0x78,
-0xc0,0x09,0x19,0x2f,0xc2,0x3f,0x02,0x86,0xfb,0x4c,0x3c,0x18,
-0xc8,0x27,0x2e,0xe4,0xe5,0x80,0x61,0x98,0x78,0x6c,0x18,0x9b,
-0x46,0x9d,0xf1,0xdc,0x2a,0xea,0x48,0x17,0x71,0x00,0x36,0xd2,
-0x73,0x1f,0x2c,0x6a,0x19,0x5d,0xa0,0x99,0x80,0xf0,0x03,0xd8,
-0x61,0x61,0x7e,0xf2,0x05,0x64,0x6e,0x47,0x82,0x29,0xf0,0x08,
-0x55,0x5e,0x84,0xff,0xbc,0x92,0x2d,0x66,0x91,0x12,0x77,0xb3,
-0x18,0x0d,0x5c,0xa8,0xfc,0x18,0x06,0xb0,0x81,0x46,0x37,0xe3,
-0x18,0xb7,0x3a,0xee,0xed,0x95,0xab,0x6c,0x76,0x02,0x18,0x9a,
-0x1e,0x4d,0xf2,0xbf,0xcf,0x3a,0x42,0xca,0x10,0x61,0xca,0xac,
-0xcb,0x4a,0x36,0x18,0xe9,0x13,0x39,0xac,0xd0,0x7c,0xff,0x95,
-0xc6,0xbe,0xba,0xf0,0x82,0x9f,0xa6,0xdc,0x36,0xc8,0x03,0xaa,
-0xd1,0xab,0xdf,0x3d,0xd4,0x9b,0xdd,0xdf,0x86,0xda,0x32,0x07,
-0xc9,0x18,0x3e,0x2c,0x4b,0xa6,0xbd,0x8c,0x85,0xdc,0xae,0x9f,
-0xe2,0x1d,0x99,0x31,0xbe,0xd9,0x7d,0x1b,0x0f,0x69,0x61,0x34,
-0xe2,0xe8,0xc1,0xbe,0x8f,0xda,0x4c,0xf5,0xce,0xb6,0x76,0xc7,
-0x20,0xb7,0x11,0xf9,0xfa,0x6f,0xc0,0x6e,0x22,0xbc,0xd0,0xc1,
-0xdd,0x41,0xae,0xd4,0x73,0xde,0x2a,0x38,0x19,0x05,0x7b,0x94,
-0x21,0x3d,0xb9,0xff,0x41,0x76,0xab,0x7d,0x0a,0xc8,0xb9,0x0e,
-0x66,0x33,0x75,0x4d,0x40,0xe0,0x0f,0xde,0x9a,0x20,0x52,0x8d,
-0x07,0x75,0x9a,0xde,0xaa,0x49,0xd1,0x61,0x53,0x0a,0x42,0x12,
-0x5e,0x83,0xde,0xfc,0xcd,0xfc,0x50,0x38,0x04,0x11,0x9f,0xb2,
-0x66,0xe3,0x41,0x86,0x71,0xb2,0x47,0xc6,0x2c,0xca,0x50,0x44,
-0x41,0x19,0x74,0x28,0x84,0x2a,0x0f,0xeb,0x12,0x41,0x66,0x7c,
-0xef,0xfc,0x21,0x17,0x12,0xb4,0x6d,0x94,0x79,0x23,0xc6,0x3b,
-0x5f,0x6a,0xc3,0x28,0x75,0x8e,0x83,0x65,0x14,0x39,0x1e,0xd0,
-0x9b,0x34,0x96,0x98,0xcb,0x89,0x5d,0x23,0x5e,0xb3,0x5f,0x5c,
-0x57,0xb8,0x03,0x94,0x48,0x8c,0xb9,0xd5,0x05,0x3f,0x5b,0x42,
-0xa5,0x4b,0x05,0xa7,0x2c,0x67,0xaa,0x97,0xca,0x84,0x94,0xa8,
-0x59,0x03,0x36,0x1d,0xd8,0xa8,0x84,0xdd,0x9a,0x5f,0xef,0xee,
-0xb3,0x3b,0x58,0x12,0xe8,0x92,0xbc,0x87,0xb1,0x25,0x0b,0x6a,
-0xbb,0x75,0xa2,0xa2,0x36,0xe2,0x18,0xeb,0xf1,0xe1,0xe3,0x8e,
-0xa2,0x50,0xbd,0xf5,0xa4,0xc6,0x5b,0xe2,0x30,0x7a,0xb0,0x13,
-0xe0,0x1b,0x9a,0xa1,0x10,0xd0,0xc4,0x9b,0xd4,0x31,0x5d,0x1e,
-0xb6,0x1a,0x08,0x1d,0xb6,0xcc,0xa4,0xe4,0xe7,0x65,0x4b,0xc3,
-0xf4,0xee,0x0b,0x38,0xfb,0x1f,0x18,0xff,0xcc,0xc6,0x38,0xd5,
-0xac,0x9b,0x07,0xcc,0xb4,0x23,0x87,0xf4,0xb1,0xf9,0x11,0x5d,
-0x40,0xe6,0x97,0xac,0x89,0x55,0x63,0x9a,0x4a,0x2f,0x26,0x31,
-0x96,0x1c,0x02,0x3a,0x57,0xd1,0x2d,0xa5,0xe0,0x13,0xbe,0xfb,
-0x2a,0xa2,0xa4,0x86,0x7d,0x45,0x56,0x1c,0x10,0xed,0x7a,0x6a,
-0x5c,0xd8,0xe6,0xf5,0x83,0x3e,0x2d,0x2b,0x81,0xd1,0x0b,0x80,
-0x16,0x06,0xc0,0x24,0xb2,0x16,0x79,0xa2,0xd1,0xa2,0x45,0x0f,
-0x9f,0x49,0x1c,0xf4,0xc0,0x24,0x7e,0xce,0x15,0x3d,0x38,0x55,
-0xbc,0x57,0x9a,0x7b,0x27,0x7a,0x4d,0x75,0xb8,0x6b,0x12,0xd3,
-0x56,0x77,0x2a,0x03,0xd1,0x72,0x4f,0x50,0x77,0x7d,0x15,0x07,
-0x1d,0x6b,0x91,0xc5,0x1e,0x90,0xb1,0x82,0xbb,0xd0,0x88,0x1d,
-0x53,0xb9,0x9b,0x60,0x2a,0x3d,0xfe,0x84,0xa8,0xcb,0x01,0x7e,
-0x1f,0x0c,0xa3,0xbe,0xbc,0xca,0x24,0x4f,0x49,0x8a,0x50,0xbb,
-0x9e,0x0d,0x7f,0x8c,0x8e,0xad,0xb9,0x76,0x7c,0x8b,0x13,0x95,
-0xe1,0x97,0xec,0x9c,0xa3,0x33,0x37,0xd0,0x44,0xfc,0x9e,0x92,
-0x98,0xa2,0x3e,0xd6,0x15,0x01,0x5a,0x73,0x8d,0xe5,0x16,0x26,
-0xa6,0xc3,0x77,0x88,0xd5,0xc9,0x61,0x29,0x21,0x98,0x88,0x39,
-0x8b,0x4d,0xb7,0x58,0xd1,0x62,0x74,0xa1,0x47,0xa0,0xd4,0x80,
-0x7e,0xc3,0x26,0x38,0x94,0xf1,0x20,0xd3,0x91,0x76,0x13,0x75,
-0x35,0xa0,0x73,0x25,0x9e,0x80,0x5c,0x70,0x41,0x3d,0x43,0x2a,
-0x6c,0xd4,0x5b,0xcd,0xe2,0x1b,0xea,0xd0,0x02,0x3f,0xa0,0xcf,
-0xd3,0x89,0x16,0x5d,0x51,0x9a,0xe3,0x55,0x30,0xc7,0x82,0x3d,
-0xcf,0x3c,0x4d,0xb6,0x2c,0x10,0x6c,0x30,0x7b,0x65,0xa1,0x35,
-0x18,0x4b,0xbf,0xf2,0x14,0xcb,0xbb,0x07,0xe4,0x74,0xe8,0xcd,
-0x22,0x85,0xb9,0x65,0x8e,0xd8,0x33,0x28,0x50,0xf0,0x18,0xbc,
-0x7d,0x6e,0xe3,0xba,0x73,0x0b,0x2f,0x71,0x97,0xc6,0x30,0xc3,
-0x50,0x32,0xbf,0x88,0xa3,0x8b,0xbb,0xe5,0x91,0x63,0xaf,0xb1,
-0xc6,0x07,0x99,0x6f,0x1d,0x6a,0xfe,0x2e,0xa7,0xfb,0xa5,0x08,
-0x45,0x4d,0x51,0xb1,0xd5,0xed,0x8e,0xcb,0xff,0x39,0x45,0x9f,
-0xa9,0x37,0x40,0x85,0xf7,0x57,0xeb,0x4d,0x1d,0x19,0x1a,0x63,
-0x78,0xcf,0x0c,0xd6,0xe6,0xd0,0x60,0xeb,0x1a,0xfd,0x9d,0x09,
-0x57,0x34,0x11,0xef,0x39,0x95,0xf1,0x98,0x09,0xa8,0x0c,0x75,
-0x4c,0xee,0x5c,0x97,0xa7,0x3c,0x04,0x20,0x0a,0xc8,0xba,0x8c,
-0x21,0xc7,0xa8,0x49,0xde,0x04,0x2a,0xf2,0x57,0x30,0x7b,0xf1,
-0xcd,0x38,0xfa,0xb7,0x8e,0x88,0xd1,0xa2,0x2b,0xb5,0xca,0xd3,
-0xab,0x0d,0x5f,0x89,0xc1,0x65,0xc2,0x3a,0x24,0x4c,0x80,0x61,
-0x83,0x31,0xec,0x67,0xc3,0x99,0x59,0x76,0xc3,0xc9,0xe2,0xf5,
-0xbc,0x47,0x5b,0xa2,0xcd,0xfe,0x38,0x8d,0x4a,0xcf,0xbc,0x57,
-0x3e,0xe2,0xe2,0x35,0x9d,0x89,0xb8,0xa6,0xf3,0x38,0x1a,0xbf,
-0x52,0x54,0x9e,0x94,0xa5,0x32,0xd7,0xaf,0xd5,0x1c,0x2a,0x73,
-0x02,0x8b,0x6d,0x28,0x55,0xfe,0x86,0x38,0xfa,0x1c,0xa7,0x82,
-0x43,0x3e,0x75,0x44,0x5c,0x35,0x2a,0x4d,0x0c,0xa9,0xbf,0x7c,
-0x62,0x6e,0x2e,0x20,0x7e,0x92,0x34,0x8d,0xdb,0x24,0x67,0x62,
-0x71,0xe9,0x07,0xa9,0xe1,0x5d,0xfc,0xb9,0x31,0x98,0x00,0x14,
-0xec,0x03,0xd2,0x33,0xcc,0x8e,0x4b,0x2e,0xb2,0xda,0x22,0xab,
-0x9d,0xcf,0x5a,0x17,0x59,0xeb,0x2a,0xcb,0x8b,0x80,0x2b,0x33,
-0xfb,0x36,0xa1,0xed,0x3a,0x7a,0x41,0x8a,0xd3,0x60,0xce,0xf9,
-0x1d,0x4b,0x3c,0xb3,0x4a,0xb0,0xaa,0xd8,0x4a,0x48,0x77,0x48,
-0x4c,0x80,0x4f,0x14,0xfb,0xf6,0x1c,0x17,0xb4,0x7f,0x8f,0x38,
-0xd0,0x74,0x3d,0x11,0x6b,0x43,0xa9,0x11,0xfa,0x0d,0x3d,0xc6,
-0x61,0x55,0x3c,0x39,0x3a,0xe4,0x17,0x4f,0x4e,0x4e,0xe6,0x28,
-0x38,0x50,0xc4,0x86,0x92,0x9d,0xa2,0x83,0x75,0x4b,0x5c,0x13,
-0x42,0xe5,0xf4,0xd9,0x74,0x44,0xce,0xe8,0xbe,0x3e,0xf1,0x12,
-0x07,0xc1,0x24,0xf5,0x14,0x59,0x37,0x8a,0x08,0x9b,0x84,0x17,
-0x0e,0x6f,0xec,0xe8,0x01,0x5d,0xc2,0xa7,0x51,0x7a,0x5b,0xdc,
-0x62,0xdb,0x2d,0x59,0xd0,0x72,0x9b,0xc9,0x30,0x4e,0xba,0xa8,
-0x85,0x81,0x2f,0x18,0x33,0x50,0x8f,0x88,0x57,0x92,0xe0,0x9d,
-0x0b,0xf6,0x9b,0x31,0x1d,0xf8,0x66,0xc3,0xdf,0x93,0xe0,0x33,
-0xe1,0x1d,0x3e,0x6a,0x8c,0xd7,0xed,0x5c,0x76,0xe0,0x03,0xd1,
-0x95,0xb7,0xbc,0xba,0xc3,0x1c,0xfe,0x2d,0x4f,0x89,0xa2,0xa1,
-0xe2,0x34,0x49,0x33,0x7a,0x43,0xd7,0x03,0x6b,0xdd,0x86,0xa5,
-0x9e,0xf4,0xf7,0xc9,0xea,0x02,0x8a,0x51,0xa6,0x80,0x49,0xa9,
-0xb7,0x1d,0xea,0x6c,0x49,0x72,0x3d,0xd1,0xd4,0x42,0xff,0x74,
-0x43,0x3b,0x89,0x90,0x85,0xa9,0x42,0x3d,0x68,0x22,0x48,0xb8,
-0xef,0x2e,0x26,0x42,0x6e,0x2e,0x23,0x4e,0xd2,0xc2,0x79,0x48,
-0xcb,0x31,0x7d,0x3c,0xc1,0xa3,0x14,0x7f,0x04,0x63,0x3e,0xd7,
-0x7b,0x2b,0x92,0x3c,0x99,0x7f,0x40,0xa3,0xbd,0xa8,0xa9,0x42,
-0x0a,0xe2,0x6b,0x3e,0xaa,0xe3,0x42,0xaa,0x28,0xb5,0x2f,0x8d,
-0xa4,0x23,0x83,0xb4,0x7d,0xe7,0x6e,0x8f,0xbe,0xe7,0x27,0x62,
-0x7e,0x26,0x54,0x27,0xcb,0x0b,0xd2,0x6d,0xdc,0x45,0x20,0x2f,
-0xcb,0xd7,0x12,0xc8,0x7e,0x2d,0x74,0x03,0x08,0x0a,0x9d,0xe6,
-0xa1,0x98,0x8c,0x3f,0x90,0x08,0x3b,0x92,0x78,0xdb,0x12,0xa9,
-0xce,0x77,0xa3,0x79,0xc6,0x75,0x81,0x09,0xc7,0xa1,0x1c,0x73,
-0x64,0xb0,0xbb,0x0c,0xe1,0x5f,0x17,0xfe,0x25,0x7b,0xb4,0xf3,
-0xca,0x07,0x99,0x6f,0xd1,0xdc,0x66,0x3e,0xd0,0x81,0x72,0x07,
-0xd0,0x0c,0x92,0xa7,0x43,0x54,0xbb,0x26,0x61,0xc0,0x6f,0xa7,
-0xee,0x5f,0xee,0xaf,0xd6,0xc4,0x83,0xd3,0x7c,0x0b,0xd6,0x23,
-0x65,0x35,0x60,0x3d,0x60,0x91,0x70,0x58,0xb6,0x93,0xb1,0x59,
-0xc0,0x7a,0xe3,0x9d,0x4e,0x8b,0x3d,0xc2,0x69,0x17,0x4d,0x8d,
-0xad,0x1a,0xdb,0xa8,0xb1,0xcd,0x1a,0x7b,0x46,0xd5,0xcf,0xce,
-0xaf,0x8e,0x76,0xcd,0xc7,0x88,0x2b,0xf2,0x0c,0x42,0x32,0x1d,
-0x3d,0x01,0x82,0x47,0x2d,0xc1,0x7c,0x45,0xac,0x81,0xbd,0x3d,
-0x1e,0x5f,0x4a,0xcc,0xe6,0x29,0x74,0x33,0x53,0x99,0x2b,0x15,
-0xef,0xcc,0x08,0xb0,0x2d,0xd2,0xba,0x3a,0xad,0x2d,0xd3,0x12,
-0x9d,0xb6,0x2e,0xd3,0x02,0xce,0x87,0x22,0x79,0x83,0xeb,0xda,
-0xc9,0xdf,0x19,0x16,0x03,0x51,0x26,0xa2,0x44,0xe1,0xda,0x9c,
-0xb1,0xe7,0x00,0x1c,0x5f,0x47,0x64,0x99,0x76,0x6f,0x5e,0xa4,
-0xfb,0xff,0xc0,0x6d,0xbb,0x04,0x03,0xfd,0xa5,0x87,0xdc,0x47,
-0x3a,0x71,0x7c,0xa4,0x49,0xa9,0x1f,0xa1,0x36,0xff,0x3a,0x20,
-0xf5,0xbf,0x48,0x80,0x7e,0x7d,0x30,0x7d,0x7d,0xca,0xdb,0x76,
-0x15,0xad,0xe6,0x66,0xb7,0x3f,0xac,0xe6,0x27,0x9d,0xe9,0xfd,
-0x52,0x3c,0xe3,0xe6,0xce,0x1e,0xa1,0x57,0x2a,0x9e,0x42,0x38,
-0x1f,0x1f,0x31,0x7f,0x4c,0x1b,0xb3,0x10,0xb0,0x7e,0x54,0xf7,
-0x77,0xa2,0x89,0x72,0xc8,0xa7,0xeb,0x57,0xfd,0x8c,0x3f,0xa1,
-0x02,0x28,0xdd,0xe3,0x3d,0x18,0xf8,0x4b,0x7a,0x0f,0xb4,0xc5,
-0xa5,0xc6,0xc3,0xee,0x69,0xa8,0x65,0x1c,0xf7,0xaa,0x06,0x37,
-0xea,0xf1,0xbb,0x54,0xc3,0xf8,0x9e,0x37,0x76,0x3e,0x11,0x24,
-0x32,0x94,0x95,0xc5,0x72,0x20,0xc8,0x4d,0x30,0x49,0xd1,0x85,
-0x36,0x10,0x4f,0x22,0x07,0x43,0x47,0x36,0x84,0xbe,0x02,0x11,
-0x7d,0xca,0xa9,0xc3,0xb0,0x8e,0x36,0xc6,0x68,0x20,0x4d,0x8e,
-0xbe,0x45,0xf9,0x78,0x4e,0x89,0x75,0x7a,0xdb,0xfe,0x01,0x7f,
-0xcd,0xb0,0xec,0x29,0xde,0x4e,0x13,0x57,0x8b,0x60,0x8a,0x5f,
-0x3f,0xd4,0xd8,0xec,0x43,0x6e,0x83,0x84,0xd2,0xb7,0x74,0xf1,
-0x0f,0x3f,0xdd,0x47,0xfd,0xec,0x56,0x5c,0x42,0x40,0xff,0x30,
-0xec,0x19,0x9f,0xfa,0x0a,0x8e,0xac,0x2f,0x2a,0x61,0x87,0x79,
-0x2d,0x58,0xc4,0x26,0xd1,0x43,0xe8,0xca,0x97,0x22,0xba,0x72,
-0x10,0xa5,0x5e,0x70,0x9c,0x78,0x09,0x3e,0xb9,0x2d,0x4c,0xe6,
-0x69,0x16,0xf4,0x3e,0x29,0xf3,0x2e,0xdd,0x92,0x4a,0xfa,0xfe,
-0x67,0xa0,0x4e,0xe2,0x7b,0xf1,0x1c,0x8c,0x0f,0xaa,0xbc,0x39,
-0x39,0xd0,0x9a,0x68,0xc6,0xa1,0x17,0x00,0x7d,0x26,0xee,0x5f,
-0x90,0xff,0x5e,0x0e,0x6c,0xee,0xba,0xfd,0x42,0xca,0xd1,0x43,
-0x4e,0x01,0x2e,0xe6,0x9a,0x6c,0xd7,0xbc,0xca,0x1e,0x95,0xff,
-0x80,0x44,0x2b,0x7a,0x40,0x6a,0x87,0x5a,0x68,0x5a,0xb7,0xa1,
-0x60,0x25,0x88,0x46,0x78,0xd4,0xf4,0xe2,0xc4,0x6b,0x70,0x6e,
-0x3a,0x15,0x25,0x25,0x4d,0xc4,0x3b,0x52,0x89,0xc0,0x2e,0x76,
-0x2e,0x79,0x61,0xaa,0xe7,0x56,0x8b,0xc6,0xe0,0x1d,0x40,0x21,
-0xc7,0xc1,0xba,0x30,0x5e,0xf9,0xef,0xd1,0x68,0x04,0xc4,0x2e,
-0x97,0x59,0xb5,0xdc,0x0a,0xf2,0xce,0x0c,0xc5,0xff,0xb2,0xc6,
-0x10,0xc6,0x29,0x33,0x2c,0x03,0x66,0x9e,0x62,0x8d,0x94,0xc5,
-0x13,0x34,0xa3,0x8d,0xe3,0xb1,0x98,0x3a,0x51,0xd8,0x87,0xfd,
-0x92,0x6e,0x7c,0xa1,0x8b,0x21,0x7f,0xba,0xba,0x05,0x0b,0xba,
-0x03,0x49,0x82,0x10,0x8d,0xa1,0xd2,0x50,0xd6,0xcf,0x55,0x6f,
-0x63,0x75,0x07,0xef,0xf5,0x42,0xbc,0xe5,0xa3,0xf9,0x0d,0x12,
-0x65,0xd0,0xf2,0x1e,0x71,0x30,0xea,0xa9,0x81,0x3d,0x9a,0xa2,
-0x33,0x96,0x39,0x30,0x37,0x0a,0x61,0xea,0x99,0xe5,0x00,0xd5,
-0x5a,0x03,0x1f,0x33,0xba,0x0d,0x6c,0x9b,0x0d,0xd0,0x4c,0x13,
-0x2e,0xa0,0x36,0xaf,0xfa,0x59,0xd2,0xee,0x4c,0x01,0xfb,0xbb,
-0x2d,0xee,0xcc,0x6b,0x51,0xf0,0x51,0xa9,0xe6,0x76,0x4a,0x34,
-0xd7,0x56,0x73,0x25,0x47,0xc1,0x0a,0x1f,0x5f,0xee,0xbe,0x61,
-0x12,0x51,0x02,0x38,0xc7,0x5b,0xb7,0x27,0x8c,0x17,0x60,0x9d,
-0x2b,0x07,0x70,0x21,0x9b,0x56,0x52,0xee,0x23,0x63,0x0d,0x0c,
-0x01,0x1b,0x4a,0x10,0x05,0x20,0xdb,0xc6,0xdc,0xa2,0xed,0x97,
-0x83,0x25,0x34,0xf9,0x9a,0xca,0x97,0x32,0xf2,0x21,0xd1,0x0f,
-0xae,0xd1,0xf2,0xe5,0x6e,0x0c,0x6d,0x63,0xda,0xb9,0xb0,0x24,
-0x80,0x79,0x35,0xdb,0x6e,0x4d,0xa7,0x71,0x7f,0xdd,0xf5,0xff,
-0x0f,0x7b,0xdf,0xd2,0xe3,0x46,0x92,0x1c,0x7c,0xef,0x5f,0x51,
-0x12,0x06,0x43,0x12,0x62,0x77,0x93,0x6c,0x3d,0x9b,0x92,0x06,
-0x7a,0xb4,0x76,0x84,0x6d,0x8d,0x7a,0xd4,0xda,0xd1,0xee,0x37,
-0xa3,0x1d,0x55,0x15,0x8b,0xcd,0x1a,0x91,0x2c,0x2e,0xab,0xd8,
-0xcd,0x5a,0x4d,0x0f,0x3e,0xf8,0x60,0x60,0x01,0x63,0x61,0x18,
-0x03,0xdb,0x07,0x1f,0x0c,0xd8,0xbe,0xf9,0x60,0x03,0x06,0x0c,
-0xf8,0x71,0xf1,0x1f,0xf0,0x7f,0x98,0x5f,0xe2,0x8c,0x88,0x7c,
-0x57,0x66,0x91,0xfd,0xd0,0x3c,0x30,0x3b,0xf0,0x5a,0xcd,0xca,
-0xc8,0xc8,0xcc,0xc8,0x88,0xc8,0x88,0xc8,0xcc,0x48,0x87,0x7e,
-0xaa,0x1b,0x04,0x2c,0xd4,0xb5,0xc3,0xd8,0xd1,0x86,0xe1,0x40,
-0xa8,0xb0,0xd4,0x55,0xef,0x39,0xaa,0x57,0xba,0x51,0x45,0x70,
-0x1f,0x30,0xc8,0xfb,0x77,0x5c,0x45,0xaa,0x63,0x86,0x60,0xde,
-0xec,0x1f,0x78,0x4e,0x99,0x48,0x7b,0x24,0xe1,0x06,0xca,0x79,
-0xfd,0x83,0x42,0xb8,0x40,0xf4,0xf8,0xc7,0x1a,0x0e,0xc2,0x0b,
-0xcb,0x41,0x20,0x04,0x97,0xe4,0x25,0x98,0x1e,0xc2,0x9c,0x7a,
-0xc5,0xd4,0x23,0x2e,0x24,0xef,0xc3,0x4d,0xe0,0x4d,0xac,0xe9,
-0x2a,0xb8,0x77,0xdf,0x0b,0x15,0xbd,0x58,0xf3,0x5c,0x1e,0x93,
-0xdd,0x3d,0xd8,0xdd,0x92,0x26,0x1a,0x61,0x10,0x99,0xae,0xc3,
-0x00,0xec,0xc2,0xb1,0x3a,0x83,0xe7,0xf0,0xca,0x0f,0x2f,0x70,
-0xec,0xed,0xd3,0xf5,0xce,0xbb,0x79,0x8e,0xb9,0xd5,0xb6,0xec,
-0x3d,0xdf,0xb6,0xa2,0x4d,0xaa,0xa7,0x0e,0xb5,0x49,0x63,0xcc,
-0x7b,0xba,0xcd,0xe3,0xf4,0xc9,0xa3,0x6d,0x4f,0x88,0x76,0x67,
-0x88,0x42,0x69,0xf3,0x78,0x12,0xce,0xe1,0x88,0xc9,0x26,0xdc,
-0xb9,0x0f,0x8e,0xe1,0xf0,0x12,0x8f,0xa4,0xbc,0x7a,0xf8,0x99,
-0x37,0x16,0xc5,0x26,0x9e,0xe8,0x9b,0x0d,0x87,0x36,0xe1,0xda,
-0x40,0x06,0x06,0x40,0xf2,0x3e,0xb6,0xcd,0xa8,0x1b,0x0c,0xe0,
-0x26,0xfb,0xdf,0x2d,0xf6,0x3f,0x06,0x75,0x9b,0xef,0xce,0x1d,
-0x8d,0x7c,0xbe,0xed,0x2b,0xea,0x20,0xdc,0xc0,0xff,0x8c,0xba,
-0xb7,0xfe,0x38,0x17,0x6a,0x9c,0x13,0xcc,0x93,0x53,0x1d,0xe6,
-0x33,0xdf,0x30,0xcf,0x3b,0xc0,0x0e,0x03,0x38,0xf3,0x20,0x29,
-0x8b,0xcf,0x59,0xc7,0x68,0x6b,0xb9,0x59,0x5f,0x7d,0x9b,0x7d,
-0x10,0x1c,0xf3,0x88,0x08,0x1c,0xb2,0x71,0x47,0x40,0x5e,0x3c,
-0x30,0xe3,0x1f,0xad,0x73,0xaa,0x36,0xf3,0x89,0x4f,0xbe,0x85,
-0x0c,0x67,0x7f,0x2c,0x7c,0xe6,0x4b,0xa0,0x90,0xb9,0x92,0xbf,
-0xc5,0x6a,0xa4,0xdd,0x9e,0xb9,0xc0,0x24,0xb6,0xcb,0xd0,0x85,
-0x31,0x23,0xc9,0xd9,0x54,0xe0,0x01,0x58,0x46,0x6c,0x00,0x40,
-0x91,0x00,0x49,0xd2,0x08,0xb8,0xad,0xcc,0xf3,0xfe,0x3f,0x49,
-0x21,0x75,0x43,0xa0,0xd0,0x02,0x85,0xf7,0x9e,0xbc,0xa0,0x15,
-0xa4,0x67,0x85,0x98,0xcc,0xd3,0xda,0x74,0x99,0x68,0x9c,0x0c,
-0x0b,0x7e,0xa3,0xa8,0x3f,0x07,0x63,0x4c,0xf8,0x93,0x8f,0xf1,
-0xa1,0x5d,0x22,0x47,0x9c,0x31,0xdf,0x2a,0x9d,0xe2,0x2b,0xa3,
-0x4c,0x53,0x84,0xcc,0x37,0xc6,0x76,0xe5,0xac,0x60,0x3b,0x21,
-0xbc,0xdf,0x0b,0x30,0x84,0x20,0x85,0x93,0x44,0x0f,0xa6,0x25,
-0x66,0x67,0x02,0x2c,0xe2,0x01,0x5c,0x38,0xf9,0x90,0x40,0x44,
-0x91,0x39,0x3d,0xd9,0xa2,0xc8,0x61,0x73,0x9b,0x2b,0x71,0xc2,
-0x2b,0xfc,0x73,0x8e,0x1c,0xb6,0xef,0x24,0xa0,0x6a,0x92,0xee,
-0xb4,0x32,0x64,0x47,0xc9,0x34,0x99,0x87,0x98,0x65,0x98,0xf5,
-0x42,0x7a,0x86,0x0a,0x52,0x3f,0x94,0x11,0x08,0x9a,0xc9,0x62,
-0x22,0x06,0xdf,0x1e,0x29,0x18,0x9b,0x16,0x62,0xdf,0x2f,0xcc,
-0x83,0xab,0x6c,0xc9,0xd9,0xcc,0x47,0x59,0x71,0x55,0xe4,0x19,
-0xc2,0x31,0xe9,0x27,0x82,0x0a,0x78,0x31,0x19,0x50,0x88,0x27,
-0x77,0x8d,0xe3,0xe0,0xdc,0x73,0x8d,0xf9,0x49,0x4d,0x41,0x03,
-0xcd,0xa9,0x60,0x5e,0x0c,0x9d,0x5a,0x33,0x26,0x07,0x90,0x89,
-0x03,0x5b,0xe0,0xc2,0x40,0x08,0x62,0x2c,0x9f,0x0b,0xa6,0xc4,
-0x2e,0x29,0xab,0x16,0x01,0x49,0xe8,0xed,0xca,0x2d,0x0c,0xda,
-0xec,0xed,0xbf,0x10,0x83,0x89,0x43,0x71,0xe6,0x2b,0x86,0xa5,
-0x00,0x50,0x40,0x68,0x35,0x5b,0xe4,0x1a,0x71,0xf0,0x41,0x65,
-0xea,0x8b,0xf3,0x01,0x7d,0x64,0x34,0xa2,0xd9,0x19,0xb9,0x37,
-0x67,0x6e,0x91,0xdc,0x94,0x14,0xa8,0x75,0x26,0x44,0x7b,0x67,
-0xef,0xd3,0x97,0x07,0x5a,0x2e,0xbb,0x74,0xc8,0xb7,0x19,0xc3,
-0xe0,0x6a,0xe7,0xaa,0x8a,0x80,0x83,0x4a,0xbb,0x0a,0x67,0x8e,
-0x60,0x8e,0xb9,0x0d,0x99,0x8b,0x64,0x0c,0x6c,0x85,0xc3,0xfd,
-0xac,0x36,0x27,0xd8,0x48,0x06,0x85,0xd4,0x19,0x99,0x64,0x9c,
-0xc6,0x70,0xa4,0x2c,0x54,0xaf,0xcb,0x0a,0xb7,0x05,0x42,0x5f,
-0x98,0x92,0xee,0x64,0x94,0x89,0x2b,0x08,0xfa,0x3b,0xd9,0x09,
-0x73,0x6c,0xd2,0x48,0x44,0x00,0x68,0x1c,0x7a,0xbc,0x87,0xe9,
-0x59,0x28,0xa2,0x33,0x78,0xd0,0xfb,0x29,0x73,0x84,0xe0,0x4a,
-0x33,0x1d,0x59,0xe9,0x29,0x2d,0x33,0x25,0x1d,0x7f,0x77,0x93,
-0x1f,0xde,0x48,0x8b,0xd2,0x55,0x48,0x5e,0x51,0x94,0xea,0x69,
-0xad,0x54,0x69,0x0f,0x9d,0xb5,0x62,0x1e,0x4e,0x73,0x48,0x8f,
-0xb7,0x73,0x7b,0xeb,0xfa,0xdb,0x20,0x0a,0x17,0x03,0x3f,0xb0,
-0x48,0x03,0x59,0x0f,0x1b,0xe3,0xfe,0x0d,0x23,0x69,0x91,0xce,
-0xc6,0xa9,0x1e,0x4b,0x99,0xd2,0x12,0xcc,0x60,0x0e,0x5f,0x1e,
-0x04,0xc3,0x71,0x78,0xe4,0xde,0x18,0x14,0x3b,0xb7,0x8a,0x78,
-0xeb,0x73,0x0a,0xdf,0x70,0x91,0x36,0xb2,0x88,0x37,0xec,0xd1,
-0xcb,0x6c,0xb8,0x70,0x3e,0x78,0xb4,0xe7,0xdc,0xa4,0x12,0x2e,
-0xc0,0x1c,0x4f,0xdf,0xc1,0x8d,0x70,0x21,0x60,0xed,0x00,0x4e,
-0x67,0xcc,0xec,0xe3,0x35,0xdd,0xf3,0x55,0x23,0x13,0x4d,0x09,
-0x4f,0x93,0xd9,0x72,0x71,0xe1,0xb9,0xa2,0x84,0xe3,0xa1,0x41,
-0xf0,0x31,0xac,0x45,0x8c,0xb8,0x6f,0x2d,0x84,0x1f,0x04,0x4b,
-0xea,0xc4,0x13,0x10,0x78,0xe7,0xa2,0xfa,0x44,0x38,0x0d,0xb6,
-0xca,0x0f,0xf0,0x89,0x68,0xae,0xc5,0xe5,0x56,0x16,0x1b,0xec,
-0x22,0xb7,0xd7,0xc9,0x35,0xd6,0xdd,0xcb,0x58,0x06,0x99,0x8a,
-0x1f,0xaf,0xb5,0x69,0x80,0x87,0xed,0xed,0x5d,0x83,0xc2,0xb1,
-0x6b,0x30,0x76,0xec,0x1a,0x44,0x8e,0x5d,0x83,0x1f,0xe7,0x96,
-0x81,0xd8,0x2c,0xe8,0xbc,0x6e,0x07,0x87,0x05,0xdc,0x48,0xdf,
-0x02,0xb6,0x84,0x8d,0xb7,0x47,0x90,0x72,0x25,0x1e,0xb5,0x2e,
-0xb6,0x8b,0xd0,0xad,0xdf,0x45,0xd8,0x79,0xed,0xba,0x14,0xb6,
-0x60,0xa6,0xc6,0xef,0x0d,0x53,0x43,0xbc,0x55,0x4f,0x31,0x13,
-0x50,0xb9,0x4d,0x5a,0x6d,0x5a,0x75,0x67,0x19,0xac,0x73,0xc8,
-0xae,0x0d,0x50,0x81,0x58,0x86,0xed,0xeb,0xf7,0xfa,0x39,0x74,
-0xcd,0xa1,0x39,0x0b,0x04,0xfb,0x02,0x9e,0x23,0xad,0x93,0x78,
-0xe2,0x78,0x6a,0x9f,0xd2,0x74,0x9e,0x78,0xe6,0x87,0xe6,0x2b,
-0x46,0x50,0xb0,0x98,0xa6,0x74,0x8a,0x82,0xaf,0xc8,0xc2,0xe0,
-0x00,0xfc,0xb5,0x07,0x0b,0xfd,0x47,0x3b,0x16,0x52,0xc3,0x9a,
-0x8f,0xf7,0x8b,0xdb,0x3e,0xb4,0xa3,0xc7,0xe5,0x97,0x2d,0xe7,
-0x7a,0x50,0x7e,0x21,0x35,0xf8,0x00,0x1f,0x45,0x0f,0x66,0xa3,
-0x32,0xc7,0x47,0x7d,0xed,0xf0,0xfd,0x82,0x88,0x04,0xba,0xde,
-0x46,0xe6,0x5d,0xfb,0x39,0x39,0xd5,0xbc,0xd7,0xc8,0xec,0x71,
-0x38,0xd6,0x85,0x16,0x9e,0x5b,0xef,0x6f,0xc8,0x8c,0x3c,0x66,
-0x2a,0x90,0x63,0xca,0xb6,0xcc,0xcb,0x98,0x47,0x2c,0xe6,0x8d,
-0x17,0x79,0x9d,0x8e,0x0f,0x24,0x67,0xe2,0x26,0xb9,0x53,0x21,
-0xee,0x5d,0xc2,0x36,0xeb,0x65,0x68,0x3b,0xdc,0x5c,0xff,0x7e,
-0xf7,0x48,0x9d,0x9a,0x4d,0x5e,0x60,0xc2,0x52,0x54,0xad,0xa4,
-0xb9,0xb0,0x83,0xb0,0xe6,0x36,0x5b,0xfc,0xde,0x92,0x7c,0x16,
-0xfe,0xa3,0xef,0x5f,0x1b,0x42,0xff,0x2e,0xa0,0xea,0xce,0xb8,
-0x61,0x7a,0x30,0x61,0x23,0x7e,0x27,0xdc,0x75,0xb4,0x3e,0x04,
-0x0f,0x72,0x2e,0xa5,0x30,0xe1,0xde,0x1a,0x2a,0xce,0xb1,0x4f,
-0xa8,0x6f,0x11,0x72,0x87,0xc2,0xde,0x27,0x24,0x0d,0x98,0x4d,
-0xe9,0x5c,0x20,0x9c,0xb8,0x47,0x43,0x64,0x39,0x43,0x63,0x35,
-0x60,0xe6,0xa8,0x7c,0x44,0x85,0x9b,0xcb,0x9f,0xee,0x1f,0x28,
-0xbd,0xa8,0xfd,0x27,0x53,0xe6,0x4a,0xe5,0x89,0x37,0x4b,0xc3,
-0x71,0x9e,0x81,0x1f,0x20,0x1d,0x00,0xa7,0x87,0xe5,0x52,0xb4,
-0xa4,0xcd,0x44,0x92,0x21,0xbc,0xa4,0x8d,0x26,0x27,0x0e,0xce,
-0x79,0xce,0x7e,0x90,0xf1,0xd3,0x93,0xeb,0x57,0xdc,0x71,0x34,
-0xb5,0x98,0xf9,0xe1,0xaf,0xfb,0x1b,0xb2,0xab,0xb9,0x63,0x1e,
-0x7c,0x7e,0x55,0x3e,0xa2,0x33,0x06,0x3c,0x3e,0x30,0xf9,0x05,
-0x6c,0xea,0x1a,0x2d,0x74,0x78,0x61,0x35,0xe4,0xb5,0x2b,0x59,
-0xcb,0x7b,0x6b,0xe9,0x16,0x7b,0x71,0x6f,0x04,0x5f,0x8b,0xa0,
-0x34,0x79,0x66,0x82,0xe5,0xe5,0xbb,0xed,0x36,0x9f,0xd5,0x1f,
-0x91,0x77,0x31,0x75,0x9b,0xf1,0x90,0xb9,0x8c,0x49,0x6f,0x45,
-0x06,0x5f,0xe1,0xe8,0xdf,0x8b,0x03,0x73,0x05,0x15,0x6b,0xe8,
-0xd6,0x06,0xfd,0x66,0xae,0x71,0xd5,0xec,0x18,0x31,0xb7,0x3c,
-0x82,0x7d,0x26,0xb1,0xbe,0x43,0x4a,0x68,0xee,0xf9,0xb6,0xe5,
-0xfe,0xc0,0x78,0x2c,0x78,0x9c,0xc4,0x8a,0xdf,0x93,0xe2,0xad,
-0x9a,0x58,0xc5,0x35,0x03,0xce,0x50,0xe0,0x7c,0x32,0xb1,0xa1,
-0xfa,0x2a,0xb8,0xa0,0x92,0x32,0x33,0x56,0x83,0xc9,0x44,0xd6,
-0xa6,0xa8,0x00,0x3f,0xe5,0x5f,0xb2,0xce,0x1d,0x27,0xd8,0x3b,
-0x3d,0xe4,0xac,0xb7,0xce,0xb4,0x09,0x86,0xe7,0x30,0x33,0xe8,
-0x8a,0xa8,0x08,0xe1,0x70,0x06,0x5c,0xda,0xd0,0xa2,0xfd,0x31,
-0x57,0xcd,0x8b,0x96,0x09,0x85,0x6a,0x7e,0xef,0xc9,0x0b,0x41,
-0x5c,0xda,0xd3,0x05,0xa6,0x48,0xb4,0x08,0x53,0x1f,0x1c,0x06,
-0x08,0xe5,0x05,0x1f,0xb2,0x7a,0x1b,0xee,0xc0,0x11,0x0e,0xba,
-0x4f,0xd4,0xe8,0xc3,0xb5,0xfe,0x18,0x2f,0xa0,0xf6,0x21,0x5e,
-0xf6,0xba,0x8e,0x6b,0xb0,0xa2,0xe2,0x96,0x44,0xaa,0x40,0x41,
-0x85,0xc5,0x34,0x3c,0x0e,0xd3,0x31,0x2e,0xb2,0xe8,0x24,0xd3,
-0x05,0x22,0xcd,0x1b,0xcf,0x21,0x55,0x98,0x81,0x41,0xe8,0x2b,
-0x62,0xe7,0x4d,0xce,0x02,0x22,0xc1,0x2a,0x8d,0x1b,0xf8,0xd9,
-0xac,0x45,0x3a,0x0b,0xc2,0x5f,0xba,0xaa,0x32,0x61,0x76,0x2a,
-0x30,0xba,0x00,0x27,0x52,0x21,0x4d,0xd2,0xc1,0x80,0x75,0xd8,
-0x8b,0xe7,0x86,0x03,0xca,0xc6,0x44,0xe7,0x1f,0xe6,0xe4,0xf9,
-0xfb,0x10,0xdd,0xaa,0x02,0xd9,0x78,0x28,0xee,0xfb,0xec,0xba,
-0x1f,0xc9,0x1d,0x0b,0xc2,0xc6,0xd0,0xb5,0xe6,0x44,0x84,0xde,
-0x6c,0x76,0xe3,0xb5,0xde,0xbc,0x21,0x3c,0x8d,0x86,0x79,0x4d,
-0x2a,0x84,0x00,0xc6,0x24,0xcc,0xdf,0x06,0xf0,0xd0,0x52,0x4c,
-0x61,0x1a,0xba,0x7d,0x42,0x15,0xb4,0x9c,0x11,0x81,0xb8,0xcf,
-0xa8,0x78,0x23,0x92,0x06,0xf1,0x34,0x93,0x15,0xcc,0xc1,0x44,
-0x8c,0x47,0xc9,0xee,0xad,0x21,0x1b,0x00,0x91,0xc9,0x5b,0x37,
-0x4b,0x00,0x75,0x1d,0xa1,0xfc,0x1c,0x01,0x30,0xb7,0x11,0xc6,
-0x49,0xdd,0x37,0x6f,0x98,0x24,0x30,0x22,0x80,0x6a,0x78,0xf3,
-0x86,0x24,0x42,0xa7,0x89,0x3a,0x6b,0x65,0x85,0x53,0xb5,0xb3,
-0x2c,0x76,0x78,0x50,0x9c,0x98,0xd7,0x77,0x3d,0xdb,0xfc,0x19,
-0xa6,0x01,0xc4,0x27,0x1f,0x1c,0x3e,0x7a,0xfa,0x34,0xf0,0xa4,
-0x4f,0x00,0xa7,0xe6,0xcd,0x1b,0x10,0x4a,0x7b,0x6e,0x60,0xf9,
-0x34,0x6e,0x54,0xb5,0xf9,0xee,0x2e,0x45,0x14,0xcd,0xe0,0x63,
-0x5d,0xa4,0x87,0x2b,0x52,0xb9,0x76,0xac,0xb5,0x08,0x05,0x13,
-0xd8,0x27,0x39,0x85,0xdf,0x4f,0xf1,0x3e,0x0e,0xfb,0x94,0xf3,
-0x4b,0xec,0xf0,0x7c,0x8c,0x95,0xe2,0x80,0x89,0xef,0xd3,0x47,
-0xae,0xf0,0xc6,0x65,0x18,0xe8,0x74,0x21,0x88,0xda,0x36,0x0c,
-0x82,0x9a,0xeb,0xe8,0x9a,0x75,0x5e,0x4d,0x16,0x00,0xb7,0x71,
-0xf4,0x74,0x01,0x1e,0x33,0x5b,0xb3,0xb2,0x09,0x38,0x75,0x26,
-0x0c,0x78,0x67,0x1a,0xd0,0xaa,0xb9,0x9a,0x74,0xad,0x64,0x89,
-0xa7,0xaf,0x8d,0x4c,0x34,0x4b,0x30,0xde,0x31,0xf1,0x4c,0x3c,
-0x92,0xa9,0xc9,0x4c,0xf0,0x99,0xc8,0xe0,0xa0,0xd9,0xdf,0x15,
-0xe3,0xbb,0x3a,0x8f,0xdf,0xc0,0x6f,0x9e,0x13,0x7d,0xd5,0x3c,
-0x3e,0xb6,0xe7,0xf1,0xb2,0xa6,0x91,0xf2,0x00,0xfc,0x0c,0xa6,
-0xb1,0xad,0xa5,0x9d,0xb3,0xa6,0x6f,0x91,0x8f,0x9a,0x72,0x72,
-0x57,0xcc,0x20,0x25,0x00,0x3b,0xc0,0xf4,0x6d,0xdb,0x64,0xcb,
-0x6e,0x7f,0x96,0xe6,0x8b,0x70,0xcc,0x7e,0x85,0x73,0x36,0x64,
-0xdc,0x07,0xa6,0xb4,0x60,0xce,0xd0,0x00,0x1b,0xf4,0x01,0x4f,
-0x93,0x6b,0x53,0x5b,0x4b,0x0d,0x67,0x3c,0x46,0x09,0x2d,0xbb,
-0x6e,0x34,0x24,0x78,0x9e,0x74,0x5d,0x5c,0xfc,0x9a,0x9c,0x07,
-0x19,0x76,0x8c,0x3b,0x73,0x6e,0x64,0x5f,0x32,0xeb,0x5c,0x3d,
-0xe2,0x65,0xbd,0xaf,0x65,0xbd,0xab,0xe5,0x79,0x9c,0xcb,0xf3,
-0xa4,0x97,0x7e,0xf3,0x70,0xb7,0x7a,0x19,0xb1,0x2d,0x7d,0x66,
-0xf9,0x72,0x55,0x36,0x2b,0x29,0x29,0x79,0x53,0xcd,0x65,0x8b,
-0xe0,0x4e,0xe6,0x69,0x21,0xda,0xc0,0xbf,0x37,0xf8,0xb3,0x56,
-0xea,0x8b,0x35,0x40,0x55,0x4a,0x2e,0x82,0xf5,0x10,0x28,0x96,
-0x1c,0xe3,0x1c,0x3b,0x2f,0x39,0xd6,0xde,0x9b,0x14,0x29,0x10,
-0x39,0x71,0xf8,0xd0,0x5b,0xf5,0x73,0x5a,0x3b,0x0d,0xf2,0x16,
-0x22,0xce,0x87,0x96,0x4e,0xaf,0x34,0x0b,0x4a,0x55,0xa0,0x67,
-0xc8,0xe4,0x85,0x22,0x41,0xa6,0x26,0xc0,0x26,0x80,0xc8,0xb5,
-0xe9,0x1a,0xa2,0x06,0xa7,0x97,0x48,0x70,0x23,0xcd,0x27,0xc1,
-0xc9,0x2c,0x9f,0xc6,0x2c,0x68,0x00,0xf8,0x09,0x00,0xf4,0xcc,
-0x24,0x58,0xe4,0x9e,0x1d,0x93,0xcc,0x35,0xd3,0x53,0x93,0x84,
-0xb2,0x4e,0x14,0x48,0xa8,0xeb,0x44,0x01,0xa4,0x4b,0x42,0xd5,
-0xb0,0xa5,0xd5,0xff,0x97,0xc9,0xb2,0x90,0x3a,0xc9,0xf8,0x97,
-0xe6,0x49,0xe4,0xce,0x71,0x7e,0x6c,0xb9,0x47,0xbc,0x5a,0x4d,
-0xd4,0x0e,0xc7,0x31,0x5f,0x72,0x6c,0xce,0x29,0xa9,0x29,0xa6,
-0x41,0x26,0x83,0xf7,0x38,0x35,0x5c,0xd1,0x6a,0x63,0x01,0x6b,
-0x52,0x1b,0x0f,0x83,0x9a,0x83,0x34,0x50,0x26,0x64,0x4e,0x7b,
-0xa8,0xe3,0x92,0x6c,0x2a,0xe1,0x19,0xf1,0x00,0x51,0xbf,0x32,
-0xcb,0xb2,0xc1,0x75,0x66,0xd9,0xaa,0xe5,0xc8,0x7b,0x69,0x41,
-0xe8,0x19,0x30,0xf9,0x92,0x1b,0x19,0xf7,0x94,0x0d,0x16,0xd0,
-0x2f,0x2d,0xe3,0xba,0x08,0xf0,0x94,0x94,0x1e,0x97,0x44,0x45,
-0x00,0x5a,0x19,0x78,0xfe,0x7a,0x63,0xa1,0xe4,0xa1,0x63,0x5a,
-0x01,0x79,0x56,0x54,0xda,0x4a,0x61,0x78,0x9a,0xfa,0xdd,0x67,
-0x66,0xb9,0x7f,0xd3,0x59,0x76,0x87,0xc3,0x56,0xf0,0x75,0x70,
-0xbd,0x5f,0x5b,0xbb,0xfb,0x5a,0x74,0x58,0x6b,0x9e,0x15,0xd8,
-0x89,0xfe,0xb4,0x3a,0x60,0x1f,0xf0,0x35,0xb9,0xa6,0xd9,0xb6,
-0xbe,0x6c,0x9b,0xb8,0xb1,0x84,0x92,0x16,0x6d,0x54,0xf4,0x60,
-0xe5,0x7e,0xf7,0xd2,0xd1,0x41,0x41,0x9f,0x0d,0xa7,0xc6,0x16,
-0x28,0xd6,0x66,0x50,0xae,0xbf,0x6d,0x06,0xd5,0xb3,0xa1,0xea,
-0x9c,0xc8,0xe5,0x61,0x43,0x4b,0x0d,0x6b,0x71,0x47,0x35,0xc5,
-0x62,0x45,0x50,0x09,0x50,0x23,0xf3,0xd2,0x03,0xf2,0x6b,0x0d,
-0xa6,0xf4,0xc0,0xf0,0xa4,0xbe,0x4e,0x91,0xd7,0x1b,0xaa,0x01,
-0xf8,0xf5,0x4a,0x88,0xdf,0x98,0x33,0x76,0x31,0x92,0x2b,0x79,
-0xd4,0x29,0x4e,0x52,0x29,0x8d,0x58,0x41,0x39,0xfa,0x57,0x24,
-0xc9,0xc5,0x5f,0xdc,0x00,0x85,0x7c,0x41,0x8c,0x1d,0x5f,0xab,
-0xbd,0x4c,0xa8,0xc7,0xaf,0xfa,0x97,0x60,0x6c,0x62,0x96,0x4a,
-0x21,0x4e,0xa5,0x12,0x27,0x56,0xf3,0xf3,0xf2,0x35,0xaf,0x2c,
-0xed,0x55,0xa8,0x4d,0x29,0x77,0xd9,0x3f,0xbc,0x36,0x03,0x93,
-0x08,0x96,0xba,0xe1,0x4a,0x28,0x3e,0x5f,0xca,0x9d,0xcd,0x9c,
-0x7e,0xe2,0xee,0xa6,0xfe,0xbb,0x7a,0x35,0x8a,0x0e,0xe8,0x03,
-0x06,0x2f,0x85,0x8e,0xe0,0xda,0xf1,0xac,0x84,0x95,0x07,0xcf,
-0xb5,0x6b,0x64,0x82,0xc3,0xee,0xda,0x5e,0x8a,0x82,0xa0,0x69,
-0x8b,0xb5,0x6a,0x9c,0x4e,0x83,0x2c,0x5e,0x4c,0x68,0x53,0x9e,
-0x44,0x96,0xff,0xee,0xab,0x17,0x2c,0x78,0x05,0xc9,0xba,0x0a,
-0xab,0x00,0xde,0x8a,0xf1,0xbc,0xd0,0x1e,0x65,0xb0,0x6f,0x36,
-0x04,0x88,0x78,0x24,0x40,0xfc,0xe6,0xb9,0xed,0x67,0xca,0x4d,
-0x6e,0x84,0x51,0xce,0xbc,0x95,0x22,0x69,0x38,0x21,0x31,0x0a,
-0xc1,0xa0,0x36,0x77,0x7a,0x9d,0x4e,0x67,0xb6,0x74,0x43,0x15,
-0x98,0x1d,0x62,0x05,0x10,0x9d,0xac,0x67,0x60,0x5e,0x08,0x7e,
-0x0a,0xbf,0x0e,0x24,0x9b,0x85,0x31,0xe4,0x9f,0x04,0x18,0x37,
-0x04,0xbc,0x96,0x70,0x84,0x39,0x32,0x98,0x17,0x46,0x09,0xfc,
-0x31,0xe8,0xcb,0x7c,0x20,0x46,0x1a,0x4f,0x1d,0xbc,0xb2,0x23,
-0xee,0xe7,0x36,0xa6,0xd9,0xd4,0x43,0x0e,0xc6,0x15,0xc0,0x3d,
-0x36,0x24,0xc9,0xa7,0x98,0x0b,0xc6,0x1e,0x7c,0x22,0xf2,0x87,
-0xe5,0xcb,0xf0,0xe8,0x93,0x70,0x92,0x34,0x1b,0x51,0x36,0x28,
-0x1b,0x2d,0xc6,0x80,0x90,0x73,0x23,0x61,0xbd,0x63,0xae,0xd9,
-0xa0,0x29,0xe7,0x96,0x23,0xa9,0xb2,0x09,0xf0,0x05,0xff,0xb3,
-0x6f,0xf1,0xa8,0xfa,0xce,0xbd,0x61,0xf2,0x60,0x9f,0xc3,0x36,
-0xce,0x49,0x36,0x7f,0x4b,0xf1,0xce,0xd9,0x3c,0x9d,0x84,0xf3,
-0x52,0x7b,0x89,0x8b,0xfd,0xdf,0xaf,0xbb,0x5d,0x0a,0x5d,0x64,
-0xd3,0x4d,0xf6,0x37,0xe6,0xa3,0xc9,0xe1,0xe1,0xc9,0xc5,0x78,
-0x40,0x4f,0xeb,0x15,0xf3,0xf1,0xe6,0xa3,0x20,0x9d,0xe2,0x1d,
-0x67,0xef,0x41,0x42,0xe8,0xa5,0x9f,0xff,0x59,0x93,0x43,0xce,
-0xd7,0x9c,0xdb,0x6d,0x89,0xb0,0x44,0xa9,0xd9,0x52,0x0b,0x47,
-0x32,0x49,0x19,0x27,0x43,0x23,0x0d,0xaa,0xc7,0xcb,0xc4,0x8c,
-0xe0,0x1b,0x0b,0x7c,0x1f,0x4e,0x7c,0x83,0x3f,0xe0,0x99,0x2b,
-0x2e,0x4f,0xec,0x97,0x51,0x4c,0x97,0x7b,0x1d,0x05,0x90,0x6f,
-0x5c,0x90,0x87,0x1c,0xd4,0x0e,0xb5,0xc9,0xd5,0x0b,0x35,0x8d,
-0xe7,0x8e,0x27,0x09,0x63,0x82,0xa6,0xb5,0x12,0x05,0x38,0x54,
-0xf9,0x82,0x84,0xd6,0x35,0x5e,0xa2,0x7d,0x39,0x6d,0xd7,0x69,
-0x5f,0x65,0xd4,0xea,0x64,0x5d,0x32,0xf5,0xbd,0xec,0xb5,0x83,
-0x92,0xfd,0x5b,0xf6,0x14,0x81,0xb3,0xa5,0xc8,0x1f,0x99,0x2d,
-0x7b,0xe2,0xaf,0x52,0x7e,0x2b,0xc5,0xb7,0x62,0x32,0xe3,0x7f,
-0x2d,0xf9,0xbf,0xa5,0xf8,0x3d,0xe6,0x7f,0x84,0x98,0x9a,0xc5,
-0x58,0x39,0x85,0xed,0x29,0x15,0xf3,0xb2,0x2b,0x35,0x99,0x28,
-0xdb,0x5a,0x76,0xfb,0xbc,0xb0,0xe7,0x28,0xec,0xf1,0xc2,0xd2,
-0x51,0xb3,0x14,0x35,0x4b,0x47,0xcd,0xb2,0xc7,0x25,0x02,0xba,
-0x03,0x10,0x77,0x01,0x89,0x16,0x9a,0x98,0x80,0xca,0xc9,0x44,
-0x03,0xa2,0xfd,0x4c,0x74,0x47,0xf6,0x76,0x22,0x9f,0x10,0xe0,
-0x55,0x4a,0x55,0x05,0x1b,0xce,0x4a,0x55,0xa5,0x34,0xaa,0x9c,
-0x6a,0x3d,0x58,0x62,0x0f,0x18,0xca,0x0f,0x3f,0x24,0xb0,0x7b,
-0x88,0xea,0x02,0x1d,0x3a,0xd5,0x1e,0x3d,0x2a,0x79,0x3f,0x60,
-0x61,0xa4,0x2e,0xea,0x0b,0x62,0x10,0xc8,0x5c,0xf3,0xf8,0x43,
-0x73,0x90,0xc6,0xd2,0x22,0x13,0x3d,0x2d,0x79,0xd7,0xba,0xfa,
-0xcb,0x04,0x4b,0xb3,0x27,0xa7,0x0e,0xf8,0x9e,0x01,0x3f,0x36,
-0xc7,0x22,0x2a,0xf0,0x5d,0xf8,0x25,0xf4,0x72,0x39,0xb6,0x16,
-0x5d,0x8d,0x75,0xb4,0x25,0x76,0x2b,0x63,0x1a,0xe5,0x0a,0xe5,
-0xf1,0xb1,0x1f,0x4b,0xb0,0x61,0xc9,0x62,0x76,0x61,0xe8,0x1b,
-0xf5,0x74,0x53,0xa8,0x06,0x30,0xd4,0x92,0x0f,0xd5,0x80,0xad,
-0x89,0xcd,0x2e,0x0f,0xe4,0x3d,0xeb,0xca,0x30,0xa4,0x55,0xa1,
-0xd3,0xee,0x54,0x9f,0xf5,0x3a,0x79,0xf0,0x4b,0x19,0x56,0xc6,
-0xaa,0xcf,0xc2,0x62,0x04,0xd1,0xb4,0x26,0x68,0x84,0x0e,0xea,
-0x15,0xed,0x7b,0x3a,0xc5,0xef,0x7e,0x6f,0x87,0xf4,0x19,0xb2,
-0xbf,0xc2,0xd4,0x93,0x98,0x7a,0x06,0xa6,0xde,0x6a,0x4c,0x66,
-0x6f,0x21,0xa8,0xc5,0x46,0xb1,0x1b,0x90,0xda,0xda,0xe5,0xaa,
-0x6b,0x97,0xab,0xaf,0x5d,0x68,0xe0,0x54,0xea,0x1a,0x94,0x6d,
-0xc5,0xae,0x24,0x47,0x82,0xf5,0x50,0x86,0x96,0x06,0x61,0x84,
-0xfc,0x10,0xa0,0x90,0x66,0xec,0xb3,0xa0,0xa0,0x2e,0xc6,0xf2,
-0x25,0x30,0x94,0x60,0x12,0x60,0x2e,0xbf,0x8a,0xe7,0xd7,0x6c,
-0xf4,0x54,0xda,0xb2,0x25,0xb5,0x46,0xf2,0x6a,0x89,0xab,0x26,
-0xac,0x3e,0x51,0x55,0x82,0xa7,0xcb,0xe9,0x52,0x6b,0xf6,0xd4,
-0x86,0xd3,0xe4,0x13,0xb1,0x8a,0xce,0x9e,0x6e,0xac,0x14,0xcc,
-0xaa,0xa0,0xa1,0x50,0x56,0x25,0x83,0xa7,0xb8,0xf5,0x0b,0xe7,
-0x87,0xf7,0xb8,0x23,0x59,0x0f,0xf6,0x35,0x73,0x7b,0x11,0x2c,
-0xb8,0x7b,0x37,0xb8,0xa3,0xf9,0xba,0x5e,0x99,0xd4,0x5a,0x76,
-0xc9,0x99,0x14,0xa6,0x66,0x68,0xbb,0xb3,0x4d,0xbb,0xa5,0x96,
-0x7a,0xa7,0xdf,0x21,0x98,0xbc,0xcc,0xdb,0x1a,0xa7,0x4c,0xc8,
-0x13,0x95,0x69,0x8e,0x01,0x32,0x55,0x09,0x19,0xb8,0x94,0x34,
-0x48,0x69,0x29,0x7b,0xd6,0xf7,0xb3,0x0b,0xea,0x85,0x64,0xd3,
-0xac,0xcc,0x67,0x45,0xf8,0x81,0xdc,0x6a,0xb8,0x40,0x9c,0xe8,
-0x68,0x1e,0x46,0x6b,0xdb,0x24,0xe8,0xf8,0x35,0x1a,0xdc,0xae,
-0x88,0x16,0x43,0xfd,0x67,0x3c,0x5a,0x65,0x88,0xa0,0xac,0xfd,
-0x49,0x37,0x7c,0x4f,0xba,0x41,0xc5,0xe1,0x4c,0x39,0xd1,0x4d,
-0x0a,0x80,0x81,0x27,0x08,0x83,0x86,0xbe,0x80,0xc3,0xc4,0x5e,
-0x53,0x47,0xe5,0x10,0x19,0x33,0xbd,0xd3,0xa9,0x7a,0x7d,0x4b,
-0xb7,0x33,0x18,0xb8,0x5e,0x1b,0xb8,0x84,0xd5,0x66,0x5f,0xfb,
-0x06,0x46,0xfd,0xbd,0x35,0x51,0x9d,0xc3,0xaa,0x96,0x00,0x5f,
-0x9a,0xbf,0x4a,0xe9,0x58,0x72,0x0b,0x46,0xa4,0x0f,0xd8,0xc4,
-0xc3,0x6b,0x37,0xbe,0x98,0x36,0xe4,0x3c,0xc1,0x8e,0xef,0x30,
-0x38,0x49,0x1a,0xf3,0x04,0xf7,0xa0,0x79,0x52,0x78,0x38,0x79,
-0xcf,0x37,0xc2,0x11,0x06,0x48,0x02,0x1e,0x3a,0xec,0x04,0x86,
-0x03,0x38,0xc2,0x31,0x4d,0x4e,0x28,0xd1,0x13,0x27,0x2b,0x4e,
-0x0b,0x08,0x01,0xb1,0x1b,0x86,0x26,0xe4,0x9c,0x1a,0xa4,0x76,
-0xd9,0x46,0x10,0xe3,0xbb,0x62,0x53,0x96,0xe4,0x87,0xfd,0xff,
-0xad,0x1c,0xf7,0xdb,0x98,0x94,0x6e,0xaa,0xbd,0xb6,0xca,0xcb,
-0x4d,0x1b,0x6b,0x85,0x2c,0xde,0x26,0x65,0x75,0x67,0x2b,0x39,
-0x6e,0x43,0xc2,0x55,0xf5,0x96,0x12,0x64,0x5f,0xc5,0x99,0x7e,
-0xdb,0x80,0x98,0x8e,0xfc,0xf9,0x61,0xc3,0x08,0x9b,0x0d,0x12,
-0x78,0x3c,0xa3,0xe4,0xee,0x8c,0xca,0x6e,0x2e,0xe1,0x67,0x66,
-0xf5,0xd7,0x66,0x75,0x72,0xec,0xc4,0x39,0x19,0x7c,0x84,0xb4,
-0xe1,0x45,0x15,0xd7,0xd5,0xa5,0xa8,0x87,0xb3,0xf2,0x7d,0x8c,
-0x10,0x80,0x40,0xc3,0x2f,0xc6,0xf9,0x8d,0x3b,0x12,0x13,0x22,
-0x0f,0xae,0xc1,0x3f,0x86,0xd4,0x5d,0xf9,0x06,0xa9,0x41,0xc5,
-0x77,0xfa,0xbe,0x56,0x61,0x9b,0xb5,0x41,0x94,0xf3,0xf5,0x7a,
-0x5a,0xd7,0x6b,0xdc,0x60,0x86,0x87,0x81,0xfc,0xa3,0x3e,0x58,
-0x59,0x5f,0xe4,0xa6,0xf2,0xe3,0xd8,0xad,0xa5,0x5c,0x36,0x99,
-0xc0,0xce,0x37,0xdc,0x53,0xf6,0xa3,0xf8,0xdc,0x42,0xa1,0xf6,
-0x34,0xf5,0x27,0x16,0xdc,0xec,0x56,0xdd,0x74,0x33,0xd8,0x8d,
-0x62,0xb7,0xc6,0x33,0x65,0x1b,0x9a,0x90,0x68,0x51,0x5d,0x9d,
-0x93,0xa6,0x26,0x63,0x7d,0x22,0xfb,0x27,0x22,0x22,0x50,0x17,
-0x1b,0x87,0xea,0xb2,0x45,0x43,0xd7,0xcb,0xda,0x5f,0x2c,0x3b,
-0xd7,0x01,0x01,0x48,0x7a,0x0c,0xe1,0x8e,0x01,0xa2,0x12,0x61,
-0x4a,0xc7,0x76,0x51,0xdf,0x94,0x64,0xbe,0x11,0x78,0x4f,0xdf,
-0x48,0xd7,0xad,0xae,0xe0,0x59,0x3a,0x49,0xe3,0xe0,0x38,0x9d,
-0x04,0x51,0x32,0x0a,0xd9,0x7c,0xcd,0x75,0xab,0xa3,0xd4,0x57,
-0x72,0xfe,0xe5,0x5a,0x60,0x46,0x6d,0x5b,0xc1,0x76,0xd0,0x63,
-0x56,0x8d,0xf7,0xc9,0xb7,0x55,0x0b,0x3a,0x2a,0x0a,0x9a,0xda,
-0x77,0x7a,0x15,0xfe,0x70,0x11,0x1b,0x40,0xd3,0xd3,0x62,0xcb,
-0x5e,0x6c,0xac,0xed,0x27,0xeb,0x98,0x40,0xcd,0x6e,0x5c,0xcd,
-0xde,0x9b,0xc0,0xef,0x78,0xb9,0x57,0x9b,0xa7,0xee,0x0d,0x63,
-0x9e,0x16,0xe7,0x9e,0xa7,0xce,0xb9,0xa6,0x87,0x19,0x60,0xfc,
-0xcb,0xa6,0x7f,0x7a,0x3a,0x97,0x39,0x25,0x9b,0x3f,0xfe,0x39,
-0xe9,0xdc,0x34,0xe6,0x64,0xb8,0xde,0x9c,0xd8,0x03,0x75,0xd1,
-0xe6,0x07,0x1e,0x57,0xcf,0x18,0x57,0x74,0xbe,0x71,0xd9,0x13,
-0xf8,0x23,0x18,0x9a,0xb5,0xa6,0x33,0xa9,0x8a,0x3e,0x7f,0x60,
-0xbc,0xd2,0xbd,0x7a,0x84,0xe5,0xe6,0xa6,0x2d,0x5b,0xcc,0xe0,
-0xe9,0x58,0x63,0x28,0xf5,0x68,0x55,0x85,0x32,0xdd,0xef,0x8b,
-0x89,0x1d,0x22,0xe6,0x3e,0x3e,0x02,0x47,0xd2,0xd6,0x26,0xe3,
-0x57,0x0e,0x32,0x3e,0x3c,0x2b,0x19,0x85,0xbd,0xaa,0x91,0xf1,
-0xbe,0xb6,0xcb,0xea,0xa0,0xa7,0xc1,0x4e,0x3e,0xda,0xfe,0x78,
-0x48,0xab,0xed,0x38,0xae,0xcf,0xa1,0x23,0x07,0x69,0x1f,0x1b,
-0xa4,0x95,0x3b,0xb1,0x4b,0x8d,0x9a,0xcb,0x0a,0x53,0x2e,0x1d,
-0x4c,0xa9,0x79,0x5e,0xe7,0x20,0xcf,0x79,0xcf,0x96,0x9c,0x85,
-0x0d,0xd7,0xa6,0xd3,0xd8,0x41,0xa7,0x47,0x6b,0xd0,0xa9,0xc2,
-0x75,0x4b,0xc9,0x75,0xb1,0xf1,0x86,0xbb,0x24,0x98,0xc3,0x3d,
-0xfd,0xa9,0x13,0xef,0xd8,0x24,0x9e,0xf2,0xbc,0x68,0xaf,0xb5,
-0x76,0x4c,0xda,0x49,0xa6,0x66,0x4d,0x0f,0xb5,0x13,0x42,0xcd,
-0xb5,0xfb,0x55,0x36,0x2a,0x9e,0xa2,0xab,0x1f,0x62,0x5b,0x59,
-0x6e,0xa0,0xf1,0xc8,0x4c,0x93,0x97,0xdb,0xb1,0xd8,0xad,0xa5,
-0x90,0x43,0x7d,0x57,0xa6,0xed,0x83,0x2e,0xab,0xd0,0x3c,0x72,
-0x24,0x81,0xc5,0xb6,0x5f,0x93,0xef,0xc9,0xd5,0x0f,0x5c,0x5d,
-0x9d,0xd3,0x8e,0xe2,0xad,0x4f,0x95,0xdf,0x55,0x59,0x7d,0x3d,
-0x3a,0x79,0x27,0xc2,0x37,0x5f,0x67,0xed,0xd9,0x89,0xd9,0xb3,
-0x57,0x86,0xfc,0x65,0xb6,0x00,0xe2,0x47,0xb5,0x30,0xe8,0x1f,
-0x07,0xc6,0x72,0xc1,0x77,0xbd,0x5c,0x42,0x6c,0xae,0x2d,0xda,
-0xb7,0xc8,0xc2,0x20,0x0a,0xf2,0xf0,0xe4,0xcb,0x7c,0x16,0xc6,
-0xe6,0xc9,0x18,0x11,0x10,0xea,0x9b,0x4c,0x55,0xbd,0x43,0x59,
-0xc2,0x45,0xcb,0x52,0x46,0x82,0xf8,0x59,0x62,0x23,0xc2,0x61,
-0x6f,0xfe,0xe0,0x0d,0x4a,0x8a,0x6b,0xdc,0xad,0x04,0x8c,0x02,
-0xa3,0x43,0xe6,0x2b,0xed,0x9a,0xf7,0x29,0x81,0xcc,0xba,0xc6,
-0x3b,0xee,0xfa,0x5b,0xd6,0x52,0xad,0x99,0xf1,0x26,0x5b,0xb7,
-0x79,0xd4,0x99,0x00,0x96,0x5e,0x9c,0x28,0x86,0xd0,0x41,0xed,
-0x70,0x8c,0x3d,0x39,0x42,0x73,0xed,0x9a,0x6f,0x1d,0x87,0xff,
-0xa4,0xf1,0x64,0x54,0x88,0x82,0xfb,0x4e,0xf7,0x91,0xd7,0x51,
-0x73,0x6b,0xbf,0xd6,0x1e,0x54,0x18,0xc4,0x43,0x2a,0x9d,0x58,
-0xea,0x2f,0x5f,0xac,0xce,0x08,0x30,0x69,0x8b,0x07,0x04,0xba,
-0xda,0xca,0x1e,0xf1,0xd9,0xbd,0x86,0x2e,0x2f,0xa3,0x96,0xb6,
-0x8b,0xbb,0xf6,0x7a,0x91,0x69,0x0b,0x46,0x06,0xd6,0x19,0x13,
-0x92,0x8b,0xd9,0xbe,0x91,0x29,0xac,0x0f,0x7f,0x44,0xc2,0x7a,
-0x01,0x89,0xb4,0x65,0x7c,0x09,0xf7,0xdc,0x2d,0xbe,0xbd,0x0f,
-0x6c,0xab,0xbe,0xe1,0x4b,0x91,0xf2,0x7b,0x45,0xb4,0xef,0x1b,
-0x2e,0xf2,0x5a,0x32,0x6d,0x88,0x2c,0x34,0xd4,0xc4,0x2b,0x1e,
-0xba,0x96,0xd0,0x9a,0xbf,0xa6,0x37,0xdf,0xb2,0xb9,0x5d,0x13,
-0x65,0x1f,0x27,0x9b,0xea,0x9b,0xfe,0xf3,0xab,0x15,0x37,0xeb,
-0x2f,0x95,0x20,0x9a,0x1a,0x03,0xad,0x46,0x43,0xae,0x95,0x72,
-0x40,0xc2,0x56,0x89,0x01,0x7c,0x75,0x45,0xa9,0x2c,0x5b,0x41,
-0x38,0x35,0x0e,0xa1,0xdd,0xdc,0xb4,0x7c,0x27,0xf8,0xaf,0x34,
-0x29,0xc0,0xe1,0xa2,0x2a,0x20,0xa8,0x06,0x9b,0x5a,0x96,0x46,
-0x72,0x13,0xf0,0xe7,0xae,0x0a,0x12,0x53,0x15,0xec,0x79,0xec,
-0x66,0xcc,0x31,0x70,0xf6,0x65,0xd7,0xb9,0xf2,0x00,0xbb,0xfd,
-0xb0,0x0b,0xaf,0x21,0x58,0x0e,0x19,0xf2,0x2c,0xae,0xa7,0x97,
-0xd7,0x03,0x22,0x0c,0xac,0xab,0xf7,0xef,0xe9,0x4a,0xca,0x54,
-0x48,0x15,0x85,0x60,0x2e,0x99,0x6b,0xf2,0xf3,0xcf,0xd7,0x22,
-0xf8,0x93,0xb8,0xdb,0xe2,0xfe,0x5b,0x53,0xdc,0x3b,0xfe,0x95,
-0x5f,0xf6,0xd6,0x01,0xec,0x88,0x21,0x38,0xb6,0x4b,0x7e,0xdb,
-0x58,0x25,0xd9,0x8e,0x91,0x18,0xab,0xb9,0xc1,0x41,0x67,0x94,
-0x3a,0x87,0x00,0xbd,0x37,0x9b,0x59,0x31,0x86,0xc1,0x2f,0xe7,
-0x9e,0xeb,0x1f,0x3e,0x2c,0xf0,0xc1,0x6a,0x93,0xf0,0x2c,0xd3,
-0x69,0x2c,0x26,0x26,0xf5,0x3c,0xc6,0xd6,0xaa,0xd9,0x74,0xd0,
-0x16,0x14,0x92,0xc1,0x1d,0xb4,0x57,0x60,0x28,0x7b,0x83,0x05,
-0xc4,0x5c,0x4b,0xb5,0x7a,0xaa,0x2d,0x5a,0xb6,0xf1,0x63,0xcf,
-0xf1,0x4f,0x78,0x72,0x8f,0x4c,0x25,0xf0,0x8b,0x4b,0x33,0xff,
-0x05,0x5d,0xb4,0x96,0x5c,0x2a,0x43,0xd3,0x9e,0xfe,0xb8,0xb8,
-0xc2,0xdb,0xf2,0xab,0x98,0x5f,0xac,0xc2,0x2f,0x57,0x9a,0xba,
-0x38,0xb1,0xb6,0xba,0xd8,0x7c,0xf0,0x03,0xaa,0xea,0x8f,0xcd,
-0x59,0x7a,0x66,0xfe,0xdc,0x3f,0xc7,0xa4,0x59,0xe8,0xd7,0x9b,
-0x1a,0x17,0xd9,0x9f,0xad,0x4f,0x76,0xbe,0x53,0xe7,0xc7,0xb5,
-0x7f,0x8e,0x29,0xbc,0xe0,0xfc,0x18,0xb3,0x92,0x9d,0x5b,0xfa,
-0xa0,0x66,0x56,0xba,0xf7,0x39,0xcf,0x29,0x99,0xef,0xcc,0x49,
-0x3e,0xbd,0x7c,0xc7,0x1c,0x74,0xaa,0x02,0x04,0x4f,0x0d,0x5e,
-0x0d,0x09,0xb4,0xbb,0x93,0x54,0x32,0x84,0x2b,0x23,0x8e,0xcf,
-0x90,0x55,0xeb,0xcb,0x34,0x97,0x0e,0xe6,0xa6,0xd3,0x2d,0x80,
-0x8d,0x7b,0x7d,0x50,0x1f,0x31,0xb8,0x60,0x57,0x6e,0x2b,0xd5,
-0x86,0xe9,0x52,0x97,0xed,0xf1,0xae,0x61,0x2e,0x0d,0x15,0x5f,
-0xd1,0xf0,0x14,0x11,0x02,0xec,0x46,0x06,0x52,0x46,0xb6,0x7b,
-0xeb,0xe2,0xc2,0xd3,0x0a,0x7e,0x9f,0x99,0x6a,0x18,0xa9,0xbc,
-0xa1,0xbb,0x86,0x81,0xaa,0x7b,0xa2,0xc6,0x29,0xe7,0x8a,0xbf,
-0x53,0xe3,0xeb,0x70,0x08,0x99,0x9b,0x40,0xbf,0x7f,0x49,0x87,
-0xa9,0xd2,0xea,0x61,0x73,0xf5,0xc2,0x95,0xcb,0xfc,0x01,0x08,
-0x7b,0xfe,0xee,0xc1,0x0c,0xda,0x36,0x75,0x65,0x92,0x3b,0x6e,
-0x1b,0x3a,0xd0,0xf9,0xc7,0x8e,0x34,0xd8,0xc6,0x96,0x22,0x7a,
-0x5a,0xf5,0x25,0x2e,0xab,0xa3,0x5d,0xa3,0xa3,0xaa,0x49,0x07,
-0xb6,0x4a,0x00,0x41,0x70,0x7c,0x25,0x64,0x52,0x8b,0xa6,0xd2,
-0x27,0x11,0x00,0x1a,0xe2,0x01,0x7f,0x2f,0xd2,0xd5,0x66,0xe9,
-0xe9,0x86,0xc6,0x8f,0x88,0xa7,0x25,0x40,0xb5,0x02,0xa7,0x84,
-0xb8,0xb8,0x74,0xad,0xe0,0x8a,0x4b,0x68,0xe0,0x3f,0xa4,0x80,
-0xaf,0x9f,0x2b,0xc4,0xc9,0x25,0x9b,0x67,0x73,0x02,0x6b,0x25,
-0x6c,0x65,0xf7,0x6c,0x8b,0xfc,0x0a,0xa7,0xe5,0xbb,0x35,0xa8,
-0x68,0xf2,0x3e,0xaa,0x2c,0xf9,0x7b,0x8d,0x71,0xfb,0x0c,0x10,
-0xaf,0xdb,0x6a,0x74,0xd6,0xb9,0x1a,0xfe,0xb4,0xdc,0xcd,0x6d,
-0x73,0x3d,0xfb,0xe8,0xcc,0xbb,0x8b,0xfc,0xe4,0x9a,0x86,0xb0,
-0xae,0x6d,0x7e,0xec,0xad,0x3e,0x15,0x89,0x3c,0x0f,0xb7,0xde,
-0xd9,0x4f,0x63,0x8f,0x8d,0x34,0xb5,0xba,0x84,0x2d,0xf6,0xc7,
-0x6a,0xcf,0xd0,0xcc,0x91,0x08,0x7c,0xb8,0xda,0x49,0x3e,0x08,
-0xa0,0xd6,0x1c,0xe5,0x6b,0xd5,0x35,0x2a,0x57,0x4b,0x91,0x8c,
-0x40,0x90,0x6c,0x5e,0x6a,0x33,0x7f,0x05,0x3f,0xb4,0xdc,0xe6,
-0x8b,0xf7,0x0c,0x9d,0x1a,0x8c,0x64,0xc5,0xf7,0x64,0x7e,0x78,
-0x8c,0x0c,0x9e,0xe3,0xbb,0x5a,0xb0,0x3a,0x1e,0xe9,0x38,0x62,
-0x42,0xc6,0x06,0xa6,0x00,0x12,0x3f,0x17,0x70,0x84,0x5d,0xa3,
-0x35,0x1f,0xf8,0x47,0x81,0x36,0x45,0x90,0xb2,0x81,0x7f,0xdf,
-0x0d,0xae,0x58,0x05,0xbe,0x00,0xa6,0x63,0x41,0x57,0x6b,0xf9,
-0xaa,0x00,0x86,0xbd,0xd6,0xe3,0xe4,0xb9,0x12,0x2c,0xd0,0x7f,
-0xe4,0xa6,0x5e,0x63,0xa0,0x66,0x94,0xa2,0x12,0xf4,0x52,0xae,
-0x34,0x40,0xcb,0x53,0xd6,0x88,0x9e,0x59,0x0b,0xf6,0x02,0xe6,
-0xdb,0x64,0x70,0xa0,0xb9,0xa7,0xa1,0x01,0x76,0x4e,0xd5,0x17,
-0xde,0xef,0xea,0xe2,0xee,0x5f,0x68,0xd7,0x8c,0xd7,0x55,0x97,
-0x43,0x51,0xb2,0x84,0x83,0xed,0xa9,0x62,0x0d,0x33,0x9a,0xe3,
-0x5c,0x42,0xb9,0x83,0xaf,0x81,0x5d,0x59,0xcc,0x56,0xad,0x5d,
-0x9a,0xe2,0xae,0xdc,0xff,0xaa,0x4c,0x11,0x67,0x66,0xc7,0xbc,
-0x88,0x93,0x00,0xf0,0xe6,0x4b,0x92,0xe7,0xe1,0x51,0xd2,0x6c,
-0x70,0xcd,0x24,0xb2,0xdc,0x07,0x8f,0x28,0x38,0x09,0x39,0xfa,
-0xc2,0x22,0x78,0xf9,0xfc,0x60,0xab,0xd1,0xd2,0x71,0x28,0x51,
-0xb1,0xa9,0x69,0xad,0x5d,0xd6,0x6a,0x7d,0x36,0x4b,0xe1,0xb2,
-0xc7,0xf1,0xf0,0xf9,0xcb,0x97,0xcf,0x9f,0x9d,0x69,0x28,0x7e,
-0x92,0xaf,0xb1,0xe4,0x3b,0x56,0xfc,0x52,0x5e,0x50,0x42,0x9c,
-0xb6,0x37,0x11,0xa9,0xa5,0xd6,0x41,0x4c,0x69,0x2a,0xe9,0x46,
-0xc9,0x3b,0xab,0xc7,0x0c,0x60,0xd3,0x13,0x99,0xf6,0x06,0xad,
-0xfd,0xb3,0xe4,0xab,0xc1,0xc6,0xe1,0x36,0x24,0x74,0x95,0xef,
-0x89,0x59,0xaf,0x6f,0x46,0xac,0x30,0x24,0x2e,0x6e,0x4a,0xa8,
-0xa1,0x3b,0x56,0x1f,0x07,0x83,0x5d,0xfd,0x24,0x0b,0x26,0x61,
-0x11,0x8f,0x30,0x8b,0x29,0x9b,0xdd,0xad,0xab,0x2d,0xcd,0x32,
-0xaa,0x59,0xe3,0x56,0xaf,0xd7,0x91,0x7d,0xc8,0xe6,0xd6,0xb0,
-0x7a,0xc8,0xc6,0x50,0x72,0xdc,0x9f,0xd0,0xbb,0x7e,0x86,0x3c,
-0x3b,0x7a,0xea,0x19,0x63,0x25,0x77,0xdc,0x78,0x11,0xe9,0x78,
-0x14,0x90,0x91,0x67,0x46,0xa0,0x37,0x96,0x0e,0x4e,0x43,0x6d,
-0x51,0xb2,0xd3,0xea,0xc8,0xbd,0x6f,0x27,0x4c,0xa0,0x6e,0x1c,
-0xba,0x71,0x74,0x5e,0x8b,0x03,0x54,0x0c,0x11,0xfe,0xa5,0x67,
-0xe5,0x91,0xd1,0xd5,0x6a,0x80,0xc4,0x9f,0x8c,0xc5,0x0d,0x6f,
-0x07,0x54,0xdc,0xd3,0xa8,0xcf,0x4a,0x57,0x5c,0x79,0xb9,0x7f,
-0x4f,0xec,0xfc,0x8b,0x0b,0x30,0xdf,0x18,0xc1,0x95,0xf3,0xcc,
-0xd5,0x35,0x34,0x22,0xce,0x3d,0x31,0x0a,0xe7,0x7b,0xcc,0x98,
-0x24,0x3b,0xb8,0x6a,0x6a,0xd7,0xc8,0x90,0xc4,0x70,0x55,0x67,
-0x57,0xac,0x8f,0xef,0x7d,0x76,0xab,0xc6,0x3d,0x4f,0x97,0xf8,
-0x48,0xbe,0x99,0x70,0x98,0x14,0x76,0x6e,0x44,0x78,0x50,0x81,
-0xe9,0x0d,0x48,0xce,0xf3,0x8e,0xa7,0x05,0x81,0xf7,0xb7,0x0f,
-0xe1,0x0d,0x89,0x70,0xac,0xd5,0x85,0xeb,0x3f,0xfb,0x60,0xbe,
-0x3d,0x9e,0x87,0x27,0xb0,0x4e,0x31,0x64,0x98,0x13,0x64,0x54,
-0x14,0xb3,0xdd,0xed,0xed,0xe3,0xa2,0xdb,0xe9,0x6c,0x4d,0x93,
-0x62,0x7b,0x90,0xc5,0x39,0xfe,0xec,0x6d,0x2e,0x8e,0xb6,0x0b,
-0xc8,0x88,0x79,0x63,0xb3,0xbb,0xb3,0x35,0x2a,0x26,0x98,0xdd,
-0xfa,0x41,0x30,0xce,0xf0,0x91,0x65,0xc8,0x5e,0x07,0xef,0x58,
-0xcd,0x66,0x39,0x26,0x11,0x81,0xd1,0x01,0x93,0x62,0x4a,0xea,
-0x3c,0x49,0x82,0x97,0x7b,0x2f,0x9e,0xdd,0xc3,0x3c,0x95,0xd8,
-0x52,0x91,0xe4,0x90,0x8d,0x77,0x37,0x48,0xe2,0x51,0x16,0x6c,
-0x26,0x4c,0xf7,0x30,0xe9,0x0f,0xd9,0xff,0x7b,0xd8,0x80,0xf2,
-0x97,0x32,0xe5,0x6c,0xb6,0x28,0x66,0x8b,0x22,0xc8,0xb3,0x49,
-0x02,0xef,0x78,0x41,0xfa,0xe5,0x64,0x42,0xef,0xcb,0x67,0xd3,
-0x21,0xd3,0x1a,0x05,0x25,0x97,0xe6,0x39,0x6c,0x19,0x99,0x93,
-0x39,0x3e,0xb7,0x14,0x46,0xd9,0x71,0xb2,0xc5,0xb1,0x50,0xa5,
-0x74,0x4a,0x66,0xab,0xa8,0xa0,0xa0,0xa1,0x2a,0x26,0xc4,0x9e,
-0x2f,0xa6,0xf0,0xee,0x5e,0x70,0x5c,0x40,0x17,0x83,0x51,0x76,
-0x02,0x0f,0x48,0x6e,0x89,0x3e,0x21,0x09,0x82,0x28,0x19,0x67,
-0x27,0xc1,0x94,0xfd,0x6f,0x01,0xa3,0xc6,0x26,0x1a,0xb9,0xe8,
-0x2a,0xbe,0xe9,0x43,0xf5,0xb7,0xaa,0xb3,0xb3,0x75,0xf8,0x68,
-0xff,0x31,0x4c,0x11,0xe8,0xfa,0x66,0x87,0xcd,0x76,0xe3,0x4d,
-0x63,0x97,0x8d,0x7f,0xd1,0xbb,0x11,0xdf,0x6c,0xb4,0xe1,0x73,
-0xe3,0xbb,0xbf,0xf9,0x73,0xd0,0x2e,0x8d,0x50,0x94,0xdc,0xe9,
-0x89,0x92,0xbf,0xfe,0x2b,0x2c,0x89,0xa8,0xa4,0xd3,0xe9,0xdc,
-0xe1,0x25,0x5f,0x14,0x58,0x10,0xcb,0x82,0x58,0x14,0x0c,0xb1,
-0x60,0x20,0x0b,0x06,0xa2,0x60,0x8e,0x05,0x89,0x2c,0x08,0x45,
-0xc1,0x14,0x0b,0x86,0xa2,0x20,0xea,0xf0,0x82,0xff,0xf9,0x17,
-0x2c,0x38,0x92,0x05,0x5d,0x51,0xf0,0xaf,0x58,0x30,0xe2,0xfd,
-0xbd,0xde,0xbb,0x2e,0x50,0xd1,0x8f,0xa0,0xf9,0xc9,0x7e,0x0b,
-0x20,0x52,0xd9,0x58,0x24,0x20,0x8e,0xb1,0xea,0x57,0x62,0xa8,
-0xdd,0xdb,0x62,0xa8,0xdf,0xfe,0x2d,0x96,0xbc,0x95,0x25,0x1d,
-0x59,0xf2,0x97,0x58,0x32,0x16,0x25,0x72,0xac,0xdf,0x7d,0xfb,
-0x17,0x58,0x32,0x91,0x75,0xae,0xcb,0x92,0x6f,0xb1,0x64,0x2a,
-0x4a,0x76,0x54,0x9d,0xff,0xc2,0x92,0x8c,0x97,0xec,0x44,0x82,
-0x0e,0xdf,0xfd,0xf1,0x3f,0xb0,0x64,0x26,0x4b,0x22,0x59,0xf2,
-0x9f,0x58,0xf2,0x3b,0xd9,0x03,0xd5,0xb7,0xff,0x8f,0x25,0x73,
-0x59,0x47,0xb6,0xf3,0x47,0x6a,0x27,0x97,0x25,0x03,0x59,0xf2,
-0xdf,0x58,0x52,0xc8,0x5e,0xab,0xbe,0xfd,0x1d,0x96,0x2c,0x44,
-0x49,0x4f,0x8d,0xe7,0x1f,0xb1,0xe4,0x58,0x8e,0x47,0x95,0xfc,
-0x1b,0x96,0x9c,0xc8,0x3a,0x0a,0xdb,0x3f,0x63,0xc9,0x52,0xf6,
-0x5a,0xb2,0xd5,0xb7,0x7f,0x86,0x25,0x25,0x2f,0xe9,0xdd,0x94,
-0xd8,0xfe,0x40,0xed,0xfc,0x5e,0x96,0xdc,0x90,0x25,0xff,0x84,
-0x25,0xef,0xf8,0x94,0xee,0xc4,0x82,0x06,0xff,0x4b,0x24,0xf8,
-0x5a,0x56,0x91,0xc4,0xf9,0xc3,0xdf,0x63,0xc9,0xa9,0xe0,0x82,
-0x70,0x47,0x30,0xd0,0x3f,0x60,0xc1,0x37,0x92,0xb3,0x6e,0x35,
-0x02,0x2a,0xf8,0xf7,0x86,0x19,0xde,0x90,0x82,0xf4,0xab,0x5f,
-0x06,0x94,0x5c,0x04,0x1f,0x0c,0x69,0x3e,0x70,0x81,0x1c,0x1a,
-0x20,0x0f,0x83,0xe6,0xaf,0x0e,0x31,0x61,0x75,0xcb,0x01,0xfc,
-0x78,0x51,0x60,0xa4,0x44,0xc1,0x5f,0x77,0x40,0x3d,0x49,0x99,
-0x82,0xc8,0x4d,0xb8,0x47,0x90,0x4f,0xbf,0x79,0xc3,0x05,0x0d,
-0xda,0xc5,0x04,0x7e,0xe1,0x05,0x7b,0x14,0x4e,0xc3,0x41,0x1a,
-0x4e,0x0d,0xf0,0x4f,0x1d,0xe0,0xbf,0x60,0x5f,0x2c,0xb0,0x5f,
-0x3a,0xc0,0x9e,0x16,0xe1,0xd8,0x46,0xf7,0x1b,0x07,0xdc,0x27,
-0xd9,0xfc,0x24,0x39,0x62,0x90,0x8f,0xc3,0xca,0xd0,0xf6,0x70,
-0x68,0x37,0x5d,0x7a,0x6c,0x56,0x85,0xfe,0x7f,0x2e,0xb8,0x93,
-0x64,0x60,0xc3,0x7d,0x8c,0x58,0x6f,0x39,0xa1,0xd3,0x3c,0x37,
-0x60,0xef,0xb9,0x46,0x76,0xf8,0x7c,0x1f,0xd2,0xb9,0xeb,0x80,
-0xdb,0x0f,0xe4,0x32,0xf9,0x71,0x32,0x9e,0x25,0x73,0xbe,0x3e,
-0x8a,0xc0,0x57,0x00,0xb1,0xaf,0x31,0x5b,0x78,0xcb,0x59,0xd2,
-0x0e,0x46,0x6c,0x11,0x1c,0x27,0xf3,0x76,0x10,0x87,0x33,0x78,
-0x46,0x96,0x0c,0xa4,0x64,0xbc,0x15,0x0e,0x06,0xf8,0x36,0xc7,
-0x7e,0x9a,0x17,0xf0,0xf2,0x42,0xd3,0x0d,0x0f,0x76,0x33,0xae,
-0xcf,0x90,0x3a,0x41,0x6f,0x64,0x38,0x5c,0xa7,0x95,0x79,0x32,
-0x61,0xab,0xd3,0x45,0x1a,0xa2,0x27,0x55,0x9a,0xc9,0xb1,0x0a,
-0xe4,0x25,0xc7,0x90,0x18,0x10,0x70,0x3e,0x16,0x6f,0x16,0x56,
-0x3e,0x51,0x18,0x8f,0x7d,0x26,0x1b,0xe3,0x33,0x9e,0x17,0x4b,
-0x46,0x9f,0x38,0x9e,0xbc,0xc8,0x66,0x07,0xf3,0x6c,0x16,0x1e,
-0xe1,0x2b,0xa5,0x88,0xc8,0xfa,0x26,0x31,0x51,0x4f,0x1e,0x2e,
-0xa2,0x68,0xac,0x9f,0xc3,0xb4,0x8c,0x18,0xad,0xeb,0xe9,0x74,
-0x94,0xcc,0xd3,0x22,0x6f,0xc6,0x90,0x09,0xad,0x1d,0x50,0x82,
-0x36,0x1a,0x87,0x04,0x1a,0x36,0x8d,0xa0,0x20,0x5b,0xec,0x73,
-0x86,0x39,0xa6,0xe7,0x99,0xb0,0x22,0x99,0x4b,0xac,0x8a,0x8a,
-0x78,0x06,0xf7,0x38,0x32,0xf5,0x09,0xa0,0x10,0xdc,0x80,0x9a,
-0x26,0x27,0xc1,0x10,0x7b,0xc5,0x38,0x87,0x8d,0x39,0x82,0xe4,
-0x1f,0xcc,0x64,0x89,0xe6,0xd9,0xdb,0x04,0xde,0xde,0x4b,0x80,
-0xc0,0x0d,0x7c,0x42,0x13,0xec,0x99,0xb4,0x10,0x89,0xf0,0xc5,
-0xf3,0x8b,0x5b,0xda,0x78,0xf2,0x87,0xac,0xfa,0x43,0xac,0xda,
-0x14,0xc9,0xe0,0xa8,0xf7,0x64,0x6f,0x0f,0xc0,0xd9,0x59,0x37,
-0x4b,0x5c,0x9f,0x57,0x4b,0xc6,0x81,0x3f,0xcd,0x5f,0xce,0x84,
-0x8f,0x62,0x0a,0x8c,0x99,0x98,0x46,0x4a,0xe6,0x1f,0xbf,0x7c,
-0xb6,0x0f,0xfe,0xcd,0x28,0x19,0x8f,0x33,0x48,0x02,0x37,0x1e,
-0xa0,0xa7,0x03,0x78,0x8d,0xc4,0x73,0xc9,0xb8,0x25,0x9a,0x38,
-0x81,0x2c,0x16,0x0c,0x01,0xb9,0xc5,0xaf,0x20,0x4d,0x1f,0x47,
-0x49,0x49,0xef,0x86,0xd9,0xb4,0x78,0x25,0x53,0xf3,0x01,0x8d,
-0x1a,0xb2,0x6a,0xcf,0x59,0x15,0x5b,0x23,0xe6,0x36,0x5a,0xe3,
-0xcc,0xc0,0x1a,0x84,0x78,0xdc,0x49,0x0f,0x49,0x0f,0x78,0xe8,
-0xc1,0x39,0xe1,0x4d,0xd0,0xaf,0xfe,0x06,0xa5,0x90,0x13,0x39,
-0xd7,0x44,0xa9,0xfa,0x22,0x21,0x9e,0x42,0xe4,0xfc,0x58,0x25,
-0x0e,0xd6,0x3e,0xf5,0x0d,0x8e,0x1b,0x24,0xcb,0xe7,0xc3,0x66,
-0x16,0x7d,0xd5,0x66,0xbd,0x56,0x73,0x03,0x7e,0x0c,0xfb,0xa8,
-0xf9,0x8f,0x3c,0x74,0x99,0xaa,0xa4,0xe9,0x20,0x12,0x0c,0x06,
-0x7d,0x08,0x88,0xf9,0x8d,0x85,0xfb,0x4b,0x71,0xd6,0x53,0x35,
-0x3c,0xd8,0x21,0x36,0x18,0x5d,0x66,0xaa,0x90,0x32,0xca,0x16,
-0x03,0xf0,0xc8,0xbe,0x58,0x0c,0x87,0x1d,0x38,0x65,0x66,0x4a,
-0x89,0xc4,0x04,0x70,0xf7,0x05,0x5c,0x17,0x9d,0x39,0xad,0x66,
-0x94,0x34,0x5a,0xdc,0x51,0x81,0x70,0xbb,0x06,0x1b,0xf7,0x6c,
-0xd8,0xf8,0x96,0x17,0x36,0xac,0xc0,0x0e,0x7d,0xb0,0x83,0x0a,
-0xde,0x81,0x17,0xef,0xa0,0x82,0x77,0x10,0xfb,0x60,0x93,0x8e,
-0x0d,0x9b,0xdc,0xf4,0xc2,0xde,0xae,0xc0,0x62,0x06,0x03,0x9d,
-0xe2,0x18,0x28,0xc1,0xf4,0x8f,0xcd,0x39,0xf3,0xc6,0x8e,0xd8,
-0xff,0xa2,0xae,0x9a,0xee,0x51,0x88,0x0b,0x11,0x2b,0x83,0xac,
-0x41,0xdd,0x9b,0x98,0x46,0xe8,0x08,0x7f,0xdc,0x86,0xbf,0xa3,
-0xae,0x4c,0x46,0xa0,0x30,0x6d,0x7d,0x19,0x87,0xf1,0x28,0xf9,
-0x1c,0x2a,0x43,0x3c,0xd9,0x48,0x68,0xc6,0xe7,0xcb,0x03,0x2d,
-0x3d,0x3a,0xdc,0x10,0x18,0xa4,0x43,0x48,0x4f,0xf2,0x74,0x8a,
-0xef,0xdd,0x8a,0xf4,0x37,0xe3,0x14,0xcf,0x16,0xf0,0x5f,0x18,
-0x14,0xe7,0x7f,0xc7,0xfc,0xdf,0xb9,0x48,0xe6,0x77,0x24,0xfe,
-0x88,0xc4,0x1f,0x80,0x52,0x7f,0x33,0x12,0x82,0xe9,0x72,0xb9,
-0x3c,0x8e,0xa1,0x43,0xb9,0x2b,0xae,0x1e,0xb3,0x66,0x6c,0x38,
-0x99,0x61,0x78,0x0e,0xb2,0x1d,0xcb,0xc4,0x4c,0x47,0xf4,0x53,
-0x64,0x86,0x89,0xe8,0x67,0x4f,0x44,0xfb,0xf9,0xa8,0x34,0x0a,
-0xb0,0xe5,0xbe,0x80,0x35,0x41,0x9b,0x02,0x18,0x04,0xf4,0x1f,
-0xba,0xae,0x6f,0xd8,0x51,0x65,0x73,0x8f,0x1a,0x09,0x92,0x8a,
-0x60,0x59,0xf5,0x6c,0xaa,0xac,0x77,0x97,0x48,0xaa,0xd5,0xe4,
-0x7d,0x21,0xaa,0x54,0xb1,0xd9,0x79,0x53,0x7c,0x73,0x0c,0xd9,
-0x6d,0x91,0xaf,0x2a,0x00,0x9a,0x6f,0xcd,0x9d,0x65,0x36,0xd4,
-0xf8,0x2d,0x53,0x77,0xf3,0x21,0xbc,0x89,0x1e,0x67,0x93,0x6d,
-0xcc,0xb3,0x01,0x4f,0x80,0x6d,0x77,0x6f,0xee,0xec,0xdc,0xee,
-0xdd,0xde,0x70,0xd0,0x46,0xdf,0x91,0xf3,0x90,0x09,0x87,0xc5,
-0x7b,0x8a,0xe9,0x08,0x66,0xd9,0x49,0x73,0xa7,0xc3,0xec,0x1b,
-0xe0,0xdf,0x4d,0x06,0xda,0x6a,0x07,0x3d,0x12,0x96,0x6b,0x0a,
-0xe2,0xc6,0x1d,0x80,0x38,0x02,0x88,0x23,0x37,0x44,0xb7,0x0b,
-0x10,0x11,0x40,0x44,0x04,0x41,0x41,0x06,0x29,0x45,0x09,0x1b,
-0x2a,0xe9,0xca,0xb4,0x40,0x53,0x24,0x9b,0x2a,0x0d,0x06,0xea,
-0x92,0x71,0xdb,0x5e,0x08,0x6a,0x4d,0x24,0xa0,0x51,0xdf,0x9a,
-0xaa,0x4a,0x7f,0xc3,0x9d,0x59,0x5b,0x53,0xb8,0x3a,0x4f,0x42,
-0x45,0x66,0x4c,0x8c,0xc7,0xcd,0x18,0x9e,0xbf,0x25,0x95,0xcb,
-0xba,0x80,0x7f,0x8a,0xac,0x23,0x5a,0x2f,0xdf,0x26,0x65,0x0e,
-0xbd,0x51,0x5d,0x7b,0x1e,0x7d,0x95,0xc4,0x05,0x6c,0x7b,0xe6,
-0xb2,0x6b,0xda,0xb7,0xa6,0xc0,0x03,0xfd,0x61,0x1f,0x70,0x1f,
-0x14,0x8c,0x4d,0x4a,0x37,0x8c,0x5d,0x85,0x90,0x59,0x8a,0x03,
-0xd2,0xd5,0x3f,0x47,0xa2,0x76,0x56,0x19,0x9f,0x3c,0x3f,0x99,
-0x82,0x35,0x94,0xcc,0x8b,0x92,0x7a,0x8d,0x04,0x83,0x9d,0x55,
-0xc5,0x90,0x80,0x9f,0x9e,0xc5,0x10,0xc9,0x48,0x04,0x13,0xca,
-0x99,0x05,0x10,0x32,0x44,0xc8,0x76,0xdd,0x5b,0xce,0xe0,0x09,
-0x68,0x33,0xb4,0x83,0x86,0xe2,0x1e,0x3e,0x66,0x06,0xe6,0x8f,
-0xfe,0xb3,0xaf,0xa0,0x84,0x5d,0x05,0x0c,0xcf,0xff,0xd4,0x4a,
-0x31,0xe9,0x6f,0x36,0xd5,0xbf,0xa0,0xb0,0x64,0x20,0x2b,0xca,
-0xc4,0x46,0x63,0x0e,0x24,0x1c,0xff,0x60,0x5c,0x81,0x71,0x60,
-0x36,0xe6,0x6c,0x08,0x39,0x63,0x16,0x6c,0x71,0xc4,0xc4,0x45,
-0x8b,0x29,0xbe,0xdb,0x9d,0x0c,0x78,0x6c,0x91,0xca,0xb6,0x92,
-0x25,0x3e,0x41,0xaa,0xa9,0x17,0x36,0x38,0x15,0xe2,0xc7,0x45,
-0x5a,0xbe,0xc4,0x6d,0x00,0x6d,0x6c,0x9c,0xb6,0x88,0x90,0x56,
-0x8a,0x55,0x2d,0xc3,0x0b,0x2e,0x09,0xbc,0x33,0xf4,0x16,0x91,
-0xdd,0x99,0xe0,0x23,0x51,0xb0,0x1b,0x1c,0x8d,0xb3,0x28,0x04,
-0xfb,0xe3,0xb4,0x09,0x69,0x18,0xee,0x6e,0xc3,0x2b,0xda,0xb3,
-0xe2,0xfe,0xff,0x05,0x00,0x00,0xff,0xff,0x61,0xc5,0xc0,0xc4,
-0x28,0x4a,0x02,0x00,
+0x1f,0x8b,0x08,0x00,0x00,0x00,0x00,0x00,0x02,0xff,0xec,0xfd,
+0x5b,0x6f,0x23,0xc9,0xb2,0x28,0x8c,0xbd,0xeb,0x57,0xc4,0x68,
+0xaf,0xdd,0x24,0x47,0xbc,0xeb,0xd2,0x6a,0xb1,0xd9,0x7d,0xd4,
+0x92,0x7a,0x5a,0x7b,0x74,0x5b,0x92,0xba,0x67,0x66,0x6b,0xb4,
+0x66,0x8a,0x55,0x49,0xb2,0xba,0x8b,0x55,0x9c,0xaa,0xa4,0x44,
+0xae,0x69,0x0d,0x0c,0x3f,0x18,0xf8,0x00,0xe3,0x83,0x61,0x1c,
+0xd8,0x7e,0xf0,0x83,0x01,0xdb,0x6f,0x7e,0xb0,0x01,0x03,0x06,
+0x7c,0x79,0xf1,0x1f,0xf0,0x7f,0x38,0xbf,0xc4,0x88,0xbc,0x55,
+0x66,0x55,0x56,0x91,0x52,0xf7,0xac,0xbd,0xce,0x77,0xce,0xda,
+0x1b,0xd3,0x62,0x65,0x64,0x64,0x64,0x64,0x64,0x66,0x64,0x44,
+0x64,0xe4,0xcb,0x6f,0xbc,0xc8,0xa5,0x8b,0x29,0x81,0x31,0x9d,
+0x04,0xaf,0xd6,0x5e,0x4e,0x08,0x75,0xc0,0x1d,0x3b,0x71,0x42,
+0x68,0x7f,0x7d,0x46,0x87,0x8d,0xdd,0xf5,0x57,0x6b,0x2f,0x13,
+0xba,0x08,0xc8,0xab,0x35,0x80,0x41,0xe4,0x2d,0xe0,0x77,0x18,
+0x38,0xee,0xa7,0x51,0x1c,0xcd,0x42,0x6f,0x0f,0xfe,0xa5,0xdd,
+0x6e,0xf7,0xe0,0x61,0x0d,0xa0,0x49,0x49,0x3c,0xf1,0x43,0x27,
+0x80,0xdf,0x61,0x18,0x85,0xb4,0x91,0xf8,0x7f,0x27,0x7b,0xd0,
+0xd9,0x99,0xce,0x11,0xe0,0x65,0x4b,0xa0,0x79,0x99,0xb8,0xb1,
+0x3f,0xa5,0xaf,0xd6,0x7a,0xd5,0xe1,0x2c,0x74,0xa9,0x1f,0x85,
+0xd5,0x1a,0xfc,0xbe,0x06,0xd0,0x6a,0xc1,0xf7,0x84,0x4c,0xc1,
+0x0f,0x21,0xa1,0x64,0x0a,0xf7,0x3e,0x1d,0xc3,0x34,0x8e,0x68,
+0xe4,0x46,0xc1,0x07,0x12,0x27,0x7e,0x14,0x62,0xa1,0xfc,0xd4,
+0x1c,0x45,0xcd,0x35,0x80,0x3b,0x27,0xce,0x41,0xf5,0xa1,0xdb,
+0x5b,0x5b,0x03,0x90,0x2d,0x80,0x47,0xdc,0xc8,0x23,0xdf,0x93,
+0x45,0x95,0x84,0xf8,0x97,0xc7,0x9b,0xe4,0xb5,0x63,0xe7,0x1e,
+0xfa,0xe0,0xd0,0x68,0x20,0x4b,0x9b,0x31,0x99,0x06,0x8e,0x4b,
+0xaa,0xad,0x46,0x6b,0x54,0x87,0xca,0x46,0xa5,0x96,0x7e,0xfa,
+0x85,0x7d,0x6a,0x55,0x6a,0xb5,0x9e,0x42,0xf1,0x89,0x2c,0xa0,
+0x0f,0x21,0xb9,0x87,0xf7,0x7e,0x48,0x77,0xf7,0xe3,0xd8,0x59,
+0x54,0x63,0xe7,0xbe,0x19,0x90,0x70,0x44,0xc7,0x02,0x72,0x18,
+0xc5,0x50,0x45,0x70,0x1f,0xfa,0xd0,0xee,0x81,0x0f,0x2f,0x21,
+0x05,0xea,0x81,0xbf,0xb1,0x51,0x43,0x54,0x37,0xfe,0x2d,0xf4,
+0x59,0x09,0x8e,0xc6,0x41,0xe4,0x91,0x7d,0x5a,0xf5,0x05,0x92,
+0x98,0xd0,0x59,0x1c,0x22,0x18,0xfe,0x7e,0x58,0xe3,0x9c,0xfb,
+0x01,0x99,0x35,0x8c,0x9d,0x89,0x1f,0x8e,0x20,0x24,0xa3,0x88,
+0xfa,0x0e,0x25,0x5e,0x1d,0xd4,0xb0,0x78,0x0e,0x75,0xc0,0x89,
+0x63,0xff,0x8e,0x24,0xe0,0x87,0x30,0xf0,0x43,0x27,0x5e,0xc0,
+0x84,0x24,0x89,0x33,0x22,0x09,0x38,0xa1,0xc7,0x51,0xb9,0x51,
+0x48,0xe3,0x28,0x48,0x4b,0xfc,0x10,0xfe,0xed,0xea,0xfc,0x0c,
+0x28,0x99,0x53,0xf5,0xb5,0xa9,0xb3,0x57,0x54,0xa9,0x62,0x63,
+0x75,0xd6,0x92,0xe4,0x2f,0x8d,0x17,0xe2,0x2f,0xce,0xa8,0x49,
+0x32,0x82,0x3e,0x43,0xd7,0x9c,0xa2,0xa0,0x55,0x19,0x30,0xef,
+0xd9,0x03,0xb8,0x0e,0x75,0xc7,0x50,0x25,0x35,0x55,0x87,0xf7,
+0x56,0x94,0xb3,0xff,0xfa,0x43,0xa8,0x4e,0x92,0x51,0x93,0x49,
+0x6e,0xbf,0x0f,0xeb,0x31,0x41,0x51,0x5b,0xaf,0xb1,0xae,0x36,
+0xf9,0x2f,0x06,0xe1,0x46,0x41,0x52,0xc7,0x16,0x9b,0x71,0x74,
+0x9f,0xd4,0x7a,0x85,0xd5,0xa9,0x13,0x53,0x59,0xff,0x3e,0xf6,
+0x29,0xa9,0xae,0xff,0x1c,0xff,0x1c,0xfe,0x3c,0xef,0x0c,0x6e,
+0x3a,0x93,0x9b,0x75,0xd8,0x60,0x58,0x44,0xd7,0x61,0x03,0xd6,
+0x6f,0x59,0x59,0x7b,0x82,0x60,0xeb,0xb5,0xdc,0x40,0x78,0x64,
+0x18,0x38,0x94,0x18,0x03,0xc1,0xf8,0x9f,0x72,0x3b,0x26,0x10,
+0x85,0x84,0xc9,0x9e,0x84,0x4e,0x68,0x4c,0x9c,0x09,0xf8,0x21,
+0xc7,0x44,0x1c,0x77,0x0c,0x9e,0x1f,0x13,0xc6,0xe3,0x3a,0x0c,
+0x83,0x59,0x32,0x26,0x1e,0x38,0x43,0x4a,0x62,0x20,0x77,0x24,
+0x1d,0x3d,0x3e,0x57,0x7c,0x9a,0x40,0xbb,0x8d,0xff,0x3f,0x1c,
+0xe2,0xff,0x53,0xc7,0x0f,0x38,0xaa,0x80,0x0c,0x29,0x44,0xc3,
+0x61,0x13,0xf6,0xe1,0x20,0x9a,0x4c,0x63,0x92,0xe0,0x3c,0xb9,
+0xe2,0x0d,0xba,0x4e,0x58,0xa1,0x30,0x20,0xb2,0x85,0x3a,0x24,
+0x11,0xca,0x57,0x42,0xe3,0xe8,0x13,0x49,0x60,0x14,0x41,0x34,
+0xa3,0xe0,0x24,0x1c,0x59,0x42,0xa3,0x98,0x78,0x30,0x08,0x22,
+0xf7,0x53,0x52,0x87,0xfb,0xb1,0xef,0x8e,0xc1,0x09,0x17,0xe0,
+0x87,0xac,0x1f,0x31,0xc4,0xc4,0xf1,0x12,0x18,0xcc,0xa8,0x2c,
+0x8c,0x09,0xb6,0xe0,0x8a,0x96,0x89,0x67,0x08,0x8f,0xac,0x56,
+0x65,0xac,0xd7,0x27,0xa6,0x60,0x08,0x9f,0x58,0x87,0xc4,0xcd,
+0x52,0x5e,0x5d,0x17,0xac,0x6b,0xc4,0xce,0xfd,0xba,0x36,0x1d,
+0x19,0xa6,0x18,0xfa,0x02,0x03,0x1b,0x54,0x67,0x10,0x90,0xe6,
+0x88,0xd0,0x1f,0x58,0x59,0xb5,0x56,0x67,0x64,0xea,0x50,0xf8,
+0x5b,0x42,0x5d,0xb2,0xb2,0xaa,0xc0,0xa9,0x96,0x2a,0x98,0xce,
+0x26,0xd3,0xaa,0x2e,0x9e,0x08,0xc6,0x6a,0x56,0x6b,0x4d,0x3a,
+0x26,0x61,0xba,0xaa,0xc5,0x24,0x99,0x05,0x34,0x85,0xe5,0xb2,
+0xc7,0xbf,0x36,0xbd,0x28,0x24,0x35,0x43,0xba,0xf1,0x7f,0x5c,
+0xf8,0x04,0xc8,0x9d,0x13,0xcc,0x48,0x2d,0x2d,0xe4,0x4d,0xcb,
+0xdf,0x0f,0x75,0xd0,0xd7,0xcf,0x07,0x39,0x87,0x6a,0x55,0x73,
+0x9d,0x50,0x40,0xfa,0xac,0xe4,0x5c,0x72,0xc7,0xb3,0xf0,0x53,
+0x7e,0xd9,0x42,0x40,0xb1,0x24,0xc1,0x06,0x6c,0xa9,0x16,0x19,
+0x78,0x33,0x21,0x54,0x9f,0xb3,0xfa,0xe7,0x9b,0x76,0x1d,0xda,
+0x75,0xe8,0x6e,0x6f,0xb3,0xff,0xdc,0xd6,0x41,0x43,0xa5,0xe0,
+0xf9,0xd8,0x88,0x79,0xc6,0x2a,0x4b,0xd2,0xd5,0x34,0x52,0xdc,
+0xe6,0xa2,0x66,0x90,0x8e,0x84,0x73,0xd1,0x83,0x3e,0xdc,0xdc,
+0xd6,0x01,0xa7,0x3b,0x5b,0x4e,0x0b,0x96,0xd8,0x7e,0x1f,0xda,
+0xf0,0xf9,0x33,0x5b,0x6c,0x35,0x7a,0xb0,0x68,0xa3,0x0f,0x3b,
+0xdb,0xdb,0x9b,0xdb,0x26,0x5b,0xa6,0x4e,0x4c,0xa1,0xcf,0x61,
+0x93,0xd9,0xc0,0x61,0x4c,0xf1,0xeb,0x08,0x2f,0xc0,0xeb,0x10,
+0x42,0x9f,0xc1,0x49,0x64,0x5a,0x75,0x46,0x5c,0x9e,0xab,0x21,
+0x6c,0xc0,0xb6,0x62,0x02,0x03,0x52,0x4c,0x0b,0xe1,0x19,0xe7,
+0x5a,0x08,0xaf,0x5e,0xc1,0x6e,0x1d,0xfe,0x50,0x5f,0xaa,0x7f,
+0xf0,0x6f,0x35,0xfe,0xe1,0xd6,0x82,0x01,0xe9,0xa8,0x67,0x71,
+0x27,0xcd,0xe9,0x2c,0x19,0x57,0xd9,0xdf,0xaa,0x84,0xb1,0x6a,
+0xa3,0x2f,0xea,0xea,0xa4,0xf3,0xa5,0x15,0x17,0x9d,0xd0,0xc3,
+0x1d,0x24,0x0a,0x81,0x8e,0x09,0x8c,0xf9,0x0c,0x89,0x86,0xec,
+0x17,0x99,0x4c,0xe9,0x82,0x57,0x66,0xbf,0x71,0x7d,0x81,0x01,
+0x09,0xa2,0x70,0x94,0x00,0x8d,0xd4,0xf0,0xc8,0x45,0x29,0xc7,
+0x03,0xde,0x3e,0x74,0xb2,0xdb,0xe1,0x47,0x1c,0xab,0x3a,0x38,
+0x94,0x8f,0xd9,0x47,0x78,0x29,0x3b,0x21,0xc7,0xca,0xa1,0x8a,
+0xee,0xe4,0xe6,0xe3,0xad,0xf8,0x5e,0x87,0x8f,0xb8,0x63,0x8a,
+0xf6,0x18,0x33,0x14,0x08,0xa2,0x33,0x67,0x82,0x00,0xd3,0x17,
+0xeb,0x53,0xb9,0x1c,0x47,0x21,0xf6,0xbc,0x41,0xa3,0x06,0x09,
+0x3d,0x20,0xa1,0x1b,0x2f,0xa6,0x94,0x78,0x90,0xf0,0xe5,0x86,
+0xaf,0xd7,0x0e,0x74,0x76,0x60,0xb0,0xa0,0x92,0x2f,0x75,0xe4,
+0x82,0x58,0x13,0x49,0xe8,0x91,0xb8,0x92,0x40,0xec,0x84,0x5e,
+0x34,0x51,0x4b,0xb9,0x87,0xdb,0x2a,0x38,0xe0,0x46,0xb3,0x10,
+0x57,0x60,0xb6,0x46,0xcb,0x4d,0x80,0xd5,0x0f,0x11,0x6d,0x97,
+0xa1,0xe5,0xa8,0xf6,0x8f,0xae,0x1a,0xdf,0x1d,0x9c,0x42,0x18,
+0x85,0x2e,0x61,0xd5,0x91,0xd7,0xae,0x3f,0x1d,0x93,0x18,0x77,
+0xe0,0x3a,0x5f,0xec,0xb5,0xe1,0x71,0x66,0x88,0x87,0xfa,0x2e,
+0x6e,0x34,0x40,0x23,0xa6,0x16,0xb5,0x5a,0x70,0x3e,0xa3,0x53,
+0x5c,0xb7,0x43,0x0f,0xfc,0x10,0xff,0x62,0x3b,0xca,0xd8,0xb9,
+0x23,0x58,0xdb,0x8f,0x21,0xba,0x67,0x7a,0x44,0x1d,0x3c,0x82,
+0x6a,0x81,0x07,0xc3,0x38,0x9a,0x60,0x19,0xdb,0x9a,0xfc,0x30,
+0xed,0xdf,0xfb,0xcb,0x13,0xd4,0x2e,0x46,0x13,0x12,0x52,0xb9,
+0xe4,0x87,0xb8,0x05,0x41,0x8c,0x48,0x49,0xc2,0x6a,0x25,0x24,
+0xbe,0x23,0x71,0x33,0x65,0x2b,0x1d,0x3b,0x14,0xbc,0x88,0x2f,
+0xfe,0xb3,0x90,0x72,0x64,0xb3,0xa9,0x90,0x2f,0x5f,0x2d,0xf1,
+0xc8,0x5e,0xa6,0x60,0x2d,0x12,0xce,0xb1,0x98,0x80,0x17,0x47,
+0xd3,0x69,0x66,0xaf,0x50,0xdb,0x21,0xaa,0x72,0x09,0x71,0x63,
+0x42,0xeb,0x10,0x38,0x03,0x12,0xd4,0x61,0x86,0x6d,0xca,0xa9,
+0x2c,0xc6,0x9c,0x8d,0x63,0x84,0xd3,0x98,0x06,0xa4,0xe9,0x4f,
+0xa6,0x51,0x4c,0xb1,0xea,0x3a,0x6e,0x18,0x75,0x4d,0x2d,0xe4,
+0xb8,0x6a,0x75,0xf8,0x3d,0x74,0x26,0x64,0x0f,0xd6,0xdf,0x9d,
+0xee,0x1f,0xac,0xd7,0x61,0xec,0x24,0xe3,0x3d,0x58,0xbf,0x7a,
+0xb7,0xdf,0xe8,0x6e,0xef,0xac,0xe3,0xaa,0xeb,0x04,0x09,0xa9,
+0xc3,0xcd,0x7a,0xe2,0x8f,0xc2,0xf5,0xdb,0xec,0xaa,0x3f,0x71,
+0xdc,0xac,0xf6,0x92,0xa1,0x02,0xeb,0x55,0x25,0xfe,0x89,0xe3,
+0xd6,0xd9,0x34,0xb9,0x26,0x73,0x7a,0xc4,0xb4,0xcf,0xb8,0x5a,
+0x6b,0x72,0x3d,0xb4,0xca,0x7a,0x56,0x53,0x4b,0x7b,0x76,0x83,
+0x71,0xee,0x97,0x34,0x95,0xeb,0x70,0xec,0xdc,0xd7,0x61,0x5d,
+0x88,0xd8,0x7a,0xda,0x19,0xc6,0xbb,0x5b,0xd5,0x50,0x7e,0x25,
+0x56,0x53,0xa2,0x9a,0x44,0xee,0x27,0xe4,0x3a,0xd7,0xf5,0x04,
+0xdf,0xb4,0xc5,0x39,0x62,0x52,0xf7,0x3d,0x53,0x88,0xad,0xc3,
+0xb5,0x8e,0x35,0x93,0x31,0xd3,0x80,0x18,0xec,0x7a,0x1d,0xd6,
+0x3d,0xc2,0xf0,0xeb,0x9b,0xb8,0x1f,0xae,0x8c,0xc7,0x0f,0x05,
+0x1a,0x12,0xe6,0xd0,0xf0,0x31,0x8e,0xa1,0xaf,0xd8,0x7c,0x48,
+0x04,0x9b,0xeb,0x40,0xc2,0x6c,0xa1,0x1a,0x03,0x9d,0x10,0x37,
+0x62,0x7a,0x75,0x3f,0xed,0x5c,0x1d,0xff,0x1c,0x45,0xfc,0xab,
+0xa4,0xb4,0x97,0xd7,0x5c,0xc4,0x78,0xa0,0x46,0xc1,0x56,0x86,
+0x0f,0xb8,0xa9,0x27,0xd5,0xcc,0xc2,0xb8,0x5b,0xab,0x21,0x2b,
+0x43,0xca,0x17,0xc2,0x84,0x90,0x10,0xfa,0xf0,0xfb,0x03,0x47,
+0xc8,0xf4,0xd2,0x28,0xac,0x56,0x70,0x4b,0xaa,0xd4,0xcb,0xb6,
+0xf4,0xb1,0x54,0x69,0x32,0x0d,0x74,0x76,0x6a,0x75,0xf0,0xef,
+0x56,0x26,0xa8,0xd3,0xad,0xa9,0x5d,0x83,0xe3,0x64,0xab,0x2b,
+0xef,0x96,0x2a,0x61,0x6a,0x99,0x43,0x9d,0x0f,0x3e,0xb9,0xaf,
+0x0a,0xb0,0xc1,0x6c,0x38,0x24,0x71,0x0d,0xc1,0x11,0xdf,0x66,
+0xb7,0xda,0xe9,0xf2,0xbe,0x6d,0x6c,0xa8,0x8a,0x1a,0xef,0xe4,
+0x9f,0x19,0xd9,0xae,0xc1,0xef,0x52,0xa4,0x15,0x77,0xf3,0x33,
+0xe0,0x53,0xda,0xfb,0x82,0x19,0x20,0x04,0xa2,0x2a,0xa7,0x75,
+0x2a,0xfa,0xfe,0xdd,0x1e,0xf8,0x77,0x75,0x70,0x3c,0xcf,0x47,
+0x64,0x4e,0x80,0x5d,0xd9,0x13,0xdd,0x7d,0xa8,0xc3,0x27,0x25,
+0x1e,0x72,0x3a,0x32,0x7e,0xa7,0x1a,0x58,0x96,0x9a,0x84,0x38,
+0x41,0x7a,0xb2,0x94,0x43,0x82,0x87,0x32,0xcb,0x5e,0x28,0xd8,
+0xa5,0xf4,0x2c,0xff,0x2e,0xfd,0x9b,0x23,0x6a,0xe2,0x9e,0x70,
+0x62,0x2a,0x4f,0xc0,0xd1,0xb1,0xc1,0xe0,0x18,0xac,0x45,0xd8,
+0x2f,0xa3,0x01,0x2b,0x54,0x76,0x77,0xe6,0xe4,0xd7,0xa1,0x90,
+0x34,0x0d,0x0b,0x5f,0x05,0x9a,0xb8,0xef,0x55,0x19,0xc6,0xe5,
+0x8a,0x69,0x6f,0x4d,0xab,0x18,0x85,0xa9,0x96,0xa0,0xc0,0xc9,
+0x1d,0x09,0x35,0x85,0x19,0xd5,0x65,0x3c,0xa6,0x45,0x43,0x60,
+0x25,0x4d,0xe4,0x3f,0x3b,0xb3,0x25,0x34,0xf6,0xc3,0xd1,0x7a,
+0x4d,0x8d,0xb9,0x71,0xfe,0x4c,0x81,0x6b,0xba,0x62,0x56,0x30,
+0x10,0x16,0x68,0x6c,0x98,0xb3,0x49,0xf0,0xe0,0x25,0x74,0x77,
+0xb3,0xda,0xba,0x31,0xdd,0x04,0x53,0xa5,0xb6,0xd8,0xae,0x03,
+0x9b,0x71,0x77,0x3e,0xb9,0x87,0xbe,0x39,0x4f,0x38,0x28,0x9f,
+0x26,0x75,0x51,0x11,0x47,0xfa,0x7c,0x38,0x4c,0x70,0x59,0xeb,
+0xec,0x18,0x54,0xfb,0x1e,0xf4,0x81,0x51,0xda,0x64,0x56,0x0e,
+0x64,0x48,0xf3,0x63,0xe4,0x87,0x4d,0xd7,0x09,0x02,0x29,0x46,
+0x7a,0xcb,0xbb,0xb5,0x3a,0xac,0xd7,0xd7,0x0d,0x2c,0x5c,0xff,
+0xe8,0x33,0x82,0x70,0xee,0x8b,0xa9,0xb9,0x5b,0x83,0x6f,0x61,
+0xab,0xfb,0x62,0xeb,0xc5,0xce,0xf3,0xee,0x8b,0x1d,0xd8,0xc8,
+0x02,0x74,0xba,0x29,0x53,0xd2,0x55,0x50,0xfe,0x59,0x3c,0x67,
+0xd5,0x3a,0xf9,0xa4,0x49,0xeb,0x91,0xb2,0x49,0x9b,0xe1,0x75,
+0x67,0xa7,0x8e,0xa3,0x53,0x3e,0x91,0x33,0x75,0xba,0xbb,0x25,
+0xd3,0xd8,0x5c,0x55,0xb9,0x34,0xf8,0x1e,0x33,0x4b,0x11,0x12,
+0xc2,0xb3,0x67,0x82,0x9b,0x2f,0xd9,0xef,0x1b,0xdf,0xbb,0xcd,
+0x1f,0xe4,0x64,0x09,0xf4,0x05,0xf0,0x06,0x74,0xd2,0x52,0xcd,
+0xd0,0x20,0x76,0xa7,0x26,0xff,0xb7,0x6a,0x39,0x8a,0xa1,0x4e,
+0xc2,0xd7,0xdd,0x3d,0xa0,0xf1,0x8c,0x3c,0xd4,0x96,0x4e,0x35,
+0xc3,0x1e,0x31,0x26,0x21,0xdc,0x93,0x01,0x9f,0x77,0x89,0x38,
+0xec,0x8f,0x08,0x05,0x3a,0x8e,0xa3,0xd9,0x68,0x5c,0x17,0xaa,
+0x5b,0xc2,0xed,0x6b,0x09,0x0c,0xa3,0x20,0x88,0xee,0x89,0xc7,
+0xf4,0x4c,0x8e,0xe4,0x8a,0x29,0x76,0x8d,0x2b,0x12,0x52,0x38,
+0xc2,0xf9,0x92,0x40,0x84,0xc2,0xeb,0xf8,0x01,0x4a,0x04,0xaa,
+0x79,0x75,0x18,0x2c,0x00,0x8f,0x02,0x30,0x8d,0x02,0xfc,0xda,
+0x84,0x37,0x11,0x33,0x85,0x04,0x3e,0xea,0x89,0xa9,0xaa,0x8c,
+0xb3,0x30,0xb5,0x83,0x70,0xcd,0x51,0x11,0xc8,0x6c,0x0f,0x74,
+0x4c,0x16,0x15,0xa6,0x01,0x32,0x6b,0x01,0xcc,0xa6,0x08,0x17,
+0x85,0xa4,0x0e,0x13,0x3f,0x9c,0x09,0x3b,0x04,0xd6,0xa3,0x8b,
+0x29,0x36,0x65,0x68,0x2a,0x48,0xdf,0x15,0x43,0x56,0x9d,0xc5,
+0x81,0x61,0x4f,0x60,0x5f,0x71,0x67,0xc5,0x75,0x6b,0xcf,0x64,
+0xde,0x43,0x1d,0xa2,0x29,0x09,0x09,0xce,0x37,0xa6,0x16,0x89,
+0x43,0x4a,0x6a,0x42,0x64,0x1d,0xb1,0x2d,0x52,0xec,0x53,0x53,
+0x2c,0x42,0x6a,0x51,0xca,0xae,0x74,0xd5,0xdf,0x3d,0x26,0x97,
+0xcc,0xf8,0xc5,0x57,0x30,0x7f,0xb8,0xc8,0x54,0x7e,0x48,0x0f,
+0x6b,0x05,0xd5,0x35,0x53,0x66,0xba,0x72,0x89,0xf5,0x44,0x49,
+0x80,0x49,0x3a,0xf6,0x4b,0x33,0x5a,0xa8,0x6e,0xa2,0x38,0xe5,
+0x9a,0xe3,0xc0,0x3a,0x1e,0xce,0xba,0x59,0xec,0xca,0xd5,0xf3,
+0x88,0xb3,0x18,0xbf,0x20,0x8b,0xab,0xeb,0x8c,0x92,0x64,0xbd,
+0xa6,0xd6,0x78,0x2c,0x12,0xb8,0xa0,0xcf,0x1a,0xcc,0x94,0x94,
+0xac,0xfe,0x8a,0xd3,0x9a,0x95,0x50,0xeb,0x6a,0xad,0x07,0x0f,
+0x19,0x64,0x24,0x8e,0xa3,0x58,0x47,0x95,0xf6,0x55,0xc0,0xb8,
+0x41,0x94,0x90,0xaa,0xb1,0xc0,0x73,0x2e,0xe4,0x47,0x2b,0x03,
+0xaa,0xd6,0xe0,0xf5,0x75,0xf9,0x49,0xb3,0x06,0x45,0x41,0x50,
+0xcd,0x6e,0xf8,0x31,0xf9,0x4d,0xf0,0xe9,0xc7,0xd3,0x93,0x77,
+0x94,0x4e,0x2f,0xc9,0x6f,0x33,0x92,0xd0,0x14,0x27,0x20,0x4c,
+0x93,0x31,0x7a,0xfd,0xbb,0xa3,0xeb,0xf5,0x3a,0x30,0x2e,0x22,
+0xb6,0xf5,0x1a,0x6c,0xb0,0xe5,0xe6,0x35,0xac,0x3f,0xf3,0xbd,
+0x3e,0xda,0x1e,0x7d,0x0f,0xf6,0x60,0x7d,0xbd,0x96,0xad,0x1f,
+0x06,0x91,0xe3,0xd9,0xbb,0x9d,0x5a,0x9b,0x7e,0x6b,0x26,0xd4,
+0xa1,0xb3,0x04,0xbe,0xe9,0x43,0xb7,0xdd,0x56,0xfd,0xe5,0xdd,
+0xc7,0xd5,0xac,0xa8,0xe7,0x69,0x7f,0xa6,0xc1,0xc2,0x34,0xda,
+0x22,0xda,0x98,0x24,0xd3,0x28,0x4c,0x08,0x2a,0xcd,0x46,0x1d,
+0xc6,0x2d,0x56,0xa9,0xe9,0x7b,0xbd,0x0c,0x41,0xdf,0x48,0xb6,
+0xeb,0x62,0x26,0xfb,0x84,0x55,0xb8,0x28,0x35,0x87,0x51,0x7c,
+0xe4,0xb8,0xe3,0xaa,0x90,0x05,0x03,0x90,0x73,0x3d,0xfd,0xf2,
+0x90,0xe5,0x8b,0x4d,0x1e,0x8c,0x31,0xcf,0x75,0x39,0x8b,0x83,
+0xe9,0x35,0xda,0x16,0x51,0xd5,0x97,0x56,0x30,0x65,0x26,0x7f,
+0x58,0xe2,0x2b,0xa8,0x3a,0x29,0x99,0x67,0x24,0x63,0xa2,0xd9,
+0x47,0x0f,0xb9,0x8e,0x7b,0x84,0x3a,0x96,0x70,0x13,0x7e,0x35,
+0x1d,0x5d,0x34,0x6d,0xef,0x41,0xa7,0xdd,0xae,0xa7,0x64,0x47,
+0xf7,0xc9,0x1e,0x6c,0x6a,0x5f,0x66,0x09,0xb9,0x42,0xa7,0x0b,
+0xdf,0x37,0xd2,0xef,0x89,0x1b,0x13,0x82,0x47,0xa9,0x84,0x97,
+0xa8,0x5e,0xca,0xfe,0xf2,0x03,0x07,0x0e,0x90,0x17,0xb9,0x33,
+0x3c,0xf3,0x37,0xd1,0xf7,0x93,0x5f,0x9a,0x18,0xfb,0xb2,0x8c,
+0x66,0xb5,0x3d,0x82,0xd6,0xe3,0x85,0xc1,0x5a,0x1c,0x01,0x93,
+0x17,0xf8,0xbf,0x25,0x27,0xcb,0x5e,0x46,0x55,0x50,0x63,0xa2,
+0xf1,0xea,0xcb,0x8e,0x78,0xf2,0x90,0xc7,0x8d,0xf0,0x7d,0x08,
+0x67,0x41,0x50,0x57,0x46,0x79,0x63,0x33,0x58,0xf9,0x2c,0x26,
+0x4c,0x81,0x0b,0x4a,0x12,0xe8,0x5b,0x8f,0x11,0x76,0x55,0x5a,
+0xb6,0xfa,0x5a,0x9a,0x3e,0x19,0x8a,0x1a,0xec,0x71,0x5c,0x9a,
+0x44,0x16,0x6d,0x13,0x25,0xfa,0xf4,0x4a,0x1a,0x75,0x0a,0x6c,
+0x3a,0x6f,0x4a,0x5c,0x38,0x16,0x0d,0xba,0xc8,0x9d,0x63,0x1b,
+0x49,0x7d,0x34,0xad,0x1e,0x9a,0x31,0x09,0x82,0x68,0x1d,0x97,
+0x2a,0xf6,0xdd,0x75,0xa6,0xce,0xc0,0x0f,0x7c,0xea,0x93,0x04,
+0x0d,0xbb,0x37,0xb7,0xb5,0xa6,0x1f,0x7a,0x64,0x7e,0x3e,0x54,
+0x0e,0x81,0xf5,0x1a,0xbc,0xea,0x43,0x3b,0xdb,0x70,0x3a,0xc8,
+0xca,0xe9,0x90,0x1d,0xc0,0x12,0xe5,0x0c,0x21,0x2c,0xca,0x98,
+0x36,0x18,0xf9,0x01,0xcd,0x6c,0xf6,0xbf,0x63,0xa7,0xf6,0x64,
+0x97,0xea,0xca,0x71,0xb9,0x97,0x75,0x61,0xd6,0x41,0xef,0xe6,
+0x1e,0xdc,0xa8,0x9e,0xdd,0x3e,0xd4,0x32,0xed,0xa5,0xa2,0xaa,
+0x6f,0xe8,0x59,0xb6,0xae,0x7a,0x54,0xd2,0x6b,0x31,0xd5,0x97,
+0x73,0xaa,0x96,0x1e,0xc7,0xd9,0xef,0x6a,0xf1,0x31,0xaa,0xf6,
+0x04,0x4d,0x57,0xab,0x5e,0xa2,0xef,0x66,0xf5,0xdb,0x7b,0x3f,
+0xf4,0xa2,0xfb,0x92,0x9d,0x50,0x77,0x0e,0x43,0x1f,0xaa,0x41,
+0xe4,0x3a,0x08,0xd0,0x4c,0x3f,0xa2,0x80,0x51,0x3a,0x4d,0xf6,
+0xd6,0x6b,0xb8,0xe9,0xde,0x27,0xc9,0x3a,0x6e,0xb7,0xf7,0xc9,
+0xba,0xc2,0x60,0x48,0x5c,0x1f,0xd6,0x85,0x9f,0xb5,0x2e,0x3c,
+0x8f,0xb8,0x63,0x0b,0x4a,0x2c,0x4e,0x2a,0x44,0x5a,0x97,0x83,
+0xc7,0x37,0xf2,0xd4,0x4e,0x34,0x76,0x42,0x2f,0x19,0x3b,0x9f,
+0x88,0x41,0x5c,0x42,0x9c,0xd8,0x1d,0xc3,0x6b,0xc8,0x7e,0xd9,
+0x80,0xf5,0x67,0x0c,0xc7,0x6b,0xa6,0x27,0xac,0xcb,0x5e,0x30,
+0x35,0x21,0x23,0x41,0x0c,0x58,0xa7,0x9c,0x01,0xe9,0x1f,0x38,
+0x44,0xe0,0x93,0x90,0xf6,0x07,0xb8,0x7d,0x90,0x78,0xbd,0x97,
+0x57,0x96,0x71,0xa4,0x7e,0x20,0x03,0xa1,0x52,0xcb,0x56,0x36,
+0xd6,0xf7,0x5a,0xad,0xf5,0x0d,0x45,0xe1,0x38,0x4a,0x68,0xfa,
+0x6b,0xea,0xd0,0x31,0x1e,0xde,0x36,0x54,0x07,0xb5,0x4e,0xf3,
+0x95,0x1d,0xfa,0x69,0xf7,0xd0,0xca,0xda,0x4c,0x02,0xdf,0x25,
+0xd5,0x8e,0x69,0x27,0xe0,0x5e,0xea,0x6b,0xb6,0x14,0xc0,0x3a,
+0x3b,0xbd,0x71,0x55,0x77,0x5d,0xfa,0x10,0x6c,0x5b,0x6d,0x4f,
+0xba,0x33,0x0e,0x82,0x28,0xc1,0x13,0xca,0x80,0x0c,0xa3,0x98,
+0x80,0x4f,0x99,0xdf,0x54,0x28,0x3f,0x75,0xf3,0xe8,0x01,0xf7,
+0x4e,0x02,0x81,0xff,0x89,0x04,0xc2,0xc9,0xc1,0x6d,0xcf,0x4b,
+0xb6,0x3b,0x06,0xa1,0xe8,0xd0,0x0f,0x1f,0x0a,0x8a,0xc6,0x4e,
+0x98,0xa0,0x21,0xd6,0x72,0xf0,0xcd,0x71,0x0c,0x07,0xa5,0x85,
+0x23,0xa5,0x6a,0xc1,0x46,0x2a,0x26,0xe9,0xfa,0x9f,0xe9,0x2b,
+0x9f,0x13,0xbd,0xb5,0x87,0x1a,0xb7,0x0b,0xd0,0xb1,0x8f,0xbb,
+0xc5,0xcb,0x96,0x0c,0xb7,0x50,0x71,0x17,0xad,0x6f,0xbf,0x5d,
+0x83,0x6f,0xf9,0xcc,0xfc,0x98,0x40,0x03,0x9c,0x10,0xe6,0xf8,
+0x0b,0xc8,0x64,0x16,0x38,0x34,0x8a,0xb1,0xf8,0x20,0x9a,0x2e,
+0x62,0x7f,0x34,0xa6,0x50,0x75,0x6b,0xd0,0x6d,0x77,0xba,0x8d,
+0x6e,0xbb,0xb3,0x59,0x87,0x83,0x71,0xec,0x27,0x34,0x42,0x6f,
+0x04,0xfc,0x1b,0x19,0x0e,0x63,0xb2,0x80,0xea,0xe9,0xf1,0x35,
+0x9c,0xf8,0x2e,0x09,0x13,0x52,0xc3,0xda,0x7c,0x42,0xb5,0x5a,
+0x23,0x9f,0x8e,0x67,0x83,0xa6,0x1b,0x4d,0x5a,0xee,0xf8,0xe3,
+0xc7,0x96,0x68,0x74,0x0d,0x18,0x09,0x17,0xa8,0xd7,0xa8,0x63,
+0xe7,0x98,0xc4,0x64,0xb0,0x80,0x51,0xec,0x84,0xcc,0x5f,0x3e,
+0x8c,0x09,0x81,0x68,0xc8,0x02,0x52,0x46,0xa4,0x0e,0x34,0x62,
+0x4e,0xe6,0x29,0x89,0x93,0x28,0x84,0x68,0x40,0x1d,0x3f,0xc4,
+0xa1,0x75,0xc0,0x8d,0xa6,0x0b,0xc4,0xc7,0xdc,0x54,0x7e,0x02,
+0x49,0x34,0xa4,0xf7,0xcc,0x61,0x13,0x7a,0xe0,0x24,0x49,0xe4,
+0x32,0x17,0x3c,0x48,0x65,0xc6,0xe1,0x4a,0x9a,0x1f,0x90,0x04,
+0xaa,0x28,0x02,0xeb,0x57,0xa2,0xc6,0x7a,0x8d,0xb5,0xe3,0x11,
+0x27,0x40,0x84,0xdc,0x03,0x02,0xb2,0x94,0x1d,0x88,0xa3,0x19,
+0x85,0x18,0x95,0x1b,0x5f,0xb8,0xe5,0xfd,0xd0,0x0d,0x66,0xcc,
+0x69,0x26,0x8b,0x03,0x7f,0xe2,0x8b,0x46,0xb0,0x3a,0x63,0x63,
+0xc2,0x78,0x1e,0xc1,0x2c,0x21,0x75,0x46,0x70,0x1d,0x26,0x91,
+0xe7,0x0f,0xf1,0x5f,0xc2,0xfa,0x37,0x9d,0x0d,0x02,0x3f,0x19,
+0xd7,0xc1,0xf3,0x11,0xfb,0x60,0x46,0x49,0x1d,0x12,0xfc,0xc8,
+0xf8,0x5a,0xc7,0xde,0xb4,0x22,0x9c,0x3d,0x01,0x23,0xce,0x8d,
+0xa6,0x38,0x87,0xa3,0xa1,0x41,0x23,0x03,0xc3,0x86,0xa6,0xc8,
+0x5c,0x2a,0xd8,0x95,0xe0,0x97,0xfb,0x71,0x34,0x31,0x60,0xc1,
+0x67,0x54,0x0d,0x67,0x71,0xe8,0xb3,0xc8,0x02,0xec,0x7a,0x04,
+0x49,0xc4,0xda,0xfd,0x48,0x5c,0x8a,0x5f,0xb0,0x06,0x97,0x6e,
+0xec,0xa3,0x1b,0x85,0xdc,0xca,0x92,0xec,0x89,0x51,0xbc,0x1e,
+0x13,0x70,0x06,0xd1,0x1d,0x61,0xdd,0x62,0x9d,0x85,0x30,0xa2,
+0xbe,0x72,0x5e,0xf9,0x09,0x4c,0xd3,0x91,0x16,0x45,0xc9,0xd8,
+0x09,0x02,0x18,0x10,0xc1,0x3e,0xe2,0x81,0x1f,0x22,0x36,0xfc,
+0x2a,0x7b,0x16,0x23,0x19,0x09,0x75,0x42,0xea,0x3b,0x01,0xe0,
+0x54,0xc0,0x76,0xb3,0x3d,0x6e,0x4a,0x3a,0xde,0x1d,0xc1,0xd5,
+0xf9,0xdb,0xeb,0x1f,0xf6,0x2f,0x8f,0xe0,0xf8,0x0a,0x2e,0x2e,
+0xcf,0x3f,0x1c,0x1f,0x1e,0x1d,0xc2,0xfa,0xfe,0x15,0x1c,0x5f,
+0xad,0xd7,0xe1,0x87,0xe3,0xeb,0x77,0xe7,0xef,0xaf,0xe1,0x87,
+0xfd,0xcb,0xcb,0xfd,0xb3,0xeb,0x9f,0xe0,0xfc,0x2d,0xec,0x9f,
+0xfd,0x04,0xdf,0x1f,0x9f,0x1d,0xd6,0xe1,0xe8,0xc7,0x8b,0xcb,
+0xa3,0xab,0x2b,0x38,0xbf,0x44,0x6c,0xc7,0xa7,0x17,0x27,0xc7,
+0x47,0x87,0x75,0x38,0x3e,0x3b,0x38,0x79,0x7f,0x78,0x7c,0xf6,
+0x1d,0xbc,0x79,0x7f,0x0d,0x67,0xe7,0xd7,0x70,0x72,0x7c,0x7a,
+0x7c,0x7d,0x74,0x08,0xd7,0xe7,0xac,0x4d,0x81,0xed,0xf8,0xe8,
+0x0a,0xf1,0x9d,0x1e,0x5d,0x1e,0xbc,0xdb,0x3f,0xbb,0xde,0x7f,
+0x73,0x7c,0x72,0x7c,0xfd,0x53,0x1d,0x71,0xbd,0x3d,0xbe,0x3e,
+0x43,0xcc,0x6f,0xcf,0x2f,0x61,0x1f,0x2e,0xf6,0x2f,0xaf,0x8f,
+0x0f,0xde,0x9f,0xec,0x5f,0xc2,0xc5,0xfb,0xcb,0x8b,0xf3,0xab,
+0x23,0xd8,0x3f,0x3b,0x84,0xb3,0xf3,0xb3,0xe3,0xb3,0xb7,0x97,
+0xc7,0x67,0xdf,0x1d,0x9d,0x1e,0x9d,0x5d,0x37,0xe1,0xf8,0x0c,
+0xce,0xce,0xe1,0xe8,0xc3,0xd1,0xd9,0x35,0x5c,0xbd,0xdb,0x3f,
+0x39,0xc1,0xd6,0x10,0xdd,0xfe,0xfb,0xeb,0x77,0xe7,0x97,0x48,
+0x28,0x1c,0x9c,0x5f,0xfc,0x74,0x79,0xfc,0xdd,0xbb,0x6b,0x78,
+0x77,0x7e,0x72,0x78,0x74,0x79,0x05,0x6f,0x8e,0xe0,0xe4,0x78,
+0xff,0xcd,0xc9,0x11,0x6f,0xed,0xec,0x27,0x38,0x38,0xd9,0x3f,
+0x3e,0xad,0xc3,0xe1,0xfe,0xe9,0xfe,0x77,0x47,0xac,0xd6,0xf9,
+0xf5,0xbb,0x23,0xd6,0xc9,0x93,0x63,0x49,0x26,0xfc,0xf0,0xee,
+0x08,0xbf,0x62,0xab,0xfb,0x67,0xb0,0x7f,0x70,0x7d,0x7c,0x7e,
+0x86,0xfd,0x39,0x38,0x3f,0xbb,0xbe,0xdc,0x3f,0xb8,0xae,0xc3,
+0xf5,0xf9,0xe5,0xb5,0xaa,0xfd,0xc3,0xf1,0xd5,0x51,0x1d,0xf6,
+0x2f,0x8f,0xaf,0x90,0x33,0x6f,0x2f,0xcf,0x4f,0x59,0x4f,0x91,
+0xbb,0xe7,0x6f,0x11,0xea,0xf8,0x0c,0xab,0x9e,0x1d,0x71,0x44,
+0xc8,0x79,0x73,0x80,0xce,0x2f,0xd9,0xef,0xf7,0x57,0x47,0x0a,
+0x27,0x1c,0x1e,0xed,0x9f,0x1c,0x9f,0x7d,0x77,0x05,0xc7,0x67,
+0xd9,0x01,0x95,0x83,0x7c,0x1e,0xfb,0x23,0x3c,0x0a,0x05,0x0b,
+0x18,0x46,0xf1,0x27,0xe9,0xb2,0xac,0x2a,0x97,0x28,0xfa,0x42,
+0xa3,0xb8,0xa2,0x8b,0x5c,0x0d,0x25,0x15,0x00,0xde,0x3a,0x83,
+0x18,0x45,0xef,0x0d,0x09,0x02,0x27,0xf6,0x2a,0x09,0x7c,0x74,
+0xee,0x1c,0xbe,0x2c,0xc2,0x1d,0xed,0x60,0xdc,0x4c,0x14,0xc3,
+0xc7,0x24,0xf0,0xc3,0xd9,0x5c,0x54,0xc2,0x95,0x6c,0xaf,0xd5,
+0x1a,0xf0,0x3a,0xcd,0x28,0x1e,0xb5,0x04,0x40,0x8b,0x03,0xe4,
+0x16,0xca,0x4e,0xb6,0x21,0x0e,0x87,0xd3,0x24,0x12,0xd4,0x83,
+0x47,0xd0,0x09,0x08,0x31,0x99,0x38,0x7e,0x98,0x34,0x59,0xa1,
+0x0a,0xd4,0xf2,0x69,0x42,0x82,0xa1,0x68,0xde,0x49,0x60,0x40,
+0x48,0x08,0x64,0x4e,0xd1,0xc5,0xcc,0xe6,0xa8,0x98,0x32,0x62,
+0xd5,0x3e,0xb8,0x3a,0x06,0xd4,0xa8,0x92,0x3a,0x38,0x93,0x28,
+0x1c,0xf1,0x8a,0x11,0xc5,0x05,0x7a,0x48,0x1c,0x3a,0x8b,0x59,
+0xb0,0xd6,0xb7,0xad,0xb5,0x6c,0xc8,0x9d,0xdc,0x0a,0xe4,0xf9,
+0x12,0x8e,0xd8,0x06,0x80,0xb3,0xf4,0x92,0x0c,0x49,0x4c,0x42,
+0x97,0x24,0x26,0x1f,0x18,0x9b,0x9a,0x21,0xa1,0x2d,0xe3,0xb3,
+0x1f,0xde,0xf9,0x89,0x3f,0x08,0x48,0xc3,0x4f,0x02,0x27,0xf4,
+0x18,0x04,0x23,0xaf,0xe5,0xd2,0x20,0x21,0xbf,0x25,0xf2,0xdf,
+0x26,0x9d,0xd3,0xa7,0x56,0xc5,0x30,0xc5,0xe5,0x75,0xef,0x28,
+0x25,0x49,0x86,0xbe,0xfb,0xfb,0xfb,0xa6,0x1f,0xde,0x3b,0x53,
+0xb6,0x15,0x4d,0xbd,0x69,0xa7,0xdd,0x72,0xc2,0xc4,0x47,0xbe,
+0xe5,0x28,0x62,0xa3,0xdb,0xf4,0x7c,0xc2,0xd0,0x4d,0x9c,0xb0,
+0xb5,0xd5,0x72,0xa3,0x30,0x89,0x02,0xf2,0x0b,0x63,0xf4,0x12,
+0xe8,0xe7,0xad,0x59,0x3c,0xbf,0xa3,0x9c,0xe5,0x95,0x59,0xc2,
+0x02,0xbb,0x7c,0x97,0x56,0x7a,0x8a,0xe3,0x57,0xe8,0xb5,0xf4,
+0x38,0x04,0x8b,0x57,0x62,0xda,0x23,0xf4,0xd9,0x6a,0xb9,0x06,
+0x50,0x57,0x7b,0x95,0xf8,0xd6,0x94,0xbf,0x53,0x1c,0xcc,0x08,
+0x77,0x34,0xf1,0x29,0x25,0x31,0xc7,0x24,0x07,0xd7,0x28,0x12,
+0x3a,0x0a,0x43,0xf2,0x0b,0x37,0xae,0x40,0xdf,0xfc,0xf9,0xf9,
+0x33,0x73,0x35,0x3e,0xac,0xad,0xe9,0x15,0x35,0x77,0x83,0xe3,
+0x79,0x27,0x7e,0x42,0x49,0x48,0x0c,0xab,0x0a,0x96,0xd5,0x21,
+0x10,0x25,0xf9,0x76,0x6e,0x10,0xe0,0x16,0xfa,0xb6,0x8f,0xec,
+0xdc,0xd6,0xb3,0x56,0xe0,0x91,0x2b,0x0a,0x6d,0x6f,0xed,0xa1,
+0x57,0x48,0x19,0x8b,0xf5,0x5c,0x4e,0x75,0x31,0x82,0x98,0x4c,
+0xa2,0x3b,0xb2,0x6a,0xef,0x98,0x05,0x2b,0x4f,0x71,0x6a,0xff,
+0x17,0xf1,0xa8,0xd1,0xe0,0xa3,0xb5,0xdb,0x6b,0x00,0x00,0x75,
+0xf0,0xa1,0x8f,0x20,0x2a,0x02,0x67,0x0d,0x30,0xa4,0x22,0x20,
+0x50,0xf5,0x1b,0x0d,0xde,0x12,0x6f,0x2b,0x1a,0x7c,0x64,0xb1,
+0xa0,0xfd,0xbe,0x22,0x04,0x39,0xc7,0x3f,0x37,0xd5,0x27,0xbd,
+0x5c,0x33,0xf3,0x0e,0x3e,0x36,0x93,0x29,0x53,0xaa,0xfd,0xba,
+0x0a,0xba,0xc9,0x87,0x54,0x3e,0x94,0x32,0x78,0x38,0x2c,0xe6,
+0xb0,0xc9,0xbc,0x65,0x4c,0xde,0x0f,0x02,0x09,0x9a,0x64,0x19,
+0x9d,0xb2,0xd7,0xc6,0x5d,0x8f,0x04,0x84,0x12,0x0b,0x3f,0x97,
+0xc8,0x86,0x4b,0x96,0x0d,0xa8,0x2c,0x84,0xcc,0x99,0xd1,0x89,
+0x47,0x89,0xc5,0xef,0xc6,0x8e,0x28,0x5c,0xc1,0x76,0xe2,0x11,
+0x9b,0x90,0xd2,0x26,0xc3,0x88,0x33,0x19,0x22,0x5a,0x8c,0x42,
+0x33,0x0e,0x49,0x52,0xd0,0x74,0xa6,0xd3,0x60,0xc1,0x3a,0x5c,
+0x67,0x0d,0x8a,0xb0,0x0b,0x80,0x28,0xd4,0xc6,0x56,0xc1,0xf7,
+0xd6,0x14,0x0a,0xd6,0x58,0x14,0xea,0x0d,0x94,0x30,0x82,0x4c,
+0x7c,0x5a,0xcc,0xf0,0x55,0xe4,0xf9,0x11,0xec,0x40,0x49,0x13,
+0x62,0xbe,0x64,0x16,0x04,0xc6,0x2c,0xd0,0xa6,0x46,0x9b,0xb5,
+0xcb,0xa2,0xc3,0x78,0x8c,0x74,0x20,0x42,0xa3,0xf9,0xf8,0x08,
+0xe9,0x2f,0xe0,0x5e,0x09,0x1f,0x82,0x72,0xe9,0xd3,0x79,0xbb,
+0xfa,0x0a,0xf6,0xa0,0xad,0xea,0xd4,0xa1,0x24,0x49,0x57,0xf5,
+0x30,0x8a,0x27,0x0e,0xf6,0xb2,0xcd,0x96,0x74,0x92,0xb8,0xce,
+0x94,0xf9,0x5d,0x3a,0xec,0xb7,0x9b,0x60,0x67,0xbb,0xec,0xef,
+0x28,0x71,0xa1,0x0f,0x9b,0xfc,0x3b,0x8f,0xc0,0x87,0x3e,0x6c,
+0xb1,0xdf,0x9e,0x8b,0x04,0x6f,0xb3,0xbf,0xfd,0x51,0x18,0xc5,
+0x04,0xfa,0xb0,0xd3,0xcb,0x6d,0xdf,0x99,0x4d,0x40,0x7e,0xae,
+0x46,0x53,0xfc,0x9d,0xf0,0x4e,0xf2,0xf3,0x77,0x30,0x14,0x7d,
+0xea,0xad,0x49,0x29,0x60,0x9c,0x04,0x3f,0x44,0x7d,0xdb,0x25,
+0xd1,0x50,0xd5,0xaf,0x65,0x42,0xaa,0x0c,0x8b,0xb4,0x1a,0xf6,
+0x9b,0xf6,0x6d,0x1d,0xd2,0x5f,0x1d,0xe3,0x57,0xf7,0x36,0x8d,
+0x28,0x32,0xc6,0x46,0x3f,0xaa,0xae,0x19,0xe6,0x49,0x41,0x34,
+0x5b,0xda,0x2a,0xe1,0x6c,0x32,0x20,0x71,0x45,0x09,0x80,0x2c,
+0x13,0xbf,0xa5,0x39,0xdc,0x20,0x66,0x4d,0xb7,0x8a,0x1b,0x84,
+0x89,0x12,0x3c,0x53,0x07,0x24,0xde,0x33,0xe8,0xcc,0xd8,0x97,
+0xd2,0x96,0xe4,0x5f,0x62,0xaf,0x5c,0x03,0x16,0x4c,0x57,0xc5,
+0x28,0xe9,0xaa,0xe4,0x46,0xd3,0x23,0x43,0x67,0x16,0xd0,0xa4,
+0xa6,0xd9,0x85,0x3f,0x91,0x85,0xb1,0xa2,0x73,0x3c,0x37,0x9f,
+0xc8,0x02,0xd7,0x75,0x66,0x6c,0xd6,0x3d,0x73,0x7a,0xa9,0x62,
+0x73,0x53,0xff,0x2e,0x97,0xf1,0x56,0x0b,0x4e,0xc8,0xc8,0x71,
+0x17,0x7b,0x9a,0x79,0x5d,0xd6,0xe0,0x18,0xbe,0xe9,0xf7,0x21,
+0x47,0x1c,0x2b,0x4a,0x9b,0x2c,0x6c,0xd4,0x68,0xec,0x41,0x73,
+0x07,0xa2,0xf8,0x48,0xe0,0x2c,0x61,0x0f,0xe9,0x40,0x8a,0x22,
+0x8c,0xc2,0x8f,0x62,0x19,0xc9,0xc9,0xc6,0x73,0x37,0x33,0x90,
+0x02,0x04,0xfa,0x99,0x0f,0xe8,0x14,0x75,0x1d,0x9a,0xf2,0xf7,
+0x17,0xf1,0x9d,0x5b,0x8a,0x84,0x0f,0xff,0x01,0x48,0x90,0x90,
+0x25,0x4d,0x76,0x76,0xbe,0x4e,0x9b,0x9d,0x9d,0xc7,0x34,0xda,
+0x5e,0xb5,0x51,0x8e,0xbc,0x5d,0x87,0x46,0xb7,0x26,0x29,0x10,
+0x9c,0x2f,0xea,0x3c,0x83,0xad,0xdb,0x11,0x35,0xba,0x8f,0xa1,
+0xf2,0xb1,0xc3,0x51,0x4e,0x58,0x67,0x67,0x25,0xca,0xa4,0xe6,
+0x57,0xd0,0x56,0x6f,0x4d,0x02,0xe4,0xa6,0x60,0x6f,0x4d,0xba,
+0xff,0x59,0xf5,0x90,0xdd,0x4a,0xd1,0xeb,0xf3,0x2f,0x9f,0x3f,
+0x0b,0xad,0xba,0xa7,0x81,0x6b,0x5a,0xb5,0x84,0x57,0x9f,0x3e,
+0x7f,0x86,0x54,0xc9,0x16,0x8d,0x4f,0x9d,0xd8,0x84,0x66,0x57,
+0xa0,0x3e,0x7f,0x56,0xbf,0x39,0xc0,0x1a,0x00,0xe0,0x57,0xe5,
+0x2e,0x83,0xd7,0x0a,0x17,0x06,0xd3,0x1c,0x05,0x04,0xff,0x4c,
+0xde,0x2c,0xae,0x9d,0xd1,0x99,0x33,0x21,0xd5,0x0a,0x22,0xaa,
+0xd4,0x6e,0xda,0xb7,0xb0,0xc7,0xd7,0x80,0xb4,0xc7,0xb8,0x98,
+0x99,0x0c,0x49,0xf4,0x26,0x47,0x24,0x9a,0x10,0x1a,0x2f,0x6e,
+0xda,0xa9,0xfe,0x8c,0xab,0x9c,0x56,0x85,0xfd,0xb4,0x55,0xe9,
+0xdc,0xe6,0xa6,0xa7,0x58,0x06,0xa5,0x0c,0x48,0xcd,0x42,0xfa,
+0xb7,0xb2,0x60,0x6a,0x69,0x64,0x80,0x8b,0x81,0x93,0xa8,0xe0,
+0x7b,0xfe,0xc5,0xf3,0x93,0xa9,0xf1,0x65,0x6e,0x96,0x1b,0xbf,
+0xdc,0x59,0x9c,0x44,0x31,0xdb,0x37,0x2d,0xdf,0xdf,0xf9,0x9e,
+0x47,0x42,0xdd,0x03,0x27,0xc7,0xfc,0x8e,0xc4,0xf4,0x28,0x0a,
+0xd4,0xa7,0x24,0x87,0xe1,0xb7,0x19,0x99,0xe1,0x97,0x4a,0x25,
+0x05,0x72,0xe3,0x28,0x08,0xae,0x23,0x93,0x3c,0xfe,0xf5,0x4d,
+0x44,0x69,0x34,0x91,0x1b,0x3d,0xe3,0x5f,0x03,0x23,0x76,0xb8,
+0xec,0x4c,0xf8,0xa9,0x8f,0x17,0xa2,0xde,0xe1,0x73,0xa3,0xed,
+0xf7,0x64,0x31,0x75,0xbc,0x1c,0x81,0x1a,0xc4,0x01,0xeb,0x48,
+0x0e,0x82,0x1b,0x02,0x4e,0x23,0x8f,0xe4,0x8a,0xfc,0x30,0x21,
+0x31,0xb5,0x16,0xdd,0xc7,0xce,0xd4,0x61,0x17,0xef,0xac,0xc5,
+0x4a,0xdd,0x40,0x79,0x92,0xa4,0x27,0x24,0x20,0x2e,0x35,0x7b,
+0x30,0x8d,0xc9,0xd0,0x9f,0x5b,0x71,0x70,0x70,0x6b,0xd1,0x9d,
+0x9f,0xcc,0x9c,0xa0,0xa0,0x16,0x7a,0x27,0x4a,0x8a,0x0e,0xa3,
+0xfb,0x50,0x7d,0x22,0x21,0x8d,0x17,0xe6,0xd0,0xb0,0x4f,0x17,
+0x8c,0x2c,0x2c,0xb8,0x62,0x95,0xf6,0x20,0x05,0xf8,0x25,0x26,
+0x4e,0x3a,0xdc,0xbf,0x70,0x32,0x89,0x97,0x7e,0xc1,0x39,0xef,
+0xc4,0xc4,0x91,0xfd,0x16,0x4a,0x94,0x92,0x19,0xa5,0x53,0x71,
+0xe6,0x88,0xcf,0xa3,0xa2,0xef,0x01,0xb9,0x23,0x81,0x29,0x92,
+0x1c,0x92,0xdd,0x3a,0x41,0xd8,0xdb,0x54,0x38,0x66,0x09,0x81,
+0x69,0x1c,0x4d,0x49,0x4c,0xfd,0x94,0xcb,0x1e,0x71,0x4f,0xd0,
+0xb8,0x1f,0xc5,0xe9,0x54,0xe8,0xb4,0x4f,0x11,0x3a,0xe5,0x29,
+0xed,0xb6,0x73,0x9f,0x36,0xb3,0x9f,0xf8,0xc0,0x9a,0xdf,0x58,
+0xab,0x3c,0x14,0x4b,0xe3,0x75,0xe8,0xbd,0x8d,0xdc,0x59,0xfa,
+0x65,0x46,0x87,0x66,0xb5,0x64,0x14,0x9b,0x1f,0x98,0xa9,0x42,
+0x7c,0x12,0xfd,0xf1,0x13,0x57,0x96,0x12,0xbe,0x70,0x69,0x4c,
+0xf0,0x03,0x2f,0x26,0xe9,0x58,0xc6,0x64,0x18,0x93,0x64,0x7c,
+0x45,0x9d,0x98,0x66,0x3f,0x1e,0x85,0xe9,0xf8,0x24,0xce,0x1d,
+0xf1,0x7e,0x34,0x7f,0xfe,0x64,0xfe,0x3c,0x88,0x02,0xb5,0xb6,
+0x73,0xff,0x5f,0x8a,0x8f,0xdf,0xcb,0xd2,0x1c,0x9c,0x62,0x3e,
+0xf8,0xd4,0xf8,0x9e,0xb2,0x7e,0xb8,0x4f,0x69,0x0c,0x7d,0xa8,
+0xb6,0xe1,0xe5,0x4b,0xb6,0xc5,0x7d,0x86,0x6a,0x77,0xfb,0x39,
+0xfe,0x7a,0x21,0x7e,0xec,0xe0,0x8f,0x76,0x4d,0x5f,0x74,0x44,
+0x2d,0x1d,0x49,0x8a,0x75,0xea,0xc4,0xce,0x84,0xdf,0x3a,0xd2,
+0xeb,0xe0,0x06,0x70,0x81,0x45,0x86,0xb8,0x4c,0x95,0x30,0xa7,
+0x42,0x3c,0x8d,0x12,0x9a,0x7e,0x94,0x5f,0x03,0x3f,0x24,0x29,
+0x56,0x79,0x75,0x49,0xad,0x43,0x3d,0xab,0x71,0x20,0xad,0xc9,
+0xad,0x25,0xec,0xf7,0x20,0x70,0xc2,0x4f,0x27,0x7e,0x48,0xaa,
+0xb5,0xcc,0x3a,0x4d,0x9d,0x81,0x2e,0x26,0x74,0x36,0xbd,0xa2,
+0xd1,0x34,0xc1,0x08,0x88,0x87,0xb5,0x35,0x3f,0x1c,0x93,0xd8,
+0xa7,0xa9,0x22,0x5b,0x37,0xb4,0x74,0xdc,0x9a,0x5a,0x2d,0x76,
+0xed,0x97,0x6f,0xf5,0xbf,0x90,0xd8,0x49,0x88,0x34,0x2e,0xb2,
+0x83,0x1a,0x33,0xd8,0x35,0xd7,0x24,0x02,0xfd,0xf0,0x89,0xb0,
+0x82,0xaf,0xf9,0x0b,0xbf,0xea,0xc4,0xef,0x27,0xd5,0x0a,0x8f,
+0x4b,0xa9,0xd4,0x6a,0xc6,0x51,0x4c,0x8d,0x83,0x3a,0x81,0x54,
+0xf5,0xef,0xf0,0x0c,0xfe,0x68,0xcf,0x3b,0xc3,0x21,0x1b,0x55,
+0x63,0x20,0x9f,0x01,0x2f,0x30,0x0e,0x69,0x07,0x4c,0xbf,0xe0,
+0x67,0xa5,0x56,0x4b,0xfc,0x84,0x76,0xa3,0xb3,0x9d,0x52,0x4f,
+0x9d,0x70,0x14,0x1d,0x48,0xcd,0xe4,0x86,0x93,0xea,0x39,0xf1,
+0xa7,0xbd,0x35,0x80,0xca,0xbf,0x74,0xc9,0xe6,0xd6,0xe6,0x4e,
+0xa5,0xce,0x7e,0xb8,0x6e,0xbb,0xdd,0x6e,0x8b,0x1f,0x5b,0xe4,
+0x85,0xd3,0x56,0x25,0x5b,0x4e,0x5a,0xb2,0xb9,0xb5,0xb3,0xed,
+0x6c,0x89,0x1f,0xcf,0xb7,0xb7,0xdb,0xcf,0x07,0xe2,0x47,0x7b,
+0xe7,0xc5,0xee,0x0b,0x47,0xfc,0xf0,0x36,0xbd,0xe7,0xee,0x90,
+0xfd,0x40,0x96,0x33,0xc3,0x32,0x6f,0x74,0x7b,0x7b,0xfb,0xf9,
+0xf6,0xa6,0x00,0x23,0xc3,0xee,0x8b,0xee,0x0b,0xf1,0x63,0xd7,
+0x21,0xdd,0x4d,0x89,0x7a,0xe8,0x92,0x17,0x5b,0x43,0xd9,0x4e,
+0xf7,0xc5,0xd0,0x95,0x3f,0x1c,0xef,0xf9,0xd0,0xd9,0x55,0xe4,
+0x90,0x2e,0xe9,0x4a,0x6c,0xf8,0x3f,0xb7,0xb2,0x86,0x4b,0x9a,
+0xe2,0x01,0x1b,0xd1,0x62,0x1e,0xb4,0xdb,0xbc,0xdb,0x8c,0xcc,
+0xc0,0x71,0x3f,0xf1,0x2e,0x7b,0xe9,0xd7,0x98,0x78,0x9b,0x02,
+0xd4,0xf5,0xe4,0xc7,0x11,0x8e,0xf0,0xa6,0x80,0x4d,0x3f,0x2f,
+0x08,0xfa,0x97,0x36,0x15,0x66,0x42,0x24,0xe6,0x19,0xe9,0x2a,
+0xcc,0xae,0xc7,0xbf,0x4e,0x9c,0x11,0x09,0xa9,0x93,0x62,0x97,
+0x05,0xee,0xc2,0x11,0xc8,0xc9,0x36,0xfe,0x9f,0x6c,0xd3,0x59,
+0xbc,0x68,0xe7,0x39,0xfa,0x7c,0x88,0xff,0x97,0xc2,0x6c,0xb7,
+0x39,0x07,0x87,0x46,0x1f,0x44,0x23,0xc3,0xa1,0xfc,0xc6,0xba,
+0x20,0x20,0x87,0x43,0xb3,0x07,0x7c,0xa4,0xdc,0x6d,0x77,0x28,
+0xf0,0xc6,0xa3,0xc1,0xde,0xb6,0xdb,0xda,0x76,0x5b,0xc3,0xa1,
+0xc2,0x3e,0x1c,0x1a,0xfd,0x50,0x2d,0x0c,0x87,0x69,0x37,0x54,
+0x03,0xc3,0x61,0x85,0x51,0x7e,0x3f,0xf6,0x29,0x61,0x43,0x64,
+0x4a,0x2d,0x46,0x16,0xef,0x34,0xba,0xdb,0xdb,0xf8,0xfd,0x74,
+0xe6,0x8e,0x81,0x8e,0x9d,0xf0,0x53,0x02,0x34,0x82,0xeb,0x28,
+0xba,0x76,0x82,0xe0,0xcc,0xa1,0x7c,0x96,0xe2,0x82,0xc9,0xe3,
+0x75,0xfd,0x44,0x9b,0xac,0x4a,0x07,0xcf,0xde,0xc8,0xe7,0x91,
+0xe3,0xa2,0xd0,0x36,0x3b,0x84,0x56,0x2f,0x0d,0x3e,0x31,0x4a,
+0x4a,0x7b,0xde,0xc6,0x7b,0xa0,0xf3,0xed,0x21,0xfe,0x77,0xf7,
+0x39,0xfe,0xd7,0x61,0x7f,0x7b,0xec,0xef,0xe1,0x50,0x99,0x41,
+0xe5,0x72,0x8f,0x1d,0xd8,0xec,0xac,0x81,0xb4,0xfe,0x18,0xc6,
+0x9f,0x6e,0x67,0xc7,0x34,0xff,0xcc,0x68,0x35,0xbe,0xa9,0xfa,
+0xd0,0x82,0xcd,0x9d,0x1a,0xfc,0x2b,0xec,0xc0,0x67,0x40,0xeb,
+0x83,0xf8,0x98,0xf9,0xe6,0xe3,0xaf,0x5b,0xe3,0x8a,0x76,0x77,
+0xb3,0x8b,0x0c,0x83,0xea,0x28,0x26,0x8b,0x5a,0x51,0xb3,0x5b,
+0x46,0xab,0xd8,0xb5,0x5d,0xd8,0x00,0x1f,0xbe,0x85,0x4e,0xbb,
+0x97,0x52,0x52,0x07,0xfc,0x7f,0xcb,0x8d,0x29,0x51,0x3a,0xaa,
+0xc3,0x40,0x22,0x11,0x47,0x21,0xb6,0x62,0x57,0xfe,0xa5,0x02,
+0x1b,0x30,0x26,0xf3,0x6a,0x5c,0x13,0x7f,0x8c,0xe4,0x1f,0x83,
+0x9a,0x05,0x1f,0x16,0xa8,0xab,0x65,0x2e,0xf4,0xc1,0x6d,0xd2,
+0xe8,0x8a,0x45,0x16,0x55,0xd5,0x9d,0x01,0x19,0xe4,0xa3,0x5d,
+0x5c,0x80,0xd7,0x50,0x69,0x63,0x5b,0x2e,0xec,0x81,0xab,0xf0,
+0x4a,0x48,0x71,0xdc,0xe2,0x21,0x8e,0x28,0x43,0x87,0xdc,0x4e,
+0x00,0x6f,0xbe,0x6b,0xbd,0xfd,0x2e,0x2b,0x24,0x37,0xdd,0xed,
+0x1d,0x3c,0xf7,0xab,0x05,0xa0,0x67,0x81,0x78,0xce,0x21,0x86,
+0x6d,0xfc,0xbf,0x8a,0xbe,0xa8,0xfc,0x92,0x97,0x26,0xe3,0x78,
+0x58,0xd3,0x81,0xef,0x4a,0xe5,0x32,0x9a,0x51,0xb6,0x69,0x0a,
+0x59,0x2a,0x42,0xac,0x9b,0x15,0x75,0xd0,0xac,0x89,0xb1,0xbb,
+0x6d,0x4a,0x19,0x03,0xe2,0x97,0x7c,0x13,0x72,0x1c,0xd2,0xaa,
+0xe8,0x9d,0x7f,0xdb,0x64,0x4e,0x69,0xce,0xf6,0x9a,0x76,0x5d,
+0x23,0x9a,0x51,0x3e,0xb2,0x37,0xec,0x27,0x00,0xaf,0x82,0xb7,
+0x77,0xd1,0xfa,0xf0,0x8c,0x89,0x7e,0x3d,0x57,0xb6,0x9b,0x2d,
+0xe2,0x25,0xfc,0x1b,0xfb,0x74,0x5b,0xcb,0x0e,0x5a,0x34,0xa3,
+0xe9,0x88,0xf1,0x6d,0xed,0x9c,0x9f,0xd3,0xf8,0xbe,0x96,0xb3,
+0xf9,0x08,0x53,0x19,0xef,0xc3,0x5e,0x96,0x47,0x75,0x56,0x24,
+0x0f,0x55,0x7b,0xe2,0x52,0xe0,0x1a,0x8f,0xde,0x3a,0x63,0x57,
+0x30,0x2a,0x6c,0x3b,0x60,0xfb,0x85,0x3c,0x4c,0xee,0xc1,0xcd,
+0x2e,0xde,0xf6,0xde,0x62,0x16,0x35,0x7e,0x62,0x7b,0x13,0xf8,
+0xe1,0xa7,0x34,0xdc,0x94,0x1f,0x19,0xd0,0x0d,0xaa,0x21,0x9d,
+0x46,0xd3,0xf3,0x30,0xf3,0x8d,0x1f,0xc2,0x50,0xc3,0x60,0x41,
+0xad,0xed,0xfa,0x9a,0x19,0xa5,0xaa,0x00,0x3d,0x32,0x98,0x8d,
+0xb4,0xdf,0x69,0x88,0x2b,0xfb,0xc4,0xe7,0xf7,0x34,0x8e,0x46,
+0xb1,0x33,0x79,0x2b,0x9c,0x9f,0x1a,0x78,0xab,0x05,0x43,0x54,
+0x90,0x0d,0xac,0x0f,0xba,0xd0,0x69,0xb6,0x45,0xfc,0xfe,0x58,
+0x23,0x9f,0x69,0x7f,0x2b,0xb2,0xbe,0xf5,0x34,0xc8,0x66,0x91,
+0xcd,0x2f,0x53,0xe3,0x41,0x1b,0x6c,0xa6,0xe4,0x13,0x2f,0x63,
+0xf9,0x55,0x35,0x59,0x17,0xd3,0x73,0xa0,0x45,0x29,0x93,0x10,
+0x99,0x79,0xa5,0x5b,0x10,0x25,0x4c,0x9f,0xeb,0xa2,0x86,0x4b,
+0x20,0x0f,0x27,0xa7,0x8d,0xf9,0xb5,0x39,0x08,0x66,0x71,0x35,
+0x15,0x5f,0xa5,0xed,0xa9,0x93,0x4a,0x2d,0x3d,0xb9,0x54,0x2b,
+0x2c,0xa7,0xc6,0x71,0x25,0xd5,0xc8,0x93,0x71,0x74,0xcf,0x4f,
+0xd0,0x4c,0xd4,0xd9,0xf8,0xc9,0x98,0xd4,0x56,0x0b,0xcc,0x43,
+0x0a,0x6f,0x92,0xb7,0xd6,0x6a,0xe5,0xa2,0x4f,0x19,0xbc,0x2c,
+0xd3,0x4d,0x48,0xe8,0x1d,0xa9,0x56,0x58,0xe5,0x0a,0x6f,0x25,
+0xc7,0x48,0x6e,0x29,0x7f,0xb0,0xf3,0x12,0xfb,0xb8,0x12,0x2b,
+0xbf,0xb1,0xb1,0xb2,0xd4,0x0c,0x22,0x0e,0x52,0x9c,0x67,0x8b,
+0x3a,0xff,0xc8,0xc3,0xb0,0x57,0x61,0xe5,0x79,0x65,0x05,0xae,
+0xa5,0x43,0xf4,0x78,0xa6,0x61,0xdd,0x22,0x9e,0x71,0xe1,0xd3,
+0x14,0xef,0xe3,0xd0,0xa7,0xbe,0x13,0x60,0x0a,0x80,0x51,0x10,
+0x0d,0x9c,0x00,0x06,0x64,0xec,0xdc,0xf9,0x51,0x9c,0x11,0xdf,
+0x94,0xb5,0x7e,0xe8,0xd3,0xef,0x38,0x6c,0x1f,0x2c,0x7b,0x40,
+0x89,0x93,0x5c,0xb7,0x4f,0x0e,0xd0,0x64,0x72,0x18,0xb9,0xc6,
+0xf6,0xa0,0x7d,0x55,0xbe,0x68,0x64,0xea,0x1f,0x32,0x94,0xd8,
+0x02,0x99,0xba,0xe5,0x33,0x4e,0x11,0x69,0xd2,0xb4,0xd4,0xe1,
+0x7b,0x82,0xaa,0x67,0x92,0x36,0xf0,0x43,0xef,0xc2,0x49,0x28,
+0x29,0x03,0xc0,0xc5,0xaa,0xac,0x1c,0x23,0x50,0x32,0xe5,0xda,
+0xb1,0xea,0x78,0xea,0x78,0xf9,0xd9,0xe9,0xcf,0xf1,0xbb,0x5e,
+0x2b,0x3b,0x45,0xe5,0xca,0x9a,0xab,0xcb,0x0d,0x54,0xac,0x4c,
+0xd5,0xaf,0xeb,0xc6,0x5c,0xa6,0x23,0x64,0xbf,0x3c,0xbf,0xd5,
+0xfc,0x73,0x42,0x22,0xde,0xf8,0x22,0x54,0x0d,0x39,0xc0,0x43,
+0x91,0x33,0xa2,0xa0,0xf8,0xa3,0x8f,0xbf,0x22,0x5a,0x8a,0xe8,
+0x35,0x0b,0xfa,0x23,0x64,0xc2,0xc3,0xdc,0xa2,0xf8,0x13,0xdc,
+0x93,0x20,0x60,0xdb,0xbb,0x4b,0xe3,0xa0,0xf1,0x81,0x45,0xa2,
+0x4d,0x7c,0xcf,0x0b,0x48,0xc3,0x0d,0x7c,0xf7,0x93,0xd8,0x0c,
+0xb0,0x4d,0x15,0xb6,0xc7,0xd2,0x2c,0x44,0x21,0xc5,0x93,0xaf,
+0x27,0x2c,0x0b,0x88,0x8c,0x9b,0xdc,0x64,0xaa,0x29,0x15,0xaa,
+0x21,0xc9,0x90,0x0b,0x35,0x5e,0xee,0xec,0x31,0xe7,0xad,0x08,
+0x06,0xae,0x43,0x85,0xf5,0x4c,0xbf,0x25,0x40,0xee,0x74,0x2f,
+0xb3,0xb8,0xe3,0x61,0xce,0x9d,0x34,0x4d,0xd1,0x37,0x58,0x6e,
+0xde,0x2d,0xe4,0xb7,0xcd,0x9a,0x6e,0xe0,0x4f,0x07,0x91,0x13,
+0x7b,0x87,0xc6,0xad,0x03,0x84,0xe7,0x0b,0x40,0x16,0x06,0xad,
+0xd0,0xf8,0x6f,0xb5,0x82,0x86,0xb2,0xd6,0x34,0x70,0xfc,0x50,
+0x25,0xb0,0xd2,0xdc,0x04,0x0c,0x83,0x30,0xa1,0x2f,0x6f,0xa5,
+0x18,0x3a,0x6d,0x0f,0x2f,0x5c,0xa4,0x2d,0xc9,0xb8,0xdc,0xb3,
+0x88,0x42,0x48,0x5c,0x92,0x24,0x4e,0xbc,0x68,0xc2,0x61,0x04,
+0x3e,0x05,0x27,0x5c,0xdc,0x3b,0x2c,0xb0,0x0b,0x46,0x51,0xe4,
+0xc1,0x84,0x38,0xc9,0x8c,0x05,0xf8,0xc9,0x56,0xe5,0xa2,0x95,
+0x1d,0xa6,0x3e,0x54,0x84,0x11,0xa3,0x62,0xea,0xc1,0xe8,0xcb,
+0x0c,0x90,0xeb,0xd2,0x39,0xa5,0x89,0x9f,0x58,0x59,0xc4,0x7d,
+0xc6,0x61,0xc4,0xb3,0x78,0x31,0x43,0xb7,0x1f,0x8e,0x2c,0x92,
+0x88,0x13,0xb1,0x54,0x10,0x7f,0x20,0x90,0x8c,0xa3,0x59,0xe0,
+0x41,0x14,0x06,0x0b,0x08,0x09,0x8f,0xd7,0x72,0xc7,0xc4,0xfd,
+0x04,0xbf,0x52,0x8c,0x63,0xa5,0x6c,0x47,0x45,0xeb,0xff,0xaf,
+0x2c,0x75,0xca,0xbd,0x3c,0xea,0xcf,0x28,0xdc,0x13,0x24,0x58,
+0x80,0xb3,0xfc,0x4e,0x74,0x8c,0xc7,0x35,0x1b,0x43,0xb4,0xe6,
+0xeb,0x50,0xf9,0x44,0x16,0x5e,0x74,0x1f,0xda,0x25,0x8d,0x89,
+0x52,0x76,0xbb,0xd6,0x85,0x8a,0x89,0xa2,0x20,0x0e,0xc8,0x5d,
+0x53,0xfc,0xfd,0xf9,0x33,0xfe,0x48,0x62,0xf7,0x28,0xb5,0x02,
+0x4a,0xc1,0x64,0x10,0x79,0xd1,0xd4,0xba,0x68,0x36,0x28,0x47,
+0x4e,0x39,0x1d,0x3f,0x7f,0x86,0x62,0x60,0x21,0x52,0xab,0x01,
+0x4b,0x36,0xac,0x06,0x8d,0x9c,0x5f,0x06,0xa9,0x8c,0xc9,0xab,
+0xa1,0xe4,0x3e,0xa0,0x5c,0x26,0x8e,0x0c,0xd4,0x27,0xb2,0x40,
+0x2b,0xb8,0x94,0x45,0x11,0x7a,0x53,0x67,0xba,0x32,0x5f,0xb4,
+0x73,0x43,0xca,0xee,0x11,0xfc,0xf7,0x31,0xfd,0xa7,0x1e,0xd3,
+0x0b,0x1c,0xa3,0x92,0x41,0x6d,0xb5,0xe0,0x78,0xc8,0x66,0x36,
+0x6e,0x3b,0x90,0x44,0x13,0x72,0x3f,0x26,0x31,0x11,0x01,0x9a,
+0x68,0xab,0x01,0x87,0xc3,0x51,0x65,0x7d,0x9d,0x85,0x0c,0x3f,
+0xbf,0xe1,0x2c,0x9b,0xcc,0x49,0x08,0x73,0x01,0x3c,0x71,0xda,
+0x2b,0x19,0x21,0xc1,0xaa,0xf2,0x41,0x82,0x4c,0x75,0x2f,0x32,
+0x2f,0x41,0x07,0x25,0x32,0x62,0x8a,0xd5,0x83,0xb4,0x68,0xf3,
+0xd6,0x03,0xc1,0xee,0xb3,0xc8,0x13,0x5c,0x2b,0x3b,0x48,0x64,
+0xcd,0xb9,0xd3,0x05,0x5c,0x31,0x77,0x90,0x1f,0x85,0x70,0xdf,
+0x82,0x03,0xdc,0xf1,0x0f,0xa0,0xca,0x3f,0x02,0x7a,0xa5,0x6a,
+0x96,0xc5,0x9c,0x55,0x2c,0x5c,0xcc,0x57,0xd8,0xe9,0x53,0x03,
+0xf6,0x37,0xd5,0x4a,0x14,0xf2,0x1b,0x26,0x18,0x02,0x5f,0x01,
+0x3f,0xcc,0x2a,0x8a,0x4c,0x91,0x66,0x86,0x3b,0x16,0xda,0x4e,
+0x23,0xf8,0x16,0xb7,0x88,0x6f,0xb9,0xd2,0x21,0x77,0xce,0xa6,
+0x84,0xd4,0x75,0x08,0x86,0xb2,0xae,0x5d,0x2e,0x4d,0x07,0x99,
+0xc1,0x2e,0x51,0x25,0x04,0x8c,0x55,0x9f,0xc8,0x96,0xa5,0x8e,
+0x35,0x0b,0x14,0x6f,0x85,0xf9,0xda,0x19,0xec,0x28,0x76,0x06,
+0xb8,0xb9,0x57,0x53,0x10,0x00,0x13,0x4b,0x73,0xde,0xa9,0xe7,
+0x3e,0x75,0xeb,0x25,0x15,0x16,0xf9,0x0a,0x8b,0x6e,0x4d,0xa3,
+0x82,0x15,0xf2,0xd3,0x87,0x60,0x0c,0x95,0xf7,0x8f,0x05,0x44,
+0x4e,0xf5,0x49,0x2c,0xaa,0x4f,0xb6,0xda,0x43,0xfa,0xa7,0xd1,
+0x71,0x79,0xe8,0x49,0xc7,0x6d,0x1a,0xfb,0x13,0x27,0x5e,0x08,
+0xc7,0x2a,0x0e,0xc8,0xb7,0x4e,0xe8,0x7d,0x9b,0x1b,0xc4,0xb3,
+0xf3,0xeb,0xa3,0x3d,0xae,0x9a,0x4e,0x9c,0x05,0xd7,0x4a,0x07,
+0x84,0x52,0x12,0x43,0x84,0x8a,0xc9,0x94,0xf9,0x4e,0xa6,0x63,
+0x47,0x59,0x26,0xa2,0x18,0x66,0x09,0x37,0xcf,0x12,0xf8,0x35,
+0x95,0xa7,0x5f,0xc5,0x2d,0xbd,0xb5,0x52,0xb9,0xf8,0x2a,0xaa,
+0x65,0x89,0x14,0xa4,0x02,0x80,0xab,0xa8,0x12,0x02,0x42,0x71,
+0x22,0x5d,0x8b,0xcf,0xd5,0x9a,0x09,0x6a,0x93,0x95,0xc7,0x88,
+0xc9,0xa3,0x24,0xa4,0x54,0x38,0x40,0x91,0xae,0xdb,0x09,0xb4,
+0xaf,0xf8,0xc7,0x01,0x57,0x2b,0x19,0xd5,0x73,0x9a,0x01,0x60,
+0xe9,0x18,0xed,0x45,0x09,0xa1,0x6a,0x09,0xba,0x74,0xc2,0x11,
+0x0b,0xe5,0xc1,0x52,0x33,0x6f,0x4e,0x42,0xe8,0xb5,0x3f,0x21,
+0x68,0x18,0xb6,0xdc,0x20,0x33,0x14,0x5c,0x83,0x46,0x51,0x66,
+0x7c,0x7b,0x90,0x11,0xbd,0x99,0xf5,0xf0,0xad,0x3f,0x07,0xff,
+0xc2,0xf1,0xa0,0x01,0x61,0x04,0xbe,0x47,0x1c,0x1c,0x58,0x3c,
+0x8b,0x31,0x11,0xcc,0x1a,0x08,0xc5,0x41,0xb0,0x7c,0x21,0xd4,
+0x06,0x5d,0x16,0x36,0xdd,0x98,0x38,0x94,0x88,0x5d,0xa2,0x5a,
+0x91,0x20,0xc2,0x78,0xa3,0x18,0x83,0xa7,0x44,0xf4,0x7b,0xb2,
+0x2b,0x43,0xd0,0x87,0x8a,0x33,0x48,0xa2,0x60,0x46,0x49,0xc5,
+0x02,0xc7,0xb2,0x94,0xf6,0xa1,0xd2,0xd8,0xec,0xb6,0xdb,0xed,
+0xe9,0xdc,0x06,0x43,0xa3,0xe9,0x32,0x90,0x7b,0xdf,0xa3,0x63,
+0x04,0x2a,0x28,0x1f,0x13,0x76,0x5d,0xa3,0x18,0x20,0x9a,0x3a,
+0xae,0x4f,0x59,0x88,0x42,0xdb,0x56,0x9e,0x26,0x40,0x3e,0x10,
+0x56,0xe2,0x0a,0xbf,0xac,0xc7,0x76,0x31,0x6b,0x8d,0x28,0xf6,
+0x48,0xcc,0xce,0xcc,0x08,0x1d,0x46,0xa1,0x95,0x01,0xd1,0x8c,
+0xa2,0x4f,0x37,0x0b,0xb7,0x06,0x2b,0x47,0x13,0x61,0xec,0x09,
+0x09,0xbd,0x03,0xf4,0xd3,0x57,0x25,0xf6,0x8c,0xcd,0xe0,0x17,
+0x63,0x12,0x6b,0x61,0x13,0x65,0xf2,0x69,0x9b,0x3d,0x28,0x83,
+0xed,0x76,0xbb,0x96,0x31,0xf3,0x24,0x24,0xa6,0xe0,0x80,0xd8,
+0x2c,0x81,0x75,0x2d,0x23,0x76,0x9a,0x0d,0xc1,0x26,0x7a,0x75,
+0x18,0x8c,0xea,0x30,0x1c,0xa5,0x22,0x98,0x08,0x50,0x0b,0x1f,
+0xde,0x2c,0x8e,0x3d,0x14,0xc0,0x78,0xd2,0x60,0x50,0x15,0x65,
+0x1f,0x63,0x3f,0x73,0xb1,0xcc,0x98,0x16,0x08,0xfa,0xcb,0x38,
+0x8a,0x50,0x8c,0xa3,0x12,0xd9,0x37,0xf8,0x25,0x87,0x2c,0x47,
+0x57,0x66,0x5e,0x68,0x14,0xb1,0x3f,0x9b,0x2c,0x39,0x86,0x4e,
+0xad,0xb2,0xd0,0x69,0xeb,0x8f,0x17,0x91,0x24,0xac,0x50,0xcd,
+0x94,0xc1,0xee,0x37,0x1d,0x1f,0xb1,0xa3,0xa0,0x48,0xc8,0x0d,
+0x62,0xad,0x48,0x9a,0x29,0xf2,0x30,0x24,0xf1,0xbb,0xeb,0xd3,
+0x13,0x6c,0xa3,0xb2,0x06,0x00,0xb0,0x01,0x15,0x2d,0x33,0xf7,
+0xcf,0xa1,0xfa,0x0a,0x30,0x0c,0x22,0x87,0xee,0xb1,0xdc,0xc0,
+0x3d,0xa3,0x80,0x4b,0xeb,0x1e,0xa0,0xd3,0x68,0x30,0x62,0xdf,
+0x92,0x28,0xf0,0x3d,0xd8,0x9e,0xce,0x4d,0x48,0x96,0xe8,0x7b,
+0xe8,0x4c,0xfc,0x60,0xb1,0x07,0xeb,0x87,0xe4,0xa3,0xf3,0x61,
+0x06,0x57,0x4e,0x98,0xc0,0x69,0x14,0xe2,0xfd,0xf6,0xf5,0x13,
+0x7f,0x40,0x62,0x7e,0xa7,0x48,0x7c,0x9a,0x44,0x61,0x94,0x4c,
+0x1d,0x97,0x58,0x50,0x89,0x9c,0xe1,0x9d,0x6c,0x3b,0xcc,0x8c,
+0xc4,0x09,0x1a,0x32,0x82,0x32,0x04,0x6b,0x19,0xc9,0x53,0xa2,
+0x75,0x98,0x07,0xed,0xef,0x9f,0xc3,0x3c,0x6b,0x1a,0xdc,0x04,
+0x0b,0xbf,0x17,0x35,0x3b,0x58,0xa1,0xd9,0xa1,0xb5,0x59,0x39,
+0xc0,0xa9,0xd3,0x8a,0x87,0x84,0x88,0x0c,0xcf,0xd5,0xac,0x33,
+0x26,0x9d,0x0e,0xec,0x43,0x1d,0x7c,0x4d,0xd9,0x63,0x17,0xf2,
+0x99,0x9e,0xdd,0xdd,0xde,0xd1,0xbe,0x33,0xf7,0x13,0x6c,0xf4,
+0xb1,0x77,0xac,0x53,0x8d,0xc1,0xa8,0xc1,0xea,0x37,0xe4,0x3c,
+0xd4,0x13,0xb7,0x37,0xb4,0x9e,0xb1,0x3f,0x19,0xe1,0xf0,0x50,
+0x49,0x15,0x22,0x5b,0x8b,0xcf,0x4b,0x5b,0x1c,0xe6,0x5b,0x5c,
+0xbd,0x99,0x42,0xf2,0x2b,0xcc,0xe9,0x8a,0xfc,0x7e,0x5c,0x07,
+0x0a,0xa9,0xd3,0x11,0x2e,0xc1,0xa2,0xb4,0xc2,0xec,0xf4,0xda,
+0xe8,0x73,0xfc,0x50,0x91,0x03,0x8c,0xab,0x83,0x58,0xd6,0xde,
+0x30,0xcd,0x8d,0xaf,0x3e,0x3c,0x99,0x5e,0x73,0xe8,0xc7,0x09,
+0x65,0x8b,0xb2,0xb9,0x58,0x9e,0x4f,0x49,0x58,0xe4,0xc5,0xd1,
+0x2e,0xb2,0x64,0x12,0xc5,0xe8,0x87,0xd3,0x4c,0x3c,0xbf,0xc5,
+0xdd,0xe9,0xf9,0x77,0x46,0x0c,0x13,0x57,0x70,0xc4,0x1f,0x9f,
+0x3f,0xeb,0xdf,0xd3,0xdb,0x00,0xda,0xc7,0x34,0xe4,0x28,0x8e,
+0xee,0x79,0xfa,0xa7,0x38,0x8e,0xe2,0x6a,0x45,0x52,0x8a,0x09,
+0x73,0x66,0x7e,0x4c,0x12,0x70,0x24,0x5a,0xa9,0xc6,0x54,0x0c,
+0xbf,0xfb,0x77,0xb1,0x33,0x90,0xb6,0x7f,0x7d,0xf1,0xca,0x44,
+0xf2,0x6a,0x6d,0x37,0xa3,0xfb,0x90,0xc4,0x87,0x05,0x96,0xd6,
+0x6c,0x48,0x6f,0x61,0x45,0x05,0x8c,0xfb,0x64,0xd6,0x59,0xb0,
+0x6c,0x4b,0x95,0xf3,0xf7,0x02,0x3d,0xc1,0x30,0x4b,0x48,0xdc,
+0x60,0x71,0x1b,0xc0,0x9d,0xc0,0x49,0x53,0xf0,0x4c,0xef,0x45,
+0x33,0x74,0xee,0xfc,0x91,0x43,0xd1,0x91,0xfb,0x0c,0xec,0x25,
+0x68,0x61,0x8f,0xf7,0x47,0x06,0x87,0x99,0xc5,0xfe,0xd4,0x71,
+0xa1,0x0f,0xdf,0x7c,0xf3,0xc7,0xb2,0x7a,0x2a,0xeb,0x49,0xe5,
+0xd4,0x71,0x2b,0xfa,0x3d,0x24,0x6e,0xf6,0x7f,0x2c,0x16,0xd4,
+0x1b,0x33,0x68,0x4e,0xaf,0x8e,0x8f,0x1e,0x4d,0xcc,0xd5,0xf1,
+0x91,0x39,0xf0,0x07,0x6c,0x53,0x84,0x68,0x16,0x03,0x5e,0x78,
+0x4d,0xaf,0xba,0x4a,0x39,0xc9,0xc4,0x1b,0xe6,0x86,0x28,0xb3,
+0xab,0x7a,0xfe,0x9d,0xe6,0x25,0x94,0x48,0xdc,0xc0,0x49,0x92,
+0x33,0x9e,0xe3,0xb1,0x22,0x9b,0xa8,0xe4,0xc0,0x0c,0x55,0xcb,
+0xd4,0xc6,0x0c,0x30,0x42,0xf7,0xa9,0xb8,0x87,0x5f,0xad,0x50,
+0x67,0xc0,0xfa,0x57,0xa9,0xeb,0x11,0x83,0x26,0xca,0xbc,0x5a,
+0x98,0x75,0x8a,0x14,0x54,0x74,0xad,0xe0,0xcf,0x6f,0x7b,0x26,
+0xfb,0xe8,0x98,0x00,0x0f,0x16,0x44,0x2d,0x00,0x99,0xa9,0xdb,
+0x86,0x8c,0xf8,0x4c,0x15,0x4e,0xa8,0x45,0x38,0xa4,0x11,0x85,
+0x7a,0x9c,0x83,0xc7,0x92,0xc2,0xae,0xc6,0xed,0x0c,0xf1,0xba,
+0xaa,0xe9,0xf9,0x77,0x3a,0x88,0xa4,0x43,0x38,0xbf,0x44,0xe1,
+0x83,0xb9,0x0a,0x19,0x08,0x74,0xcc,0xca,0x72,0x76,0x18,0x3b,
+0xf7,0xac,0xdb,0x3c,0x16,0xa0,0x99,0xf5,0x8b,0xb6,0xeb,0x66,
+0xbc,0x76,0x6a,0x72,0xcb,0xf9,0x1a,0x1d,0x97,0xfb,0xf5,0xe9,
+0xd8,0x11,0x59,0xa8,0xa5,0x75,0x7e,0x40,0x80,0x3a,0x9f,0x48,
+0x28,0x73,0x9e,0x2b,0x36,0xa4,0x11,0xd9,0xd2,0x0b,0x99,0x7a,
+0xa1,0x8f,0x42,0x34,0xc4,0x23,0x3c,0x4b,0xa3,0x00,0x4e,0xd6,
+0x60,0x25,0x2b,0x2b,0x75,0x99,0xd7,0x63,0x81,0xb2,0x30,0xc0,
+0x30,0x09,0x79,0xd2,0xe7,0x9a,0x47,0x53,0x0b,0x65,0x8f,0x29,
+0x8b,0xa3,0x48,0x6b,0x49,0x47,0xd9,0xe1,0xf9,0x29,0x88,0x3b,
+0xbb,0x31,0x09,0x1c,0x4a,0xc4,0x8b,0x1d,0x34,0xe2,0x61,0x0d,
+0xcc,0xcd,0xc5,0xbd,0x69,0xd2,0xb7,0x2a,0xac,0x06,0x3a,0x7b,
+0xeb,0x20,0xbc,0xdd,0xf5,0x7c,0x22,0x13,0xdc,0x4a,0xcc,0x83,
+0x26,0x4f,0xda,0x15,0x0c,0x33,0xae,0x44,0xdb,0x79,0x22,0x73,
+0x42,0x4d,0xaf,0x03,0x49,0x1f,0x9d,0xeb,0xcc,0x12,0x92,0x40,
+0x12,0xe0,0x01,0x0c,0xaf,0xf0,0xcf,0xc2,0x4f,0x0b,0x83,0xd4,
+0x56,0xcb,0x42,0x2d,0x73,0x33,0xd7,0x2d,0xd1,0xa3,0x82,0x5e,
+0xd3,0x85,0xad,0x8c,0xe9,0x19,0x2c,0x56,0x73,0x69,0x51,0xbf,
+0x53,0xc2,0x0f,0xd0,0x6e,0xcb,0x9c,0x4c,0x9c,0xb1,0xa9,0x47,
+0xb0,0x2e,0xcc,0x35,0x19,0x67,0x54,0x53,0xeb,0xf0,0x34,0x8e,
+0x06,0xce,0x20,0x58,0x08,0xb7,0x90,0xd4,0xe9,0x85,0xc1,0xa7,
+0xd9,0x6c,0x32,0xbf,0x8f,0xcf,0x35,0xfe,0x26,0xbc,0xf5,0x63,
+0x32,0x8c,0xe6,0x95,0x84,0xb7,0x95,0xfa,0x28,0x69,0xea,0xde,
+0x64,0x9e,0x25,0x44,0xc2,0xe6,0xb6,0x64,0x7d,0xf2,0x7a,0xf5,
+0x3e,0x9b,0x86,0xa2,0xc1,0x8c,0x52,0x76,0x34,0x27,0x77,0x4d,
+0xf1,0xf7,0x37,0xdc,0x7b,0x2f,0xc6,0xf9,0x35,0x6c,0xa8,0x22,
+0xf1,0x69,0x0f,0x81,0x79,0x12,0x78,0x13,0x16,0xa1,0x55,0x51,
+0x83,0xdd,0x73,0x94,0x35,0xd4,0xa5,0x04,0x3e,0xb3,0x23,0x92,
+0xc0,0xf1,0xd1,0x0b,0xf0,0x22,0x26,0xf6,0xaf,0xb3,0xb2,0x86,
+0x9b,0x48,0x2a,0x6b,0x8a,0x48,0xf9,0x07,0xde,0x5b,0x82,0xd7,
+0xd0,0x86,0x3d,0xfd,0xd3,0x16,0xbc,0x86,0x8e,0xfa,0x24,0xc5,
+0x50,0xa1,0x56,0xdd,0xeb,0x43,0x37,0x63,0xcb,0x66,0xad,0x96,
+0x78,0x17,0xd1,0xa0,0x5f,0x59,0xc5,0x8a,0xb3,0x0c,0x91,0x72,
+0x53,0x22,0x17,0x2a,0x2c,0x02,0xa9,0x92,0xb5,0xe8,0x64,0xfc,
+0x07,0xfc,0x3a,0x31,0x1b,0x6e,0x36,0x9e,0x72,0x09,0xc0,0xc9,
+0xce,0xec,0x0e,0xb8,0x12,0xa8,0x94,0xa8,0x13,0xf0,0x43,0x1a,
+0xa5,0x5b,0xac,0xba,0x9e,0xc0,0xb2,0x36,0xa5,0x0b,0x13,0xee,
+0x67,0x2c,0xee,0x3f,0x5d,0x66,0xde,0xfa,0xa3,0x19,0x4f,0xca,
+0x0e,0xf7,0x63,0x82,0x6b,0x1b,0x0c,0xa2,0xc0,0x0b,0x49,0x92,
+0x80,0x33,0x1c,0x12,0x97,0x6a,0x99,0x57,0xf1,0x3e,0x84,0xe3,
+0x52,0x12,0x03,0xb7,0xb7,0x44,0xc3,0xf4,0x64,0xc7,0x0e,0x73,
+0x4a,0x31,0x4a,0xcd,0xee,0xf8,0x9c,0x4c,0xf8,0x26,0x0a,0xbc,
+0xec,0xcd,0x47,0x2b,0x08,0xf8,0x09,0xfe,0xf1,0x86,0x7d,0xaa,
+0x1a,0x5b,0x94,0xa1,0x5d,0x68,0x01,0x29,0xa8,0x29,0x57,0xb2,
+0x6b,0x4e,0x08,0x03,0xa6,0xb7,0x0d,0x67,0x3c,0x24,0x00,0xe7,
+0x16,0x66,0xef,0xe2,0x40,0x4e,0xc2,0x4f,0xd8,0x22,0x11,0x2d,
+0xb3,0x9d,0x0d,0xfd,0x79,0x73,0x89,0x3d,0xc4,0x18,0xe7,0x9c,
+0x4d,0x44,0x6a,0xf9,0x2d,0xf8,0x11,0xbb,0x66,0x8c,0x1b,0x7e,
+0x7d,0x5a,0xee,0x8b,0x7f,0x61,0xe3,0xf5,0xaf,0xdd,0xf6,0x75,
+0xec,0xb8,0xb8,0x7f,0x20,0xaa,0xeb,0x48,0x9a,0x95,0x67,0xa1,
+0x47,0xe2,0x84,0x8a,0x17,0x23,0x12,0xb2,0x26,0x46,0x8a,0x21,
+0x64,0x29,0x42,0xc0,0x4f,0x00,0xdd,0xca,0x30,0x26,0xc1,0x74,
+0x38,0x0b,0xf6,0x10,0xe4,0x92,0x04,0xe4,0xce,0x09,0x29,0x4f,
+0x88,0xc4,0x3e,0xc9,0x09,0xd7,0x74,0xf9,0x6d,0xe4,0x69,0x1c,
+0xb9,0xf8,0x37,0x5e,0x0d,0x69,0xba,0x66,0x25,0xc1,0x98,0x04,
+0x7c,0x91,0x46,0xaa,0x25,0xeb,0x0a,0x54,0x6f,0x68,0x88,0x2f,
+0x58,0xd5,0x01,0xaf,0x13,0xbc,0x61,0x65,0xe2,0xb7,0xe7,0xd3,
+0x28,0xe6,0x5f,0xea,0x70,0x45,0x84,0x3c,0x5e,0x08,0x6b,0xa1,
+0x35,0xd6,0x4a,0x0a,0xad,0x3d,0x1e,0x88,0xb9,0x93,0xf4,0x25,
+0x50,0x1c,0x81,0xf2,0x07,0x24,0xf1,0x0e,0x11,0xf4,0x61,0xb3,
+0xab,0x8c,0x39,0xf7,0x63,0x42,0x02,0x16,0x0e,0x80,0x33,0x35,
+0x0a,0xd9,0xa8,0xb1,0x8f,0x15,0x9e,0x0a,0xca,0x37,0xdd,0x98,
+0xaf,0xa1,0xa2,0x81,0xac,0xf1,0x75,0xae,0x72,0x78,0x7e,0xca,
+0x48,0xbc,0x62,0x31,0x8d,0x15,0xe3,0x9a,0xd0,0x6c,0x5a,0x07,
+0xb5,0x26,0xd7,0x21,0xad,0xad,0x3d,0xd3,0xc4,0x1c,0x85,0x7b,
+0xf0,0xb7,0x9b,0x9b,0x53,0xd8,0x7c,0x89,0xff,0xfc,0xcb,0xe6,
+0x4b,0x0d,0x07,0x83,0x87,0xd9,0x94,0x83,0xfc,0xba,0xf9,0xca,
+0x78,0x30,0x87,0x84,0x1e,0xe7,0xa8,0x75,0x99,0x67,0x3f,0x59,
+0xff,0xa3,0x24,0x5d,0x8c,0x79,0x32,0x68,0x21,0x28,0xdc,0x2c,
+0xa5,0xc3,0xab,0xc5,0x77,0x44,0x68,0x8a,0xdb,0xac,0xce,0x28,
+0x03,0x37,0x8a,0x62,0xcf,0x0f,0xf9,0x2d,0x78,0x00,0x6c,0x85,
+0x57,0x3b,0xc0,0x02,0xcd,0x4d,0xca,0xce,0x98,0xd3,0x28,0xc9,
+0xad,0xc2,0xa1,0xc7,0xf8,0x2f,0x96,0x6a,0x46,0xa7,0x6c,0x29,
+0xb9,0xf7,0x79,0x68,0xda,0x5d,0x33,0xbd,0xb3,0x8f,0xff,0x73,
+0x9d,0x84,0xe8,0x5b,0x9d,0xbc,0x0f,0x0d,0xda,0x28,0xeb,0x3b,
+0x02,0xeb,0x53,0x4c,0x9c,0x4f,0xbd,0x3c,0x82,0xd9,0x54,0xab,
+0xde,0x6a,0xc1,0x27,0xf6,0x20,0x1d,0x05,0x87,0x73,0x08,0x07,
+0x48,0x2f,0x96,0x64,0x7e,0x9c,0x25,0x14,0xfc,0x90,0x61,0x6a,
+0x5a,0x9a,0x47,0x21,0x2b,0x6e,0x3a,0x95,0x3b,0xa3,0xed,0x30,
+0x62,0xe1,0x1f,0x4d,0xfe,0x80,0x8a,0x5e,0xe2,0x87,0x94,0xc4,
+0x43,0x22,0x32,0x92,0xe9,0x25,0xbf,0x8a,0x36,0x7f,0x6d,0xda,
+0xda,0x7b,0xd0,0x56,0xcd,0x49,0xc4,0x04,0x86,0xcc,0x9d,0xc9,
+0x34,0x20,0x10,0x0d,0xc1,0xd1,0xe5,0x8f,0x03,0x69,0x42,0xf8,
+0x9f,0xb6,0xf8,0x3f,0xdb,0xfc,0x9f,0x1d,0xfe,0xcf,0x73,0x2e,
+0xa0,0xcf,0x5f,0x66,0x85,0xf0,0x34,0xba,0x23,0x45,0x9a,0x86,
+0xa0,0xd1,0x22,0x8c,0x8f,0x15,0x18,0x35,0x04,0x09,0x4c,0x1c,
+0x96,0x0e,0xca,0x49,0x44,0xcf,0x12,0x09,0xc0,0xdf,0x07,0x71,
+0x63,0xb6,0x20,0x10,0x0f,0x06,0x0b,0xd8,0xec,0xea,0x82,0xbd,
+0xa1,0x16,0x81,0x62,0x09,0x4c,0xf9,0xc6,0x73,0xb8,0xca,0xba,
+0xea,0xd1,0x3c,0xe5,0xe3,0xa0,0x51,0xba,0x35,0x26,0x99,0x17,
+0x54,0xd2,0x24,0xa2,0xee,0xd8,0x70,0xd3,0xb3,0xdd,0x44,0x5e,
+0xd6,0x33,0x73,0x8b,0xbb,0x63,0x61,0x7c,0xdb,0x96,0x7d,0xe7,
+0x2f,0x53,0xb1,0x93,0x55,0xdb,0xc8,0x68,0xed,0x8e,0xe1,0x15,
+0x74,0xba,0xcf,0x6b,0x80,0x95,0xf0,0x2f,0x59,0x9a,0xd6,0x70,
+0xc7,0x66,0xd0,0x97,0xad,0xa9,0xf6,0xd6,0xf3,0x55,0xda,0x7a,
+0xc9,0xdb,0x92,0x18,0xac,0xad,0xe4,0xda,0xd1,0x28,0xe5,0xed,
+0x30,0x52,0xf1,0xcf,0x9e,0x05,0x4f,0x7b,0x7e,0xd0,0x86,0xcf,
+0x1c,0xfe,0x15,0xec,0xd4,0x6a,0x76,0xa0,0x5d,0x09,0x84,0x51,
+0xf3,0x9b,0x6f,0x53,0xb0,0x87,0x9c,0xd8,0xe3,0x00,0x83,0xa3,
+0x6f,0xc8,0x42,0xd4,0x63,0x32,0x9a,0x05,0x4e,0xdc,0x9a,0xd1,
+0xe1,0xae,0x58,0x7d,0x0f,0x06,0x70,0x30,0x87,0x83,0x05,0x07,
+0x60,0x37,0x25,0x59,0x09,0x16,0xf4,0xb0,0xa8,0x07,0x07,0x0b,
+0x38,0x15,0x88,0x47,0xb1,0xad,0xb0,0x35,0xe1,0xc5,0xec,0x5a,
+0x27,0x07,0xe8,0x6e,0x55,0x3b,0xad,0xcd,0xd6,0x76,0xed,0x0f,
+0xb8,0x41,0xc0,0x3a,0x02,0xde,0xc2,0xcf,0x31,0x87,0x0c,0xf8,
+0xa5,0xd1,0x3d,0x96,0xd8,0xeb,0x02,0x08,0xf4,0xe0,0x02,0x06,
+0xec,0xbf,0x31,0xfb,0xaf,0xcb,0xfe,0x3b,0x85,0x67,0x70,0x9f,
+0x9d,0x75,0x79,0xd1,0x15,0x8c,0x6f,0xb5,0x84,0xc6,0xc2,0xd4,
+0x24,0xd6,0xfb,0x4a,0x3d,0x2d,0x03,0x98,0xef,0x21,0x78,0x73,
+0x0e,0x0d,0xd8,0xec,0xd6,0xd3,0xef,0x8b,0x82,0xef,0xbc,0x8d,
+0x3d,0x7d,0x9f,0x48,0x0f,0x5f,0x9a,0x26,0x9f,0x5e,0x67,0x4d,
+0x25,0x45,0x79,0xc7,0xdf,0x87,0x89,0x3a,0x32,0x89,0x02,0x2d,
+0x61,0x57,0x9a,0x6b,0xcc,0x8b,0xdc,0xa4,0x75,0x47,0x37,0xe7,
+0xf3,0xc6,0x68,0xda,0x72,0xc7,0xce,0x94,0x92,0xb8,0xb3,0x2d,
+0x12,0x82,0xe9,0x27,0x84,0x67,0x7d,0xd8,0x94,0x83,0x2f,0xe8,
+0xd6,0x57,0x5f,0xfc,0xb4,0x30,0x3f,0xb1,0x38,0x62,0x96,0x05,
+0x19,0x78,0xd4,0x74,0x77,0xab,0xa2,0x0b,0xba,0x76,0xbc,0x68,
+0xd7,0x38,0x24,0x9a,0x95,0x3b,0x0a,0x48,0xc5,0x4e,0xea,0x67,
+0x13,0x0d,0x72,0xb3,0x14,0xb2,0xab,0x41,0x6e,0x97,0x42,0x6e,
+0x66,0x5f,0x99,0x60,0x40,0xaa,0x72,0xbb,0xa2,0x4f,0x76,0xf6,
+0xe9,0x8f,0x1b,0x34,0x6c,0x73,0x36,0x6c,0x40,0xa5,0x2e,0x7f,
+0x2d,0xf0,0xd7,0xed,0xcf,0xb1,0xaa,0xc1,0x46,0x8a,0xe7,0x9f,
+0xd6,0x33,0x01,0x9b,0x89,0xa2,0xcc,0x71,0x4d,0x6f,0x37,0xaf,
+0x30,0xae,0x4f,0x1e,0x9c,0xfc,0x00,0xc8,0x5f,0xd0,0x5d,0xc2,
+0x7f,0xf9,0x0b,0xb6,0x96,0xb0,0x5f,0xfe,0xc2,0x94,0x3a,0xa5,
+0xdc,0x97,0xbf,0xd2,0x4e,0xa4,0x7c,0xe3,0xa2,0x53,0x11,0xdf,
+0x01,0x36,0x04,0xb4,0xf6,0xa1,0xd2,0xd3,0x8b,0x0d,0xdc,0xf0,
+0x1a,0xb6,0x60,0x0f,0xda,0xb5,0x42,0x70,0xc6,0x9b,0xd2,0xd2,
+0x79,0x71,0x53,0x58,0x3c,0x75,0x46,0x04,0xad,0xfd,0x66,0x1b,
+0xcf,0xee,0x2b,0x2b,0x8d,0x76,0x7a,0x4b,0x3c,0x1d,0xed,0xd5,
+0x46,0x90,0x41,0x6d,0x6c,0x18,0x10,0xe9,0xcf,0x1c,0x03,0x15,
+0xe3,0x78,0x2f,0x74,0xf1,0xed,0x19,0xe2,0x7b,0xba,0x1a,0xe1,
+0xf2,0xbe,0xfb,0x63,0xc9,0xce,0x12,0xf6,0xd2,0x60,0xa8,0x1c,
+0xbc,0x67,0x28,0x16,0x72,0x04,0xd5,0xb7,0x3f,0x36,0x95,0x09,
+0xa2,0xf6,0xc4,0x21,0xcb,0x0e,0xb7,0xbd,0xc5,0xca,0xa4,0x82,
+0x07,0x8e,0xd3,0x4a,0xad,0x8c,0x17,0xda,0x02,0x77,0x73,0x2b,
+0x96,0x67,0x43,0x17,0x11,0xa4,0xf6,0xf2,0x25,0x8c,0xc8,0xa2,
+0x82,0x45,0x4d,0xb7,0x9d,0x68,0xbc,0x3a,0xc5,0x81,0xe2,0x17,
+0x13,0x9b,0x98,0x9d,0xf3,0x40,0xbc,0x61,0x2c,0x32,0x76,0xf1,
+0x12,0xf1,0x4a,0xb0,0xe5,0x9e,0xa3,0x71,0xca,0x28,0x3e,0xc1,
+0x24,0x63,0x5f,0xe9,0xe2,0x75,0x98,0x10,0xea,0xa8,0x1f,0x18,
+0xf3,0x9f,0x96,0x44,0x5e,0xaa,0x2c,0xd2,0xfb,0x08,0x82,0xe8,
+0x1e,0x06,0x3e,0x4d,0xf6,0xe4,0xc7,0x36,0xf4,0x53,0xc5,0x1e,
+0x6f,0xa3,0x42,0x5f,0xdc,0x15,0x90,0x5f,0xba,0xd0,0xe7,0x59,
+0x7c,0xe5,0x87,0x4d,0xfc,0x40,0x02,0xe2,0x24,0x0a,0x46,0x1e,
+0xcb,0x5a,0x78,0x06,0x51,0xb8,0x3b,0x3c,0x1f,0x6f,0x17,0x1a,
+0xdc,0x85,0xbf,0xb3,0x05,0x8e,0xe7,0x11,0xef,0xa9,0x27,0x9a,
+0xa5,0xd6,0xba,0x02,0x8b,0xdd,0x12,0xab,0x5d,0x89,0xe5,0x2e,
+0x67,0xbd,0x2b,0x35,0xd4,0x7d,0xa1,0xb1,0xce,0xcc,0x3e,0xbf,
+0xd2,0x21,0x2d,0xbf,0x2a,0x5b,0x2b,0x66,0x4e,0xe5,0x76,0x8e,
+0x7a,0x84,0x3d,0x69,0xfa,0x12,0xda,0xaa,0x18,0xf9,0xb2,0xb3,
+0x65,0x70,0x71,0x67,0x7b,0xf9,0x39,0x92,0x9b,0x04,0xec,0xad,
+0xb0,0xb2,0x43,0x12,0x50,0xe7,0x27,0x78,0xf5,0xa4,0xa6,0x1e,
+0x94,0x40,0x87,0x64,0xce,0x1e,0x72,0x22,0x84,0xc9,0x34,0x3b,
+0xec,0xd0,0x31,0xe1,0xb9,0xa5,0x7d,0x12,0xa7,0x52,0xbe,0x05,
+0x7d,0x3e,0x67,0xea,0xb0,0x8b,0x02,0x4e,0x70,0x1e,0x77,0x76,
+0xa0,0x2f,0x5f,0x04,0xe0,0x22,0x89,0x10,0x9c,0x4c,0xf6,0x27,
+0x3e,0xbf,0x28,0x36,0x27,0xde,0x34,0xd6,0xe3,0xe5,0xf8,0x17,
+0x2f,0xde,0x4d,0x8b,0x71,0xea,0xf1,0x62,0xfc,0x8b,0x17,0x77,
+0x76,0xb4,0xea,0x91,0x27,0xe9,0x80,0xcf,0x1c,0xd9,0x67,0x56,
+0x29,0x9d,0xa3,0x61,0x84,0x50,0x49,0x56,0x8d,0xec,0xda,0xd4,
+0x48,0xd6,0x1c,0x5a,0xc4,0xc5,0x27,0x44,0xff,0xac,0x2f,0x10,
+0x66,0xae,0xb6,0xf0,0x43,0x96,0x96,0x4b,0x25,0xc5,0xc4,0xa9,
+0x6a,0x67,0x99,0xab,0x4e,0x8d,0x40,0x23,0xb8,0xba,0x30,0x8d,
+0x21,0xd5,0xcd,0x2e,0x2e,0xcc,0x58,0xf5,0xe5,0x4b,0xe8,0xd6,
+0x6a,0x6a,0xeb,0x12,0x5d,0x11,0x07,0x28,0xf9,0x4d,0x3f,0x79,
+0x67,0x6c,0x25,0xf2,0x5e,0x87,0xc7,0x4c,0x08,0x51,0x90,0xb4,
+0xd0,0xa1,0x95,0x59,0x13,0xd3,0x13,0xb1,0xb6,0x26,0xce,0xeb,
+0xb0,0xa8,0xc3,0x7d,0x1d,0xc6,0x75,0x20,0x1a,0x0f,0x45,0x9a,
+0x40,0x91,0xd4,0x3f,0x51,0x57,0x9c,0x50,0x0b,0xf8,0x91,0x19,
+0x41,0xc3,0xe8,0x5e,0x71,0x98,0xdc,0x35,0x79,0x81,0xb2,0xca,
+0x1a,0x87,0xec,0x39,0x1f,0x50,0x06,0xc2,0x59,0xb4,0x48,0xbf,
+0xfc,0xc4,0xbf,0x30,0xcb,0x9b,0x6e,0x13,0x4d,0x69,0x11,0x37,
+0x62,0x94,0x2b,0x84,0x5f,0x6f,0x89,0xd8,0x6b,0x77,0x17,0x69,
+0xfa,0x2c,0x7e,0x94,0xe7,0x91,0x8a,0x3e,0x1e,0xe2,0x63,0xc2,
+0x52,0x7e,0xa3,0x1e,0xc9,0x00,0xd2,0x90,0xf1,0x67,0xcf,0xb0,
+0xbd,0x6f,0xfa,0xa2,0xc5,0x34,0x3c,0x5b,0xfc,0x71,0x24,0x63,
+0xce,0xe5,0xf8,0xb2,0xfd,0x9e,0x04,0x4d,0xde,0xe8,0x09,0x06,
+0x3c,0x89,0x92,0x85,0x51,0x72,0x1d,0x4d,0x53,0x1d,0x90,0xd9,
+0x00,0x35,0x2a,0x99,0x0d,0x90,0x18,0x9e,0x8e,0xa0,0xa9,0x03,
+0x68,0xce,0x0e,0x23,0xa4,0x3d,0x2b,0x56,0xe2,0xaa,0x35,0xb3,
+0x14,0x68,0x83,0x0d,0x70,0x9f,0xe1,0x61,0x93,0xbf,0xcd,0xf0,
+0x03,0xda,0xd7,0x39,0x92,0xb1,0x1d,0xe2,0x1d,0x8b,0x68,0xec,
+0xa9,0xd1,0x3a,0x75,0xe8,0xb8,0xc9,0x7c,0x54,0xd5,0xea,0x1c,
+0x5a,0x70,0x5f,0x83,0x6f,0x79,0x3d,0x6c,0xb0,0x96,0x0e,0xa2,
+0x0e,0xb8,0x80,0x16,0x8c,0x15,0xa0,0x78,0x31,0x5f,0x0d,0x0d,
+0x01,0xee,0xf0,0x8c,0xc0,0xb9,0x8b,0x7c,0x8f,0x9d,0x36,0xd9,
+0x2d,0x29,0x51,0xee,0x78,0xca,0x04,0x92,0xc8,0xac,0xf1,0xe2,
+0x1e,0xb6,0x92,0xb3,0x39,0xae,0xac,0x35,0x98,0xa7,0x73,0x8d,
+0x7f,0x7d,0xa5,0xd1,0xc6,0x4a,0xd5,0xcf,0x14,0x6a,0xc1,0xeb,
+0x2e,0xcc,0xba,0x0b,0x78,0xa5,0x91,0xcb,0x4a,0xd5,0xcf,0x94,
+0x78,0x6e,0x00,0x47,0x8a,0x13,0xf6,0xde,0x3e,0x7f,0x96,0x87,
+0x9b,0x6e,0xb8,0x88,0x52,0x27,0xa6,0x09,0x38,0x14,0x36,0xbb,
+0x50,0xbd,0xba,0xa8,0xb1,0x29,0x82,0xd1,0x59,0x4d,0xc1,0xd3,
+0x8d,0x54,0x39,0x5c,0x18,0x06,0x23,0x31,0xcb,0x95,0xa4,0xed,
+0xc1,0x5c,0x06,0x2e,0x2f,0xf6,0x60,0x21,0xff,0xe6,0xcf,0xbe,
+0x88,0x8d,0x9e,0x6d,0x7f,0xa9,0xd1,0x4f,0x93,0xa8,0x9c,0x3d,
+0x59,0xed,0xdb,0x58,0x2f,0x9b,0x9c,0x32,0xac,0x92,0x60,0xc5,
+0x7b,0x20,0x8c,0x2b,0x5a,0xce,0xa8,0xbc,0x1d,0x0d,0xd9,0xc3,
+0x46,0x4d,0xd3,0x1b,0x4c,0x6b,0x72,0x0a,0x4b,0xb8,0xf7,0x9b,
+0xb9,0x3d,0x2c,0xee,0x53,0x09,0x86,0xb9,0x8e,0x90,0x91,0x91,
+0xe7,0xc1,0x60,0x26,0x65,0xc5,0xb2,0xa6,0xe3,0x8c,0x2e,0x5c,
+0x9e,0x4b,0xf7,0x00,0x8d,0xc2,0xdf,0xe1,0x97,0x5f,0x98,0xa7,
+0xe0,0x97,0x5f,0x90,0x63,0x75,0xc1,0x73,0xa5,0x32,0x68,0xcf,
+0xf4,0x58,0x6f,0x07,0xea,0x53,0x14,0xfd,0x0c,0xd2,0x5d,0x63,
+0xd0,0x60,0xd0,0xc7,0x9e,0x7c,0xd5,0x16,0x20,0x39,0x16,0x98,
+0x03,0xb8,0x52,0x57,0x66,0x50,0x8d,0x23,0xf3,0x4e,0x1b,0xf0,
+0x81,0x18,0x87,0xfa,0xec,0x11,0x96,0x05,0x6e,0x3d,0x44,0xbc,
+0xc9,0x88,0xf0,0x82,0xfb,0x52,0xb9,0x4c,0x32,0x23,0x38,0xef,
+0x64,0x19,0x50,0x44,0xc3,0x6c,0xaa,0x49,0x03,0xcc,0xa6,0x9a,
+0x40,0xd8,0x46,0x36,0xa7,0xd8,0x99,0x1d,0x1d,0x0e,0x57,0xed,
+0xa9,0x44,0x54,0x58,0x85,0x11,0x36,0x9b,0xe6,0xde,0xf5,0xca,
+0x8d,0x46,0xfa,0xc8,0xd5,0xc3,0x5a,0xf9,0x9d,0xce,0x35,0x43,
+0xac,0x72,0x22,0xd4,0x6a,0xc1,0x23,0x86,0x0a,0xe1,0xf5,0xe9,
+0x95,0xce,0xd3,0xa7,0xcc,0x2e,0x83,0xa7,0x72,0xf4,0xf4,0x2b,
+0x68,0x19,0x23,0x59,0xae,0x48,0xb7,0xb3,0xe8,0x48,0x6d,0x03,
+0x58,0xce,0x20,0x70,0x30,0x43,0x91,0xee,0x43,0xe2,0x59,0x37,
+0xfc,0x70,0x04,0x7e,0x98,0x3a,0x76,0x93,0xb1,0xbc,0x3b,0x2d,
+0x7c,0x03,0x8f,0xe2,0xc5,0x8a,0xac,0xc8,0x25,0x51,0xb4,0x5e,
+0x73,0x56,0x8b,0x65,0x56,0x7d,0xcf,0xf8,0xdb,0x79,0x47,0x0e,
+0xfd,0x64,0x5a,0x35,0xb4,0x78,0x78,0x0d,0x8d,0x6d,0xd8,0x83,
+0x6d,0xbb,0xcd,0xdb,0x52,0x37,0xa3,0x9b,0xe7,0x10,0xac,0x7c,
+0xb9,0xf8,0x90,0xbf,0x7f,0xb7,0x3c,0xb8,0x53,0x3c,0x94,0x97,
+0x77,0x68,0x66,0x53,0xdf,0x65,0x73,0x41,0xfa,0xd4,0x5a,0x90,
+0xe6,0xf8,0xff,0xfd,0x41,0x7d,0x14,0xd9,0x3b,0x33,0x8d,0x3c,
+0x18,0xd8,0x88,0xad,0x54,0x05,0x36,0x4a,0x85,0x43,0xbb,0xa9,
+0xa7,0x47,0x2d,0xe6,0x8b,0x45,0x2e,0x74,0x6b,0x74,0x97,0x8c,
+0xfb,0xd5,0x3c,0xf7,0xec,0x69,0xa5,0x8a,0xc9,0xc3,0x4b,0x82,
+0x1e,0x6d,0x94,0xcf,0xa3,0x70,0xe4,0x87,0x44,0x25,0x6d,0x3b,
+0x0e,0xb5,0xa8,0x30,0x90,0x4f,0x29,0xe3,0x7e,0x9d,0xfa,0x5e,
+0x10,0xce,0x4f,0xc4,0x33,0x7a,0xe0,0x24,0xe0,0x80,0x13,0x02,
+0x7b,0x40,0x8a,0x1f,0xc5,0x1d,0x13,0x96,0xbd,0x15,0x04,0x9b,
+0xdd,0xc6,0xc0,0xa7,0xcc,0xc1,0x36,0x22,0x71,0x73,0x8d,0x45,
+0x45,0xc4,0x09,0x05,0x76,0xfb,0x67,0x0f,0x1c,0x98,0xd1,0x61,
+0xa3,0xb3,0x93,0xd6,0x65,0x30,0x57,0x04,0xdf,0xc5,0x11,0x40,
+0xf8,0xe1,0x0c,0xcf,0x65,0x2f,0xb8,0x9d,0x41,0x0b,0x5b,0x16,
+0x51,0xc6,0xd5,0x76,0x63,0xbb,0xd3,0xa9,0x35,0x73,0x90,0x18,
+0x38,0x5c,0x0e,0xd9,0xd9,0x12,0xa0,0x0e,0x4c,0x9c,0x84,0x07,
+0x01,0x31,0xb7,0x3c,0x0c,0x03,0x67,0x24,0xdd,0xf7,0x9d,0x3e,
+0x06,0x6e,0xd4,0xa1,0xdb,0x67,0x41,0x01,0x81,0x1f,0x92,0x3a,
+0x6c,0xf5,0x59,0xdc,0x59,0x1d,0x76,0xfb,0x3e,0x6a,0xa0,0x09,
+0xc1,0x03,0x60,0x5f,0x05,0x21,0x58,0xc5,0x53,0x84,0xda,0xe9,
+0xb2,0xc1,0xb4,0xa5,0x3a,0x90,0xd0,0x4b,0x3d,0xef,0x73,0xe1,
+0x57,0x5f,0x88,0x7f,0x7d,0xf1,0x6f,0xc0,0x86,0x8d,0xfd,0x19,
+0xcd,0xa4,0x3b,0xde,0x95,0xc9,0xde,0x59,0xe4,0x88,0xf8,0x1b,
+0xcd,0x41,0xe2,0x4f,0x87,0xd2,0x58,0xfc,0x39,0x18,0x89,0x3f,
+0x86,0xea,0x0f,0xec,0xa6,0xf8,0x3b,0x16,0x87,0x98,0x3a,0x64,
+0xe2,0x97,0x71,0x27,0x6d,0x70,0xb5,0x0e,0xdf,0x01,0x4c,0x83,
+0x04,0x5b,0xd0,0x95,0x72,0xab,0x42,0xa1,0x0b,0x04,0x38,0x5d,
+0x89,0xf8,0xb7,0x9a,0xa8,0xb1,0x4c,0xb0,0xd7,0x40,0x44,0xc4,
+0xa4,0x01,0x9d,0x4c,0x8f,0x65,0xca,0x29,0xcf,0x93,0xa9,0x51,
+0x29,0xa9,0xe3,0xb9,0x1c,0xc5,0x75,0x31,0x7d,0x66,0x05,0xd1,
+0xa8,0x5a,0xf9,0x95,0x84,0xde,0xaf,0xe0,0x27,0x40,0xa3,0x08,
+0x02,0xbc,0xaa,0xdb,0x84,0xd3,0x28,0xa1,0xf2,0xb9,0x32,0x87,
+0x29,0xe0,0x07,0x57,0x97,0xcd,0x8a,0x32,0xd7,0x79,0x60,0x41,
+0xcd,0xb3,0xda,0x4a,0x93,0x1b,0x0f,0x0e,0x5d,0xc0,0xcb,0x3e,
+0xc2,0xf7,0x60,0xa1,0xe5,0x3b,0x63,0x37,0x5f,0xd1,0xd4,0x9a,
+0xa6,0xf5,0x65,0x84,0x03,0x88,0xb8,0xd9,0x14,0xf7,0x4d,0x1c,
+0xdd,0xdf,0xaa,0x24,0x58,0x69,0x7a,0x4b,0xa9,0xa3,0xcb,0x1c,
+0x42,0x9a,0x49,0x53,0x45,0x45,0xa7,0x99,0x6f,0xf4,0xb2,0x6a,
+0xda,0xa8,0x56,0x9b,0x25,0x1b,0x96,0x11,0xeb,0x69,0xa6,0xda,
+0x9a,0x5e,0xf3,0x9b,0x5c,0xfe,0x60,0xfd,0x18,0x28,0x30,0xcd,
+0xad,0xdb,0x01,0x16,0x37,0x3a,0x86,0xca,0xe1,0xd8,0xf2,0x81,
+0x02,0x80,0xf6,0x4c,0x81,0x11,0x63,0xcb,0x06,0xde,0x88,0xaf,
+0x05,0x69,0x7b,0x45,0x4e,0xdd,0xf8,0xb7,0xe2,0x46,0x11,0xfe,
+0xcf,0x1d,0x6b,0x9f,0x3b,0xd2,0x34,0xab,0xdf,0xb8,0x98,0xd7,
+0x64,0xed,0x46,0xc7,0x28,0x66,0x5f,0xf1,0x00,0x8c,0x04,0x66,
+0x1f,0xf8,0xc4,0x6f,0x2a,0xd9,0x90,0x24,0x5b,0x07,0x4a,0x2f,
+0x47,0xbc,0x6c,0x25,0x53,0x27,0x7c,0x55,0x29,0x7a,0xfb,0x51,
+0xb5,0x53,0x8c,0x4a,0x81,0x21,0xc1,0x8d,0x8e,0x59,0xa8,0xb5,
+0x84,0x0d,0x01,0x0b,0xd1,0xee,0xaf,0xc7,0x84,0x2d,0x3f,0x8d,
+0x3b,0xdf,0x23,0x11,0x64,0xee,0xe0,0xac,0xeb,0xe4,0xe4,0x06,
+0xc9,0x86,0x95,0x45,0xac,0xf4,0xd7,0x2b,0x8a,0x45,0xfc,0x7f,
+0x83,0x11,0xf4,0x39,0xff,0x44,0x22,0xd0,0x9e,0x51,0x3c,0xc4,
+0x62,0x4e,0xfa,0xab,0x57,0x98,0x14,0xd6,0x0e,0x85,0xcb,0x8d,
+0xc4,0x83,0xa9,0xdc,0x76,0x33,0xad,0xe0,0x69,0x21,0x0a,0x3c,
+0xe3,0x1b,0xf2,0x84,0x57,0x7c,0x06,0x39,0x8e,0x64,0x6f,0xe6,
+0xa7,0x21,0x6f,0x79,0xc8,0xb4,0xa7,0xec,0x7a,0xd4,0x3d,0x3b,
+0xe7,0xef,0x61,0x7b,0xbd,0x4a,0x2f,0x03,0xfb,0x90,0xf9,0xcd,
+0xb6,0x25,0xb2,0xc7,0x23,0xd0,0xbe,0xc5,0x3a,0x07,0x69,0x46,
+0xbc,0x0c,0xad,0x23,0x78,0x09,0xbb,0x35,0x76,0x81,0xa9,0x0f,
+0xbb,0x26,0xe6,0x87,0x5c,0x7f,0xd5,0x9e,0x52,0xd8,0xe9,0x6e,
+0xbe,0x2b,0xb2,0x23,0x18,0x3d,0xd5,0xc0,0x37,0x40,0xf9,0xad,
+0xb0,0x3d,0x85,0xac,0x57,0x59,0xd6,0x2e,0xdb,0xbe,0x0a,0xdb,
+0xdc,0xb2,0x33,0xba,0x84,0x24,0xb9,0x5c,0x45,0x33,0xaa,0x65,
+0xe0,0xef,0xd4,0x7a,0x85,0xa3,0xc0,0x49,0xb0,0xf0,0xde,0x26,
+0xa4,0x65,0xbd,0x2e,0xc2,0xb3,0x84,0x03,0x62,0xdf,0x2e,0xe4,
+0xc1,0x6e,0xbe,0x93,0x83,0x95,0xc4,0x5c,0x4c,0x87,0xe2,0xd9,
+0xc2,0xe5,0x89,0x9b,0xf2,0x04,0x15,0x3c,0xea,0x69,0x40,0xe4,
+0xe3,0x9a,0xfc,0x85,0xff,0x4c,0x15,0xfe,0x32,0x60,0x2a,0x7d,
+0x40,0x58,0x20,0x29,0x7b,0x68,0x84,0x38,0xde,0x6b,0xcb,0x88,
+0xe9,0x53,0xe7,0xd9,0x33,0x78,0xa4,0x70,0xa6,0xea,0x4c,0xe1,
+0x8c,0xdc,0x29,0x96,0x4e,0x56,0x97,0x9d,0xcc,0xf7,0xc6,0x6c,
+0xf7,0x58,0x2e,0x95,0xb2,0xea,0xba,0x5c,0xdd,0x2a,0x59,0x08,
+0xe6,0xdf,0xcb,0xdf,0x6a,0x13,0xba,0x4d,0x16,0x10,0x4a,0xea,
+0x1b,0x97,0xd8,0x86,0xf6,0xfa,0x6c,0xfd,0xcc,0x75,0x7e,0x30,
+0xe2,0x71,0xcf,0xdb,0x25,0x9d,0xcf,0x5d,0xaf,0xab,0x64,0x00,
+0x41,0xaa,0x03,0xe2,0x92,0xca,0x60,0x74,0x6b,0x81,0xa8,0x2c,
+0xe1,0x99,0x58,0x71,0xbe,0xd1,0xaf,0x14,0xda,0xc8,0x59,0x8d,
+0x86,0xe1,0x93,0x68,0x50,0x83,0x96,0xd9,0x6c,0x72,0xfb,0xa0,
+0xaa,0x27,0x9d,0x75,0x69,0xe4,0x56,0xea,0xf2,0x79,0xa6,0x79,
+0x7a,0x52,0xdc,0xcf,0x9c,0xc9,0xd4,0x24,0xc3,0xf0,0x16,0xc9,
+0xca,0x2f,0xed,0x95,0x03,0xba,0x42,0xdd,0x57,0xf6,0xba,0xa3,
+0xf2,0xba,0xe2,0x1a,0xdd,0x5e,0x66,0x17,0xc7,0x90,0x2e,0x5c,
+0xe3,0x2a,0x45,0x7b,0xf8,0xb3,0x70,0x90,0x64,0x7a,0x64,0x5d,
+0xf8,0x10,0x99,0x9f,0xfc,0xe0,0x7b,0x04,0xb9,0x55,0x43,0x75,
+0xa8,0x67,0x43,0xe8,0x8e,0xed,0xbc,0xcf,0x10,0xac,0x86,0x40,
+0x68,0x63,0xb8,0x48,0xe5,0xbc,0xfd,0x4b,0x94,0x1e,0xbb,0xc2,
+0x23,0xea,0x1b,0x57,0x96,0x6e,0x16,0xb7,0xc6,0x3d,0x6a,0x96,
+0x6b,0x55,0x4b,0x8e,0x97,0x39,0x0c,0x94,0xdc,0x61,0x2a,0xc8,
+0x17,0xf9,0x8b,0x96,0x2a,0xf5,0x89,0x79,0x23,0x2d,0x69,0x23,
+0xff,0xd6,0x87,0x8e,0x2a,0x28,0xcc,0x1b,0x59,0x40,0x52,0x9a,
+0x67,0xd3,0x4e,0xd0,0x37,0xd9,0xe6,0x8c,0x13,0x8a,0xf6,0x1d,
+0x04,0x15,0xcb,0xe8,0xc8,0x08,0x0e,0x86,0xb1,0x93,0xc9,0x34,
+0x8a,0x9d,0xd8,0x0f,0x16,0xe0,0xf9,0x09,0x9a,0x36,0x3c,0xe5,
+0xbb,0xd4,0x91,0xa9,0xab,0x51,0x32,0x99,0xa0,0xad,0x3f,0xea,
+0x0e,0xd5,0xf2,0xfe,0x30,0x30,0x9d,0xb5,0xb9,0x17,0xb2,0xa4,
+0x61,0x85,0xed,0xd9,0xc4,0xc2,0x22,0x61,0x49,0xd2,0x07,0x56,
+0x10,0x98,0xa9,0xcc,0xdc,0x13,0xf4,0x38,0xa4,0x24,0xbe,0x73,
+0x82,0xaa,0x81,0xb6,0x0e,0xdb,0xea,0xde,0x40,0xf1,0x39,0xfc,
+0xa9,0x9d,0x72,0x03,0xe2,0xc4,0xb6,0x86,0x6b,0x5f,0x8f,0x44,
+0x6e,0x49,0xb3,0x47,0xe6,0xc7,0xd1,0xbd,0x3a,0xf6,0x6e,0x6c,
+0xe8,0x6f,0xc7,0xc8,0x29,0x9b,0xa6,0x00,0x36,0x84,0x4b,0x40,
+0xe9,0x3f,0x5a,0xd0,0x85,0xcf,0xd2,0x0b,0x64,0x3c,0xa1,0x90,
+0xfe,0x90,0xcf,0x0d,0x55,0xb5,0x7a,0x1b,0xa9,0x1d,0xa0,0x86,
+0x59,0xd3,0xb3,0x6f,0xd9,0xf0,0xd3,0xa6,0xd6,0x92,0x34,0x9c,
+0x06,0x0e,0x3b,0x69,0x33,0x7d,0x37,0x8e,0xee,0x0d,0x18,0x1d,
+0xab,0xfe,0x64,0x4c,0x32,0x1b,0x50,0x34,0x10,0x71,0x97,0x0a,
+0x7f,0x5d,0x46,0x30,0x28,0x26,0x23,0x3f,0x0a,0x05,0xae,0x46,
+0xe6,0xc9,0x19,0x68,0xe4,0x9f,0xa5,0x51,0x9c,0x63,0x8d,0xf7,
+0x4b,0x2c,0x06,0x2c,0x10,0x99,0x12,0xfe,0x60,0x72,0x34,0xa5,
+0xfe,0xc4,0xff,0x3b,0x57,0x38,0x55,0xf1,0x2c,0x61,0x39,0x05,
+0xfd,0x04,0x86,0x4e,0x42,0x65,0x0a,0x32,0xf6,0x4e,0xa4,0xe6,
+0xcf,0xbb,0x1f,0x13,0x66,0x63,0x5b,0x80,0x33,0x89,0x66,0xa1,
+0x7a,0x08,0x3a,0x71,0x26,0x24,0xf5,0x09,0xa6,0xf7,0xf6,0x56,
+0x7d,0x91,0x22,0x33,0xeb,0x1d,0xcf,0x63,0x17,0x59,0x43,0x72,
+0x0f,0xea,0x40,0xa1,0x8f,0x22,0x7f,0xbe,0x32,0xc6,0x84,0x47,
+0xf2,0xb2,0xa7,0xf5,0x95,0x8b,0x34,0x1d,0xae,0x7a,0xe4,0xe7,
+0x1b,0x1e,0x30,0x98,0x9a,0xa6,0xb5,0x41,0x33,0xca,0x74,0x49,
+0x6b,0x34,0x7a,0xc6,0x37,0x8b,0x4c,0xa4,0x7b,0x55,0x9e,0xd0,
+0xbc,0x5c,0x28,0x7a,0xea,0xba,0xc0,0xc9,0x35,0x6d,0xe2,0xcc,
+0x79,0xbe,0xa0,0x74,0x1a,0xce,0xa6,0x9e,0x43,0x09,0xff,0x6a,
+0x62,0x58,0x0a,0xc3,0xa5,0x65,0xd9,0x04,0x3d,0xe4,0x5d,0x4a,
+0x93,0xae,0xf8,0xc9,0x54,0xb3,0x38,0xf3,0x2e,0x6f,0xf4,0x41,
+0x59,0x7c,0x52,0xde,0xb1,0xa2,0x57,0x1a,0x37,0xcc,0xa9,0x6a,
+0x65,0x96,0x9e,0x5c,0x34,0x85,0x7a,0x99,0xb2,0x3f,0xff,0x6c,
+0x54,0x3a,0x27,0x4b,0x2e,0xfa,0x16,0xf4,0x31,0x67,0xc9,0xf6,
+0x54,0xee,0x52,0x5c,0x87,0x02,0xa1,0x3f,0x58,0x1e,0x9d,0x14,
+0x7f,0x7f,0x14,0xff,0xba,0xd2,0xc8,0xe8,0x8e,0x7b,0x6b,0xb6,
+0xe7,0x6e,0x54,0x4f,0x2d,0xef,0xde,0x68,0x65,0x6b,0x56,0xe1,
+0x4b,0x3b,0xbd,0x02,0x0b,0xc1,0x26,0x2c,0x86,0x1c,0xa1,0x91,
+0xf0,0xdf,0xae,0xce,0xcf,0x9a,0x3c,0x27,0x81,0x3f,0x5c,0xb0,
+0x7e,0x37,0x63,0x32,0x0d,0x1c,0x97,0x54,0x5b,0x18,0x98,0xd7,
+0x1a,0xd5,0xa1,0xf2,0xb7,0x9b,0x4a,0xad,0x56,0x2b,0x7f,0x60,
+0x93,0x19,0xa6,0xb0,0xfe,0x8d,0x2f,0x8c,0x55,0x52,0xf9,0x4d,
+0x1f,0xdb,0xca,0x04,0xab,0x71,0xa7,0x5b,0xaa,0x51,0xda,0xb5,
+0x65,0x46,0x70,0xe5,0xe7,0x76,0xc5,0xfc,0xc2,0x75,0xd9,0x9f,
+0xdb,0x95,0x3d,0xeb,0xf7,0x6e,0x3b,0x57,0xa2,0x34,0xc4,0x2c,
+0x6a,0x47,0x47,0x2d,0xea,0xcf,0xdb,0xcf,0x8d,0xfa,0xf2,0x02,
+0x24,0x09,0x82,0x6a,0xe6,0xac,0x5f,0x80,0x15,0x3d,0xeb,0x95,
+0x9f,0xef,0xd8,0x7f,0x87,0x96,0x16,0xc2,0xca,0x5e,0xfe,0xe3,
+0xbc,0x3d,0xb0,0x7f,0x76,0x33,0xd4,0xe8,0xc9,0x23,0x44,0x0e,
+0xfe,0xfc,0xa1,0xc8,0x7c,0x4a,0xad,0xc8,0x62,0x80,0x8a,0xd4,
+0xf9,0xe1,0xf9,0x1e,0x1c,0x4f,0xa6,0x5c,0x0f,0x05,0xe2,0xd0,
+0x5f,0x42,0x72,0x8f,0xcb,0xd4,0x2f,0xa3,0x00,0x47,0xa5,0x99,
+0xad,0xa2,0x08,0x88,0x89,0x13,0xfc,0x08,0xaf,0x34,0xc3,0x75,
+0x2d,0x7b,0x76,0x30,0x35,0x32,0x04,0xcf,0x91,0xc4,0x85,0x37,
+0xab,0xf3,0xa7,0x93,0x40,0xae,0x20,0xc6,0xa2,0x65,0xef,0xf0,
+0x22,0x5d,0x8f,0x8d,0xef,0xbc,0x6a,0xb5,0x56,0xc6,0x8b,0x82,
+0xb1,0x8c,0x2d,0xe3,0x17,0xdb,0xe4,0xc3,0xc2,0xec,0x02,0x94,
+0x03,0xab,0xd0,0xed,0x16,0x0d,0x33,0x06,0xbc,0xb4,0x8b,0x46,
+0xb8,0xd1,0x78,0x42,0x9f,0xa8,0x85,0x00,0x5a,0xd4,0x27,0xf6,
+0x07,0xc6,0x0d,0xe2,0x13,0x50,0x2b,0x4d,0x00,0x1e,0xae,0x27,
+0xfd,0x37,0x99,0x6e,0x12,0x5b,0x3b,0x09,0xa1,0xa3,0x13,0x72,
+0x47,0x82,0x6a,0x67,0xf5,0x06,0xfc,0xd0,0x86,0x7f,0x58,0x8e,
+0xbf,0xbd,0xda,0x0c,0x26,0xb6,0x21,0xea,0x0c,0xac,0xb8,0xc5,
+0x41,0x46,0x3c,0xd7,0xbb,0x0c,0xbd,0xe5,0x30,0xcd,0xdb,0x84,
+0x4a,0x6e,0xf8,0xf1,0x1a,0x93,0xf5,0x84,0xad,0x2f,0x02,0xe2,
+0x45,0x3a,0xe5,0x21,0xe1,0xbf,0x6f,0xdc,0xf1,0x6d,0xbe,0x96,
+0x58,0xab,0xb3,0x80,0x79,0xb3,0x62,0x51,0x6b,0xf3,0xcc,0x6c,
+0xcf,0x37,0x50,0x34,0x17,0x8a,0x67,0xfa,0x53,0x66,0x7b,0xd9,
+0x8c,0x5f,0x32,0xeb,0xf3,0xb3,0xc4,0xd2,0x61,0xcd,0x59,0x25,
+0xc8,0xda,0xd0,0x36,0xd9,0x5b,0xfe,0x71,0x7e,0x0b,0x7d,0xb8,
+0xd1,0x9f,0x10,0xab,0x83,0x85,0x9b,0x1c,0x76,0x63,0xc3,0xfa,
+0x3d,0xa7,0x9a,0xa9,0x30,0xf9,0x62,0xfb,0x48,0x9e,0x19,0xea,
+0xdd,0x6c,0x93,0xce,0x12,0x3e,0xe3,0xf0,0xb1,0xd7,0x7e,0xa4,
+0x7f,0x6c,0xf9,0xc8,0x1a,0x5c,0xf9,0x28,0x79,0x80,0xea,0x95,
+0x85,0x0f,0x15,0xa8,0xdc,0xda,0x06,0xc6,0xb2,0x3d,0xd8,0x06,
+0xc4,0xde,0xd6,0xca,0xed,0x14,0xb1,0xfc,0x61,0xf9,0x5a,0x99,
+0x2f,0xcc,0xc7,0x6c,0x8b,0xa9,0xbe,0x92,0xfa,0x72,0x74,0x75,
+0x80,0xd7,0xf6,0x78,0xcc,0x34,0x5c,0x91,0xdf,0x66,0x24,0x74,
+0x09,0x1c,0xe3,0x6f,0x6f,0xe6,0x92,0x18,0xaa,0xec,0xe6,0x9e,
+0x9f,0x40,0x7b,0xfe,0x62,0x50,0x6b,0xe6,0x16,0x9e,0x1b,0xdb,
+0xaa,0x93,0x79,0x5c,0x30,0x53,0x6a,0x7b,0x66,0xb0,0x60,0xd9,
+0x72,0x13,0x7f,0x85,0x15,0x11,0x7b,0x71,0x8b,0xe9,0xc7,0xd0,
+0x1f,0x11,0x8e,0xe0,0x6a,0x91,0x50,0x32,0x81,0x83,0x68,0x32,
+0x71,0x42,0x0f,0xaa,0x70,0x7e,0x75,0x20,0xba,0xe0,0x59,0xba,
+0x70,0xfb,0xa7,0x76,0x21,0x4a,0xdc,0x15,0xbb,0x70,0x01,0x87,
+0xe4,0xce,0x77,0x49,0x3a,0x1e,0x4c,0xff,0x85,0x2a,0x1c,0x1e,
+0x5c,0x09,0xfa,0xdb,0x16,0xfa,0x2f,0xfe,0x54,0xfa,0x3d,0x37,
+0x59,0x91,0xfe,0x5f,0x60,0x3f,0x0d,0x84,0x82,0x0b,0x1e,0x2f,
+0xab,0x8d,0xc2,0xfe,0x85,0x1c,0x85,0xa1,0xa5,0x17,0xbf,0x94,
+0x6d,0x5f,0x3c,0x04,0x7c,0x45,0x3a,0xfe,0x06,0x17,0xb1,0x7f,
+0xe7,0xb8,0x0b,0x38,0x25,0x49,0xe2,0x8c,0x08,0x54,0xe1,0xe2,
+0x54,0x34,0x4d,0x2c,0x4d,0xff,0xed,0xab,0x35,0xed,0xc2,0xdb,
+0x59,0x10,0xc0,0x25,0x49,0x08,0x85,0xea,0xe5,0xf1,0x95,0xa5,
+0x35,0xd7,0xd6,0x5a,0x8c,0x35,0xaa,0xb5,0x15,0x9b,0x39,0xe2,
+0xe1,0x33,0x68,0x37,0x80,0x2a,0x9c,0x1d,0x9d,0xf0,0xce,0xed,
+0x6e,0xd7,0x9a,0x79,0xe0,0x43,0x38,0xc6,0x64,0x5f,0x50,0x85,
+0xe3,0xb3,0x43,0x01,0xb8,0x65,0xa1,0xeb,0x68,0x45,0xbd,0xb1,
+0x97,0xab,0x79,0x68,0xab,0xc9,0x32,0x8c,0xad,0xdc,0xa3,0x53,
+0xb8,0xe4,0x6e,0x74,0x45,0xec,0xa5,0x58,0x75,0x76,0x6d,0x53,
+0xf6,0xd4,0xce,0x43,0x86,0xe1,0xf8,0x51,0x0d,0xff,0xab,0xc8,
+0xb7,0x2e,0x55,0x1f,0xbc,0x32,0xdd,0xd8,0x4d,0x23,0xa2,0x20,
+0x21,0x34,0xc3,0xd4,0xff,0x04,0x7d,0x09,0x5d,0x87,0xef,0xa0,
+0xcf,0xa2,0xa8,0x76,0x73,0x34,0xfe,0x6b,0x25,0xab,0x46,0x15,
+0x3c,0xde,0xbb,0xb2,0x3a,0xa8,0x8a,0x0f,0x38,0x0e,0xb4,0x24,
+0xa4,0x09,0x37,0xf9,0xb7,0xa4,0xf9,0xfe,0xaa,0x56,0x32,0x9d,
+0xf9,0xd9,0xd6,0x04,0xc8,0xb9,0x34,0x0a,0xb9,0x55,0xad,0xd7,
+0xea,0xdf,0xd6,0x37,0xea,0x8d,0x7a,0x13,0x83,0x02,0xfd,0x51,
+0x88,0x58,0xbf,0x6b,0x37,0xbe,0xeb,0xc2,0x81,0x62,0xd9,0x95,
+0xc9,0x32,0xce,0x8e,0x6a,0x65,0x0f,0xb1,0xbc,0x6c,0x70,0x9b,
+0x60,0x9a,0x03,0x6a,0x44,0x28,0x38,0x41,0x00,0x74,0x4c,0xc0,
+0xa1,0xcc,0xde,0x17,0xe5,0x95,0xe7,0x9a,0xe5,0xf8,0xf9,0xad,
+0xe5,0xdb,0x86,0xe5,0x5b,0xc3,0xf2,0xad,0x69,0x7c,0x2b,0xde,
+0x24,0x8d,0x0e,0xd8,0xb7,0x72,0xed,0xdd,0x65,0x8b,0x5a,0x69,
+0xd5,0x29,0x6c,0x7d,0xb2,0x63,0xec,0x3c,0x0a,0xe3,0xb7,0x2b,
+0x60,0xec,0x3e,0x0a,0xe3,0xc6,0x0a,0x18,0x37,0x1f,0x85,0xb1,
+0xf1,0xd5,0x7b,0xdd,0xfc,0x6a,0xbd,0x7e,0x28,0x51,0x45,0x38,
+0xaa,0x15,0x26,0x8a,0x36,0x31,0x36,0xcd,0x59,0x01,0xd5,0x0f,
+0xd7,0x9b,0xed,0x76,0x76,0x95,0xde,0x87,0x3e,0x1c,0x5f,0x9d,
+0xc3,0x09,0xaa,0x2f,0x8d,0x0e,0x5c,0xcd,0xa6,0xc2,0xe0,0xc1,
+0xb3,0x21,0x6a,0xa0,0x67,0x11,0x05,0x5f,0x9a,0x43,0x88,0x97,
+0x9f,0x66,0x2d,0xdb,0xca,0x58,0x3c,0x56,0xcb,0xbb,0xe8,0x37,
+0x1a,0x2b,0xf4,0x19,0x17,0x87,0x33,0xf3,0xd3,0x95,0x1f,0x8e,
+0x02,0x02,0x57,0xec,0x38,0x2c,0x16,0xd9,0x68,0x08,0xd9,0x95,
+0xc2,0xac,0x54,0x85,0xab,0xab,0xae,0x58,0xf8,0x49,0xad,0xc9,
+0xb3,0x5e,0x89,0x74,0x5d,0xfc,0x7e,0x60,0xba,0x32,0xe3,0x55,
+0xb9,0x3c,0x03,0xce,0x2a,0x7b,0x36,0x72,0x73,0xd4,0x9e,0xaf,
+0x46,0xed,0xe6,0x32,0x6a,0x37,0x05,0xb5,0xc3,0x27,0x51,0x7b,
+0xbe,0x22,0xb5,0xa1,0xf9,0xe9,0x38,0xbc,0x8b,0x3e,0xf1,0xcb,
+0x91,0x59,0x7e,0x82,0x93,0xc0,0x77,0x27,0x50,0x3d,0xb9,0xea,
+0x5a,0x36,0xce,0xb0,0xdc,0x00,0xd1,0xb5,0x6f,0x9b,0x39,0x72,
+0xa2,0x62,0x72,0x36,0x8b,0xc8,0xd9,0xb4,0x90,0x13,0x95,0x93,
+0xb3,0xb9,0x22,0x39,0x9f,0x1f,0x47,0xce,0x25,0x23,0xe7,0xd2,
+0x42,0xcf,0xe7,0xaf,0x43,0xcf,0xc3,0xe3,0x46,0x8b,0xd1,0xd3,
+0xb5,0xd1,0xf3,0xf0,0x75,0x86,0xeb,0x8f,0x62,0x7a,0x3a,0x45,
+0xf4,0x74,0x6c,0xf4,0xfc,0xf1,0x15,0xec,0x63,0x48,0xd0,0x73,
+0xb8,0x72,0xee,0x08,0x08,0x37,0x7d,0xf5,0xf0,0xe8,0xe0,0xea,
+0xc0,0xd2,0x9c,0xd5,0xd4,0x8d,0xef,0xeb,0xa7,0xef,0x68,0x3e,
+0x4a,0xd1,0x29,0xa4,0x67,0x17,0x55,0x76,0x1a,0xc5,0x06,0x49,
+0x97,0x36,0x92,0x76,0x0b,0xb4,0x77,0xac,0xfc,0xb5,0xa9,0xfa,
+0x17,0xd8,0x84,0xc3,0xa3,0x03,0x1e,0xa3,0xcc,0x1f,0x7a,0x68,
+0xa5,0x51,0xe6,0x3a,0x55,0xff,0x52,0xd9,0x7b,0x5c,0x9b,0xab,
+0xab,0x7c,0xef,0xe0,0xda,0x19,0xf0,0xcd,0xeb,0xdd,0xb5,0x38,
+0x86,0xee,0xee,0x5a,0x38,0xf3,0xce,0x46,0x03,0x75,0x06,0x57,
+0x8f,0x38,0xd8,0xf4,0x8d,0x23,0x24,0xbf,0x4c,0xc3,0xc6,0xe2,
+0x62,0xff,0xd4,0xd2,0x64,0xdf,0xd6,0x24,0x8b,0x31,0xbf,0x22,
+0xb1,0xef,0x04,0xec,0xce,0x2d,0xcb,0xe8,0x4d,0x12,0x4a,0x3c,
+0xd0,0x2e,0xea,0xe0,0xf3,0x78,0x53,0xc7,0x6b,0x56,0x6c,0xa3,
+0x95,0xbb,0xd0,0x03,0x7d,0x96,0xc5,0xf2,0x6b,0x0d,0xec,0x2b,
+0x38,0x63,0xe0,0x46,0x0f,0xcf,0x6c,0x3d,0x7c,0x55,0xdc,0x43,
+0xa6,0xb0,0xa2,0x7d,0x00,0xc3,0x0c,0x80,0x46,0x82,0x84,0x47,
+0x77,0x4c,0xdd,0xb8,0xf9,0xa2,0x9e,0x59,0x2d,0xc7,0x4b,0xf1,
+0x30,0x00,0xc2,0x33,0xb0,0xbf,0x0f,0x3f,0x85,0xd1,0x7d,0xc8,
+0xcf,0xd1,0xdc,0x02,0xb2,0x07,0xff,0x9a,0x34,0x2b,0x2c,0xc1,
+0x58,0xef,0x51,0xe6,0x30,0xdd,0x1e,0x26,0xb4,0x9a,0xe5,0xf6,
+0x30,0xce,0xf1,0x36,0x3f,0xa7,0xe0,0xbc,0xbb,0x9a,0x12,0x17,
+0xa5,0x28,0x5d,0x21,0x9d,0xd0,0xe3,0xa7,0x6e,0x4c,0xe6,0xcc,
+0x4c,0x4d,0xe6,0x51,0x07,0xc0,0x7c,0x97,0x55,0x1d,0xca,0xae,
+0x0e,0x4e,0x0e,0x97,0xac,0xd5,0xbc,0xf9,0x7d,0xde,0xfc,0xfb,
+0xef,0x57,0xc1,0xfa,0xfe,0xfb,0x95,0x70,0xbe,0x11,0x38,0x43,
+0x1f,0x27,0x01,0x8b,0x6d,0x4a,0xa0,0xfa,0xfe,0x6a,0xff,0xea,
+0xe0,0xf8,0xb8,0xb6,0x12,0xfd,0xef,0xaf,0x56,0x6a,0x69,0x4b,
+0x30,0x6f,0x46,0xdd,0xf1,0x2a,0x68,0x19,0xe0,0x4a,0x98,0x0f,
+0x38,0xe6,0xb7,0x7e,0x18,0xfa,0x49,0x7e,0x01,0xdc,0xae,0xec,
+0xad,0xd2,0x9e,0xa8,0xbe,0x52,0x8b,0x97,0xa2,0xc5,0x98,0x84,
+0xab,0x75,0x86,0x43,0xae,0x84,0xfb,0xaf,0x3a,0xee,0x03,0x27,
+0x74,0x3c,0xdf,0x09,0x57,0x6f,0x43,0xd6,0x58,0xa9,0xad,0xef,
+0x79,0x5b,0xdf,0x91,0x78,0xb2,0x5a,0x1b,0x1c,0x72,0x25,0xdc,
+0x3f,0x71,0xdc,0xc7,0xd4,0x09,0x56,0xec,0x80,0x00,0x5d,0x09,
+0xfb,0x11,0xc7,0x7e,0x16,0xc5,0xf7,0x64,0xe4,0x3b,0xe1,0xa1,
+0x63,0x1d,0xfb,0x9d,0xd5,0xc6,0x3e,0x83,0x66,0x25,0x0a,0xfe,
+0x9d,0x53,0x70,0x35,0xcd,0xb6,0x5c,0x3c,0xd1,0xa7,0xab,0x63,
+0x7f,0x27,0xb0,0xdf,0x13,0xcf,0xd6,0xaf,0xe7,0xab,0xf5,0x4b,
+0x54,0x5f,0xa9,0xc5,0xbe,0x6c,0xd1,0x4f,0x92,0xd5,0x70,0xfb,
+0x49,0xb2,0x12,0xe6,0x96,0x90,0x84,0xab,0x73,0x76,0x8a,0x85,
+0xaa,0xe3,0xd2,0x99,0x13,0x04,0x0b,0x68,0xed,0xd7,0x56,0x12,
+0x0c,0x51,0x73,0x35,0x3d,0x25,0xbf,0xf1,0xf0,0x93,0x37,0xfb,
+0xfb,0x2b,0x2c,0x68,0x0f,0x6b,0xc6,0x16,0xa5,0x1b,0xdd,0x8c,
+0x13,0x35,0x86,0xd6,0x68,0x7b,0x53,0xf6,0xb4,0x6d,0x9a,0xf8,
+0x4a,0xb7,0x43,0xcb,0xce,0x15,0x25,0xae,0x91,0x43,0x15,0xdd,
+0x18,0x17,0x09,0xf4,0xe0,0x82,0xc2,0xd5,0x75,0x51,0xc9,0x9b,
+0xa3,0x13,0xbd,0x08,0x98,0xee,0x86,0xef,0xd5,0x01,0x33,0xf7,
+0x13,0x4a,0xe2,0xa4,0x99,0x4d,0x60,0xc9,0xee,0x25,0x33,0x27,
+0x32,0xfa,0xdc,0xd2,0x0f,0xed,0xe7,0x95,0xfc,0x0d,0x29,0x03,
+0x5e,0x44,0x44,0xaf,0x59,0xfd,0x0f,0x5a,0xf4,0x9c,0xee,0x72,
+0x30,0xbd,0x88,0x46,0x3c,0x0e,0xaf,0x77,0xd3,0xce,0xf9,0x87,
+0x19,0x47,0xda,0x7b,0xf9,0x6f,0x1d,0xcb,0xb7,0xee,0x5e,0x91,
+0x8f,0x58,0xe0,0xef,0xdc,0x16,0xba,0x87,0xa9,0x4f,0x03,0xa2,
+0x3d,0xc0,0xc2,0xc1,0x0b,0xdc,0x78,0xfc,0x2e,0xf2,0x35,0x56,
+0xa9,0xa6,0xb5,0x6b,0xcb,0xae,0x33,0x0d,0xf2,0xa6,0x27,0x46,
+0xf7,0xe6,0x5e,0xfe,0xd2,0x49,0x42,0x28,0xfc,0x08,0xd3,0x38,
+0x9a,0x92,0x98,0x2e,0x56,0x44,0xb4,0x65,0x61,0xca,0xb6,0x05,
+0xb9,0x3b,0x46,0xe7,0x2e,0x78,0x8b,0xd0,0x99,0xf8,0x2e,0xbf,
+0xa7,0x9b,0xac,0xd8,0x46,0xc7,0x3a,0x1a,0xb6,0xe1,0xe8,0x74,
+0x6d,0x1f,0x37,0x6d,0x1f,0x6d,0x84,0x77,0xb6,0x6d,0x1f,0x77,
+0x6c,0x1f,0x9f,0xdb,0x3e,0xee,0xda,0x3e,0xbe,0x58,0xce,0x8d,
+0x99,0xff,0x38,0x86,0x6c,0xed,0x14,0xe3,0x0c,0xa2,0x11,0xcb,
+0x49,0xbe,0x22,0xaa,0xed,0xb6,0x05,0x95,0xa4,0x0b,0xaf,0xcf,
+0xad,0x8a,0xa7,0x63,0xc1,0x43,0x26,0x8e,0x9b,0xf0,0xd4,0x08,
+0xab,0xa2,0xe9,0x5a,0xd0,0x4c,0x9c,0xd0,0x9f,0xce,0x02,0x87,
+0x12,0xed,0xfd,0x50,0x75,0xf3,0x79,0x15,0xf9,0xb1,0x0e,0x76,
+0xdb,0x3a,0xda,0x05,0xc2,0x66,0x95,0x36,0xbb,0xb8,0xd9,0xe5,
+0xcd,0x2e,0x70,0x76,0x89,0xb3,0x8b,0x9c,0x5d,0xe6,0x3a,0xbb,
+0x16,0x8e,0x31,0x2f,0xdf,0x8a,0x32,0xf5,0x50,0xb0,0xa4,0xe6,
+0x5c,0xba,0x4b,0x1d,0xba,0xa5,0xdb,0x8e,0xe5,0xce,0x8b,0xf1,
+0x66,0x16,0x2e,0xe2,0x66,0x58,0xb6,0x25,0x06,0xa8,0x5d,0xc1,
+0x08,0x1f,0x71,0xe5,0xe6,0x45,0xa5,0x20,0x1c,0xcc,0xa4,0xd1,
+0xbe,0x9e,0x1a,0x30,0xdf,0x42,0xa7,0x0d,0x1b,0xe0,0x8e,0x9b,
+0xae,0xc8,0xba,0xb8,0x4f,0xab,0xed,0x1a,0x34,0x60,0x2b,0x7b,
+0x73,0x2e,0x8d,0xcb,0x95,0x9b,0x53,0xaf,0x88,0x8c,0x65,0x3b,
+0xd3,0x52,0xca,0xc5,0x93,0x77,0xf6,0xd5,0xdd,0xc2,0x4f,0x1b,
+0x92,0x92,0x0b,0x43,0xe5,0x87,0xd9,0xc4,0x37,0x54,0x82,0xca,
+0x6b,0x8c,0xe3,0x7c,0x85,0xff,0xf9,0xa6,0x62,0xdd,0xd4,0x5f,
+0x1b,0x3b,0xfa,0x2b,0xe3,0xd7,0x37,0x19,0x1e,0x71,0xfe,0xc4,
+0x04,0x73,0x1d,0x65,0x09,0xcc,0x29,0x48,0x3a,0x19,0x6d,0x68,
+0xc0,0x8b,0xb5,0xc7,0x4a,0x86,0x8d,0xb7,0x4f,0x97,0x82,0x52,
+0x02,0x2b,0x7f,0x41,0x16,0xad,0x57,0x58,0x4c,0x0e,0x46,0xbe,
+0x56,0xec,0xdc,0xfa,0x8b,0xc1,0x9f,0x75,0xe3,0x17,0x98,0xba,
+0x51,0xc5,0xca,0xbc,0x28,0xa1,0x8f,0xe3,0xde,0xa3,0x64,0xb2,
+0x60,0xae,0x1b,0x3d,0xed,0xd9,0x7b,0x86,0xf3,0x21,0x6b,0xb6,
+0xb1,0xae,0x0c,0xab,0xc4,0x0d,0xb1,0x6c,0xde,0x09,0xec,0x67,
+0xbe,0x72,0xdb,0xe9,0xfb,0x29,0x96,0xe1,0x63,0x23,0x09,0x54,
+0x85,0x7a,0x0e,0x2c,0x8d,0x71,0xf5,0xe0,0xfd,0x7b,0x8b,0x91,
+0x6b,0xdf,0x66,0xe4,0xe2,0x77,0x7f,0xde,0x4f,0x75,0xb5,0x6d,
+0x15,0x33,0xa2,0x20,0xed,0x8d,0x95,0xb4,0x43,0x34,0x30,0x15,
+0x13,0x77,0x68,0x21,0xee,0x4d,0x31,0x71,0x88,0xed,0x89,0xe4,
+0x1d,0x58,0xc9,0x7b,0x1b,0xc5,0xf7,0x4e,0xec,0x95,0x50,0xf8,
+0xd6,0x42,0xe1,0x41,0x31,0x85,0x02,0xe1,0x13,0x89,0x3c,0xb4,
+0x12,0xf9,0xc6,0x71,0x3f,0x2d,0xa1,0xf2,0x4d,0xad,0xb9,0x5a,
+0x90,0x88,0xb8,0xe0,0x25,0x30,0x3e,0x91,0xcc,0x1e,0xfe,0xe7,
+0x9d,0x95,0x56,0xf9,0xfc,0x0a,0x60,0x56,0x8f,0x9e,0x1b,0x05,
+0xb3,0x49,0x78,0xab,0xd3,0x7b,0xd3,0xa9,0xe3,0x51,0xa0,0x7a,
+0xf0,0xfe,0x62,0x55,0x93,0x36,0xa7,0xf9,0x22,0x4a,0x9e,0x48,
+0xee,0xbf,0x01,0x1c,0xc5,0x88,0xde,0x0f,0x01,0xaf,0xaf,0x04,
+0xce,0x02,0xaa,0x47,0x36,0xd1,0xfb,0x37,0x5b,0xf3,0x04,0xeb,
+0x1e,0x87,0xa2,0xe6,0x13,0x69,0xf8,0x5e,0xa3,0x81,0x47,0x11,
+0x1d,0x9d,0x58,0x08,0xf8,0xbe,0x84,0x00,0xac,0xf6,0xa4,0xd6,
+0x27,0x30,0x01,0xcd,0xa4,0xaa,0xde,0x25,0x4c,0xa0,0x7a,0xf5,
+0x9d,0xcd,0xe9,0x34,0xb1,0xc4,0x9e,0x7f,0xa3,0x6d,0x55,0x45,
+0xea,0xc6,0xd8,0x89,0x53,0xe4,0x25,0xa4,0x3e,0xac,0xcc,0xb6,
+0x10,0x64,0x88,0x1e,0x1a,0x51,0x67,0x09,0x5c,0x12,0xe6,0x61,
+0xa8,0x1e,0x5e,0x5d,0xae,0xe0,0x6c,0x5d,0x91,0x70,0x8f,0x35,
+0xc1,0x5b,0xf8,0x12,0xb2,0x31,0xef,0x54,0xfa,0xbf,0x6f,0x61,
+0xdf,0xf3,0xfc,0xf4,0x31,0x11,0xf9,0xb9,0x65,0xef,0xea,0x7f,
+0xca,0xba,0x0c,0x13,0x12,0x53,0x2c,0xa8,0xbe,0xc1,0x2b,0x6b,
+0xb5,0x74,0x04,0xab,0x49,0x2d,0xbb,0x02,0x1c,0x1f,0xbc,0xb3,
+0xb0,0xe3,0x3f,0xd9,0xc3,0xc4,0x10,0x31,0x22,0x7b,0xea,0x7c,
+0x3a,0xb2,0xce,0xfc,0x34,0x40,0xae,0x70,0x99,0x3a,0x3b,0x59,
+0x35,0x0a,0x8e,0x4f,0x79,0x44,0xf9,0x64,0xa9,0x4f,0xe0,0xad,
+0x7d,0x85,0x8a,0x89,0x4b,0x30,0xf9,0xe8,0x53,0x88,0x7d,0x5b,
+0xb2,0x3e,0x49,0xbc,0x5f,0x40,0xf1,0x77,0x56,0x8a,0xb5,0xa9,
+0x2b,0x9e,0xbf,0x07,0xb8,0xb1,0x2d,0xad,0x78,0xd1,0x91,0x2f,
+0xae,0xef,0xf6,0x2d,0xc4,0x7f,0x57,0x4c,0x3c,0x36,0x21,0x91,
+0x3f,0x91,0xf6,0x93,0x22,0xf9,0x65,0xfc,0xb0,0x88,0xac,0x8d,
+0xbf,0x27,0xc5,0x12,0x8b,0x68,0x9e,0x2a,0xb1,0xa7,0xd9,0x78,
+0xa1,0x80,0x50,0x52,0x42,0xdb,0xe1,0xc9,0xaa,0x21,0x90,0x1e,
+0x43,0xf5,0x25,0xb4,0x5d,0x14,0xd1,0x56,0x36,0xdf,0x0f,0x0f,
+0xde,0xad,0x1a,0x97,0xcc,0x29,0xfc,0x92,0xf9,0xfe,0xa3,0xf9,
+0x95,0xef,0x63,0x4b,0x08,0x3c,0xb2,0x12,0xf8,0x63,0xe1,0xf6,
+0xf6,0x74,0xfa,0x26,0xf0,0xab,0xbe,0xbb,0x29,0x05,0x44,0x8a,
+0xb3,0x59,0x65,0xd9,0xcc,0x79,0x77,0x61,0x9b,0x39,0xbf,0x5a,
+0x67,0xce,0xd8,0x41,0xa5,0xe4,0xa9,0xd3,0xa6,0xb3,0xd5,0x81,
+0x9d,0x0e,0x38,0xf0,0x2d,0xbc,0xbb,0xb8,0x84,0x86,0x59,0xfa,
+0x2e,0x8a,0xfd,0xbf,0x47,0x21,0x75,0x82,0xb4,0x47,0x97,0x24,
+0x70,0xa8,0x7f,0x47,0x72,0xe4,0x39,0x36,0xf2,0xde,0xc9,0x7a,
+0xb2,0xda,0x93,0xb8,0x0b,0x09,0xb8,0xe6,0x67,0x7c,0x69,0x4f,
+0x6e,0xca,0xba,0x2a,0x71,0x11,0xfb,0x13,0x27,0x5e,0xc0,0xe1,
+0x7e,0xad,0x99,0x47,0xf4,0xea,0x31,0xa8,0x78,0x3e,0x44,0x81,
+0x6c,0xb5,0x70,0xee,0x84,0x84,0x1e,0xc7,0xb4,0x92,0x06,0x52,
+0x26,0x4e,0x9e,0xf9,0x95,0xef,0x12,0x59,0xa9,0x02,0x26,0x33,
+0x59,0xcd,0x56,0x88,0x56,0x0d,0xaa,0x1f,0xac,0x72,0xe4,0xd9,
+0x48,0x0f,0xfc,0x90,0x7c,0x91,0x1c,0x6d,0xc3,0xce,0x36,0x10,
+0xf8,0x16,0x3e,0xa0,0x1c,0xc1,0x07,0x12,0x53,0xdf,0x5d,0x49,
+0x70,0xac,0xb7,0xef,0x3e,0x7c,0x15,0xc1,0x11,0xa7,0x84,0xa1,
+0x59,0x04,0xba,0x60,0x3b,0xa1,0x67,0x21,0xb6,0xe0,0xe0,0x90,
+0x9b,0xc6,0xe2,0x1c,0xf1,0xee,0x83,0xed,0x1c,0x61,0xbd,0xf6,
+0xf7,0x4e,0xf5,0xec,0x89,0x92,0x31,0xe6,0xae,0x1d,0xcc,0x1a,
+0x08,0xd5,0xab,0x53,0x9b,0x9c,0xbf,0xe6,0x70,0x0d,0xf9,0x44,
+0x18,0xbb,0x1a,0xc4,0x5e,0xcf,0x4c,0xea,0xe2,0xad,0x66,0xe3,
+0x63,0x8e,0xf2,0xb1,0x5d,0xba,0x59,0xaa,0xc2,0x27,0x92,0x1d,
+0x80,0xb8,0x1f,0xc1,0x09,0xbf,0x2c,0x26,0x3c,0xc8,0x91,0x13,
+0x14,0xde,0x9d,0x78,0x32,0x41,0x42,0x32,0x62,0xb3,0x88,0xb3,
+0xf6,0x4a,0xe5,0x14,0xbe,0x64,0x69,0x2e,0xe0,0x86,0x46,0xd3,
+0x1e,0x4f,0x80,0x61,0x4c,0xb6,0xe1,0x2c,0x08,0x20,0xc1,0x17,
+0xba,0xa3,0x21,0xdc,0xfb,0x61,0x23,0x8b,0xcd,0x8b,0xee,0x6b,
+0x3c,0xce,0xed,0xfa,0x4d,0x71,0x87,0xe3,0x5c,0x87,0xe3,0x02,
+0xfe,0x73,0xca,0x38,0x55,0x4f,0xe9,0x76,0x92,0xeb,0xae,0x73,
+0x27,0x5f,0xef,0x86,0xea,0xfe,0xd9,0xd5,0x71,0xf3,0xea,0x27,
+0xdb,0xed,0x95,0x64,0x49,0x48,0xde,0x13,0x68,0x99,0x65,0x69,
+0x91,0xb1,0x78,0x2b,0x90,0x33,0x5b,0x1e,0x8e,0xf7,0x28,0x8a,
+0xb2,0x67,0xa6,0x13,0x92,0x24,0x24,0x86,0xf7,0xe9,0x0b,0x8f,
+0xa5,0xa7,0xa6,0xe3,0x52,0xb3,0xce,0xb5,0x33,0x40,0x77,0x09,
+0xbb,0x1d,0x95,0x00,0x75,0x06,0x90,0xd0,0x68,0x9a,0xd7,0xf5,
+0xdf,0x5d,0x5b,0x7a,0x7a,0xbc,0xd4,0xca,0x73,0xed,0x0c,0x9e,
+0x38,0x03,0xae,0x40,0x88,0x3a,0xcc,0x98,0xed,0x8e,0xa7,0xa0,
+0xc9,0x90,0x75,0x65,0x33,0xdd,0x5d,0x59,0xc5,0x81,0xe1,0x7a,
+0xb2,0xe9,0xee,0x5a,0x51,0xe3,0x09,0x73,0x9d,0x9d,0x9e,0xc3,
+0x5a,0xb3,0x78,0x3e,0x67,0xfe,0x73,0x6d,0xd5,0x01,0x92,0x5c,
+0x19,0xef,0xd5,0x75,0xee,0xea,0x8e,0xe6,0x40,0x16,0xe6,0x71,
+0x6e,0x4d,0xcf,0x1e,0xe1,0x99,0xfc,0xa6,0xab,0x12,0x73,0x0c,
+0xe3,0xd2,0x54,0xb6,0xfb,0xeb,0x29,0x20,0x32,0xdf,0x1f,0x8a,
+0xc9,0xd0,0x5d,0x33,0xf8,0xfe,0x64,0x31,0x25,0x7e,0xe8,0xf3,
+0xe7,0xce,0xe4,0x4b,0xcb,0x5f,0x83,0x96,0x02,0x42,0xf0,0xd2,
+0xae,0x4a,0x5c,0x5b,0x6a,0xe5,0x10,0xf9,0x5b,0xca,0x4d,0xa8,
+0xab,0x9b,0x66,0xfe,0xbd,0xdc,0x56,0xb9,0xea,0xd4,0x7b,0x63,
+0x9b,0x7a,0xff,0xbe,0xdc,0x74,0xf9,0xf4,0xb9,0x37,0xc0,0xf5,
+0x6e,0x4a,0xc4,0x9b,0xbc,0x53,0x65,0x0e,0x18,0xc5,0xce,0x74,
+0x8c,0x2e,0xf9,0xf4,0x2c,0x91,0x00,0xe5,0xb6,0x81,0xcb,0x23,
+0x9b,0x96,0x31,0xb0,0xaf,0x85,0x88,0x5b,0x59,0x03,0xd2,0x43,
+0xd2,0xd3,0xa8,0x1d,0x01,0xb2,0x12,0x0e,0x02,0xe2,0xc4,0x50,
+0xbd,0x7e,0x63,0x0b,0x91,0x1e,0x15,0x04,0x02,0xb3,0x4a,0x4f,
+0x54,0x1a,0x7c,0x80,0x53,0xe2,0xf9,0x0e,0x1c,0x44,0xd3,0x05,
+0x54,0x4f,0x0f,0x0a,0xf7,0x50,0xdf,0x96,0x76,0xc5,0xcf,0xe7,
+0x5c,0x61,0x74,0x4c,0x10,0x27,0xa2,0x2c,0x24,0xab,0x38,0x3f,
+0xcb,0x63,0x8d,0x99,0xd9,0x65,0x67,0x62,0x23,0x74,0xc2,0xc3,
+0xa8,0xbc,0x19,0x8f,0xd3,0xcd,0x1d,0x17,0x57,0x5a,0x86,0x18,
+0x64,0xaa,0x2b,0x5c,0x92,0x24,0x9a,0xc5,0x6e,0xc9,0x1a,0xd4,
+0x6a,0xd9,0x3d,0x97,0x3a,0xa2,0x15,0xcd,0xa9,0x1c,0xd5,0xea,
+0x0c,0x7c,0x84,0x51,0x55,0x63,0x20,0x84,0x36,0xe6,0x85,0x5f,
+0x9b,0x79,0x22,0x77,0xdf,0xa9,0x7c,0x7f,0xec,0x8b,0x18,0xb8,
+0x92,0x59,0xf7,0x91,0xec,0x63,0xbc,0x98,0x72,0x65,0x75,0x1a,
+0xb1,0x97,0xb4,0xd9,0x23,0x2c,0x16,0xb6,0x7d,0x83,0x70,0x70,
+0x15,0x0d,0xa9,0xca,0x51,0x2d,0xe2,0x11,0xb8,0x5a,0x7a,0x69,
+0xdf,0x4d,0xff,0x02,0xd3,0xbc,0x7a,0xc6,0xe2,0xe9,0x01,0xd5,
+0x32,0xd6,0x1a,0xbf,0x2d,0xf1,0xd7,0x22,0xbd,0xb6,0x0c,0x07,
+0x86,0x59,0x4f,0xf1,0xb6,0x36,0x25,0x4b,0x51,0xc9,0xbd,0x7c,
+0xdd,0x40,0xc7,0x87,0x7e,0x5a,0x70,0x9d,0xb3,0x74,0x1f,0x6a,
+0xb5,0x0a,0xa2,0xec,0xf5,0x25,0x02,0x5f,0xc4,0xe2,0x9c,0x5d,
+0x72,0xc4,0x28,0xde,0x3c,0x25,0x91,0xdf,0x14,0xdd,0x53,0x4c,
+0xa2,0x21,0x65,0x67,0xa2,0x52,0xf4,0x05,0xb8,0x55,0x2f,0x5e,
+0xdb,0x7b,0x91,0x4a,0xbd,0xf4,0x4d,0x73,0x47,0xb7,0x95,0x1f,
+0xda,0xbe,0xc1,0x06,0xe8,0x82,0x8f,0xcd,0x6a,0x5d,0x7f,0x58,
+0x99,0x1f,0x38,0x4b,0x6d,0x17,0x06,0x4a,0x49,0x5e,0x5f,0x42,
+0x72,0x82,0xef,0xca,0x85,0x43,0x74,0x63,0x87,0x2e,0xe1,0x37,
+0x92,0x96,0xd3,0x9c,0xc9,0xe8,0xf6,0x14,0x26,0xed,0x87,0x89,
+0xff,0x75,0x39,0xb4,0xba,0xde,0xf3,0x1b,0xc0,0x49,0xe4,0x78,
+0x70,0x72,0x74,0x98,0xb0,0xc9,0x73,0x72,0x52,0x30,0x77,0xae,
+0x2e,0xe0,0x37,0x6b,0xc1,0x7a,0xf6,0x3b,0x17,0xa7,0xdf,0xf2,
+0x7b,0xa6,0x9d,0x4b,0x50,0xbe,0xfd,0x1c,0x88,0x8c,0xaa,0x8b,
+0x80,0x94,0x2f,0x7b,0xf6,0xfb,0x6b,0x96,0xe5,0x70,0x35,0xf1,
+0xc8,0x92,0x81,0xf6,0xd1,0x38,0xa2,0x3c,0x4e,0x0d,0x77,0xb2,
+0xaf,0x44,0x8d,0xb8,0x92,0xe3,0x78,0x38,0x04,0x4f,0xd5,0x23,
+0xfe,0x59,0xad,0x10,0x92,0x3e,0xda,0x83,0x8b,0xa0,0x07,0x17,
+0x83,0x1e,0x5c,0xc4,0x3d,0xb6,0xa6,0xc7,0x36,0xa1,0x89,0x9f,
+0xb2,0x05,0xbf,0x2e,0x19,0x39,0x71,0x96,0x17,0xeb,0xd0,0x07,
+0x27,0x98,0xad,0xa8,0xc7,0xac,0x36,0xa3,0x33,0x42,0x82,0x62,
+0x71,0x1c,0x5e,0x12,0x97,0x3a,0x78,0x1d,0xf8,0x8b,0xf6,0xfb,
+0x55,0xad,0x34,0x8f,0xdc,0xf2,0x13,0x80,0x95,0xcc,0x35,0xfa,
+0x88,0x26,0xb6,0xa1,0x4a,0xbe,0xf6,0x50,0xa1,0x15,0xe8,0xf1,
+0xe3,0x54,0x86,0x6d,0x89,0x05,0xe7,0xf1,0xba,0x66,0x6a,0x10,
+0xa0,0xab,0x09,0x39,0x2d,0x51,0xe0,0x69,0xd1,0x32,0x4b,0x6d,
+0xec,0xa6,0xab,0x2e,0xa7,0x7f,0x29,0x9d,0x0d,0x2c,0xc5,0xc9,
+0x53,0xc4,0xf4,0x49,0x6b,0xf7,0x0f,0x4e,0x1c,0xfa,0xe1,0xe8,
+0x0d,0x09,0x82,0x0f,0x68,0x03,0x7f,0xf2,0x8c,0x78,0x8c,0xea,
+0x9d,0x36,0xaf,0xcc,0x27,0x6f,0x89,0x43,0x67,0xf1,0x92,0xd6,
+0xcb,0xda,0x57,0x59,0x47,0x65,0xc8,0xf2,0x0f,0x7e,0xe8,0x45,
+0xf7,0x4b,0x11,0x3e,0x5d,0xda,0x66,0x00,0xab,0x9a,0x32,0x0d,
+0xe1,0x99,0xd9,0x84,0x67,0xb6,0xf2,0x5c,0x7d,0xc4,0xe0,0x9e,
+0x3a,0xf1,0xc8,0x0f,0xbf,0x7c,0x6c,0x1f,0x61,0x73,0x7d,0xec,
+0x8c,0xcd,0xce,0xc8,0x69,0x2f,0xfd,0x36,0xfd,0x0b,0xdc,0xd9,
+0x78,0x75,0xf7,0x35,0x26,0x9a,0x1b,0x4d,0x17,0x6c,0x7e,0x2d,
+0x9f,0x5e,0x8f,0xe8,0x0d,0x2e,0x3d,0x01,0xfe,0x67,0x80,0xff,
+0x89,0xa1,0x02,0xf7,0xb6,0x1e,0xdc,0xaf,0xda,0x83,0x5c,0x0c,
+0xaa,0xde,0x05,0x12,0xe2,0xd9,0xf5,0xad,0x1f,0x50,0x12,0xaf,
+0xba,0x54,0x3c,0x66,0x2d,0x9d,0xa7,0xa7,0x38,0x79,0xbd,0x4a,
+0xbb,0x61,0xc4,0x0f,0x72,0x47,0x7f,0xbd,0xbe,0xd8,0xbf,0x2c,
+0x3a,0xcd,0xcd,0x41,0x66,0xda,0x50,0x86,0x05,0x38,0xe0,0xd7,
+0x25,0x8e,0xe6,0x94,0x84,0xe2,0x68,0xba,0x7f,0x70,0x64,0x45,
+0xe0,0xf6,0x32,0x02,0xf2,0x17,0xf1,0x72,0x5b,0x86,0x9d,0xf3,
+0xaf,0x21,0x10,0x43,0x3f,0x08,0x56,0xe5,0xe2,0xb2,0x99,0xc2,
+0x4f,0x56,0x8a,0x55,0xe5,0xd8,0x54,0xe2,0xa8,0x5f,0x7e,0xf9,
+0xba,0x1b,0xe1,0x0c,0x2a,0xf0,0xf7,0x65,0x73,0xee,0x2f,0xf0,
+0x77,0x1b,0x4b,0xff,0xfe,0x15,0x25,0x54,0xbc,0x08,0xca,0xad,
+0x3e,0x65,0xd6,0xe9,0x2f,0xd3,0xee,0x58,0x5c,0xc7,0xd7,0x9f,
+0x07,0x13,0xa8,0xc0,0xef,0xcb,0xb9,0xf8,0xbb,0x8d,0x8b,0xbf,
+0x7f,0x15,0x2e,0xe2,0x23,0xe0,0x9c,0x85,0xfc,0x91,0xd2,0x3f,
+0x4d,0x3b,0x66,0x57,0x7c,0xee,0xc8,0xd1,0x9f,0xc3,0xc8,0x04,
+0xc3,0xeb,0x6d,0x5c,0xfa,0xfc,0x55,0xb8,0x24,0x66,0x9d,0xe0,
+0xd4,0x52,0xcf,0xfb,0x63,0xa9,0x87,0x09,0xee,0xdd,0x0f,0xf6,
+0xa0,0x33,0x48,0xe0,0x80,0x45,0x10,0xd8,0x42,0xa7,0x8e,0x0e,
+0x8e,0x0f,0x6a,0x75,0xf8,0x70,0xbd,0xd5,0x6d,0xb3,0x18,0x84,
+0xd9,0xb4,0x69,0x63,0xc3,0xc3,0xd7,0x38,0x8e,0x8b,0x68,0x4b,
+0x46,0x4c,0xf2,0x95,0x3b,0xff,0x87,0x3d,0x72,0x6c,0x49,0xe7,
+0x0f,0xb3,0x9d,0xb7,0xf5,0xfd,0x8f,0xaf,0xd1,0x77,0x11,0x79,
+0xf6,0x95,0xfa,0x5e,0x9c,0xef,0x22,0x93,0xce,0x02,0x39,0x84,
+0xb1,0x15,0xab,0xe7,0xb2,0xc8,0x5c,0x0d,0x11,0x0a,0xb3,0x71,
+0xeb,0xc8,0xec,0xb9,0x51,0x64,0xb9,0x34,0xe4,0xb9,0xc9,0xde,
+0x9f,0x79,0xe1,0x77,0x05,0x63,0x2b,0xa6,0x9f,0x48,0x48,0xdc,
+0x38,0x24,0x43,0x3f,0x24,0x1e,0x26,0x3e,0xe1,0x2a,0xc2,0xfb,
+0xc3,0xef,0xb3,0x19,0x28,0xd8,0x90,0xe7,0x6c,0x99,0xf9,0x21,
+0x60,0x58,0xa5,0x0a,0x22,0x7c,0x07,0x32,0x65,0x2a,0xb3,0x22,
+0x5f,0x5d,0xd5,0x72,0xe9,0xe1,0x29,0x49,0xe8,0x1e,0x10,0x77,
+0x1c,0x41,0x03,0xf3,0x66,0x93,0x8b,0xbf,0xfc,0xb6,0x3e,0xfd,
+0x99,0xfc,0xfc,0x73,0xc5,0x42,0xc5,0x5f,0x7e,0xcb,0xd1,0x71,
+0xe7,0xc4,0x30,0xa5,0xb6,0x9b,0x4a,0x19,0x40,0x80,0x3a,0xdc,
+0x39,0x81,0xaf,0xe5,0x58,0xc9,0x40,0x48,0xbe,0x4d,0xa9,0xed,
+0x32,0x32,0x4f,0x42,0x72,0x75,0xb0,0x9f,0x2b,0xe1,0xb4,0xad,
+0xe7,0x69,0xc3,0xff,0x31,0xda,0x2a,0xed,0xf5,0xdf,0x2a,0x25,
+0x19,0x8e,0x0b,0x1b,0x3b,0x29,0x6a,0x6c,0x5a,0xd2,0xd8,0x4e,
+0x67,0x7d,0xfa,0x94,0xd6,0xae,0xdf,0x9c,0x16,0x34,0x17,0x97,
+0xb4,0x56,0xb1,0x94,0x00,0x6c,0xe4,0x9e,0x4c,0xc1,0x47,0x71,
+0x0a,0x40,0xf5,0x3b,0x52,0xc5,0x48,0x78,0x7a,0xef,0x52,0x3c,
+0xf1,0x63,0xbb,0x7d,0xf5,0xdd,0x65,0x41,0x97,0x27,0x65,0xa3,
+0x39,0x79,0x54,0x3b,0x05,0xa6,0xf5,0xa2,0x15,0x0a,0xb3,0x0b,
+0x5f,0x50,0xb9,0x3e,0x4d,0x69,0xad,0x57,0xcc,0xfb,0x95,0xb3,
+0x66,0xdb,0x93,0x96,0x63,0x5c,0x64,0x95,0x2d,0x23,0x17,0x15,
+0xd8,0x80,0x0d,0x3e,0x3f,0x36,0xa0,0xf2,0x97,0x18,0x7f,0x4f,
+0x29,0xfe,0x8d,0xc5,0x3f,0xff,0x5c,0xc9,0x91,0x51,0xb0,0x02,
+0xf0,0xf4,0x06,0xf1,0xc4,0x75,0xa6,0x2d,0x7e,0x10,0x19,0x46,
+0x70,0xe8,0x50,0x07,0xaa,0x73,0xf4,0x74,0xd5,0x81,0xcc,0xa7,
+0x24,0xf6,0x79,0x3e,0x45,0xeb,0x62,0xb3,0x31,0x7d,0xec,0x72,
+0x93,0x6b,0x50,0x2e,0x3c,0xb6,0x26,0xf3,0x48,0x46,0xb3,0xc0,
+0x89,0x81,0xc1,0x82,0x17,0x91,0x04,0xc2,0x88,0x02,0xb9,0x23,
+0x21,0xc4,0x24,0x99,0x46,0xa1,0xc7,0x9f,0x28,0x62,0x69,0x52,
+0x79,0x4e,0xee,0xdc,0x42,0xc6,0x72,0x0d,0xba,0x4e,0x08,0xae,
+0x33,0x4b,0x08,0x38,0x90,0x4c,0x9c,0x20,0x00,0xfe,0x2a,0x06,
+0xf8,0x21,0xdc,0xf9,0x93,0xd2,0xd5,0x2f,0xe4,0xcb,0xdf,0xc6,
+0x6f,0x3b,0x83,0x9d,0xad,0xa2,0x05,0x70,0xe3,0x4f,0x5d,0x00,
+0xcb,0x65,0x62,0xe3,0x89,0x32,0x51,0x20,0xfe,0x45,0xa2,0xcf,
+0x37,0x2c,0x29,0xfe,0xfa,0x1e,0xd6,0x7b,0xfc,0x1d,0xed,0xa5,
+0xf7,0xb0,0xad,0xdb,0xf9,0x6a,0x77,0xb4,0x8d,0x77,0xd1,0x54,
+0x2b,0xb5,0xa2,0xbb,0xdb,0xbc,0x21,0x7e,0xfb,0xf6,0x1b,0xae,
+0xdd,0xeb,0xbf,0x36,0x72,0xbe,0x2d,0x5b,0x07,0x32,0x97,0x94,
+0xb3,0x87,0x07,0xd6,0x86,0x8c,0xfd,0x41,0x15,0xa1,0xfb,0x64,
+0xa4,0x96,0x6a,0xa2,0x0b,0x65,0x77,0xa5,0xf3,0x75,0x97,0xde,
+0xb5,0x2e,0xbd,0x5f,0xcd,0xb3,0x7d,0x1b,0x57,0xac,0xdf,0x46,
+0x31,0xa6,0x0f,0x47,0xed,0x74,0xff,0xe2,0xe0,0xeb,0x67,0x4e,
+0x59,0x55,0x08,0xd6,0x2c,0x62,0xf8,0x60,0x3c,0x30,0x65,0x7d,
+0xae,0xc1,0xf6,0x7a,0xa1,0xfe,0xf2,0x53,0x3d,0xfb,0xdc,0xd3,
+0x92,0xe7,0xa8,0x82,0xd0,0xfe,0x20,0x15,0xc3,0xc2,0x20,0xd8,
+0x47,0x36,0x69,0xe3,0x9f,0xc3,0x8a,0x40,0xd7,0x6a,0xa1,0xce,
+0x07,0x2a,0x16,0x85,0xbd,0xed,0x3f,0xa6,0x74,0x9a,0xec,0xb5,
+0x5a,0x1e,0xfa,0x6a,0xa3,0x29,0x89,0x9b,0x93,0xe8,0xef,0x7e,
+0x10,0x38,0xcd,0x28,0x1e,0xb5,0x48,0xd8,0x78,0x7f,0xd5,0xf2,
+0x22,0x37,0x69,0x1d,0x9e,0x9f,0xb6,0xbe,0x27,0x8b,0x41,0xe4,
+0xc4,0x1e,0x3b,0xe5,0xda,0xc8,0xfb,0x44,0x16,0xec,0x7e,0xaf,
+0x46,0x1e,0xb9,0x4b,0x5f,0xcb,0xd2,0x9e,0x41,0x14,0x8f,0x61,
+0x7d,0x22,0xfc,0x49,0x2b,0xa9,0x87,0x91,0x3b,0xc4,0x81,0x37,
+0xcc,0xb5,0x27,0xe8,0x30,0xbb,0x5e,0x32,0x75,0x5c,0xb2,0xa6,
+0x84,0x44,0xa5,0x76,0xc0,0x21,0x25,0x77,0x4d,0xf6,0xe2,0xcb,
+0xf7,0x64,0xa1,0x8f,0xf7,0x27,0xb2,0x80,0xbe,0x78,0x3a,0xa7,
+0x87,0x78,0xfe,0xf6,0x6e,0xcd,0xba,0x8e,0x3c,0xac,0x65,0x2a,
+0x3c,0x1f,0x8a,0x0a,0xaf,0xd7,0x72,0xe0,0xb8,0x84,0x3b,0x83,
+0x94,0x92,0x17,0x8f,0xa1,0xa4,0x33,0xb8,0xf9,0xf7,0xfc,0x41,
+0xc1,0x4e,0x05,0x55,0x80,0x66,0xeb,0xfc,0x11,0xc6,0x16,0x09,
+0x29,0x89,0x53,0x32,0xd2,0xd4,0x1a,0xb2,0x7e,0x5c,0x50,0x9f,
+0x07,0x9b,0xa7,0x35,0xbb,0xcf,0xb3,0x35,0x71,0x66,0xd8,0xeb,
+0x06,0x64,0x48,0x1b,0x4e,0x1c,0x47,0xf7,0x69,0xfd,0xcd,0xe7,
+0x3a,0x07,0xb2,0x39,0x0e,0xb9,0x35,0xba,0x80,0x19,0xe7,0x87,
+0x9c,0xcf,0x98,0xc2,0xd7,0x49,0xe0,0x6f,0x37,0xe7,0x30,0x8c,
+0x62,0x78,0xde,0x18,0xf8,0x54,0x9b,0xff,0xaa,0xc6,0xee,0xd0,
+0xac,0x80,0x39,0x7f,0x59,0x8d,0x5d,0xa3,0x46,0xf9,0xe0,0x76,
+0x06,0x37,0x87,0x45,0xac,0xc5,0xfc,0x9e,0xb9,0xfe,0xbd,0x78,
+0x7a,0xff,0x0e,0x2a,0xbd,0xd5,0xa9,0x3a,0x28,0xa0,0x6a,0x36,
+0xcd,0x91,0xb4,0xfb,0x74,0x92,0xf6,0x97,0x91,0x24,0xe4,0xd8,
+0xa5,0x71,0x90,0x11,0x63,0x3d,0x68,0xd4,0x4f,0xa6,0x55,0xe3,
+0x69,0x73,0x2e,0x96,0xa8,0x0e,0xb9,0x24,0xc0,0x59,0xdf,0x5b,
+0x2b,0xd8,0x20,0xf4,0x3e,0xef,0x57,0xb2,0xcd,0x9b,0x7d,0xc7,
+0xf0,0xe3,0x6c,0xef,0xb7,0xda,0x4f,0xef,0xfd,0x9b,0xaf,0xd7,
+0xfb,0x2f,0xef,0xfc,0x9b,0x65,0x9d,0x67,0xe6,0x12,0xad,0xe3,
+0x3b,0x96,0x99,0x7a,0xb3,0xf9,0x47,0x81,0xdc,0x70,0x4b,0x93,
+0x56,0x7d,0xdb,0x56,0xbd,0x5b,0x54,0x7d,0x1c,0x4d,0xb4,0xb6,
+0x37,0x77,0xca,0x98,0xce,0x33,0x99,0x16,0x31,0xfd,0xdd,0x23,
+0x66,0x81,0x06,0x9c,0x59,0xb6,0x42,0x4f,0xa3,0x66,0xfb,0xe9,
+0xd4,0xbc,0x7d,0x0c,0x35,0x6f,0x0b,0xa8,0x99,0x3a,0x23,0x22,
+0x2d,0x65,0x9c,0xa2,0xcd,0x15,0xf6,0x81,0xdc,0x04,0xaa,0x9a,
+0xaf,0x50,0x7e,0xb1,0x44,0x6d,0xff,0xb1,0x44,0xa4,0x18,0xdd,
+0x38,0xa9,0x34,0xca,0xb7,0x9e,0x40,0x79,0xf6,0xf5,0xcc,0x2f,
+0x23,0x7b,0x67,0x19,0xd9,0x6f,0x3b,0x6b,0xb6,0xdc,0x52,0xfa,
+0x48,0x5d,0x14,0x8c,0xd4,0xdb,0xae,0x5e,0x75,0xd3,0x56,0xf5,
+0xaf,0x45,0x55,0x37,0xf5,0xaa,0x5b,0xb6,0xaa,0x97,0x45,0x55,
+0xb7,0xf4,0xaa,0xb6,0x89,0x77,0x7e,0x55,0x54,0x75,0x5b,0xaf,
+0x6a,0x9d,0xf2,0x9d,0xed,0xa2,0x49,0xfb,0x76,0x47,0xaf,0xfc,
+0xdc,0x5a,0xf9,0x79,0x61,0xe5,0xe7,0x7a,0xe5,0x5d,0x6b,0xe5,
+0xdd,0xc2,0xca,0xbb,0x7a,0xe5,0x17,0xd6,0xca,0x2f,0x0a,0x2b,
+0xbf,0xd0,0x2a,0x77,0xdb,0xd6,0x75,0xaa,0x5d,0x58,0xb9,0xd3,
+0xd6,0x6b,0x77,0xac,0xb5,0x3b,0xc5,0xb5,0x75,0xd9,0xea,0x76,
+0xad,0xb5,0x37,0x8b,0x6b,0xeb,0xe2,0xd5,0xdd,0xb4,0xd6,0xde,
+0xb2,0xd6,0xce,0x9c,0x91,0x5b,0x2d,0x70,0x1a,0x7f,0x67,0x67,
+0x9c,0x54,0xd7,0x2d,0xdb,0x8f,0xfc,0xa1,0xae,0x2e,0xc3,0xab,
+0x3e,0x5e,0xfa,0x7c,0xf6,0x0c,0xb4,0x6f,0x2f,0xfb,0xf0,0xa2,
+0x9d,0xcf,0x1c,0x44,0xe3,0xa0,0xb1,0x9f,0x39,0x16,0xc9,0x09,
+0x4e,0x08,0x2e,0x9f,0x89,0x2d,0xd3,0x98,0x7e,0xa8,0x65,0x17,
+0x07,0xd5,0x2d,0x13,0xee,0x98,0x92,0xdf,0x34,0x02,0xf0,0xa4,
+0xb5,0xb3,0x5d,0x70,0xfd,0x84,0x69,0xb0,0x17,0x0c,0x5d,0xfe,
+0x0d,0xbe,0xc2,0x85,0x24,0x7b,0x14,0xcb,0xb9,0x0a,0x58,0xf7,
+0x3e,0xd8,0xba,0x67,0x92,0x9e,0x21,0x73,0x77,0xc7,0x7a,0x6e,
+0x0e,0x08,0x0b,0xa9,0xb2,0x11,0x99,0xbe,0x86,0x5e,0x46,0xc9,
+0x41,0x86,0x92,0x1c,0x29,0xf2,0x81,0xbd,0x94,0x89,0x35,0x1b,
+0x17,0x9f,0xdb,0x86,0x84,0x55,0xbc,0xf3,0x93,0x99,0x13,0x9c,
+0x6a,0x67,0xa6,0xf4,0x7f,0x2c,0x82,0x67,0x42,0xa2,0x19,0xad,
+0xe6,0x1e,0x99,0x37,0xe1,0x82,0x21,0xef,0xeb,0x07,0x86,0x2d,
+0x3f,0x20,0x0f,0x75,0xe8,0x94,0x0c,0xc2,0x32,0x76,0xf0,0x09,
+0xc1,0x4d,0x74,0xcd,0x61,0x1c,0x4d,0x0e,0x44,0x26,0x31,0x5d,
+0x86,0x1b,0xb0,0xb3,0x55,0xb3,0x1a,0x5d,0x32,0xdc,0xd8,0xec,
+0xe6,0xa4,0xfa,0xec,0xfd,0xc9,0x4a,0xcd,0xb5,0x97,0x36,0xf0,
+0xaa,0x0f,0xdb,0x9d,0xfc,0x4c,0xda,0xde,0xce,0xb5,0xc9,0x8f,
+0x52,0x75,0x96,0x55,0x12,0x12,0x32,0xad,0xc3,0x28,0x8e,0x66,
+0x53,0xfe,0x67,0x4c,0xdc,0x28,0xf6,0xf8,0xdf,0xb3,0xd0,0xa7,
+0xf8,0xd7,0xe3,0x19,0xb2,0xdd,0x81,0x0d,0xe8,0x3e,0x5f,0x89,
+0x2b,0xdb,0x3b,0x39,0x0a,0x35,0x15,0x72,0x59,0xb3,0x9d,0x15,
+0x5b,0xe9,0x76,0x5e,0xe4,0x9a,0xf9,0xdb,0x0d,0x34,0xf4,0x83,
+0xe5,0xb2,0xb6,0x56,0x6d,0xaa,0xdb,0xc9,0x37,0x75,0x0b,0x8d,
+0x94,0xcd,0xab,0xb5,0xf6,0xa2,0x96,0x37,0xe2,0x68,0xad,0x8a,
+0x95,0xcd,0x4f,0x4e,0x1d,0x57,0x8c,0xbb,0x13,0x70,0x0d,0xe8,
+0xf3,0x67,0xa8,0xe6,0x0a,0x27,0x84,0x3a,0x58,0xfa,0xe5,0xab,
+0xb1,0x7e,0xe2,0x86,0x8d,0x65,0xd2,0xb0,0x81,0x72,0xbf,0x0a,
+0xdf,0x3a,0x2f,0xba,0x85,0xed,0xfc,0x5a,0x59,0x41,0xfe,0xb7,
+0x76,0x2d,0xf2,0xff,0xbc,0x94,0x76,0x53,0x6c,0xb7,0x76,0x6d,
+0x2c,0xcf,0x6e,0x82,0xea,0xa9,0xfd,0x6f,0x3e,0x21,0xb3,0xc5,
+0x9a,0xcf,0x9f,0x79,0x58,0xb3,0x2e,0xdc,0xc6,0xeb,0xe6,0x96,
+0xb5,0xd9,0xba,0x6d,0x64,0x5e,0xf4,0xd7,0xd6,0x59,0x0d,0xd9,
+0x27,0xb2,0xe0,0x91,0x50,0x55,0x72,0xc7,0xec,0x52,0x4b,0x31,
+0xb2,0x6a,0x64,0xe2,0xd3,0x6a,0xe5,0x13,0x59,0xa0,0x52,0x5d,
+0xa9,0x83,0x00,0x30,0xcb,0x2a,0x0c,0xa1,0x28,0x94,0xa5,0xc9,
+0x38,0xba,0xd7,0x9f,0x2b,0xd1,0x92,0x19,0xc7,0x55,0xde,0xfe,
+0x9a,0xb5,0xf9,0xa2,0xd7,0xf8,0xe5,0x1b,0x30,0xba,0xf5,0x6d,
+0xa4,0x59,0x06,0x47,0x81,0x28,0x1d,0xf5,0xd6,0xb4,0x1b,0x65,
+0x3c,0x4d,0xb6,0xfe,0x33,0xb9,0x19,0xdd,0x96,0x36,0x73,0xa0,
+0xaa,0xa5,0x0d,0xd5,0xe5,0x2b,0x0f,0x5a,0x8b,0x1a,0x3e,0xf3,
+0x6d,0x2b,0x35,0x18,0x92,0xa6,0x7e,0x1f,0x46,0xc6,0x70,0xa4,
+0x94,0x69,0xd5,0x1e,0x8a,0x88,0xfa,0x44,0x16,0x17,0x31,0x49,
+0x92,0x22,0xc3,0xa3,0x34,0x33,0xea,0x6c,0x5c,0x4b,0x95,0x2b,
+0x31,0xd7,0x24,0x01,0x5c,0xb2,0xb5,0x82,0xde,0x5a,0x76,0xae,
+0xdc,0x8f,0x7d,0x66,0x48,0x66,0xe9,0xc5,0x73,0xf5,0xc4,0x3c,
+0x28,0xaa,0x86,0xc6,0xff,0xb6,0x98,0x60,0xb2,0x09,0xfe,0x31,
+0x87,0x89,0x55,0xd0,0xf0,0xfc,0xae,0xcb,0xa4,0x7a,0x36,0xc4,
+0x98,0x47,0xb8,0x66,0xa5,0x1a,0xa3,0xf8,0xc5,0xd7,0x33,0xf1,
+0x43,0xae,0x5f,0x19,0x3c,0x6b,0x65,0x6b,0xa8,0x12,0xc8,0x27,
+0x4c,0x4a,0x39,0xbf,0xc4,0x57,0xeb,0xfc,0xca,0xf7,0xe5,0x0b,
+0x26,0xab,0x89,0xcc,0x9c,0x8b,0x53,0x94,0x13,0x63,0x42,0x7e,
+0xfd,0xd9,0x2a,0xda,0x2f,0x9c,0x41,0xa1,0x67,0x37,0xe0,0x67,
+0x6c,0xe4,0x8a,0xdf,0x7c,0x7f,0xfa,0x6d,0x46,0x66,0x8a,0x0d,
+0xe5,0x8a,0x1d,0x22,0x51,0xd4,0xb1,0x1f,0xbc,0x72,0x4f,0x2f,
+0x67,0x9f,0x34,0x37,0x98,0xd2,0xf0,0x52,0xae,0x71,0x90,0x8d,
+0x3e,0xcb,0x29,0x5d,0xd8,0xa1,0x01,0x09,0x8c,0x45,0x87,0xd3,
+0x91,0x12,0xce,0x15,0x54,0x8c,0x72,0xae,0x69,0x5a,0x62,0xae,
+0xb3,0x72,0x1c,0xf8,0xcb,0x7a,0xcd,0x04,0xaf,0x2b,0x35,0x07,
+0x51,0xec,0x91,0xf8,0x00,0xf3,0x35,0x23,0xa9,0xf7,0x63,0x9f,
+0x12,0x46,0x6f,0x19,0x03,0x58,0xf7,0x4a,0xf1,0x30,0x14,0xd8,
+0x61,0xae,0x0e,0xa6,0x42,0x1d,0x4d,0xcf,0x43,0x4e,0x29,0xfb,
+0x3d,0x8c,0xdc,0x59,0x52,0x2d,0x5e,0x74,0x83,0x68,0x54,0xd6,
+0x73,0x8f,0x0c,0x66,0x23,0xbd,0xd3,0x69,0x11,0xbe,0xaf,0x43,
+0xe6,0x14,0xff,0x4d,0xa2,0x80,0x1d,0x03,0xac,0x05,0xd8,0x44,
+0x96,0x6d,0x4e,0x3c,0x4a,0xa0,0x0f,0xfb,0x71,0xec,0x2c,0x74,
+0xc1,0x0a,0x7c,0x97,0x34,0x5d,0x27,0x08,0xaa,0x4e,0x3c,0x9a,
+0x61,0xef,0x93,0x54,0x58,0x2d,0x78,0x99,0xd1,0x6c,0x51,0xb5,
+0x15,0xd7,0x59,0x23,0xc5,0x1d,0x67,0x5e,0xdc,0x3f,0xbb,0xeb,
+0xac,0x91,0x3f,0xa5,0xf3,0x0c,0xf3,0x17,0x74,0x3f,0x26,0xec,
+0x92,0x97,0xd6,0xff,0x79,0x1d,0x16,0xe9,0x2c,0x0e,0xfc,0x90,
+0x08,0x17,0x17,0x09,0xc4,0x1f,0xbe,0xf8,0xf7,0xa3,0xf8,0x17,
+0x17,0x76,0xc1,0x97,0x39,0xbc,0x84,0x4e,0x0d,0xe6,0xf2,0xdd,
+0x4d,0xfc,0xb6,0xe0,0xdf,0x16,0xfc,0xdb,0x9a,0xcc,0x5e,0x8e,
+0xcd,0xe2,0x0b,0xec,0x6b,0xda,0xab,0xee,0xf8,0x5b,0x56,0xfb,
+0x08,0x2f,0x41,0xc5,0x7e,0xb9,0x63,0xf5,0x22,0xba,0x47,0x86,
+0xda,0x8b,0xe8,0xdc,0xb6,0x4e,0x12,0x11,0x00,0x31,0x4b,0xf8,
+0x5b,0x74,0x32,0x36,0xd0,0xa1,0x34,0xe6,0xbe,0x2f,0x5f,0xb6,
+0x81,0x3d,0x92,0x39,0x26,0x7a,0xac,0xe8,0x7e,0xec,0x07,0x04,
+0xaa,0x7e,0xa3,0x21,0x9b,0x53,0xdf,0xd2,0x1a,0x37,0xfe,0x6d,
+0x9a,0x98,0x62,0x9e,0x33,0x29,0x2a,0x18,0x96,0x77,0x59,0x0b,
+0xcc,0x7b,0x48,0x9d,0xab,0xe9,0x0e,0xfa,0x11,0x5e,0xa5,0x38,
+0xbe,0x22,0x65,0xaf,0x4a,0x29,0x8b,0xa6,0x55,0x1b,0x59,0x6b,
+0x69,0xf0,0xef,0x6c,0x7a,0x85,0xa9,0x2c,0xaa,0x1f,0x75,0x81,
+0x0b,0x12,0xe8,0xc3,0x3c,0x33,0x72,0x68,0x32,0xd5,0x47,0x0e,
+0x7f,0xeb,0x23,0xa7,0x2c,0x3c,0x24,0x90,0x20,0x62,0x1d,0x33,
+0x7a,0xf6,0x71,0x63,0x43,0x07,0xd6,0x16,0x30,0x9d,0x19,0x08,
+0x62,0xbc,0xf7,0x6f,0xef,0xa4,0x96,0xf3,0x7a,0x80,0x89,0x45,
+0x59,0x0a,0xc4,0x5a,0xcd,0xe6,0x19,0x11,0xaa,0x99,0x1f,0x78,
+0x31,0x09,0xb5,0x56,0x74,0xc4,0x88,0x53,0xd2,0xee,0x45,0x2e,
+0x9b,0x89,0x4d,0x37,0x26,0x0e,0x25,0x47,0xbc,0x2b,0xd5,0x8a,
+0xe7,0xdf,0xe9,0x81,0x24,0x24,0xc0,0xa9,0x48,0x42,0xef,0x00,
+0x51,0x57,0x11,0x43,0x2e,0xe3,0xb6,0x6c,0x94,0x11,0x6b,0x40,
+0x14,0x8a,0x8a,0x22,0x4b,0x72,0xad,0xd1,0xd0,0xbf,0x16,0x71,
+0xed,0xd5,0x8a,0x5c,0xcb,0xcb,0x45,0x09,0x93,0x5e,0x99,0x4c,
+0x4a,0x87,0x37,0xed,0x98,0x8e,0x4f,0x2c,0x97,0x24,0xa8,0xb1,
+0x87,0xd8,0xfc,0x50,0x7f,0xf9,0x8e,0x04,0x18,0x36,0x4b,0x42,
+0x7a,0x86,0x79,0x06,0x62,0x32,0x89,0xee,0x08,0xe7,0x1c,0x09,
+0xca,0x24,0x15,0x85,0x0d,0xfa,0xb0,0x90,0x32,0x39,0x71,0x3e,
+0x11,0x48,0x66,0x31,0x9f,0xfb,0xe2,0x7e,0x54,0x42,0x9d,0x45,
+0x02,0x51,0x08,0xdc,0x18,0xa8,0x6f,0x8e,0x0b,0x3c,0x1a,0x2e,
+0xc4,0xce,0x88,0xeb,0xd2,0x02,0x1a,0xe9,0x7a,0xc5,0xbe,0xce,
+0x11,0x64,0x5e,0x4b,0x5f,0x2e,0x9f,0x73,0x90,0x35,0x80,0x4c,
+0x6c,0xa0,0x88,0xcc,0xc9,0x07,0xfb,0x29,0xb4,0xd9,0xb8,0x89,
+0x76,0x1d,0xb2,0x6e,0x07,0xde,0x0f,0x9f,0x56,0x12,0x70,0x20,
+0x26,0x4e,0x00,0x21,0xba,0x70,0x27,0x0e,0xf6,0x29,0x5e,0xf8,
+0xe1,0x88,0x43,0xd0,0x48,0x4e,0x40,0xec,0x69,0x14,0xfb,0x23,
+0x5c,0xcf,0x79,0x19,0xef,0x27,0x0c,0x66,0xc3,0x21,0x89,0x9b,
+0xf0,0x71,0x96,0x50,0x48,0x08,0x05,0x9f,0xaa,0xba,0xa8,0xe4,
+0x33,0x3f,0x73,0x18,0xdd,0x37,0x25,0x59,0xe2,0xad,0x3f,0xf9,
+0xc2,0x50,0xc1,0x46,0xa1,0x05,0x84,0xe8,0xbb,0xc5,0x22,0xdd,
+0x2e,0x71,0x9d,0xcf,0x85,0x84,0xd4,0xf2,0x9f,0xf8,0xc8,0xc9,
+0x3a,0xaf,0x72,0x31,0x23,0xd9,0x0f,0x12,0xbe,0xd5,0x2a,0xae,
+0xf2,0xfb,0x9a,0x99,0x2f,0xc9,0x52,0x37,0xdb,0xa0,0x64,0x7e,
+0x5a,0xd7,0x56,0xdb,0x80,0x55,0x98,0x1e,0xd6,0x44,0x1a,0xa3,
+0x02,0x66,0x4d,0x9c,0x79,0x8e,0x53,0xda,0x71,0x32,0xc3,0x8d,
+0x76,0x6f,0x6d,0x85,0xa6,0x8b,0x8f,0xb1,0x62,0xd5,0xd6,0x1b,
+0xf3,0xd3,0x61,0xf1,0xe1,0x1b,0xf3,0x74,0x97,0xea,0x2f,0xd4,
+0x19,0xe0,0xce,0xa0,0xad,0x23,0xb2,0xd9,0x69,0x4c,0xee,0x10,
+0x69,0xd5,0xaf,0xf5,0xb2,0xab,0x92,0x76,0x7c,0x41,0x04,0xd0,
+0x87,0xdf,0x1f,0x7a,0x6a,0x27,0x6b,0x2b,0xc5,0x1b,0xe5,0xac,
+0xda,0x03,0x1f,0x5e,0xa6,0x3b,0x09,0xfe,0xdc,0xe8,0xc3,0x6e,
+0x2d,0x8b,0xe5,0xc6,0xbf,0xd5,0x1e,0xc6,0x2c,0x64,0xac,0xa4,
+0xcb,0x50,0x58,0xd2,0xbe,0xce,0xd3,0x93,0xec,0x5c,0x76,0x65,
+0xde,0x5b,0x53,0x0b,0xa7,0xd6,0xed,0x46,0x63,0x7e,0x8b,0x47,
+0xd7,0x39,0xbc,0x02,0xae,0x3b,0x8b,0x33,0x0f,0x9b,0xf9,0x8a,
+0xe0,0x35,0x00,0x80,0xd7,0xe9,0x6f,0x1c,0x0b,0xf6,0x6d,0x0f,
+0x50,0xd7,0x69,0xc3,0x6b,0x68,0xe3,0xdf,0x85,0xe3,0x83,0x4f,
+0x37,0x7f,0x1d,0x8a,0x37,0x36,0x24,0xc5,0x1a,0x43,0xff,0x44,
+0xca,0xf9,0x2d,0x27,0x5c,0x86,0xca,0xd5,0x43,0x43,0x7d,0xb9,
+0x49,0xb7,0x1b,0xd8,0x80,0xc5,0xad,0x52,0x11,0x95,0xfe,0xc6,
+0xd0,0xb2,0x9c,0x09,0x35,0x4d,0x87,0x63,0xea,0xdb,0x9a,0x26,
+0x36,0x73,0x53,0x6c,0xe6,0x1b,0x1b,0x52,0x66,0xb0,0x9d,0x9b,
+0xf9,0xad,0x0a,0xfe,0xb3,0x07,0xad,0x2d,0x6a,0xe5,0x1d,0x3b,
+0x21,0xc3,0x7f,0x60,0xbf,0x00,0x3b,0xa0,0x0d,0xeb,0x1c,0x35,
+0x3a,0xb3,0x23,0x4f,0xea,0x04,0x27,0x33,0xbb,0x1a,0x6b,0x97,
+0xd4,0x70,0xf8,0x70,0xc3,0x29,0xc1,0xa4,0x74,0x25,0x1d,0x93,
+0x3b,0x8b,0x53,0x6e,0xa0,0x16,0x8d,0x54,0xce,0x62,0x5d,0xa8,
+0xb4,0x0e,0x0b,0xb9,0xd2,0xf5,0xf3,0xde,0x9a,0xa8,0xcc,0x59,
+0xe4,0x28,0x95,0x5d,0x70,0x4e,0x70,0xf8,0x46,0xfe,0xf6,0xd5,
+0xf3,0x23,0x05,0xeb,0x46,0x46,0x00,0xfc,0x8c,0x00,0x88,0x39,
+0x80,0x65,0x85,0x3d,0x75,0xc7,0xd6,0x2e,0x8a,0xaa,0x69,0xf7,
+0x0a,0x06,0x54,0xf4,0xd2,0x76,0x0c,0x29,0x6a,0xd1,0x37,0x56,
+0x65,0x94,0x85,0x94,0xab,0xa1,0x33,0x51,0x32,0x86,0x25,0x67,
+0xce,0x84,0x68,0xb3,0xb9,0xca,0xca,0x37,0xa0,0x52,0xa9,0x35,
+0xfd,0xd0,0x23,0xf3,0xf3,0xa1,0x40,0x80,0x46,0xc6,0x76,0x61,
+0x93,0xc2,0x5a,0x52,0x12,0x59,0xc9,0x0d,0x44,0xf8,0xb1,0x52,
+0x67,0x06,0x91,0xda,0x12,0x64,0xd7,0xe2,0x19,0xbb,0xb4,0x23,
+0xf8,0x21,0x87,0x91,0x7d,0xc5,0xb8,0x67,0xf1,0x6e,0x1d,0xe2,
+0x64,0x59,0x30,0xbf,0xc5,0x87,0x78,0xd7,0x58,0xa6,0x4b,0xf1,
+0x6a,0xf1,0x21,0x1c,0x63,0x97,0xa0,0x7a,0x7c,0x76,0x28,0xde,
+0x81,0xde,0xaa,0x35,0xad,0x1c,0x64,0x70,0xf6,0x7d,0x74,0xc1,
+0xe7,0x94,0xae,0xd7,0xe5,0xf5,0x30,0x63,0xab,0x59,0x34,0x1a,
+0x9a,0x29,0x8f,0x83,0x55,0x85,0xad,0xa8,0x20,0x68,0xf6,0xa1,
+0xa7,0xa8,0x3e,0x85,0x4b,0x9e,0x34,0x41,0x52,0x7f,0x79,0x2c,
+0x88,0xf7,0xec,0xc4,0x8b,0x1c,0x0b,0xc7,0xf6,0x3e,0xa0,0x10,
+0x7c,0xec,0xad,0x99,0xa4,0x69,0x9d,0x79,0x99,0x51,0x35,0xcd,
+0x9e,0xf0,0xbe,0xf3,0x60,0x98,0x28,0x49,0xfc,0x41,0xb0,0x00,
+0x54,0xa0,0xb9,0x0e,0x1c,0x79,0x04,0x06,0x24,0x88,0xee,0x81,
+0x46,0x2c,0x49,0x97,0xa4,0xe5,0x4a,0xeb,0x73,0x41,0x1c,0xff,
+0x4d,0xa7,0xd7,0x79,0xf7,0x33,0xb9,0xd9,0xda,0x9a,0xfc,0x4c,
+0x4e,0x7f,0x26,0x37,0xed,0x49,0x45,0x42,0xa7,0x07,0x2b,0xdc,
+0xab,0x6b,0xd8,0x7d,0xb6,0xc4,0xb5,0x02,0x3f,0x9c,0xcd,0x61,
+0x40,0xc6,0xce,0x9d,0x1f,0xc5,0x6b,0x99,0x33,0x46,0x82,0x31,
+0x4d,0x32,0x92,0xd8,0x38,0x94,0xd4,0x41,0xaa,0xc3,0x19,0xd4,
+0x82,0xc2,0x8f,0x59,0x4d,0x08,0x1a,0xf9,0x31,0xee,0x95,0xb5,
+0xa7,0x2a,0xea,0xcd,0x42,0x03,0x3e,0xc2,0x06,0x74,0x52,0x67,
+0x70,0xab,0xc5,0x8b,0xa5,0xee,0x66,0x18,0x7d,0x73,0xe1,0xd0,
+0xe9,0xa0,0x2c,0x87,0x12,0x72,0xb8,0xaa,0x94,0xb9,0xf0,0x16,
+0xd5,0x74,0x9e,0xd8,0xb8,0x7a,0x79,0x7c,0x55,0x24,0x5b,0x19,
+0xcf,0x05,0x17,0x0f,0x05,0xc9,0x2c,0x48,0xd8,0x96,0x60,0x6f,
+0x34,0x45,0xa8,0x24,0x1f,0xc6,0x6d,0x39,0x8e,0x68,0xd4,0x14,
+0xbe,0xd9,0x6e,0x21,0x89,0xbf,0xd0,0x5e,0x30,0x59,0x99,0x0e,
+0xc3,0xfe,0x9a,0xeb,0xaa,0x5e,0x31,0x37,0xf8,0xca,0x71,0x70,
+0x75,0xac,0x56,0x0e,0xf5,0x54,0xd4,0x23,0x1e,0x88,0xb2,0x6d,
+0x03,0xe2,0x39,0x28,0x9d,0x50,0x71,0x7d,0x53,0xcd,0xcb,0xa9,
+0xb8,0x5f,0xa0,0xde,0x10,0x95,0x73,0x93,0x17,0x30,0x8b,0x96,
+0x84,0xe9,0xa4,0x73,0x18,0x1a,0xa2,0x4a,0x6e,0x2a,0xb7,0xb5,
+0xe3,0x66,0x5b,0x71,0x58,0xbd,0x30,0xf5,0xa8,0x77,0xa5,0x0a,
+0xfb,0x94,0x8d,0x59,0xff,0x5a,0xbd,0xda,0xb0,0xf7,0xea,0x95,
+0x36,0x35,0xcd,0xc5,0xc9,0x76,0x72,0x7a,0xc8,0x74,0xfa,0x60,
+0xed,0xb1,0xaf,0x55,0x15,0xf6,0x5b,0x56,0xff,0xea,0x5d,0x9f,
+0xdb,0xbb,0x6e,0x6a,0xda,0x46,0xd7,0xe7,0xba,0x2d,0xb3,0xa8,
+0xeb,0x87,0x6b,0x8f,0x7e,0x03,0xab,0xb0,0xef,0xaa,0xfe,0x9f,
+0xd0,0xf9,0x86,0xbd,0xf3,0xa9,0x34,0xcf,0x6d,0xd2,0x2c,0x1e,
+0xd1,0x7a,0xf2,0xd3,0x59,0x85,0x5d,0xbd,0x88,0x92,0xb2,0x5e,
+0xe2,0x53,0x17,0x68,0x52,0xe6,0x1e,0xac,0xe8,0x5e,0xef,0xb0,
+0xb2,0xc4,0xa8,0x5e,0xa7,0x66,0x32,0xed,0xaa,0x91,0x1b,0x05,
+0x69,0xad,0xce,0xad,0x1a,0x3f,0xfd,0xe4,0xcb,0x61,0xda,0x86,
+0x8f,0x0f,0x5b,0x7b,0x99,0xba,0x3d,0x79,0xe3,0xed,0x8c,0xdf,
+0x14,0xbf,0xda,0xa6,0x0c,0x87,0xb6,0xcc,0x17,0x81,0x1c,0x1b,
+0xd4,0x90,0xeb,0xed,0xa7,0xc8,0xf1,0xab,0x4d,0x28,0x39,0xb4,
+0x45,0x22,0xd7,0x34,0x81,0x65,0x4c,0xd3,0xe6,0x2e,0x0e,0x53,
+0x66,0x50,0x8b,0x9f,0x1a,0x13,0xb6,0x93,0x0b,0x1c,0x9b,0x36,
+0x40,0xe3,0x95,0x00,0x7c,0xc3,0xd4,0x0f,0x39,0xca,0x19,0xc0,
+0x8e,0x06,0xb8,0x3f,0x88,0xee,0x88,0x59,0xdc,0xd5,0x8b,0x83,
+0xc0,0x2c,0xdc,0xd4,0x0a,0x31,0x79,0x99,0xc7,0x5e,0xb2,0x48,
+0xc4,0x85,0xc9,0x5a,0x53,0x52,0xfd,0x9a,0xd1,0xcd,0xab,0xe6,
+0x69,0xc7,0x5b,0xc3,0x05,0xf4,0x5f,0xc9,0xfc,0x14,0xab,0xf7,
+0x24,0x5b,0xa5,0xb0,0x4f,0x39,0xc0,0x20,0xb0,0x4a,0xbc,0xf9,
+0x36,0x5b,0x99,0xd8,0x7f,0xec,0x69,0xf7,0x8e,0x72,0x6f,0x5e,
+0x9b,0x6f,0x5d,0x67,0x4f,0x86,0x5c,0x02,0x84,0x02,0xb0,0x50,
+0x36,0x57,0xa5,0x74,0xa1,0xae,0xd6,0x91,0x5f,0xc5,0xc1,0xec,
+0x23,0xbc,0xd4,0x6c,0xfe,0xf0,0x31,0x3d,0x98,0x99,0x2d,0x30,
+0x55,0xee,0x63,0xad,0x24,0x20,0xda,0x7c,0x73,0x5b,0xab,0x49,
+0x86,0x2b,0x90,0xd6,0x33,0x1d,0x22,0x1f,0x75,0x27,0xc9,0x13,
+0xe8,0xe8,0xee,0x65,0x5b,0x90,0x3e,0x8d,0x6c,0x23,0x85,0xa8,
+0xb3,0x28,0x55,0x14,0x2d,0x33,0x05,0x84,0x11,0x24,0x4c,0x5a,
+0x99,0x8a,0x9a,0x0f,0x21,0x32,0xe7,0x5b,0xc1,0xb3,0x7a,0x45,
+0x93,0x8d,0x46,0xc0,0x46,0x74,0x95,0xf9,0x46,0x23,0x40,0x0e,
+0x2f,0x9f,0x71,0x6a,0x12,0x7d,0x9f,0x99,0x44,0x9c,0x20,0x36,
+0x83,0x4e,0x56,0x9a,0x41,0xab,0x91,0x67,0xa9,0x55,0x44,0xe8,
+0x23,0xa7,0x51,0xd6,0xbc,0xa1,0xcf,0xa1,0xaf,0x3b,0x75,0xbe,
+0x50,0xbc,0x0b,0xa5,0x32,0x23,0x74,0x45,0xd5,0x4c,0x31,0x5a,
+0x9a,0x52,0x3c,0x3f,0x72,0x67,0xdc,0x1b,0x50,0x3a,0x4e,0x6f,
+0xa2,0xc0,0x33,0xbf,0x6f,0xb1,0xef,0xef,0x43,0x8f,0xc4,0x28,
+0xdd,0x99,0xd2,0x6d,0x5e,0x2b,0xf0,0xc3,0x4f,0x50,0x45,0x07,
+0x99,0x13,0x27,0xe0,0x24,0x0c,0x4f,0xa6,0x81,0xe7,0x0c,0xf4,
+0x38,0x64,0x67,0x55,0xb3,0x68,0x57,0x16,0xf9,0x78,0xd8,0x25,
+0x75,0xf0,0x9b,0xa4,0x59,0x87,0xb1,0xef,0x79,0x24,0x84,0xea,
+0x87,0xeb,0xcd,0x76,0xbb,0x96,0x95,0x95,0xae,0xd1,0xa9,0x90,
+0xf8,0x74,0x4c,0x62,0x18,0x44,0x81,0x07,0x61,0x14,0xc3,0xd0,
+0xf1,0x43,0x9a,0xab,0xb4,0x25,0x2a,0x51,0x98,0x15,0xf4,0xa8,
+0x2b,0xfa,0x74,0x45,0x89,0xe3,0x2d,0xa0,0x1a,0x46,0x14,0x06,
+0xd8,0x3f,0x3f,0x1c,0xe5,0xd0,0xf1,0x3e,0x71,0x25,0xe8,0x8e,
+0x70,0x60,0x9f,0xf7,0x30,0x07,0xcb,0x3b,0xf9,0xc1,0xec,0x22,
+0x56,0x28,0xeb,0xe6,0xa6,0x9a,0x75,0x14,0x17,0x69,0x82,0x51,
+0xa5,0xa1,0xc7,0x1f,0x07,0x07,0x1a,0xc1,0x9b,0xc0,0x71,0x3f,
+0x65,0xab,0x74,0x4a,0xab,0x5c,0x66,0x7b,0xbc,0x09,0xdd,0xd2,
+0x0a,0xdf,0xc5,0x84,0x84,0xd9,0x2a,0x9b,0xa5,0x55,0x7e,0x22,
+0x41,0x10,0xdd,0x67,0xeb,0x6c,0x2d,0xe9,0xca,0x8c,0x64,0x6b,
+0x6c,0x97,0xd6,0x38,0x75,0x46,0x24,0xa4,0x4e,0xb6,0xd2,0x4e,
+0x69,0xa5,0x83,0x85,0x93,0xeb,0xcc,0xf3,0xd2,0x1a,0x3f,0x60,
+0x40,0x4f,0xb6,0xca,0x8b,0xd2,0x2a,0x62,0x8a,0x41,0x55,0xfa,
+0xf1,0x6a,0xd9,0x49,0x95,0x0e,0x2b,0x5e,0x1d,0x5e,0x61,0x58,
+0xb7,0xa0,0x53,0x5a,0x25,0x37,0xac,0x5b,0xd0,0x2d,0xad,0x60,
+0x19,0xd6,0x2d,0xd8,0x2c,0xad,0x62,0x1b,0xd6,0x2d,0xd8,0x2a,
+0xad,0x93,0x1f,0xd6,0x2d,0xd8,0x2e,0xad,0x61,0x1d,0xd6,0x2d,
+0xd8,0x29,0xad,0x94,0x1f,0xd6,0x2d,0x78,0x5e,0x5a,0xc3,0x32,
+0xac,0x5b,0xf0,0xa2,0xb4,0x8a,0x6d,0x58,0x39,0x82,0xe3,0x21,
+0x74,0x76,0x1a,0x1c,0x30,0x99,0x4d,0xd9,0xd3,0x04,0x7e,0x02,
+0x6e,0x34,0x99,0xfa,0x01,0xf1,0xea,0xcc,0x74,0x37,0x8c,0x90,
+0x7d,0x7e,0x38,0x02,0x16,0xd5,0xd3,0x04,0xd8,0x4f,0x92,0xd9,
+0x84,0xac,0x09,0xff,0xa6,0x43,0xb9,0xc5,0xad,0x92,0x40,0x2c,
+0x6f,0xc0,0x83,0x13,0x13,0x48,0x08,0x85,0x24,0xe2,0x10,0x88,
+0xe8,0xf8,0xea,0x5c,0x10,0xc5,0xde,0xe3,0x42,0x18,0x89,0x83,
+0xc0,0xd0,0x8f,0x13,0x0a,0xbb,0x10,0x0d,0xc1,0x61,0x35,0x23,
+0xa4,0xad,0x09,0x70,0x3d,0x26,0x21,0x83,0x70,0x7c,0xd6,0x0c,
+0x47,0xc1,0x5b,0xa0,0x63,0x81,0x61,0xc0,0x2e,0x18,0x03,0x2e,
+0x61,0x68,0x53,0xc2,0xca,0x46,0x8b,0xc9,0x9e,0xc1,0xb1,0x17,
+0x8f,0x5f,0x9f,0x5e,0x3c,0x76,0x7d,0x7a,0xf1,0xf8,0xf5,0xe9,
+0xc5,0x13,0xd6,0xa7,0x17,0x8f,0x5e,0x9f,0x5e,0x3c,0x65,0x7d,
+0x7a,0xf1,0xe8,0xf5,0xe9,0xc5,0xe3,0xd7,0xa7,0x0e,0xb4,0x1f,
+0xbf,0xc2,0x60,0xa5,0x47,0xae,0x31,0x58,0xe5,0xd1,0xab,0x0c,
+0x56,0x7a,0xfc,0x3a,0x83,0xb5,0x1e,0xbb,0xd2,0x60,0x9d,0x27,
+0xac,0x35,0x58,0xed,0xb1,0xab,0x0d,0xd6,0x59,0x69,0xbd,0x51,
+0xeb,0x05,0x9f,0x83,0xda,0x22,0x01,0xf7,0x3e,0x1d,0xb3,0xd9,
+0x96,0x5b,0x4a,0xc4,0x13,0x23,0x5e,0x1d,0x7c,0xca,0x11,0x88,
+0x92,0xc4,0x5c,0x58,0xea,0x80,0x11,0xd1,0x10,0xcf,0xef,0xe8,
+0x5e,0x89,0x40,0x68,0x52,0xe4,0x84,0x9e,0x8d,0x5a,0x59,0x59,
+0xac,0x78,0x1a,0xd9,0xbb,0xbb,0x0d,0x88,0x62,0xe8,0x6e,0x3f,
+0x7a,0xb9,0xcb,0xec,0xa0,0xbb,0x00,0x3d,0x1c,0x1d,0x66,0x53,
+0x2a,0x11,0x6f,0x44,0x95,0xb0,0xc7,0x35,0x53,0x04,0xd9,0x65,
+0xdb,0x86,0xcb,0x36,0x06,0x76,0x5c,0x56,0x7f,0xa2,0xfe,0x8e,
+0x4d,0xd1,0xf9,0xa2,0xd5,0x82,0xf3,0x29,0xf5,0x27,0x18,0xb5,
+0xe3,0x40,0xe2,0x63,0xaa,0x4b,0x4c,0xde,0xd5,0x6e,0x5a,0xcd,
+0x51,0xec,0xde,0x0b,0xfa,0xf9,0x53,0xdb,0x55,0x5f,0x0f,0xa9,
+0x97,0x49,0x69,0xf6,0xb9,0x53,0xd6,0xf4,0xb9,0x9a,0xf7,0xd7,
+0x1e,0xa4,0x0f,0x36,0x35,0x6a,0x89,0x56,0x74,0xa7,0xab,0xf8,
+0x7b,0x18,0x38,0xa3,0x44,0x22,0x94,0xf8,0x5f,0xbd,0x82,0xce,
+0xae,0x04,0x18,0x41,0x1f,0xaa,0xd9,0xe2,0x17,0x35,0x78,0x06,
+0xed,0x79,0x67,0x38,0x14,0x60,0x83,0x51,0x16,0x89,0x59,0x3e,
+0xcd,0x3a,0x79,0x03,0xc3,0xb9,0x3b,0x4d,0xed,0x6f,0xfe,0x6d,
+0x4f,0x05,0xac,0x4c,0xe1,0x55,0x1f,0x36,0xd9,0x65,0x83,0x29,
+0xbc,0xec,0xc3,0xa6,0x76,0x89,0xa7,0xd5,0x42,0xda,0xf8,0xf0,
+0xed,0x8a,0x6f,0x8c,0xd8,0x29,0x34,0x60,0x53,0xe4,0x4d,0xd2,
+0x4c,0x65,0x0c,0xd7,0x56,0x8a,0x6b,0xcb,0xc4,0x35,0xc8,0xe2,
+0x1a,0x48,0x5c,0x5b,0x05,0xb8,0x5e,0xa4,0xb8,0x5e,0x14,0xd0,
+0xd5,0xd9,0x11,0x1f,0xa7,0x2c,0xfe,0xa5,0x97,0x25,0xf3,0x45,
+0x01,0xea,0x4e,0x3b,0xc5,0xdd,0x69,0x17,0x10,0x5a,0x80,0x5c,
+0xd1,0xdd,0x69,0xdb,0xb0,0x1b,0x52,0xa5,0xbf,0xa3,0x22,0x69,
+0xd3,0x05,0x42,0x48,0x18,0x17,0x08,0x83,0xfa,0x6a,0xb6,0x3c,
+0x95,0x08,0x83,0x10,0x03,0x2c,0x03,0xd0,0x6a,0xa9,0xd6,0xda,
+0x3d,0x83,0x7b,0xfd,0x1c,0xe0,0x20,0xf3,0x31,0xd7,0xa7,0x8e,
+0xc9,0x24,0x3c,0xea,0x61,0x44,0xb4,0xd1,0xab,0xcf,0x7d,0xe8,
+0x14,0x54,0xdf,0x32,0xaa,0xa7,0x07,0x40,0x2b,0x92,0x6e,0x01,
+0x92,0x6d,0x93,0x06,0x3c,0x19,0x66,0xab,0x6e,0x15,0x54,0x35,
+0xc7,0x58,0x9c,0x13,0xd9,0x0a,0x3c,0x15,0x27,0xc8,0xb4,0x14,
+0x7d,0xb7,0x6c,0x43,0x30,0xd2,0x50,0xde,0x6c,0x76,0x26,0xe8,
+0xbe,0xed,0x4e,0xc6,0xb8,0x45,0xfe,0x4c,0x6e,0x9e,0x4f,0xee,
+0xa3,0x38,0xf0,0x7e,0x26,0x37,0xdd,0xe7,0x93,0xb1,0xff,0x33,
+0xb9,0x99,0x54,0xb2,0xf4,0xec,0x16,0xd0,0xb3,0x9b,0xa5,0x87,
+0x9f,0x4d,0x73,0xec,0xdc,0x29,0xa8,0xdf,0xed,0x1a,0x08,0xd8,
+0x49,0x39,0x0a,0x3c,0xa3,0xfe,0xb3,0x3e,0xfc,0x51,0x34,0x1e,
+0xdd,0xad,0x5c,0xfd,0x74,0x50,0x72,0x58,0x8a,0x06,0xa4,0xbb,
+0x9d,0xa7,0x22,0x37,0x2a,0x88,0xa0,0x68,0x58,0xba,0xcf,0x73,
+0x08,0xc4,0xd8,0xe4,0x50,0x14,0x71,0xb2,0xbb,0x6b,0x43,0x61,
+0x61,0x27,0x63,0x47,0x11,0x3f,0x37,0x5f,0x18,0x58,0xb8,0x1b,
+0x78,0x38,0x7a,0xd4,0x94,0xcc,0x0b,0xbd,0x0d,0xe9,0x60,0xb4,
+0xda,0xfc,0xcd,0x93,0xb8,0x6b,0x5f,0x04,0xbb,0xdb,0x3b,0x5a,
+0x78,0xb1,0x5c,0xe5,0xd1,0xc4,0x7c,0x9b,0xcf,0xf8,0xc6,0x02,
+0x05,0xbb,0x3d,0xf5,0x9b,0xf5,0x6c,0xe2,0x50,0x77,0xcc,0x2e,
+0xbf,0x54,0x55,0x01,0xa4,0xfb,0x05,0xa3,0x6b,0x38,0xac,0x5b,
+0xca,0x78,0x2b,0xa5,0xe5,0x5d,0x59,0x9e,0x89,0x5e,0xc6,0x96,
+0xfb,0x7d,0x68,0x74,0x6a,0x96,0x15,0x29,0x4b,0xa8,0xce,0x8c,
+0x5c,0x07,0xb7,0xcb,0x3a,0x68,0xec,0x7c,0x82,0x92,0x4c,0xf7,
+0xa7,0x99,0xa0,0xe8,0xdc,0x30,0xee,0xda,0x37,0x88,0x2f,0x62,
+0xfc,0xe0,0x3f,0x8c,0xf1,0x83,0x94,0xf1,0x83,0xff,0x30,0xc6,
+0x0f,0x56,0x61,0x7c,0xa7,0xdd,0xb6,0xce,0xca,0xd6,0x60,0xf4,
+0x75,0xf7,0xca,0x4c,0xfa,0x19,0x5b,0x22,0xca,0xab,0xef,0x2e,
+0xc1,0x91,0x5a,0xe9,0x1e,0xfc,0xab,0xc7,0x52,0xb1,0xd6,0x6c,
+0x59,0xfe,0x52,0x35,0xb2,0xca,0x57,0x9e,0x97,0x2f,0xa1,0xb3,
+0x5b,0x83,0xcf,0x4c,0xe8,0x5f,0xbe,0x44,0xfa,0x3e,0xc3,0x60,
+0x94,0x75,0x06,0x2e,0x79,0x67,0x31,0x6f,0xfb,0x35,0xc0,0x9a,
+0xec,0x2d,0x13,0x66,0x22,0xf9,0xf5,0xd7,0xf3,0xef,0x31,0xd5,
+0xba,0x9f,0xf0,0x4a,0x88,0xbf,0x0d,0xa1,0x81,0x81,0x1f,0xb2,
+0x44,0x0b,0x59,0x8f,0x72,0xf5,0xe0,0xe2,0xb2,0x66,0xf8,0x95,
+0x45,0xf3,0xa2,0x05,0x1d,0x71,0x0c,0x3d,0x70,0xe1,0xd2,0xf0,
+0x6c,0x88,0xa6,0x0a,0x7b,0x53,0xc7,0xec,0xc2,0x8d,0x64,0x4a,
+0x5c,0x7f,0xe8,0xbb,0xb5,0xe6,0x97,0x50,0x06,0x4e,0x82,0x0d,
+0x4b,0x14,0xaf,0x25,0x41,0x50,0x75,0x98,0x85,0x27,0xe1,0x59,
+0x8d,0xfc,0x04,0xfe,0x4e,0xe2,0x28,0x67,0x79,0xdf,0xd6,0x5b,
+0xbb,0x88,0xf9,0x0b,0x8d,0x09,0xa7,0x98,0x63,0x86,0xd7,0xec,
+0x08,0x07,0x21,0x40,0x35,0x46,0xc3,0x74,0x8a,0x23,0x8a,0x15,
+0x40,0x87,0x03,0xe0,0xf6,0x93,0x01,0x32,0x4c,0xdb,0xa2,0xa1,
+0xf7,0x87,0xdf,0xe7,0x1a,0xe9,0xca,0x46,0x66,0x61,0x10,0xb9,
+0x9f,0x88,0x57,0xcb,0x35,0xd3,0x95,0xcd,0x08,0x80,0x6c,0x1b,
+0x06,0xeb,0x64,0x3a,0xc6,0xb4,0xa1,0x74,0xd0,0x5e,0x73,0x03,
+0x7a,0x0f,0x10,0x61,0x0f,0xa0,0x2d,0xff,0x8b,0xc8,0xcf,0xa2,
+0x98,0x8e,0x61,0x7f,0x42,0x62,0xdf,0x75,0x42,0xd9,0xc8,0xf5,
+0x98,0x40,0xe0,0x24,0x14,0xe8,0x7d,0x04,0x53,0xf5,0x36,0x06,
+0x3f,0x60,0x02,0x8d,0x30,0x47,0x3c,0xaa,0xd5,0x30,0x9b,0xd6,
+0x99,0x62,0xe5,0x91,0x30,0xa2,0x04,0x2f,0xcb,0x36,0x84,0x7d,
+0x8b,0x51,0xc3,0xb8,0xc3,0x00,0x4e,0xbe,0x6f,0x77,0x58,0x3a,
+0x5d,0xee,0x73,0xca,0x1e,0x53,0xb7,0x61,0x53,0xef,0x8e,0x78,
+0x18,0xc0,0xde,0x1b,0x06,0x1b,0x82,0x02,0x72,0xee,0x1c,0x3f,
+0x70,0xb8,0xb1,0x7f,0xa8,0xce,0xc6,0x0d,0x3f,0xac,0x43,0x14,
+0x9b,0x15,0x79,0xa7,0xcf,0x22,0x59,0x97,0xd5,0x08,0x23,0x6a,
+0x3d,0x9b,0xea,0x4f,0x84,0x16,0x9d,0x4c,0xb3,0xc9,0x70,0xf8,
+0xd7,0x12,0x8f,0x98,0x70,0x4a,0x6d,0x1b,0x49,0x4d,0x45,0x37,
+0x63,0xd6,0xf9,0xb5,0x82,0x7c,0xbc,0x37,0xed,0x50,0xbf,0x28,
+0x65,0xe4,0x2b,0x63,0x38,0x77,0x0c,0x9c,0xe2,0x0e,0xcf,0x54,
+0x4c,0xa6,0x42,0xac,0x95,0xb5,0x7c,0xc6,0xed,0x45,0x36,0xcd,
+0x76,0x36,0x49,0xf7,0x86,0x0a,0x64,0xc9,0x03,0x5e,0x16,0x50,
+0x99,0xb9,0x95,0x55,0xf2,0x98,0x59,0xab,0xc5,0x5e,0x1f,0x8d,
+0x43,0x2d,0x27,0x73,0x48,0x21,0x21,0x64,0x02,0x34,0x5a,0x4b,
+0x37,0x08,0x99,0x9b,0xd9,0x09,0x17,0xc2,0x80,0x9a,0x10,0x20,
+0x73,0x97,0x4c,0x29,0xbc,0xde,0xa9,0xc3,0x0e,0x17,0xce,0xed,
+0x95,0x86,0xe4,0x69,0xec,0x7b,0xfd,0x0f,0xe3,0x9f,0xf4,0x86,
+0x9a,0xa2,0x13,0x46,0x30,0xe5,0x0b,0x99,0xfe,0x35,0x47,0x65,
+0xa7,0xb3,0x44,0x78,0xba,0x26,0x5a,0x2f,0x0a,0xa9,0xb2,0x38,
+0xcd,0x12,0x12,0xe3,0xc9,0x96,0x9d,0xe1,0x3e,0x91,0x45,0x52,
+0xda,0x54,0x77,0x69,0x53,0x3b,0x99,0x1e,0xe0,0x0a,0xe4,0x88,
+0x15,0x08,0xf1,0xb3,0xb5,0xa3,0xbc,0x8d,0xe7,0xbd,0x4e,0xaf,
+0xdd,0x5b,0x36,0x23,0xb6,0x37,0x33,0x2d,0x81,0x47,0x5c,0x08,
+0xf8,0xdc,0x6f,0x4d,0xa2,0x59,0x42,0x4a,0x9b,0xd9,0x6e,0x87,
+0x65,0xc2,0xac,0x07,0x59,0xee,0x7b,0x1e,0x13,0x94,0x24,0x1b,
+0x6a,0xf9,0x9f,0xd6,0xb4,0xb7,0x47,0x12,0xa8,0xbe,0xc1,0x18,
+0xdd,0x5a,0xea,0x52,0xb6,0x3c,0xc4,0x71,0x7c,0xf0,0xae,0x28,
+0x92,0x1b,0xd1,0x60,0xd5,0x64,0x69,0xac,0x5a,0x9d,0x07,0x73,
+0x7d,0x54,0x97,0x8b,0x1f,0x19,0xc1,0xb6,0x66,0x44,0x55,0x99,
+0x11,0xc7,0x3d,0xfd,0xde,0x2a,0xbb,0x6b,0xb3,0xfa,0x2d,0x0e,
+0x11,0x06,0xc2,0x5a,0x6a,0x34,0xd0,0x32,0xf3,0xd1,0xb8,0x8d,
+0x63,0x24,0x90,0x60,0xf7,0x46,0xe2,0xe8,0xfe,0x56,0x86,0x23,
+0x7f,0xdc,0xd8,0x60,0xe1,0xce,0xea,0x7a,0x70,0x16,0x4e,0x5d,
+0x9d,0xcc,0x46,0x83,0x1c,0x69,0xd1,0x74,0x67,0x64,0x4e,0x79,
+0x04,0x46,0x61,0xc4,0xe0,0x99,0x88,0xca,0x48,0x9c,0x09,0x91,
+0xdb,0x36,0x86,0x99,0xc2,0xeb,0xe2,0xe0,0x3a,0x44,0x5b,0x16,
+0x26,0xf1,0x4f,0x10,0x3f,0x0a,0x25,0x41,0x87,0x6f,0xf5,0x78,
+0x43,0xf5,0xf2,0xfd,0x6a,0x6c,0x8a,0xc9,0x2c,0x21,0x2a,0xba,
+0xb8,0x8c,0x49,0x0a,0xf3,0x9f,0xc5,0xa9,0x55,0xe3,0x87,0xcb,
+0x58,0xf1,0x9d,0xc6,0x0a,0x2d,0xf8,0x63,0x90,0x44,0xc1,0x8c,
+0x12,0x80,0x1b,0x5b,0x04,0x26,0xce,0x37,0x1e,0x83,0xf9,0x6e,
+0xbf,0x2c,0x06,0x13,0x11,0x2a,0x54,0x7f,0x42,0xc8,0xa9,0xa8,
+0x91,0xde,0x79,0x4c,0xfb,0x75,0x62,0x2e,0x46,0x2c,0x0e,0xc6,
+0xb2,0xfe,0x9c,0x94,0x2d,0x3f,0x58,0x69,0xf5,0xe5,0xe7,0x29,
+0x4b,0x4f,0xe9,0xca,0xb3,0xf6,0x88,0x0b,0x0d,0x79,0x40,0xdb,
+0x05,0x86,0x5e,0x7e,0x59,0xd2,0x34,0x91,0xdc,0x13,0x35,0xfc,
+0x52,0xc7,0x4d,0xe7,0xa4,0xfc,0x5a,0x47,0xe3,0x31,0xb7,0x3a,
+0x18,0xaf,0xca,0x6f,0x71,0xe4,0x2b,0x7d,0x34,0x92,0xb4,0xd8,
+0x2f,0x5f,0x2c,0xcd,0x44,0xbf,0xec,0xc2,0x85,0x29,0x3f,0xa7,
+0x6b,0xda,0x5b,0x52,0x85,0xf2,0x73,0x58,0x20,0x3f,0x3c,0x03,
+0xdd,0xff,0xa4,0xe4,0xe7,0x89,0xb2,0x73,0xfa,0x15,0x65,0x47,
+0x5c,0xc2,0x79,0xac,0xf4,0x30,0xf6,0xfe,0xa3,0xe5,0xe7,0xc2,
+0x94,0x9f,0x32,0x25,0xe8,0xf0,0xe0,0x5d,0x99,0x14,0x3d,0x4a,
+0x09,0xfa,0x73,0x34,0xa0,0xa7,0xea,0x3c,0x4b,0x54,0x1c,0x19,
+0xd6,0xd8,0x29,0xd2,0x70,0xb4,0xf4,0x28,0x59,0x25,0xe7,0x47,
+0xfc,0x9b,0x87,0x73,0x2e,0x61,0xef,0x51,0x11,0x7b,0x59,0x57,
+0xfe,0x5b,0x54,0x31,0x6f,0x3e,0x6e,0x6c,0xe8,0x37,0x62,0xcd,
+0x28,0xd0,0x5f,0xf5,0x28,0x50,0x65,0xa1,0x92,0xdb,0x38,0x02,
+0x2e,0xd3,0x0a,0xde,0x5d,0x14,0x69,0x05,0xf8,0x16,0x7e,0x94,
+0xfc,0xc3,0x54,0x82,0xaf,0x71,0x0b,0xa7,0xb3,0xd5,0x81,0x9d,
+0x0e,0x38,0xf0,0x2d,0xbc,0xbb,0xb8,0x04,0x66,0xf4,0x79,0x17,
+0xc5,0xfe,0xdf,0x23,0x7c,0x63,0x29,0x65,0xd0,0x25,0x09,0x1c,
+0xe6,0x70,0xcb,0xea,0x88,0x07,0x76,0x1d,0xf1,0x9d,0xac,0x29,
+0x2b,0xfe,0x57,0x73,0x21,0xc9,0x05,0xb8,0x22,0xa1,0x27,0xed,
+0xa0,0x7a,0xa0,0xf0,0x45,0xec,0x4f,0x9c,0x78,0x01,0x87,0xfb,
+0xf9,0x78,0xe1,0x28,0x86,0x68,0xe2,0x53,0x4a,0x3c,0x34,0x7f,
+0x89,0x77,0x31,0x53,0xe3,0x73,0xc2,0x03,0x4d,0xa8,0xe4,0x14,
+0x33,0xcd,0x49,0x1c,0xdc,0x02,0x92,0x10,0xf0,0x08,0x66,0xcc,
+0x49,0x20,0x0a,0x45,0xea,0x26,0x57,0xb2,0xf6,0xf8,0x50,0x85,
+0xb8,0x41,0x42,0x28,0xbe,0xe8,0xaa,0x48,0x68,0xbc,0x52,0x06,
+0xcd,0x1e,0x74,0xc1,0x05,0x34,0x26,0x7f,0xb8,0x46,0x7f,0x39,
+0x8b,0x90,0xd9,0xf7,0xee,0x9c,0xd0,0x25,0x1e,0x7c,0xf0,0x3d,
+0x12,0xb1,0x08,0x8c,0x28,0xac,0x54,0x6a,0xd6,0xfa,0x6d,0xad,
+0x7e,0x87,0xd7,0x3f,0x93,0x75,0x12,0x5b,0xa5,0x1d,0xad,0x42,
+0xd7,0x0e,0xd0,0x86,0x9e,0xa0,0xad,0x07,0x3b,0xd0,0x83,0x5d,
+0xe8,0xc1,0x0b,0xf6,0x6d,0x1b,0x7a,0xaa,0x7a,0xb7,0xdb,0x56,
+0xd5,0xd1,0x6e,0xc9,0x7a,0xd0,0x60,0xa9,0xde,0x52,0x0e,0x69,
+0x36,0x4c,0x2f,0x62,0x7e,0xc3,0x09,0x71,0x42,0x34,0x1c,0xd1,
+0x31,0x9e,0x72,0x06,0x0b,0x15,0xd8,0x37,0x49,0x48,0x70,0x47,
+0x92,0x26,0x00,0xc3,0x6d,0x56,0xad,0x03,0x25,0x41,0x80,0x35,
+0x90,0xd1,0xe3,0x08,0x9d,0xc7,0x63,0x87,0xc2,0x90,0x38,0xc2,
+0xf0,0x49,0x67,0x31,0xe1,0xd1,0x42,0x72,0xd0,0x54,0x0c,0xd1,
+0x9e,0x25,0x10,0xbc,0xb3,0xd9,0x6d,0xf0,0x65,0x23,0xb1,0x05,
+0xe9,0x0b,0x23,0xb5,0xcd,0x68,0x9e,0xc6,0xef,0xb3,0xe5,0xd0,
+0x16,0xe9,0xcd,0x1e,0x79,0xd4,0x0d,0x37,0xd9,0x80,0x37,0x16,
+0xa4,0xcd,0x1e,0x4a,0x70,0x02,0x88,0xc9,0x34,0x70,0x5c,0x96,
+0x96,0x09,0x5c,0xb5,0xd6,0x25,0x84,0x26,0x76,0x3b,0xfa,0x35,
+0x71,0xc7,0xa1,0xef,0x3a,0x41,0x0a,0x9d,0xd8,0x83,0xc7,0xf1,
+0x9d,0x75,0xee,0x47,0xab,0x03,0x69,0x8e,0x9a,0xf8,0xc6,0xe8,
+0x76,0x77,0x3b,0x0b,0xfc,0x22,0x05,0xc6,0x48,0x01,0x69,0xa8,
+0x81,0x2a,0x8f,0xe1,0x3e,0x3c,0x3a,0x50,0x36,0x5f,0xb4,0x0f,
+0xa6,0xd7,0x94,0x5e,0xb1,0x09,0xc8,0xb1,0x15,0x4d,0xc2,0x2b,
+0x16,0x8e,0xf4,0xb8,0x69,0xa8,0x8f,0x62,0x25,0x01,0xdf,0x23,
+0x21,0x45,0x27,0x06,0xe3,0x98,0x44,0x81,0xa1,0xa1,0x7c,0x5e,
+0x3e,0x61,0x42,0x36,0x24,0x16,0x36,0x33,0x01,0x8e,0x29,0x24,
+0xe3,0x68,0x16,0x78,0xc2,0xd4,0x1e,0x85,0xd2,0xde,0xde,0x55,
+0x6f,0xb2,0xd6,0x61,0x30,0x13,0x11,0xac,0x40,0xf0,0x65,0x6e,
+0x2f,0x59,0xd3,0xb2,0xef,0x70,0xf0,0x4e,0xbb,0x9d,0x9d,0xe8,
+0xc8,0xa6,0x29,0xf4,0xe0,0xe2,0x0e,0xff,0xe3,0x4a,0x86,0xdd,
+0x8f,0x49,0x4c,0xb0,0x84,0xdb,0xf0,0x33,0xb2,0x8b,0xab,0xb2,
+0x62,0xd6,0x54,0xdd,0x71,0x10,0x0b,0x45,0xa5,0xd2,0x34,0x0a,
+0x3b,0xaa,0xb0,0xdb,0x4d,0x0b,0x91,0xec,0x8b,0x3b,0xf0,0x13,
+0x19,0x37,0x3b,0xb9,0x77,0x62,0x22,0x63,0x5f,0xa1,0x3a,0x8c,
+0xc4,0xeb,0x7b,0x5c,0x85,0x85,0x7b,0x27,0x51,0x89,0x99,0x82,
+0x74,0x62,0xc2,0x8f,0x6f,0x63,0x42,0x76,0x77,0x60,0x8a,0x9e,
+0x54,0x08,0x67,0x93,0x01,0x89,0xeb,0x90,0x50,0x87,0xbd,0x54,
+0xcd,0x17,0x9d,0x17,0xdb,0x35,0x64,0x63,0x08,0x0e,0x93,0x17,
+0xd6,0x0f,0xc1,0xe4,0xd0,0x09,0xea,0xd8,0x6f,0x3f,0xf4,0x70,
+0x08,0x45,0x4f,0x2f,0xcf,0x4f,0xc1,0x75,0x62,0x1a,0xfb,0xde,
+0x08,0x47,0x70,0xe4,0x27,0x34,0x66,0x03,0x2c,0x5a,0x60,0xe4,
+0x4b,0x27,0x98,0x13,0xdc,0x3b,0x0b,0xee,0x5d,0x62,0x9d,0x3b,
+0x8d,0x62,0x02,0xf8,0xe4,0x60,0x3c,0x61,0x75,0xc4,0x14,0xe7,
+0xea,0x3b,0x4e,0x8b,0x69,0x1c,0xb9,0x4d,0x17,0x1a,0x3c,0x5b,
+0x47,0xb7,0xdd,0xe9,0xd6,0x59,0xe4,0xd6,0x24,0x53,0x51,0xb0,
+0xea,0xce,0x9f,0x48,0xc3,0x76,0xc2,0x3b,0xf4,0xb7,0x9b,0x9b,
+0xd7,0x6d,0x17,0xa2,0x98,0xfd,0xd5,0x71,0xc1,0x19,0xe2,0xb4,
+0xcc,0x88,0xa6,0x92,0xbc,0xea,0xeb,0x5a,0x51,0xa2,0x51,0x3e,
+0x29,0x96,0x47,0xdb,0x69,0xfe,0xdf,0xf6,0x2d,0xcb,0xed,0xa3,
+0x02,0xe2,0x4a,0x3c,0x1e,0x6a,0x23,0xf5,0x93,0x6a,0x85,0x87,
+0x57,0xa7,0x86,0x6d,0x99,0xd8,0x1e,0xcb,0x30,0x68,0xb2,0x31,
+0x0b,0x7d,0x9c,0x37,0x05,0x20,0x3c,0x0f,0x57,0x45,0xcb,0xaa,
+0x9d,0x37,0x68,0xf7,0xba,0xae,0xb4,0xcd,0x66,0xbd,0x0a,0x88,
+0x82,0x1d,0x9d,0x4a,0x31,0xec,0xa4,0xf5,0x97,0x78,0x26,0x5e,
+0xe9,0x9e,0x09,0xd6,0x35,0x3e,0x13,0xb1,0x27,0xf2,0xb3,0x70,
+0x4e,0x40,0x32,0xf5,0x69,0xfa,0xaa,0x59,0xab,0x05,0xd1,0x8c,
+0x82,0xc3,0xc3,0x23,0xff,0xd8,0x7c,0xde,0x06,0xca,0xed,0x68,
+0xaf,0xc5,0xd3,0x97,0x36,0xb6,0x15,0x13,0xfd,0xaa,0xdd,0xeb,
+0x3e,0xdf,0xe9,0xb5,0x4b,0xbb,0x6e,0x32,0xb8,0x04,0xd9,0xee,
+0x76,0xef,0xc5,0x76,0xaf,0xfd,0x38,0x3e,0x8a,0xb0,0x1b,0xb1,
+0xa7,0x11,0x0f,0x06,0x0b,0x60,0x40,0x20,0x13,0x6a,0xa6,0x80,
+0xc6,0x77,0x76,0x0e,0x26,0x89,0xb6,0x9f,0x36,0x73,0x84,0xa5,
+0x62,0xb7,0x01,0x95,0x52,0xba,0x96,0x8b,0xc8,0xab,0xdd,0xcd,
+0xde,0x56,0xbb,0xdd,0xde,0xec,0xb5,0xcd,0x91,0xce,0x68,0xf6,
+0x2c,0x44,0x95,0x5b,0x39,0xb3,0x6a,0x3d,0x30,0xf5,0x3d,0x7b,
+0xcf,0x5a,0x68,0xf9,0x35,0xa8,0x7e,0x28,0x52,0xe9,0x71,0xb2,
+0xff,0xa9,0x2a,0xfd,0xa2,0x50,0xa5,0x7f,0x72,0x4e,0x81,0xce,
+0xd6,0x36,0x26,0xaa,0x27,0xf0,0x2d,0x7c,0x40,0x95,0x1e,0x3e,
+0x90,0x98,0xb2,0xed,0x7d,0xb9,0x36,0x5f,0x60,0x16,0xff,0xf0,
+0xe7,0x6b,0xf3,0x7f,0x52,0x66,0x05,0x16,0xe0,0x3c,0xc4,0x0f,
+0xa0,0x9f,0x6b,0x70,0xda,0xe7,0xd9,0x52,0x70,0x27,0x5f,0x1c,
+0x0a,0xc5,0xc5,0xfc,0x77,0x1f,0x0a,0x2e,0xe6,0xbf,0x53,0x5c,
+0x5a,0x6d,0x41,0x4e,0x19,0xc1,0x7e,0x6a,0x69,0x62,0xd3,0x4b,
+0xf7,0x3a,0x4c,0xe7,0x56,0x9d,0xb6,0x4d,0xd1,0x49,0x2f,0xf5,
+0x7f,0x11,0xe3,0x72,0xa7,0x4c,0xfd,0xda,0xff,0x57,0x3a,0x5e,
+0x4d,0x60,0x0c,0x2c,0xd8,0x9c,0x3d,0x93,0x52,0xbd,0x3a,0xad,
+0xd9,0x94,0x65,0x15,0x04,0xb1,0xcf,0x78,0x28,0x80,0xf7,0x4f,
+0x6b,0xb6,0x9b,0x96,0xc2,0x0a,0xce,0x61,0x8e,0x2f,0x4f,0x73,
+0xc1,0x22,0xf2,0xbe,0x45,0xe8,0xb5,0xd0,0x65,0xc1,0xee,0x1d,
+0x5e,0x5d,0xe6,0x5b,0xe6,0x0a,0xd1,0xfe,0x8c,0x46,0xb8,0x93,
+0xbb,0x70,0x46,0xee,0xd9,0x5e,0x5f,0x3d,0x39,0x3b,0x35,0x6e,
+0xd2,0x4f,0x60,0xcc,0xab,0xa2,0x62,0x72,0x11,0xfb,0x77,0x0e,
+0x25,0xbc,0x7d,0xec,0x19,0xbf,0x0b,0x7c,0x6d,0xbd,0x2d,0xba,
+0x9f,0x3e,0x68,0x26,0xbd,0x12,0xea,0xc9,0xf6,0x83,0xef,0xed,
+0xcc,0x38,0x24,0x89,0x3f,0x0a,0xb1,0x89,0xf7,0x57,0xfb,0x57,
+0x07,0xc7,0xc7,0x4c,0xed,0x30,0xf5,0x7a,0xf8,0xae,0xdd,0xf8,
+0x6e,0x53,0x56,0x46,0x6c,0xfb,0x67,0xa7,0x35,0xee,0x34,0x4f,
+0x08,0xe5,0x6a,0x24,0xd3,0xb5,0x6d,0xe9,0x03,0x3a,0x9b,0x5d,
+0xe0,0x0f,0xf8,0x0b,0x2e,0x22,0x35,0xe7,0x27,0x76,0x76,0x5f,
+0x4d,0xa2,0x88,0x8e,0xa1,0x7a,0x15,0x44,0xf7,0x35,0xe0,0x29,
+0x94,0x78,0x9f,0x0f,0x72,0x35,0x64,0xf4,0x0c,0x8f,0xdb,0xe5,
+0xa7,0x4f,0x0e,0x7a,0x76,0x6a,0x8d,0x1f,0x3a,0x67,0xca,0x62,
+0x4a,0xc5,0xf9,0xa9,0xf5,0x4e,0xec,0x0f,0xb1,0x33,0x15,0x5b,
+0xb1,0x02,0xdd,0xff,0xe1,0xb4,0x66,0x3b,0x3a,0xe1,0x78,0x36,
+0x62,0x32,0x25,0x0e,0x4d,0x79,0xbd,0x9f,0x1b,0xfe,0x17,0x4a,
+0x48,0xe0,0x14,0xdd,0xc9,0xf0,0x23,0x3c,0x83,0x9f,0x20,0x0a,
+0x51,0x47,0xa7,0x51,0x08,0x2c,0xc7,0x7c,0x13,0xe0,0x8a,0x10,
+0x79,0x2b,0x42,0xd3,0xf9,0xa3,0x50,0x54,0xbb,0x8e,0x1d,0xf7,
+0x93,0x7e,0x38,0x57,0xb7,0x49,0x18,0xfe,0x31,0xcb,0x42,0x15,
+0x05,0x03,0x27,0x86,0x2a,0xee,0xef,0x45,0xd2,0x8a,0xba,0x30,
+0xbf,0x26,0x8c,0x1a,0xb1,0x90,0x95,0xaa,0x43,0xe9,0x4e,0xa7,
+0x9d,0xab,0xb3,0x9b,0x1e,0x31,0x51,0x38,0x26,0x30,0x24,0xc4,
+0x63,0x1d,0xbd,0x78,0xfb,0x36,0x07,0x2d,0xbb,0x4a,0x79,0xc0,
+0x01,0x3f,0x7a,0x50,0xa0,0x11,0x0c,0x67,0x41,0x20,0x73,0xa7,
+0xb2,0xda,0x47,0x3f,0x16,0x44,0x44,0xb1,0x8e,0x48,0xaa,0x0e,
+0x8f,0x0e,0xae,0x0f,0x8e,0x4e,0x8b,0x6e,0xe2,0x22,0x28,0x37,
+0x26,0x17,0xf5,0x5a,0xde,0x5b,0x3d,0x0a,0x31,0xfa,0x07,0x86,
+0x51,0x48,0x1b,0xec,0xc5,0x3a,0xec,0xbb,0x5c,0x49,0x93,0x82,
+0xaa,0xbb,0xa2,0x2a,0x25,0x31,0x5c,0x93,0x4f,0x34,0x8e,0x42,
+0x7f,0x9e,0xca,0xc5,0xf5,0xd1,0xf7,0x05,0x77,0x49,0xf7,0xf1,
+0xb6,0x0d,0xec,0xb6,0xe5,0x14,0x38,0xcd,0x4d,0x0f,0x79,0x85,
+0x14,0x75,0xfc,0x2a,0x86,0xbc,0xfa,0x73,0xa8,0x26,0x84,0xe7,
+0xd5,0x25,0xe9,0xa5,0xc3,0x9a,0xfd,0x22,0xa9,0xe8,0x0e,0x3f,
+0x97,0xc3,0xa5,0x76,0x2a,0x3f,0x30,0x67,0x2f,0xd2,0x79,0xa6,
+0xa4,0xe9,0xf2,0x20,0x3f,0xf3,0xf8,0xdc,0xbb,0x9e,0xc5,0x21,
+0x9c,0x87,0x70,0xea,0xc4,0x38,0x4d,0x30,0xa7,0xbd,0xfd,0xa6,
+0xa8,0x98,0x72,0x8d,0x7b,0x73,0xa2,0x14,0xdc,0x10,0x65,0xb2,
+0x76,0x12,0x8d,0x46,0xfc,0xe8,0xca,0x9e,0x40,0xf7,0x13,0x91,
+0x81,0x2a,0x58,0xa8,0xcb,0x54,0xa8,0x21,0x3a,0xe9,0x69,0x99,
+0x85,0x67,0x35,0x50,0x0d,0x06,0x9e,0x50,0xcb,0x7e,0x9d,0xf4,
+0x3d,0x4b,0x49,0x40,0x49,0xcc,0xd6,0xb0,0x2b,0x2e,0x5d,0x6f,
+0x44,0x66,0x5e,0xa8,0xb2,0xd6,0x26,0xce,0x02,0x06,0x04,0x1b,
+0x52,0x5c,0x50,0x2d,0xb2,0x03,0x92,0x4f,0xc9,0x71,0x38,0xf6,
+0x07,0x3e,0x2d,0x62,0xfa,0x8e,0xe8,0x8d,0xbe,0xc4,0x7e,0x62,
+0x8f,0x46,0x72,0xf6,0x7e,0x9f,0x5f,0x71,0x38,0x7d,0x98,0x34,
+0x88,0xbd,0x46,0x8a,0xe0,0x90,0xb0,0xe3,0xbe,0x7a,0x9d,0x98,
+0xd5,0x7d,0xf3,0x7d,0x7e,0x53,0x69,0x6b,0xf7,0xc3,0xca,0xd7,
+0x0c,0x5c,0x84,0x53,0x43,0x5f,0x40,0xd0,0xc4,0x63,0x2c,0x23,
+0x2b,0xad,0x1e,0xf2,0xa6,0x21,0x72,0xf3,0x9d,0x1f,0xf8,0x94,
+0xac,0x50,0xa5,0xab,0xaa,0x1c,0x90,0x20,0x80,0xd3,0x68,0xc5,
+0xa6,0x36,0xb5,0x81,0x7b,0x44,0xb5,0xad,0x94,0x1f,0x6f,0xf1,
+0x8d,0x85,0xe3,0xb0,0xc5,0xfe,0x3d,0x9f,0xf1,0x57,0xf8,0x69,
+0x62,0xab,0x65,0x4c,0xfd,0x23,0x66,0x06,0x21,0x92,0xa1,0x79,
+0xa1,0xe5,0x77,0x2e,0x05,0xe7,0xf9,0xe6,0x43,0x23,0x18,0x30,
+0x2f,0x15,0x44,0x21,0x50,0xba,0x80,0x68,0x46,0xa7,0x33,0x5a,
+0xb0,0xbe,0xb6,0x79,0xd8,0x67,0x41,0x75,0x14,0x01,0x3e,0x6a,
+0x45,0xb5,0x37,0x95,0xda,0x41,0x49,0x3c,0x8d,0x09,0x85,0xf5,
+0x09,0xa1,0xce,0x3a,0x7f,0x5f,0x84,0x4d,0x67,0x82,0x37,0x82,
+0xc7,0x30,0xf0,0xd3,0x74,0x1d,0x55,0xc2,0xfa,0xc7,0x2d,0x15,
+0xac,0xfc,0x8d,0x4f,0x8f,0xc3,0xe9,0xac,0x50,0x9e,0x79,0x5b,
+0x06,0x73,0x58,0xe8,0xad,0x13,0xe0,0x3e,0xee,0x0f,0x7d,0x12,
+0x27,0x4c,0x13,0xd8,0x0f,0x28,0xdb,0xe7,0xcf,0x66,0x13,0x35,
+0x79,0x4e,0x22,0xf7,0x13,0xb7,0x13,0xca,0x19,0xa6,0xb7,0x1f,
+0xce,0x26,0x0c,0xa0,0xb4,0xe5,0x9d,0x74,0x30,0x31,0xf7,0x1d,
+0x33,0x2f,0x85,0x70,0x4a,0xa8,0x23,0xdb,0x4f,0xc0,0xc1,0x36,
+0x64,0x13,0x12,0x87,0xde,0x12,0x72,0x06,0x51,0x24,0x47,0xec,
+0x1d,0xb1,0xf2,0x16,0x9f,0xa7,0x2d,0x1e,0x1e,0x9d,0x08,0x7b,
+0x39,0xb2,0x0b,0x03,0xb2,0xc2,0x51,0x43,0xcc,0x66,0xee,0x75,
+0x94,0xf5,0x91,0x00,0x0b,0xae,0x17,0x19,0xea,0x19,0xf1,0xc8,
+0xa9,0xd5,0x69,0x77,0x02,0xba,0x22,0xe9,0x72,0x43,0xf9,0x9e,
+0x90,0x29,0xf0,0xd7,0x6d,0x70,0xc2,0xa0,0xc8,0x8b,0xb0,0x54,
+0x18,0xfb,0xa3,0x71,0x80,0xc3,0xae,0x5d,0x08,0xce,0x0f,0xcc,
+0x27,0x42,0xa6,0x57,0xaa,0x7e,0x69,0x8b,0xe9,0x6a,0x80,0x15,
+0x0f,0x4e,0x8e,0x2f,0xde,0x9c,0xef,0x5f,0x1e,0xa6,0xcd,0x67,
+0x47,0x3e,0xb5,0x2c,0x12,0x01,0x74,0x1d,0x1d,0x04,0xfe,0x54,
+0xc6,0xf7,0x96,0xb4,0x65,0xec,0x66,0xef,0xe3,0x11,0x09,0xdd,
+0x05,0xdc,0xfb,0xa1,0x17,0xdd,0xc3,0xc4,0x09,0x9d,0x11,0x89,
+0x61,0xec,0x87,0x94,0x71,0x59,0xd6,0x3f,0x88,0x42,0x1a,0x47,
+0x41,0xe3,0x3b,0xf0,0x13,0x10,0x7a,0xb7,0x67,0x15,0x47,0x7c,
+0x6a,0xe6,0x38,0x61,0x78,0xa9,0xe6,0x11,0x29,0xa6,0x67,0x53,
+0xa7,0x27,0x76,0x7c,0xbc,0x47,0x2a,0xef,0xdd,0x0b,0xb2,0xd8,
+0x78,0x2b,0x12,0x24,0x8e,0x0c,0x25,0x3a,0x11,0xea,0x91,0x98,
+0xf2,0xa6,0x1f,0xbb,0xa5,0x49,0x14,0xfa,0x16,0xba,0xe2,0x86,
+0xc6,0x1b,0xe4,0xda,0x0d,0xa6,0xf6,0x92,0x91,0xac,0x4e,0xc2,
+0x72,0x77,0xa1,0x16,0xfd,0x35,0xf7,0x4f,0xde,0xdc,0x8b,0xb2,
+0xe6,0xb8,0xb1,0x4c,0xef,0xbb,0xc4,0x60,0xb0,0xa0,0x0e,0x6e,
+0x40,0x1c,0x7c,0x6e,0x0a,0x7c,0xca,0xb3,0x2b,0x58,0x08,0x95,
+0xf4,0xe9,0x72,0x69,0x27,0x53,0x68,0x24,0x6e,0x34,0x19,0xb0,
+0x88,0x13,0x84,0x24,0xc3,0x21,0x71,0xa9,0xca,0xb6,0xd0,0x91,
+0x58,0xc4,0x18,0x21,0xa1,0x8a,0x7f,0x78,0xec,0x49,0x9a,0x20,
+0x26,0x8b,0x2f,0xcc,0xb1,0xdc,0xe6,0x3a,0x8c,0x1a,0xe8,0xa4,
+0x56,0x1b,0xb4,0xf6,0xe2,0x74,0x02,0xb1,0xc3,0x32,0xe4,0xd0,
+0xb1,0xc3,0xad,0xff,0x0c,0xf5,0xc4,0xba,0x25,0x6d,0x6b,0x97,
+0xc5,0x25,0xe6,0x16,0xfe,0xe1,0x3a,0x53,0xa5,0xc1,0xe2,0x0a,
+0x56,0x58,0x3f,0x4d,0x24,0x70,0x35,0x0b,0x57,0xab,0x92,0x26,
+0x12,0x78,0x77,0xb1,0x5a,0x8d,0x34,0x8b,0xc0,0xd5,0xc1,0xf9,
+0x2a,0x55,0x76,0xb4,0x7e,0x05,0x64,0xe4,0xb8,0x0b,0x15,0xd7,
+0x0b,0x64,0x32,0x0b,0x1c,0x7e,0xbf,0xe3,0xc7,0x4e,0xe7,0x72,
+0xa7,0x66,0xab,0x9e,0x76,0x8b,0x7b,0x3e,0xf2,0xb5,0xf3,0xc7,
+0x70,0x23,0x6f,0x01,0xea,0x1b,0x84,0x12,0x0f,0xa6,0x4e,0x42,
+0x49,0x4a,0x26,0xaa,0x06,0xd2,0x11,0x37,0xa6,0x74,0xba,0xd7,
+0x6a,0xdd,0x51,0x74,0x96,0x84,0x84,0xb6,0xbc,0xc8,0x4d,0x5a,
+0x77,0xb4,0xdb,0x6d,0x37,0xb8,0xf9,0x7e,0x4a,0x49,0xbc,0xd5,
+0x1c,0xd3,0x49,0x50,0xf0,0x70,0xc0,0x29,0x7b,0x67,0xb1,0xd8,
+0x6c,0x83,0x70,0xd1,0x50,0xd8,0x45,0xb8,0x35,0x39,0x1a,0x7c,
+0x24,0x2e,0x55,0x26,0xe5,0xe2,0xcb,0xe5,0x66,0x4e,0xef,0x92,
+0x0b,0xdf,0xe9,0xeb,0x33,0x48,0x8e,0xba,0xbb,0x75,0xab,0x8c,
+0x9e,0xb6,0x4b,0xed,0xab,0xdd,0x5c,0xc8,0xc4,0xc8,0x6f,0xed,
+0x99,0x81,0xf0,0x3c,0x22,0x50,0x30,0x41,0xe6,0xa3,0x2d,0x8c,
+0xfb,0x6e,0xeb,0xd1,0xd8,0xf2,0xa9,0xa5,0x3b,0x12,0xd3,0xa3,
+0x28,0x28,0xab,0xbf,0xfa,0xcd,0x81,0x52,0xe2,0x3b,0x19,0xe2,
+0xb5,0x49,0x2b,0x8e,0xa4,0x2b,0xf4,0x61,0x2f,0x7b,0x13,0x40,
+0x3d,0x81,0x88,0x59,0x80,0xd3,0xd4,0xc1,0xfc,0x5b,0xd2,0x7c,
+0x7f,0x55,0xeb,0x15,0x57,0xe9,0x3c,0xbe,0x4a,0xf7,0xf1,0x55,
+0x36,0x97,0x56,0x61,0x0e,0x0c,0xdd,0xde,0x03,0xe8,0x14,0x2c,
+0xe1,0xc3,0xe6,0x1e,0xd6,0xc1,0xe3,0xaf,0x1b,0x31,0xcd,0x92,
+0x64,0x9a,0xc7,0x34,0x7d,0x07,0xfc,0xe1,0x23,0xe3,0x5d,0x2a,
+0x0d,0x86,0x3f,0xc3,0x52,0xed,0x6c,0x76,0xb5,0xf4,0xc9,0xab,
+0xde,0x70,0x61,0x15,0xb8,0x93,0x70,0x45,0xf1,0x7b,0x9e,0xa9,
+0x9c,0x1e,0x72,0x57,0x44,0xd0,0xe9,0xee,0xe5,0x6e,0x0b,0x88,
+0x04,0xb2,0x68,0x70,0x59,0x01,0xc3,0x4e,0xb6,0x03,0x41,0x34,
+0xaa,0x56,0xae,0x48,0x8c,0xea,0x39,0xbb,0x6a,0x21,0x3c,0xcf,
+0xc4,0xd3,0xb7,0x14,0x71,0x20,0x6d,0x56,0xb2,0x83,0xac,0xc1,
+0x7c,0xcf,0x40,0x56,0xa0,0xe1,0x05,0x1b,0xb9,0x1f,0x3b,0x6d,
+0x7e,0x56,0xca,0xdc,0x8f,0x10,0x27,0xcd,0x3a,0xfe,0x3d,0x61,
+0x07,0x38,0xf6,0xe7,0xfd,0x98,0x90,0x40,0x7c,0x14,0x87,0x88,
+0xa6,0xc1,0x9a,0x76,0xbb,0xcd,0xf0,0xde,0xd1,0x2e,0x93,0xa0,
+0x3c,0x66,0x8e,0xad,0x99,0xfb,0x2a,0xd0,0xd5,0xe5,0xbd,0x1d,
+0x97,0x6b,0x5f,0xd2,0x75,0xce,0x5a,0xce,0xb6,0xd5,0x65,0x6d,
+0x89,0xd3,0x32,0x3b,0x22,0x1a,0x4d,0x4a,0x30,0x2e,0xa4,0x4e,
+0xb8,0xb0,0xc0,0x80,0x59,0xd4,0x10,0x27,0x78,0x4e,0x25,0xff,
+0x98,0xd4,0x75,0x58,0xa9,0x96,0xe3,0xde,0x4e,0xb8,0x9d,0x43,
+0x52,0x30,0x26,0x81,0x07,0xf8,0xe8,0x6b,0xd3,0x1c,0x9e,0x79,
+0xa7,0xcd,0x78,0xac,0x56,0x77,0xb6,0x5c,0xbd,0xc8,0x0c,0x22,
+0x63,0x99,0x05,0x0e,0x79,0x9a,0x01,0xe5,0xa6,0x95,0x0c,0xec,
+0x2b,0x1b,0x24,0xeb,0xea,0x11,0xeb,0x45,0x4e,0x26,0x2c,0x4f,
+0x2b,0xba,0x72,0xfd,0xab,0x08,0xef,0x45,0xa5,0x67,0x11,0xd4,
+0x37,0xe8,0x39,0x0f,0x47,0x40,0x23,0xce,0x4a,0x79,0x3a,0x5f,
+0x72,0x61,0xa9,0xdd,0xde,0xda,0xe3,0x2b,0x4c,0xe8,0x01,0x7b,
+0x45,0xd1,0x0f,0x5b,0xec,0xdf,0x48,0x9d,0xf0,0x75,0x4e,0x0b,
+0x90,0x3d,0x74,0x78,0x1f,0xe7,0x0a,0xa2,0x19,0x65,0x25,0xe7,
+0xf9,0x2b,0x59,0xcc,0x6a,0xb0,0xca,0x44,0x6e,0xb7,0xb7,0x19,
+0x45,0x33,0x3a,0xdc,0x05,0x32,0xa7,0x7c,0xc9,0x33,0xc5,0x83,
+0x61,0x9d,0xd1,0xa1,0xe4,0xb6,0x89,0x94,0x51,0x13,0xc3,0xbd,
+0xef,0xa5,0x6e,0x78,0xa3,0x13,0x89,0x3f,0xc1,0xf8,0x0d,0x12,
+0xf2,0xcc,0x61,0x81,0x13,0x8f,0x08,0xdc,0x39,0xc1,0x8c,0x24,
+0xe0,0x24,0xbc,0xe5,0x34,0x6c,0xa6,0x9c,0xd8,0x1d,0xce,0xbe,
+0x51,0x5c,0x4a,0x6b,0x32,0x8a,0x9f,0x48,0x2b,0x7b,0xfd,0x2f,
+0x8c,0x28,0x38,0x9e,0x07,0x9b,0x5d,0x66,0xd2,0xf5,0x49,0xe0,
+0x19,0x40,0xcc,0xbc,0xc1,0x38,0xff,0x72,0xd0,0x9b,0xf7,0x16,
+0xa7,0x7a,0xa1,0x58,0x36,0xb4,0xe2,0x49,0x69,0x97,0x3a,0x82,
+0xff,0x68,0x2c,0x29,0x1f,0x00,0x84,0x78,0x62,0xb7,0x78,0xf8,
+0x06,0xb7,0x76,0x94,0xf5,0x27,0xdf,0x1d,0xbe,0x0a,0xa4,0x85,
+0xd7,0xe5,0x17,0xe7,0xd8,0xe8,0xa0,0xb9,0x9a,0x4f,0x23,0xb3,
+0x07,0xfc,0xdb,0x3b,0x9e,0x7b,0xb2,0x9f,0xbe,0x47,0x5b,0xcc,
+0x9c,0x2d,0xbe,0x44,0x3b,0x01,0x35,0x1f,0x24,0xcb,0xa2,0x6f,
+0xb5,0xd4,0x56,0xab,0x3f,0x47,0xcb,0xff,0xc7,0x22,0x62,0xdf,
+0xee,0x9f,0x9c,0x34,0xae,0xdf,0x5d,0x9e,0xbf,0xff,0xee,0x9d,
+0xa1,0xc6,0x3d,0xb7,0xb7,0x90,0xa1,0xa3,0x1c,0x4a,0x57,0x21,
+0xf9,0xc2,0x64,0x3e,0x0a,0xce,0x1e,0x68,0x61,0xdf,0xa1,0x6f,
+0x14,0xf0,0xe7,0x67,0x92,0x3d,0x2d,0x00,0xb7,0x6e,0x14,0xb3,
+0x00,0xe0,0x3d,0xfd,0x85,0x0b,0xb3,0xd8,0xf3,0x93,0xa9,0x2c,
+0xc6,0xbf,0xcd,0xe2,0xb9,0x28,0x9a,0x67,0x6a,0xc9,0x1a,0xe6,
+0x67,0xf5,0x0a,0xc5,0x5e,0xe6,0xa9,0x10,0x1b,0x18,0x8f,0x6a,
+0xdf,0xcb,0x5f,0x16,0x30,0x81,0xa9,0x33,0x90,0xbd,0xc3,0x3f,
+0x8d,0x32,0xdc,0x7b,0x7f,0xfc,0x91,0xa5,0x31,0x96,0xcf,0x59,
+0x63,0x74,0x36,0x6e,0x2a,0xaf,0xb3,0x80,0xa2,0x7c,0xcf,0x78,
+0x06,0xbb,0x9e,0x85,0xe2,0xef,0x66,0xef,0xe9,0x0f,0x7b,0xd7,
+0x0b,0x30,0x25,0x26,0x2a,0x9d,0xb2,0x87,0x9e,0xf6,0x43,0xaa,
+0x67,0x84,0x56,0x6b,0xb9,0xef,0x6a,0x4c,0xe5,0x53,0x13,0x99,
+0xf2,0xec,0xf3,0xc8,0x7a,0xd6,0x87,0xe2,0x5b,0x94,0xca,0xd1,
+0x1b,0x80,0x78,0xb7,0x83,0xbb,0x62,0x2e,0xbf,0x82,0xab,0x57,
+0xb8,0x50,0xbe,0x9a,0xaf,0x57,0xe4,0xc2,0xc5,0x98,0x11,0xee,
+0x31,0xcb,0x7b,0x7a,0x83,0x02,0x4f,0x2f,0xef,0x1a,0x7a,0x07,
+0x2e,0xaf,0xec,0xbe,0x5e,0x81,0xfc,0xf1,0x6e,0x5e,0x0c,0xa9,
+0xe4,0xeb,0xa8,0x74,0xe4,0xda,0x9c,0xb6,0xbb,0xed,0xd5,0x7d,
+0xb6,0xff,0x36,0x9b,0x4c,0xa1,0xfa,0xd6,0x49,0xe8,0x6a,0x1e,
+0x5b,0x41,0xfa,0x0a,0x0e,0x5b,0xb3,0x93,0xcb,0xfc,0xb6,0x67,
+0xd1,0xa3,0x5c,0xb7,0x67,0xd1,0xe3,0xbc,0xb7,0x87,0x51,0x58,
+0xa1,0x5c,0x3b,0x29,0xf3,0xe1,0x5a,0x3d,0xb3,0xef,0xd8,0xee,
+0xb3,0x92,0x67,0x36,0x9a,0x3e,0xd2,0x31,0xcb,0xe9,0x9a,0x3e,
+0xca,0x3d,0x7b,0xe2,0x4f,0x7c,0x59,0x87,0x46,0x62,0xd9,0xc2,
+0x16,0x31,0xb0,0x31,0x5a,0xe6,0x9e,0x65,0xbd,0x59,0xcd,0x3d,
+0x2b,0x98,0xb6,0xba,0x93,0xf6,0xd0,0x4f,0x1e,0xed,0xa5,0x95,
+0x16,0x72,0xac,0xbb,0xb2,0xd7,0xf5,0x2c,0x7a,0xaa,0xe3,0x55,
+0x92,0xb8,0x9a,0xe7,0x55,0x99,0x4c,0xcf,0x96,0x79,0x5e,0x87,
+0xc3,0xe5,0xae,0xd7,0xb3,0xe8,0xb1,0xde,0xd7,0x68,0xaa,0x39,
+0x5f,0xab,0x4f,0xf6,0xbe,0xd6,0x8a,0xdd,0xaf,0x62,0x96,0x9a,
+0x86,0x6a,0xab,0xf7,0xf4,0x6c,0xc6,0xae,0xef,0x3f,0xdd,0x73,
+0xca,0x2f,0x75,0xad,0xe0,0x36,0x5d,0x6d,0xb2,0x7e,0x5d,0xe7,
+0x29,0x6f,0x73,0xf6,0x78,0x17,0x6a,0x5a,0xf1,0x29,0x8e,0xd4,
+0xb4,0xf6,0x13,0xdc,0xa9,0x1a,0x9f,0x1e,0xed,0x54,0x95,0xf3,
+0xe0,0x51,0x5e,0x55,0xd1,0x60,0xa9,0x6f,0x55,0x56,0x5e,0xe6,
+0x62,0x2d,0xc6,0xb5,0xba,0xa3,0x95,0xe3,0xf0,0x2d,0xee,0x56,
+0x35,0x5d,0xc4,0x14,0x31,0x7c,0x5c,0x8f,0x76,0xb2,0x4a,0x66,
+0x7d,0x89,0x97,0x55,0x12,0xf2,0x58,0x37,0xab,0x36,0xc8,0xa9,
+0xbb,0xd2,0xe6,0x6b,0x35,0x7d,0x87,0x46,0x73,0x4f,0xf5,0xb5,
+0x72,0xbb,0xfc,0x25,0x7b,0x71,0xba,0xc8,0xe9,0x2a,0x31,0x88,
+0x1b,0x9f,0xa5,0x4e,0x57,0x6b,0x5f,0x2c,0xae,0xd7,0x92,0xae,
+0x3c,0xde,0xf5,0x7a,0xc8,0xef,0x02,0x7d,0x32,0x3d,0xb0,0xac,
+0xe9,0x72,0xf7,0xab,0xd1,0xee,0x93,0xfd,0xaf,0x17,0x97,0xc7,
+0xa7,0xfb,0x97,0x3f,0x59,0xbc,0xaf,0x36,0xd1,0x7c,0x92,0xfb,
+0x55,0x8a,0xe7,0xd7,0xf1,0xbf,0x1a,0xdd,0x7e,0xa2,0x03,0x56,
+0x52,0xb4,0x82,0x07,0x56,0xe2,0x58,0x81,0x98,0x47,0x3b,0x62,
+0x6d,0x9b,0x9b,0xe6,0x82,0x14,0x4f,0x9e,0x0b,0x0c,0xcc,0x1b,
+0x09,0xfe,0x10,0x7c,0x6e,0x95,0xcc,0x7a,0x71,0xbf,0xc8,0x51,
+0x59,0xe8,0xbe,0xbd,0x24,0x09,0x8d,0xe2,0xbc,0x4b,0xf5,0xf2,
+0xe0,0x6b,0xbb,0x8b,0x5f,0x94,0xb2,0x85,0xad,0x60,0xb1,0x41,
+0x8c,0xc4,0x51,0x4c,0x53,0x19,0x31,0x79,0x69,0x59,0xc5,0x59,
+0x9b,0xf1,0xd2,0x4a,0x24,0x2b,0x3b,0x6b,0x6d,0x5e,0xda,0x74,
+0x74,0x56,0x77,0xd6,0xf2,0x33,0xdc,0x97,0xb8,0x6b,0x39,0x86,
+0x47,0x3a,0x6c,0x79,0xa5,0xc7,0xb9,0x6c,0x45,0x43,0x8f,0x73,
+0xda,0xf2,0x4a,0x5f,0xe0,0xb6,0xe5,0x08,0x2c,0x35,0x69,0x84,
+0x9d,0x6e,0x5d,0x1c,0x00,0x37,0x3b,0x17,0xba,0x70,0x39,0x06,
+0xbb,0x13,0xb7,0xe8,0x21,0xcf,0x7f,0x26,0x57,0xac,0x22,0xe8,
+0x3f,0xcc,0x19,0xbb,0xd4,0xce,0xb8,0xcc,0x1b,0x5b,0x8c,0xe0,
+0x1f,0xe8,0x8e,0x5d,0xda,0x0b,0x2d,0xc1,0x97,0xa2,0x85,0x5d,
+0x23,0x60,0x1e,0x94,0xcd,0x2e,0x5e,0xfe,0x37,0x1d,0x92,0xa6,
+0x91,0x52,0x77,0x44,0x9a,0x70,0x76,0x9f,0x64,0x6a,0xc6,0x12,
+0x27,0x16,0xb3,0xd2,0x93,0x9d,0x97,0x4b,0x3b,0xba,0xd4,0x7b,
+0xb9,0xdc,0xb0,0xbc,0xd4,0x7d,0xb9,0x14,0x45,0x81,0xff,0x92,
+0x8d,0x32,0xbb,0x45,0xed,0xb8,0x9f,0x80,0x46,0xd2,0xec,0xfb,
+0x18,0xb7,0xe5,0xd2,0xb6,0xed,0x7e,0xcb,0x65,0xde,0xc7,0xaf,
+0xea,0x31,0xcc,0x3a,0xf5,0x32,0x34,0xe7,0xbd,0x79,0x36,0x00,
+0xd3,0x87,0x67,0x83,0x30,0x7d,0x77,0x36,0x88,0x22,0xe7,0x5d,
+0xe5,0xeb,0xf9,0xe1,0x72,0x4e,0xb5,0x15,0x1c,0x17,0x4f,0xf0,
+0xaa,0xad,0x82,0xf5,0xd1,0xee,0xaf,0x15,0x90,0x3e,0xcd,0x01,
+0xb5,0x7c,0x51,0xe5,0x68,0xc7,0xbe,0x47,0x56,0x71,0x06,0x2d,
+0x77,0x54,0xae,0xea,0x0b,0x5a,0xc5,0xdd,0x23,0x66,0xe5,0x72,
+0x8f,0x8f,0x0d,0x10,0x1a,0xf9,0xf0,0xbc,0xfc,0xd2,0x6b,0xf3,
+0x03,0xa5,0x5e,0x1e,0x19,0x0b,0xc2,0xa1,0xf8,0xb7,0x9c,0xfb,
+0x80,0x39,0x7c,0x32,0x90,0x2a,0x23,0x8c,0x09,0x89,0xbe,0x9f,
+0x2c,0x24,0x7e,0xcb,0x41,0xce,0x33,0x50,0xf3,0x3c,0xae,0x2c,
+0x9e,0x1c,0x84,0x72,0x0c,0x65,0x20,0xd5,0xf7,0x82,0x1a,0xdc,
+0x41,0x64,0xad,0xa4,0xbf,0xbc,0xae,0xd5,0x43,0x9f,0x51,0x06,
+0x1e,0x3f,0x95,0x38,0x62,0x66,0x81,0xe1,0x86,0x69,0xb5,0xb4,
+0xeb,0x80,0x22,0x96,0x40,0x4f,0x4f,0x2f,0x60,0xb2,0xcc,0x61,
+0xbb,0xd8,0x8f,0x3d,0x2b,0xd0,0xc2,0x00,0xfa,0x29,0x03,0xf4,
+0x90,0xdf,0x51,0x0b,0x1f,0x46,0xff,0x9a,0xde,0x22,0x71,0x4f,
+0x33,0x96,0x99,0x1f,0xa8,0x70,0x53,0xa0,0x90,0x5e,0x72,0x83,
+0xf7,0x0d,0x8d,0xa6,0x3d,0x6e,0x3f,0x32,0xee,0xf1,0xf2,0x3b,
+0x4b,0xf8,0xa0,0x4c,0x34,0xc4,0xb3,0xa7,0x38,0x6b,0x7a,0x78,
+0x3b,0x8d,0xb9,0x2e,0xae,0xdf,0x64,0x7d,0x3a,0x71,0x41,0x0c,
+0x20,0x6f,0x53,0xb4,0x57,0xa6,0x80,0xea,0xfa,0x5d,0xaa,0x00,
+0xe6,0xa4,0x4b,0xbb,0xeb,0xf9,0xf9,0x33,0x74,0x6a,0xf2,0x4a,
+0xa4,0x4d,0xa8,0xb4,0x3b,0x9f,0x9f,0x3f,0xa7,0xbc,0x36,0xeb,
+0xcc,0x8d,0x84,0x87,0xf9,0xe7,0xd3,0x85,0x95,0x41,0x0f,0xdf,
+0xad,0x62,0x16,0x8e,0xe6,0xd5,0x4f,0x05,0x2f,0xe7,0xa7,0x3e,
+0xe7,0xa2,0x0e,0x6b,0x12,0x65,0x64,0x71,0xd2,0x84,0x48,0x7b,
+0x86,0x56,0x23,0x66,0xa6,0x92,0x8f,0xeb,0x67,0xdf,0x25,0xf4,
+0x88,0xc3,0xe9,0x0a,0x24,0x65,0xa4,0x1d,0xb9,0x66,0xb2,0x46,
+0x27,0x90,0x17,0x6a,0x59,0x5e,0x4f,0x48,0x92,0x90,0x18,0x4f,
+0x99,0x5e,0x36,0xcf,0xab,0x48,0x4a,0x9e,0x79,0x8d,0xfd,0xda,
+0x19,0xc8,0xc3,0xcf,0x45,0x02,0xd4,0x19,0x40,0x42,0xa3,0x69,
+0x3e,0x8f,0xe6,0xbb,0xeb,0x15,0x1e,0x67,0xbf,0x76,0x06,0x8f,
+0xba,0x40,0xcd,0xc4,0xa7,0x57,0x9e,0x7f,0x2c,0x5d,0x1a,0xc9,
+0x9c,0xa2,0x53,0xc1,0x9e,0x3d,0xf5,0x0a,0xc4,0xd4,0x82,0xd9,
+0x14,0x7f,0xf3,0xf5,0x3c,0xd3,0x8b,0xab,0xf7,0x05,0xd2,0xc2,
+0x6a,0xbe,0x9f,0x7e,0x75,0xe2,0x8d,0x84,0x76,0xda,0xee,0xb1,
+0x91,0xf5,0xe5,0x5b,0x92,0xa9,0x2d,0xab,0x26,0x1c,0xfb,0x96,
+0xbc,0x7a,0x35,0xc1,0xa1,0xc7,0xe5,0xcc,0x53,0xc4,0x3c,0x35,
+0x77,0xde,0xb5,0x1a,0x02,0x0c,0x35,0x2b,0x1e,0x84,0xc3,0xb2,
+0x41,0x38,0xc4,0xaa,0xff,0x21,0xc3,0x20,0xf9,0xf9,0xf8,0x91,
+0x60,0x03,0xf8,0x4f,0x33,0x0c,0x3d,0xcb,0x7f,0xae,0xc5,0xab,
+0x6d,0xa1,0x4f,0x7d,0x87,0x92,0xd4,0x6e,0xcc,0x35,0x4a,0xa0,
+0xd2,0x5d,0x03,0x70,0xa1,0x25,0xd3,0x97,0xaf,0x49,0xde,0xe0,
+0x70,0xf4,0x58,0x1e,0x9b,0x39,0xff,0x67,0xd1,0x63,0x0a,0x16,
+0xe6,0x15,0x08,0x1c,0xf6,0xef,0x6d,0x91,0xff,0x8a,0xa3,0x48,
+0x1d,0x42,0xd6,0xbc,0xad,0x3e,0x57,0x61,0x25,0x54,0xc9,0x3b,
+0x6b,0x97,0x24,0x20,0x77,0x4e,0x48,0xf7,0x80,0xdf,0x47,0x47,
+0x05,0xbc,0xa3,0xb3,0xe0,0x15,0x5c,0x24,0x7a,0xa7,0xb9,0xa9,
+0x26,0x0a,0x09,0xc8,0xac,0x36,0x43,0xe2,0xf0,0x24,0x58,0xc2,
+0x70,0x47,0x7d,0x1a,0x70,0xe3,0x4d,0x22,0xdf,0x86,0x13,0x22,
+0xcb,0x31,0xb0,0xa8,0xb8,0x26,0x08,0xd3,0x63,0xb0,0xa8,0xc3,
+0x3a,0xb3,0x9f,0xac,0x9b,0x16,0x5e,0x81,0x96,0x27,0x49,0xf2,
+0x13,0x98,0x46,0x49,0x22,0x53,0xfb,0xa0,0x3d,0x99,0x46,0x12,
+0x9e,0x81,0x3b,0x03,0xf4,0xd5,0x2d,0xf0,0xb3,0x78,0x4a,0x44,
+0x92,0x35,0x58,0x08,0x3f,0x28,0x72,0x42,0xb8,0x46,0x3d,0x1f,
+0x95,0x5c,0x12,0x52,0x49,0x1a,0x33,0xf1,0x64,0xa9,0xf7,0x43,
+0x1a,0xf1,0x04,0x30,0xb6,0x77,0x9f,0x85,0x33,0x01,0xdb,0xe2,
+0xc6,0xec,0x96,0xef,0x46,0x21,0x04,0xce,0x80,0x04,0x09,0xcc,
+0x98,0xb1,0x7b,0x4c,0xe6,0x8e,0x47,0x5c,0x1f,0x95,0x3a,0x4b,
+0xf0,0x87,0x40,0xf1,0xdb,0x8c,0xc4,0x8b,0xe5,0x48,0x1a,0x12,
+0x43,0x0e,0x5b,0x77,0x65,0x82,0xde,0x5f,0xbf,0x6d,0xec,0xda,
+0x02,0x45,0x56,0x23,0x45,0xaf,0x5e,0x45,0xf9,0xf4,0xfc,0xc4,
+0x9d,0x25,0x2c,0xaf,0x53,0x34,0x84,0xf5,0x6b,0xc6,0x3d,0x76,
+0xe9,0x62,0xbd,0x56,0x6c,0xbb,0x63,0x60,0x0c,0xaa,0x48,0x34,
+0xb3,0xd3,0xf0,0xdf,0xd5,0x56,0x8b,0xee,0xe4,0x47,0xed,0xb5,
+0x6f,0x4a,0xf7,0x5a,0x89,0xee,0x4f,0xdd,0x6c,0xa7,0x31,0xb9,
+0x2b,0xde,0x6c,0x07,0x38,0xab,0x58,0xec,0x0a,0xf3,0x6c,0xa8,
+0x54,0xdc,0xa3,0xd8,0x99,0x8e,0x7d,0x37,0x8d,0x1b,0x65,0xfd,
+0xe4,0xf9,0x84,0x2e,0x8f,0x2e,0x8a,0xf8,0x8b,0x98,0x54,0xd6,
+0xed,0x34,0x90,0xe1,0xd1,0x9d,0x13,0xaf,0x0f,0x06,0x3c,0x6f,
+0xb7,0x96,0x3d,0x33,0xbf,0x70,0x2f,0x6e,0x05,0x30,0x4b,0xda,
+0x89,0x50,0x37,0x82,0x01,0x0d,0xe0,0xaa,0xea,0x8d,0xfe,0x40,
+0x8f,0x48,0xe2,0x69,0x4b,0x95,0xaa,0xd5,0x4d,0xd3,0x73,0x9a,
+0xec,0x1a,0x01,0x0e,0x3d,0x1c,0xe0,0xf1,0x14,0xaa,0xd7,0x6f,
+0x0e,0xac,0xaf,0xb2,0xf3,0xe2,0x83,0x59,0xcc,0x66,0xb9,0x88,
+0x81,0x2a,0x78,0xa3,0x7d,0x53,0xab,0x21,0x5f,0xf2,0xbf,0x88,
+0x28,0x09,0xa9,0x8f,0x0b,0x94,0xb8,0x3e,0xa4,0xcd,0x34,0x0e,
+0x7a,0xc5,0xc4,0x2d,0xe2,0x8f,0xfb,0x37,0x0b,0xee,0x18,0x39,
+0x61,0xe8,0xc4,0x83,0x28,0x6e,0x39,0x8e,0xd3,0x98,0x8d,0x5a,
+0x62,0x31,0xdf,0x29,0xbc,0x65,0x44,0x9d,0x01,0x47,0xff,0x05,
+0xb9,0x73,0xb4,0x67,0x0a,0x75,0xbb,0x25,0x1e,0x2b,0x05,0x73,
+0x6f,0x7b,0xa6,0x55,0x57,0x60,0xc4,0xa7,0xc8,0x0c,0x11,0x16,
+0x87,0xd3,0xdf,0x1f,0x6c,0x49,0x5a,0x7c,0x80,0x53,0xe2,0xf9,
+0x0e,0x1c,0x44,0xd3,0x05,0x54,0x4f,0xed,0x23,0xc1,0x13,0x4e,
+0xc8,0x7c,0x11,0xf6,0x11,0xd0,0xc2,0x67,0xa2,0xe1,0x50,0x3e,
+0x71,0x21,0x2f,0x07,0x04,0x24,0xb6,0xf8,0x30,0xb6,0xb5,0x3a,
+0x61,0x69,0x15,0x75,0xa4,0xf3,0x39,0x02,0x93,0xe8,0xd2,0x07,
+0x8b,0x3a,0x5a,0x17,0xd8,0x4c,0x40,0xfc,0x8e,0x1f,0xe2,0xfc,
+0xe4,0x0b,0x48,0x69,0x47,0x9c,0x19,0x8d,0x18,0x65,0x4b,0xe9,
+0x2f,0x83,0xec,0x80,0xc1,0x4a,0xdc,0xcd,0xa2,0x84,0x78,0xb8,
+0xf8,0x4e,0x03,0x67,0x51,0x07,0x7f,0x14,0x46,0x31,0x49,0x80,
+0x47,0x7b,0xe5,0x2a,0xeb,0x9d,0x70,0x82,0x80,0x3d,0x9a,0x64,
+0x7f,0x9f,0x75,0x82,0x9c,0x61,0x8c,0x59,0x65,0x5d,0x56,0xba,
+0xc1,0x24,0x3d,0x91,0x47,0xb1,0xd8,0x7f,0xa5,0xb3,0xaf,0x21,
+0xa2,0xe0,0x67,0x09,0xf7,0x0d,0xb2,0xfd,0x94,0xed,0xde,0xc4,
+0xf5,0x3d,0x76,0xe3,0x23,0xf5,0xcc,0xd1,0x08,0x19,0x9c,0xd0,
+0x78,0xe6,0x52,0x20,0xdc,0xaf,0x9f,0xe0,0x1d,0x99,0xd0,0x25,
+0x09,0x8c,0xa3,0x80,0x2d,0x8c,0x5a,0x1e,0x3d,0x70,0x06,0xd1,
+0x8c,0xa6,0xef,0x6c,0xa7,0xe1,0x18,0x2c,0x6c,0x44,0xbe,0xfe,
+0xeb,0xc0,0xc8,0xbf,0x23,0xa1,0x08,0x07,0xb9,0x56,0xcf,0x79,
+0xab,0xe4,0x64,0x2c,0xd9,0xa3,0xd8,0x60,0x31,0xe7,0xa3,0x50,
+0x42,0x64,0x27,0x80,0x46,0x90,0x10,0xda,0x62,0x5d,0x13,0x18,
+0xf8,0x83,0xb7,0x3a,0x8a,0x24,0xa5,0x83,0x75,0x1a,0x6b,0x39,
+0x09,0x06,0x6c,0x4a,0x45,0x48,0xe2,0x6b,0xb2,0x37,0x7f,0xa9,
+0x1d,0x0b,0xc7,0x20,0xf2,0x53,0xd6,0x8d,0x7a,0xdc,0x31,0x9e,
+0x10,0x8a,0x08,0x7d,0x9a,0x80,0xcf,0x74,0xd0,0x40,0x28,0x55,
+0x16,0xd1,0x65,0x0c,0x59,0xf0,0xbd,0xf3,0xfb,0x5c,0x4a,0xd0,
+0xae,0x06,0xf3,0x56,0x8c,0x77,0x1e,0x6a,0x4b,0x83,0x3a,0xc7,
+0xc1,0xd2,0x40,0x8e,0x87,0x10,0x9a,0x6f,0x46,0xc5,0x84,0x33,
+0xbb,0xce,0x64,0xcd,0x7c,0x71,0x5d,0xd1,0x4e,0xc7,0xc4,0x17,
+0x63,0x6e,0x74,0xc1,0x2e,0x96,0x09,0xa1,0x97,0x0a,0xcf,0xaa,
+0x92,0xa9,0x5e,0x2a,0x13,0x5a,0x62,0x2a,0x1a,0xf7,0x63,0xdf,
+0x1d,0x4b,0xbf,0x35,0xbf,0xde,0xed,0xc1,0x9d,0xef,0xf0,0x4b,
+0xf2,0x16,0xc1,0x96,0x22,0x98,0xfa,0xad,0x63,0x95,0xb5,0x11,
+0xc7,0x38,0x1d,0x1f,0x3e,0xee,0xa8,0x0a,0x35,0x3a,0xeb,0x75,
+0xde,0x12,0xc7,0xe1,0x3a,0x21,0x7b,0x43,0x93,0x08,0x05,0x4d,
+0xbc,0x49,0x1d,0x21,0x3f,0xcd,0x06,0x48,0x46,0x2c,0xa9,0xd4,
+0xfc,0xac,0x62,0xa9,0xb9,0xde,0xf7,0xfe,0x63,0xc6,0x9f,0x9a,
+0x14,0x27,0xa9,0xe8,0xe6,0x11,0x43,0x1a,0xc8,0x21,0x63,0x6c,
+0x7e,0x18,0x93,0x70,0x09,0x64,0x5d,0xac,0x1a,0xb3,0x44,0x46,
+0x31,0x89,0xb1,0xe4,0x18,0x30,0xb8,0x0a,0x68,0x04,0x13,0xe7,
+0x13,0x01,0x27,0x14,0x59,0x52,0x89,0xa7,0xd8,0x8a,0x03,0x92,
+0x86,0x9e,0x6a,0x17,0xb6,0x79,0x7d,0xc7,0x63,0xcb,0x8a,0xa3,
+0xf5,0x82,0x46,0x40,0x1c,0x77,0xac,0x6a,0x61,0x1b,0x7c,0xd1,
+0x0a,0x23,0x4a,0x14,0x0d,0xe9,0xc0,0xc4,0x76,0xc9,0x15,0x3d,
+0x38,0x55,0xb2,0xb7,0xb2,0xf4,0x4e,0xd3,0x35,0x35,0x23,0x5d,
+0xd3,0x88,0x6d,0x75,0xa7,0x32,0x11,0x2d,0x8f,0x04,0xcd,0xae,
+0xaf,0xbc,0xba,0xb9,0xc8,0x02,0x8d,0xb8,0xb3,0x82,0x8e,0x15,
+0x1a,0x2d,0xdc,0x04,0xbf,0xb2,0xc7,0x9f,0x90,0x74,0x39,0xc0,
+0x1f,0x9c,0xc0,0xf7,0xc4,0xe4,0x54,0xa7,0x24,0xc5,0xa8,0x3d,
+0xcb,0x86,0x1f,0x62,0x60,0x6b,0xae,0x1d,0xdb,0xe2,0xc4,0x60,
+0xf8,0x25,0xbb,0xcc,0xd1,0x99,0xed,0x82,0x3c,0xc0,0x95,0xca,
+0x29,0x6a,0x13,0x5d,0x91,0xa0,0x35,0xd7,0x58,0x6e,0x61,0x52,
+0xeb,0x2a,0xc8,0xd5,0x29,0x23,0x52,0x42,0x31,0x11,0x73,0x16,
+0x9b,0xee,0x40,0xd1,0x62,0x74,0x91,0x8e,0xc0,0x4a,0x03,0xfa,
+0x0d,0x4c,0x01,0xe0,0x2a,0x1a,0xd2,0x34,0xd3,0x6e,0xac,0xae,
+0x06,0x5c,0x5d,0x8b,0x27,0x20,0x97,0x5c,0x50,0xa7,0xc8,0x85,
+0xad,0x46,0xa7,0x5d,0x7c,0x43,0x3d,0x1a,0x52,0x7e,0x40,0x2f,
+0xb3,0x89,0x16,0x5d,0x51,0x2a,0x89,0x2a,0x28,0xf1,0x60,0x97,
+0xb9,0xa7,0x99,0x2f,0x6b,0x46,0x23,0x2c,0x5e,0x5b,0xea,0x0d,
+0x46,0xe8,0xd7,0x6b,0xab,0x84,0x07,0xe4,0x6c,0xe8,0xed,0x22,
+0x83,0x79,0x2e,0x81,0xe1,0x92,0xc7,0xe0,0xcd,0x73,0x1b,0xb7,
+0x9d,0x1b,0x74,0x89,0xbb,0x34,0x9a,0x1b,0x46,0xbb,0x88,0x93,
+0x82,0x67,0xe1,0x13,0xe8,0xc3,0x0d,0xd6,0xb8,0x95,0xe5,0xc6,
+0xa1,0xe6,0x2f,0x72,0xba,0x5f,0x8a,0x54,0xd4,0x68,0xff,0x4e,
+0x6f,0x77,0x5c,0xfe,0xf5,0xb4,0xd6,0x04,0xb4,0x32,0xc3,0x87,
+0xeb,0xcd,0x76,0x9a,0x19,0x1a,0x73,0x78,0x2f,0x34,0xd1,0xe6,
+0xd8,0x7a,0x70,0x31,0xf9,0x0b,0x2c,0x8c,0x7c,0xcf,0x89,0x50,
+0x4f,0x38,0x52,0x99,0xea,0x38,0x01,0x3f,0x84,0xcb,0x53,0x9e,
+0x02,0xf0,0x62,0xa2,0xc3,0x68,0x7a,0xcc,0x5e,0x9a,0x37,0xa3,
+0x01,0xfc,0x15,0x4c,0x37,0x1a,0x85,0xfe,0xdf,0xd3,0x8c,0x18,
+0x1d,0x68,0x40,0x42,0x54,0xa4,0x57,0x17,0x1a,0x5c,0xc0,0xe5,
+0x87,0x4d,0x68,0xc0,0x94,0xc4,0x13,0x27,0x24,0x21,0x0d,0x16,
+0x3a,0xec,0x56,0xa6,0x88,0xd7,0xb3,0x1e,0x6d,0x19,0x6f,0xf6,
+0xc3,0xc4,0x5f,0x79,0xe6,0xbd,0xb6,0x31,0x17,0xaf,0xe9,0x4c,
+0xc5,0x35,0x9d,0xa7,0xf1,0xf8,0xb5,0xe2,0xf2,0x74,0x55,0x2e,
+0x73,0xfb,0x5a,0x3d,0xc3,0x65,0xce,0x60,0xb1,0x0d,0x25,0x2a,
+0xde,0x10,0x47,0x9f,0xd3,0xd4,0x2c,0xe1,0x84,0xb8,0x6a,0xb4,
+0x32,0x33,0xa4,0xfd,0x72,0x5d,0xdf,0x5c,0xdc,0x88,0x6b,0xd3,
+0xb8,0x4d,0x72,0x21,0x16,0x97,0x7e,0x6a,0xcd,0x82,0xc5,0x9f,
+0x3b,0x83,0x19,0x82,0x82,0x7d,0x40,0x46,0x86,0x99,0x79,0xc9,
+0x45,0x51,0x57,0x14,0x75,0xf3,0x45,0x9b,0xa2,0x68,0x53,0x15,
+0x59,0x09,0xc8,0xea,0xcc,0xb6,0x4d,0x68,0xb7,0x31,0xf0,0xd5,
+0xed,0xf2,0xc4,0xb6,0xf9,0x3c,0x37,0x20,0xa0,0x2a,0xb6,0x12,
+0x66,0x3b,0x64,0x42,0x80,0x4f,0x14,0xdb,0xf6,0x9c,0x2c,0x6a,
+0xfb,0x1e,0x71,0x90,0xf2,0xf5,0x44,0xac,0x0d,0x2b,0x8d,0xd0,
+0x6f,0x00,0x27,0x91,0xe3,0xc1,0xc9,0xd1,0x21,0xbf,0x78,0x72,
+0x72,0x52,0x62,0xe0,0x40,0x15,0xfb,0xe4,0xe8,0xf0,0xaa,0xe8,
+0x60,0xdd,0x11,0xd7,0x84,0xd0,0x38,0x7d,0x36,0x9b,0xb0,0x60,
+0x74,0x5b,0x9f,0x38,0xc4,0x81,0x33,0x4d,0x2c,0x20,0x9b,0x1a,
+0x88,0xf0,0x49,0x58,0xf1,0xf0,0xc6,0x8e,0xe6,0x18,0x12,0x3e,
+0xf3,0x93,0x71,0x71,0x8b,0xdd,0x2c,0x64,0x41,0xcb,0x5d,0x80,
+0xcd,0x2c,0xa8,0x41,0x81,0x85,0xf7,0x41,0xe4,0x78,0x8c,0x79,
+0x2b,0x32,0xfc,0xea,0x02,0x7e,0xd3,0xa6,0x03,0xdf,0x6c,0xf8,
+0x7b,0x12,0x7c,0x26,0xbc,0xc7,0x47,0x8d,0xf1,0xba,0x5d,0xdb,
+0x3a,0x10,0x03,0x79,0xcb,0x6b,0x10,0xe4,0xe8,0xef,0x58,0x20,
+0x8a,0x86,0x8a,0xf3,0x24,0xa1,0xec,0x0d,0x5d,0x0b,0xae,0x4d,
+0x13,0x97,0x7a,0xd2,0xdf,0xa6,0xab,0x0b,0x2c,0x1a,0x4c,0x81,
+0x90,0xb2,0xde,0x5e,0xb1,0xce,0xae,0xc8,0xae,0xf5,0x94,0x5b,
+0x18,0x9f,0xae,0x59,0x27,0x11,0xb3,0x70,0x55,0xa8,0x07,0x4d,
+0x04,0x0b,0xf7,0xb3,0x8b,0x89,0xd0,0x9b,0x57,0x51,0x27,0xd9,
+0xc2,0x79,0xc8,0x96,0x63,0xf6,0xe7,0x09,0x1e,0xa5,0xf8,0x23,
+0x18,0xe5,0x52,0x6f,0xad,0xc8,0xf4,0xc9,0xfc,0x03,0x1a,0xdd,
+0x65,0x4d,0x15,0x72,0x10,0x5f,0xf3,0x51,0x1d,0x17,0x5a,0xc5,
+0x4a,0xfb,0xd2,0x04,0x62,0xd3,0xf7,0x9d,0xbb,0x3d,0xfa,0x81,
+0x9f,0x88,0xf9,0x99,0x50,0x9d,0x2c,0x2f,0x98,0x6d,0xe3,0xce,
+0x8f,0x66,0x89,0x7c,0x2d,0x81,0xf9,0xaf,0x85,0x6d,0x00,0x51,
+0x79,0x4d,0xd6,0x2d,0x99,0x7f,0x20,0x16,0x7e,0x24,0xf1,0xb6,
+0x25,0x72,0x9d,0xef,0x46,0x65,0xce,0x75,0x41,0x09,0xa7,0x61,
+0x35,0xe1,0xa0,0x3d,0xb8,0x08,0x7a,0x70,0x31,0xe8,0xc1,0x45,
+0xdc,0x63,0x3b,0xaf,0xe8,0xe2,0xc1,0x18,0xdd,0x6d,0xfa,0x03,
+0x1d,0xa8,0x77,0x10,0x97,0x3a,0xe1,0x68,0x16,0xa0,0xd9,0x35,
+0x26,0x0e,0xbf,0x9d,0xba,0x7f,0xb9,0x5f,0xab,0x8b,0x07,0xa7,
+0xf9,0x16,0x9c,0x8e,0x94,0xd1,0x80,0xf1,0x80,0x45,0xcc,0x71,
+0x99,0x41,0xc6,0x3a,0x80,0xf1,0xc6,0x7b,0xc2,0x0c,0x4d,0x8c,
+0xa6,0x3d,0x74,0x35,0x76,0xea,0xb0,0x55,0x87,0xed,0x3a,0x3c,
+0x67,0xd5,0xcf,0xce,0xaf,0x8f,0xf6,0xf4,0xc7,0x88,0x2b,0xf2,
+0x0c,0xc2,0x74,0x3a,0xf6,0x04,0x08,0x1e,0xb5,0x84,0xf0,0x15,
+0x89,0x06,0xf6,0xf6,0x38,0xbc,0x94,0x94,0x95,0x19,0x74,0xa9,
+0x6e,0xcc,0x95,0x86,0x77,0x3d,0xc1,0xb6,0xf8,0x36,0x48,0xbf,
+0x75,0xe5,0xb7,0x38,0xfd,0xb6,0x29,0xbf,0x39,0x94,0x6a,0x9f,
+0xb7,0xb8,0xad,0x1d,0x1b,0xc2,0xc5,0x40,0xc0,0xf8,0xec,0xa3,
+0x08,0x6d,0xa6,0xf0,0x12,0x06,0xec,0x75,0x44,0xa0,0x69,0x78,
+0xf3,0x32,0xdb,0xff,0x6d,0x2f,0x0d,0x8f,0xf6,0xa1,0xcf,0x82,
+0xa3,0xe1,0x25,0xc4,0x99,0x18,0x69,0x66,0xd4,0xf7,0xd1,0x9a,
+0x7f,0xe3,0x30,0xf3,0xbf,0xf8,0x70,0xd3,0xb9,0xbd,0xcd,0x3c,
+0xb2,0xbf,0xa2,0x6f,0x37,0x7d,0xd4,0xb9,0xac,0xb8,0x7b,0x5b,
+0xcb,0x4f,0x3a,0x3d,0xfa,0xa5,0x78,0xc6,0x95,0xce,0x1e,0x75,
+0xd9,0xbb,0x68,0x0a,0xe1,0x7c,0x7c,0xc2,0xfc,0xd1,0x7d,0xcc,
+0x42,0xc1,0xfa,0x41,0xdd,0xdf,0xf1,0xa7,0x2a,0x20,0x9f,0x5d,
+0xbf,0xf2,0x28,0x7f,0x42,0xc5,0x49,0xe0,0x9e,0x04,0x01,0xfe,
+0xcb,0xec,0x1e,0xe8,0x8b,0x4b,0xb4,0x87,0xdd,0x13,0x92,0xea,
+0x38,0xd9,0xab,0x1a,0xdc,0xa9,0xc7,0xef,0x52,0x05,0xd1,0x3d,
+0x6f,0xec,0x7c,0x2a,0x58,0xa4,0x19,0x2b,0x8b,0xf5,0x40,0xa8,
+0xe2,0x24,0x75,0xc2,0x05,0xb3,0xa2,0xf0,0xa7,0x85,0x32,0xba,
+0x61,0x52,0x43,0x26,0xda,0x8c,0x53,0x87,0xa4,0x81,0x3e,0x46,
+0x7f,0x28,0x5d,0x8e,0xb6,0x45,0xf9,0xb8,0x04,0x62,0x13,0xa0,
+0x07,0x30,0xc7,0xff,0x2c,0x10,0xf6,0x34,0xba,0x53,0x57,0x8b,
+0x68,0x04,0x37,0xf3,0x3a,0x2c,0x6e,0x73,0x1b,0x64,0x0f,0x60,
+0xcc,0x2e,0xfe,0xe1,0x5f,0xf7,0xbe,0x47,0xc7,0xe2,0x12,0x02,
+0xc6,0x87,0x61,0xcf,0xf8,0xd4,0x57,0x78,0x64,0x7d,0x51,0x09,
+0x3b,0xcc,0x6b,0xf9,0x21,0x4c,0xfd,0x39,0x09,0x12,0x9b,0x65,
+0xff,0xd2,0xf1,0x13,0x2b,0x3a,0xce,0xbc,0x38,0x0a,0xa9,0x74,
+0x99,0x27,0xd4,0x71,0x3f,0x29,0xf7,0x2e,0x8e,0x49,0x14,0x7b,
+0xf6,0x67,0xa0,0x4e,0xa2,0x7b,0x12,0x17,0x62,0x95,0x37,0x27,
+0x87,0xa9,0x25,0x1a,0x38,0xf6,0x02,0xa4,0xfc,0x82,0xd4,0x25,
+0x8f,0xdf,0xcb,0xa1,0xcd,0x5d,0xb7,0x5f,0xca,0x39,0xf6,0x90,
+0x93,0x13,0x13,0x47,0x63,0xdb,0x0d,0xaf,0xd2,0x63,0xf0,0xb7,
+0xe0,0x87,0x85,0x0f,0x48,0xbd,0x60,0x2d,0xb4,0x8d,0xdb,0x50,
+0x13,0x67,0xee,0x4f,0xf0,0xa8,0x69,0xa5,0x89,0xd7,0xe0,0xd2,
+0x74,0x2a,0x20,0x05,0xa0,0x7c,0x47,0x2a,0x16,0xd4,0x45,0x99,
+0x4b,0x5e,0xf8,0xd5,0x72,0xab,0x25,0xa5,0xe0,0x7d,0xe8,0xf1,
+0x64,0xe7,0x0d,0x5e,0xb1,0xe0,0x1e,0x4d,0x4a,0x80,0xd8,0xe5,
+0xa8,0x51,0x2b,0x5b,0x41,0xde,0x99,0x61,0xf9,0xbf,0x8c,0x31,
+0x4c,0xa8,0x43,0x35,0xcf,0x80,0x5e,0xb6,0x96,0xa6,0x26,0x8d,
+0xa6,0x24,0x84,0x6a,0x18,0x85,0x62,0xea,0xf8,0xc4,0xab,0xd5,
+0xc1,0xa7,0x22,0xc4,0x90,0x3f,0x5d,0xdd,0x01,0x0a,0x19,0x4c,
+0x12,0x85,0x68,0xcc,0x4f,0x40,0xd5,0xcf,0x55,0xef,0x62,0xf5,
+0x0c,0xdd,0x9b,0x85,0x74,0xcb,0x47,0xf3,0x9b,0x4c,0x95,0x99,
+0x05,0x14,0x7c,0x8e,0x46,0x3d,0x35,0xd0,0x63,0x53,0x74,0x01,
+0x34,0x83,0x73,0xab,0x10,0x67,0x3a,0xb3,0x32,0x48,0x53,0xab,
+0x81,0x4d,0x18,0xa9,0x35,0xb3,0x82,0x68,0x80,0xcd,0x34,0x11,
+0x02,0x6a,0xca,0xaa,0x5d,0x24,0xcd,0xce,0xc0,0xee,0x4a,0x2d,
+0xbe,0x28,0x6b,0x51,0xc8,0xd1,0x4a,0xcd,0xbd,0x58,0xa1,0xb9,
+0x2e,0xb4,0xf5,0xe6,0x74,0x0e,0x56,0x12,0x48,0xc3,0x37,0x74,
+0x26,0x4a,0x04,0xe7,0x57,0x07,0x00,0x27,0xc0,0x01,0xe0,0xea,
+0x3a,0x83,0xb8,0x53,0x82,0x98,0xc5,0xc8,0xe8,0x38,0x39,0xb2,
+0x40,0xa2,0x28,0x40,0xd9,0xd5,0xe6,0x16,0xdb,0x7e,0x39,0x5a,
+0x46,0x26,0x5f,0x53,0xf9,0x52,0x86,0xd8,0x21,0x0a,0x8d,0xe5,
+0xab,0x69,0xc5,0xd5,0xb1,0xe2,0x92,0x08,0xca,0x6a,0x76,0xb3,
+0x35,0x33,0x8d,0xdb,0xeb,0x6e,0x5a,0xd6,0xa7,0xb2,0x4e,0xe0,
+0x46,0x5d,0xda,0x8d,0x4d,0xad,0x1b,0x16,0x84,0x29,0x96,0xb2,
+0xea,0x5d,0x4b,0xf5,0x1c,0x19,0x79,0x04,0xaf,0x10,0x83,0x9c,
+0x81,0x72,0x89,0x4c,0xc3,0x0c,0x51,0xbd,0x39,0xb9,0x28,0x88,
+0x32,0x51,0xfa,0x08,0x11,0x0a,0xca,0x53,0xcf,0x07,0x54,0x1e,
+0x81,0xf8,0xe3,0x1f,0x2b,0x1c,0x10,0x2e,0x33,0x07,0x04,0x8e,
+0xe0,0x2b,0x9d,0x12,0xcc,0x13,0x42,0xcc,0xa9,0xaa,0x03,0xdf,
+0x48,0xfe,0x8c,0x63,0x82,0x68,0x62,0xc5,0xa3,0x82,0xdd,0xfb,
+0x4e,0x35,0xef,0xfb,0x6a,0x71,0x79,0x4d,0x80,0x23,0xf4,0x6e,
+0x29,0x15,0x8d,0x63,0xe0,0xc4,0x27,0xe0,0x00,0xea,0x85,0x81,
+0x42,0x61,0xb3,0x7a,0x5c,0x7d,0x41,0xd8,0xdb,0x5f,0x57,0x8b,
+0x77,0x2b,0x08,0x73,0xbb,0x7a,0x52,0x7c,0xdb,0x5f,0x57,0x09,
+0x6c,0x4b,0x83,0xda,0x94,0x32,0x56,0x18,0xdd,0x56,0x70,0xe8,
+0x53,0xa1,0x6d,0x6f,0x39,0xef,0x1e,0x61,0x85,0xd2,0xc6,0xf1,
+0xde,0x89,0x31,0xc4,0xa4,0x81,0x77,0xee,0xe1,0x0e,0x83,0x97,
+0x84,0x25,0xe5,0x87,0x37,0x1f,0x0a,0x6d,0x51,0x51,0x2c,0xf8,
+0x1b,0x0d,0x87,0x59,0xc6,0xd5,0x91,0x0d,0x51,0x2c,0xe6,0x7b,
+0x90,0x55,0xa3,0xb6,0xa1,0x0e,0x3b,0x50,0x87,0xe7,0x50,0x47,
+0xa8,0x5d,0xe1,0x9d,0x1b,0x8d,0x8b,0xce,0xb6,0x3f,0x70,0x02,
+0xf1,0x06,0xfe,0x07,0x4e,0xde,0xea,0xfd,0x9c,0xa5,0xfd,0x9c,
+0xb0,0x3c,0x39,0xf9,0x6e,0x9e,0x16,0x75,0xf3,0xa9,0x1d,0x6c,
+0x43,0xfd,0xf1,0x9d,0xe4,0x59,0x7c,0x1e,0xdb,0xc7,0xec,0x2a,
+0x37,0xed,0xa5,0xdf,0xa6,0x7f,0x81,0x3b,0x61,0x11,0xc1,0x20,
+0x1b,0xbb,0x05,0xe4,0x72,0xdf,0xb4,0x7f,0xd4,0x9e,0xb8,0xb4,
+0x99,0x4f,0x7c,0x0a,0x17,0x32,0xc6,0xfe,0x64,0xf0,0x19,0x60,
+0x14,0x33,0x57,0x8a,0xb7,0x58,0x8d,0xb4,0xdb,0x53,0x1b,0x98,
+0xc2,0xf6,0x35,0xd6,0x42,0x37,0x9a,0x2e,0x1e,0xb7,0x04,0x5e,
+0x50,0x60,0x1d,0x40,0x8e,0x00,0x63,0x49,0x05,0x84,0xae,0x2c,
+0xf2,0xfe,0xbf,0xf5,0x03,0x4a,0x62,0x48,0xd1,0x22,0x87,0x8f,
+0xde,0x5e,0xf2,0x1d,0xa4,0x9b,0x31,0x31,0x99,0xd1,0xda,0xfc,
+0x32,0x51,0x40,0x86,0x54,0xdc,0x28,0xea,0xc5,0xa8,0x8c,0xc9,
+0xf3,0xe4,0x21,0x7b,0x68,0x97,0xb3,0xc3,0x8d,0xa2,0xd8,0xf3,
+0x43,0x87,0xf2,0xe5,0xd6,0x81,0x21,0x6f,0x57,0x8d,0x0a,0x6b,
+0xc7,0xc1,0xf7,0x7b,0x11,0x86,0x23,0xf0,0x69,0x13,0x60,0x3f,
+0x5c,0xb0,0xec,0x4c,0x88,0x45,0x3e,0x80,0xeb,0x27,0xe0,0x11,
+0x4a,0x5c,0x4a,0x3c,0x88,0x66,0x34,0xf1,0x3d,0xa5,0x41,0x72,
+0xbc,0xf2,0x7c,0x2e,0x90,0xa3,0xfb,0x4e,0x01,0xaa,0xaf,0xe2,
+0x4e,0xab,0x9f,0xc0,0x88,0x84,0x24,0x76,0x10,0x1b,0x52,0xa1,
+0x4e,0x86,0x29,0xa4,0x1e,0x94,0x01,0x92,0x67,0xaa,0x98,0x33,
+0x43,0xb8,0x47,0x68,0x4c,0x10,0x93,0xf2,0x58,0xad,0x47,0x21,
+0x69,0x24,0xe3,0x88,0xae,0xcb,0x3c,0x43,0xac,0x4f,0xda,0xe9,
+0x1f,0xe8,0xd8,0x61,0x7a,0xb6,0x7a,0x72,0xd7,0x08,0x07,0x17,
+0x27,0x57,0x57,0x44,0x6a,0x4a,0x1e,0x68,0x87,0x8a,0xe3,0xa1,
+0x88,0x5a,0x33,0x06,0x07,0x91,0xc9,0x80,0x2d,0x3c,0xc2,0xa0,
+0x09,0x22,0x50,0xcf,0x05,0xf3,0xc4,0x2e,0x7e,0x10,0xc0,0x00,
+0x59,0xc2,0xdf,0xae,0x6c,0x32,0xa3,0xcd,0xd1,0xc9,0xa5,0xec,
+0x8c,0xeb,0xc8,0x98,0x2f,0x97,0x04,0x09,0x43,0x81,0xa6,0xd5,
+0x68,0x96,0xa4,0xbd,0x07,0xf6,0xa0,0x32,0xa7,0xc5,0x26,0xb5,
+0x5c,0xca,0x39,0xcf,0x1e,0x29,0xbd,0x09,0xcc,0x53,0xa7,0xa4,
+0x44,0xad,0x0b,0x21,0xd3,0x77,0x8e,0xfe,0x7a,0x7d,0xa1,0xe5,
+0xb2,0xf3,0x87,0xc2,0xcd,0xe8,0xc0,0x7a,0x7b,0x3d,0xb5,0x80,
+0x43,0x14,0xc3,0x3a,0xc6,0x1c,0xe1,0x18,0x0b,0x1d,0x32,0x91,
+0xc9,0x18,0xc2,0x11,0xf7,0x67,0xd5,0xd3,0xd7,0x75,0x85,0x51,
+0x28,0x8d,0x91,0x21,0x81,0xef,0xfa,0x34,0x01,0x27,0x7d,0x5d,
+0x36,0x1a,0xa6,0xa6,0x2f,0x74,0x66,0xc1,0xfd,0x38,0x92,0x57,
+0x10,0xb4,0xe1,0xf0,0x48,0xe2,0xc6,0xfe,0x80,0x18,0xaf,0xd4,
+0xea,0xf6,0x9e,0xc6,0x2b,0x56,0xc4,0x63,0xf0,0x90,0xfa,0xd0,
+0x8d,0xd9,0x95,0x66,0x1e,0xb2,0xd2,0x4d,0x57,0x99,0x90,0xaf,
+0xf1,0x2f,0x1b,0x22,0x78,0xc3,0xa7,0x0b,0x5b,0x21,0x3f,0x15,
+0x0d,0x7c,0x9a,0xd8,0x4a,0xbb,0xec,0xb0,0x46,0x63,0x27,0x4c,
+0x26,0x3e,0x85,0xcd,0xdd,0xe6,0xd6,0x27,0x18,0x38,0x33,0xaf,
+0x18,0x58,0xa6,0x81,0x2c,0x87,0x75,0x99,0xff,0x66,0x32,0x0b,
+0xa8,0x3f,0x0d,0x7c,0x12,0x9b,0x30,0x6d,0x06,0x73,0x75,0x7d,
+0x01,0xc3,0xc0,0x19,0x25,0xa5,0x9e,0xdb,0x94,0x79,0xab,0x4b,
+0x8a,0x70,0xb8,0x28,0x1d,0x59,0xda,0x1b,0x8e,0xf8,0xcb,0x6c,
+0x6c,0xe3,0xdc,0x3f,0x38,0xb2,0x3a,0xa9,0xe4,0x11,0x20,0xa6,
+0x40,0x23,0x20,0xa1,0xa7,0x26,0x58,0x1d,0x30,0x3a,0x63,0x4a,
+0x3c,0xdb,0x46,0xfb,0xe8,0x6a,0x5c,0x45,0x4b,0x27,0x4f,0x95,
+0xcc,0x1d,0x97,0x16,0x5c,0x51,0x62,0xfd,0xe1,0x9d,0x10,0x7d,
+0x58,0x89,0x19,0x6e,0x2f,0xb3,0x11,0xfe,0x05,0xe6,0x9c,0x88,
+0xb7,0x38,0xe1,0xad,0x9b,0xea,0xdb,0xcb,0x7d,0xfb,0x92,0x0f,
+0xec,0x89,0x68,0xb1,0x8a,0x2b,0x57,0x16,0x8d,0x60,0x96,0x90,
+0xc7,0xef,0xbb,0x5f,0x63,0x1b,0x1c,0xfa,0x78,0xbb,0x74,0x05,
+0xa7,0x01,0x0b,0xb6,0xcf,0x7a,0x0d,0xa8,0xc5,0x6b,0x10,0x58,
+0xbc,0x06,0x03,0x8b,0xd7,0xe0,0x9f,0xd3,0x65,0x20,0xfe,0xbc,
+0x69,0xdf,0xd6,0xe1,0x8a,0xe2,0x8d,0xf4,0x26,0x8a,0x25,0x3a,
+0xde,0x0e,0x30,0xe5,0x8a,0x3b,0xae,0x7d,0x99,0x17,0xa1,0x53,
+0xee,0x45,0xd8,0xbc,0xb5,0x5d,0x0a,0x9b,0x41,0x05,0xfe,0x6e,
+0xa8,0x1a,0xf2,0xad,0x7a,0x6e,0x33,0xc1,0x25,0xb7,0xca,0x77,
+0x9b,0x5a,0x59,0x2c,0x43,0x26,0x0e,0xd9,0xe6,0x00,0x95,0x88,
+0xe5,0x16,0xbd,0xc4,0xd7,0x2f,0xa0,0x4b,0x82,0xe6,0x32,0x20,
+0x8c,0x96,0x28,0x94,0xfb,0x24,0x8b,0x38,0x0e,0xb3,0x51,0x9a,
+0xd6,0x88,0x67,0x11,0x34,0x9f,0x53,0x82,0x60,0x16,0xfa,0x3c,
+0x8a,0x42,0xec,0xc8,0x52,0xe1,0x40,0xfc,0xc9,0xd3,0x42,0x3b,
+0x66,0x6a,0x85,0x35,0x1f,0xef,0x17,0xbc,0x10,0x1e,0x3d,0x31,
+0x7f,0x5d,0x12,0xe8,0x46,0xf9,0x99,0x5a,0xc1,0x3d,0xf6,0x28,
+0x3a,0x4c,0xc7,0x8b,0x84,0x3d,0xea,0x9b,0x35,0xdf,0xcf,0x38,
+0x93,0x5e,0x36,0xf2,0xc8,0x0a,0xf7,0x7e,0xc1,0xce,0x74,0xdc,
+0x4b,0xe6,0xec,0x9d,0x13,0xe8,0x93,0x16,0x5e,0xf1,0xd0,0x35,
+0x91,0x91,0xc7,0x4c,0x05,0x72,0xe7,0x04,0x5a,0x99,0x47,0x5c,
+0xd1,0x90,0x2c,0x2a,0x3c,0x74,0xfc,0x45,0x49,0x26,0x73,0x92,
+0x5b,0x17,0xc4,0xa3,0xaf,0xe0,0x66,0xfd,0x1a,0xab,0x1d,0x73,
+0xae,0xff,0x63,0x7d,0xa4,0xd6,0x95,0x4d,0x5d,0x60,0x62,0xa5,
+0x6c,0x69,0xe5,0x2b,0x17,0x23,0x10,0xf7,0xdc,0x6a,0x4d,0xdc,
+0x5b,0x52,0xcf,0xc2,0xbf,0xfe,0xc7,0xaf,0x86,0x48,0xdf,0x3f,
+0xce,0x61,0x7a,0x31,0x81,0x0a,0xfc,0x6e,0x84,0x7b,0x48,0x19,
+0x14,0x52,0xca,0xcd,0x84,0x47,0x2b,0x2c,0x71,0x16,0x3f,0xa1,
+0xee,0x22,0xe4,0xf5,0x73,0x7e,0x42,0xbe,0x02,0x46,0x21,0x8f,
+0x0b,0xc4,0x88,0x7b,0xa0,0x11,0x90,0xf9,0x94,0x29,0xab,0x30,
+0x8e,0x12,0xf5,0x88,0x8a,0x50,0x97,0xff,0x7a,0x72,0x91,0xae,
+0x8b,0xda,0xff,0x54,0xca,0x5c,0xb5,0x78,0x02,0x1c,0x53,0x70,
+0x82,0x24,0xc2,0x73,0x80,0x3a,0x00,0x58,0x4f,0x58,0xb6,0x85,
+0x96,0xaf,0x66,0x32,0xc9,0x10,0xbb,0xa4,0xcd,0x54,0x4e,0xd6,
+0x39,0x6b,0x9c,0xbd,0x17,0x89,0xe8,0xc9,0xd5,0x2b,0x6e,0x5a,
+0x9a,0x9a,0x4d,0x8b,0xe1,0xb7,0x8a,0x1b,0xca,0x56,0xb3,0xdb,
+0x3c,0xc4,0xf8,0xa6,0xf9,0x88,0x1e,0x69,0xf0,0xf8,0x8b,0x29,
+0x2f,0xa8,0x53,0x97,0xac,0x42,0x57,0x5f,0xbc,0x0c,0x15,0xea,
+0x95,0xfe,0x1d,0x39,0x5a,0x69,0x6d,0xc9,0x6e,0xee,0x15,0xf8,
+0x6c,0x86,0x8b,0x4a,0x91,0x57,0xef,0xb6,0x67,0xe5,0xac,0x3c,
+0x44,0xde,0x26,0xd4,0x75,0xe8,0x64,0xb6,0x31,0x75,0x5a,0x51,
+0xc6,0x57,0x0c,0xfd,0xbb,0xbc,0x30,0x77,0x50,0xb9,0x87,0x36,
+0xd7,0xd4,0xed,0x8b,0xbc,0xda,0x31,0x76,0x12,0x18,0x10,0x12,
+0xaa,0xfd,0x1d,0x53,0x42,0x8b,0x93,0x6f,0x5d,0xf9,0x07,0x82,
+0x40,0x79,0xf9,0xd9,0xb4,0x12,0xf7,0xa4,0x44,0xab,0x26,0x56,
+0x79,0xcd,0x80,0x37,0xce,0x0e,0x9f,0x41,0x22,0xfc,0xbb,0xa9,
+0x71,0x21,0x4d,0xca,0x3c,0x9b,0xb2,0xc1,0x64,0xa2,0xcd,0xad,
+0x02,0x22,0xca,0x7f,0x01,0x63,0x74,0xb9,0x0c,0x94,0x1b,0x56,
+0x92,0x98,0xb6,0x7e,0x75,0x72,0xc4,0xcc,0x73,0x2c,0x33,0xe8,
+0x12,0xab,0x08,0xc7,0x61,0x35,0xb8,0xd4,0xb1,0xc5,0xec,0xc7,
+0x24,0x6d,0x5e,0xb6,0x2c,0xc2,0x77,0x55,0xf3,0x47,0x6f,0x2f,
+0x25,0x73,0xb9,0x4f,0x17,0x85,0x82,0x68,0x16,0xa6,0x1e,0x5c,
+0xb8,0xf8,0x9f,0x29,0x3c,0x03,0xb8,0x5f,0xb3,0x1b,0x8e,0x58,
+0xa7,0x7b,0x9c,0x1b,0x3d,0xbc,0xd6,0xef,0xb2,0x0b,0xa8,0x3d,
+0xb4,0x97,0xdd,0x96,0x49,0x0d,0xab,0x98,0x4a,0x0b,0x51,0x4b,
+0xa0,0xe4,0xc2,0x2c,0x74,0xee,0x1c,0x3f,0x40,0xda,0x59,0x30,
+0xb6,0xb8,0x40,0x94,0xae,0xa4,0x90,0x90,0x90,0x36,0x0d,0x0c,
+0x72,0xbd,0xe2,0xe2,0xdc,0x10,0x22,0x20,0x13,0xac,0xf2,0x7e,
+0xa3,0x3c,0x9b,0xb5,0xf8,0x9a,0x85,0xe6,0x2f,0x7d,0xa9,0x32,
+0x61,0x36,0x73,0x30,0xb3,0xa9,0x09,0x21,0xee,0x0e,0xf9,0x9e,
+0x17,0x90,0x62,0x3c,0xdb,0x16,0xa8,0x2c,0x26,0x1e,0xff,0x10,
+0xf3,0x93,0x7f,0x11,0xa2,0xe7,0x79,0xa0,0x2c,0x1e,0x6e,0xf7,
+0x3d,0xdd,0x2a,0x46,0xf2,0x22,0x03,0x91,0xc5,0xd0,0xc9,0x8c,
+0x89,0x90,0xc6,0x9c,0xb8,0x89,0x5a,0xbf,0xfe,0xca,0xf1,0x54,
+0x2a,0xe6,0x35,0x29,0x07,0x06,0x3e,0x9d,0x38,0xc9,0x27,0xc0,
+0x87,0x96,0x5c,0x6e,0xa6,0xe1,0xb7,0x4f,0x78,0x05,0x2d,0x67,
+0x04,0xc8,0xfb,0x8c,0xa9,0x6c,0x0c,0x94,0x42,0xac,0x9e,0xa6,
+0x4a,0x32,0x9d,0x19,0xc0,0x33,0xa1,0xf7,0x96,0xb0,0x0d,0x81,
+0xb8,0xca,0x5b,0x36,0x4a,0x08,0xb5,0xc5,0xa0,0x8a,0x25,0x02,
+0x61,0x76,0x19,0x8c,0x95,0xbb,0xbf,0xfe,0x1a,0x47,0xf7,0x95,
+0x0a,0x5b,0x1a,0x7e,0xfd,0x95,0xcf,0x08,0x9d,0x27,0x69,0xac,
+0x55,0xc6,0x9c,0xaa,0xc5,0xb2,0x64,0xcd,0x83,0x32,0x62,0x5e,
+0xf7,0x7a,0xd6,0xc5,0x33,0x4c,0x1e,0x38,0x09,0xec,0x5f,0x1d,
+0x1c,0x1f,0x43,0x41,0xfa,0x04,0x3c,0xd4,0xfc,0xfa,0x2b,0x4e,
+0xca,0xec,0xd8,0xe0,0xf6,0x69,0xdc,0xa8,0xaa,0x0b,0xef,0x2e,
+0xb7,0x28,0x9a,0xc6,0xc7,0x32,0x4b,0x8f,0x58,0x48,0xd5,0xde,
+0xb1,0xd2,0x26,0x04,0x13,0xf4,0x93,0x3c,0xe0,0xef,0x63,0x76,
+0x1f,0x07,0x2e,0x20,0x11,0x97,0xd8,0xab,0x49,0x2d,0x9b,0xe2,
+0xe0,0xf0,0xe8,0xe0,0xf8,0xc0,0x66,0xde,0xf8,0x1a,0x0a,0x3a,
+0xbf,0x10,0xc4,0xdb,0x36,0x14,0x82,0x92,0xeb,0xe8,0x9a,0x76,
+0x9e,0x4f,0x16,0x80,0xb7,0x71,0xf4,0x74,0x01,0x05,0x6a,0xb6,
+0xa6,0x65,0xeb,0xc6,0x07,0x7b,0xba,0x05,0xa5,0x40,0xa7,0xcd,
+0x95,0xa4,0x6b,0xe5,0x9a,0xb8,0x7f,0x6b,0x64,0xa2,0x99,0xa3,
+0xf2,0xce,0x12,0xcf,0xb8,0x63,0x95,0x9a,0xcc,0x04,0x9f,0xca,
+0x0c,0x0e,0x9a,0xfe,0x9d,0x53,0xbe,0xf3,0xe3,0xf8,0x07,0xfe,
+0x16,0x39,0xd1,0x97,0x8d,0xe3,0x61,0x76,0x1c,0xbf,0xd6,0x30,
+0xf2,0x3c,0x00,0xff,0x0d,0x0c,0x63,0x5d,0x4b,0x3b,0x97,0x19,
+0xbe,0x59,0x32,0xae,0xba,0xe3,0xd5,0x46,0x90,0x27,0x00,0xbb,
+0x60,0xe9,0xdb,0x5a,0x5c,0x97,0x6d,0x7d,0xf0,0x93,0x99,0x13,
+0xb4,0xae,0x88,0x13,0xbb,0x63,0xee,0x07,0xe6,0x69,0xc1,0xac,
+0xa6,0x01,0x4a,0x62,0x5e,0x3d,0xcf,0x6d,0x2d,0x35,0x9c,0xf1,
+0x18,0xe5,0x43,0xcf,0x8a,0x2b,0x20,0x2c,0x9e,0x74,0x55,0x5c,
+0xe2,0x9a,0xdc,0x43,0xaf,0x98,0x30,0xde,0xa1,0x02,0x64,0xbf,
+0xc4,0x44,0x7b,0xc4,0x2b,0xf3,0xbe,0x56,0xe6,0x5d,0xad,0x82,
+0xc7,0xb9,0x0a,0x9e,0xf4,0xd2,0x6f,0x1e,0xee,0xe5,0x2f,0x23,
+0xd6,0xd5,0x99,0x59,0xbd,0x5c,0x15,0x4d,0x17,0x3c,0x29,0x79,
+0x35,0x1d,0xcb,0x1a,0x87,0xbb,0x8f,0x7d,0x2a,0xdb,0x60,0x7f,
+0xaf,0x89,0x67,0xad,0xd2,0x2f,0x99,0x0e,0xa6,0xa5,0xfc,0x88,
+0x60,0xf0,0x5e,0x94,0xdc,0xb1,0x31,0xb6,0x5e,0x72,0x2c,0xbd,
+0x37,0x29,0x53,0x20,0x0a,0xe6,0x88,0xae,0xd7,0xca,0xc7,0xb4,
+0x74,0x18,0xd4,0x2d,0x44,0x36,0x1e,0x5a,0x3a,0xbd,0x85,0x59,
+0xb0,0x48,0x0b,0xf4,0x0c,0x99,0xa2,0x50,0x26,0xc8,0xcc,0x27,
+0xdb,0x14,0x00,0x32,0xd7,0xa6,0xad,0x8b,0x1a,0x9c,0x5e,0xa2,
+0xc0,0x8d,0x34,0x9f,0x1c,0x4e,0x65,0xf9,0x34,0x46,0x41,0x03,
+0x60,0x9f,0x10,0x40,0xcf,0x4c,0xc2,0x8a,0xec,0xa3,0x63,0xb2,
+0xb9,0x64,0x78,0x4a,0x92,0x50,0x96,0x4d,0x05,0x3e,0xa9,0xcb,
+0xa6,0x02,0xce,0x2e,0x05,0x55,0x22,0x96,0x19,0xfa,0xaf,0xc9,
+0x9c,0xaa,0x35,0xc9,0xf8,0x97,0x8f,0x93,0xcc,0x9d,0x63,0xfd,
+0x58,0xb3,0xf7,0x78,0xf9,0x32,0x51,0xda,0x1d,0xcb,0x78,0xa9,
+0xbe,0x59,0x87,0xa4,0xa4,0x98,0x77,0x92,0x78,0x7f,0xe2,0xd0,
+0x88,0x85,0x56,0xeb,0x0b,0x6a,0x93,0x5a,0x7f,0x48,0x48,0xe3,
+0x85,0xca,0x84,0x2c,0x78,0x8f,0x75,0x6c,0x33,0x9b,0x97,0x88,
+0x8c,0x78,0x88,0xa8,0x97,0x1b,0x65,0xd5,0xe0,0x2a,0xa3,0x9c,
+0xa9,0x65,0xc9,0x7b,0x99,0x81,0xd0,0x33,0x60,0x8a,0x2d,0x77,
+0x60,0xdc,0x53,0x36,0x44,0x40,0xbf,0xb4,0xcc,0xf6,0x45,0x84,
+0xe7,0x49,0xe9,0xd9,0x96,0x98,0x32,0x80,0xef,0x0c,0x22,0x7f,
+0xbd,0xb1,0x51,0xb6,0x5a,0x29,0xe1,0x37,0xbc,0xad,0x5b,0xee,
+0x4a,0x81,0x3e,0x54,0xf5,0xbb,0xcf,0xf0,0x0c,0xfe,0x68,0xcf,
+0x3b,0xc3,0x61,0x0d,0x3e,0xc3,0x56,0xaf,0xb4,0x76,0xe7,0x16,
+0xfa,0xb9,0xe6,0x6f,0xfc,0xdb,0x6c,0xa2,0x3f,0xad,0x0e,0xf4,
+0xe1,0x86,0x95,0x42,0x59,0xb3,0x75,0x7d,0xdb,0x36,0x71,0xb3,
+0x92,0xdb,0x9e,0xb1,0x67,0x2f,0x0a,0xef,0x77,0xcf,0xa1,0x5f,
+0xc8,0x9f,0x35,0xeb,0x8a,0x2d,0x51,0xac,0x2c,0xa0,0x62,0xfd,
+0xce,0x0a,0xa8,0x26,0x9c,0x86,0x24,0x8a,0xf9,0xa0,0xa7,0x86,
+0xcd,0x48,0x47,0x3e,0xc5,0x62,0x6e,0xa2,0x72,0xc0,0x9e,0x25,
+0xc1,0x58,0x56,0x16,0x35,0x98,0x45,0x01,0x8c,0x48,0xea,0x6b,
+0x9d,0xf2,0x7a,0x43,0x25,0x00,0x3f,0x2e,0x85,0xf8,0xc9,0x1c,
+0xb1,0x2f,0x63,0x79,0x3a,0x1f,0x75,0x8e,0xf3,0x59,0xa9,0x94,
+0x58,0xc9,0x39,0xfe,0xaf,0x4c,0x92,0xcb,0x7e,0x09,0x05,0x34,
+0x9a,0x51,0x14,0xc7,0xdb,0xd4,0x97,0x89,0xf5,0xc4,0x55,0xff,
+0x05,0x2a,0x9b,0x08,0xac,0xa6,0xd3,0x22,0x9d,0x4e,0xd1,0x8c,
+0xde,0x2c,0x6e,0x45,0x65,0x00,0xad,0x36,0x4f,0xb9,0x0b,0x73,
+0x59,0xfb,0x66,0x71,0xab,0x10,0xcc,0x53,0x04,0x12,0xc5,0xcd,
+0x5c,0x79,0x36,0x13,0xfe,0x93,0x79,0x37,0xf5,0xdf,0xf9,0xab,
+0x51,0x3c,0x40,0x1f,0x31,0x14,0x72,0x68,0x84,0xd7,0x8e,0xa7,
+0x0b,0xdc,0x79,0x58,0x5c,0xbb,0xc6,0x26,0x4a,0xe6,0x34,0xe5,
+0x12,0x4d,0x21,0xf8,0xb0,0xb9,0x5a,0x35,0xc1,0x27,0x2f,0x72,
+0x67,0x13,0xee,0x94,0xe7,0x53,0x56,0xfc,0xee,0xa5,0x2f,0x58,
+0x88,0x0a,0x4a,0x74,0x53,0xac,0x12,0xb8,0xe9,0xb2,0x78,0xa1,
+0x23,0x9e,0xc1,0xbe,0x5a,0x91,0x20,0xf2,0x91,0x00,0xf9,0x5b,
+0xe4,0xb6,0x9f,0xa6,0xc7,0xe4,0x8a,0x33,0x48,0xa2,0x60,0x46,
+0x49,0xc5,0x0a,0xc9,0xac,0x10,0x7d,0xa8,0x34,0x36,0xbb,0xed,
+0x76,0x7b,0x3a,0xb7,0x43,0xd1,0x68,0xba,0x1c,0x88,0x47,0xd6,
+0xf7,0xa1,0x52,0x08,0x21,0xa2,0xf0,0xcb,0x40,0xa2,0xa9,0xe3,
+0xfa,0x94,0x6d,0x46,0x6d,0x3b,0x04,0xbe,0x96,0x30,0x62,0x39,
+0x32,0x0e,0xa2,0x80,0x27,0xf0,0x67,0x46,0xdf,0xa9,0x13,0x93,
+0x90,0x16,0xd4,0x61,0x57,0x76,0xe4,0xfd,0xdc,0x4a,0x18,0x85,
+0x05,0xec,0x88,0x66,0x14,0xa5,0x27,0x0b,0xc9,0xe7,0xa7,0x1c,
+0x8b,0x11,0xa1,0x62,0x20,0x92,0x37,0x8b,0x6b,0x67,0x74,0xe6,
+0x4c,0x48,0xb5,0x32,0x88,0xbc,0x45,0xa5,0x76,0xd3,0xbe,0xc5,
+0x9c,0x1b,0x24,0xf4,0x0e,0xc6,0x7e,0xe0,0x55,0xd5,0xd8,0x0a,
+0x24,0x79,0x31,0x81,0xbe,0x22,0xa2,0x97,0x91,0xd1,0xf4,0xbb,
+0x38,0x0d,0xf3,0x13,0xec,0x39,0xba,0x71,0xee,0xa3,0xf8,0x13,
+0xb7,0x77,0x4e,0x63,0x7f,0xe2,0xc4,0x0b,0xed,0x25,0xae,0x28,
+0x84,0x1f,0x3b,0x1d,0x6e,0xba,0x88,0xc2,0xc6,0x8f,0x9d,0x0e,
+0xcb,0x47,0x93,0x40,0x32,0x8e,0x66,0x01,0xde,0x57,0x23,0x70,
+0x40,0xe3,0xa0,0x71,0x00,0x7e,0xc8,0xee,0x38,0x17,0x06,0x12,
+0x22,0x95,0xc5,0xf2,0x9f,0x90,0x60,0x28,0xe4,0x5a,0x48,0x7b,
+0x76,0x46,0x64,0xa6,0x52,0xb5,0x96,0x6e,0x1c,0x64,0xe2,0xd3,
+0x6a,0x05,0x1b,0xa9,0xf0,0x7a,0xa2,0x4c,0x8e,0x08,0x7b,0x63,
+0x41,0xf8,0xe1,0xe4,0x37,0xfc,0x03,0x9f,0xb9,0x12,0xf3,0x89,
+0xcc,0xa9,0x51,0xcc,0x2f,0xf7,0x5a,0x0a,0x30,0xdf,0xb8,0x64,
+0x0f,0x3f,0xa0,0xb6,0x79,0x9b,0x62,0x79,0xe1,0x4d,0xb3,0xb8,
+0xe3,0x09,0x89,0x66,0xb4,0x9a,0xd9,0x89,0x80,0x75,0x55,0xbd,
+0x20,0xa1,0x91,0x26,0x4a,0xb4,0x2f,0x0f,0xf5,0xb2,0xd5,0x37,
+0x55,0x6a,0x75,0xb6,0xce,0x3b,0x75,0x98,0x77,0xeb,0xb0,0xe8,
+0xd4,0x61,0xd1,0x4d,0x19,0x1c,0xcd,0x65,0xfe,0xc8,0x68,0xde,
+0x95,0x7f,0x2d,0xd4,0xb7,0x85,0xfc,0x46,0x27,0x53,0xf1,0xd7,
+0x5c,0xfc,0xbb,0x90,0xbf,0x03,0xed,0x2e,0x6b,0x66,0xe7,0x94,
+0xba,0xa7,0x5a,0x98,0xe7,0x1d,0xb5,0x92,0xc9,0xb2,0xe6,0xbc,
+0xd3,0x13,0x85,0x5d,0x4b,0x61,0x57,0x14,0x2e,0x2c,0x35,0x17,
+0xb2,0xe6,0xc2,0x52,0x73,0xd1,0x15,0x33,0x02,0xc9,0x41,0x88,
+0x97,0x88,0x44,0x33,0x4d,0x4c,0xa6,0xd0,0xc7,0x46,0x7b,0xe2,
+0x03,0x6f,0x3f,0x9a,0x77,0xd2,0x0f,0xac,0xcd,0xc9,0xb4,0x67,
+0x56,0x59,0xa4,0x55,0x58,0xc3,0xd1,0x22,0xad,0xb2,0x30,0xaa,
+0x3c,0x68,0x14,0xcc,0x19,0x05,0xf3,0x0e,0x3e,0x7d,0xc3,0xc0,
+0xfa,0x0c,0xd5,0x17,0x10,0xf4,0xa0,0x3d,0x7a,0xb4,0x10,0x74,
+0xe0,0xc6,0xc8,0x49,0xd4,0x37,0x44,0x00,0x95,0x6b,0x9e,0xfd,
+0xd0,0x0e,0x48,0x81,0xd2,0xc8,0x24,0xa5,0x0b,0x41,0x9a,0xc6,
+0x2b,0x5e,0x5f,0xa3,0xe4,0xc1,0x02,0xdf,0x35,0xe0,0x03,0xb3,
+0x2f,0xb2,0x82,0xf0,0xc2,0xcf,0x91,0xca,0x79,0x90,0xd9,0x74,
+0x35,0xd1,0xd1,0xb6,0xd8,0x66,0x14,0x78,0xf0,0x0d,0xcf,0xe3,
+0x93,0x7d,0x2c,0x21,0x0b,0xcb,0x35,0x66,0x1b,0x06,0xf3,0x69,
+0x04,0x5d,0x15,0x2a,0x01,0x74,0xb4,0xe4,0x43,0x25,0x60,0x2b,
+0x62,0xcb,0x96,0xa7,0xf7,0xac,0x73,0xdd,0x50,0x5a,0x85,0xce,
+0xbb,0x07,0x7d,0xd4,0xcb,0xe6,0x43,0xf1,0x2c,0x63,0x95,0x59,
+0xd5,0x53,0x87,0x8e,0xd1,0x9a,0x56,0xc5,0x15,0xa1,0x5d,0xeb,
+0x99,0xdf,0xfd,0x90,0x7d,0x2f,0x3e,0xed,0xf0,0xf5,0x6c,0xd1,
+0x55,0x35,0x10,0x53,0x57,0x61,0xea,0x1a,0x98,0xba,0xcb,0x31,
+0x99,0xd4,0x42,0x1f,0x7e,0x87,0x79,0x67,0x0f,0xf8,0xb2,0xb5,
+0x27,0x96,0xae,0x3d,0xb1,0x7c,0xed,0x61,0x03,0x0f,0x6a,0xad,
+0x61,0x73,0x3b,0x15,0x57,0x3e,0x8f,0xa4,0xe8,0xb1,0x39,0x34,
+0x37,0x18,0x23,0xe7,0x0f,0x07,0x94,0xb3,0x99,0xd1,0x2c,0x39,
+0xa8,0x4f,0x63,0xf5,0x12,0x18,0x9b,0xc1,0x7c,0x02,0x8b,0xf9,
+0x9b,0xca,0xfc,0x8a,0x8d,0x3e,0xac,0xad,0x69,0x13,0x56,0xcd,
+0xd7,0xcc,0x74,0xd5,0x26,0x6b,0xd1,0x54,0x4d,0x27,0x9e,0x3e,
+0x4f,0xe7,0x5a,0xb3,0x0f,0x59,0x38,0x6d,0x7e,0xce,0x03,0x8d,
+0xd8,0x87,0xb5,0xa5,0x13,0xb3,0xd5,0xb2,0xc9,0xb6,0x65,0x66,
+0x88,0x14,0xb7,0xc5,0x93,0xf3,0x59,0x5f,0x1c,0x24,0xcb,0xc1,
+0x3e,0xf7,0xa1,0xca,0xc0,0xe0,0xe5,0x4b,0x78,0xa1,0x9d,0x75,
+0x0b,0xe7,0xa4,0xd6,0xb2,0x6d,0x9e,0xad,0xa9,0xf0,0x12,0x27,
+0x7b,0x9c,0xad,0x66,0x5b,0xaa,0xd5,0xd7,0x8a,0xa6,0xac,0x8c,
+0x5e,0x12,0x67,0x5c,0x1b,0x88,0xe0,0x0c,0xdf,0x0d,0x8d,0x83,
+0x01,0x13,0xaa,0x45,0x07,0x1a,0xda,0x6c,0x50,0xb3,0x65,0xd1,
+0xcd,0x7c,0x7f,0xfc,0x44,0xfd,0xa2,0xb9,0x69,0x56,0x6e,0xb5,
+0x8c,0x73,0xa0,0xd0,0x1a,0xbe,0xc0,0x4e,0x34,0x8a,0x9d,0xc1,
+0xca,0x3a,0x09,0x3b,0xf8,0x55,0x2a,0x32,0x4e,0x6c,0x36,0xd4,
+0x7f,0xba,0xe3,0x65,0x8a,0x08,0x9b,0x6b,0xff,0x7d,0x6d,0xf8,
+0x07,0xad,0x0d,0xa9,0x1d,0xce,0x9c,0x27,0xba,0x4a,0xe1,0x8e,
+0xf9,0x13,0x84,0x50,0x49,0xeb,0x01,0x1b,0xd8,0x8d,0x34,0x54,
+0x8e,0x21,0x8b,0x42,0xea,0x87,0xe9,0xeb,0x5b,0xba,0x9e,0x31,
+0x98,0x0d,0xf5,0xda,0x28,0x25,0x1b,0x7d,0x44,0xd2,0x33,0x30,
+0xea,0xef,0xad,0x3d,0xac,0x19,0xb0,0x69,0x4b,0x88,0xcf,0x4f,
+0x7e,0xf0,0x79,0x58,0x72,0x0d,0x7b,0xa4,0x77,0xd8,0xc4,0x23,
+0x6a,0x57,0x7e,0x0e,0x2b,0x3d,0x2d,0x9c,0xef,0x78,0x08,0xf7,
+0xa4,0x12,0x13,0xe6,0x83,0x16,0x49,0xe1,0x49,0xe8,0x49,0x47,
+0x38,0x83,0x41,0x96,0xe0,0x09,0x3d,0xac,0x50,0x8c,0xa7,0x03,
+0x07,0x42,0x72,0x1f,0xb0,0x44,0x4f,0x82,0xad,0x6c,0x58,0x70,
+0x12,0x70,0x71,0x43,0x26,0xa7,0x63,0x6a,0xb0,0xda,0xa6,0x1b,
+0xa1,0x8d,0xef,0x9b,0x2c,0x67,0xf9,0xfc,0x89,0x66,0xb4,0x99,
+0x30,0x7f,0x5b,0xbb,0x0e,0x8d,0xd4,0xd7,0x96,0x7b,0xb9,0x69,
+0x35,0x93,0xc5,0x27,0xb2,0xc8,0x7b,0xb6,0xc8,0x5d,0x1d,0x3e,
+0x91,0x45,0xfa,0x96,0xd2,0x27,0xc2,0x05,0xaa,0xf2,0xa9,0x82,
+0x36,0x1d,0xf5,0xf3,0x59,0xc5,0x30,0x9b,0x79,0x24,0xa1,0x71,
+0xb4,0xa8,0xd6,0x32,0xd9,0xcd,0x15,0xfc,0xd4,0xac,0x7e,0x6b,
+0x56,0xe7,0x07,0x3b,0x19,0x27,0xc3,0x1e,0x21,0xad,0x14,0xa2,
+0x72,0xcb,0xea,0x72,0xab,0x87,0xb5,0xf2,0x2b,0x66,0x21,0xc0,
+0x09,0x8d,0xbf,0x5e,0xf6,0xa1,0xf2,0x42,0x61,0x62,0xc8,0x61,
+0x03,0xff,0x31,0x66,0xdd,0x37,0x7f,0x30,0x6e,0xf0,0xe2,0x17,
+0xbd,0xa2,0x56,0xd1,0xcd,0x5a,0xe1,0x9c,0x2b,0xa2,0x3a,0x2c,
+0xa3,0x1a,0xeb,0x43,0x48,0xe6,0xb4,0xb8,0xd7,0x17,0x4b,0xeb,
+0xcb,0xdc,0x54,0xc5,0x38,0xf6,0x4a,0x39,0x17,0x4d,0x26,0xe8,
+0xf9,0xc6,0x7b,0xca,0xc5,0x28,0x6e,0x32,0x28,0x52,0x9f,0xa6,
+0xfe,0xc4,0x82,0x5d,0xdc,0xf2,0x4e,0x37,0x43,0xdc,0x2c,0xcf,
+0x94,0xe9,0x67,0x4f,0xcd,0xaa,0xab,0x4b,0x52,0x68,0x0a,0xd6,
+0x99,0xa2,0x4f,0x5a,0x44,0xb0,0x2e,0x6b,0x1c,0xab,0xab,0x16,
+0x8d,0xb5,0x5e,0xd5,0xfe,0x79,0xde,0xde,0x42,0x04,0x38,0xd3,
+0x5d,0x34,0x77,0x78,0xea,0xbd,0xda,0x85,0xd5,0x57,0xb0,0xe8,
+0x99,0x33,0x99,0x17,0x22,0xae,0xd4,0xed,0xa7,0x6b,0x5d,0x70,
+0xea,0x4f,0x7c,0x17,0xee,0xfc,0x09,0x0c,0xc8,0xd8,0xb9,0xf3,
+0xd5,0xd3,0x82,0xca,0x64,0xac,0x76,0x72,0xf1,0x65,0x03,0x4c,
+0xab,0x6d,0x0d,0x5a,0xd0,0x85,0xcf,0x50,0xf8,0xe4,0xdb,0x2a,
+0x0f,0xc3,0x89,0xa1,0x35,0xbc,0xfa,0xe2,0xe1,0x22,0x3f,0x99,
+0x56,0x0b,0x5a,0xac,0x65,0x37,0x9b,0x8c,0xfb,0x29,0x13,0x26,
+0x50,0xe2,0x8d,0x2b,0xf1,0xbd,0x49,0xfc,0x96,0x97,0x7b,0xb5,
+0x71,0xea,0x6c,0x1b,0xe3,0x34,0x7b,0xf2,0x38,0xb5,0x9f,0x34,
+0x3c,0xce,0x5c,0xe0,0x81,0x46,0xf1,0xf0,0xb4,0xbf,0xe6,0x90,
+0x34,0xfe,0xf9,0xc7,0xa4,0xbd,0x63,0x8c,0xc9,0x70,0xb5,0x31,
+0xc9,0x76,0xd4,0xc6,0x9b,0xff,0xe0,0x7e,0x75,0x8d,0x7e,0x0d,
+0x9e,0xd6,0xaf,0xec,0x00,0xfe,0x13,0x74,0x2d,0xb3,0xa7,0xff,
+0x3c,0xef,0x0c,0x6e,0xf6,0x8d,0x57,0xba,0x97,0xf7,0x70,0xd1,
+0x68,0x64,0xe7,0x16,0xbc,0xd4,0x67,0x95,0xfe,0x16,0x62,0x81,
+0x68,0x77,0xfe,0x51,0x42,0x6c,0x99,0x62,0xf6,0xf0,0x11,0xd8,
+0x80,0xce,0xca,0x6c,0xfc,0x68,0x61,0xe3,0x9b,0xc7,0xb2,0x51,
+0xea,0xab,0x1a,0x1b,0x5f,0xf5,0xf5,0x87,0x26,0x73,0xfc,0xcc,
+0x79,0x60,0x6d,0xbc,0xfd,0xe7,0x61,0xad,0xe6,0x71,0x5c,0x5d,
+0x42,0xc7,0x16,0xd6,0x1e,0x1a,0xac,0x9d,0x1b,0xde,0x7f,0xd1,
+0xf2,0x3c,0x27,0x94,0x73,0x8b,0x50,0x6a,0x27,0xaf,0x27,0xb0,
+0xe7,0xa9,0xb1,0x25,0x8f,0x11,0xc3,0x95,0xf9,0x14,0x58,0xf8,
+0x74,0xb0,0x02,0x9f,0x72,0x52,0x37,0x57,0x52,0xe7,0x1a,0x6f,
+0xb8,0x9b,0x5e,0x6f,0xf3,0x78,0xfa,0x5f,0x3b,0xf3,0xee,0x4c,
+0xe6,0xa5,0x27,0x2f,0xee,0x6b,0x2d,0xed,0x93,0x16,0xc9,0x54,
+0x2d,0xa1,0x50,0x8b,0x10,0xaa,0xae,0x4c,0xd7,0xa2,0x92,0x3b,
+0x29,0xda,0xe8,0x90,0x6e,0x65,0xe5,0x40,0x13,0x96,0x99,0xaa,
+0x69,0xf4,0xd2,0x2d,0xc7,0xf5,0xdc,0xa7,0x6e,0xbd,0x08,0x7a,
+0x91,0x87,0x16,0x96,0x23,0x05,0x2c,0xdd,0x7e,0x55,0xe1,0x93,
+0x2b,0xef,0x78,0x7a,0x75,0x4e,0x0b,0xc5,0x5b,0x9d,0x2b,0xbf,
+0xe5,0x45,0x7d,0x35,0x3e,0x15,0x0e,0x44,0xd1,0x78,0x3d,0x96,
+0xb2,0x7b,0x93,0xb2,0x1f,0x8c,0xf9,0x17,0x65,0x27,0x20,0xfb,
+0xb8,0xd0,0x22,0x93,0xd2,0x8f,0x9e,0xb1,0x5d,0xf4,0xd6,0x54,
+0x91,0x0d,0x87,0x0d,0xc5,0x62,0x90,0xc1,0x20,0x0b,0x12,0xe7,
+0xfe,0x97,0x64,0xea,0xb8,0x66,0x64,0x8c,0x34,0x08,0xf5,0x4c,
+0xa1,0xca,0xdf,0xa1,0x5c,0x0c,0x60,0x03,0x16,0xca,0x12,0x24,
+0x62,0x89,0x0d,0x0b,0x47,0xd6,0xf9,0x83,0x15,0x85,0x5d,0xe3,
+0x65,0xce,0x60,0x04,0x06,0x41,0xe6,0x2b,0xed,0xda,0xe9,0x53,
+0x01,0x99,0x75,0x8d,0x77,0xdc,0xf5,0xb7,0xac,0xd5,0xb2,0x66,
+0xda,0x9b,0xb2,0x6b,0xdb,0xbc,0xcc,0x69,0x36,0x4f,0x4f,0x71,
+0xb2,0x18,0x4d,0x07,0xa5,0xdd,0x31,0x7c,0x72,0x1c,0xcd,0xc6,
+0x46,0xd1,0x3e,0x8e,0xff,0x53,0xca,0x93,0x51,0x61,0x00,0xaf,
+0xac,0xc7,0x47,0x51,0x67,0x60,0x86,0x69,0x1b,0x85,0x59,0x01,
+0x29,0x60,0x95,0xce,0xac,0x87,0xa5,0xb6,0x3a,0xc3,0xc0,0x64,
+0xc6,0x40,0xa9,0xf5,0x1b,0xfa,0x50,0xa4,0xf7,0x1a,0x6b,0xf9,
+0x62,0x50,0xd3,0xbc,0xb8,0x2b,0xef,0x17,0x91,0xb6,0x61,0x44,
+0x0b,0xd8,0xc0,0x49,0xf2,0x65,0xba,0xef,0xc0,0x9c,0xac,0x6f,
+0xfe,0x89,0x26,0xeb,0x17,0xcc,0xc8,0xec,0x1c,0x9f,0xe3,0x3d,
+0xf7,0x8c,0xdc,0xbe,0x42,0xb1,0x4d,0xbf,0xb1,0x97,0x22,0xd5,
+0xf7,0xdc,0xd4,0x7e,0x65,0x1c,0x91,0x57,0x9a,0xd3,0xc6,0x94,
+0xc5,0x86,0xaa,0xec,0x8a,0x87,0xbe,0x4a,0x68,0xcd,0x6f,0xe8,
+0xcd,0xd7,0xb2,0xd2,0xae,0x4d,0xe5,0x22,0x49,0x36,0x97,0xef,
+0x65,0xcb,0x8a,0x5d,0xf4,0xe7,0xe9,0x44,0x34,0x57,0x0c,0xa6,
+0x35,0x1a,0xf3,0x3a,0x5d,0x1c,0x18,0x63,0xf3,0xcc,0x40,0xb9,
+0xfa,0x26,0x5d,0xb2,0xb2,0x0b,0x84,0x75,0xc5,0xe1,0x68,0x1b,
+0x8d,0xcc,0xd9,0x09,0xff,0xb7,0x30,0x39,0x20,0xe0,0x06,0x79,
+0x40,0x5c,0x1a,0xb2,0xdc,0xca,0xac,0x48,0xff,0x7d,0x29,0xb0,
+0x2d,0x05,0xc4,0x5c,0x0a,0x8e,0x0a,0xf4,0x66,0x96,0x63,0xe0,
+0xf1,0xdb,0xae,0x75,0xe7,0x41,0x71,0xfb,0x8f,0xdd,0x78,0x8d,
+0x89,0x65,0x99,0x43,0x05,0x9b,0xeb,0xc3,0xd7,0xa3,0x80,0x33,
+0x06,0xf7,0xd5,0x57,0x7d,0x7d,0x91,0x32,0x17,0xa4,0xdc,0x82,
+0x60,0x6e,0x99,0x2b,0xca,0xf3,0x7f,0xbb,0x1a,0xc1,0x7f,0x9f,
+0xee,0xd9,0xe9,0xfe,0x37,0x73,0xba,0xb7,0x8b,0x77,0x7e,0x45,
+0xad,0x05,0xd8,0x62,0x43,0xb0,0xb8,0x4b,0xfe,0x56,0x59,0x36,
+0xb3,0x2d,0x3d,0x31,0x76,0x73,0x43,0x82,0x1e,0x39,0xeb,0x2c,
+0x13,0xe8,0x4f,0xd3,0x99,0x53,0xc1,0xc8,0x45,0xca,0x3d,0x69,
+0xac,0xff,0xe3,0xcd,0x02,0x7f,0x59,0xae,0x12,0x3e,0x66,0x38,
+0x8d,0xcd,0xc4,0xe4,0x5e,0x81,0xb2,0xb5,0x6c,0x34,0x2d,0xbc,
+0xc5,0x05,0xc9,0x90,0x0e,0xee,0x2b,0x30,0x16,0x7b,0x43,0x04,
+0x1e,0xd6,0x32,0xcb,0xea,0xc3,0x5a,0xb1,0xf2,0x93,0x1d,0xe3,
+0xff,0x8a,0x07,0x77,0x64,0x2e,0x02,0xdf,0x7d,0x35,0xf5,0x3f,
+0xb7,0x64,0x8c,0xac,0x4b,0x46,0x7d,0x15,0xbb,0x78,0x8a,0xb7,
+0x56,0xbc,0xc4,0x7c,0xb7,0x0c,0xff,0x4a,0x76,0x62,0x6d,0x77,
+0x79,0xb2,0x51,0xef,0xeb,0x2f,0xd5,0xef,0xcc,0x51,0x3a,0x35,
+0x7f,0x9e,0x3c,0x61,0xd0,0x32,0xe8,0x57,0x1b,0x1a,0x1b,0xdb,
+0x4f,0x57,0x67,0xbb,0xf0,0xd4,0x15,0xe3,0x3a,0x79,0xc2,0x10,
+0x3e,0x7c,0xc5,0x19,0x18,0x3d,0x79,0xf6,0x61,0xcd,0x68,0x61,
+0xf7,0x73,0x3e,0x71,0x66,0xfe,0x6e,0x0e,0xf2,0xc3,0xd7,0x3f,
+0x98,0xe3,0x9a,0x6a,0x9a,0xc4,0xf0,0xd5,0x10,0xfd,0xee,0x24,
+0x2f,0x19,0xe2,0x95,0x11,0xcb,0x67,0x3f,0x4e,0xe8,0x2f,0x7e,
+0xa2,0x0e,0x98,0x0d,0xeb,0xb1,0x00,0x36,0xcc,0x4e,0xbd,0x86,
+0x46,0x07,0xf6,0x94,0x5b,0xa9,0xd4,0x4c,0xe7,0xdb,0x74,0x8f,
+0xdf,0x2b,0xe6,0xd6,0x90,0x3b,0x2b,0x1a,0x27,0x45,0x06,0x81,
+0x7a,0x63,0xbb,0x06,0x8b,0x41,0xf6,0x78,0x6b,0x93,0xc2,0x87,
+0x1c,0xfe,0x22,0x35,0xd5,0x50,0x52,0x45,0x43,0x2f,0x0d,0x05,
+0x55,0x3f,0x89,0x3e,0xe4,0x62,0xdb,0xf5,0xf3,0x4e,0xc9,0x59,
+0x47,0x8f,0x30,0xcf,0xde,0xbf,0xe4,0xc1,0x54,0x7e,0x3e,0xd8,
+0x3c,0x7d,0xe1,0xca,0xa6,0xfe,0x20,0x44,0x76,0xfc,0xfa,0x38,
+0x82,0x26,0x18,0xe4,0x07,0xb9,0x6d,0xd7,0xa1,0x41,0x97,0x9f,
+0xac,0xa5,0x21,0xab,0x6c,0xa5,0x4c,0xf7,0xf3,0x67,0x89,0xaf,
+0x45,0x68,0xc7,0x62,0x1c,0x29,0xc0,0x96,0x33,0x20,0x48,0x89,
+0xcf,0x99,0x4c,0x4a,0xd1,0xe4,0x68,0x92,0x06,0xa0,0x21,0x0b,
+0xf0,0x2f,0x44,0xba,0xca,0x69,0x53,0x93,0x47,0x86,0xa7,0x26,
+0x41,0xb5,0x02,0xeb,0x0c,0xb1,0x49,0xe9,0x4a,0xc6,0x15,0xdb,
+0xa4,0xc1,0xff,0x31,0x0e,0x14,0xd1,0xb9,0x64,0x3a,0xd9,0xe6,
+0xe6,0xe3,0x0e,0x81,0xa5,0x33,0x6c,0x29,0x79,0x59,0x8d,0xfc,
+0x1b,0xc1,0xcb,0xdf,0x57,0xe0,0xa2,0x29,0xfb,0x8b,0x81,0xfe,
+0x7b,0x85,0x7e,0x17,0x29,0x20,0x85,0xc7,0xd6,0x07,0xeb,0x71,
+0xb3,0xfd,0x5f,0xed,0x71,0xb3,0x65,0xee,0x67,0xaf,0x1f,0xed,
+0x5d,0x14,0x91,0x6b,0x1a,0xc2,0xb2,0xb6,0xf9,0xcf,0x25,0xa9,
+0x48,0x54,0x3c,0xdc,0x6a,0xb1,0x9f,0x86,0x8f,0x4d,0xf7,0x8f,
+0x31,0xc2,0x04,0x35,0xa5,0x31,0x34,0x31,0x63,0x42,0xf5,0x9b,
+0x6c,0x24,0xdf,0xb3,0x67,0x1a,0x54,0x3e,0x94,0xaf,0x56,0xd6,
+0xa8,0xda,0x2d,0x65,0x32,0x82,0xf4,0xe2,0xb9,0x36,0xf2,0xdf,
+0xb0,0x0f,0x35,0xbb,0xfa,0x52,0x18,0x43,0x97,0x76,0x46,0x89,
+0xe2,0x9f,0xa4,0x7e,0x14,0x28,0x19,0x22,0xc7,0x77,0xbe,0x60,
+0xb9,0x3d,0xd2,0x12,0x62,0xc2,0x95,0x0d,0x96,0x02,0x48,0xfe,
+0x9c,0x4d,0xa1,0xaf,0xf3,0x5a,0x74,0xfc,0x75,0x36,0x65,0x83,
+0xf8,0xbe,0x07,0xdf,0x64,0x0a,0x7a,0xab,0x6f,0xe8,0xe9,0x5e,
+0xbe,0xcc,0x80,0x91,0xdd,0xeb,0xd9,0xe0,0xd9,0x12,0x2c,0xe8,
+0x16,0x8a,0x0d,0xf0,0x33,0x56,0x8a,0x9c,0xd1,0x2b,0x3d,0x4a,
+0x23,0xb4,0x8a,0xb2,0x66,0xe8,0x6f,0xfc,0x5b,0x13,0x6b,0xb1,
+0x93,0xc1,0x82,0xa6,0xaf,0xa1,0x41,0x71,0xf6,0xd3,0x2f,0x82,
+0xee,0xfc,0xe6,0x5e,0xbc,0xd1,0xae,0x68,0xaf,0xcb,0x6f,0x87,
+0xb2,0x64,0x0e,0x1b,0x7d,0xf0,0x53,0xd1,0x30,0xad,0x39,0xd6,
+0x2d,0x54,0x1c,0xf0,0x35,0xb0,0x6f,0x66,0xd3,0x65,0x7b,0x57,
+0x41,0x5e,0x2a,0xbb,0x22,0x23,0x84,0xd9,0x32,0x2e,0x32,0x12,
+0x00,0xdf,0x7c,0x21,0x49,0xe2,0x8c,0x48,0xb5,0x22,0x56,0x26,
+0x51,0xa9,0x09,0x07,0xdc,0x38,0x89,0x39,0xfa,0x1c,0x0a,0xd7,
+0xe7,0x17,0xcd,0x4a,0x4d,0xc7,0x91,0x4e,0x95,0x2c,0x37,0x33,
+0x7b,0x57,0x66,0xb7,0x7e,0x9c,0xa6,0xf0,0xb5,0xfb,0xf1,0xe6,
+0xfc,0xfa,0xfa,0xfc,0xf4,0x51,0x5d,0x29,0x66,0xf9,0x0a,0x5b,
+0xbe,0x65,0xc7,0x5f,0x40,0x43,0xc7,0x99,0x3d,0x4d,0x0c,0xd2,
+0xad,0xd6,0xc2,0x4c,0xa5,0x2a,0x15,0xd9,0xa5,0xd9,0x4e,0x3d,
+0x30,0x9a,0x30,0x3a,0x54,0x64,0xb4,0x2e,0x1e,0xa5,0xa2,0x1a,
+0x0b,0x68,0xd8,0x15,0x89,0x9c,0x69,0x32,0xaf,0x44,0xac,0xae,
+0x46,0x2c,0x51,0x24,0xbe,0x5c,0x95,0x48,0xbb,0x6e,0xd9,0x7d,
+0x2c,0x02,0xb6,0x7e,0x16,0xc1,0xc4,0xa1,0xee,0x98,0x65,0x31,
+0x9d,0x85,0x5e,0x73,0xbd,0xd6,0x5b,0x5b,0x65,0x8f,0x5b,0xbe,
+0x5f,0x0f,0xb2,0x41,0x36,0xcf,0x87,0xf9,0x20,0x1b,0x63,0x91,
+0x13,0xe7,0x09,0x9d,0xf4,0x47,0xe4,0xd9,0xc9,0xa4,0x15,0xd2,
+0xd0,0xe7,0x6f,0xbc,0xc8,0x74,0x3c,0x05,0x79,0x66,0x60,0x43,
+0x2b,0x51,0xb9,0x67,0x60,0x59,0x5a,0x1d,0xe5,0xfb,0x5e,0x96,
+0x46,0xa7,0x28,0xb1,0x8f,0x0c,0xa0,0xaa,0x40,0x25,0xcd,0x99,
+0x93,0x8d,0x47,0x7c,0x4c,0x32,0x96,0xd5,0x0c,0x2a,0xf6,0x61,
+0xd4,0x47,0xa5,0x23,0xaf,0xbc,0xbc,0xea,0x4b,0xcf,0xbf,0xbc,
+0x00,0xf3,0x87,0x61,0x5c,0x79,0xca,0x58,0x6d,0x30,0x25,0xe2,
+0xc9,0x03,0x93,0xe2,0xfc,0x13,0x33,0x26,0x29,0x02,0xbf,0x42,
+0x86,0xa4,0x4f,0x64,0x91,0x1f,0xdd,0x8d,0x0d,0xed,0xd7,0x9f,
+0x39,0xba,0x79,0xe5,0x5e,0xa4,0x4b,0x3c,0x50,0x6f,0x26,0x5c,
+0x11,0x9a,0xcd,0x8d,0x88,0x0f,0x2a,0x24,0x84,0x26,0xd0,0x67,
+0x99,0xf8,0x58,0x52,0xcc,0xa3,0x03,0xb8,0xc2,0x37,0x24,0x9c,
+0x40,0xab,0x8b,0xd7,0x7f,0x4e,0xfc,0x90,0xc0,0x61,0xec,0xdc,
+0xe3,0x3e,0x75,0x45,0x78,0x42,0xe3,0x31,0xa5,0xd3,0xbd,0x56,
+0xeb,0x8e,0x76,0xda,0xed,0x66,0x48,0x68,0xcb,0x8b,0xdc,0x84,
+0xfd,0xec,0x36,0x66,0xa3,0x16,0xc5,0x8c,0x98,0xdb,0x8d,0xce,
+0x66,0x73,0x4c,0x27,0x2c,0xbb,0xf5,0x3e,0x04,0x11,0x85,0x68,
+0xc8,0x12,0x0f,0x92,0x04,0x9c,0xe9,0x34,0x81,0x59,0x22,0xd2,
+0x66,0xca,0x94,0xd4,0x09,0x21,0x70,0x7d,0x74,0x79,0xda,0x67,
+0x79,0x2a,0x59,0x4b,0x94,0x24,0x98,0x8d,0x77,0x0f,0x88,0x3b,
+0x8e,0xa0,0x41,0xa0,0xf2,0x33,0xa9,0xb6,0x9d,0x9f,0x49,0xf5,
+0x4d,0x05,0xcb,0xaf,0x55,0xca,0xd9,0x68,0x46,0xa7,0x33,0x0a,
+0x49,0x34,0x21,0xd4,0x9f,0x90,0x04,0xb1,0x4d,0xf8,0xfb,0xf2,
+0x51,0x38,0x0c,0x7c,0x97,0xf2,0xe4,0xd2,0x22,0x87,0x6d,0x4c,
+0x86,0x24,0x66,0xcf,0x2d,0x39,0x83,0xe8,0x8e,0x34,0x05,0x16,
+0x5e,0xc9,0x0f,0xb9,0xda,0x2a,0x2b,0xa4,0xd0,0x58,0x95,0x25,
+0xc4,0x8e,0x67,0x21,0xbe,0xbb,0x07,0x77,0x14,0x49,0x84,0x71,
+0x74,0x4f,0xee,0xc4,0x3b,0x44,0xd7,0xec,0x59,0xb6,0x41,0x40,
+0x60,0x40,0x82,0xe8,0x1e,0xc2,0xe8,0x1e,0xfb,0x9a,0xf0,0x26,
+0x2a,0x89,0x24,0x95,0xbd,0xe9,0xc3,0xeb,0x37,0xf3,0xa3,0xd3,
+0xbc,0x3a,0x38,0x39,0xc4,0x21,0xc2,0xb5,0xbe,0xda,0x5e,0x03,
+0xa8,0xfc,0x5a,0xd9,0x83,0xca,0xcf,0xb3,0xee,0xb6,0xbb,0x53,
+0xa9,0xe3,0xe7,0xca,0x7f,0xf9,0xdf,0xfe,0x2f,0x2a,0x58,0xe2,
+0xc8,0x92,0x17,0x5d,0x59,0xf2,0xbf,0xf9,0x5f,0xb3,0x92,0x01,
+0x2f,0x69,0xb7,0xdb,0x2f,0x44,0xc9,0xcf,0x94,0x15,0xb8,0xaa,
+0xc0,0x95,0x05,0x43,0x56,0xe0,0xa9,0x02,0x4f,0x16,0xc4,0xac,
+0x80,0xa8,0x02,0x47,0x16,0x84,0xac,0x60,0x28,0x0b,0x06,0x6d,
+0x51,0xf0,0xff,0xfd,0xbf,0xb2,0x82,0x91,0x2a,0xe8,0xc8,0x82,
+0xff,0x1b,0x2b,0x18,0x0b,0x7a,0xb7,0xba,0x5b,0x12,0x15,0xff,
+0x01,0xd5,0xb3,0x93,0x1a,0x42,0xf8,0xaa,0xb1,0x81,0x84,0xb8,
+0x63,0x55,0x3f,0xca,0xae,0x76,0x76,0x65,0x57,0xff,0xf3,0xff,
+0x8e,0x95,0x7c,0x52,0x25,0x6d,0x55,0xf2,0xbf,0x62,0x25,0x81,
+0x2c,0x51,0x7d,0xfd,0x2f,0xff,0xf9,0x7f,0xc9,0x4a,0x26,0xaa,
+0xce,0x96,0x2a,0xf9,0xcf,0xac,0x24,0x94,0x25,0x9b,0x69,0x9d,
+0xff,0x37,0x2b,0x89,0x44,0xc9,0xe6,0x40,0xf2,0xe1,0xbf,0xfc,
+0x8f,0xff,0x4f,0x56,0x32,0x55,0x25,0x03,0x55,0xf2,0xff,0x62,
+0x25,0xbf,0x29,0x0a,0x52,0xda,0xfe,0x67,0xac,0x24,0x56,0x75,
+0x54,0x3b,0xff,0x23,0x6f,0x27,0x51,0x25,0x9e,0x2a,0xf9,0xff,
+0xb0,0x12,0xaa,0xa8,0x4e,0x69,0xfb,0xdf,0xb3,0x92,0x99,0x2c,
+0xe9,0xa6,0xfd,0xf9,0x3f,0xb1,0x92,0x3b,0xd5,0x9f,0xb4,0xe4,
+0xff,0xce,0x4a,0xee,0x55,0x9d,0x14,0xdb,0xff,0x85,0x95,0xcc,
+0x15,0xd5,0x4a,0xac,0xfe,0xf3,0xff,0x9c,0x95,0x2c,0x44,0x49,
+0x77,0x47,0x61,0xfb,0x1f,0x78,0x3b,0x7f,0x57,0x25,0xdb,0xaa,
+0xe4,0xff,0xcc,0x4a,0x7e,0x17,0x43,0xba,0xe9,0x4a,0x1e,0xfc,
+0xff,0x38,0x0b,0x3e,0xab,0x2a,0x8a,0x39,0xff,0xc3,0xff,0x81,
+0x95,0x3c,0x48,0x29,0x70,0x36,0xa5,0x00,0xfd,0x1f,0x59,0xc1,
+0x1f,0x4a,0xb2,0x9e,0x57,0x80,0x17,0xfc,0x3f,0x2a,0xa6,0x79,
+0x43,0x4d,0xa4,0xf7,0xdf,0x03,0x4f,0x2e,0xc2,0x1e,0x0c,0xa9,
+0xee,0xdb,0x40,0xae,0x0c,0x90,0x37,0x50,0x7d,0x7f,0xc5,0x12,
+0x56,0xd7,0x2c,0xc0,0x87,0x33,0xea,0x8e,0x0d,0xf8,0x2d,0x0b,
+0xd4,0x5b,0x3f,0x0c,0xfd,0xc4,0x84,0x3b,0x00,0x3c,0xcf,0x6e,
+0xdb,0xa0,0x71,0x75,0x31,0x81,0x2f,0x0b,0xc1,0x0e,0x9c,0xd0,
+0xf1,0x7c,0x27,0x34,0xc0,0xff,0x6a,0x01,0xff,0x8e,0xc4,0x93,
+0x0c,0xd8,0xf7,0x16,0xb0,0x63,0xea,0x04,0x59,0x74,0x3f,0x59,
+0xe0,0xce,0xa2,0xf8,0x9e,0x8c,0x7c,0x27,0x3c,0x74,0x72,0x5d,
+0x3b,0x62,0x5d,0xdb,0xb1,0xad,0x63,0xd3,0x3c,0xf4,0xbf,0xdb,
+0xe0,0xee,0x89,0x97,0x85,0x7b,0xc7,0xb0,0x3e,0xb7,0x42,0xfb,
+0x49,0x62,0xc0,0xf6,0x6d,0x3d,0xbb,0x3a,0x3f,0x71,0xa8,0x6f,
+0x74,0xad,0xb5,0xaf,0xb6,0xc9,0x77,0x24,0x98,0x92,0x58,0xec,
+0x8f,0xd2,0xf0,0x05,0x68,0xfb,0x0a,0xea,0x80,0x96,0xb1,0x3a,
+0x8c,0x9d,0xd0,0x0b,0x48,0x5c,0x07,0xd7,0x99,0xd2,0x59,0x2c,
+0x34,0x7c,0x12,0x34,0x1d,0xcf,0x63,0x6f,0x73,0x9c,0xf8,0x09,
+0x25,0x21,0x89,0xab,0x76,0x78,0xd4,0x9b,0xd9,0xfe,0x8c,0xa9,
+0x13,0xf4,0x46,0x86,0xc3,0x55,0x5a,0x89,0xc9,0x24,0xba,0x23,
+0x5f,0xd2,0x10,0x7f,0x52,0xa5,0x4a,0xee,0x52,0x43,0x1e,0xb9,
+0xc3,0xc4,0x80,0x88,0xf3,0x50,0xbe,0x59,0x98,0xfb,0xc4,0xcd,
+0x78,0xe4,0xae,0xc9,0x75,0x8c,0x0f,0x22,0x2f,0x96,0xb2,0x3e,
+0x09,0x3c,0x09,0x8d,0xa6,0x17,0x71,0x34,0x75,0x46,0xec,0x95,
+0xd2,0x1a,0xe4,0xbf,0x29,0x4c,0x9c,0x92,0x37,0xb3,0x01,0x6e,
+0x8d,0xe9,0x91,0x36,0xa3,0xc4,0x68,0xa4,0xfb,0xe1,0x98,0xc4,
+0x3e,0x4d,0xaa,0x2e,0x66,0x42,0xab,0x03,0x4f,0xd0,0xc6,0xfb,
+0xa1,0x80,0x86,0x55,0xc3,0x28,0xe8,0x46,0x61,0x42,0xe3,0x99,
+0xcb,0x9f,0x67,0x62,0x15,0xb9,0xba,0x04,0x30,0x4c,0x2d,0x9e,
+0x3c,0xb9,0x36,0x09,0x69,0xfa,0x09,0xa1,0x18,0xb8,0x01,0x15,
+0x92,0x7b,0x18,0x32,0xaa,0x5a,0x2d,0xec,0xf3,0x00,0x93,0x7f,
+0xf8,0x09,0x0c,0xe2,0xe8,0x13,0xc1,0xb7,0xf7,0x08,0x32,0xb8,
+0xc2,0x9e,0xd0,0x9c,0x25,0x04,0x7c,0x2a,0x13,0xe1,0xcb,0xe7,
+0x17,0x9b,0x5a,0x7f,0x92,0x37,0x51,0xe0,0xbd,0x61,0x55,0xab,
+0x32,0x19,0x5c,0x9a,0x16,0x03,0xf3,0xbf,0x41,0x7f,0xe5,0x2c,
+0x71,0x3d,0x51,0x8d,0x04,0x25,0x69,0xfe,0x92,0xa9,0x13,0x72,
+0x9b,0x02,0x09,0x9a,0x7e,0x18,0x92,0xf8,0xdd,0xf5,0xe9,0x09,
+0xf4,0xa1,0x32,0x26,0x41,0x10,0x61,0x12,0xb8,0xc0,0x63,0x27,
+0x1d,0xc4,0x6b,0x24,0x9e,0x23,0x41,0x4d,0x36,0x71,0xdf,0x81,
+0x3e,0x22,0xe0,0xc7,0xe2,0x1f,0x7c,0x8f,0x1f,0xa1,0xf0,0x0b,
+0x4b,0x7a,0x37,0x8c,0x42,0xfa,0x83,0x4a,0xcd,0x37,0x88,0x04,
+0x4a,0x56,0xb5,0x6b,0xad,0xca,0x5a,0xe3,0xc2,0x6d,0xb4,0x26,
+0x84,0xe1,0xbe,0xc3,0xec,0x71,0xf7,0x5d,0xc6,0x7a,0xc4,0xc3,
+0x1f,0x9c,0x93,0xa7,0x09,0xfe,0xab,0xc7,0x4a,0xd2,0x9c,0x6b,
+0xb2,0x34,0xfd,0xa2,0x20,0x8e,0xd1,0x72,0x7e,0x97,0x26,0x0e,
+0xd6,0x3e,0xf5,0x0c,0x89,0xf3,0xc8,0xfc,0x7c,0x58,0x8d,0x06,
+0x1f,0xeb,0x40,0x82,0x74,0x6c,0x7c,0xe8,0x43,0x34,0xf8,0xa8,
+0x9d,0x1f,0x85,0xe9,0xd2,0x4f,0x93,0xa6,0xb3,0x2c,0x60,0x83,
+0x8f,0xec,0x0c,0xd1,0xef,0xb3,0xea,0xa2,0x3b,0xbe,0x14,0x41,
+0xf1,0xbb,0xd1,0xc9,0x08,0xba,0xca,0x54,0xa1,0xe6,0xa8,0x3b,
+0x66,0x27,0xb2,0x9f,0x67,0xc3,0x61,0x1b,0xa3,0xcc,0xcc,0x59,
+0xa2,0x30,0x21,0xdc,0x2b,0x09,0xd7,0x61,0x87,0x39,0xad,0xe6,
+0x80,0x54,0x6a,0x6b,0xc0,0xfe,0xf7,0xf9,0xb3,0x01,0xeb,0x76,
+0xb3,0xb0,0xee,0xf3,0x42,0x58,0x27,0x07,0x3b,0x2c,0x82,0xf5,
+0x72,0x78,0xbd,0x42,0xbc,0x5e,0x0e,0xaf,0xe7,0x16,0xc1,0x92,
+0x76,0x16,0x96,0xec,0x14,0xc2,0xee,0xe6,0x60,0x59,0x06,0x03,
+0x9d,0xe3,0xcc,0x50,0xc2,0xd2,0x3f,0x56,0xe3,0x4e,0x1d,0x46,
+0x9d,0x3a,0x0c,0x3a,0xe9,0x70,0x8f,0x1d,0xb6,0x11,0x55,0xe3,
+0x0e,0xbc,0x7c,0x09,0x9d,0x1d,0x96,0x46,0x68,0xc4,0x7e,0xec,
+0xe2,0xdf,0x83,0x8e,0x4a,0x46,0x90,0x62,0x6a,0xfe,0xe2,0x3a,
+0xee,0x98,0xdc,0x60,0xe5,0xdb,0x6c,0x42,0x33,0x31,0x5e,0x05,
+0xd0,0xea,0x44,0x87,0x8d,0x07,0x9e,0x3f,0x1c,0x42,0x1f,0x8e,
+0x43,0xf6,0xde,0xad,0x4c,0x7f,0x13,0xf8,0x2c,0xb6,0x40,0xfc,
+0xc2,0x1f,0x6d,0xf1,0xb7,0x2b,0xfe,0x8d,0x65,0x32,0xbf,0x91,
+0xfc,0x63,0x20,0xff,0x40,0x94,0xfa,0x9b,0x91,0x3e,0xbc,0x54,
+0x0f,0xdd,0x36,0xef,0x5c,0x24,0x28,0xb1,0xd9,0xd5,0x5d,0xe8,
+0xe7,0xe0,0x54,0x86,0xe1,0x18,0xe7,0xb6,0x2b,0x96,0x22,0x80,
+0x11,0xff,0x29,0x33,0xc3,0x0c,0xf8,0xcf,0xae,0xb4,0xf6,0x8b,
+0x5e,0x69,0x1c,0xf0,0xfc,0x84,0xe2,0x9e,0xa0,0x0d,0x01,0x76,
+0x02,0xe9,0x47,0xd2,0x75,0x87,0x1d,0xaf,0x6c,0xfa,0xa8,0x19,
+0x43,0xfc,0x5e,0x61,0x6c,0xaa,0xaa,0xf7,0x92,0xb3,0x54,0xab,
+0x29,0x68,0xe1,0x5c,0xc9,0x63,0xcb,0xe6,0x4d,0x29,0x1a,0xe3,
+0x3e,0x04,0x3e,0x93,0xab,0x1c,0x80,0x76,0xb6,0x16,0x87,0xe5,
+0x84,0x3a,0xee,0xa7,0xe8,0x8e,0xc4,0x43,0x7c,0x13,0xdd,0x8d,
+0x26,0x2d,0x96,0x67,0x03,0x9f,0x00,0x6b,0x75,0x76,0x36,0x37,
+0x77,0xbb,0xbb,0x6b,0x16,0xde,0xe8,0x1e,0xb9,0x02,0x36,0xc1,
+0xef,0x29,0xa5,0x2c,0x1d,0xc1,0x34,0xba,0xaf,0x6e,0xb6,0xe1,
+0x5b,0x26,0xbf,0x0d,0x88,0xbb,0xb5,0x3a,0x74,0xf9,0x64,0xd9,
+0x48,0x21,0xb6,0x5f,0x20,0xc4,0x08,0x21,0x46,0x76,0x88,0x4e,
+0x07,0x21,0x06,0x08,0x31,0xe0,0x10,0xdc,0xc8,0x20,0x09,0x02,
+0xe2,0xb8,0x63,0xbe,0x56,0xfa,0x94,0xa9,0x22,0x51,0x98,0xae,
+0x60,0xb8,0x5c,0x0e,0xa3,0xf8,0xc8,0xc1,0x65,0x4d,0x90,0xa7,
+0x7d,0xab,0xa6,0x55,0x8a,0x32,0x6b,0x6b,0x0b,0xae,0x2e,0x93,
+0x58,0xb1,0xe9,0x3a,0x41,0x50,0x75,0xf1,0xf9,0x5b,0xbe,0xe4,
+0xd6,0xc1,0x67,0x7f,0xca,0xac,0x23,0x1a,0x95,0x9f,0xc8,0x22,
+0x41,0x6a,0x52,0xd2,0xce,0x07,0x1f,0x89,0x4b,0xd1,0xed,0x99,
+0x28,0xd2,0xb4,0x6f,0x55,0x89,0x07,0xe9,0xf9,0x44,0x16,0xcc,
+0x0f,0x9a,0xa8,0x74,0xc3,0x8c,0x54,0x34,0x99,0xf9,0x21,0x28,
+0xb4,0x06,0xe2,0xd4,0xb3,0x3a,0x76,0x92,0xf3,0xfb,0x10,0xb5,
+0x21,0x12,0xd3,0x05,0xa7,0x9a,0x31,0x0c,0x3d,0xab,0xb2,0x26,
+0x33,0x23,0x25,0xfc,0x59,0x0c,0x99,0x8c,0x44,0x0a,0xa1,0x1a,
+0x59,0x04,0xe1,0x8a,0x08,0xd7,0x5d,0x8f,0xe6,0xd3,0x28,0x21,
+0x19,0xd3,0x0e,0x53,0x14,0x8f,0xd8,0x63,0x66,0x31,0xf4,0x41,
+0xff,0xd9,0x4b,0xa1,0xa4,0x5e,0x05,0x7d,0xa5,0x62,0x69,0xa5,
+0x2c,0xe9,0x6f,0x14,0xea,0x5f,0xd8,0x64,0x89,0x86,0x43,0xed,
+0x1b,0x57,0xe6,0xa0,0x2f,0xf4,0xcb,0xde,0xda,0x1a,0xf6,0x1f,
+0xfb,0x1c,0x0d,0x31,0x67,0xcc,0x2c,0x20,0x3c,0x71,0xd1,0x2c,
+0x64,0xef,0x76,0x13,0x4f,0xd8,0x16,0x79,0x59,0x93,0xcc,0xd9,
+0x13,0xa4,0xda,0xf2,0xd2,0x5b,0xd3,0x4c,0xfc,0x6c,0x93,0x96,
+0x25,0x26,0xd0,0xda,0xda,0x43,0x8d,0x33,0x32,0x93,0x62,0x55,
+0xcb,0xf0,0xc2,0xb6,0x04,0x41,0x0c,0x7f,0x8b,0x28,0x4b,0x0c,
+0xbc,0x96,0x05,0x7b,0x30,0x0a,0xa2,0x81,0x83,0xfa,0xc7,0x43,
+0x15,0xd3,0x30,0xbc,0x6c,0x25,0x6e,0xec,0x4f,0xe9,0xab,0xff,
+0xff,0x00,0xfd,0xd3,0x2b,0xe1,0x4e,0x69,0x02,0x00,
 	}))
 
 	if err != nil {
@@ -2878,4 +3053,4 @@ func term_html() []byte {
 	gz.Close()
 
 	return b.Bytes()
-}
\ No newline at end of file
+}
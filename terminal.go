@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// termViewer follows a session on a plain terminal, at the other end of an
+// SSH channel or a TCP connection. What it's sent queues up like it does
+// for event streams, so a client that can't keep up is dropped rather than
+// holding up everyone else.
+type termViewer struct {
+	*eventQueue
+	w io.Writer
+	// closed is closed once the client is gone.
+	closed chan struct{}
+
+	// Only used from pump.
+	cols, rows           int
+	pilotCols, pilotRows int
+	warned               string
+}
+
+// A window message carries the size of the client's window to pump. It
+// never goes on the wire.
+const windowMessage = "window"
+
+func newTermViewer(w io.Writer) *termViewer {
+	return &termViewer{eventQueue: newEventQueue(), w: w, closed: make(chan struct{})}
+}
+
+// window sets the size of the client's window, once it tells us.
+func (t *termViewer) window(cols, rows int) {
+	t.WriteControl(controlMessage{Type: windowMessage, Cols: cols, Rows: rows})
+}
+
+// refuseViewer says why a terminal viewer can't join a session, if it
+// can't, the way ServeHTTP would.
+func refuseViewer(session *session, err error, joinRate *rateLimiter, ip string) (code, message string) {
+	switch {
+	case err != nil || session.Pilot == nil:
+		return errNotFound, errSessionNotFound.Error()
+	case session.Encrypted:
+		return "encrypted", "session is end-to-end encrypted, use termshare or a browser to view it"
+	case session.Private:
+		return errForbidden, "session only takes a copilot"
+	case settings().Limits.MaxViewers > 0 && session.Viewers.Len() >= settings().Limits.MaxViewers:
+		return errServerFull, "session has reached its viewer limit"
+	}
+	if ok, _ := joinRate.Allow(ip); !ok {
+		return errRateLimited, "too many joins from your address"
+	}
+	return "", ""
+}
+
+func (t *termViewer) refuse(code, message string) {
+	metrics.HandshakeFailures.Inc(code)
+	io.WriteString(t.w, "termshare: "+message+"\r\n")
+}
+
+// watch has a terminal viewer follow the session, starting from what's on
+// the screen now, until one of them goes.
+func (session *session) watch(t *termViewer, transport string, l *logger) {
+	if session.Screen != nil {
+		t.Write(session.Screen.Snapshot())
+	}
+	if session.Size != nil {
+		t.WriteControl(*session.Size)
+	}
+	session.Viewers.Add(t, transport)
+	l = l.With("role", "viewer").Sample()
+	l.Info("connected")
+	started := time.Now()
+	reason := t.pump(session.EOF)
+	session.Viewers.Remove(t)
+	l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+}
+
+// leaving says whether a viewer pressed ctrl-c, ctrl-d or q to leave, since
+// there's nothing else for their keys to do.
+func leaving(keys []byte) bool {
+	return bytes.IndexAny(keys, "\x03\x04q") >= 0
+}
+
+// pump sends the client what's queued up for it until it leaves, falls
+// behind or the session ends, and says which it was.
+func (t *termViewer) pump(eof <-chan struct{}) string {
+	for {
+		if err := t.flush(); err != nil {
+			return disconnectReason(err)
+		}
+		select {
+		case <-t.wake:
+		case <-t.closed:
+			return "closed"
+		case <-eof:
+			t.flush()
+			t.notice("session ended")
+			return "session ended"
+		}
+	}
+}
+
+func (t *termViewer) flush() error {
+	events, dropped := t.take()
+	for _, ev := range events {
+		var err error
+		if ev.Control != nil {
+			err = t.control(*ev.Control)
+		} else {
+			_, err = t.w.Write(ev.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if dropped {
+		return errFellBehind
+	}
+	return nil
+}
+
+// control keeps track of how big the pilot's terminal and the client's
+// window are, and passes on notices from the server.
+func (t *termViewer) control(msg controlMessage) error {
+	switch msg.Type {
+	case "resize":
+		t.pilotCols, t.pilotRows = msg.Cols, msg.Rows
+	case windowMessage:
+		t.cols, t.rows = msg.Cols, msg.Rows
+	case "restart":
+		return t.notice(msg.Message)
+	default:
+		return nil
+	}
+	return t.checkSize()
+}
+
+// checkSize tells the client when their window is too small for what the
+// pilot is drawing, since nothing can resize it for them.
+func (t *termViewer) checkSize() error {
+	if t.cols == 0 || t.pilotCols == 0 || t.pilotCols <= t.cols && t.pilotRows <= t.rows {
+		t.warned = ""
+		return nil
+	}
+	warning := fmt.Sprintf("the pilot's terminal is %dx%d, make your window at least that big", t.pilotCols, t.pilotRows)
+	if warning == t.warned {
+		return nil
+	}
+	t.warned = warning
+	return t.notice(warning)
+}
+
+func (t *termViewer) notice(message string) error {
+	_, err := io.WriteString(t.w, "\r\n[termshare: "+message+"]\r\n")
+	return err
+}
@@ -1,8 +1,7 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"io"
@@ -13,16 +12,16 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"code.google.com/p/go.net/websocket"
+	"github.com/gorilla/websocket"
 	"github.com/heroku/hk/term"
 	"github.com/kr/pty"
-	"github.com/nu7hatch/gouuid"
 )
 
 const VERSION = "v0.2.0"
@@ -30,9 +29,19 @@ const VERSION = "v0.2.0"
 var daemon *bool = flag.Bool("d", false, "run the server daemon")
 var copilot *bool = flag.Bool("c", false, "allow a copilot to join to share control")
 var private *bool = flag.Bool("p", false, "only allow a copilot and no viewers")
+var encrypt *bool = flag.Bool("e", false, "encrypt the session end-to-end so the server can't read it")
 var server *string = flag.String("s", "termsha.re:443", "use a different server to start session")
 var notls *bool = flag.Bool("n", false, "do not use tls endpoints")
 var version *bool = flag.Bool("v", false, "print version and exit")
+var listen *string = flag.String("listen", "", "serve the session directly on this address instead of using a server")
+var slug *string = flag.String("name", "", "use a custom name for the session")
+var words *bool = flag.Bool("words", false, "generate a readable session name instead of a uuid")
+var quiet *bool = flag.Bool("quiet", false, "only print the session url")
+var jsonOutput *bool = flag.Bool("json", false, "print the session details as json instead of the banner")
+var infoFile *string = flag.String("info-file", "", "write the session details as json to this file")
+var hook *string = flag.String("hook", "", "run this shell command with the session details as json on stdin")
+var configFile *string = flag.String("config", "", "daemon config file")
+var advertise *bool = flag.Bool("advertise", false, "announce a -listen session on the local network")
 
 var banner = ` _                          _                    
 | |_ ___ _ __ _ __ ___  ___| |__   __ _ _ __ ___ 
@@ -43,13 +52,20 @@ var banner = ` _                          _
 Running this open source service supported 100% by community.
 Donate: https://www.gittip.com/termshare
 
-Session URL: {{URL}}
-`
+Session URL: {{.URL}}
+{{if .CopilotURL}}Copilot URL: {{.CopilotURL}}
+{{end}}`
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage:  %v [session-url]\n\n", os.Args[0])
-		fmt.Fprintln(os.Stderr, "Starts termshare sesion or connects to session if session-url is specified\n")
+		fmt.Fprintf(os.Stderr, "Usage:  %v [session-url]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %v browse\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %v upgrade\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %v transcript [recording]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Starts termshare sesion or connects to session if session-url is specified.")
+		fmt.Fprintln(os.Stderr, "Browse lists sessions shared on the local network and joins one.")
+		fmt.Fprintln(os.Stderr, "Upgrade replaces termshare with the release the server is running.")
+		fmt.Fprint(os.Stderr, "Transcript prints a recorded session, or stdin, as plain text.\n\n")
 		flag.PrintDefaults()
 	}
 }
@@ -58,74 +74,300 @@ type session struct {
 	Name          string
 	AllowCopilot  bool
 	Private       bool
+	Encrypted     bool
 	Viewers       *viewers
 	Pilot         io.ReadWriteCloser
 	Copilot       io.ReadWriteCloser
 	CopilotBuffer *bufferWriter
+	CopilotToken  string
+	Owner         string
+	Expires       time.Time
+	Expiry        *time.Timer
+	Started       time.Time
+	Size          *controlMessage
+	Screen        *screen
+	Pollers       *pollers
 	EOF           chan struct{}
 }
 
+func newSession(name string, copilot, private, encrypted bool) *session {
+	sess := &session{
+		Name:          name,
+		AllowCopilot:  copilot,
+		Private:       private,
+		Encrypted:     encrypted,
+		Viewers:       &viewers{v: make(map[io.Writer]string)},
+		Pollers:       &pollers{p: make(map[string]*eventQueue)},
+		EOF:           make(chan struct{}),
+		CopilotBuffer: &bufferWriter{},
+	}
+	if copilot {
+		sess.CopilotToken = newToken()
+		sess.CopilotBuffer.max = copilotBacklog
+	}
+	if !encrypted {
+		sess.Screen = newScreen(80, 24)
+	}
+	return sess
+}
+
+// Urls returns the session's viewer url and, if it takes a copilot, the
+// url that comes with control.
+func (session *session) Urls(base string) (string, string) {
+	url := base + "/" + session.Name
+	if session.CopilotToken == "" {
+		return url, ""
+	}
+	return url, url + "?copilot=" + session.CopilotToken
+}
+
+// isCopilotToken checks a token against the session's copilot token, in
+// constant time so it can't be guessed a byte at a time.
+func (session *session) isCopilotToken(token string) bool {
+	return session.CopilotToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(session.CopilotToken)) == 1
+}
+
+func (session *session) banner(base, server string) bannerData {
+	data := bannerData{Server: server}
+	data.URL, data.CopilotURL = session.Urls(base)
+	if !session.Expires.IsZero() {
+		data.Expires = session.Expires.Format(time.RFC1123)
+	}
+	return data
+}
+
+// control acts on a control message from the pilot.
+func (session *session) control(msg controlMessage) {
+	switch msg.Type {
+	case "resize":
+		session.Size = &msg
+		if session.Screen != nil {
+			session.Screen.Resize(msg.Cols, msg.Rows)
+		}
+		session.Viewers.Control(msg)
+		if copilot, ok := session.Copilot.(controlWriter); ok {
+			copilot.WriteControl(msg)
+		}
+	}
+}
+
+// announce tells everyone in the session something. Participants that
+// negotiated framing get a control message; viewers that didn't get the
+// message as a line of text, unless the session is encrypted.
+func (session *session) announce(msg controlMessage) {
+	if pilot, ok := session.Pilot.(controlWriter); ok {
+		pilot.WriteControl(msg)
+	}
+	if copilot, ok := session.Copilot.(controlWriter); ok {
+		copilot.WriteControl(msg)
+	}
+	session.Viewers.Announce(msg, !session.Encrypted)
+}
+
+// greet tells a participant what was negotiated and how big the pilot's
+// terminal is.
+func (session *session) greet(conn controlWriter, h handshake) {
+	conn.WriteControl(helloMessage(h))
+	if session.Size != nil && h.Has(capResize) {
+		conn.WriteControl(*session.Size)
+	}
+}
+
 type sessions struct {
 	sync.Mutex
 	s map[string]*session
 }
 
-func (s sessions) Get(name string) (sess *session, err error) {
+func (s *sessions) Get(name string) (sess *session, err error) {
 	s.Lock()
 	defer s.Unlock()
 	sess, found := s.s[name]
 	if !found {
-		err = errors.New("session not found")
+		err = errSessionNotFound
 		return
 	}
 	return
 }
 
-func (s sessions) Create(name string, copilot, private bool) (*session, error) {
-	if sess, _ := s.Get(name); sess != nil {
-		return nil, errors.New("session already exists")
-	}
-	sess := &session{
-		Name:          name,
-		AllowCopilot:  copilot,
-		Private:       private,
-		Viewers:       &viewers{v: make(map[io.Writer]struct{})},
-		EOF:           make(chan struct{}),
-		CopilotBuffer: &bufferWriter{},
-	}
+// Create adds a session for the pilot at owner, unless one by that name
+// exists. Checking and adding happen under one lock, so of two pilots
+// asking for the same name at once only one gets it.
+func (s *sessions) Create(name, owner string, copilot, private, encrypted bool) (*session, error) {
 	s.Lock()
 	defer s.Unlock()
+	if _, found := s.s[name]; found {
+		return nil, errSessionTaken
+	}
+	sess := newSession(name, copilot, private, encrypted)
+	sess.Owner = owner
 	s.s[name] = sess
 	return sess, nil
 }
 
-func (s sessions) Delete(name string) {
+func (s *sessions) All() []*session {
+	s.Lock()
+	defer s.Unlock()
+	all := make([]*session, 0, len(s.s))
+	for _, sess := range s.s {
+		all = append(all, sess)
+	}
+	return all
+}
+
+// Owned counts the sessions created from an address.
+func (s *sessions) Owned(ip string) (n int) {
+	s.Lock()
+	defer s.Unlock()
+	for _, sess := range s.s {
+		if sess.Owner == ip {
+			n++
+		}
+	}
+	return
+}
+
+func (s *sessions) Len() int {
 	s.Lock()
 	defer s.Unlock()
-	delete(s.s, name)
+	return len(s.s)
+}
+
+// Delete removes sess, unless another session has its name by now, and
+// says whether it did.
+func (s *sessions) Delete(sess *session) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.remove(sess)
+}
+
+func (s *sessions) remove(sess *session) bool {
+	if s.s[sess.Name] != sess {
+		return false
+	}
+	delete(s.s, sess.Name)
+	return true
+}
+
+// Expire ends sess once it has lasted max, calling expired if it was still
+// going by then.
+func (s *sessions) Expire(sess *session, max time.Duration, expired func()) {
+	s.Lock()
+	defer s.Unlock()
+	sess.Expires = time.Now().Add(max)
+	sess.Expiry = time.AfterFunc(max, func() {
+		if s.Delete(sess) {
+			expired()
+		}
+	})
+}
+
+// End removes sess when its pilot leaves, so it doesn't expire later on
+// and take a new session by the same name with it.
+func (s *sessions) End(sess *session) bool {
+	s.Lock()
+	defer s.Unlock()
+	if sess.Expiry != nil {
+		sess.Expiry.Stop()
+	}
+	return s.remove(sess)
 }
 
 type viewers struct {
 	sync.Mutex
-	v map[io.Writer]struct{}
+	v map[io.Writer]string
 }
 
-func (v viewers) Write(data []byte) (n int, err error) {
+func (v *viewers) Write(data []byte) (n int, err error) {
 	v.Lock()
 	defer v.Unlock()
 	for w := range v.v {
-		n, err = w.Write(data)
-		if err != nil || n != len(data) {
+		err := safely(func() error {
+			n, err := w.Write(data)
+			if err == nil && n != len(data) {
+				err = io.ErrShortWrite
+			}
+			return err
+		})
+		if err != nil {
 			delete(v.v, w)
+			metrics.ViewerEvictions.Inc("")
 		}
 	}
 	return len(data), nil
 }
 
-func (v viewers) Add(viewer io.Writer) {
+// safely runs a write to one viewer, turning a panic into an error so a
+// viewer that trips over a bug, like a transcriber's screen, is dropped
+// instead of taking the daemon down with it.
+func safely(write func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			serverLog.Error("viewer write failed", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("viewer panicked: %v", r)
+		}
+	}()
+	return write()
+}
+
+func (v *viewers) Add(viewer io.Writer, transport string) {
+	v.Lock()
+	defer v.Unlock()
+	v.v[viewer] = transport
+}
+
+// Transports counts viewers by how they're connected.
+func (v *viewers) Transports() map[string]int {
+	v.Lock()
+	defer v.Unlock()
+	counts := make(map[string]int)
+	for _, transport := range v.v {
+		counts[transport]++
+	}
+	return counts
+}
+
+func (v *viewers) Remove(viewer io.Writer) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.v, viewer)
+}
+
+func (v *viewers) Len() int {
 	v.Lock()
 	defer v.Unlock()
-	v.v[viewer] = struct{}{}
+	return len(v.v)
+}
+
+func (v *viewers) Control(msg controlMessage) {
+	v.Lock()
+	defer v.Unlock()
+	for w := range v.v {
+		if cw, ok := w.(controlWriter); ok {
+			if safely(func() error { cw.WriteControl(msg); return nil }) != nil {
+				delete(v.v, w)
+				metrics.ViewerEvictions.Inc("")
+			}
+		}
+	}
+}
+
+func (v *viewers) Announce(msg controlMessage, inBand bool) {
+	v.Lock()
+	defer v.Unlock()
+	for w := range v.v {
+		if fc, ok := w.(*framedConn); ok {
+			if fc.framing {
+				fc.WriteControl(msg)
+			} else if inBand {
+				fc.Write([]byte("\r\n[" + msg.Message + "]\r\n"))
+			}
+		} else if cw, ok := w.(controlWriter); ok {
+			cw.WriteControl(msg)
+		} else if inBand {
+			w.Write([]byte("\r\n[" + msg.Message + "]\r\n"))
+		}
+	}
 }
 
 type flushWriter struct {
@@ -149,44 +391,67 @@ func FlushWriter(writer io.Writer) flushWriter {
 	return fw
 }
 
+// bufferWriter holds on to what is written while there is nobody to write
+// it to, one message per Write so frames survive being buffered. It keeps
+// the latest max bytes' worth, dropping the oldest messages, and nothing
+// at all with max 0.
 type bufferWriter struct {
-	w *websocket.Conn
-	b *bytes.Buffer
+	sync.Mutex
+	w    io.Writer
+	b    [][]byte
+	size int
+	max  int
 }
 
+// A copilot that joins late, or comes back, gets this much of the output
+// it missed.
+const copilotBacklog = 256 << 10
+
 func (bw *bufferWriter) Write(p []byte) (n int, err error) {
-	if bw.b == nil {
-		bw.b = new(bytes.Buffer)
-	}
-	if bw.b.Len() > 0 && bw.w != nil {
-		if _, err = bw.b.WriteTo(bw.w); err != nil {
+	bw.Lock()
+	defer bw.Unlock()
+	for len(bw.b) > 0 && bw.w != nil {
+		if _, err = bw.w.Write(bw.b[0]); err != nil {
 			bw.w = nil
-			err = nil
+			break
 		}
+		bw.size -= len(bw.b[0])
+		bw.b = bw.b[1:]
 	}
 	if bw.w != nil {
-		n, err = bw.w.Write(p)
-		if err != nil {
-			bw.w = nil
-			return bw.b.Write(p)
+		if n, err = bw.w.Write(p); err == nil {
+			return n, nil
 		}
-		return n, err
-	} else {
-		return bw.b.Write(p)
+		bw.w = nil
 	}
+	if bw.max > 0 {
+		bw.b = append(bw.b, append([]byte(nil), p...))
+		bw.size += len(p)
+		for bw.size > bw.max && len(bw.b) > 1 {
+			bw.size -= len(bw.b[0])
+			bw.b = bw.b[1:]
+		}
+	}
+	return len(p), nil
+}
+
+// Len is how many bytes are waiting to be written.
+func (bw *bufferWriter) Len() int {
+	bw.Lock()
+	defer bw.Unlock()
+	return bw.size
 }
 
 func readResponse(resp *http.Response) (string, error) {
 	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-		return string(body), nil
-	} else {
-		return "", errors.New("unexpected status: " + string(resp.StatusCode))
+	if resp.StatusCode != 200 {
+		return "", readError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
+	return string(body), nil
 }
 
 func baseUrl(protocol string) string {
@@ -197,36 +462,122 @@ func baseUrl(protocol string) string {
 }
 
 func createSession() {
-	name, err := uuid.NewV4()
-	if err != nil {
-		panic(err)
+	if *listen != "" {
+		listenSession()
+		return
 	}
-	values := map[bool]string{
-		true:  "true",
-		false: "",
+	info, h := openSession()
+	var keys sessionKeys
+	if *encrypt {
+		key, err := newSessionKey()
+		if err != nil {
+			fatal(1, err)
+		}
+		if keys, err = parseSessionKey(key); err != nil {
+			fatal(1, err)
+		}
+		info.withKey(key)
 	}
-	resp, err := http.PostForm(baseUrl("http")+"/"+name.String(),
-		url.Values{"copilot": {values[*copilot]}, "private": {values[*private]}})
+	info.print()
+
+	conn, err := dialSession("/"+info.Name, nil)
 	if err != nil {
-		panic(err)
+		fatal(exitUnavailable, "unable to connect to session:", err)
 	}
-	body, err := readResponse(resp)
+	if h.Has(capFraming) {
+		conn.framing, conn.awaitHello = true, false
+	}
+	conn.OnControl = showNotice
+	var stream io.ReadWriter = conn
+	var output io.WriteCloser = nopCloser{conn}
+	if keys.output != nil {
+		// The server can't gather up encrypted output, so it's done here.
+		stream = newEncryptedConn(conn, keys.output, keys.input)
+		output = newShaper(stream, nil, func() int { return 0 })
+	}
+	pty, err := startShell()
 	if err != nil {
-		log.Fatal("unable to open session")
+		fatal(1, "unable to start shell:", err)
 	}
-	fmt.Println(body)
+	watchSize(pty, func(cols, rows int) {
+		if h.Has(capResize) {
+			conn.WriteControl(resizeMessage(cols, rows))
+		}
+	})
+	runPilot(pty, output, stream)
+	output.Close()
+	conn.CloseWith(websocket.CloseNormalClosure, "pilot left")
+}
 
-	conn, err := websocket.Dial(baseUrl("ws")+"/"+name.String(), "", baseUrl("http"))
-	if err != nil {
-		panic(err)
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// openSession registers a new session with the server and returns what the
+// server told us about it. Generated names that happen to be taken already
+// are simply replaced with fresh ones.
+func openSession() (sessionInfo, handshake) {
+	values := map[bool]string{
+		true:  "true",
+		false: "",
+	}
+	form := clientHandshake()
+	form.Set("copilot", values[*copilot])
+	form.Set("private", values[*private])
+	form.Set("encrypted", values[*encrypt])
+	for attempt := 1; ; attempt++ {
+		name, err := newSessionName()
+		if err != nil {
+			fatal(exitUsage, err)
+		}
+		req, err := http.NewRequest("POST", baseUrl("http")+"/"+name, strings.NewReader(form.Encode()))
+		if err != nil {
+			fatal(1, err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token := os.Getenv("TERMSHARE_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fatal(exitUnavailable, "unable to reach server "+*server+":", err)
+		}
+		h := readHandshake(resp)
+		body, err := readResponse(resp)
+		if e, ok := err.(*apiError); ok && e.Code == errConflict && *slug == "" && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			sessionError(name, err)
+		}
+		if err := checkServerProtocol(*server, h); err != nil {
+			fatal(exitProtocol, err)
+		}
+		info := sessionInfo{
+			Name:         name,
+			Url:          resp.Header.Get("X-Termshare-Url"),
+			CopilotUrl:   resp.Header.Get("X-Termshare-Copilot-Url"),
+			CopilotToken: resp.Header.Get("X-Termshare-Copilot-Token"),
+			Expires:      resp.Header.Get("X-Termshare-Expires"),
+			Banner:       body,
+		}
+		if info.Url == "" {
+			info.Url = publicUrl(nil) + "/" + name
+		}
+		return info, h
 	}
+}
+
+func startShell() (*os.File, error) {
 	cols, err := term.Cols()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	lines, err := term.Lines()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	cmd := exec.Command(os.Getenv("SHELL"))
 	cmd.Env = []string{
@@ -237,51 +588,83 @@ func createSession() {
 		"COLUMNS=" + strconv.Itoa(cols),
 		"LINES=" + strconv.Itoa(lines),
 	}
-	pty, err := pty.Start(cmd)
-	if err != nil {
-		panic(err)
+	return pty.Start(cmd)
+}
+
+// watchSize keeps the pty the same size as the local terminal, reporting
+// the size to resized now and whenever the terminal changes.
+func watchSize(tty *os.File, resized func(cols, rows int)) {
+	update := func() {
+		cols, err := term.Cols()
+		if err != nil {
+			return
+		}
+		rows, err := term.Lines()
+		if err != nil {
+			return
+		}
+		pty.Setsize(tty, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+		resized(cols, rows)
 	}
-	if err := term.MakeRaw(os.Stdin); err != nil {
-		panic(err)
+	update()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			update()
+		}
+	}()
+}
+
+// runPilot puts the local terminal in raw mode and shuttles data between it,
+// the shell's pty and the session until either side goes away. input may be
+// nil when nothing remote feeds the pty directly.
+func runPilot(pty *os.File, output io.Writer, input io.Reader) {
+	if err := makeRaw(); err != nil {
+		fatal(1, err)
 	}
 	exitSignal := make(chan os.Signal)
 	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-exitSignal
-		term.Restore(os.Stdin)
+		restoreTerminal()
 		os.Exit(0)
 	}()
-	defer term.Restore(os.Stdin)
+	defer restoreTerminal()
 	eof := make(chan bool, 1)
 	go func() {
-		io.Copy(io.MultiWriter(os.Stdout, conn), pty)
+		io.Copy(io.MultiWriter(os.Stdout, output), pty)
 		eof <- true
 	}()
 	go func() {
 		io.Copy(pty, os.Stdin)
 		eof <- true
 	}()
-	go func() {
-		io.Copy(pty, conn)
-		eof <- true
-	}()
-	go func() {
-		for {
-			_, err := conn.Write([]byte("\x00"))
-			if err != nil {
-				return
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	if input != nil {
+		go func() {
+			io.Copy(pty, input)
+			eof <- true
+		}()
+	}
 	<-eof
 }
 
+// showNotice prints messages the server sends, like it restarting, over
+// whatever is on the terminal.
+func showNotice(msg controlMessage) {
+	if msg.Type == "restart" {
+		fmt.Fprint(os.Stderr, "\r\n[termshare: "+msg.Message+"]\r\n")
+	}
+}
+
 func joinSession(sessionUrl string) {
 	url, err := url.Parse(sessionUrl)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if url.Scheme == "http" {
+		*notls = true
+	}
 	if !strings.Contains(url.Host, ":") {
 		if *notls {
 			*server = url.Host + ":80"
@@ -291,37 +674,200 @@ func joinSession(sessionUrl string) {
 	} else {
 		*server = url.Host
 	}
-	conn, err := websocket.Dial(baseUrl("ws")+url.Path, "", baseUrl("http"))
+	conn, err := dialSession(url.Path, url.Query())
 	if err != nil {
-		log.Fatal(err)
+		joinError(url.String(), err)
 	}
-	if err := term.MakeRaw(os.Stdin); err != nil {
-		log.Fatal(err)
+	conn.OnControl = showNotice
+	var stream io.ReadWriter = conn
+	if url.Fragment != "" {
+		keys, err := parseSessionKey(url.Fragment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stream = newEncryptedConn(conn, keys.input, keys.output)
+	}
+	if err := makeRaw(); err != nil {
+		fatal(1, err)
 	}
 	exitSignal := make(chan os.Signal)
 	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-exitSignal
-		term.Restore(os.Stdin)
+		restoreTerminal()
 		os.Exit(0)
 	}()
-	defer term.Restore(os.Stdin)
+	defer restoreTerminal()
 	eof := make(chan bool, 1)
 	go func() {
-		io.Copy(os.Stdout, conn)
+		_, err := io.Copy(os.Stdout, stream)
+		if _, ok := err.(*serverTooOld); ok {
+			fatal(exitProtocol, err)
+		}
 		eof <- true
 	}()
 	go func() {
-		io.Copy(conn, os.Stdin)
+		io.Copy(stream, os.Stdin)
 		eof <- true
 	}()
 	<-eof
 }
 
+// ServeHTTP connects copilots and viewers to a session whose pilot is
+// already attached, either through the daemon or a local -listen session.
+func (session *session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	isWebsocket := r.Header.Get("Upgrade") == "websocket"
+	h := parseHandshake(r.URL.Query())
+	if session.Encrypted {
+		h = h.Without(capDeflate)
+	}
+	l := requestLog(r).With("session", session.Name)
+	switch {
+	case session.Pilot != nil && session.Copilot == nil && session.AllowCopilot && isWebsocket &&
+		session.isCopilotToken(r.URL.Query().Get("copilot")):
+		conn, err := acceptConn(w, r)
+		if err != nil {
+			return
+		}
+		copilot := newFramedConn(conn, h.Has(capFraming))
+		copilot.binary = copilot.binary || session.Encrypted
+		session.greet(copilot, h)
+		session.Copilot = copilot
+		session.CopilotBuffer.w = copilot
+		if !session.Encrypted {
+			session.Pilot.Write([]byte("\x07")) // ding!
+		}
+		l = l.With("role", "copilot", "transport", transportWebsocket)
+		l.Info("connected")
+		started := time.Now()
+		left := make(chan error, 1)
+		go func() {
+			left <- relayFrames(countingWriter{session.Pilot, "input"}, copilot)
+		}()
+		reason := "session ended"
+		select {
+		case err := <-left:
+			reason = disconnectReason(err)
+		case <-session.EOF:
+			hangUp(copilot, websocket.CloseNormalClosure, reason)
+		}
+		session.Copilot = nil
+		session.CopilotBuffer.w = nil
+		copilot.Close()
+		l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+	case session.Pilot != nil && !session.Private:
+		if max := settings().Limits.MaxViewers; max > 0 && session.Viewers.Len() >= max && !continuingPoll(r) {
+			full(w, 30*time.Second, "session has reached its viewer limit")
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/events"):
+			session.serveEvents(w, r, h.Without(capDeflate), l)
+			return
+		case strings.HasSuffix(r.URL.Path, "/poll"):
+			session.servePoll(w, r, h.Without(capDeflate), l)
+			return
+		}
+		if isWebsocket {
+			conn, err := acceptConn(w, r)
+			if err != nil {
+				return
+			}
+			viewer := newFramedConn(conn, h.Has(capFraming))
+			viewer.binary = viewer.binary || session.Encrypted
+			session.greet(viewer, h)
+			transport := transportWebsocket
+			if r.URL.Query().Get("client") == transportBrowser {
+				transport = transportBrowser
+			}
+			session.Viewers.Add(viewer, transport)
+			l := l.With("role", "viewer", "transport", transport).Sample()
+			l.Info("connected")
+			started := time.Now()
+			left := make(chan error, 1)
+			go func() {
+				for {
+					if _, err := viewer.ReadFrame(); err != nil {
+						left <- err
+						return
+					}
+				}
+			}()
+			reason := "session ended"
+			select {
+			case err := <-left:
+				session.Viewers.Remove(viewer)
+				reason = disconnectReason(err)
+			case <-session.EOF:
+				hangUp(viewer, websocket.CloseNormalClosure, reason)
+			}
+			viewer.Close()
+			l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+		} else if format, ok := negotiateFormat(w, r); ok {
+			switch {
+			case format == formatHtml:
+				l.Sample().Debug("page loaded", "transport", transportBrowser)
+				w.Header().Set("Content-Type", contentType(format))
+				w.Write(term_html())
+			case format == formatEvents:
+				session.serveEvents(w, r, h.Without(capDeflate), l)
+			case session.Encrypted:
+				metrics.HandshakeFailures.Inc("encrypted")
+				w.WriteHeader(http.StatusNotAcceptable)
+				w.Write([]byte("session is end-to-end encrypted, use termshare or a browser to view it\n"))
+			default:
+				session.serveStream(w, r, format, l)
+			}
+		}
+	}
+}
+
+// serveStream follows the session over a plain HTTP response in one of the
+// streamed formats.
+func (session *session) serveStream(w http.ResponseWriter, r *http.Request, format string, l *logger) {
+	w.Header().Set("Content-Type", contentType(format))
+	var out io.Writer = FlushWriter(w)
+	if acceptsGzip(r) {
+		gz := newGzipFlushWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	viewer := session.streamViewer(out, format)
+	session.Viewers.Add(viewer, transportHttp)
+	l = l.With("role", "viewer", "transport", transportHttp, "format", format).Sample()
+	l.Info("connected")
+	started := time.Now()
+	reason := "session ended"
+	select {
+	case <-r.Context().Done():
+		session.Viewers.Remove(viewer)
+		reason = "closed"
+	case <-session.EOF:
+		if t, ok := viewer.(*transcriber); ok {
+			t.Flush()
+		}
+	}
+	l.Info("disconnected", "duration", time.Since(started), "reason", reason)
+}
+
 func startDaemon() {
+	c, err := loadConfig(configPath())
+	if err != nil {
+		fatal(1, "unable to load config:", err)
+	}
+	currentConfig = c
+	reloadConfigOnHangup()
 	sessions := sessions{s: make(map[string]*session)}
+	cluster := newCluster(c)
+	go cluster.keepRegistered(&sessions)
+	drainOnTerm(&sessions)
+	sessionRate := newRateLimiter(func() int { return settings().Limits.SessionsPerMinute })
+	sessionRatePerIP := newRateLimiter(func() int { return settings().Limits.SessionsPerIPPerMinute })
+	joinRate := newRateLimiter(func() int { return settings().Limits.JoinsPerMinute })
+	bytesPerSecond := func() int { return settings().Limits.BytesPerSecond }
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		requestId(w, r)
 		switch {
 		case r.RequestURI == "/":
 			http.Redirect(w, r, "https://github.com/progrium/termshare", 301)
@@ -329,93 +875,173 @@ func startDaemon() {
 			return
 		case r.RequestURI == "/version":
 			w.Write([]byte(VERSION))
-		case strings.HasPrefix(r.RequestURI, "/download/"):
-			parts := strings.Split(r.RequestURI, "/")
-			os := parts[len(parts)-1]
-			http.Redirect(w, r, "https://github.com/progrium/termshare/releases/download/"+VERSION+"/termshare_"+VERSION+"_"+os+"_x86_64.tgz", 301)
+		case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+			serveHealth(w, r)
+		case r.URL.Path == "/metrics":
+			serveMetrics(w, &sessions)
+		case r.URL.Path == "/download" || strings.HasPrefix(r.URL.Path, "/download/"):
+			serveDownload(w, r)
 		default:
-			parts := strings.Split(r.RequestURI, "/")
+			parts := strings.Split(r.URL.Path, "/")
 			sessionName := parts[1]
 			session, err := sessions.Get(sessionName)
 			if r.Method == "POST" {
+				if !validSessionName(sessionName) {
+					refuse(w, http.StatusBadRequest, errInvalidName, "session names are 3 to 64 letters, digits, dashes or underscores")
+					return
+				}
 				r.ParseForm()
-				_, err = sessions.Create(sessionName, r.Form.Get("copilot") != "", r.Form.Get("private") != "")
+				h := parseHandshake(r.Form)
+				if !checkProtocol(w, r, h) {
+					return
+				}
+				if !authorized(r) {
+					refuse(w, http.StatusUnauthorized, errUnauthorized, "a token is required to create sessions")
+					return
+				}
+				if isDraining() {
+					refuse(w, http.StatusServiceUnavailable, errRestarting, "server is restarting")
+					return
+				}
+				if max := settings().Limits.MaxSessions; max > 0 && sessions.Len() >= max {
+					full(w, time.Minute, "server has reached its session limit")
+					return
+				}
+				ip := clientIP(r)
+				if max := settings().Limits.MaxSessionsPerIP; max > 0 && sessions.Owned(ip) >= max {
+					limited(w, time.Minute, "too many sessions open from your address")
+					return
+				}
+				if ok, retry := sessionRatePerIP.Allow(ip); !ok {
+					limited(w, retry, "too many sessions created from your address")
+					return
+				}
+				if ok, retry := sessionRate.Allow(""); !ok {
+					limited(w, retry, "too many sessions are being created")
+					return
+				}
+				session, err = sessions.Create(sessionName, ip, r.Form.Get("copilot") != "", r.Form.Get("private") != "", r.Form.Get("encrypted") != "")
+				if err == nil {
+					if err = cluster.Directory.Register(sessionName, cluster.Self); err != nil {
+						sessions.Delete(session)
+					}
+				}
 				if err != nil {
-					log.Println(err)
-					w.WriteHeader(http.StatusConflict)
+					requestLog(r).Warn("session not created", "session", sessionName, "error", err)
+					if err == errSessionTaken {
+						refuse(w, http.StatusConflict, errConflict, err.Error())
+					} else {
+						refuse(w, http.StatusServiceUnavailable, errUnavailable, "session directory unavailable")
+					}
 					return
 				}
-				logline := sessionName + ": session created"
-				if r.Form.Get("copilot") != "" {
-					logline = logline + " [copilot]"
+				requestLog(r).Info("session created", "session", sessionName,
+					"copilot", session.AllowCopilot, "private", session.Private, "encrypted", session.Encrypted)
+				if max := settings().MaxDuration(); max > 0 {
+					sessions.Expire(session, max, func() {
+						cluster.Directory.Unregister(sessionName, cluster.Self)
+						if pilot := session.Pilot; pilot != nil {
+							hangUp(pilot, websocket.ClosePolicyViolation, "session time limit reached")
+						}
+					})
+				}
+				data := session.banner(publicUrl(r), serverName(r))
+				w.Header().Set("X-Termshare-Url", data.URL)
+				w.Header().Set("X-Termshare-Copilot-Url", data.CopilotURL)
+				w.Header().Set("X-Termshare-Copilot-Token", session.CopilotToken)
+				if !session.Expires.IsZero() {
+					w.Header().Set("X-Termshare-Expires", session.Expires.Format(time.RFC3339))
 				}
-				if r.Form.Get("private") != "" {
-					logline = logline + " [private]"
+				if session.Encrypted {
+					h = h.Without(capDeflate)
 				}
-				log.Println(logline)
-				baseUrl := baseUrl("http")
-				baseUrl = strings.TrimSuffix(baseUrl, ":443")
-				baseUrl = strings.TrimSuffix(baseUrl, ":80")
-				w.Write([]byte(strings.Replace(banner, "{{URL}}", baseUrl+"/"+sessionName, 1)))
+				writeHandshake(w, h)
+				w.Write([]byte(sessionBanner(data)))
 				return
 			}
+			node := cluster.Self
 			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
+				if node, err = cluster.Directory.Lookup(sessionName); err != nil || node == cluster.Self {
+					refuse(w, http.StatusNotFound, errNotFound, errSessionNotFound.Error())
+					return
+				}
+			}
+			if ok, retry := joinRate.Allow(clientIP(r)); !ok && !continuingPoll(r) {
+				limited(w, retry, "too many joins from your address")
 				return
 			}
-			isWebsocket := r.Header.Get("Upgrade") == "websocket"
-			switch {
-			case session.Pilot == nil && isWebsocket:
-				websocket.Handler(func(conn *websocket.Conn) {
-					session.Pilot = conn
-					log.Println(sessionName + ": pilot connected")
-					_, err := io.Copy(io.MultiWriter(session.Viewers, session.CopilotBuffer), session.Pilot)
-					if err != nil {
-						if err == io.EOF {
-							close(session.EOF)
-						} else {
-							log.Println("pilot writing error: ", err)
-						}
-					}
-				}).ServeHTTP(w, r)
-			case session.Pilot != nil && session.Copilot == nil && session.AllowCopilot && isWebsocket:
-				websocket.Handler(func(conn *websocket.Conn) {
-					session.Copilot = conn
-					session.CopilotBuffer.w = conn
-					session.Pilot.Write([]byte("\x07")) // ding!
-					log.Println(sessionName + ": copilot connected")
-					eof := make(chan struct{})
-					go func() {
-						io.Copy(session.Pilot, session.Copilot)
-						session.Copilot = nil
-						session.CopilotBuffer.w = nil
-						eof <- struct{}{}
-					}()
-					<-eof
-				}).ServeHTTP(w, r)
-			case session.Pilot != nil && !session.Private:
-				if isWebsocket {
-					websocket.Handler(func(conn *websocket.Conn) {
-						session.Viewers.Add(conn)
-						log.Println(sessionName + ": viewer connected [websocket]")
-						<-session.EOF
-					}).ServeHTTP(w, r)
+			h := parseHandshake(r.URL.Query())
+			if r.URL.Query().Get("protocol") != "" && !checkProtocol(w, r, h) {
+				return
+			}
+			if !originAllowed(r) {
+				refuse(w, http.StatusForbidden, errForbidden, "origin not allowed")
+				return
+			}
+			if node != cluster.Self {
+				requestLog(r).Debug("relaying", "session", sessionName, "node", node)
+				cluster.Bus.Relay(w, r, node)
+				return
+			}
+			if session.Pilot == nil && r.Header.Get("Upgrade") == "websocket" {
+				conn, err := acceptConn(w, r)
+				if err != nil {
+					return
+				}
+				if session.Encrypted {
+					h = h.Without(capDeflate)
+				}
+				pilot := newFramedConn(conn, h.Has(capFraming))
+				pilot.binary = pilot.binary || session.Encrypted
+				pilot.OnControl = session.control
+				pilot.WriteControl(helloMessage(h))
+				session.Pilot = pilot
+				session.Started = time.Now()
+				l := requestLog(r).With("session", sessionName, "role", "pilot", "transport", transportWebsocket)
+				l.Info("connected")
+				var output io.WriteCloser
+				if session.Encrypted {
+					output = newThrottle(io.MultiWriter(session.Viewers, session.CopilotBuffer), bytesPerSecond)
 				} else {
-					if strings.HasPrefix(r.Header.Get("User-Agent"), "curl/") {
-						session.Viewers.Add(FlushWriter(w))
-						log.Println(sessionName + ": viewer connected [http]")
-						<-session.EOF
-					} else {
-						log.Println(sessionName + ": viewer connected [browser]")
-						w.Write(term_html())
-					}
+					output = newShaper(io.MultiWriter(session.Viewers, session.CopilotBuffer), session.Screen, bytesPerSecond)
+				}
+				err = relayFrames(countingWriter{output, "output"}, pilot)
+				output.Close()
+				duration := time.Since(session.Started)
+				reason, clean := disconnectReason(err), cleanClose(err)
+				if closed := pilot.ClosedWith(); closed != "" {
+					reason, clean = closed, true
+				}
+				if clean {
+					l.Info("disconnected", "duration", duration, "reason", reason)
+				} else {
+					l.Warn("disconnected", "duration", duration, "reason", reason)
 				}
+				metrics.SessionDuration.Observe(duration.Seconds())
+				if sessions.End(session) {
+					cluster.Directory.Unregister(sessionName, cluster.Self)
+				}
+				close(session.EOF)
+				pilot.Close()
+				return
 			}
+			session.ServeHTTP(w, r)
 		}
 	})
-	port := ":" + os.Getenv("PORT")
-	log.Println("Termshare server started on " + port + "...")
-	log.Fatal(http.ListenAndServe(port, nil))
+	if c.SSH.Listen != "" {
+		go serveSSH(c, &sessions, joinRate)
+	}
+	if c.Telnet.Listen != "" {
+		go serveTelnet(c, &sessions, joinRate)
+	}
+	serverLog.Info("server started", "listen", c.Listen, "version", VERSION)
+	if c.TLS.Cert != "" {
+		err = http.ListenAndServeTLS(c.Listen, c.TLS.Cert, c.TLS.Key, nil)
+	} else {
+		err = http.ListenAndServe(c.Listen, nil)
+	}
+	serverLog.Error("server stopped", "error", err)
+	os.Exit(1)
 }
 
 func main() {
@@ -429,9 +1055,16 @@ func main() {
 	if *daemon {
 		startDaemon()
 	} else {
-		if flag.Arg(0) == "" {
+		switch flag.Arg(0) {
+		case "":
 			createSession()
-		} else {
+		case "browse":
+			browseSessions()
+		case "upgrade":
+			upgrade()
+		case "transcript":
+			transcribe(flag.Arg(1))
+		default:
 			joinSession(flag.Arg(0))
 		}
 	}
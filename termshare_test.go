@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type panickyWriter struct{}
+
+func (panickyWriter) Write(p []byte) (int, error) {
+	var lines [][]cell
+	return len(lines[len(p)]), nil
+}
+
+// A viewer that panics is dropped, and the others still get the output.
+func TestViewersDropPanickingViewer(t *testing.T) {
+	v := &viewers{v: make(map[io.Writer]string)}
+	var good bytes.Buffer
+	v.Add(panickyWriter{}, transportHttp)
+	v.Add(&good, transportHttp)
+	v.Write([]byte("hello"))
+	if v.Len() != 1 {
+		t.Errorf("%d viewers left, want 1", v.Len())
+	}
+	if good.String() != "hello" {
+		t.Errorf("viewer got %q", good.String())
+	}
+}
+
+// Pilots asking for the same name at once get one session between them,
+// and it's counted against its owner from the start.
+func TestSessionsCreateRace(t *testing.T) {
+	s := &sessions{s: make(map[string]*session)}
+	const pilots = 50
+	created := make(chan *session, pilots)
+	for i := 0; i < pilots; i++ {
+		go s.Owned("192.0.2.1")
+		go func() {
+			sess, err := s.Create("brave-otter", "192.0.2.1", false, false, false)
+			if err != nil && err != errSessionTaken {
+				t.Error(err)
+			}
+			created <- sess
+		}()
+	}
+	var won []*session
+	for i := 0; i < pilots; i++ {
+		if sess := <-created; sess != nil {
+			won = append(won, sess)
+		}
+	}
+	if len(won) != 1 {
+		t.Fatalf("%d pilots got the name, want 1", len(won))
+	}
+	if got, _ := s.Get("brave-otter"); got != won[0] {
+		t.Error("the session under the name isn't the one that was created")
+	}
+	if n := s.Owned("192.0.2.1"); n != 1 {
+		t.Errorf("owner has %d sessions, want 1", n)
+	}
+}
+
+func TestBufferWriterKeepsLatest(t *testing.T) {
+	bw := &bufferWriter{max: 10}
+	for _, msg := range []string{"aaaa", "bbbb", "cccc", "dd"} {
+		bw.Write([]byte(msg))
+	}
+	if bw.Len() != 10 {
+		t.Errorf("holding %d bytes, want 10", bw.Len())
+	}
+	var out bytes.Buffer
+	bw.w = &out
+	bw.Write([]byte("e"))
+	if out.String() != "bbbbccccdde" {
+		t.Errorf("caught up with %q", out.String())
+	}
+
+	none := &bufferWriter{}
+	none.Write([]byte("nobody is listening"))
+	if none.Len() != 0 {
+		t.Errorf("holding %d bytes without a max", none.Len())
+	}
+}
+
+// A viewer hanging up is noticed even while the session is quiet.
+func TestStreamViewersLeaving(t *testing.T) {
+	session := newSession("quiet-heron", false, false, false)
+	serve := map[string]func(w *httptest.ResponseRecorder, r *http.Request){
+		formatRaw: func(w *httptest.ResponseRecorder, r *http.Request) {
+			session.serveStream(w, r, formatRaw, serverLog)
+		},
+		formatEvents: func(w *httptest.ResponseRecorder, r *http.Request) {
+			session.serveEvents(w, r, handshake{}, serverLog)
+		},
+	}
+	for format, serve := range serve {
+		ctx, hangUp := context.WithCancel(context.Background())
+		r := httptest.NewRequest("GET", "/quiet-heron", nil).WithContext(ctx)
+		done := make(chan struct{})
+		go func() {
+			serve(httptest.NewRecorder(), r)
+			close(done)
+		}()
+		for session.Viewers.Len() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		hangUp()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s viewer still being served after hanging up", format)
+		}
+		if n := session.Viewers.Len(); n != 0 {
+			t.Errorf("%s viewer left behind, %d viewers", format, n)
+		}
+	}
+}
+
+// A session that ends early mustn't expire later on and take a new session
+// by the same name with it.
+func TestSessionNameReusedAfterEarlyEnd(t *testing.T) {
+	s := sessions{s: make(map[string]*session)}
+	expired := make(chan string, 3)
+	first, _ := s.Create("brave-otter", "192.0.2.1", false, false, false)
+	s.Expire(first, 10*time.Millisecond, func() { expired <- "first" })
+	if !s.End(first) {
+		t.Fatal("first session wasn't there to end")
+	}
+	// Gone without its timer stopped, as if it ended while expiring.
+	second, _ := s.Create("brave-otter", "192.0.2.1", false, false, false)
+	s.Expire(second, 10*time.Millisecond, func() { expired <- "second" })
+	s.Delete(second)
+	third, err := s.Create("brave-otter", "192.0.2.1", false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Expire(third, time.Hour, func() { expired <- "third" })
+	time.Sleep(50 * time.Millisecond)
+	if sess, _ := s.Get("brave-otter"); sess != third {
+		t.Error("the session using the name now is gone")
+	}
+	select {
+	case which := <-expired:
+		t.Errorf("%s session expired after it had ended", which)
+	default:
+	}
+	if s.End(first) || s.Delete(second) {
+		t.Error("ended a session that had already ended")
+	}
+}
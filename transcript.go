@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// transcriber turns terminal output into a plain text transcript. The
+// output goes through a screen, and a line makes it into the transcript
+// once it's finished: when the cursor leaves it with a line feed or it
+// scrolls off the top. Whatever gets redrawn in between, progress bars,
+// line editing and the like, never shows up, and nothing does while a full
+// screen program has the alternate screen.
+type transcriber struct {
+	screen *screen
+	w      io.Writer
+	// done is how many rows from the top have made it into the transcript.
+	done int
+	err  error
+}
+
+func newTranscriber(w io.Writer, cols, rows int) *transcriber {
+	t := &transcriber{screen: newScreen(cols, rows), w: w}
+	t.screen.Scrolled = t.scrolled
+	t.screen.Committed = t.committed
+	return t
+}
+
+func (t *transcriber) line(cells []cell) {
+	if t.err == nil {
+		_, t.err = io.WriteString(t.w, lineText(cells)+"\n")
+	}
+}
+
+func (t *transcriber) committed(y int, wrapped bool) {
+	// The cursor going back up, after a clear for one, means those rows
+	// have new text coming.
+	if y < t.done {
+		t.done = y
+	}
+	for ; t.done < y; t.done++ {
+		t.line(t.screen.lines[t.done])
+	}
+	// A line that wrapped carries on in the next row, so it's written
+	// without its end.
+	if wrapped {
+		if t.err == nil {
+			var buf bytes.Buffer
+			for _, c := range t.screen.lines[y] {
+				buf.WriteRune(c.r)
+			}
+			_, t.err = t.w.Write(buf.Bytes())
+		}
+	} else {
+		t.line(t.screen.lines[y])
+	}
+	t.done = y + 1
+}
+
+func (t *transcriber) scrolled(line []cell) {
+	if t.done > 0 {
+		t.done--
+	} else {
+		t.line(line)
+	}
+}
+
+func (t *transcriber) Write(p []byte) (int, error) {
+	t.screen.Write(p)
+	if t.err != nil {
+		return 0, t.err
+	}
+	return len(p), nil
+}
+
+func (t *transcriber) WriteControl(msg controlMessage) error {
+	if msg.Type == "resize" {
+		t.screen.Resize(msg.Cols, msg.Rows)
+	}
+	return t.err
+}
+
+// Flush adds the rows up to the cursor that haven't made it into the
+// transcript yet, for when the output ends.
+func (t *transcriber) Flush() error {
+	s := t.screen
+	s.Lock()
+	defer s.Unlock()
+	last := s.y
+	if lineText(s.lines[last]) == "" {
+		last--
+	}
+	if t.done <= last {
+		t.committed(last, false)
+	}
+	return t.err
+}
+
+// transcribe prints the transcript of a recorded session, either the raw
+// terminal output, like script(1) saves, or an asciicast v2 recording, like
+// ?format=asciicast gives.
+func transcribe(path string) {
+	in := os.Stdin
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fatal(exitNoInput, "unable to open recording:", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	r := bufio.NewReader(in)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var header struct {
+		Version int `json:"version"`
+		Width   int `json:"width"`
+		Height  int `json:"height"`
+	}
+	if start, _ := r.Peek(1); string(start) == "{" {
+		first, _ := r.ReadBytes('\n')
+		if json.Unmarshal(first, &header) != nil || header.Version != 2 {
+			header.Version = 0
+			r = bufio.NewReader(io.MultiReader(bytes.NewReader(first), r))
+		}
+	}
+	if header.Version != 2 {
+		t := newTranscriber(out, 80, 24)
+		if _, err := io.Copy(t, r); err != nil {
+			fatal(1, "unable to read recording:", err)
+		}
+		t.Flush()
+		return
+	}
+
+	t := newTranscriber(out, header.Width, header.Height)
+	for {
+		line, err := r.ReadBytes('\n')
+		var event []interface{}
+		if json.Unmarshal(line, &event) == nil && len(event) == 3 {
+			code, _ := event[1].(string)
+			data, _ := event[2].(string)
+			switch code {
+			case "o":
+				t.Write([]byte(data))
+			case "r":
+				var cols, rows int
+				if _, err := fmt.Sscanf(data, "%dx%d", &cols, &rows); err == nil {
+					t.screen.Resize(cols, rows)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatal(1, "unable to read recording:", err)
+		}
+	}
+	t.Flush()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// releaseOS and releaseArch name the platform the way release tarballs do,
+// which is how uname -s and uname -m would.
+func releaseOS() string {
+	return strings.ToUpper(runtime.GOOS[:1]) + runtime.GOOS[1:]
+}
+
+func releaseArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	case "arm":
+		return "armv7"
+	}
+	return runtime.GOARCH
+}
+
+func fetch(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	body, err := readResponse(resp)
+	return []byte(body), err
+}
+
+// verifyChecksum checks data against a checksum file in the format written
+// by shasum -a 256.
+func verifyChecksum(data, checksum []byte) error {
+	fields := strings.Fields(string(checksum))
+	if len(fields) == 0 {
+		return errors.New("empty checksum")
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+func extractBinary(tarball []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, errors.New("no termshare binary in release")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Base(header.Name) == "termshare" {
+			return ioutil.ReadAll(archive)
+		}
+	}
+}
+
+// replaceExecutable writes the new binary next to the old one and renames it
+// into place, so the swap is atomic and a failed upgrade leaves the old
+// binary alone.
+func replaceExecutable(path string, binary []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".termshare-upgrade")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// compareVersions compares release versions like v0.2.0 part by part,
+// returning -1, 0 or 1 as a is older than, the same as or newer than b.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = leadingNumber(as[i])
+		}
+		if i < len(bs) {
+			y = leadingNumber(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func leadingNumber(s string) (n int) {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			break
+		}
+		n = n*10 + int(c-'0')
+	}
+	return
+}
+
+// upgradeError is a failed upgrade and the exit code it calls for.
+type upgradeError struct {
+	code int
+	what string
+	err  error
+}
+
+func (e *upgradeError) Error() string {
+	return e.what + " " + e.err.Error()
+}
+
+// installRelease replaces the binary at path with the release the server
+// at base is on, and returns its version. An older release than this one
+// is turned down, so a server that's behind can't downgrade clients.
+func installRelease(base, path string) (string, error) {
+	latest, err := fetch(base + "/version")
+	if err != nil {
+		return "", &upgradeError{exitUnavailable, "unable to check version:", err}
+	}
+	version := strings.TrimSpace(string(latest))
+	switch compareVersions(version, VERSION) {
+	case 0:
+		return VERSION, nil
+	case -1:
+		return "", &upgradeError{1, "refusing to upgrade:",
+			errors.New("the server is on " + version + ", which is older than " + VERSION)}
+	}
+	fmt.Println("Upgrading termshare " + VERSION + " to " + version + "...")
+	download := base + "/download/" + releaseOS() + "/" + releaseArch()
+	tarball, err := fetch(download)
+	if err != nil {
+		return "", &upgradeError{exitUnavailable, "unable to download release:", err}
+	}
+	checksum, err := fetch(download + ".sha256")
+	if err != nil {
+		return "", &upgradeError{exitUnavailable, "unable to download release checksum:", err}
+	}
+	if err := verifyChecksum(tarball, checksum); err != nil {
+		return "", &upgradeError{1, "refusing to upgrade:", err}
+	}
+	binary, err := extractBinary(tarball)
+	if err != nil {
+		return "", &upgradeError{1, "unable to unpack release:", err}
+	}
+	if err := replaceExecutable(path, binary); err != nil {
+		return "", &upgradeError{1, "unable to replace " + path + ":", err}
+	}
+	return version, nil
+}
+
+// upgrade replaces the running binary with the release the server is on.
+func upgrade() {
+	path, err := os.Executable()
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		fatal(1, "unable to find termshare binary:", err)
+	}
+	version, err := installRelease(baseUrl("http"), path)
+	if e, ok := err.(*upgradeError); ok {
+		fatal(e.code, e.what, e.err)
+	}
+	if version == VERSION {
+		fmt.Println("termshare " + VERSION + " is up to date")
+		return
+	}
+	fmt.Println("Upgraded to " + version)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func releaseTarball(t *testing.T, binary string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	archive.WriteHeader(&tar.Header{Name: "termshare", Mode: 0755, Size: int64(len(binary))})
+	archive.Write([]byte(binary))
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+// releaseServer stands in for a termshare server on version, serving
+// tarball for this platform with checksum. A nil tarball is a 404.
+func releaseServer(version string, tarball []byte, checksum string) *httptest.Server {
+	download := "/download/" + releaseOS() + "/" + releaseArch()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/version":
+			w.Write([]byte(version + "\n"))
+		case tarball != nil && r.URL.Path == download:
+			w.Write(tarball)
+		case tarball != nil && r.URL.Path == download+".sha256":
+			w.Write([]byte(checksum + "  termshare.tgz\n"))
+		default:
+			writeError(w, http.StatusNotFound, errNotFound, "no release")
+		}
+	}))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func installed(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "termshare")
+	if err := ioutil.WriteFile(path, []byte("old binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func binaryAt(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInstallRelease(t *testing.T) {
+	tarball := releaseTarball(t, "new binary")
+	srv := releaseServer("v9.0.0", tarball, sha256Hex(tarball))
+	defer srv.Close()
+	path := installed(t)
+	version, err := installRelease(srv.URL, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "v9.0.0" {
+		t.Errorf("installed %q, want v9.0.0", version)
+	}
+	if got := binaryAt(t, path); got != "new binary" {
+		t.Errorf("binary is %q after upgrading", got)
+	}
+}
+
+func TestInstallReleaseFails(t *testing.T) {
+	tarball := releaseTarball(t, "new binary")
+	tests := []struct {
+		name    string
+		srv     *httptest.Server
+		message string
+	}{
+		{"checksum mismatch", releaseServer("v9.0.0", tarball, sha256Hex([]byte("something else"))), "checksum mismatch"},
+		{"missing release", releaseServer("v9.0.0", nil, ""), "unable to download release"},
+		{"older release", releaseServer("v0.0.1", tarball, sha256Hex(tarball)), "older than " + VERSION},
+	}
+	for _, test := range tests {
+		path := installed(t)
+		_, err := installRelease(test.srv.URL, path)
+		test.srv.Close()
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: error %v, want one saying %q", test.name, err, test.message)
+		}
+		if got := binaryAt(t, path); got != "old binary" {
+			t.Errorf("%s: binary is %q, want it left alone", test.name, got)
+		}
+	}
+}
+
+// The new binary is renamed over the old one, so there's never a moment
+// without a working binary at path, and nothing is left behind.
+func TestReplaceExecutable(t *testing.T) {
+	path := installed(t)
+	if err := replaceExecutable(path, []byte("new binary")); err != nil {
+		t.Fatal(err)
+	}
+	if got := binaryAt(t, path); got != "new binary" {
+		t.Errorf("binary is %q after replacing it", got)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("binary has mode %v, want it executable", info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("%d files next to the binary, want just it", len(files))
+	}
+}
+
+func TestInstallReleaseUpToDate(t *testing.T) {
+	srv := releaseServer(VERSION, nil, "")
+	defer srv.Close()
+	path := installed(t)
+	if version, err := installRelease(srv.URL, path); err != nil || version != VERSION {
+		t.Errorf("got %q, %v, want %s", version, err, VERSION)
+	}
+	if got := binaryAt(t, path); got != "old binary" {
+		t.Errorf("binary is %q, want it left alone", got)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v0.2.0", "v0.2.0", 0},
+		{"v0.2.0", "v0.10.0", -1},
+		{"v1.0.0", "v0.9.9", 1},
+		{"v0.2", "v0.2.1", -1},
+		{"v0.3.0-rc1", "v0.2.0", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
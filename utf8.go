@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// Older clients get terminal data in websocket text messages, which must
+// be valid UTF-8 or the browser drops the connection. A pty doesn't care
+// about runes, so its reads can end halfway through one and programs can
+// print bytes that aren't UTF-8 at all. textChunker holds an unfinished
+// rune back until the rest of it arrives and replaces anything invalid
+// with U+FFFD.
+type textChunker struct {
+	partial []byte
+}
+
+func (tc *textChunker) chunk(p []byte) []byte {
+	data := append(tc.partial, p...)
+	tc.partial = nil
+	if cut := unfinishedRune(data); cut < len(data) {
+		tc.partial = append([]byte(nil), data[cut:]...)
+		data = data[:cut]
+	}
+	return bytes.ToValidUTF8(data, []byte("\uFFFD"))
+}
+
+// unfinishedRune finds where a rune that could still be completed by what
+// comes next starts at the end of data, or returns len(data).
+func unfinishedRune(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var utf8Inputs = []string{
+	"plain ascii",
+	"héllo wörld",
+	"日本語のテキスト",
+	"emoji 😀👍 and more",
+	"\U0010FFFF at the top",
+	"ends mid rune \xe2\x82",
+	"ends mid emoji \xf0\x9f\x98",
+	"a\xe2\x82b truncated in the middle",
+	"\xff\xfe bytes that are never UTF-8",
+	"\x80\x80 lone continuations",
+	"\xc0\xaf overlong",
+	"\xed\xa0\x80 surrogate",
+	"\xf4\x90\x80\x80 past the top",
+	"€\xe2€\xe2\x82€",
+}
+
+// validRunes is the text of s with anything that isn't valid UTF-8 left
+// out, and the replacement character too.
+func validRunes(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r != utf8.RuneError {
+			b.WriteRune(r)
+		}
+		s = s[size:]
+	}
+	return b.String()
+}
+
+// chunkAll feeds the pieces through a textChunker, checking every message
+// is valid UTF-8, and returns the messages joined with whatever is still
+// held back.
+func chunkAll(t *testing.T, input string, pieces []string) string {
+	var tc textChunker
+	var out strings.Builder
+	for _, piece := range pieces {
+		msg := tc.chunk([]byte(piece))
+		if !utf8.Valid(msg) {
+			t.Fatalf("%q split as %q: message %q isn't valid UTF-8", input, pieces, msg)
+		}
+		out.Write(msg)
+	}
+	return out.String() + string(tc.partial)
+}
+
+func TestTextChunkerSplits(t *testing.T) {
+	for _, input := range utf8Inputs {
+		var splits [][]string
+		for i := 0; i <= len(input); i++ {
+			splits = append(splits, []string{input[:i], input[i:]})
+			for j := i; j <= len(input); j++ {
+				splits = append(splits, []string{input[:i], input[i:j], input[j:]})
+			}
+		}
+		for _, pieces := range splits {
+			got := chunkAll(t, input, pieces)
+			if utf8.ValidString(input) {
+				if got != input {
+					t.Errorf("%q split as %q came out as %q", input, pieces, got)
+				}
+				continue
+			}
+			if validRunes(got) != validRunes(input) {
+				t.Errorf("%q split as %q came out as %q, losing text", input, pieces, got)
+			}
+		}
+	}
+}
+
+// One byte at a time is the worst a pty can do.
+func TestTextChunkerByteAtATime(t *testing.T) {
+	for _, input := range utf8Inputs {
+		var pieces []string
+		for i := 0; i < len(input); i++ {
+			pieces = append(pieces, input[i:i+1])
+		}
+		if got := chunkAll(t, input, pieces); validRunes(got) != validRunes(input) {
+			t.Errorf("%q byte at a time came out as %q", input, got)
+		}
+	}
+}